@@ -0,0 +1,29 @@
+// Compares sequential and parallel chapter conversion on a 100-chapter book.
+// Run with `cargo bench`.
+use cipher::{convert_chapters_with, Options};
+use std::time::{Duration, Instant};
+
+const BOOK: &str = "testdata/many-chapters.epub";
+const RUNS: u32 = 10;
+
+fn time(options: &Options) -> Duration {
+    convert_chapters_with(BOOK, options).expect("warm-up conversion failed");
+    let start = Instant::now();
+    for _ in 0..RUNS {
+        convert_chapters_with(BOOK, options).expect("conversion failed");
+    }
+    start.elapsed() / RUNS
+}
+
+fn main() {
+    let parallel = Options::default();
+    let sequential = Options {
+        jobs: 1,
+        ..parallel.clone()
+    };
+    let sequential_time = time(&sequential);
+    let parallel_time = time(&parallel);
+    println!("sequential (1 job):  {:>10.2?}", sequential_time);
+    println!("parallel ({} jobs): {:>10.2?}", parallel.jobs, parallel_time);
+    println!("speedup: {:.2}x", sequential_time.as_secs_f64() / parallel_time.as_secs_f64());
+}
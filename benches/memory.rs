@@ -0,0 +1,77 @@
+// Measures the memory used converting a book with one 3 MB chapter, counting
+// allocations with a wrapping global allocator. Run with `cargo bench --bench
+// memory`.
+use cipher::{convert_chapters_with, convert_file_with, Options};
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+const BOOK: &str = "testdata/large-chapter.epub";
+const CHAPTER_BYTES: usize = 3_138_337;
+
+struct Counting;
+
+static ALLOCATIONS: AtomicUsize = AtomicUsize::new(0);
+static ALLOCATED: AtomicUsize = AtomicUsize::new(0);
+static LIVE: AtomicUsize = AtomicUsize::new(0);
+static PEAK: AtomicUsize = AtomicUsize::new(0);
+
+unsafe impl GlobalAlloc for Counting {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        let ptr = System.alloc(layout);
+        if !ptr.is_null() {
+            ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+            ALLOCATED.fetch_add(layout.size(), Ordering::Relaxed);
+            let live = LIVE.fetch_add(layout.size(), Ordering::Relaxed) + layout.size();
+            PEAK.fetch_max(live, Ordering::Relaxed);
+        }
+        ptr
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        System.dealloc(ptr, layout);
+        LIVE.fetch_sub(layout.size(), Ordering::Relaxed);
+    }
+}
+
+#[global_allocator]
+static GLOBAL: Counting = Counting;
+
+// Runs `f` and prints how many allocations it made, how many bytes they came
+// to, and the most that was live at once above what was live before.
+fn measure(name: &str, f: impl FnOnce()) {
+    let live = LIVE.load(Ordering::Relaxed);
+    PEAK.store(live, Ordering::Relaxed);
+    let allocations = ALLOCATIONS.load(Ordering::Relaxed);
+    let allocated = ALLOCATED.load(Ordering::Relaxed);
+    f();
+    let peak = PEAK.load(Ordering::Relaxed) - live;
+    println!(
+        "{:<24} {:>9} allocations {:>9.1} MiB allocated {:>7.1} MiB peak ({:.1}x the chapter)",
+        name,
+        ALLOCATIONS.load(Ordering::Relaxed) - allocations,
+        (ALLOCATED.load(Ordering::Relaxed) - allocated) as f64 / (1024.0 * 1024.0),
+        peak as f64 / (1024.0 * 1024.0),
+        peak as f64 / CHAPTER_BYTES as f64,
+    );
+}
+
+fn main() {
+    // One job, so that the peak is that of converting one chapter at a time.
+    let options = Options {
+        jobs: 1,
+        ..Options::default()
+    };
+    measure("whole book", || {
+        convert_file_with(BOOK, &options).expect("conversion failed");
+    });
+    measure("chapters", || {
+        convert_chapters_with(BOOK, &options).expect("conversion failed");
+    });
+    let limited = Options {
+        max_chapter_size: Some(1024 * 1024),
+        ..options
+    };
+    measure("--max-chapter-size 1024", || {
+        convert_chapters_with(BOOK, &limited).expect_err("the chapter is over the limit");
+    });
+}
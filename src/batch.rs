@@ -0,0 +1,88 @@
+use anyhow::{Context, Result};
+use std::collections::HashMap;
+use std::error::Error;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+// Returned by a batch conversion when some books failed; the others were
+// still converted. Use `downcast_ref::<BatchError>()` to get at the list.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BatchError {
+    /// Each failed book and the reason it failed.
+    pub failures: Vec<(PathBuf, String)>,
+    /// The failed books that are DRM-protected, which are in `failures` too.
+    pub drm_protected: Vec<PathBuf>,
+    /// Number of books in the batch.
+    pub total: usize,
+}
+
+impl fmt::Display for BatchError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} of {} books failed to convert:", self.failures.len(), self.total)?;
+        for (path, reason) in &self.failures {
+            write!(f, "\n  {}: {}", path.display(), reason)?;
+        }
+        Ok(())
+    }
+}
+
+impl Error for BatchError {}
+
+// What a batch conversion would do with one book, from `plan_books`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BookPlan {
+    pub book: PathBuf,
+    /// The markdown file the book would be written to and its size in bytes,
+    /// or why the book would fail.
+    pub output: Result<(PathBuf, usize), String>,
+}
+
+fn is_epub(path: &Path) -> bool {
+    path.extension().is_some_and(|ext| ext.eq_ignore_ascii_case("epub"))
+}
+
+// Lists the .epub files in `dir`, and in its subdirectories when
+// `recursive`, sorted by path.
+pub fn find_epubs(dir: &Path, recursive: bool) -> Result<Vec<PathBuf>> {
+    let mut books = Vec::new();
+    let mut dirs = vec![dir.to_path_buf()];
+    while let Some(dir) = dirs.pop() {
+        let entries = fs::read_dir(&dir).with_context(|| format!("Failed to read {}", dir.display()))?;
+        for entry in entries {
+            let path = entry.with_context(|| format!("Failed to read {}", dir.display()))?.path();
+            if path.is_dir() {
+                if recursive {
+                    dirs.push(path);
+                }
+            } else if is_epub(&path) {
+                books.push(path);
+            }
+        }
+    }
+    books.sort();
+    Ok(books)
+}
+
+// Pairs each book with `<stem>.md` in `dst_dir`, or next to the book when
+// there's no `dst_dir`. A book whose output was already taken by an earlier
+// one gets an error instead of overwriting it.
+pub(crate) fn outputs(books: &[PathBuf], dst_dir: Option<&Path>) -> Vec<Result<PathBuf, String>> {
+    let mut seen: HashMap<PathBuf, &Path> = HashMap::new();
+    books
+        .iter()
+        .map(|book| {
+            let dst = match dst_dir {
+                Some(dir) => dir.join(book.file_name().unwrap_or_default()).with_extension("md"),
+                None => book.with_extension("md"),
+            };
+            match seen.get(&dst) {
+                Some(first) => Err(format!("{} would overwrite the output of {}", dst.display(), first.display())),
+                None => {
+                    seen.insert(dst.clone(), book);
+                    Ok(dst)
+                }
+            }
+        })
+        .collect()
+}
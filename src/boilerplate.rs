@@ -0,0 +1,166 @@
+use crate::chapter::Chapter;
+use crate::normalize::{normalize, LineEnding};
+use std::collections::{HashMap, HashSet};
+use std::ops::Range;
+use std::path::{Path, PathBuf};
+
+// Lines this close to the start or end of a chapter can be boilerplate.
+const EDGE_LINES: usize = 3;
+// A line repeated in fewer chapters than this is never boilerplate, however
+// short the book.
+const MIN_CHAPTERS: usize = 3;
+// Blocks this close to the start of a chapter can be a repeated header.
+const LEADING_BLOCKS: usize = 4;
+
+// Removes the lines a book repeats at the start or end of most chapters, such
+// as a publisher banner or a running header, returning each line removed and
+// how many chapters it was removed from. A line counts when it is among the
+// first or last few non-blank lines of at least `threshold` (0 to 1) of the
+// chapters. Headings are kept, as links and the TOC may point at them.
+pub(crate) fn strip(chapters: &mut [Chapter], threshold: f64) -> Vec<(String, usize)> {
+    let mut counts: HashMap<String, usize> = HashMap::new();
+    for chapter in chapters.iter() {
+        let lines: Vec<&str> = chapter.markdown.lines().collect();
+        let edge: HashSet<&str> = edge_lines(&lines).into_iter().map(|i| lines[i].trim()).collect();
+        for line in edge {
+            *counts.entry(line.to_string()).or_default() += 1;
+        }
+    }
+    let needed = ((threshold * chapters.len() as f64).ceil() as usize).max(MIN_CHAPTERS);
+    let boilerplate: HashSet<String> =
+        counts.into_iter().filter(|(_, count)| *count >= needed).map(|(line, _)| line).collect();
+    if boilerplate.is_empty() {
+        return Vec::new();
+    }
+
+    let mut removed: HashMap<String, usize> = HashMap::new();
+    for chapter in chapters.iter_mut() {
+        let lines: Vec<&str> = chapter.markdown.lines().collect();
+        let drop: HashSet<usize> =
+            edge_lines(&lines).into_iter().filter(|i| boilerplate.contains(lines[*i].trim())).collect();
+        if drop.is_empty() {
+            continue;
+        }
+        for line in drop.iter().map(|i| lines[*i].trim()).collect::<HashSet<_>>() {
+            *removed.entry(line.to_string()).or_default() += 1;
+        }
+        let kept: Vec<&str> = (0..lines.len()).filter(|i| !drop.contains(i)).map(|i| lines[i]).collect();
+        chapter.markdown = normalize(&kept.join("\n"), LineEnding::Lf);
+    }
+    let mut removed: Vec<(String, usize)> = removed.into_iter().collect();
+    removed.sort();
+    removed
+}
+
+// Removes the blocks a book repeats word for word at the start of at least
+// `min` chapters, such as the book's title and author opening every chapter
+// file, from every chapter but the first, returning each block removed and
+// how many chapters it was removed from. Unlike `strip`, headings count: a
+// block is only kept when it matches the chapter's own title in the TOC.
+pub(crate) fn dedupe(
+    chapters: &mut [Chapter],
+    titles: &HashMap<PathBuf, String>,
+    root_base: &Path,
+    min: usize,
+) -> Vec<(String, usize)> {
+    let mut counts: HashMap<String, usize> = HashMap::new();
+    for chapter in chapters.iter() {
+        let lines: Vec<&str> = chapter.markdown.lines().collect();
+        let leading: HashSet<String> = leading_blocks(&lines).into_iter().map(|block| text(&lines[block])).collect();
+        for block in leading {
+            *counts.entry(block).or_default() += 1;
+        }
+    }
+    let repeated: HashSet<String> =
+        counts.into_iter().filter(|(_, count)| *count >= min).map(|(block, _)| block).collect();
+    if repeated.is_empty() {
+        return Vec::new();
+    }
+
+    let mut seen = HashSet::new();
+    let mut removed: HashMap<String, usize> = HashMap::new();
+    for chapter in chapters.iter_mut() {
+        let title = titles.get(&root_base.join(&chapter.href)).map(|title| plain(title));
+        let lines: Vec<&str> = chapter.markdown.lines().collect();
+        let mut drop = HashSet::new();
+        for block in leading_blocks(&lines) {
+            let text = text(&lines[block.clone()]);
+            if !repeated.contains(&text) {
+                continue;
+            }
+            // The first copy stays, whether or not it's the chapter's title.
+            if seen.insert(text.clone()) || title.as_deref() == Some(plain(&text).as_str()) {
+                continue;
+            }
+            drop.extend(block);
+            *removed.entry(text).or_default() += 1;
+        }
+        if drop.is_empty() {
+            continue;
+        }
+        let kept: Vec<&str> = (0..lines.len()).filter(|i| !drop.contains(i)).map(|i| lines[i]).collect();
+        chapter.markdown = normalize(&kept.join("\n"), LineEnding::Lf);
+    }
+    let mut removed: Vec<(String, usize)> = removed.into_iter().collect();
+    removed.sort();
+    removed
+}
+
+// The lines of each of the first few blocks of a chapter, the runs of lines
+// between blank ones. A code fence ends them.
+fn leading_blocks(lines: &[&str]) -> Vec<Range<usize>> {
+    let mut blocks = Vec::new();
+    let mut start = None;
+    for (i, line) in lines.iter().enumerate() {
+        let line = line.trim();
+        if line.starts_with("```") || line.starts_with("~~~") {
+            return blocks;
+        }
+        match (line.is_empty(), start) {
+            (true, Some(first)) => {
+                blocks.push(first..i);
+                start = None;
+            }
+            (false, None) => start = Some(i),
+            _ => {}
+        }
+        if blocks.len() == LEADING_BLOCKS {
+            return blocks;
+        }
+    }
+    blocks.extend(start.map(|first| first..lines.len()));
+    blocks
+}
+
+// A block with its whitespace normalized, for comparing with the others.
+fn text(lines: &[&str]) -> String {
+    lines.iter().flat_map(|line| line.split_whitespace()).collect::<Vec<_>>().join(" ")
+}
+
+// The words of a heading or title, without the markdown around them, for
+// comparing one with the other.
+fn plain(text: &str) -> String {
+    let text = match text.rfind(" {#") {
+        Some(start) if text.ends_with('}') => &text[..start],
+        _ => text,
+    };
+    let words = text.split_whitespace().filter(|word| !word.chars().all(|c| matches!(c, '#' | '=' | '-')));
+    let words: Vec<String> = words.map(|word| word.replace(['*', '_', '\\'], "").to_lowercase()).collect();
+    words.join(" ")
+}
+
+// The positions of the first and last few non-blank lines of a chapter that
+// could be boilerplate. Headings can't be, and code fences end the search.
+fn edge_lines(lines: &[&str]) -> Vec<usize> {
+    let content: Vec<usize> = (0..lines.len()).filter(|i| !lines[*i].trim().is_empty()).collect();
+    let fence = |i: &&usize| {
+        let line = lines[**i].trim_start();
+        line.starts_with("```") || line.starts_with("~~~")
+    };
+    let first = content.iter().take(EDGE_LINES).take_while(|i| !fence(i));
+    let last = content.iter().rev().take(EDGE_LINES).take_while(|i| !fence(i));
+    let mut edge: Vec<usize> = first.chain(last).copied().filter(|i| !lines[*i].trim_start().starts_with('#')).collect();
+    edge.sort();
+    edge.dedup();
+    edge
+}
@@ -0,0 +1,266 @@
+use crate::Options;
+use anyhow::{Context, Result};
+use std::env;
+use std::fs;
+use std::io::{self, ErrorKind, Read};
+use std::path::{Path, PathBuf};
+use std::process;
+
+// Converted books kept by --cache under the user's cache directory, one
+// markdown file per book and set of options. Entries are only ever replaced
+// whole, so a run that is interrupted while writing one leaves the old entry
+// or none, never half of one.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Cache {
+    dir: PathBuf,
+}
+
+// How many entries the cache holds and their total size, for --cache-info.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct CacheInfo {
+    pub entries: usize,
+    pub bytes: u64,
+}
+
+const EXTENSION: &str = "md";
+
+impl Cache {
+    pub fn new(dir: &Path) -> Cache {
+        Cache { dir: dir.to_path_buf() }
+    }
+
+    // The cache in the user's cache directory, see `default_dir`.
+    pub fn open_default() -> Option<Cache> {
+        Some(Cache::new(&default_dir()?))
+    }
+
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    // Identifies a conversion: a SHA-256 of the EPUB, the options that shape
+    // the markdown and the version of cipher, so that an upgrade doesn't serve
+    // markdown converted the old way. Options that don't change the output,
+    // such as the number of jobs, are left out.
+    pub fn key(epub: &[u8], options: &Options) -> String {
+        options_key(&sha256(epub), options)
+    }
+
+    // Like `key`, hashing the EPUB as it's read rather than holding all of it,
+    // for books on disk that may be hundreds of megabytes.
+    pub fn key_from_reader<R: Read>(mut epub: R, options: &Options) -> io::Result<String> {
+        let mut hasher = Sha256::new();
+        let mut buf = vec![0; 64 * 1024];
+        loop {
+            match epub.read(&mut buf) {
+                Ok(0) => break,
+                Ok(n) => hasher.update(&buf[..n]),
+                Err(e) if e.kind() == ErrorKind::Interrupted => continue,
+                Err(e) => return Err(e),
+            }
+        }
+        Ok(options_key(&hasher.finish(), options))
+    }
+
+    fn entry(&self, key: &str) -> PathBuf {
+        self.dir.join(key).with_extension(EXTENSION)
+    }
+
+    // The markdown cached under `key`, if any. An entry that can't be read is
+    // treated as missing.
+    pub fn get(&self, key: &str) -> Option<String> {
+        fs::read_to_string(self.entry(key)).ok()
+    }
+
+    // Stores the markdown under `key` by writing a temporary file next to the
+    // entry and renaming it into place.
+    pub fn put(&self, key: &str, markdown: &str) -> Result<()> {
+        fs::create_dir_all(&self.dir).with_context(|| format!("Failed to create {}", self.dir.display()))?;
+        let entry = self.entry(key);
+        // The process id keeps two runs caching the same book from sharing a
+        // temporary file.
+        let tmp = self.dir.join(format!("{}.{}.tmp", key, process::id()));
+        if let Err(e) = fs::write(&tmp, markdown) {
+            let _ = fs::remove_file(&tmp);
+            return Err(e).with_context(|| format!("Failed to write {}", tmp.display()));
+        }
+        fs::rename(&tmp, &entry).with_context(|| format!("Failed to write {}", entry.display()))
+    }
+
+    // Removes every entry, and temporary files left by interrupted runs,
+    // returning how many entries there were. A cache that doesn't exist yet is
+    // already clear.
+    pub fn clear(&self) -> Result<usize> {
+        let mut removed = 0;
+        for path in self.files()? {
+            fs::remove_file(&path).with_context(|| format!("Failed to remove {}", path.display()))?;
+            if path.extension().is_some_and(|ext| ext == EXTENSION) {
+                removed += 1;
+            }
+        }
+        Ok(removed)
+    }
+
+    pub fn info(&self) -> Result<CacheInfo> {
+        let mut info = CacheInfo::default();
+        for path in self.files()?.iter().filter(|path| path.extension().is_some_and(|ext| ext == EXTENSION)) {
+            info.entries += 1;
+            info.bytes += fs::metadata(path).map(|metadata| metadata.len()).unwrap_or(0);
+        }
+        Ok(info)
+    }
+
+    // The entries and temporary files in the cache directory. Anything else
+    // that ends up there is left alone.
+    fn files(&self) -> Result<Vec<PathBuf>> {
+        let entries = match fs::read_dir(&self.dir) {
+            Ok(entries) => entries,
+            Err(e) if e.kind() == ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(e) => return Err(e).with_context(|| format!("Failed to read {}", self.dir.display())),
+        };
+        let mut files = Vec::new();
+        for entry in entries {
+            let path = entry.with_context(|| format!("Failed to read {}", self.dir.display()))?.path();
+            if path.is_file() && path.extension().is_some_and(|ext| ext == EXTENSION || ext == "tmp") {
+                files.push(path);
+            }
+        }
+        files.sort();
+        Ok(files)
+    }
+}
+
+// cipher in the user's cache directory: $XDG_CACHE_HOME or ~/.cache on Unix,
+// ~/Library/Caches on macOS and %LocalAppData% on Windows. None when the
+// directory can't be determined.
+pub fn default_dir() -> Option<PathBuf> {
+    let var = |name: &str| env::var_os(name).filter(|value| !value.is_empty()).map(PathBuf::from);
+    let dir = if cfg!(windows) {
+        var("LOCALAPPDATA")
+    } else if cfg!(target_os = "macos") {
+        var("HOME").map(|home| home.join("Library").join("Caches"))
+    } else {
+        var("XDG_CACHE_HOME").or_else(|| var("HOME").map(|home| home.join(".cache")))
+    };
+    Some(dir?.join("cipher"))
+}
+
+fn options_key(epub_digest: &[u8; 32], options: &Options) -> String {
+    let options = Options {
+        cancel: None,
+        progress: None,
+        jobs: 1,
+        ..options.clone()
+    };
+    let input = format!("{}\0{}\0{:?}", hex(epub_digest), env!("CARGO_PKG_VERSION"), options);
+    hex(&sha256(input.as_bytes()))
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+const K: [u32; 64] = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5, 0xd807aa98,
+    0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174, 0xe49b69c1, 0xefbe4786,
+    0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da, 0x983e5152, 0xa831c66d, 0xb00327c8,
+    0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967, 0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13,
+    0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85, 0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819,
+    0xd6990624, 0xf40e3585, 0x106aa070, 0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a,
+    0x5b9cca4f, 0x682e6ff3, 0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7,
+    0xc67178f2,
+];
+
+// SHA-256 (FIPS 180-4), so that cache keys don't depend on a crate for one
+// hash.
+pub fn sha256(bytes: &[u8]) -> [u8; 32] {
+    let mut hasher = Sha256::new();
+    hasher.update(bytes);
+    hasher.finish()
+}
+
+// SHA-256 over input that arrives in pieces. Only a partial block is kept
+// between them.
+struct Sha256 {
+    h: [u32; 8],
+    pending: Vec<u8>,
+    len: u64,
+}
+
+impl Sha256 {
+    fn new() -> Sha256 {
+        Sha256 {
+            h: [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19],
+            pending: Vec::with_capacity(64),
+            len: 0,
+        }
+    }
+
+    fn update(&mut self, mut bytes: &[u8]) {
+        self.len = self.len.wrapping_add(bytes.len() as u64);
+        if !self.pending.is_empty() {
+            let take = bytes.len().min(64 - self.pending.len());
+            self.pending.extend_from_slice(&bytes[..take]);
+            bytes = &bytes[take..];
+            if self.pending.len() < 64 {
+                return;
+            }
+            compress(&mut self.h, &self.pending);
+            self.pending.clear();
+        }
+        let mut blocks = bytes.chunks_exact(64);
+        for block in blocks.by_ref() {
+            compress(&mut self.h, block);
+        }
+        self.pending.extend_from_slice(blocks.remainder());
+    }
+
+    fn finish(mut self) -> [u8; 32] {
+        let mut tail = std::mem::take(&mut self.pending);
+        tail.push(0x80);
+        while tail.len() % 64 != 56 {
+            tail.push(0);
+        }
+        tail.extend(self.len.wrapping_mul(8).to_be_bytes());
+        for block in tail.chunks(64) {
+            compress(&mut self.h, block);
+        }
+        let mut digest = [0u8; 32];
+        for (chunk, word) in digest.chunks_mut(4).zip(self.h) {
+            chunk.copy_from_slice(&word.to_be_bytes());
+        }
+        digest
+    }
+}
+
+fn compress(h: &mut [u32; 8], block: &[u8]) {
+    let mut w = [0u32; 64];
+    for (i, word) in block.chunks(4).enumerate() {
+        w[i] = u32::from_be_bytes([word[0], word[1], word[2], word[3]]);
+    }
+    for i in 16..64 {
+        let s0 = w[i - 15].rotate_right(7) ^ w[i - 15].rotate_right(18) ^ (w[i - 15] >> 3);
+        let s1 = w[i - 2].rotate_right(17) ^ w[i - 2].rotate_right(19) ^ (w[i - 2] >> 10);
+        w[i] = w[i - 16].wrapping_add(s0).wrapping_add(w[i - 7]).wrapping_add(s1);
+    }
+    let [mut a, mut b, mut c, mut d, mut e, mut f, mut g, mut hh] = *h;
+    for i in 0..64 {
+        let s1 = e.rotate_right(6) ^ e.rotate_right(11) ^ e.rotate_right(25);
+        let ch = (e & f) ^ (!e & g);
+        let t1 = hh.wrapping_add(s1).wrapping_add(ch).wrapping_add(K[i]).wrapping_add(w[i]);
+        let s0 = a.rotate_right(2) ^ a.rotate_right(13) ^ a.rotate_right(22);
+        let maj = (a & b) ^ (a & c) ^ (b & c);
+        let t2 = s0.wrapping_add(maj);
+        hh = g;
+        g = f;
+        f = e;
+        e = d.wrapping_add(t1);
+        d = c;
+        c = b;
+        b = a;
+        a = t1.wrapping_add(t2);
+    }
+    for (state, value) in h.iter_mut().zip([a, b, c, d, e, f, g, hh]) {
+        *state = state.wrapping_add(value);
+    }
+}
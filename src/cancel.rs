@@ -0,0 +1,64 @@
+use std::error::Error;
+use std::fmt;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+// A cloneable handle used to stop a conversion from another thread. The
+// conversion checks it between spine items.
+#[derive(Debug, Clone, Default)]
+pub struct CancelToken {
+    cancelled: Arc<AtomicBool>,
+    deadline: Option<Instant>,
+}
+
+impl CancelToken {
+    pub fn new() -> Self {
+        CancelToken::default()
+    }
+
+    // A token that also counts as cancelled once `timeout` has elapsed.
+    pub fn with_timeout(timeout: Duration) -> Self {
+        CancelToken {
+            cancelled: Arc::default(),
+            deadline: Some(Instant::now() + timeout),
+        }
+    }
+
+    pub fn cancel(&self) {
+        self.cancelled.store(true, Ordering::SeqCst);
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        self.check().is_err()
+    }
+
+    pub(crate) fn check(&self) -> Result<(), Cancelled> {
+        if self.cancelled.load(Ordering::SeqCst) {
+            Err(Cancelled::Cancelled)
+        } else if self.deadline.is_some_and(|deadline| Instant::now() >= deadline) {
+            Err(Cancelled::TimedOut)
+        } else {
+            Ok(())
+        }
+    }
+}
+
+// Returned (wrapped in context) when a conversion stops because its token was
+// cancelled; use `downcast_ref::<Cancelled>()` to tell it apart.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Cancelled {
+    Cancelled,
+    TimedOut,
+}
+
+impl fmt::Display for Cancelled {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Cancelled::Cancelled => f.write_str("conversion cancelled"),
+            Cancelled::TimedOut => f.write_str("conversion timed out"),
+        }
+    }
+}
+
+impl Error for Cancelled {}
@@ -0,0 +1,195 @@
+use crate::dom::{self, Node};
+use crate::markdown;
+use crate::matter::Matter;
+use epub::doc::NavPoint;
+use std::collections::{HashMap, HashSet};
+use std::error::Error;
+use std::fmt;
+use std::ops::RangeInclusive;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Chapter {
+    /// Position in the spine, counting from 1.
+    pub index: usize,
+    /// The TOC label, or failing that the chapter's first h1-h3 heading, its
+    /// HTML <title>, or the file name in `href`. See `resolve_title`.
+    pub title: String,
+    pub href: String,
+    pub markdown: String,
+}
+
+impl Chapter {
+    // The title, or for a chapter built without one the first heading in its
+    // markdown.
+    pub fn display_title(&self) -> String {
+        match self.title.is_empty() {
+            true => markdown::first_heading(&self.markdown).unwrap_or_default(),
+            false => self.title.clone(),
+        }
+    }
+}
+
+// Returned by a best-effort conversion (`Options::strict` off) when some
+// chapters failed. The rest of the book was still converted, with a
+// placeholder in place of each failed chapter; use
+// `downcast::<ChapterErrors>()` to get at the output and the failures.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ChapterErrors {
+    /// The href of each chapter that failed and why.
+    pub failures: Vec<(String, String)>,
+    /// The converted chapters, from the per-chapter conversions
+    /// (`convert_chapters_with` and friends); empty otherwise.
+    pub chapters: Vec<Chapter>,
+    /// The assembled book, from the whole-book conversions (`convert_file_with`
+    /// and friends); empty otherwise.
+    pub markdown: String,
+}
+
+impl fmt::Display for ChapterErrors {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.failures.len() {
+            1 => write!(f, "1 chapter failed to convert:")?,
+            n => write!(f, "{} chapters failed to convert:", n)?,
+        }
+        for (href, reason) in &self.failures {
+            write!(f, "\n  {}: {}", href, reason)?;
+        }
+        Ok(())
+    }
+}
+
+impl Error for ChapterErrors {}
+
+// A spine item as listed by --list-chapters.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SpineEntry {
+    /// Position in the spine, counting from 1.
+    pub index: usize,
+    pub idref: String,
+    /// The label of the first TOC entry pointing into the item, if any.
+    pub title: Option<String>,
+    /// False for items marked linear="no", which go where
+    /// `Options::nonlinear` says.
+    pub linear: bool,
+    /// Whether the item is front or back matter, see `Options::skip_front_matter`.
+    pub matter: Option<Matter>,
+}
+
+// An entry of the book's table of contents, as `Book::toc` lists it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TocEntry {
+    pub title: String,
+    /// How deeply the entry is nested, from 0 at the top level.
+    pub depth: usize,
+    /// The spine position of the item it points into, counting from 1.
+    pub index: usize,
+    /// The id it points at within the item, if any.
+    pub fragment: Option<String>,
+}
+
+// Spine positions to convert, counting from 1, parsed from a list of indices
+// and ranges such as "1,3,5-8".
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ChapterSelection(Vec<RangeInclusive<usize>>);
+
+impl FromStr for ChapterSelection {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = |part: &str| format!("invalid chapter selection {:?} (expected e.g. 1,3,5-8)", part);
+        let number = |part: &str, n: &str| match n.trim().parse::<usize>() {
+            Ok(n) if n > 0 => Ok(n),
+            _ => Err(invalid(part)),
+        };
+        let mut ranges = Vec::new();
+        for part in s.split(',') {
+            let range = match part.split_once('-') {
+                Some((start, end)) => number(part, start)?..=number(part, end)?,
+                None => {
+                    let n = number(part, part)?;
+                    n..=n
+                }
+            };
+            if range.is_empty() {
+                return Err(invalid(part));
+            }
+            ranges.push(range);
+        }
+        Ok(ChapterSelection(ranges))
+    }
+}
+
+impl ChapterSelection {
+    pub fn contains(&self, index: usize) -> bool {
+        self.0.iter().any(|range| range.contains(&index))
+    }
+
+    // The largest position selected, used to reject selections past the end.
+    pub fn max(&self) -> usize {
+        self.0.iter().map(|range| *range.end()).max().unwrap_or(0)
+    }
+}
+
+// Maps each TOC target file to a nav point label: the first one that points at
+// the file itself, or failing that the first one that points at a fragment in
+// it. Books split sections across files, so the entry for a file's own start
+// can come after entries for sections carried over from the previous file.
+pub(crate) fn toc_titles(toc: &[NavPoint]) -> HashMap<PathBuf, String> {
+    let mut titles = HashMap::new();
+    collect_toc_titles(toc, &mut titles, &mut HashSet::new());
+    titles
+}
+
+fn collect_toc_titles(points: &[NavPoint], titles: &mut HashMap<PathBuf, String>, whole: &mut HashSet<PathBuf>) {
+    for point in points {
+        let content = point.content.to_string_lossy();
+        let (file, fragment) = match content.split_once('#') {
+            Some((file, _)) => (PathBuf::from(file), true),
+            None => (PathBuf::from(content.as_ref()), false),
+        };
+        let label = point.label.split_whitespace().collect::<Vec<_>>().join(" ");
+        if !label.is_empty() {
+            if !fragment && whole.insert(file.clone()) {
+                titles.insert(file, label);
+            } else {
+                titles.entry(file).or_insert(label);
+            }
+        }
+        collect_toc_titles(&point.children, titles, whole);
+    }
+}
+
+// A chapter's title from the best source available: its TOC label, the text
+// of its first h1-h3 heading or <title> (`own`, see `html_heading`), or its
+// file name without the extension.
+pub(crate) fn resolve_title(toc: Option<&String>, own: Option<String>, href: &str) -> String {
+    toc.cloned().or(own).unwrap_or_else(|| {
+        let path = Path::new(href);
+        path.file_stem().unwrap_or(path.as_os_str()).to_string_lossy().into_owned()
+    })
+}
+
+// The text of the first h1, h2 or h3 in the chapter, if it has any text.
+pub(crate) fn html_heading(nodes: &[Node]) -> Option<String> {
+    let mut heading = None;
+    dom::walk(nodes, &mut |el| {
+        if heading.is_none() && (el.is("h1") || el.is("h2") || el.is("h3")) {
+            heading = Some(el.text()).filter(|text| !text.is_empty());
+        }
+    });
+    heading
+}
+
+pub(crate) fn html_title(html: &str) -> Option<String> {
+    let start = html.find("<title")?;
+    let open_end = start + html[start..].find('>')? + 1;
+    let close = open_end + html[open_end..].find("</title>")?;
+    let title = html[open_end..close].split_whitespace().collect::<Vec<_>>().join(" ");
+    if title.is_empty() {
+        None
+    } else {
+        Some(title)
+    }
+}
@@ -0,0 +1,135 @@
+use crate::dom::{self, Element, Node};
+
+// html2md drops the language of code blocks and can lose their whitespace.
+// Each <pre> is swapped for a placeholder paragraph before conversion and
+// put back afterwards as a fenced block, with its text exactly as it was and
+// the language named by its classes as the info string. Code in tables is
+// left to the table conversion.
+pub(crate) fn hide(nodes: &mut [Node]) -> Vec<(String, String)> {
+    let mut blocks = Vec::new();
+    hide_in(nodes, None, &mut blocks);
+    blocks
+}
+
+// `wrapper` is the language named by the parent element, which is where
+// GitHub-style markup puts it: <div class="highlight highlight-source-go">.
+fn hide_in(nodes: &mut [Node], wrapper: Option<&str>, blocks: &mut Vec<(String, String)>) {
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        if el.is("table") {
+            continue;
+        }
+        if !el.is("pre") {
+            let language = element_language(el);
+            hide_in(&mut el.children, language.as_deref(), blocks);
+            continue;
+        }
+        let placeholder = format!("CIPHERCODE{}X", blocks.len());
+        blocks.push((placeholder.clone(), fenced(el, wrapper)));
+        let mut paragraph = Element::new("p");
+        paragraph.children.push(Node::Text(placeholder));
+        *node = Node::Element(paragraph);
+    }
+}
+
+// Puts the code blocks back in place of their placeholders. A placeholder
+// that ended up in a list item or a blockquote has its block indented or
+// quoted to match.
+pub(crate) fn restore(markdown: &str, blocks: &[(String, String)]) -> String {
+    if blocks.is_empty() {
+        return markdown.to_string();
+    }
+    let mut out = Vec::new();
+    for line in markdown.split('\n') {
+        let block = blocks.iter().find_map(|(placeholder, block)| Some((line.find(placeholder.as_str())?, block)));
+        match block {
+            Some((start, block)) => {
+                // A list marker only goes on the first line; the rest line up
+                // under it.
+                let first = &line[..start];
+                let rest: String = first.chars().map(|c| if c == '>' || c.is_whitespace() { c } else { ' ' }).collect();
+                for (i, code) in block.lines().enumerate() {
+                    let prefix = if i == 0 { first } else { rest.as_str() };
+                    out.push(match code.is_empty() {
+                        true => prefix.trim_end().to_string(),
+                        false => format!("{}{}", prefix, code),
+                    });
+                }
+            }
+            None => out.push(line.to_string()),
+        }
+    }
+    out.join("\n")
+}
+
+fn fenced(pre: &Element, wrapper: Option<&str>) -> String {
+    let mut code = String::new();
+    collect_code(&pre.children, &mut code);
+    // A newline straight after <pre> isn't part of the content.
+    let code = code.strip_prefix("\r\n").or_else(|| code.strip_prefix('\n')).unwrap_or(&code);
+    let code = code.trim_end_matches(['\n', '\r']);
+    // Longer than any run of backticks in the code, so none of them closes it.
+    let longest = code.split(|c| c != '`').map(str::len).max().unwrap_or(0);
+    let fence = "`".repeat(longest.max(2) + 1);
+    let language = language(pre).or_else(|| wrapper.map(str::to_string)).unwrap_or_default();
+    format!("{}{}\n{}\n{}", fence, language, code, fence)
+}
+
+// The text of a code block with entities decoded and <br> as a line break.
+fn collect_code(nodes: &[Node], out: &mut String) {
+    for node in nodes {
+        match node {
+            Node::Text(text) => out.push_str(&dom::decode_entities(text)),
+            Node::Element(el) if el.is("br") => out.push('\n'),
+            Node::Element(el) => collect_code(&el.children, out),
+            Node::Raw(raw) => {
+                if let Some(cdata) = raw.strip_prefix("<![CDATA[").and_then(|raw| raw.strip_suffix("]]>")) {
+                    out.push_str(cdata);
+                }
+            }
+            Node::Comment(_) => {}
+        }
+    }
+}
+
+// The language of a code block, from the <pre> or the <code> directly in it:
+// language-go and lang-go (HTML5 and highlight.js), highlight-source-go
+// (GitHub), "brush: go" (SyntaxHighlighter), "sourceCode go" (pandoc), or a
+// data-lang or data-language attribute.
+fn language(pre: &Element) -> Option<String> {
+    let code = pre.children.iter().find_map(|node| match node {
+        Node::Element(el) if el.is("code") => Some(el),
+        _ => None,
+    });
+    [Some(pre), code].into_iter().flatten().find_map(element_language)
+}
+
+fn element_language(el: &Element) -> Option<String> {
+    let class = el.attr("class").unwrap_or_default();
+    let classes: Vec<&str> = class.split_whitespace().collect();
+    let language = match class.split_once("brush:") {
+        Some((_, brush)) => brush.split(|c: char| c == ';' || c.is_whitespace()).find(|s| !s.is_empty()),
+        None => None,
+    };
+    let language = language
+        .or_else(|| {
+            classes.iter().find_map(|c| {
+                ["language-", "lang-", "highlight-source-"].iter().find_map(|prefix| c.strip_prefix(prefix))
+            })
+        })
+        .or_else(|| match classes.iter().position(|c| *c == "sourceCode") {
+            Some(i) => classes.iter().skip(i + 1).find(|c| **c != "sourceCode").copied(),
+            None => None,
+        })
+        .or_else(|| el.attr("data-lang"))
+        .or_else(|| el.attr("data-language"))?;
+    // Only what an info string can hold, e.g. "c++", "objective-c", "c#".
+    let language: String = language
+        .to_lowercase()
+        .chars()
+        .filter(|c| c.is_alphanumeric() || matches!(c, '+' | '-' | '_' | '#' | '.'))
+        .collect();
+    (!language.is_empty()).then_some(language)
+}
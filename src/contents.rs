@@ -0,0 +1,57 @@
+use crate::chapter::{Chapter, TocEntry};
+use crate::cover::{self, NoCover};
+use crate::metadata::Metadata;
+use crate::{doc_to_chapters, load_toc, select_rendition, toc_of, Options};
+use anyhow::Result;
+use epub::doc::EpubDoc;
+use std::io::{Read, Seek};
+
+// Everything most programs want from a book, read in one pass over the
+// archive: see `convert_all`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Contents {
+    pub metadata: Metadata,
+    /// The table of contents, as `Book::toc` lists it.
+    pub toc: Vec<TocEntry>,
+    /// The chapters as `convert_chapters_with` converts them.
+    pub chapters: Vec<Chapter>,
+    /// The cover image, when the book declares one that can be read.
+    pub cover: Option<CoverImage>,
+}
+
+// A cover image as it is in the archive.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CoverImage {
+    /// The image's path relative to the package document.
+    pub href: String,
+    pub media_type: String,
+    pub bytes: Vec<u8>,
+}
+
+pub(crate) fn load<R: Read + Seek>(mut doc: EpubDoc<R>, options: &Options) -> Result<Contents> {
+    select_rendition(&mut doc, options)?;
+    let metadata = Metadata::load(&mut doc);
+    let (points, _) = load_toc(&mut doc, options)?;
+    let toc = toc_of(&mut doc, &points);
+    let cover = match cover::read(&mut doc) {
+        Ok((item, bytes)) => Some(CoverImage {
+            href: item.path.strip_prefix(&doc.root_base).unwrap_or(&item.path).to_string_lossy().into_owned(),
+            media_type: item.media_type,
+            bytes,
+        }),
+        Err(e) if e.is::<NoCover>() => None,
+        Err(e) => {
+            // A cover declared but missing from the archive shouldn't cost
+            // the rest of the book.
+            warn!("{:#}; leaving out the cover", e);
+            None
+        }
+    };
+    let chapters = doc_to_chapters(&mut doc, &points, options, true)?;
+    Ok(Contents {
+        metadata,
+        toc,
+        chapters,
+        cover,
+    })
+}
@@ -0,0 +1,259 @@
+use crate::chapter::{Chapter, ChapterErrors, ChapterSelection};
+use crate::format::Format;
+use crate::images::ImageOptions;
+use crate::normalize::normalize;
+use crate::render::{Renderer, Style, Theme, Wrap};
+use crate::metadata::Metadata;
+use crate::{html, json, org, text, CancelToken, Chapters, Options, Transform};
+use anyhow::Result;
+use std::io::{Cursor, Read, Seek, Write};
+use std::path::Path;
+
+// A conversion set up once and used for any number of books: the options,
+// the output format and, for ANSI output, the terminal style. It holds no
+// state between books, so one converter can be shared by several threads.
+//
+//     let converter = Converter::new().format(Format::Text).jobs(2);
+//     let text = converter.convert_file("book.epub")?;
+//
+// The settings most programs want have methods of their own; the rest are
+// in `Options`, see `options`, which the methods after it adjust.
+//
+//     let converter = Converter::new()
+//         .options(Options { toc: false, ..Options::default() })
+//         .front_matter(false)
+//         .chapters("2-5".parse()?)
+//         .images(ImageOptions { dir: "out/images".into(), link_prefix: "images".into() });
+//     converter.write_file("book.epub", &mut File::create("out/book.md")?)?;
+#[derive(Debug, Clone, Default)]
+pub struct Converter {
+    options: Options,
+    format: Format,
+    style: Option<Style>,
+    wrap: Wrap,
+}
+
+// Where a book is read from.
+enum Source<'a> {
+    Path(&'a str),
+    Bytes(&'a [u8]),
+}
+
+impl Source<'_> {
+    fn metadata(&self) -> Result<Metadata> {
+        match self {
+            Source::Path(path) => crate::read_metadata(path),
+            Source::Bytes(bytes) => crate::read_metadata_from(Cursor::new(bytes)),
+        }
+    }
+}
+
+impl Converter {
+    pub fn new() -> Converter {
+        Converter::default()
+    }
+
+    pub fn options(self, options: Options) -> Converter {
+        Converter { options, ..self }
+    }
+
+    // The number of threads converting each book's chapters, or books at a
+    // time in `convert_dir`.
+    pub fn jobs(self, jobs: usize) -> Converter {
+        Converter {
+            options: Options { jobs, ..self.options },
+            ..self
+        }
+    }
+
+    // Whether the book's metadata goes at the top, as YAML front matter or in
+    // the `Options::metadata_format` given.
+    pub fn front_matter(self, front_matter: bool) -> Converter {
+        Converter {
+            options: Options { front_matter, ..self.options },
+            ..self
+        }
+    }
+
+    // Converts only the selected spine positions.
+    pub fn chapters(self, chapters: ChapterSelection) -> Converter {
+        Converter {
+            options: Options {
+                chapters: Some(chapters),
+                ..self.options
+            },
+            ..self
+        }
+    }
+
+    // Writes the book's images into a folder and links to them there, instead
+    // of leaving the links as the book has them.
+    pub fn images(self, images: ImageOptions) -> Converter {
+        Converter {
+            options: Options {
+                images: Some(images),
+                embed_images: None,
+                ..self.options
+            },
+            ..self
+        }
+    }
+
+    // Stops each conversion at its next spine item once `cancel` fires or
+    // its deadline passes, with a `Cancelled` error.
+    pub fn cancel(self, cancel: CancelToken) -> Converter {
+        Converter {
+            options: Options {
+                cancel: Some(cancel),
+                ..self.options
+            },
+            ..self
+        }
+    }
+
+    // Adds a transform, run on each chapter's markdown after the ones added
+    // before it; see `Transform`.
+    pub fn transform<F: Fn(&str) -> Result<String> + Send + Sync + 'static>(mut self, name: &str, f: F) -> Converter {
+        self.options.transforms.push(Transform::new(name, f));
+        self
+    }
+
+    pub fn format(self, format: Format) -> Converter {
+        Converter { format, ..self }
+    }
+
+    // The style of `Format::Ansi` output, the dark theme by default.
+    pub fn style<S: Into<Style>>(self, style: S) -> Converter {
+        Converter {
+            style: Some(style.into()),
+            ..self
+        }
+    }
+
+    pub fn wrap(self, wrap: Wrap) -> Converter {
+        Converter { wrap, ..self }
+    }
+
+    // Reads the whole EPUB into memory first, since the zip archive has to be
+    // seekable.
+    pub fn convert<R: Read>(&self, mut reader: R) -> Result<String> {
+        let mut bytes = Vec::new();
+        reader.read_to_end(&mut bytes)?;
+        self.run(Source::Bytes(&bytes))
+    }
+
+    pub fn convert_file(&self, path_str: &str) -> Result<String> {
+        self.run(Source::Path(path_str))
+    }
+
+    // Like `convert`, writing the output to `w`. Nothing is written when the
+    // conversion fails, including for a `ChapterErrors`, whose markdown holds
+    // the output.
+    pub fn write<R: Read, W: Write>(&self, reader: R, w: &mut W) -> Result<()> {
+        w.write_all(self.convert(reader)?.as_bytes())?;
+        Ok(())
+    }
+
+    pub fn write_file<W: Write>(&self, path_str: &str, w: &mut W) -> Result<()> {
+        w.write_all(self.convert_file(path_str)?.as_bytes())?;
+        Ok(())
+    }
+
+    // Opens the book for converting its chapters one at a time, only those
+    // asked for and only when asked; see `Chapters`. The chapters are
+    // markdown whatever the format. Unlike `convert`, the reader isn't read
+    // into memory first: the chapters are read from it as they're converted.
+    pub fn lazy_chapters<R: Read + Seek + Send + 'static>(&self, reader: R) -> Result<Chapters> {
+        crate::open_chapters_from(reader, &self.options)
+    }
+
+    pub fn lazy_chapters_file(&self, path_str: &str) -> Result<Chapters> {
+        crate::open_chapters(path_str, &self.options)
+    }
+
+    // Converts every .epub under `src_dir` into a markdown file of the same
+    // name in `dst_dir`, see `convert_dir_with`. The books are written as
+    // markdown whatever the format.
+    pub fn convert_dir(&self, src_dir: &Path, dst_dir: &Path) -> Result<()> {
+        crate::convert_dir_with(src_dir, dst_dir, &self.options)
+    }
+
+    // Converts the book and formats the result. Without `strict`, a book with
+    // broken chapters fails with a `ChapterErrors` whose markdown holds the
+    // formatted output.
+    fn run(&self, source: Source) -> Result<String> {
+        if matches!(self.format, Format::Json | Format::Ndjson) {
+            let chapters = match source {
+                Source::Path(path) => crate::convert_chapters_with(path, &self.options),
+                Source::Bytes(bytes) => crate::convert_chapters_from(bytes, &self.options),
+            };
+            let metadata = source.metadata()?;
+            let to_json = |chapters: &[Chapter]| match self.format {
+                Format::Json => json::to_json(&metadata, chapters, false) + "\n",
+                _ => json::to_ndjson(chapters),
+            };
+            return recover(chapters, |chapters| to_json(&chapters), |errors| to_json(&errors.chapters));
+        }
+        if matches!(self.format, Format::Html | Format::Org) {
+            // The page puts the metadata in its <head> and builds its own
+            // table of contents, linking to the ids the headings are given;
+            // the Org document puts it in keywords.
+            let options = Options {
+                front_matter: false,
+                toc: false,
+                heading_ids: true,
+                ..self.options.clone()
+            };
+            let markdown = match source {
+                Source::Path(path) => crate::convert_file_with(path, &options),
+                Source::Bytes(bytes) => crate::convert_with(bytes, &options),
+            };
+            let metadata = source.metadata()?;
+            let to_document = |markdown: &str| {
+                let document = match self.format {
+                    Format::Org => org::to_org(&metadata, markdown),
+                    _ => html::to_html(&metadata, markdown),
+                };
+                normalize(&document, options.line_ending)
+            };
+            return recover(markdown, |markdown| to_document(&markdown), |errors| to_document(&errors.markdown));
+        }
+        let markdown = match source {
+            Source::Path(path) => crate::convert_file_with(path, &self.options),
+            Source::Bytes(bytes) => crate::convert_with(bytes, &self.options),
+        };
+        recover(markdown, |markdown| self.format_markdown(&markdown), |errors| self.format_markdown(&errors.markdown))
+    }
+
+    fn format_markdown(&self, markdown: &str) -> String {
+        match self.format {
+            Format::Text => normalize(&text::to_text(markdown), self.options.line_ending),
+            Format::Ansi => {
+                let style = self.style.clone().unwrap_or(Style::Theme(Theme::Dark));
+                Renderer::new(style).wrap(self.wrap).render(markdown)
+            }
+            Format::Markdown | Format::Json | Format::Ndjson | Format::Html | Format::Org => {
+                markdown.to_string()
+            }
+        }
+    }
+}
+
+// Formats a conversion's output, including the partial output carried by a
+// `ChapterErrors`.
+fn recover<T>(
+    result: Result<T>,
+    format: impl FnOnce(T) -> String,
+    format_partial: impl FnOnce(&ChapterErrors) -> String,
+) -> Result<String> {
+    match result {
+        Ok(converted) => Ok(format(converted)),
+        Err(e) => match e.downcast::<ChapterErrors>() {
+            Ok(mut errors) => {
+                errors.markdown = format_partial(&errors);
+                Err(errors.into())
+            }
+            Err(e) => Err(e),
+        },
+    }
+}
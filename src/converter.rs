@@ -0,0 +1,960 @@
+use crate::code;
+use crate::direction::Direction;
+use crate::dom::{self, Element, Node};
+use crate::links;
+use crate::typography::{normalize_typography, Typography};
+use anyhow::Result;
+use std::borrow::Cow;
+use std::fmt;
+use std::panic;
+use std::str::FromStr;
+
+// html2md has no settings of its own, so the markdown it produces is adjusted
+// afterwards. Emphasis and strikethrough are swapped for placeholders before
+// conversion, and headings, list markers and escapes are rewritten line by
+// line outside fenced code. The defaults leave html2md's output untouched:
+// ATX headings, `*` bullets, `1.` numbers, lists spaced as converted, `*`
+// emphasis, ~~strikethrough~~, escapes and the book's own typography.
+// Blockquotes, <q>, <br> and <hr> are always converted here, as html2md
+// flattens nested quotes, drops <q> altogether, runs lines broken with <br>
+// together and loses scene breaks marked with <hr>.
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MarkdownOptions {
+    pub headings: HeadingStyle,
+    /// Marker for unordered list items.
+    pub bullet: Bullet,
+    /// What follows the number of ordered list items.
+    pub ordered_delimiter: OrderedDelimiter,
+    /// Whether list items are separated by blank lines. None keeps them as
+    /// html2md writes them, which depends on how the items are marked up.
+    pub list_spacing: Option<ListSpacing>,
+    pub emphasis: Emphasis,
+    /// Write <del>, <s> and <strike> as GitHub Flavored Markdown
+    /// `~~strikethrough~~`. When false the struck text is kept plain.
+    pub strikethrough: bool,
+    /// Backslash-escape markdown characters that appear in the text.
+    pub escape: bool,
+    /// Added to every heading level, so that with 1 an <h1> becomes `##`.
+    /// Levels stop at 6.
+    pub heading_offset: usize,
+    /// Rewrite quotes, dashes and stray invisible characters in the text.
+    pub typography: Option<Typography>,
+    /// The quotation marks put around <q> elements.
+    pub quote_style: QuoteStyle,
+    /// How a <br> outside code and tables ends its line.
+    pub line_break: LineBreak,
+    /// How <dl> definition lists are written.
+    pub definition_lists: DefinitionList,
+}
+
+impl Default for MarkdownOptions {
+    fn default() -> Self {
+        MarkdownOptions {
+            headings: HeadingStyle::default(),
+            bullet: Bullet::default(),
+            ordered_delimiter: OrderedDelimiter::default(),
+            list_spacing: None,
+            emphasis: Emphasis::default(),
+            strikethrough: true,
+            escape: true,
+            heading_offset: 0,
+            typography: None,
+            quote_style: QuoteStyle::default(),
+            line_break: LineBreak::default(),
+            definition_lists: DefinitionList::default(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum HeadingStyle {
+    /// `# Title`, for every level.
+    #[default]
+    Atx,
+    /// Title underlined with `=` or `-`. Only levels 1 and 2 have a setext
+    /// form; deeper headings stay ATX.
+    Setext,
+}
+
+impl FromStr for HeadingStyle {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "atx" => Ok(HeadingStyle::Atx),
+            "setext" => Ok(HeadingStyle::Setext),
+            _ => Err(format!("invalid heading style {} (expected atx or setext)", s)),
+        }
+    }
+}
+
+impl fmt::Display for HeadingStyle {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            HeadingStyle::Atx => f.write_str("atx"),
+            HeadingStyle::Setext => f.write_str("setext"),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Bullet {
+    #[default]
+    Asterisk,
+    Dash,
+    Plus,
+}
+
+impl Bullet {
+    fn marker(self) -> char {
+        match self {
+            Bullet::Asterisk => '*',
+            Bullet::Dash => '-',
+            Bullet::Plus => '+',
+        }
+    }
+}
+
+impl FromStr for Bullet {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "*" => Ok(Bullet::Asterisk),
+            "-" => Ok(Bullet::Dash),
+            "+" => Ok(Bullet::Plus),
+            _ => Err(format!("invalid bullet {} (expected *, - or +)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Bullet {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.marker())
+    }
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum OrderedDelimiter {
+    /// `1.`
+    #[default]
+    Period,
+    /// `1)`
+    Paren,
+}
+
+impl OrderedDelimiter {
+    fn marker(self) -> char {
+        match self {
+            OrderedDelimiter::Period => '.',
+            OrderedDelimiter::Paren => ')',
+        }
+    }
+}
+
+impl FromStr for OrderedDelimiter {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "." => Ok(OrderedDelimiter::Period),
+            ")" => Ok(OrderedDelimiter::Paren),
+            _ => Err(format!("invalid ordered list delimiter {} (expected . or ))", s)),
+        }
+    }
+}
+
+impl fmt::Display for OrderedDelimiter {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.marker())
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ListSpacing {
+    /// No blank lines between items, nested ones included. An item holding
+    /// several paragraphs keeps the blank lines between them.
+    Tight,
+    /// A blank line between every two items.
+    Loose,
+}
+
+impl FromStr for ListSpacing {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "tight" => Ok(ListSpacing::Tight),
+            "loose" => Ok(ListSpacing::Loose),
+            _ => Err(format!("invalid list spacing {} (expected tight or loose)", s)),
+        }
+    }
+}
+
+impl fmt::Display for ListSpacing {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ListSpacing::Tight => f.write_str("tight"),
+            ListSpacing::Loose => f.write_str("loose"),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Emphasis {
+    /// `*em*` and `**strong**`.
+    #[default]
+    Asterisk,
+    /// `_em_` and `__strong__`.
+    Underscore,
+    /// Emphasized text is kept as plain text.
+    None,
+}
+
+impl FromStr for Emphasis {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "*" => Ok(Emphasis::Asterisk),
+            "_" => Ok(Emphasis::Underscore),
+            "none" => Ok(Emphasis::None),
+            _ => Err(format!("invalid emphasis {} (expected *, _ or none)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Emphasis {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Emphasis::Asterisk => f.write_str("*"),
+            Emphasis::Underscore => f.write_str("_"),
+            Emphasis::None => f.write_str("none"),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum QuoteStyle {
+    /// “Double” quotes, and ‘single’ ones for a quote within a quote.
+    #[default]
+    Curly,
+    /// "Double" and 'single' ASCII quotes.
+    Straight,
+}
+
+impl QuoteStyle {
+    // The opening and closing marks for a <q> inside `depth` others.
+    fn marks(self, depth: usize) -> (&'static str, &'static str) {
+        match (self, depth % 2) {
+            (QuoteStyle::Curly, 0) => ("“", "”"),
+            (QuoteStyle::Curly, _) => ("‘", "’"),
+            (QuoteStyle::Straight, 0) => ("\"", "\""),
+            (QuoteStyle::Straight, _) => ("'", "'"),
+        }
+    }
+}
+
+impl FromStr for QuoteStyle {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "curly" => Ok(QuoteStyle::Curly),
+            "straight" => Ok(QuoteStyle::Straight),
+            _ => Err(format!("invalid quote style {} (expected curly or straight)", s)),
+        }
+    }
+}
+
+impl fmt::Display for QuoteStyle {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            QuoteStyle::Curly => f.write_str("curly"),
+            QuoteStyle::Straight => f.write_str("straight"),
+        }
+    }
+}
+
+// A hard line break. A <br> that ends a paragraph is dropped, and two or more
+// in a row, as between stanzas, end the paragraph.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum LineBreak {
+    /// Two trailing spaces.
+    #[default]
+    Spaces,
+    /// A trailing backslash, which survives editors that trim whitespace.
+    Backslash,
+}
+
+impl LineBreak {
+    fn marker(self) -> &'static str {
+        match self {
+            LineBreak::Spaces => "  ",
+            LineBreak::Backslash => "\\",
+        }
+    }
+}
+
+impl FromStr for LineBreak {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "spaces" => Ok(LineBreak::Spaces),
+            "backslash" => Ok(LineBreak::Backslash),
+            _ => Err(format!("invalid line break {} (expected spaces or backslash)", s)),
+        }
+    }
+}
+
+impl fmt::Display for LineBreak {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LineBreak::Spaces => f.write_str("spaces"),
+            LineBreak::Backslash => f.write_str("backslash"),
+        }
+    }
+}
+
+// How a <dl> is written: each <dt> a line of its own, followed by its <dd>s.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum DefinitionList {
+    /// PHP Markdown Extra's `:   definition` under the term, which pandoc,
+    /// kramdown and markdown-it's deflist plugin read as a definition list.
+    #[default]
+    Extra,
+    /// The term in bold and the definition as an indented paragraph below
+    /// it, for renderers without definition lists.
+    Bold,
+}
+
+impl FromStr for DefinitionList {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "extra" => Ok(DefinitionList::Extra),
+            "bold" => Ok(DefinitionList::Bold),
+            _ => Err(format!("invalid definition list style {} (expected extra or bold)", s)),
+        }
+    }
+}
+
+impl fmt::Display for DefinitionList {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            DefinitionList::Extra => f.write_str("extra"),
+            DefinitionList::Bold => f.write_str("bold"),
+        }
+    }
+}
+
+const EM: &str = "CIPHEREMX";
+const STRONG: &str = "CIPHERSTRONGX";
+const STRIKE: &str = "CIPHERSTRIKEX";
+const BREAK: &str = "CIPHERBREAKX";
+const RULE: &str = "CIPHERRULEX";
+
+// Converts HTML to markdown with one set of options. Built once per book and
+// shared by the threads converting its chapters.
+#[derive(Debug, Clone)]
+pub(crate) struct HtmlConverter {
+    options: MarkdownOptions,
+    /// Delimiters replacing the emphasis placeholders, when html2md's own
+    /// emphasis isn't wanted.
+    delimiters: Option<(&'static str, &'static str)>,
+    /// Likewise for strikethrough.
+    strike: Option<&'static str>,
+    /// The book's direction, which chapters that don't declare their own
+    /// run in.
+    direction: Direction,
+}
+
+impl Default for HtmlConverter {
+    fn default() -> Self {
+        HtmlConverter::new(&MarkdownOptions::default())
+    }
+}
+
+impl HtmlConverter {
+    pub(crate) fn new(options: &MarkdownOptions) -> HtmlConverter {
+        let delimiters = match options.emphasis {
+            Emphasis::Asterisk => None,
+            Emphasis::Underscore => Some(("_", "__")),
+            Emphasis::None => Some(("", "")),
+        };
+        HtmlConverter {
+            options: options.clone(),
+            delimiters,
+            strike: (!options.strikethrough).then_some(""),
+            direction: Direction::Ltr,
+        }
+    }
+
+    pub(crate) fn with_direction(self, direction: Option<Direction>) -> HtmlConverter {
+        HtmlConverter {
+            direction: direction.unwrap_or(Direction::Ltr),
+            ..self
+        }
+    }
+
+    pub(crate) fn direction(&self) -> Direction {
+        self.direction
+    }
+
+    // The converter for text running in `direction`. Right-to-left text is
+    // left out of the smart quotes and dashes, which follow English usage
+    // rather than that of Hebrew or Arabic.
+    pub(crate) fn for_direction(&self, direction: Direction) -> Cow<'_, HtmlConverter> {
+        match self.options.typography {
+            Some(typography) if typography.smart && direction == Direction::Rtl => {
+                let typography = Typography {
+                    quotes: false,
+                    dashes: false,
+                    ..typography
+                };
+                let options = MarkdownOptions {
+                    typography: Some(typography),
+                    ..self.options.clone()
+                };
+                Cow::Owned(HtmlConverter { options, ..self.clone() })
+            }
+            _ => Cow::Borrowed(self),
+        }
+    }
+
+    pub(crate) fn to_markdown(&self, html: &str) -> Result<String> {
+        let quoted = html.contains("<blockquote") || html.contains("<q");
+        let breaks = html.contains("<br");
+        let rules = html.contains("<hr");
+        let defined = html.contains("<dl");
+        let mut quotes = Vec::new();
+        let mut lists = Vec::new();
+        let markdown = match (self.delimiters, self.strike) {
+            (None, None) if !quoted && !breaks && !rules && !defined => html_to_markdown(html)?,
+            (delimiters, strike) => {
+                let mut nodes = dom::parse(html);
+                if defined {
+                    self.hide_definition_lists(&mut nodes, &mut lists)?;
+                }
+                if quoted {
+                    quotes = self.hide_blockquotes(&mut nodes)?;
+                    mark_quotes(&mut nodes, self.options.quote_style, 0);
+                }
+                if breaks {
+                    mark_breaks(&mut nodes, false);
+                }
+                if rules {
+                    mark_rules(&mut nodes);
+                }
+                mark_inline(&mut nodes, delimiters.is_some(), strike.is_some());
+                html_to_markdown(&dom::serialize(&nodes))?
+            }
+        };
+        let mut markdown = match breaks {
+            true => restore_breaks(&markdown, self.options.line_break),
+            false => markdown,
+        };
+        if rules {
+            markdown = restore_rules(&markdown);
+        }
+        markdown = self.rewrite_lines(&markdown);
+        if !self.options.escape {
+            markdown = unescape(&markdown);
+        }
+        if let Some((em, strong)) = self.delimiters {
+            markdown = markdown.replace(EM, em).replace(STRONG, strong);
+        }
+        if let Some(strike) = self.strike {
+            markdown = markdown.replace(STRIKE, strike);
+        }
+        if let Some(typography) = &self.options.typography {
+            markdown = normalize_typography(&markdown, typography);
+        }
+        // The quotes and definition lists were converted on their own, so
+        // they are only put back once the rest has been rewritten.
+        Ok(code::restore(&code::restore(&markdown, &quotes), &lists))
+    }
+
+    // Swaps each outermost <dl> for a placeholder paragraph holding it as
+    // `DefinitionList` says, converting each term and definition on its own.
+    fn hide_definition_lists(&self, nodes: &mut [Node], lists: &mut Vec<(String, String)>) -> Result<()> {
+        for node in nodes.iter_mut() {
+            let Node::Element(el) = node else {
+                continue;
+            };
+            if el.is("pre") || el.is("code") {
+                continue;
+            }
+            let mut entries = Vec::new();
+            if el.is("dl") {
+                definition_entries(&el.children, &mut entries);
+            }
+            if entries.is_empty() {
+                self.hide_definition_lists(&mut el.children, lists)?;
+                continue;
+            }
+            let strong = self.delimiters.map_or("**", |(_, strong)| strong);
+            let mut lines: Vec<String> = Vec::new();
+            let mut after_term = false;
+            for entry in entries {
+                let markdown = self.to_markdown(&dom::serialize(&entry.children))?;
+                let markdown = markdown.trim_matches('\n');
+                if entry.is("dt") {
+                    // A term after a definition starts the next entry.
+                    if !after_term && !lines.is_empty() {
+                        lines.push(String::new());
+                    }
+                    let term = markdown.split_whitespace().collect::<Vec<_>>().join(" ");
+                    lines.push(match self.options.definition_lists {
+                        DefinitionList::Extra => term,
+                        DefinitionList::Bold => format!("{}{}{}", strong, term, strong),
+                    });
+                    after_term = true;
+                    continue;
+                }
+                let (first, rest) = match self.options.definition_lists {
+                    DefinitionList::Extra => (":   ", "    "),
+                    DefinitionList::Bold => {
+                        lines.push(String::new());
+                        ("  ", "  ")
+                    }
+                };
+                for (i, line) in markdown.split('\n').enumerate() {
+                    lines.push(match (i, line.is_empty()) {
+                        (0, _) => format!("{}{}", first, line),
+                        (_, true) => String::new(),
+                        (_, false) => format!("{}{}", rest, line),
+                    });
+                }
+                after_term = false;
+            }
+            let placeholder = format!("CIPHERDEFLIST{}X", lists.len());
+            lists.push((placeholder.clone(), lines.join("\n")));
+            let mut paragraph = Element::new("p");
+            paragraph.children.push(Node::Text(placeholder));
+            *node = Node::Element(paragraph);
+        }
+        Ok(())
+    }
+
+    // Swaps each outermost <blockquote> for a placeholder paragraph and
+    // converts its content on its own, so that the blockquotes nested in it
+    // get a `>` more for each level.
+    fn hide_blockquotes(&self, nodes: &mut [Node]) -> Result<Vec<(String, String)>> {
+        let mut quotes = Vec::new();
+        self.hide_blockquotes_in(nodes, &mut quotes)?;
+        Ok(quotes)
+    }
+
+    fn hide_blockquotes_in(&self, nodes: &mut [Node], quotes: &mut Vec<(String, String)>) -> Result<()> {
+        for node in nodes.iter_mut() {
+            let Node::Element(el) = node else {
+                continue;
+            };
+            if el.is("pre") || el.is("code") {
+                continue;
+            }
+            if !el.is("blockquote") {
+                self.hide_blockquotes_in(&mut el.children, quotes)?;
+                continue;
+            }
+            let inner = self.to_markdown(&dom::serialize(&el.children))?;
+            let lines: Vec<String> = inner
+                .trim_matches('\n')
+                .lines()
+                .map(|line| match line.is_empty() {
+                    true => ">".to_string(),
+                    false => format!("> {}", line),
+                })
+                .collect();
+            let placeholder = format!("CIPHERQUOTE{}X", quotes.len());
+            quotes.push((placeholder.clone(), lines.join("\n")));
+            let mut paragraph = Element::new("p");
+            paragraph.children.push(Node::Text(placeholder));
+            *node = Node::Element(paragraph);
+        }
+        Ok(())
+    }
+
+    fn rewrite_lines(&self, markdown: &str) -> String {
+        let options = &self.options;
+        let markers = options.bullet == Bullet::Asterisk && options.ordered_delimiter == OrderedDelimiter::Period;
+        let lists = markers && options.list_spacing.is_none();
+        if options.headings == HeadingStyle::Atx && lists && options.heading_offset == 0 {
+            return markdown.to_string();
+        }
+        let mut out = Vec::new();
+        let mut in_fence = false;
+        // Whether the line before was text of a paragraph outside any list,
+        // whether it belonged to a list item and whether it was blank.
+        let (mut in_paragraph, mut in_list, mut after_blank) = (false, false, true);
+        for line in markdown.split('\n') {
+            let trimmed = line.trim_start();
+            if trimmed.starts_with("```") || trimmed.starts_with("~~~") {
+                in_fence = !in_fence;
+            }
+            if in_fence {
+                out.push(line.to_string());
+                continue;
+            }
+            if let Some((level, text)) = atx(line) {
+                out.push(heading(options.headings, (level + options.heading_offset).min(6), text));
+                (in_paragraph, in_list, after_blank) = (false, false, true);
+                continue;
+            }
+            if line.trim_start_matches(|c: char| c == '>' || c.is_whitespace()).is_empty() {
+                out.push(line.to_string());
+                (in_paragraph, after_blank) = (false, true);
+                continue;
+            }
+            let item = starts_item(line, in_paragraph);
+            out.push(match item {
+                true => self.rewrite_marker(line),
+                false => line.to_string(),
+            });
+            in_list = item || (in_list && (line.starts_with(char::is_whitespace) || !after_blank));
+            (in_paragraph, after_blank) = (!in_list, false);
+        }
+        let out = out.join("\n");
+        match options.list_spacing {
+            Some(spacing) => space_lists(&out, spacing),
+            None => out,
+        }
+    }
+
+    // Rewrites the marker of a line `starts_item` takes for a list item.
+    fn rewrite_marker(&self, line: &str) -> String {
+        let start = item_start(line);
+        let rest = &line[start..];
+        if let Some(item) = rest.strip_prefix("* ") {
+            return format!("{}{} {}", &line[..start], self.options.bullet.marker(), item);
+        }
+        let digits = rest.len() - rest.trim_start_matches(|c: char| c.is_ascii_digit()).len();
+        match rest[digits..].strip_prefix(". ") {
+            Some(item) if digits > 0 => {
+                let number = &line[..start + digits];
+                format!("{}{} {}", number, self.options.ordered_delimiter.marker(), item)
+            }
+            _ => line.to_string(),
+        }
+    }
+}
+
+// Where a list marker would start on `line`: list items can sit inside
+// blockquotes, behind any number of "> ", and nested items are indented.
+fn item_start(line: &str) -> usize {
+    line.len() - line.trim_start_matches(|c: char| c == '>' || c.is_whitespace()).len()
+}
+
+// Whether `line` starts a list item, with any bullet or delimiter. A
+// thematic break such as `* * *` doesn't.
+fn is_item(line: &str) -> bool {
+    let rest = &line[item_start(line)..];
+    if rest.starts_with(['*', '-', '+']) && rest[1..].starts_with(' ') {
+        let marks: Vec<char> = rest.chars().filter(|c| !c.is_whitespace()).collect();
+        return marks.len() < 3 || marks.iter().any(|c| *c != marks[0]);
+    }
+    let digits = rest.len() - rest.trim_start_matches(|c: char| c.is_ascii_digit()).len();
+    (1..=9).contains(&digits) && (rest[digits..].starts_with(". ") || rest[digits..].starts_with(") "))
+}
+
+// Whether `line` starts a list item, after a line of paragraph text when
+// `in_paragraph`. Only a list numbered from 1 can start in the middle of a
+// paragraph: a line such as "1984. The year" there carries the paragraph on.
+fn starts_item(line: &str, in_paragraph: bool) -> bool {
+    let rest = &line[item_start(line)..];
+    is_item(line) && !(in_paragraph && rest.starts_with(|c: char| c.is_ascii_digit()) && !rest.starts_with("1. "))
+}
+
+// Removes the blank lines between list items, or puts one between every two,
+// outside fenced code. A blank line before an item's further paragraphs, or
+// before and after the list, is left alone.
+fn space_lists(markdown: &str, spacing: ListSpacing) -> String {
+    let mut out: Vec<&str> = Vec::new();
+    let mut blanks: Vec<&str> = Vec::new();
+    let mut in_fence = false;
+    // Whether the last line that wasn't blank belongs to a list item, and
+    // whether it was a heading.
+    let (mut in_list, mut after_heading) = (false, false);
+    for line in markdown.split('\n') {
+        let trimmed = line.trim_start_matches(|c: char| c == '>' || c.is_whitespace());
+        if in_fence {
+            in_fence = !(trimmed.starts_with("```") || trimmed.starts_with("~~~"));
+            out.push(line);
+            continue;
+        }
+        if trimmed.is_empty() {
+            blanks.push(line);
+            continue;
+        }
+        let after_blank = !blanks.is_empty();
+        let item = starts_item(line, !after_blank && !in_list && !after_heading);
+        match spacing {
+            ListSpacing::Tight if in_list && item => blanks.clear(),
+            ListSpacing::Loose if in_list && item && !after_blank => {
+                out.push(line[..item_start(line)].trim_end());
+            }
+            _ => {}
+        }
+        out.append(&mut blanks);
+        out.push(line);
+        in_fence = trimmed.starts_with("```") || trimmed.starts_with("~~~");
+        // A paragraph carrying on an item is indented under it, or follows
+        // it without a blank line.
+        in_list = item || (in_list && (line.starts_with(char::is_whitespace) || !after_blank));
+        after_heading = atx(line).is_some();
+    }
+    out.append(&mut blanks);
+    out.join("\n")
+}
+
+// A heading in the given style; setext only covers levels 1 and 2.
+pub(crate) fn heading(style: HeadingStyle, level: usize, text: &str) -> String {
+    match (style, level) {
+        (HeadingStyle::Setext, 1 | 2) => {
+            let underline = if level == 1 { "=" } else { "-" };
+            format!("{}\n{}", text, underline.repeat(text.chars().count().max(3)))
+        }
+        _ => format!("{} {}", "#".repeat(level), text),
+    }
+}
+
+// Splits an ATX heading into its level and text.
+fn atx(line: &str) -> Option<(usize, &str)> {
+    let level = line.len() - line.trim_start_matches('#').len();
+    let text = line[level..].strip_prefix(' ')?.trim();
+    match (level, text.is_empty()) {
+        (1..=6, false) => Some((level, text)),
+        _ => None,
+    }
+}
+
+// Replaces <em>/<i> and <strong>/<b> (with `emphasis`) and <del>/<s>/<strike>
+// (with `strike`) with their content between placeholders, so html2md leaves
+// the delimiters to us. Code is left alone.
+fn mark_inline(nodes: &mut Vec<Node>, emphasis: bool, strike: bool) {
+    let mut out = Vec::with_capacity(nodes.len());
+    for node in nodes.drain(..) {
+        match node {
+            Node::Element(el) if el.is("pre") || el.is("code") => out.push(Node::Element(el)),
+            Node::Element(mut el) => {
+                mark_inline(&mut el.children, emphasis, strike);
+                let placeholder = match el.local_name() {
+                    "em" | "i" if emphasis => EM,
+                    "strong" | "b" if emphasis => STRONG,
+                    "del" | "s" | "strike" if strike => STRIKE,
+                    _ => {
+                        out.push(Node::Element(el));
+                        continue;
+                    }
+                };
+                out.push(Node::Text(placeholder.to_string()));
+                out.append(&mut el.children);
+                out.push(Node::Text(placeholder.to_string()));
+            }
+            node => out.push(node),
+        }
+    }
+    *nodes = out;
+}
+
+// Replaces each <q> with its content between quotation marks, alternating
+// double and single ones for quotes within quotes.
+fn mark_quotes(nodes: &mut Vec<Node>, style: QuoteStyle, depth: usize) {
+    let mut out = Vec::with_capacity(nodes.len());
+    for node in nodes.drain(..) {
+        match node {
+            Node::Element(el) if el.is("pre") || el.is("code") => out.push(Node::Element(el)),
+            Node::Element(mut el) if el.is("q") => {
+                mark_quotes(&mut el.children, style, depth + 1);
+                let (open, close) = style.marks(depth);
+                out.push(Node::Text(open.to_string()));
+                out.append(&mut el.children);
+                out.push(Node::Text(close.to_string()));
+            }
+            Node::Element(mut el) => {
+                mark_quotes(&mut el.children, style, depth);
+                out.push(Node::Element(el));
+            }
+            node => out.push(node),
+        }
+    }
+    *nodes = out;
+}
+
+// Replaces each <br> with a placeholder, so that html2md leaves the line
+// breaks to us. Code and tables are left alone: code keeps its own lines, and
+// a pipe table row can't hold one. Nor can a heading, so a <br> in one is a
+// space.
+fn mark_breaks(nodes: &mut [Node], heading: bool) {
+    for node in nodes.iter_mut() {
+        match node {
+            Node::Element(el) if el.is("br") && heading => *node = Node::Text(" ".to_string()),
+            Node::Element(el) if el.is("br") => *node = Node::Text(BREAK.to_string()),
+            Node::Element(el) if el.is("pre") || el.is("code") || el.is("table") => {}
+            Node::Element(el) => {
+                let heading = heading || links::is_heading(el);
+                mark_breaks(&mut el.children, heading);
+            }
+            _ => {}
+        }
+    }
+}
+
+fn restore_breaks(markdown: &str, line_break: LineBreak) -> String {
+    let mut out = Vec::new();
+    for line in join_broken_lines(markdown) {
+        let mut parts = line.split(BREAK);
+        let mut lines = vec![parts.next().unwrap_or_default().trim_end().to_string()];
+        let mut breaks = 0;
+        for part in parts {
+            breaks += 1;
+            let part = part.trim();
+            if part.is_empty() {
+                continue;
+            }
+            let last = lines.last_mut().expect("there is always the text before the first break");
+            match (last.is_empty(), breaks) {
+                // A break that starts the paragraph does nothing.
+                (true, _) => last.push_str(part),
+                (false, 1) => {
+                    last.push_str(line_break.marker());
+                    lines.push(part.to_string());
+                }
+                (false, _) => {
+                    lines.push(String::new());
+                    lines.push(part.to_string());
+                }
+            }
+            breaks = 0;
+        }
+        out.extend(lines);
+    }
+    out.join("\n")
+}
+
+// The lines of `markdown`, with a line that ends in a break joined to the
+// line after it in the same paragraph, so that a run of breaks html2md split
+// over lines counts as one run.
+fn join_broken_lines(markdown: &str) -> Vec<String> {
+    let mut lines: Vec<String> = Vec::new();
+    for line in markdown.split('\n') {
+        match lines.last_mut() {
+            Some(last) if last.trim_end().ends_with(BREAK) && !line.trim().is_empty() => {
+                let len = last.trim_end().len();
+                last.truncate(len);
+                last.push_str(line.trim_start());
+            }
+            _ => lines.push(line.to_string()),
+        }
+    }
+    lines
+}
+
+// The <dt> and <dd> elements of a <dl> in order, looking through the <div>s
+// HTML allows around each group of them.
+fn definition_entries<'a>(nodes: &'a [Node], entries: &mut Vec<&'a Element>) {
+    for node in nodes {
+        match node {
+            Node::Element(el) if el.is("dt") || el.is("dd") => entries.push(el),
+            Node::Element(el) if el.is("div") => definition_entries(&el.children, entries),
+            _ => {}
+        }
+    }
+}
+
+// Replaces each <hr> outside code with a paragraph holding a placeholder,
+// which `restore_rules` turns into a thematic break.
+fn mark_rules(nodes: &mut [Node]) {
+    for node in nodes.iter_mut() {
+        match node {
+            Node::Element(el) if el.is("hr") => {
+                let mut paragraph = Element::new("p");
+                paragraph.children.push(Node::Text(RULE.to_string()));
+                *node = Node::Element(paragraph);
+            }
+            Node::Element(el) if el.is("pre") || el.is("code") => {}
+            Node::Element(el) => mark_rules(&mut el.children),
+            _ => {}
+        }
+    }
+}
+
+// Writes each rule placeholder as `---` on a line of its own, at the indent
+// of the line it was in, with blank lines around it so that it can't be read
+// as the underline of a setext heading.
+fn restore_rules(markdown: &str) -> String {
+    let mut out: Vec<String> = Vec::new();
+    // Right after a rule, where a line of text needs a blank line first.
+    let mut after_rule = false;
+    fn push(out: &mut Vec<String>, after_rule: &mut bool, line: String) {
+        if std::mem::take(after_rule) && !line.trim().is_empty() {
+            out.push(String::new());
+        }
+        out.push(line);
+    }
+    for line in markdown.split('\n') {
+        if !line.contains(RULE) {
+            push(&mut out, &mut after_rule, line.to_string());
+            continue;
+        }
+        let indent = &line[..line.len() - line.trim_start().len()];
+        for (i, text) in line.split(RULE).map(str::trim).enumerate() {
+            if i > 0 {
+                if out.last().is_some_and(|last| !last.trim().is_empty()) {
+                    out.push(String::new());
+                }
+                out.push(format!("{}---", indent));
+                after_rule = true;
+            }
+            if !text.is_empty() {
+                push(&mut out, &mut after_rule, format!("{}{}", indent, text));
+            }
+        }
+    }
+    out.join("\n")
+}
+
+// The characters html2md escapes in text.
+const ESCAPED: &[char] = &['\\', '<', '>', '*', '_', '~', '=', '+', '-', '#'];
+
+// Drops html2md's backslash escapes outside fenced code.
+fn unescape(markdown: &str) -> String {
+    let mut out = Vec::new();
+    let mut in_fence = false;
+    for line in markdown.split('\n') {
+        let trimmed = line.trim_start();
+        if trimmed.starts_with("```") || trimmed.starts_with("~~~") {
+            in_fence = !in_fence;
+        }
+        if in_fence {
+            out.push(line.to_string());
+            continue;
+        }
+        let mut unescaped = String::with_capacity(line.len());
+        let mut chars = line.chars().peekable();
+        while let Some(c) = chars.next() {
+            match chars.peek() {
+                Some(next) if c == '\\' && ESCAPED.contains(next) => unescaped.extend(chars.next()),
+                _ => unescaped.push(c),
+            }
+        }
+        out.push(unescaped);
+    }
+    out.join("\n")
+}
+
+// Runs html2md, turning a panic on malformed markup into an error.
+fn html_to_markdown(html: &str) -> Result<String> {
+    panic::catch_unwind(|| html2md::parse_html(html)).map_err(|payload| {
+        let message = payload
+            .downcast_ref::<&str>()
+            .map(|s| s.to_string())
+            .or_else(|| payload.downcast_ref::<String>().cloned())
+            .unwrap_or_else(|| "unknown error".to_string());
+        anyhow::anyhow!("html2md failed: {}", message)
+    })
+}
@@ -0,0 +1,112 @@
+use crate::encoding;
+use crate::href;
+use crate::images;
+use crate::opf::{ManifestItem, Package};
+use anyhow::{Context, Result};
+use epub::doc::EpubDoc;
+use std::error::Error;
+use std::fmt;
+use std::fs;
+use std::io::{Read, Seek};
+use std::path::PathBuf;
+
+#[derive(Debug, Clone)]
+pub struct CoverOptions {
+    /// File the cover image is written to. Without an extension, one is added
+    /// from the cover's media type.
+    pub path: PathBuf,
+    /// Link to the file from the markdown, usually `path` relative to the
+    /// markdown file. Gets the same extension as `path`.
+    pub link: String,
+}
+
+// Returned when the book declares no cover image, so that callers can skip
+// it; use `downcast_ref::<NoCover>()` to tell it apart from other failures.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct NoCover;
+
+impl fmt::Display for NoCover {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("the book declares no cover image")
+    }
+}
+
+impl Error for NoCover {}
+
+// Finds the cover image through the EPUB3 cover-image manifest property,
+// falling back to the EPUB2 <meta name="cover" content="item-id">. Books that
+// declare neither often open with a cover page wrapping the image in an
+// <svg>; the page the guide names as the cover, or failing that a first spine
+// item named cover, is the cover when it's an image or shows just one.
+pub(crate) fn find<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Result<ManifestItem> {
+    let package = Package::load(doc)?;
+    if let Some(item) = package.item_with_property("cover-image") {
+        return Ok(item.clone());
+    }
+    let by_id = |id: &String| package.manifest.iter().find(|item| item.id == *id);
+    if let Some(id) = package.metadata.get("cover").and_then(|ids| ids.first()) {
+        return match by_id(id) {
+            // Some books point the meta at the cover page instead.
+            Some(item) if !images::is_image(&item.media_type) => {
+                page_image(doc, &package, item).ok_or_else(|| NoCover.into())
+            }
+            Some(item) => Ok(item.clone()),
+            None => anyhow::bail!("Cover {} is not in the manifest", id),
+        };
+    }
+    let named = |item: &&ManifestItem| item.path.file_stem().is_some_and(|stem| stem.eq_ignore_ascii_case("cover"));
+    let page = match package.guide.iter().find(|reference| reference.kind == "cover") {
+        Some(reference) => package.manifest.iter().find(|item| item.path == reference.path),
+        None => package.spine.first().and_then(by_id).filter(named),
+    };
+    match page {
+        Some(item) if images::is_image(&item.media_type) => Ok(item.clone()),
+        Some(item) => page_image(doc, &package, item).ok_or_else(|| NoCover.into()),
+        None => Err(NoCover.into()),
+    }
+}
+
+// The manifest item of the one image a cover page shows.
+fn page_image<R: Read + Seek>(doc: &mut EpubDoc<R>, package: &Package, page: &ManifestItem) -> Option<ManifestItem> {
+    let html = encoding::decode(&doc.get_resource_by_path(&page.path).ok()?);
+    let path = href::resolve(&page.path, &images::page_image(&html)?)?;
+    package.manifest.iter().find(|item| item.path == path && images::is_image(&item.media_type)).cloned()
+}
+
+// Reads the cover image found by `find`.
+pub(crate) fn read<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Result<(ManifestItem, Vec<u8>)> {
+    let item = find(doc)?;
+    let bytes = doc
+        .get_resource_by_path(&item.path)
+        .map_err(|e| anyhow::anyhow!("Failed to read cover {}: {}", item.path.display(), e))?;
+    Ok((item, bytes))
+}
+
+// Writes the cover to `options.path` and returns the image line linking to it.
+// A book without a usable cover isn't an error: it's reported and None returned.
+pub(crate) fn write<R: Read + Seek>(doc: &mut EpubDoc<R>, options: &CoverOptions) -> Result<Option<String>> {
+    let (item, bytes) = match read(doc) {
+        Ok(cover) => cover,
+        Err(e) => {
+            warn!("{:#}; not writing {}", e, options.path.display());
+            return Ok(None);
+        }
+    };
+    let (path, link) = match (options.path.extension(), extension(&item.media_type)) {
+        (None, Some(ext)) => (options.path.with_extension(ext), format!("{}.{}", options.link, ext)),
+        _ => (options.path.clone(), options.link.clone()),
+    };
+    fs::write(&path, bytes).with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(Some(format!("![cover]({})", link.replace(' ', "%20"))))
+}
+
+fn extension(media_type: &str) -> Option<&'static str> {
+    match media_type.split(';').next().unwrap_or_default().trim() {
+        "image/jpeg" => Some("jpg"),
+        "image/png" => Some("png"),
+        "image/gif" => Some("gif"),
+        "image/svg+xml" => Some("svg"),
+        "image/webp" => Some("webp"),
+        _ => None,
+    }
+}
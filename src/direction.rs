@@ -0,0 +1,165 @@
+use crate::dom::{self, Element, Node};
+use serde::Serialize;
+use std::fmt;
+use std::str::FromStr;
+
+// Languages written right to left, by their primary subtag. A script subtag
+// overrides it either way: az-Arab is right to left and sd-Deva isn't.
+const RTL_LANGUAGES: &[&str] = &[
+    "ar", "arc", "ckb", "dv", "fa", "he", "iw", "ji", "nqo", "prs", "ps", "sd", "syr", "ug", "ur", "yi",
+];
+const RTL_SCRIPTS: &[&str] = &["adlm", "arab", "hebr", "mand", "nkoo", "rohg", "syrc", "thaa"];
+
+// Elements whose text becomes a paragraph, heading or list item of its own,
+// and the containers holding them.
+const BLOCKS: &[&str] = &[
+    "address", "article", "aside", "blockquote", "body", "caption", "dd", "details", "div", "dl", "dt",
+    "figcaption", "figure", "footer", "h1", "h2", "h3", "h4", "h5", "h6", "header", "html", "li", "main", "nav",
+    "ol", "p", "section", "table", "tbody", "td", "tfoot", "th", "thead", "tr", "ul",
+];
+
+// U+200F RIGHT-TO-LEFT MARK and U+200E LEFT-TO-RIGHT MARK. At the start of a
+// paragraph either one is its first strongly directional character, which
+// sets the paragraph's direction for renderers that follow the Unicode
+// bidirectional algorithm.
+const RLM: char = '\u{200f}';
+const LRM: char = '\u{200e}';
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Direction {
+    Ltr,
+    Rtl,
+}
+
+impl FromStr for Direction {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "ltr" => Ok(Direction::Ltr),
+            "rtl" => Ok(Direction::Rtl),
+            _ => Err(format!("invalid direction {} (expected ltr or rtl)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Direction {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Direction::Ltr => f.write_str("ltr"),
+            Direction::Rtl => f.write_str("rtl"),
+        }
+    }
+}
+
+// How right-to-left text is marked up in the markdown, which has no way of
+// its own to say which way text runs.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum RtlWrap {
+    /// A right-to-left mark at the start of each paragraph, heading and list
+    /// item written right to left. It survives any renderer, and the text
+    /// still searches the same, but alignment is left to the renderer.
+    Marks,
+    /// Each right-to-left chapter in a `<div dir="rtl">`, which renderers
+    /// that allow HTML lay out and align right to left. Paragraphs running
+    /// the other way from their chapter get a directional mark.
+    Div,
+}
+
+impl FromStr for RtlWrap {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "marks" => Ok(RtlWrap::Marks),
+            "div" => Ok(RtlWrap::Div),
+            _ => Err(format!("invalid rtl wrap {} (expected marks or div)", s)),
+        }
+    }
+}
+
+impl fmt::Display for RtlWrap {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            RtlWrap::Marks => f.write_str("marks"),
+            RtlWrap::Div => f.write_str("div"),
+        }
+    }
+}
+
+// The direction a BCP 47 language tag such as he, ar-EG or az-Arab is
+// written in. Case is ignored, and so is the difference between - and _.
+pub fn language_direction(language: &str) -> Direction {
+    let language = language.trim().to_ascii_lowercase();
+    let mut subtags = language.split(['-', '_']);
+    let primary = subtags.next().unwrap_or_default();
+    let script = subtags.find(|subtag| subtag.len() == 4 && subtag.chars().all(|c| c.is_ascii_alphabetic()));
+    let rtl = match script {
+        Some(script) => RTL_SCRIPTS.contains(&script),
+        None => RTL_LANGUAGES.contains(&primary),
+    };
+    match rtl {
+        true => Direction::Rtl,
+        false => Direction::Ltr,
+    }
+}
+
+// The direction a chapter declares on its <body> or <html> element, with a
+// dir attribute or failing that by its language. None when it says neither,
+// and the book's direction applies.
+pub(crate) fn chapter_direction(nodes: &[Node]) -> Option<Direction> {
+    // The <html> element's (dir, language) and then the <body>'s.
+    let mut roots = Vec::new();
+    dom::walk(nodes, &mut |el| {
+        if (el.is("html") || el.is("body")) && roots.len() < 2 {
+            let language = el.attr("xml:lang").or_else(|| el.attr("lang"));
+            let language = language.filter(|language| !language.trim().is_empty()).map(language_direction);
+            roots.push((declared(el), language));
+        }
+    });
+    roots.iter().rev().find_map(|(dir, _)| *dir).or_else(|| roots.iter().rev().find_map(|(_, language)| *language))
+}
+
+fn declared(el: &Element) -> Option<Direction> {
+    el.attr("dir").and_then(|dir| dir.parse().ok())
+}
+
+// Puts a directional mark at the start of each paragraph, heading, list item
+// and table cell whose direction isn't `base`, the direction the markdown is
+// read in: left to right for plain markdown, or the chapter's own in a <div
+// dir>. An element's direction is that of its dir attribute or else its
+// parent's, starting from the chapter's; dir="auto" leaves it to the renderer.
+pub(crate) fn mark(nodes: &mut [Node], parent: Direction, base: Direction) {
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        if !BLOCKS.iter().any(|name| el.is(name)) {
+            continue;
+        }
+        if el.attr("dir").is_some_and(|dir| dir.trim().eq_ignore_ascii_case("auto")) {
+            continue;
+        }
+        let direction = declared(el).unwrap_or(parent);
+        let has_blocks = el.children.iter().any(|child| match child {
+            Node::Element(child) => BLOCKS.iter().any(|name| child.is(name)) || child.is("pre"),
+            _ => false,
+        });
+        if has_blocks {
+            mark(&mut el.children, direction, base);
+        } else if direction != base && !el.text().trim().is_empty() {
+            let mark = match direction {
+                Direction::Rtl => RLM,
+                Direction::Ltr => LRM,
+            };
+            el.children.insert(0, Node::Text(mark.to_string()));
+        }
+    }
+}
+
+// A right-to-left chapter's markdown inside a <div dir="rtl">, with blank
+// lines around it so that the markdown in it is still read as markdown.
+pub(crate) fn wrap(markdown: &str) -> String {
+    format!("<div dir=\"rtl\">\n\n{}\n\n</div>", markdown.trim_matches('\n'))
+}
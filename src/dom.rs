@@ -0,0 +1,365 @@
+// A small, lenient HTML/XHTML tree used to rewrite chapter markup before it
+// is handed to html2md. It keeps text and entities verbatim so that an
+// unmodified document serializes back to equivalent markup.
+
+const VOID_ELEMENTS: &[&str] = &[
+    "area", "base", "br", "col", "embed", "hr", "img", "input", "link", "meta", "param", "source", "track", "wbr",
+];
+const RAW_TEXT_ELEMENTS: &[&str] = &["script", "style"];
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Node {
+    Element(Element),
+    /// Text exactly as it appeared in the source, entities included.
+    Text(String),
+    Comment(String),
+    /// Doctypes, processing instructions and CDATA sections, kept verbatim.
+    Raw(String),
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Element {
+    pub name: String,
+    /// Attribute values are stored decoded and re-escaped on serialization.
+    pub attrs: Vec<(String, String)>,
+    pub children: Vec<Node>,
+}
+
+impl Element {
+    pub fn new(name: &str) -> Self {
+        Element {
+            name: name.to_string(),
+            attrs: Vec::new(),
+            children: Vec::new(),
+        }
+    }
+
+    // The tag name without any namespace prefix ("svg:image" -> "image").
+    pub fn local_name(&self) -> &str {
+        local(&self.name)
+    }
+
+    pub fn is(&self, name: &str) -> bool {
+        self.local_name().eq_ignore_ascii_case(name)
+    }
+
+    // Looks an attribute up by its full name, falling back to the local name
+    // so that "epub:type" and "xlink:href" can be found either way.
+    pub fn attr(&self, name: &str) -> Option<&str> {
+        self.attrs
+            .iter()
+            .find(|(k, _)| k.eq_ignore_ascii_case(name))
+            .or_else(|| self.attrs.iter().find(|(k, _)| local(k).eq_ignore_ascii_case(name)))
+            .map(|(_, v)| v.as_str())
+    }
+
+    pub fn set_attr(&mut self, name: &str, value: &str) {
+        match self.attrs.iter_mut().find(|(k, _)| k.eq_ignore_ascii_case(name)) {
+            Some(attr) => attr.1 = value.to_string(),
+            None => self.attrs.push((name.to_string(), value.to_string())),
+        }
+    }
+
+    pub fn remove_attr(&mut self, name: &str) {
+        self.attrs.retain(|(k, _)| !k.eq_ignore_ascii_case(name));
+    }
+
+    pub fn has_class(&self, class: &str) -> bool {
+        self.attr("class").is_some_and(|c| c.split_whitespace().any(|c| c == class))
+    }
+
+    // Decoded text content with whitespace collapsed.
+    pub fn text(&self) -> String {
+        let mut text = String::new();
+        collect_text(&self.children, &mut text);
+        text.split_whitespace().collect::<Vec<_>>().join(" ")
+    }
+}
+
+fn local(name: &str) -> &str {
+    name.rsplit(':').next().unwrap_or(name)
+}
+
+fn collect_text(nodes: &[Node], out: &mut String) {
+    for node in nodes {
+        match node {
+            Node::Text(text) => out.push_str(&decode_entities(text)),
+            Node::Element(el) => collect_text(&el.children, out),
+            _ => {}
+        }
+    }
+}
+
+pub fn text_content(nodes: &[Node]) -> String {
+    let mut text = String::new();
+    collect_text(nodes, &mut text);
+    text.split_whitespace().collect::<Vec<_>>().join(" ")
+}
+
+pub fn parse(html: &str) -> Vec<Node> {
+    let mut root: Vec<Node> = Vec::new();
+    let mut stack: Vec<Element> = Vec::new();
+    let mut rest = html;
+
+    fn push(stack: &mut [Element], root: &mut Vec<Node>, node: Node) {
+        match stack.last_mut() {
+            Some(parent) => parent.children.push(node),
+            None => root.push(node),
+        }
+    }
+
+    while !rest.is_empty() {
+        if !rest.starts_with('<') {
+            let end = rest.find('<').unwrap_or(rest.len());
+            push(&mut stack, &mut root, Node::Text(rest[..end].to_string()));
+            rest = &rest[end..];
+            continue;
+        }
+
+        if let Some(body) = rest.strip_prefix("<!--") {
+            let end = body.find("-->").unwrap_or(body.len());
+            push(&mut stack, &mut root, Node::Comment(body[..end].to_string()));
+            rest = body.get(end + 3..).unwrap_or("");
+        } else if rest.starts_with("<![CDATA[") {
+            let end = rest.find("]]>").map(|i| i + 3).unwrap_or(rest.len());
+            push(&mut stack, &mut root, Node::Raw(rest[..end].to_string()));
+            rest = &rest[end..];
+        } else if rest.starts_with("<!") || rest.starts_with("<?") {
+            let end = rest.find('>').map(|i| i + 1).unwrap_or(rest.len());
+            push(&mut stack, &mut root, Node::Raw(rest[..end].to_string()));
+            rest = &rest[end..];
+        } else if let Some(body) = rest.strip_prefix("</") {
+            let end = body.find('>').unwrap_or(body.len());
+            let name = body[..end].trim();
+            if let Some(pos) = stack.iter().rposition(|el| el.name.eq_ignore_ascii_case(name)) {
+                while stack.len() > pos {
+                    let el = stack.pop().unwrap();
+                    push(&mut stack, &mut root, Node::Element(el));
+                }
+            }
+            rest = body.get(end + 1..).unwrap_or("");
+        } else if rest[1..].starts_with(|c: char| c.is_ascii_alphabetic()) {
+            let (el, self_closing, after) = parse_start_tag(&rest[1..]);
+            rest = after;
+            let name = el.name.to_ascii_lowercase();
+            if self_closing || VOID_ELEMENTS.contains(&name.as_str()) {
+                push(&mut stack, &mut root, Node::Element(el));
+            } else if RAW_TEXT_ELEMENTS.contains(&name.as_str()) {
+                let mut el = el;
+                let close = find_ignore_case(rest, &format!("</{}", name)).unwrap_or(rest.len());
+                if close > 0 {
+                    el.children.push(Node::Text(rest[..close].to_string()));
+                }
+                rest = &rest[close..];
+                rest = match rest.find('>') {
+                    Some(i) => &rest[i + 1..],
+                    None => "",
+                };
+                push(&mut stack, &mut root, Node::Element(el));
+            } else {
+                stack.push(el);
+            }
+        } else {
+            push(&mut stack, &mut root, Node::Text("<".to_string()));
+            rest = &rest[1..];
+        }
+    }
+
+    while let Some(el) = stack.pop() {
+        push(&mut stack, &mut root, Node::Element(el));
+    }
+    root
+}
+
+// Parses `name attr="v" ...>` and returns the element, whether it was
+// self-closing, and the remaining input.
+fn parse_start_tag(input: &str) -> (Element, bool, &str) {
+    let name_end = input
+        .find(|c: char| c.is_whitespace() || c == '>' || c == '/')
+        .unwrap_or(input.len());
+    let mut el = Element::new(&input[..name_end]);
+    let mut rest = &input[name_end..];
+    let mut self_closing = false;
+
+    loop {
+        rest = rest.trim_start();
+        if rest.is_empty() {
+            break;
+        }
+        if let Some(after) = rest.strip_prefix("/>") {
+            self_closing = true;
+            rest = after;
+            break;
+        }
+        if let Some(after) = rest.strip_prefix('>') {
+            rest = after;
+            break;
+        }
+        if let Some(after) = rest.strip_prefix('/') {
+            rest = after;
+            continue;
+        }
+        let key_end = rest
+            .find(|c: char| c.is_whitespace() || c == '=' || c == '>' || c == '/')
+            .unwrap_or(rest.len())
+            .max(1);
+        let key = rest[..key_end].to_string();
+        rest = rest[key_end..].trim_start();
+        let mut value = String::new();
+        if let Some(after) = rest.strip_prefix('=') {
+            rest = after.trim_start();
+            if let Some(quote) = rest.chars().next().filter(|c| *c == '"' || *c == '\'') {
+                let body = &rest[1..];
+                let end = body.find(quote).unwrap_or(body.len());
+                value = decode_entities(&body[..end]);
+                rest = body.get(end + 1..).unwrap_or("");
+            } else {
+                let end = rest.find(|c: char| c.is_whitespace() || c == '>').unwrap_or(rest.len());
+                value = decode_entities(&rest[..end]);
+                rest = &rest[end..];
+            }
+        }
+        el.attrs.push((key, value));
+    }
+    (el, self_closing, rest)
+}
+
+fn find_ignore_case(haystack: &str, needle: &str) -> Option<usize> {
+    haystack.to_ascii_lowercase().find(&needle.to_ascii_lowercase())
+}
+
+pub fn serialize(nodes: &[Node]) -> String {
+    let mut out = String::new();
+    serialize_into(nodes, &mut out);
+    out
+}
+
+fn serialize_into(nodes: &[Node], out: &mut String) {
+    for node in nodes {
+        match node {
+            Node::Text(text) => out.push_str(text),
+            Node::Comment(comment) => {
+                out.push_str("<!--");
+                out.push_str(comment);
+                out.push_str("-->");
+            }
+            Node::Raw(raw) => out.push_str(raw),
+            Node::Element(el) => serialize_element(el, out),
+        }
+    }
+}
+
+fn serialize_element(el: &Element, out: &mut String) {
+    out.push('<');
+    out.push_str(&el.name);
+    for (key, value) in &el.attrs {
+        out.push(' ');
+        out.push_str(key);
+        out.push_str("=\"");
+        out.push_str(&escape_attr(value));
+        out.push('"');
+    }
+    if VOID_ELEMENTS.contains(&el.name.to_ascii_lowercase().as_str()) && el.children.is_empty() {
+        out.push_str("/>");
+        return;
+    }
+    out.push('>');
+    serialize_into(&el.children, out);
+    out.push_str("</");
+    out.push_str(&el.name);
+    out.push('>');
+}
+
+// Calls `f` on every element in document order, parents before children.
+pub fn walk_mut<F: FnMut(&mut Element)>(nodes: &mut [Node], f: &mut F) {
+    for node in nodes.iter_mut() {
+        if let Node::Element(el) = node {
+            f(el);
+            walk_mut(&mut el.children, f);
+        }
+    }
+}
+
+pub fn walk<F: FnMut(&Element)>(nodes: &[Node], f: &mut F) {
+    for node in nodes {
+        if let Node::Element(el) = node {
+            f(el);
+            walk(&el.children, f);
+        }
+    }
+}
+
+pub fn escape_text(text: &str) -> String {
+    text.replace('&', "&amp;").replace('<', "&lt;").replace('>', "&gt;")
+}
+
+pub fn escape_attr(value: &str) -> String {
+    escape_text(value).replace('"', "&quot;")
+}
+
+pub fn decode_entities(text: &str) -> String {
+    if !text.contains('&') {
+        return text.to_string();
+    }
+    let mut out = String::with_capacity(text.len());
+    let mut rest = text;
+    while let Some(start) = rest.find('&') {
+        out.push_str(&rest[..start]);
+        rest = &rest[start..];
+        let end = match rest[1..].find(|c: char| c == ';' || c == '&' || c.is_whitespace()) {
+            Some(i) if rest.as_bytes()[i + 1] == b';' => i + 1,
+            _ => {
+                out.push('&');
+                rest = &rest[1..];
+                continue;
+            }
+        };
+        match decode_entity(&rest[1..end]) {
+            Some(c) => out.push(c),
+            None => out.push_str(&rest[..=end]),
+        }
+        rest = &rest[end + 1..];
+    }
+    out.push_str(rest);
+    out
+}
+
+fn decode_entity(entity: &str) -> Option<char> {
+    if let Some(num) = entity.strip_prefix('#') {
+        let code = match num.strip_prefix(['x', 'X']) {
+            Some(hex) => u32::from_str_radix(hex, 16).ok()?,
+            None => num.parse().ok()?,
+        };
+        return char::from_u32(code);
+    }
+    Some(match entity {
+        "amp" => '&',
+        "lt" => '<',
+        "gt" => '>',
+        "quot" => '"',
+        "apos" => '\'',
+        "nbsp" => '\u{a0}',
+        "shy" => '\u{ad}',
+        "mdash" => '—',
+        "ndash" => '–',
+        "hellip" => '…',
+        "lsquo" => '‘',
+        "rsquo" => '’',
+        "ldquo" => '“',
+        "rdquo" => '”',
+        "copy" => '©',
+        "reg" => '®',
+        "trade" => '™',
+        "deg" => '°',
+        "middot" => '·',
+        "times" => '×',
+        "eacute" => 'é',
+        "egrave" => 'è',
+        "agrave" => 'à',
+        "ccedil" => 'ç',
+        "uuml" => 'ü',
+        "ouml" => 'ö',
+        "auml" => 'ä',
+        _ => return None,
+    })
+}
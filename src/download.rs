@@ -0,0 +1,110 @@
+use anyhow::{bail, Context, Result};
+use reqwest::header::CONTENT_TYPE;
+use reqwest::StatusCode;
+use std::fs::{self, File};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::Duration;
+use std::{env, process};
+
+// Whether an argument names a book on the web rather than a file.
+pub fn is_url(arg: &str) -> bool {
+    let scheme = arg.split_once("://").map(|(scheme, _)| scheme.to_ascii_lowercase());
+    matches!(scheme.as_deref(), Some("http" | "https"))
+}
+
+// The name of the book at `url`: the last segment of its path, with .epub
+// added when it doesn't end in it.
+pub fn file_name(url: &str) -> String {
+    let path = url.split(['?', '#']).next().unwrap_or_default();
+    let name = path.split_once("://").map_or(path, |(_, rest)| rest).split('/').skip(1).last();
+    let name = name.filter(|name| !name.is_empty()).unwrap_or("download");
+    match name.to_ascii_lowercase().ends_with(".epub") {
+        true => name.to_string(),
+        false => format!("{}.epub", name),
+    }
+}
+
+// An EPUB fetched into a temporary file, which is removed when this is
+// dropped.
+#[derive(Debug)]
+pub struct Download {
+    path: PathBuf,
+    /// The URL the book came from in the end, after redirects.
+    url: String,
+}
+
+impl Download {
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    // The name the book has on the server it was served from in the end.
+    pub fn file_name(&self) -> String {
+        file_name(&self.url)
+    }
+
+    // Copies the fetched book to `path`, refusing to replace a file unless
+    // `force` is set.
+    pub fn keep(&self, path: &Path, force: bool) -> Result<()> {
+        if path.exists() && !force {
+            bail!("{} already exists (use --force to overwrite it)", path.display());
+        }
+        fs::copy(&self.path, path).with_context(|| format!("Failed to save the download to {}", path.display()))?;
+        Ok(())
+    }
+}
+
+impl Drop for Download {
+    fn drop(&mut self) {
+        let _ = fs::remove_file(&self.path);
+    }
+}
+
+// Fetches the EPUB at `url` into a temporary file, following redirects.
+// Fails on any answer but 200 OK, one with no response within `timeout`, a
+// body larger than `max_size` bytes, and a body that is neither served as
+// application/epub+zip nor starts like a zip archive.
+pub async fn fetch(url: &str, timeout: Duration, max_size: u64) -> Result<Download> {
+    let client = reqwest::Client::builder()
+        .timeout(timeout)
+        .user_agent(concat!("cipher/", env!("CARGO_PKG_VERSION")))
+        .build()
+        .context("Failed to set up the HTTP client")?;
+    let mut response = client.get(url).send().await.with_context(|| format!("Failed to download {}", url))?;
+    if response.status() != StatusCode::OK {
+        bail!("Failed to download {}: the server answered {}", url, response.status());
+    }
+    if response.content_length().is_some_and(|len| len > max_size) {
+        bail!("{} is larger than the {} MiB limit", url, max_size / (1024 * 1024));
+    }
+    let content_type = response.headers().get(CONTENT_TYPE).and_then(|value| value.to_str().ok()).map(str::to_string);
+
+    // Several books can be downloading at once in the same process.
+    static DOWNLOADS: AtomicUsize = AtomicUsize::new(0);
+    let name = format!("cipher-download-{}-{}.epub", process::id(), DOWNLOADS.fetch_add(1, Ordering::Relaxed));
+    let download = Download { path: env::temp_dir().join(name), url: response.url().to_string() };
+    let mut file = File::create(&download.path)
+        .with_context(|| format!("Failed to create {}", download.path.display()))?;
+    let (mut size, mut head) = (0, Vec::<u8>::with_capacity(4));
+    while let Some(chunk) = response.chunk().await.with_context(|| format!("Failed to download {}", url))? {
+        size += chunk.len() as u64;
+        if size > max_size {
+            bail!("{} is larger than the {} MiB limit", url, max_size / (1024 * 1024));
+        }
+        head.extend(chunk.iter().take(4 - head.len()));
+        file.write_all(&chunk).with_context(|| format!("Failed to write {}", download.path.display()))?;
+    }
+    file.flush().with_context(|| format!("Failed to write {}", download.path.display()))?;
+
+    let epub = content_type.as_deref().is_some_and(|content_type| {
+        let mime = content_type.split(';').next().unwrap_or_default().trim();
+        mime.eq_ignore_ascii_case("application/epub+zip")
+    });
+    if !epub && head != b"PK\x03\x04" {
+        let served = content_type.unwrap_or_else(|| "no content type".to_string());
+        bail!("{} isn't an EPUB (the server sent {})", url, served);
+    }
+    Ok(download)
+}
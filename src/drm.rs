@@ -0,0 +1,100 @@
+use crate::dom;
+use crate::href;
+use anyhow::Result;
+use epub::doc::EpubDoc;
+use std::error::Error;
+use std::fmt;
+use std::io::{Read, Seek};
+use std::path::Path;
+
+pub(crate) const ENCRYPTION: &str = "META-INF/encryption.xml";
+const RIGHTS: &str = "META-INF/rights.xml";
+const LCP_LICENSE: &str = "META-INF/license.lcpl";
+
+// Font obfuscation only mangles embedded fonts; the text stays readable.
+const FONT_OBFUSCATION: &[&str] = &["http://www.idpf.org/2008/embedding", "http://ns.adobe.com/pdf/enc#RC"];
+
+// Returned when the book's content documents are encrypted, so that callers
+// can explain why instead of failing on unreadable markup; use
+// `downcast_ref::<DrmProtected>()` to tell it apart from other failures.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DrmProtected {
+    /// Archive paths of the encrypted resources.
+    pub encrypted: Vec<String>,
+    /// Whether the book carries Adobe ADEPT rights (META-INF/rights.xml).
+    pub adobe: bool,
+    /// Whether the book carries a Readium LCP license
+    /// (META-INF/license.lcpl).
+    pub readium: bool,
+}
+
+impl fmt::Display for DrmProtected {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match (self.adobe, self.readium) {
+            (true, _) => f.write_str("this book is DRM-protected (Adobe ADEPT) and cannot be converted"),
+            (false, true) => f.write_str("this book is DRM-protected (Readium LCP) and cannot be converted"),
+            (false, false) => f.write_str("this book is DRM-protected and cannot be converted"),
+        }
+    }
+}
+
+impl Error for DrmProtected {}
+
+// The resources META-INF/encryption.xml lists, by archive path: those that
+// are encrypted, and the fonts that are only obfuscated, which the text can be
+// converted without.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub(crate) struct Encryption {
+    pub encrypted: Vec<String>,
+    pub obfuscated: Vec<String>,
+}
+
+impl Encryption {
+    pub(crate) fn is_obfuscated(&self, path: &Path) -> bool {
+        self.obfuscated.iter().any(|font| Path::new(font) == path)
+    }
+}
+
+// Reads META-INF/encryption.xml. A book without one encrypts nothing.
+pub(crate) fn read<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Encryption {
+    match doc.get_resource_by_path(ENCRYPTION) {
+        Ok(bytes) => classify(&String::from_utf8_lossy(&bytes)),
+        Err(_) => Encryption::default(),
+    }
+}
+
+// Fails with `DrmProtected` when META-INF/encryption.xml encrypts anything
+// with an algorithm other than font obfuscation.
+pub(crate) fn check<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Result<()> {
+    let encrypted = read(doc).encrypted;
+    if encrypted.is_empty() {
+        return Ok(());
+    }
+    let adobe = doc.get_resource_by_path(RIGHTS).is_ok();
+    let readium = doc.get_resource_by_path(LCP_LICENSE).is_ok();
+    Err(DrmProtected { encrypted, adobe, readium }.into())
+}
+
+// Sorts the CipherReference URIs of each <EncryptedData> by its algorithm.
+pub(crate) fn classify(xml: &str) -> Encryption {
+    let mut encryption = Encryption::default();
+    dom::walk(&dom::parse(xml), &mut |el| {
+        if !el.is("EncryptedData") {
+            return;
+        }
+        let mut algorithm = None;
+        let mut uri = None;
+        dom::walk(&el.children, &mut |child| {
+            if child.is("EncryptionMethod") {
+                algorithm = child.attr("Algorithm").map(String::from);
+            } else if child.is("CipherReference") {
+                uri = child.attr("URI").map(href::percent_decode);
+            }
+        });
+        match algorithm.is_some_and(|algorithm| FONT_OBFUSCATION.contains(&algorithm.as_str())) {
+            true => encryption.obfuscated.extend(uri),
+            false => encryption.encrypted.push(uri.unwrap_or_default()),
+        }
+    });
+    encryption
+}
@@ -0,0 +1,61 @@
+use encoding_rs::{Encoding, UTF_8, WINDOWS_1252};
+
+// Content documents are usually UTF-8, but older books declare windows-1252,
+// ISO-8859-1 or, in Japanese and Chinese books, Shift_JIS or GBK in the XML
+// declaration or a <meta charset>, and some have no declaration at all.
+// Everything is decoded to UTF-8 here before parsing, so accented characters
+// and kana come through instead of turning into U+FFFD or mojibake.
+
+// How far into the document to look for a declaration.
+const SNIFF_LEN: usize = 1024;
+
+pub(crate) fn decode(bytes: &[u8]) -> String {
+    let (encoding, bytes) = match Encoding::for_bom(bytes) {
+        Some((encoding, bom_len)) => (encoding, &bytes[bom_len..]),
+        None => (declared(bytes).unwrap_or_else(|| detect(bytes)), bytes),
+    };
+    encoding.decode_without_bom_handling(bytes).0.into_owned()
+}
+
+// Without a usable declaration, bytes that aren't valid UTF-8 are taken to be
+// windows-1252, the usual encoding of such books.
+fn detect(bytes: &[u8]) -> &'static Encoding {
+    match std::str::from_utf8(bytes) {
+        Ok(_) => UTF_8,
+        Err(_) => WINDOWS_1252,
+    }
+}
+
+// The encoding named by the XML declaration or a <meta> tag near the start of
+// the document, when it's one we can decode.
+fn declared(bytes: &[u8]) -> Option<&'static Encoding> {
+    let head = String::from_utf8_lossy(&bytes[..bytes.len().min(SNIFF_LEN)]).to_ascii_lowercase();
+    if let Some(decl) = head.trim_start().strip_prefix("<?xml") {
+        let decl = &decl[..decl.find("?>").unwrap_or(decl.len())];
+        if let Some(name) = attr_value(decl, "encoding") {
+            return label(name);
+        }
+    }
+    head.match_indices("<meta").find_map(|(start, _)| {
+        let tag = &head[start..];
+        let tag = &tag[..tag.find('>').unwrap_or(tag.len())];
+        attr_value(tag, "charset").and_then(label)
+    })
+}
+
+// The value after `name=` in `text`, quoted or not. Also finds charset inside
+// content="text/html; charset=...".
+fn attr_value<'a>(text: &'a str, name: &str) -> Option<&'a str> {
+    let start = text.find(name)? + name.len();
+    let rest = text[start..].trim_start().strip_prefix('=')?.trim_start();
+    let rest = rest.trim_start_matches(['"', '\'']);
+    let end = rest.find(|c: char| c == '"' || c == '\'' || c == ';' || c == '/' || c == '>' || c.is_whitespace());
+    Some(&rest[..end.unwrap_or(rest.len())])
+}
+
+// Any WHATWG encoding label, which treat ISO-8859-1 and ASCII as windows-1252
+// just as browsers do. A document whose declaration could be read as ASCII
+// isn't UTF-16, whatever it says, so that is taken to mean UTF-8.
+fn label(name: &str) -> Option<&'static Encoding> {
+    Encoding::for_label(name.as_bytes()).map(Encoding::output_encoding)
+}
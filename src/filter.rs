@@ -0,0 +1,147 @@
+use crate::chapter;
+use crate::dom;
+use crate::matter::{self, Matter};
+use crate::nonlinear::Nonlinear;
+use crate::search::Pattern;
+use crate::{check_selection, opf, reading_positions, Options};
+use anyhow::Result;
+use epub::doc::EpubDoc;
+use std::collections::{HashMap, HashSet};
+use std::io::{Read, Seek};
+use std::path::{Path, PathBuf};
+
+// Which spine items `Options` converts, and in what order: the selection,
+// the non-linear items, the front and back matter, and the filters on titles
+// and hrefs. Whole-book conversion and `Chapters` both ask it, so they leave
+// out the same items.
+pub(crate) struct SpineFilter<'a> {
+    options: &'a Options,
+    /// The TOC title of each item, by archive path.
+    titles: &'a HashMap<PathBuf, String>,
+    root_base: PathBuf,
+    /// The non-linear items the policy moves or drops.
+    nonlinear: HashSet<String>,
+    matter: HashMap<String, Matter>,
+    /// The titles of the items `leaves_out` left out.
+    left_out: Vec<String>,
+}
+
+impl<'a> SpineFilter<'a> {
+    // Fails for a selection past the end of the spine.
+    pub(crate) fn new<R: Read + Seek>(
+        doc: &mut EpubDoc<R>,
+        options: &'a Options,
+        titles: &'a HashMap<PathBuf, String>,
+    ) -> Result<SpineFilter<'a>> {
+        if let Some(selection) = &options.chapters {
+            check_selection(selection, doc.spine.len())?;
+        }
+        // A selection names spine positions outright, so it picks non-linear
+        // items like any other.
+        let nonlinear = match options.nonlinear == Nonlinear::Include || options.chapters.is_some() {
+            true => HashSet::new(),
+            false => opf::nonlinear(doc),
+        };
+        let matter = match (options.skip_front_matter || options.skip_back_matter) && options.chapters.is_none() {
+            true => matter::classify(doc, &options.keep),
+            false => HashMap::new(),
+        };
+        Ok(SpineFilter {
+            options,
+            titles,
+            root_base: doc.root_base.clone(),
+            nonlinear,
+            matter,
+            left_out: Vec::new(),
+        })
+    }
+
+    // The spine positions, counting from 0, in the order they're converted:
+    // the non-linear items go to the end as an appendix, or are dropped.
+    pub(crate) fn order(&self, spine_ids: &[String]) -> Vec<usize> {
+        reading_positions(spine_ids, &self.nonlinear, self.options.nonlinear)
+    }
+
+    // Whether the item at `index` (counting from 0) is left out before it's
+    // read: by the selection, as a dropped non-linear item, as skipped front
+    // or back matter, or by its TOC title or href. `path` is None for an item
+    // missing from the manifest.
+    pub(crate) fn skips(&self, index: usize, idref: &str, path: Option<&Path>) -> bool {
+        let options = self.options;
+        if options.chapters.as_ref().is_some_and(|selection| !selection.contains(index + 1)) {
+            return true;
+        }
+        let shown = path.unwrap_or(Path::new(idref));
+        let shown = shown.strip_prefix(&self.root_base).unwrap_or(shown).display();
+        if self.nonlinear.contains(idref) && options.nonlinear == Nonlinear::Drop {
+            info!("skipping non-linear spine item {}", shown);
+            return true;
+        }
+        let skip_matter = |matter: &&Matter| match matter {
+            Matter::Front => options.skip_front_matter,
+            Matter::Back => options.skip_back_matter,
+        };
+        if let Some(matter) = self.matter.get(idref).filter(skip_matter) {
+            info!("skipping {} {}", matter, shown);
+            return true;
+        }
+        let Some(path) = path else {
+            return false;
+        };
+        let href = self.href(path);
+        let skipped = |title: &&String| options.skip_titles.iter().any(|pattern| pattern.is_match(title));
+        if let Some(title) = self.titles.get(path).filter(skipped) {
+            info!("skipping {}, titled {:?}", href, title);
+            return true;
+        }
+        if options.skip_hrefs.iter().any(|pattern| pattern.is_match(&href)) {
+            info!("skipping {} by its href", href);
+            return true;
+        }
+        false
+    }
+
+    // Whether any item is matched against --match and --exclude, which need
+    // its HTML for the title it gives itself.
+    pub(crate) fn filtering(&self) -> bool {
+        !self.options.match_chapters.is_empty() || !self.options.exclude_chapters.is_empty()
+    }
+
+    // Whether --match and --exclude leave out the item read from `path`,
+    // whose HTML is None when it couldn't be read.
+    pub(crate) fn leaves_out(&mut self, path: &Path, html: Option<&str>) -> bool {
+        if !self.filtering() {
+            return false;
+        }
+        let href = self.href(path);
+        let own = html.and_then(|html| chapter::html_heading(&dom::parse(html)).or_else(|| chapter::html_title(html)));
+        let title = chapter::resolve_title(self.titles.get(path), own, &href);
+        let matches = |patterns: &[Pattern]| {
+            patterns.iter().any(|pattern| pattern.is_match(&title) || pattern.is_match(&href))
+        };
+        let wanted = self.options.match_chapters.is_empty() || matches(&self.options.match_chapters);
+        if wanted && !matches(&self.options.exclude_chapters) {
+            return false;
+        }
+        info!("leaving out {}, titled {:?}", href, title);
+        self.left_out.push(title);
+        true
+    }
+
+    // Fails when --match and --exclude left out every item there was,
+    // naming a few of them; `kept` is the number of items left in.
+    pub(crate) fn check_kept(&self, kept: usize) -> Result<()> {
+        if !self.filtering() || kept > 0 || self.left_out.is_empty() {
+            return Ok(());
+        }
+        let mut titles: Vec<String> = self.left_out.iter().take(5).map(|title| format!("{:?}", title)).collect();
+        if self.left_out.len() > titles.len() {
+            titles.push(format!("and {} more", self.left_out.len() - titles.len()));
+        }
+        anyhow::bail!("No chapter matches the title and href filters; the book has {}", titles.join(", "))
+    }
+
+    fn href(&self, path: &Path) -> String {
+        path.strip_prefix(&self.root_base).unwrap_or(path).to_string_lossy().into_owned()
+    }
+}
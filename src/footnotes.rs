@@ -0,0 +1,252 @@
+use crate::dom::{self, Element, Node};
+use crate::href;
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+
+const CONTAINER_TYPES: &[&str] = &["footnotes", "endnotes", "rearnotes", "doc-endnotes"];
+
+// A note body pulled out of the chapter, numbered in order of first reference.
+pub(crate) struct Note {
+    pub number: usize,
+    pub html: String,
+}
+
+// Where a note lives: the archive path of its file and its id there.
+type NoteId = (PathBuf, String);
+
+// Notes that live in another file of the book, such as a notes.xhtml at the
+// end, keyed by where they live. Chapters that refer to them take a copy, and
+// the file they came from drops them.
+#[derive(Debug, Default)]
+pub(crate) struct NoteFiles {
+    notes: HashMap<NoteId, Element>,
+}
+
+impl NoteFiles {
+    // Finds the notes that `chapters` refer to in other files, reading those
+    // files with `read` (which returns None when a file can't be read).
+    pub(crate) fn load<'a, I, F>(chapters: I, mut read: F) -> NoteFiles
+    where
+        I: IntoIterator<Item = (&'a Path, &'a str)>,
+        F: FnMut(&Path) -> Option<String>,
+    {
+        let mut wanted: HashMap<PathBuf, HashSet<String>> = HashMap::new();
+        for (path, html) in chapters {
+            if !html.contains("noteref") && !html.contains("#fn") {
+                continue;
+            }
+            dom::walk(&dom::parse(html), &mut |el| {
+                if let Some((target, id)) = note_target(el, path) {
+                    if target != href::normalize(path) {
+                        wanted.entry(target).or_default().insert(id);
+                    }
+                }
+            });
+        }
+
+        let mut files = NoteFiles::default();
+        for (path, ids) in wanted {
+            let Some(html) = read(&path) else {
+                continue;
+            };
+            dom::walk(&dom::parse(&html), &mut |el| {
+                if let Some(id) = el.attr("id").filter(|id| ids.contains(*id)) {
+                    files.notes.entry((path.clone(), id.to_string())).or_insert_with(|| el.clone());
+                }
+            });
+        }
+        files
+    }
+
+    fn get(&self, path: &Path, id: &str) -> Option<&Element> {
+        self.notes.get(&(path.to_path_buf(), id.to_string()))
+    }
+
+    // Ids of the notes in `path` that other chapters take.
+    fn moved_from(&self, path: &Path) -> HashSet<String> {
+        let path = href::normalize(path);
+        self.notes.keys().filter(|(p, _)| *p == path).map(|(_, id)| id.clone()).collect()
+    }
+}
+
+fn semantics(el: &Element) -> impl Iterator<Item = &str> {
+    let epub_type = el.attr("epub:type").unwrap_or_default().split_whitespace();
+    epub_type.chain(el.attr("role").unwrap_or_default().split_whitespace())
+}
+
+fn is_noteref(el: &Element) -> bool {
+    el.is("a") && semantics(el).any(|t| t == "noteref" || t == "doc-noteref")
+}
+
+// Links written by tools that don't mark noterefs, such as pandoc's
+// <a href="#fn1" id="fnref1">, which point at an id starting with "fn".
+fn is_fn_link(el: &Element) -> bool {
+    let fragment = el.attr("href").and_then(|target| href::split_fragment(target).1).unwrap_or_default();
+    el.is("a") && fragment.starts_with("fn") && !fragment.starts_with("fnref")
+}
+
+fn is_note_container(el: &Element) -> bool {
+    el.has_class("footnotes") || semantics(el).any(|t| CONTAINER_TYPES.contains(&t))
+}
+
+// The note a noteref points at, as an archive path and id.
+fn note_target(el: &Element, chapter_path: &Path) -> Option<NoteId> {
+    if !is_noteref(el) && !is_fn_link(el) {
+        return None;
+    }
+    let target = el.attr("href")?;
+    let path = match href::split_fragment(target) {
+        ("", _) => href::normalize(chapter_path),
+        _ => href::resolve(chapter_path, target)?,
+    };
+    match href::split_fragment(target) {
+        (_, Some(id)) if !id.is_empty() => Some((path, id.to_string())),
+        _ => None,
+    }
+}
+
+// Replaces noterefs with a placeholder and removes the notes they point at,
+// returning them in reference order. Notes in the same chapter are found by
+// id and notes in other files come from `files`. Refs whose note can't be
+// found are left as they are.
+pub(crate) fn extract(nodes: &mut Vec<Node>, chapter_path: &Path, files: &NoteFiles) -> Vec<Note> {
+    let own_path = href::normalize(chapter_path);
+    let mut local_ids = HashSet::new();
+    let mut ref_ids = HashSet::new();
+    dom::walk(nodes, &mut |el| {
+        if let Some((path, id)) = note_target(el, chapter_path) {
+            if path == own_path {
+                local_ids.insert(id);
+            }
+            if let Some(ref_id) = el.attr("id") {
+                ref_ids.insert(ref_id.to_string());
+            }
+        }
+    });
+    let mut bodies: HashMap<String, Element> = HashMap::new();
+    dom::walk(nodes, &mut |el| {
+        if let Some(id) = el.attr("id").filter(|id| local_ids.contains(*id)) {
+            if !is_noteref(el) && !is_fn_link(el) {
+                bodies.entry(id.to_string()).or_insert_with(|| el.clone());
+            }
+        }
+    });
+
+    let mut numbers: HashMap<NoteId, usize> = HashMap::new();
+    let mut found = HashMap::new();
+    replace_refs(nodes, chapter_path, &mut |target: &NoteId| {
+        let body = match target.0 == own_path {
+            true => bodies.get(&target.1),
+            false => files.get(&target.0, &target.1),
+        }?;
+        let next = numbers.len() + 1;
+        let number = *numbers.entry(target.clone()).or_insert(next);
+        found.entry(number).or_insert_with(|| body.clone());
+        Some(number)
+    });
+
+    let mut notes: Vec<Note> = found
+        .into_iter()
+        .map(|(number, mut body)| {
+            remove_backlinks(&mut body.children, &ref_ids);
+            Note {
+                number,
+                html: dom::serialize(&body.children),
+            }
+        })
+        .collect();
+    notes.sort_by_key(|note| note.number);
+
+    let mut removed: HashSet<String> =
+        numbers.into_keys().filter(|(path, _)| *path == own_path).map(|(_, id)| id).collect();
+    removed.extend(files.moved_from(chapter_path));
+    if !removed.is_empty() {
+        remove_notes(nodes, &removed);
+        remove_empty_containers(nodes);
+    }
+    notes
+}
+
+fn replace_refs<F: FnMut(&NoteId) -> Option<usize>>(nodes: &mut [Node], chapter_path: &Path, number: &mut F) {
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        let Some(target) = note_target(el, chapter_path) else {
+            replace_refs(&mut el.children, chapter_path, number);
+            continue;
+        };
+        if let Some(n) = number(&target) {
+            *node = Node::Text(placeholder(n));
+        }
+    }
+}
+
+fn remove_notes(nodes: &mut Vec<Node>, ids: &HashSet<String>) {
+    nodes.retain(|node| match node {
+        Node::Element(el) => !el.attr("id").is_some_and(|id| ids.contains(id)),
+        _ => true,
+    });
+    for node in nodes.iter_mut() {
+        if let Node::Element(el) = node {
+            remove_notes(&mut el.children, ids);
+        }
+    }
+}
+
+// Drops footnote sections left with nothing but rules and whitespace once
+// their notes have been taken out.
+fn remove_empty_containers(nodes: &mut Vec<Node>) {
+    nodes.retain(|node| match node {
+        Node::Element(el) if is_note_container(el) => !dom::text_content(&el.children).is_empty(),
+        _ => true,
+    });
+    for node in nodes.iter_mut() {
+        if let Node::Element(el) = node {
+            remove_empty_containers(&mut el.children);
+        }
+    }
+}
+
+// Drops links from a note back to its noteref, which would dangle once the
+// note moves to the end of the chapter.
+fn remove_backlinks(nodes: &mut Vec<Node>, ref_ids: &HashSet<String>) {
+    nodes.retain(|node| match node {
+        Node::Element(el) if el.is("a") => match el.attr("href").map(href::split_fragment) {
+            Some((_, Some(id))) => !ref_ids.contains(id),
+            _ => true,
+        },
+        _ => true,
+    });
+    for node in nodes.iter_mut() {
+        if let Node::Element(el) = node {
+            remove_backlinks(&mut el.children, ref_ids);
+        }
+    }
+}
+
+pub(crate) fn placeholder(number: usize) -> String {
+    format!("CIPHERNOTEREF{}X", number)
+}
+
+// Swaps the placeholders for `[^n]` references and appends the definitions,
+// indenting continuation lines so multi-paragraph notes stay in one footnote.
+pub(crate) fn restore(markdown: &str, notes: &[(usize, String)]) -> String {
+    let mut markdown = markdown.to_string();
+    for (number, _) in notes {
+        markdown = markdown.replace(&placeholder(*number), &format!("[^{}]", number));
+    }
+    for (number, body) in notes {
+        let mut lines = body.trim().lines();
+        let first = lines.next().unwrap_or_default();
+        markdown.push_str(&format!("\n\n[^{}]: {}", number, first));
+        for line in lines {
+            markdown.push('\n');
+            if !line.trim().is_empty() {
+                markdown.push_str("    ");
+                markdown.push_str(line);
+            }
+        }
+    }
+    markdown
+}
@@ -0,0 +1,52 @@
+use std::fmt;
+use std::str::FromStr;
+
+// What the converted book is written out as.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Format {
+    #[default]
+    Markdown,
+    /// Plain text, see `text::to_text`.
+    Text,
+    /// Markdown styled for the terminal with ANSI escapes, see `render::Renderer`.
+    Ansi,
+    /// One JSON object with the metadata and every chapter, see `json::to_json`.
+    Json,
+    /// One JSON object per chapter and line, see `json::to_ndjson`.
+    Ndjson,
+    /// One self-contained HTML document, see `html::to_html`.
+    Html,
+    /// An Emacs Org document, see `org::to_org`.
+    Org,
+}
+
+impl FromStr for Format {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "md" | "markdown" => Ok(Format::Markdown),
+            "txt" | "text" => Ok(Format::Text),
+            "ansi" => Ok(Format::Ansi),
+            "json" => Ok(Format::Json),
+            "ndjson" | "jsonl" => Ok(Format::Ndjson),
+            "html" => Ok(Format::Html),
+            "org" => Ok(Format::Org),
+            _ => Err(format!("invalid format {} (expected md, txt, ansi, json, ndjson, html or org)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Format {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Format::Markdown => f.write_str("md"),
+            Format::Text => f.write_str("txt"),
+            Format::Ansi => f.write_str("ansi"),
+            Format::Json => f.write_str("json"),
+            Format::Ndjson => f.write_str("ndjson"),
+            Format::Html => f.write_str("html"),
+            Format::Org => f.write_str("org"),
+        }
+    }
+}
@@ -0,0 +1,109 @@
+use crate::dom;
+use crate::encoding;
+use crate::href;
+use crate::opf::Package;
+use epub::doc::EpubDoc;
+use serde::Serialize;
+use std::io::{Read, Seek};
+use std::path::{Path, PathBuf};
+
+// Reference types (EPUB2) and landmark epub:types (EPUB3) marking where the
+// text of the book starts, past the cover, title page and contents.
+const START_TYPES: &[&str] = &["text", "start", "bodymatter"];
+
+// A page the book names as a landmark: its cover, table of contents, the
+// start of the text and so on. EPUB2 books list them in the package
+// document's <guide>, and EPUB3 books in the navigation document's <nav
+// epub:type="landmarks">.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct GuideRef {
+    /// The reference type or epub:type, e.g. cover, toc, text or bodymatter.
+    pub kind: String,
+    /// The guide's title attribute or the landmark's link text. Empty when
+    /// the book gives none.
+    pub title: String,
+    /// The page's path relative to the package document, with the fragment
+    /// when the reference has one, as it appears in `Items`.
+    pub href: String,
+    pub source: GuideSource,
+    /// The page's path in the archive.
+    #[serde(skip)]
+    pub(crate) path: PathBuf,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum GuideSource {
+    Guide,
+    Landmarks,
+}
+
+impl GuideRef {
+    // A reference to `target`, as written in the document at `base`. None
+    // for external links and pure fragments. Its href is the archive path
+    // until `read` makes it relative.
+    pub(crate) fn new(kind: &str, title: &str, target: &str, base: &Path, source: GuideSource) -> Option<GuideRef> {
+        let path = href::resolve(base, target)?;
+        let href = match href::split_fragment(target) {
+            (_, Some(fragment)) => format!("{}#{}", path.display(), fragment),
+            (_, None) => path.display().to_string(),
+        };
+        Some(GuideRef {
+            kind: kind.to_string(),
+            title: title.split_whitespace().collect::<Vec<_>>().join(" "),
+            href,
+            source,
+            path,
+        })
+    }
+
+    pub(crate) fn is_start(&self) -> bool {
+        START_TYPES.contains(&self.kind.as_str())
+    }
+}
+
+// The book's landmarks, then its guide, since EPUB3 books that have both
+// keep the guide for older readers.
+pub(crate) fn read<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Vec<GuideRef> {
+    let package = Package::load(doc).unwrap_or_default();
+    let mut references = landmarks(doc, &package);
+    references.extend(package.guide);
+    let root_base = doc.root_base.clone();
+    for reference in references.iter_mut() {
+        if let Ok(relative) = Path::new(&reference.href).strip_prefix(&root_base) {
+            reference.href = relative.to_string_lossy().into_owned();
+        }
+    }
+    references
+}
+
+// The entries of the EPUB3 navigation document's <nav epub:type="landmarks">,
+// when the book has one.
+pub(crate) fn landmarks<R: Read + Seek>(doc: &mut EpubDoc<R>, package: &Package) -> Vec<GuideRef> {
+    let Some(nav) = package.item_with_property("nav").map(|item| item.path.clone()) else {
+        return Vec::new();
+    };
+    match doc.get_resource_by_path(&nav) {
+        Ok(bytes) => parse_landmarks(&encoding::decode(&bytes), &nav),
+        Err(_) => Vec::new(),
+    }
+}
+
+fn parse_landmarks(html: &str, nav_path: &Path) -> Vec<GuideRef> {
+    let mut landmarks = Vec::new();
+    dom::walk(&dom::parse(html), &mut |el| {
+        let is_landmarks = el.attr("epub:type").is_some_and(|t| t.split_whitespace().any(|t| t == "landmarks"));
+        if !el.is("nav") || !is_landmarks {
+            return;
+        }
+        dom::walk(&el.children, &mut |a| {
+            let (true, Some(kinds), Some(target)) = (a.is("a"), a.attr("epub:type"), a.attr("href")) else {
+                return;
+            };
+            for kind in kinds.split_whitespace() {
+                landmarks.extend(GuideRef::new(kind, &a.text(), target, nav_path, GuideSource::Landmarks));
+            }
+        });
+    });
+    landmarks
+}
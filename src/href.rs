@@ -0,0 +1,68 @@
+use std::path::{Component, Path, PathBuf};
+
+// Returns true for hrefs that point outside the book (http:, mailto:, data:, ...).
+pub(crate) fn is_external(href: &str) -> bool {
+    match href.find(':') {
+        Some(colon) => {
+            let scheme = &href[..colon];
+            !scheme.is_empty() && scheme.chars().all(|c| c.is_ascii_alphanumeric() || "+-.".contains(c))
+        }
+        None => href.starts_with("//"),
+    }
+}
+
+// Splits "chapter.xhtml#frag" into the path and the optional fragment.
+pub(crate) fn split_fragment(href: &str) -> (&str, Option<&str>) {
+    match href.split_once('#') {
+        Some((path, fragment)) => (path, Some(fragment)),
+        None => (href, None),
+    }
+}
+
+// Resolves an href found in the document at `base` to a normalized archive
+// path. External links and pure fragments resolve to None.
+pub(crate) fn resolve(base: &Path, href: &str) -> Option<PathBuf> {
+    if is_external(href) {
+        return None;
+    }
+    let (path, _) = split_fragment(href);
+    let path = path.split('?').next().unwrap_or_default();
+    if path.is_empty() {
+        return None;
+    }
+    let joined = base.parent().unwrap_or_else(|| Path::new("")).join(percent_decode(path));
+    Some(normalize(&joined))
+}
+
+pub(crate) fn normalize(path: &Path) -> PathBuf {
+    let mut out = PathBuf::new();
+    for component in path.components() {
+        match component {
+            Component::ParentDir => {
+                out.pop();
+            }
+            Component::CurDir | Component::RootDir | Component::Prefix(_) => {}
+            Component::Normal(part) => out.push(part),
+        }
+    }
+    out
+}
+
+pub(crate) fn percent_decode(s: &str) -> String {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        if bytes[i] == b'%' && i + 2 < bytes.len() {
+            let hex = std::str::from_utf8(&bytes[i + 1..i + 3]).ok();
+            if let Some(b) = hex.and_then(|hex| u8::from_str_radix(hex, 16).ok()) {
+                out.push(b);
+                i += 3;
+                continue;
+            }
+        }
+        out.push(bytes[i]);
+        i += 1;
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
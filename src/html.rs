@@ -0,0 +1,123 @@
+use crate::direction::Direction;
+use crate::dom::{escape_attr, escape_text};
+use crate::metadata::Metadata;
+use pulldown_cmark::{html, CowStr, Event, Options, Parser, Tag, TagEnd};
+
+// Enough style to read comfortably in a browser: a narrow measure, images
+// that fit the page, and code, quotes and tables set off from the text.
+const STYLESHEET: &str = "\
+body { max-width: 40em; margin: 0 auto; padding: 1em; font: 1.1em/1.6 Georgia, serif; color: #222; \
+background: #fdfdfb; }
+h1, h2, h3, h4, h5, h6 { line-height: 1.25; }
+img, svg { max-width: 100%; height: auto; }
+pre { overflow-x: auto; padding: 0.5em; background: #f3f3f0; }
+code { font-size: 0.9em; }
+blockquote { margin-left: 0; padding-left: 1em; border-left: 3px solid #ccc; color: #555; }
+table { border-collapse: collapse; }
+th, td { padding: 0.25em 0.5em; border: 1px solid #ccc; }
+nav#toc { margin-bottom: 2em; padding-bottom: 1em; border-bottom: 1px solid #ccc; }
+nav#toc ul { padding-left: 1.5em; }
+";
+
+// Turns the converted book into one HTML document that opens on its own,
+// offline: the metadata in <title> and <meta> tags, a nav at the top linking
+// to the chapters, and a stylesheet inlined. The markdown should be converted
+// with `Options::heading_ids`, which gives the headings the ids the nav and
+// the links between chapters point at, and without front matter, which the
+// <head> replaces. The nav lists the top two levels of headings.
+pub fn to_html(metadata: &Metadata, markdown: &str) -> String {
+    let options = Options::ENABLE_TABLES
+        | Options::ENABLE_FOOTNOTES
+        | Options::ENABLE_STRIKETHROUGH
+        | Options::ENABLE_HEADING_ATTRIBUTES
+        | Options::ENABLE_DEFINITION_LIST;
+    let events: Vec<Event> = Parser::new_ext(markdown, options).collect();
+    let mut body = String::new();
+    html::push_html(&mut body, events.iter().cloned());
+
+    let mut out = String::from("<!DOCTYPE html>\n<html");
+    if let Some(language) = metadata.language.as_deref().filter(|language| !language.trim().is_empty()) {
+        out.push_str(&format!(" lang=\"{}\"", escape_attr(language.trim())));
+    }
+    if metadata.direction == Some(Direction::Rtl) {
+        out.push_str(" dir=\"rtl\"");
+    }
+    out.push_str(">\n<head>\n<meta charset=\"utf-8\">\n");
+    out.push_str("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n");
+    let title = metadata.title.as_deref().filter(|title| !title.trim().is_empty()).unwrap_or("Untitled");
+    out.push_str(&format!("<title>{}</title>\n", escape_text(title.trim())));
+    let mut meta: Vec<(&str, &str)> = metadata.creators.iter().map(|creator| ("author", creator.as_str())).collect();
+    let fields = [
+        ("description", &metadata.description),
+        ("dcterms.publisher", &metadata.publisher),
+        ("dcterms.date", &metadata.date),
+    ];
+    meta.extend(fields.into_iter().filter_map(|(name, value)| Some((name, value.as_deref()?))));
+    meta.extend(metadata.identifiers.iter().map(|identifier| ("dcterms.identifier", identifier.as_str())));
+    for (name, content) in meta {
+        let content = content.split_whitespace().collect::<Vec<_>>().join(" ");
+        out.push_str(&format!("<meta name=\"{}\" content=\"{}\">\n", name, escape_attr(&content)));
+    }
+    out.push_str(&format!("<style>\n{}</style>\n</head>\n<body>\n", STYLESHEET));
+    out.push_str(&nav(&headings(&events)));
+    out.push_str("<main>\n");
+    out.push_str(&body);
+    out.push_str("</main>\n</body>\n</html>\n");
+    out
+}
+
+// The level, id and escaped text of each heading that has an id.
+fn headings(events: &[Event]) -> Vec<(usize, String, String)> {
+    let mut headings = Vec::new();
+    let mut current: Option<(usize, CowStr, String)> = None;
+    for event in events {
+        match (event, current.as_mut()) {
+            (Event::Start(Tag::Heading { level, id: Some(id), .. }), _) => {
+                current = Some((*level as usize, id.clone(), String::new()));
+            }
+            (Event::Text(text) | Event::Code(text), Some((_, _, heading))) => heading.push_str(&escape_text(text)),
+            (Event::End(TagEnd::Heading(_)), Some(_)) => {
+                let (level, id, text) = current.take().unwrap();
+                headings.push((level, id.to_string(), text.split_whitespace().collect::<Vec<_>>().join(" ")));
+            }
+            _ => {}
+        }
+    }
+    headings
+}
+
+// The table of contents, the top level of headings with the level below
+// nested under each. Empty for a book without headings.
+fn nav(headings: &[(usize, String, String)]) -> String {
+    let Some(top) = headings.iter().map(|(level, _, _)| *level).min() else {
+        return String::new();
+    };
+    let mut out = String::from("<nav id=\"toc\">\n<ul>\n");
+    let (mut in_item, mut in_sublist) = (false, false);
+    for (level, id, text) in headings.iter().filter(|(level, _, _)| *level <= top + 1) {
+        let link = format!("<li><a href=\"#{}\">{}</a>", escape_attr(id), text);
+        if *level == top {
+            match (in_sublist, in_item) {
+                (true, _) => out.push_str("</ul></li>\n"),
+                (false, true) => out.push_str("</li>\n"),
+                _ => {}
+            }
+            out.push_str(&link);
+            (in_item, in_sublist) = (true, false);
+        } else {
+            if !in_sublist {
+                out.push_str(if in_item { "\n<ul>\n" } else { "<li>\n<ul>\n" });
+                (in_item, in_sublist) = (true, true);
+            }
+            out.push_str(&link);
+            out.push_str("</li>\n");
+        }
+    }
+    match (in_sublist, in_item) {
+        (true, _) => out.push_str("</ul></li>\n"),
+        (false, true) => out.push_str("</li>\n"),
+        _ => {}
+    }
+    out.push_str("</ul>\n</nav>\n");
+    out
+}
@@ -0,0 +1,524 @@
+use crate::dom::{self, Element, Node};
+use crate::drm;
+use crate::href;
+use anyhow::{Context, Result};
+use epub::doc::EpubDoc;
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::fs;
+use std::io::{Read, Seek};
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+#[derive(Debug, Clone)]
+pub struct ImageOptions {
+    /// Directory the image files are written to.
+    pub dir: PathBuf,
+    /// Prefix for rewritten image links, usually `dir` relative to the markdown file.
+    pub link_prefix: String,
+}
+
+// Where a <figure>'s <figcaption> goes in the markdown.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum FigureCaption {
+    /// An italic line under the figure's images.
+    #[default]
+    Italic,
+    /// The title of each of the figure's images, ![alt](src "caption").
+    /// Figures without images still get an italic line.
+    Title,
+}
+
+impl FromStr for FigureCaption {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "italic" => Ok(FigureCaption::Italic),
+            "title" => Ok(FigureCaption::Title),
+            _ => Err(format!("invalid figure caption style {} (expected italic or title)", s)),
+        }
+    }
+}
+
+impl fmt::Display for FigureCaption {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            FigureCaption::Italic => f.write_str("italic"),
+            FigureCaption::Title => f.write_str("title"),
+        }
+    }
+}
+
+pub(crate) fn is_image(media_type: &str) -> bool {
+    media_type.starts_with("image/")
+}
+
+// The link to use for each image archive path. None leaves the links to that
+// image as they are.
+pub(crate) type Links = HashMap<PathBuf, Option<String>>;
+
+// The image manifest items as (id, path, media type), ordered by path. Items
+// that are obfuscated would only come out as garbage, and are left out.
+fn image_items<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Vec<(String, PathBuf, String)> {
+    let encryption = drm::read(doc);
+    let mut items: Vec<(String, PathBuf, String)> = doc
+        .resources
+        .iter()
+        .filter(|(_, (_, media_type))| is_image(media_type))
+        .filter(|(_, (path, _))| {
+            let obfuscated = encryption.is_obfuscated(path);
+            if obfuscated {
+                info!("skipping {}, which is obfuscated", path.display());
+            }
+            !obfuscated
+        })
+        .map(|(id, (path, media_type))| (id.clone(), path.clone(), media_type.clone()))
+        .collect();
+    items.sort_by(|a, b| a.1.cmp(&b.1));
+    items
+}
+
+// Writes every image manifest item into `options.dir` and returns the link to
+// use for each archive path. Items missing from the archive are reported and skipped.
+pub(crate) fn extract<R: Read + Seek>(doc: &mut EpubDoc<R>, options: &ImageOptions) -> Result<Links> {
+    fs::create_dir_all(&options.dir).with_context(|| format!("Failed to create {}", options.dir.display()))?;
+
+    let mut used = HashSet::new();
+    let mut links = HashMap::new();
+    for (id, path, _) in image_items(doc) {
+        if links.contains_key(&path) {
+            continue;
+        }
+        let bytes = match doc.get_resource(&id) {
+            Ok(bytes) => bytes,
+            Err(e) => {
+                warn!("image {} is missing from the archive: {}", path.display(), e);
+                continue;
+            }
+        };
+        let name = unique_name(&path, &mut used);
+        let dst = options.dir.join(&name);
+        fs::write(&dst, bytes).with_context(|| format!("Failed to write {}", dst.display()))?;
+        links.insert(path, Some(link(&options.link_prefix, &name)));
+    }
+    info!("wrote {} images to {}", links.len(), options.dir.display());
+    Ok(links)
+}
+
+// Returns a data: URI holding each image manifest item, so the markdown needs
+// no image files next to it. Images larger than `max_bytes` would bloat the
+// output, so they're reported and their links left alone.
+pub(crate) fn embed<R: Read + Seek>(doc: &mut EpubDoc<R>, max_bytes: u64) -> Links {
+    let mut links = HashMap::new();
+    for (id, path, media_type) in image_items(doc) {
+        if links.contains_key(&path) {
+            continue;
+        }
+        let bytes = match doc.get_resource(&id) {
+            Ok(bytes) => bytes,
+            Err(e) => {
+                warn!("image {} is missing from the archive: {}", path.display(), e);
+                continue;
+            }
+        };
+        let uri = match bytes.len() as u64 {
+            len if len > max_bytes => {
+                warn!("not embedding image {}: {} bytes is over the {} byte limit", path.display(), len, max_bytes);
+                None
+            }
+            _ => Some(data_uri(&media_type, &bytes)),
+        };
+        links.insert(path, uri);
+    }
+    info!("embedded {} of {} images", links.values().filter(|uri| uri.is_some()).count(), links.len());
+    links
+}
+
+fn data_uri(media_type: &str, bytes: &[u8]) -> String {
+    let media_type = media_type.split(';').next().unwrap_or_default().trim();
+    format!("data:{};base64,{}", media_type, base64(bytes))
+}
+
+const BASE64: &[u8; 64] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+// Standard base64 with padding.
+fn base64(bytes: &[u8]) -> String {
+    let mut out = String::with_capacity(bytes.len().div_ceil(3) * 4);
+    for chunk in bytes.chunks(3) {
+        let n = chunk.iter().enumerate().fold(0u32, |n, (i, &b)| n | u32::from(b) << (16 - 8 * i));
+        for i in 0..4 {
+            match i <= chunk.len() {
+                true => out.push(char::from(BASE64[(n >> (18 - 6 * i) & 0x3F) as usize])),
+                false => out.push('='),
+            }
+        }
+    }
+    out
+}
+
+fn unique_name(path: &Path, used: &mut HashSet<String>) -> String {
+    let file_name = path.file_name().map(|n| n.to_string_lossy().into_owned()).unwrap_or_else(|| "image".to_string());
+    let (stem, ext) = match file_name.rsplit_once('.') {
+        Some((stem, ext)) if !stem.is_empty() => (stem.to_string(), format!(".{}", ext)),
+        _ => (file_name.clone(), String::new()),
+    };
+    let mut name = file_name;
+    let mut n = 2;
+    while !used.insert(name.clone()) {
+        name = format!("{}-{}{}", stem, n, ext);
+        n += 1;
+    }
+    name
+}
+
+fn link(prefix: &str, name: &str) -> String {
+    let name = name.replace(' ', "%20");
+    match prefix.trim_end_matches('/') {
+        "" => name,
+        prefix => format!("{}/{}", prefix, name),
+    }
+}
+
+// Takes each <figure> apart into paragraphs of their own, one for each image
+// and one for the rest of what it holds, since html2md runs a figure's caption
+// into the text before it. The caption becomes an italic line under all of
+// them or the title of each image, following `style`. Images without alt
+// text take the caption's, or failing that their file name; an empty alt, as
+// decorative images have, is kept empty. Runs before the image links are
+// rewritten, so that the file names are the book's own.
+pub(crate) fn caption_figures(nodes: &mut Vec<Node>, style: FigureCaption) {
+    unwrap_figures(nodes, style);
+    dom::walk_mut(nodes, &mut |el| {
+        if !el.is("img") || el.attr("alt").is_some() {
+            return;
+        }
+        let name = el
+            .attr("src")
+            .filter(|src| !src.starts_with("data:"))
+            .map(|src| href::split_fragment(src).0.rsplit('/').next().unwrap_or_default())
+            .map(href::percent_decode);
+        if let Some(name) = name.filter(|name| !name.is_empty()) {
+            el.set_attr("alt", &name);
+        }
+    });
+}
+
+fn unwrap_figures(nodes: &mut Vec<Node>, style: FigureCaption) {
+    let mut out = Vec::with_capacity(nodes.len());
+    for node in std::mem::take(nodes) {
+        match node {
+            Node::Element(el) if el.is("pre") || el.is("code") => out.push(Node::Element(el)),
+            Node::Element(mut el) => {
+                unwrap_figures(&mut el.children, style);
+                match el.is("figure") {
+                    true => out.extend(unwrap_figure(el, style)),
+                    false => out.push(Node::Element(el)),
+                }
+            }
+            node => out.push(node),
+        }
+    }
+    *nodes = out;
+}
+
+fn unwrap_figure(mut figure: Element, style: FigureCaption) -> Vec<Node> {
+    let mut caption = None;
+    figure.children.retain(|node| match node {
+        Node::Element(el) if el.is("figcaption") => {
+            caption = caption.take().or_else(|| Some(el.text()).filter(|text| !text.is_empty()));
+            false
+        }
+        _ => true,
+    });
+    let mut images = 0;
+    dom::walk_mut(&mut figure.children, &mut |el| {
+        if !el.is("img") {
+            return;
+        }
+        images += 1;
+        if let Some(caption) = &caption {
+            if el.attr("alt").is_none() {
+                el.set_attr("alt", caption);
+            }
+            if style == FigureCaption::Title && el.attr("title").is_none() {
+                el.set_attr("title", caption);
+            }
+        }
+    });
+
+    let mut out = Vec::new();
+    let mut text = Element::new("p");
+    let flush = |text: &mut Element, out: &mut Vec<Node>| {
+        if text.children.iter().any(|node| !matches!(node, Node::Text(t) if t.trim().is_empty())) {
+            out.push(Node::Element(std::mem::replace(text, Element::new("p"))));
+        }
+        text.children.clear();
+    };
+    for node in figure.children {
+        match node {
+            Node::Element(el) if el.is("img") => {
+                flush(&mut text, &mut out);
+                let mut paragraph = Element::new("p");
+                paragraph.children.push(Node::Element(el));
+                out.push(Node::Element(paragraph));
+            }
+            Node::Element(el) if FIGURE_BLOCKS.iter().any(|name| el.is(name)) => {
+                flush(&mut text, &mut out);
+                out.push(Node::Element(el));
+            }
+            node => text.children.push(node),
+        }
+    }
+    flush(&mut text, &mut out);
+    if let Some(caption) = caption.filter(|_| style == FigureCaption::Italic || images == 0) {
+        let mut em = Element::new("em");
+        em.children.push(Node::Text(dom::escape_text(&caption)));
+        let mut paragraph = Element::new("p");
+        paragraph.children.push(Node::Element(em));
+        out.push(Node::Element(paragraph));
+    }
+    out
+}
+
+// What a figure can hold besides its images that stands as a block of its own.
+const FIGURE_BLOCKS: &[&str] = &[
+    "aside", "blockquote", "div", "dl", "h1", "h2", "h3", "h4", "h5", "h6", "ol", "p", "pre", "section", "svg",
+    "table", "ul",
+];
+
+// Gets <img> elements ready for html2md, which writes an image as
+// ![alt](src "title") unless it has a width, height or align, in which case
+// it's kept as an HTML tag. Those attributes are dropped, and brackets in the
+// alt and quotes in the title are escaped so that they can't end the markdown
+// early.
+pub(crate) fn prepare(nodes: &mut [Node]) {
+    dom::walk_mut(nodes, &mut |el| {
+        if el.is("img") {
+            for attr in ["width", "height", "align"] {
+                el.remove_attr(attr);
+            }
+            if let Some(alt) = el.attr("alt") {
+                let alt = alt.split_whitespace().collect::<Vec<_>>().join(" ");
+                el.set_attr("alt", &alt.replace('[', "\\[").replace(']', "\\]"));
+            }
+            if let Some(title) = el.attr("title") {
+                let title = title.split_whitespace().collect::<Vec<_>>().join(" ");
+                el.set_attr("title", &title.replace('"', "\\\""));
+            }
+        }
+    });
+}
+
+// Points <img src> and SVG <image href> at the extracted or embedded files.
+pub(crate) fn rewrite(nodes: &mut [Node], chapter_path: &Path, links: &Links) {
+    dom::walk_mut(nodes, &mut |el| {
+        let attr = if el.is("img") {
+            "src"
+        } else if el.is("image") {
+            "href"
+        } else {
+            return;
+        };
+        let key = match el.attrs.iter().position(|(k, _)| k.rsplit(':').next() == Some(attr)) {
+            Some(pos) => pos,
+            None => return,
+        };
+        let src = el.attrs[key].1.clone();
+        let Some(path) = href::resolve(chapter_path, &src) else {
+            return;
+        };
+        match links.get(&path) {
+            Some(Some(link)) => el.attrs[key].1 = link.clone(),
+            Some(None) => {}
+            None => warn!("{} references missing image {}", chapter_path.display(), src),
+        }
+    });
+}
+
+// Where inline <svg> drawings go, following --images and --embed-images.
+#[derive(Debug, Clone, Copy)]
+pub(crate) enum SvgOutput<'a> {
+    // Written to a file in the images directory.
+    Write(&'a ImageOptions),
+    // Embedded as a data: URI when no larger than this many bytes.
+    Embed(u64),
+    // Kept as <svg> markup in the markdown.
+    Inline,
+    // Named by a "[figure: ...]" line.
+    Describe,
+}
+
+// Elements a <svg> can hold while only framing a picture, as covers do.
+const FRAME_ELEMENTS: &[&str] = &["svg", "g", "image", "title", "desc", "metadata"];
+
+// Replaces the chapter's inline <svg> elements, which html2md drops or turns
+// into stray text. An <svg> that only frames one <image> becomes an <img> of
+// that image; any other is written out or embedded as an image, kept as
+// markup, or described by a placeholder standing for its "[figure: title]"
+// line. Returns the placeholders and the text they stand for, for
+// `restore_figures`.
+pub(crate) fn inline_svg(nodes: &mut [Node], chapter_path: &Path, output: SvgOutput) -> Result<Vec<(String, String)>> {
+    let mut figures = Vec::new();
+    let mut drawn = 0;
+    replace_svg(nodes, chapter_path, output, &mut drawn, &mut figures)?;
+    Ok(figures)
+}
+
+fn replace_svg(
+    nodes: &mut [Node],
+    chapter_path: &Path,
+    output: SvgOutput,
+    drawn: &mut usize,
+    figures: &mut Vec<(String, String)>,
+) -> Result<()> {
+    // A drawing among text stays inline; one on its own gets a paragraph.
+    let inline = nodes.iter().any(|node| matches!(node, Node::Text(text) if !text.trim().is_empty()));
+    let block = |node: Node| match inline {
+        true => node,
+        false => {
+            let mut paragraph = Element::new("p");
+            paragraph.children.push(node);
+            Node::Element(paragraph)
+        }
+    };
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        if !el.is("svg") {
+            replace_svg(&mut el.children, chapter_path, output, drawn, figures)?;
+            continue;
+        }
+        let label = svg_label(el);
+        let img = |src: &str| {
+            let mut img = Element::new("img");
+            img.set_attr("src", src);
+            img.set_attr("alt", label.as_deref().unwrap_or_default());
+            block(Node::Element(img))
+        };
+        if let Some(src) = framed_image(el) {
+            *node = img(&src);
+            continue;
+        }
+        *drawn += 1;
+        let svg = standalone_svg(el);
+        let replacement = match output {
+            SvgOutput::Write(images) => {
+                let stem = chapter_path.file_stem().unwrap_or_default().to_string_lossy();
+                let name = format!("{}-svg{}.svg", stem, drawn);
+                let dst = images.dir.join(&name);
+                fs::create_dir_all(&images.dir).with_context(|| format!("Failed to create {}", images.dir.display()))?;
+                fs::write(&dst, &svg).with_context(|| format!("Failed to write {}", dst.display()))?;
+                Some(img(&link(&images.link_prefix, &name)))
+            }
+            SvgOutput::Embed(max_bytes) if svg.len() as u64 <= max_bytes => {
+                Some(img(&data_uri("image/svg+xml", svg.as_bytes())))
+            }
+            SvgOutput::Embed(max_bytes) => {
+                warn!(
+                    "not embedding inline svg {} in {}: {} bytes is over the {} byte limit",
+                    drawn,
+                    chapter_path.display(),
+                    svg.len(),
+                    max_bytes
+                );
+                None
+            }
+            SvgOutput::Inline => {
+                let placeholder = format!("CIPHERFIGURE{}X", figures.len());
+                figures.push((placeholder.clone(), inline_markup(el)));
+                Some(block(Node::Text(placeholder)))
+            }
+            SvgOutput::Describe => None,
+        };
+        *node = replacement.unwrap_or_else(|| {
+            let placeholder = format!("CIPHERFIGURE{}X", figures.len());
+            let line = match &label {
+                Some(label) => format!("[figure: {}]", label),
+                None => "[figure]".to_string(),
+            };
+            figures.push((placeholder.clone(), line));
+            block(Node::Text(placeholder))
+        });
+    }
+    Ok(())
+}
+
+// The <title> of a drawing, or failing that its aria-label.
+fn svg_label(svg: &Element) -> Option<String> {
+    let title = svg.children.iter().find_map(|node| match node {
+        Node::Element(el) if el.is("title") => Some(el.text()),
+        _ => None,
+    });
+    let label = title.or_else(|| svg.attr("aria-label").map(dom::decode_entities))?;
+    let label = label.split_whitespace().collect::<Vec<_>>().join(" ");
+    (!label.is_empty()).then_some(label)
+}
+
+// The href of the one <image> an <svg> frames, if that is all it does.
+fn framed_image(svg: &Element) -> Option<String> {
+    let mut images = Vec::new();
+    let mut frame = true;
+    dom::walk(&svg.children, &mut |el| {
+        frame &= FRAME_ELEMENTS.iter().any(|name| el.is(name));
+        if el.is("image") {
+            images.push(el.attr("href").map(dom::decode_entities));
+        }
+    });
+    match (frame, images.as_slice()) {
+        (true, [Some(href)]) => Some(href.clone()),
+        _ => None,
+    }
+}
+
+// The image a cover page shows: the one <image> its <svg> frames, or its one
+// <img>. None for a page with more than one picture.
+pub(crate) fn page_image(html: &str) -> Option<String> {
+    let mut srcs = Vec::new();
+    dom::walk(&dom::parse(html), &mut |el| match el.local_name() {
+        "svg" => srcs.push(framed_image(el)),
+        "img" => srcs.push(el.attr("src").map(dom::decode_entities)),
+        _ => {}
+    });
+    match srcs.as_slice() {
+        [Some(src)] => Some(src.clone()),
+        _ => None,
+    }
+}
+
+// The drawing as markup to leave in the markdown, declaring its namespaces.
+// Blank lines would end the HTML block, so they're dropped.
+fn inline_markup(svg: &Element) -> String {
+    let svg = standalone_svg(svg);
+    let markup = svg.split_once('\n').map_or(svg.as_str(), |(_, markup)| markup);
+    markup.lines().filter(|line| !line.trim().is_empty()).collect::<Vec<_>>().join("\n")
+}
+
+// The drawing as an SVG file of its own, declaring the namespaces that the
+// chapter declared for it.
+fn standalone_svg(svg: &Element) -> String {
+    let mut svg = svg.clone();
+    let xmlns = match svg.name.split_once(':') {
+        Some((prefix, _)) => format!("xmlns:{}", prefix),
+        None => "xmlns".to_string(),
+    };
+    if !svg.attrs.iter().any(|(name, _)| *name == xmlns) {
+        svg.attrs.insert(0, (xmlns, "http://www.w3.org/2000/svg".to_string()));
+    }
+    let uses_xlink = |el: &Element| el.attrs.iter().any(|(name, _)| name.starts_with("xlink:"));
+    let mut xlink = uses_xlink(&svg);
+    dom::walk(&svg.children, &mut |el| xlink |= uses_xlink(el));
+    if xlink && !svg.attrs.iter().any(|(name, _)| name == "xmlns:xlink") {
+        svg.attrs.push(("xmlns:xlink".to_string(), "http://www.w3.org/1999/xlink".to_string()));
+    }
+    format!("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n{}\n", dom::serialize(&[Node::Element(svg)]))
+}
+
+pub(crate) fn restore_figures(markdown: &str, figures: &[(String, String)]) -> String {
+    let mut markdown = markdown.to_string();
+    for (placeholder, line) in figures {
+        markdown = markdown.replace(placeholder, line);
+    }
+    markdown
+}
@@ -0,0 +1,75 @@
+use crate::drm;
+use crate::metadata::{self, Metadata};
+use crate::opf::Package;
+use crate::pages;
+use anyhow::Result;
+use epub::doc::EpubDoc;
+use serde::Serialize;
+use std::io::{Read, Seek};
+
+const NCX_MEDIA_TYPE: &str = "application/x-dtbncx+xml";
+
+// A summary of a book for inspecting it without converting anything.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct Info {
+    pub title: Option<String>,
+    pub authors: Vec<String>,
+    pub language: Option<String>,
+    /// The first dc:identifier.
+    pub identifier: Option<String>,
+    pub publisher: Option<String>,
+    pub date: Option<String>,
+    pub subjects: Vec<String>,
+    /// Number of spine items.
+    pub chapters: usize,
+    pub manifest_items: usize,
+    /// Uncompressed size in bytes of the manifest items found in the archive.
+    pub size: u64,
+    /// Whether the book has an EPUB3 nav document or an NCX.
+    pub has_toc: bool,
+    /// Number of entries in the page list, which maps the print edition's
+    /// page numbers to places in the book; see `page_list`.
+    pub pages: usize,
+    /// Archive paths of the fonts META-INF/encryption.xml obfuscates. The
+    /// text converts without them.
+    pub obfuscated_fonts: Vec<String>,
+}
+
+impl Info {
+    pub fn to_json(&self, pretty: bool) -> String {
+        let json = match pretty {
+            true => serde_json::to_string_pretty(self),
+            false => serde_json::to_string(self),
+        };
+        json.expect("info always serializes")
+    }
+}
+
+pub(crate) fn read<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Result<Info> {
+    let package = Package::load(doc)?;
+    let metadata = Metadata::from_map(&doc.metadata);
+    let has_toc = package.item_with_property("nav").is_some()
+        || package.toc_id.is_some()
+        || package.manifest.iter().any(|item| item.media_type == NCX_MEDIA_TYPE);
+    let ids: Vec<String> = doc.resources.keys().cloned().collect();
+    let size = ids
+        .iter()
+        .filter_map(|id| doc.get_resource(id).ok())
+        .map(|bytes| bytes.len() as u64)
+        .sum();
+    Ok(Info {
+        title: metadata.title,
+        authors: metadata.creators,
+        language: metadata.language,
+        identifier: metadata.identifiers.into_iter().next(),
+        publisher: metadata.publisher,
+        date: metadata.date,
+        subjects: metadata::all(&doc.metadata, "subject"),
+        chapters: doc.spine.len(),
+        manifest_items: doc.resources.len(),
+        size,
+        has_toc,
+        pages: pages::page_list(doc).len(),
+        obfuscated_fonts: drm::read(doc).obfuscated,
+    })
+}
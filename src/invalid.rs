@@ -0,0 +1,94 @@
+use crate::lenient::{self, Defect};
+use crate::opf::{self, CONTAINER};
+use epub::archive::EpubArchive;
+use std::error::Error;
+use std::fmt;
+use std::io::{Read, Seek};
+
+const MIMETYPE: &str = "mimetype";
+const EPUB_MIMETYPE: &str = "application/epub+zip";
+
+// Returned when the input can't be opened as an EPUB, so that callers can
+// tell bad input apart from failures of their own; use
+// `downcast_ref::<InvalidEpub>()` to check.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum InvalidEpub {
+    /// Not an EPUB at all: not a zip archive, or a zip archive of something
+    /// else.
+    NotEpub(String),
+    /// An EPUB that is missing a part every book needs, or whose package the
+    /// epub crate can't read.
+    Corrupt(String),
+}
+
+impl fmt::Display for InvalidEpub {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            InvalidEpub::NotEpub(reason) => write!(f, "not an EPUB: {}", reason),
+            InvalidEpub::Corrupt(reason) => write!(f, "corrupt EPUB: {}", reason),
+        }
+    }
+}
+
+impl Error for InvalidEpub {}
+
+// Looks for the common reasons an input isn't a usable EPUB before it's handed
+// to the epub crate, whose errors don't say which it was, and for the ways it
+// breaks the container rules that can be worked around, which are returned. A
+// missing mimetype is only held against archives that have no container
+// either, as plenty of books that leave it out convert fine.
+pub(crate) fn check<R: Read + Seek>(mut reader: R) -> Result<Vec<Defect>, InvalidEpub> {
+    let compressed = lenient::mimetype_compressed(&mut reader);
+    let Ok(mut archive) = EpubArchive::from_reader(reader) else {
+        return Err(InvalidEpub::NotEpub("the file isn't a zip archive".to_string()));
+    };
+    let mut defects = Vec::new();
+    let container = lenient::find_container(&archive.files);
+    // The folder as it's spelled in the archive, for the names next to it.
+    let folder = match &container {
+        Some((name, _)) => name[..name.len() - CONTAINER.len()].to_string(),
+        None => String::new(),
+    };
+    match archive.get_entry(format!("{}{}", folder, MIMETYPE)) {
+        Ok(bytes) => {
+            let mimetype = String::from_utf8_lossy(&bytes);
+            if mimetype.trim() != EPUB_MIMETYPE {
+                let reason = format!("its mimetype is {:?} rather than {}", mimetype.trim(), EPUB_MIMETYPE);
+                return Err(InvalidEpub::NotEpub(reason));
+            }
+            if compressed {
+                defects.push(Defect::CompressedMimetype);
+            }
+        }
+        Err(_) if container.is_none() => {
+            return Err(InvalidEpub::NotEpub("the zip archive has no mimetype file".to_string()));
+        }
+        Err(_) => defects.push(Defect::NoMimetype),
+    }
+    let Some((name, folder_path)) = container else {
+        return Err(InvalidEpub::Corrupt(format!("{} is missing", CONTAINER)));
+    };
+    if name != CONTAINER {
+        defects.push(Defect::MisplacedContainer { name: name.clone(), folder: folder_path });
+    }
+    let bytes = archive.get_entry(&name).unwrap_or_default();
+    if lenient::starts_with_bom(&bytes) {
+        defects.push(Defect::Bom(CONTAINER.to_string()));
+    }
+    for rootfile in opf::parse_rootfiles(&String::from_utf8_lossy(&bytes)) {
+        let package = archive.get_entry(format!("{}{}", folder, rootfile.full_path)).unwrap_or_default();
+        if lenient::starts_with_bom(&package) {
+            defects.push(Defect::Bom(rootfile.full_path));
+        }
+    }
+    Ok(defects)
+}
+
+impl From<&Defect> for InvalidEpub {
+    fn from(defect: &Defect) -> InvalidEpub {
+        match defect {
+            Defect::NoMimetype => InvalidEpub::NotEpub(defect.to_string()),
+            _ => InvalidEpub::Corrupt(defect.to_string()),
+        }
+    }
+}
@@ -0,0 +1,78 @@
+use crate::opf::Package;
+use anyhow::Result;
+use epub::doc::EpubDoc;
+use serde::Serialize;
+use std::collections::HashSet;
+use std::io::{Read, Seek};
+
+// The book's inventory as the package document declares it: the spine in
+// reading order, and the manifest items outside it such as images, styles
+// and fonts.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct Items {
+    pub spine: Vec<Item>,
+    pub other: Vec<Item>,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct Item {
+    pub id: String,
+    /// The item's path relative to the package document. Empty for a spine
+    /// item the manifest doesn't have.
+    pub href: String,
+    /// Empty for a spine item the manifest doesn't have.
+    pub media_type: String,
+    /// The manifest properties, e.g. nav or cover-image.
+    pub properties: Vec<String>,
+    /// False for spine items marked linear="no". Items outside the spine
+    /// are always true.
+    pub linear: bool,
+}
+
+impl Items {
+    pub fn to_json(&self, pretty: bool) -> String {
+        let json = match pretty {
+            true => serde_json::to_string_pretty(self),
+            false => serde_json::to_string(self),
+        };
+        json.expect("items always serialize")
+    }
+}
+
+pub(crate) fn read<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Result<Items> {
+    let package = Package::load(doc)?;
+    let root_base = doc.root_base.clone();
+    let item = |index: usize, linear: bool| {
+        let manifest = &package.manifest[index];
+        Item {
+            id: manifest.id.clone(),
+            href: manifest.path.strip_prefix(&root_base).unwrap_or(&manifest.path).to_string_lossy().into_owned(),
+            media_type: manifest.media_type.clone(),
+            properties: manifest.properties.clone(),
+            linear,
+        }
+    };
+    // An id listed twice in the manifest means its first item, as for the
+    // conversion; the other one is listed outside the spine.
+    let mut in_spine = HashSet::new();
+    let spine = package
+        .spine
+        .iter()
+        .map(|idref| {
+            let linear = !package.nonlinear.contains(idref);
+            match package.manifest.iter().position(|manifest| manifest.id == *idref) {
+                Some(index) => {
+                    in_spine.insert(index);
+                    item(index, linear)
+                }
+                None => Item {
+                    id: idref.clone(),
+                    linear,
+                    ..Item::default()
+                },
+            }
+        })
+        .collect();
+    let other = (0..package.manifest.len()).filter(|index| !in_spine.contains(index)).map(|index| item(index, true)).collect();
+    Ok(Items { spine, other })
+}
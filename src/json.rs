@@ -0,0 +1,144 @@
+use crate::chapter::Chapter;
+use crate::metadata::Metadata;
+use crate::stats::{word_count, BookStats};
+use crate::validate::Problem;
+use serde::Serialize;
+
+// A chapter as written by --format json and ndjson.
+#[derive(Debug, Serialize)]
+struct ChapterJson<'a> {
+    /// Position in the spine, counting from 1.
+    index: usize,
+    href: &'a str,
+    /// The TOC title, or failing that the chapter's first heading.
+    title: String,
+    markdown: &'a str,
+}
+
+impl<'a> ChapterJson<'a> {
+    fn new(chapter: &'a Chapter) -> Self {
+        ChapterJson {
+            index: chapter.index,
+            href: &chapter.href,
+            title: chapter.display_title(),
+            markdown: &chapter.markdown,
+        }
+    }
+}
+
+#[derive(Debug, Serialize)]
+struct BookJson<'a> {
+    metadata: &'a Metadata,
+    chapters: Vec<ChapterJson<'a>>,
+    stats: &'a BookStats,
+}
+
+// The book as a single JSON object: {"metadata": {...}, "chapters": [...],
+// "stats": {...}}, with the reading time at the usual speed.
+pub fn to_json(metadata: &Metadata, chapters: &[Chapter], pretty: bool) -> String {
+    book_to_json(metadata, chapters, &BookStats::new(chapters), pretty)
+}
+
+// Like `to_json`, with stats worked out by the caller.
+pub fn book_to_json(metadata: &Metadata, chapters: &[Chapter], stats: &BookStats, pretty: bool) -> String {
+    let book = BookJson {
+        metadata,
+        chapters: chapters.iter().map(ChapterJson::new).collect(),
+        stats,
+    };
+    let json = match pretty {
+        true => serde_json::to_string_pretty(&book),
+        false => serde_json::to_string(&book),
+    };
+    json.expect("book always serializes")
+}
+
+// One chapter object per line, for consumers that stream the output.
+pub fn to_ndjson(chapters: &[Chapter]) -> String {
+    let mut out = String::new();
+    for chapter in chapters {
+        out.push_str(&serde_json::to_string(&ChapterJson::new(chapter)).expect("chapter always serializes"));
+        out.push('\n');
+    }
+    out
+}
+
+// A chapter file written by --split, as listed in its index.json.
+#[derive(Debug, Serialize)]
+struct SplitChapterJson<'a> {
+    /// Position in the spine, counting from 1.
+    index: usize,
+    href: &'a str,
+    title: String,
+    /// The chapter's file name in the split directory.
+    file: &'a str,
+    words: usize,
+}
+
+#[derive(Debug, Serialize)]
+struct SplitIndexJson<'a> {
+    metadata: &'a Metadata,
+    chapters: Vec<SplitChapterJson<'a>>,
+}
+
+// The index.json for a split book: its metadata and, in spine order, each
+// chapter with the file it was written to. `files` pairs up with `chapters`.
+pub fn split_index_to_json(metadata: &Metadata, chapters: &[Chapter], files: &[String], pretty: bool) -> String {
+    let index = SplitIndexJson {
+        metadata,
+        chapters: chapters
+            .iter()
+            .zip(files)
+            .map(|(chapter, file)| SplitChapterJson {
+                index: chapter.index,
+                href: &chapter.href,
+                title: chapter.display_title(),
+                file,
+                words: word_count(&chapter.markdown),
+            })
+            .collect(),
+    };
+    let json = match pretty {
+        true => serde_json::to_string_pretty(&index),
+        false => serde_json::to_string(&index),
+    };
+    json.expect("index always serializes")
+}
+
+// A book checked by `cipher validate`, as written by --format json and ndjson.
+#[derive(Debug, Serialize)]
+struct ValidationJson<'a> {
+    file: &'a str,
+    ok: bool,
+    problems: &'a [Problem],
+}
+
+impl<'a> ValidationJson<'a> {
+    fn new((file, problems): &'a (String, Vec<Problem>)) -> Self {
+        ValidationJson {
+            file,
+            ok: problems.iter().all(Problem::is_warning),
+            problems,
+        }
+    }
+}
+
+// Every book's problems as one JSON array.
+pub fn validation_to_json(results: &[(String, Vec<Problem>)], pretty: bool) -> String {
+    let results: Vec<ValidationJson> = results.iter().map(ValidationJson::new).collect();
+    let json = match pretty {
+        true => serde_json::to_string_pretty(&results),
+        false => serde_json::to_string(&results),
+    };
+    json.expect("problems always serialize")
+}
+
+// One object per book and line.
+pub fn validation_to_ndjson(results: &[(String, Vec<Problem>)]) -> String {
+    let mut out = String::new();
+    for result in results {
+        out.push_str(&serde_json::to_string(&ValidationJson::new(result)).expect("problems always serialize"));
+        out.push('\n');
+    }
+    out
+}
@@ -0,0 +1,66 @@
+use crate::dom::{self, Element, Node};
+use std::slice;
+
+// Elements markdown has nothing for, kept as HTML by default: <details>, and
+// the <summary> with it, and subscripts and superscripts, which html2md would
+// run into the text around them. Tables a pipe table can't represent are kept
+// as HTML anyway; see `tables::hide`.
+pub(crate) const DEFAULT_KEEP_HTML: &[&str] = &["details", "sub", "sup"];
+
+// Elements that stand as blocks of their own, whose markup goes back on
+// lines of its own; others are kept inline in their paragraph.
+const BLOCKS: &[&str] = &[
+    "address", "article", "aside", "blockquote", "details", "dialog", "div", "dl", "fieldset", "figure", "footer",
+    "form", "header", "main", "nav", "ol", "section", "table", "ul",
+];
+
+// Swaps each element named in `tags` outside code for a placeholder holding
+// its markup, which `restore` puts back after conversion so that it comes out
+// as it is, inside and all. The placeholder of a block is a paragraph of its
+// own, and that of an inline element stays in its text.
+pub(crate) fn hide(nodes: &mut [Node], tags: &[String]) -> Vec<(String, String)> {
+    let mut kept = Vec::new();
+    if !tags.is_empty() {
+        hide_in(nodes, tags, &mut kept);
+    }
+    kept
+}
+
+fn hide_in(nodes: &mut [Node], tags: &[String], kept: &mut Vec<(String, String)>) {
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        if el.is("pre") || el.is("code") {
+            continue;
+        }
+        if !tags.iter().any(|tag| el.is(tag)) {
+            hide_in(&mut el.children, tags, kept);
+            continue;
+        }
+        let block = BLOCKS.iter().any(|name| el.is(name));
+        let html = dom::serialize(slice::from_ref(node));
+        let placeholder = format!("CIPHERHTML{}X", kept.len());
+        *node = match block {
+            true => {
+                kept.push((placeholder.clone(), html));
+                let mut paragraph = Element::new("p");
+                paragraph.children.push(Node::Text(placeholder));
+                Node::Element(paragraph)
+            }
+            false => {
+                // On one line, so that it stays inside its paragraph.
+                kept.push((placeholder.clone(), html.split_whitespace().collect::<Vec<_>>().join(" ")));
+                Node::Text(placeholder)
+            }
+        };
+    }
+}
+
+pub(crate) fn restore(markdown: &str, kept: &[(String, String)]) -> String {
+    let mut markdown = markdown.to_string();
+    for (placeholder, html) in kept {
+        markdown = markdown.replace(placeholder, html);
+    }
+    markdown
+}
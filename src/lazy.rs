@@ -0,0 +1,244 @@
+use crate::chapter::{self, Chapter};
+use crate::filter::SpineFilter;
+use crate::links::{Marks, Targets};
+use crate::normalize::{normalize, LineEnding};
+use crate::slug::Slugger;
+use crate::{images, markdown, read_spine_item, Book, BookWide, Options};
+use anyhow::{bail, Context, Result};
+use std::collections::HashMap;
+use std::fmt;
+use std::io::{Read, Seek};
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex, PoisonError};
+
+// An open book the chapters are converted from, whatever it's read from.
+trait Source: Send {
+    fn convert(&mut self, index: usize, wide: &BookWide) -> Result<(Chapter, Marks)>;
+    fn book_wide(&mut self, indexes: &[usize]) -> Result<BookWide>;
+    fn html(&mut self, index: usize) -> Result<Vec<u8>>;
+}
+
+impl<R: Read + Seek + Send> Source for Book<R> {
+    fn convert(&mut self, index: usize, wide: &BookWide) -> Result<(Chapter, Marks)> {
+        Book::convert(self, index, Some(wide))
+    }
+
+    fn book_wide(&mut self, indexes: &[usize]) -> Result<BookWide> {
+        Book::book_wide(self, indexes)
+    }
+
+    fn html(&mut self, index: usize) -> Result<Vec<u8>> {
+        Book::html(self, index)
+    }
+}
+
+// The book, and what's known of the chapters converted from it so far.
+struct Open {
+    book: Box<dyn Source>,
+    options: Options,
+    /// The spine position, counting from 0, of each item handed out, by
+    /// archive path.
+    items: HashMap<PathBuf, usize>,
+    /// The headings and ids of the items converted, for the links to them.
+    targets: Targets,
+    /// What the items handed out take from each other, once the first of
+    /// them is converted.
+    wide: Option<BookWide>,
+}
+
+impl Open {
+    // Converts the item at `index` (counting from 0) as whole-book conversion
+    // does, pointing its links to the other items handed out at their
+    // headings. Those items are converted the first time they're linked to.
+    // The first call reads every item handed out, for the notes they take
+    // from each other's files, and extracts the images.
+    fn markdown(&mut self, index: usize) -> Result<String> {
+        if self.wide.is_none() {
+            let mut indexes: Vec<usize> = self.items.values().copied().collect();
+            indexes.sort_unstable();
+            self.wide = Some(self.book.book_wide(&indexes)?);
+        }
+        let wide = self.wide.as_ref().expect("loaded above");
+        let (chapter, mut marks) = self.book.convert(index, wide)?;
+        let links = std::mem::take(&mut marks.links);
+        if let Some(path) = self.items.iter().find(|(_, i)| **i == index).map(|(path, _)| path.clone()) {
+            self.targets.insert(&path, &chapter, marks);
+        }
+        for link in &links {
+            let Some(&target) = self.items.get(&link.path).filter(|_| !self.targets.contains(&link.path)) else {
+                continue;
+            };
+            // A chapter that doesn't convert is linked to by its href.
+            if let Ok((linked, marks)) = self.book.convert(target, wide) {
+                self.targets.insert(&link.path, &linked, marks);
+            }
+        }
+        let options = &self.options;
+        let mut markdown = normalize(&self.targets.resolve(&chapter.markdown, &links), LineEnding::Lf);
+        if let Some(level) = options.promote_chapters {
+            markdown = markdown::promote_headings(&markdown, level, options.markdown.headings);
+        }
+        if options.heading_ids {
+            markdown = markdown::add_heading_ids(&markdown, &mut Slugger::default());
+        }
+        for transform in &options.transforms {
+            markdown = transform
+                .apply(&markdown)
+                .with_context(|| format!("Failed to transform {} with {}", chapter.href, transform.name()))?;
+        }
+        Ok(markdown)
+    }
+}
+
+// The book, until `Chapters::close` lets go of it.
+type Shared = Arc<Mutex<Option<Open>>>;
+
+// The spine items of a book `Options` converts, in the order it converts
+// them, handed out without converting any: each `LazyChapter` converts its item when its
+// markdown is asked for, so a caller that only wants some of the chapters, or
+// only their titles, doesn't pay for the rest. Made by `Converter::lazy_chapters`.
+//
+//     for chapter in Converter::new().lazy_chapters_file("book.epub")? {
+//         let chapter = chapter?;
+//         if chapter.title.starts_with("Chapter") {
+//             index(&chapter.href, &chapter.markdown()?);
+//         }
+//     }
+//
+// The book stays open while the iterator or any chapter it handed out is
+// alive, or until `close`.
+pub struct Chapters {
+    book: Shared,
+    items: std::vec::IntoIter<Result<LazyChapter>>,
+}
+
+impl Chapters {
+    // Lists the spine items of `book` that its options convert, in the order
+    // they convert them; see `SpineFilter`. Items that are neither HTML nor an
+    // image are skipped, as whole-book conversion does, and with --match or
+    // --exclude every item is read for the title it gives itself.
+    pub(crate) fn new<R: Read + Seek + Send + 'static>(mut book: Book<R>) -> Result<Chapters> {
+        let options = book.options.clone();
+        let mut items = Vec::new();
+        {
+            let mut filter = SpineFilter::new(&mut book.doc, &options, &book.titles)?;
+            let spine_ids = book.doc.spine.clone();
+            for index in filter.order(&spine_ids) {
+                let idref = &spine_ids[index];
+                let resource = book.doc.resources.get(idref).cloned();
+                if filter.skips(index, idref, resource.as_ref().map(|(path, _)| path.as_path())) {
+                    continue;
+                }
+                // Whole-book conversion leaves out items missing from the
+                // manifest too.
+                let Some((path, media_type)) = resource else {
+                    continue;
+                };
+                let href = path.strip_prefix(&book.doc.root_base).unwrap_or(&path).to_string_lossy().into_owned();
+                let media = media_type.split(';').next().unwrap_or_default().trim();
+                let svg = media == "image/svg+xml" && options.inline_svg;
+                if !matches!(media, "application/xhtml+xml" | "text/html") && !svg && !images::is_image(media) {
+                    warn!("skipping spine item {} ({})", href, media_type);
+                    continue;
+                }
+                if filter.filtering() {
+                    let max_size = options.max_chapter_size;
+                    let html = read_spine_item(&mut book.doc, idref, &path, &media_type, max_size, options.inline_svg);
+                    if filter.leaves_out(&path, html.ok().flatten().as_deref()) {
+                        continue;
+                    }
+                }
+                let title = chapter::resolve_title(book.titles.get(&path), None, &href);
+                items.push((index, path, href, title));
+            }
+            filter.check_kept(items.len())?;
+        }
+        let open = Open {
+            items: items.iter().map(|(index, path, _, _)| (path.clone(), *index)).collect(),
+            book: Box::new(book),
+            options,
+            targets: Targets::default(),
+            wide: None,
+        };
+        let book: Shared = Arc::new(Mutex::new(Some(open)));
+        let items: Vec<Result<LazyChapter>> = items
+            .into_iter()
+            .map(|(index, _, href, title)| Ok(LazyChapter { index: index + 1, href, title, book: book.clone() }))
+            .collect();
+        Ok(Chapters { book, items: items.into_iter() })
+    }
+
+    // Lets go of the book, closing the file or dropping the reader it was
+    // read from. Chapters not converted by then fail to convert.
+    pub fn close(&mut self) {
+        self.book.lock().unwrap_or_else(PoisonError::into_inner).take();
+    }
+}
+
+impl Iterator for Chapters {
+    type Item = Result<LazyChapter>;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        self.items.next()
+    }
+
+    fn size_hint(&self) -> (usize, Option<usize>) {
+        self.items.size_hint()
+    }
+}
+
+impl ExactSizeIterator for Chapters {}
+
+impl fmt::Debug for Chapters {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Chapters").field("remaining", &self.items.len()).finish()
+    }
+}
+
+// A spine item `Chapters` handed out, converted only when asked.
+#[derive(Clone)]
+pub struct LazyChapter {
+    /// The item's position in the spine, counting from 1.
+    pub index: usize,
+    pub href: String,
+    /// The item's title in the TOC, or its file name when the TOC doesn't
+    /// list it: the heading it gives itself is only known once converted.
+    pub title: String,
+    book: Shared,
+}
+
+impl LazyChapter {
+    // Converts the item with the options of the converter that opened the
+    // book, as `convert_chapters_with` converts it: links to the other
+    // chapters handed out point at their headings, and notes kept in another
+    // file go with the chapters that refer to them, so the first chapter
+    // converted reads the others. The passes that need the whole book,
+    // numbering headings across it, removing boilerplate and chunking, are
+    // left out. Each call converts it again.
+    pub fn markdown(&self) -> Result<String> {
+        self.with_book(|open| open.markdown(self.index - 1))
+    }
+
+    // The item as it is in the archive, before anything is converted.
+    pub fn html(&self) -> Result<Vec<u8>> {
+        self.with_book(|open| open.book.html(self.index - 1))
+    }
+
+    fn with_book<T>(&self, f: impl FnOnce(&mut Open) -> Result<T>) -> Result<T> {
+        let mut book = self.book.lock().unwrap_or_else(PoisonError::into_inner);
+        match book.as_mut() {
+            Some(open) => f(open),
+            None => bail!("Failed to convert {}: the book was closed", self.href),
+        }
+    }
+}
+
+impl fmt::Debug for LazyChapter {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("LazyChapter")
+            .field("index", &self.index)
+            .field("href", &self.href)
+            .field("title", &self.title)
+            .finish()
+    }
+}
@@ -0,0 +1,172 @@
+use crate::opf::CONTAINER;
+use crate::zip::ZipWriter;
+use epub::archive::EpubArchive;
+use std::fmt;
+use std::fs::File;
+use std::io::{self, BufReader, Cursor, Read, Seek, SeekFrom};
+
+const BOM: &[u8] = b"\xef\xbb\xbf";
+
+// A way a book breaks the container rules that the conversion can work
+// around. `invalid::check` finds them; with `Options::lenient` each one is
+// warned about and tolerated, and otherwise it's an `InvalidEpub`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) enum Defect {
+    NoMimetype,
+    CompressedMimetype,
+    /// META-INF/container.xml under another name: in a folder the book was
+    /// zipped up in, in another case, or with backslashes. The folder is
+    /// the part of the name before META-INF.
+    MisplacedContainer { name: String, folder: String },
+    /// An XML file the epub crate parses, by its path in the repaired book.
+    Bom(String),
+}
+
+impl fmt::Display for Defect {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Defect::NoMimetype => f.write_str("the zip archive has no mimetype file"),
+            Defect::CompressedMimetype => f.write_str("the mimetype file is compressed"),
+            Defect::MisplacedContainer { name, .. } => write!(f, "{} is at {}", CONTAINER, name),
+            Defect::Bom(name) => write!(f, "{} starts with a byte order mark", name),
+        }
+    }
+}
+
+impl Defect {
+    // Whether the epub crate can only open the book once it's rewritten.
+    pub(crate) fn needs_repair(&self) -> bool {
+        matches!(self, Defect::MisplacedContainer { .. } | Defect::Bom(_))
+    }
+}
+
+// Finds META-INF/container.xml among the archive's file names, returning its
+// name and the folder before it. Names are compared with forward slashes and
+// ignoring case; the shallowest match wins.
+pub(crate) fn find_container(files: &[String]) -> Option<(String, String)> {
+    if files.iter().any(|name| name == CONTAINER) {
+        return Some((CONTAINER.to_string(), String::new()));
+    }
+    let suffix = CONTAINER.to_lowercase();
+    files
+        .iter()
+        .filter_map(|name| {
+            let normalized = normalize_name(name).to_lowercase();
+            let folder = normalized.strip_suffix(&suffix)?;
+            (folder.is_empty() || folder.ends_with('/')).then(|| (name.clone(), folder.len()))
+        })
+        .min_by_key(|(_, depth)| *depth)
+        .map(|(name, depth)| {
+            let folder = normalize_name(&name)[..depth].to_string();
+            (name, folder)
+        })
+}
+
+pub(crate) fn starts_with_bom(bytes: &[u8]) -> bool {
+    bytes.starts_with(BOM)
+}
+
+fn normalize_name(name: &str) -> String {
+    let name = name.replace('\\', "/");
+    name.trim_start_matches("./").trim_start_matches('/').to_string()
+}
+
+// Rewrites the book as a new archive with its container where the epub crate
+// looks for it and without the byte order marks: every file moves out of the
+// folder the book was zipped up in, container.xml gets its proper name, and
+// the mimetype comes first as the spec asks. The entries are stored, as the
+// copy only lives in memory.
+pub(crate) fn repair<R: Read + Seek>(reader: R, defects: &[Defect]) -> anyhow::Result<Vec<u8>> {
+    let mut archive = EpubArchive::from_reader(reader).map_err(|e| anyhow::anyhow!("Failed to read EPUB: {}", e))?;
+    let folder = defects.iter().find_map(|defect| match defect {
+        Defect::MisplacedContainer { folder, .. } => Some(folder.clone()),
+        _ => None,
+    });
+    let folder = folder.unwrap_or_default();
+    let mut zip = ZipWriter::default();
+    zip.add("mimetype", b"application/epub+zip")?;
+    for name in archive.files.clone() {
+        let normalized = normalize_name(&name);
+        let Some(path) = normalized.strip_prefix(&folder).filter(|path| !path.is_empty() && !path.ends_with('/')) else {
+            continue;
+        };
+        let path = match path.eq_ignore_ascii_case(CONTAINER) {
+            true => CONTAINER,
+            false => path,
+        };
+        if path == "mimetype" {
+            continue;
+        }
+        let bytes = archive.get_entry(&name).map_err(|e| anyhow::anyhow!("Failed to read {}: {}", name, e))?;
+        let bom = defects.iter().any(|defect| matches!(defect, Defect::Bom(bom) if bom == path));
+        match bom {
+            true => zip.add(path, bytes.strip_prefix(BOM).unwrap_or(&bytes))?,
+            false => zip.add(path, &bytes)?,
+        }
+    }
+    zip.finish()
+}
+
+// Whether the archive's first entry is the mimetype file, compressed. The
+// epub crate reads it either way, but the spec asks for it stored so that the
+// file type can be told from the first bytes.
+pub(crate) fn mimetype_compressed<R: Read + Seek>(reader: &mut R) -> bool {
+    let mut header = [0u8; 38];
+    let read = reader.rewind().and_then(|()| reader.read_exact(&mut header));
+    let _ = reader.seek(SeekFrom::Start(0));
+    read.is_ok()
+        && header[..4] == *b"PK\x03\x04"
+        && u16::from_le_bytes([header[26], header[27]]) == 8
+        && header[30..38] == *b"mimetype"
+        && u16::from_le_bytes([header[8], header[9]]) != 0
+}
+
+// An EPUB opened from a path: the file itself, or a copy in memory when it
+// had to be repaired or was packed up from an HTML file or unpacked folder.
+pub enum EpubFile {
+    Disk(BufReader<File>),
+    Memory(Cursor<Vec<u8>>),
+}
+
+impl Read for EpubFile {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        match self {
+            EpubFile::Disk(file) => file.read(buf),
+            EpubFile::Memory(bytes) => bytes.read(buf),
+        }
+    }
+}
+
+impl Seek for EpubFile {
+    fn seek(&mut self, pos: SeekFrom) -> io::Result<u64> {
+        match self {
+            EpubFile::Disk(file) => file.seek(pos),
+            EpubFile::Memory(bytes) => bytes.seek(pos),
+        }
+    }
+}
+
+// An EPUB opened from a seekable reader: the reader itself, or a copy in
+// memory when it had to be repaired.
+pub(crate) enum Repaired<R> {
+    Original(R),
+    Copy(Cursor<Vec<u8>>),
+}
+
+impl<R: Read> Read for Repaired<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        match self {
+            Repaired::Original(reader) => reader.read(buf),
+            Repaired::Copy(bytes) => bytes.read(buf),
+        }
+    }
+}
+
+impl<R: Seek> Seek for Repaired<R> {
+    fn seek(&mut self, pos: SeekFrom) -> io::Result<u64> {
+        match self {
+            Repaired::Original(reader) => reader.seek(pos),
+            Repaired::Copy(bytes) => bytes.seek(pos),
+        }
+    }
+}
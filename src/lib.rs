@@ -1,25 +1,1734 @@
-use anyhow::{Result};
-use epub::doc::EpubDoc;
-use std::path::Path;
+use anyhow::{Context, Result};
+use converter::HtmlConverter;
+use slug::Slugger;
+use epub::archive::EpubArchive;
+use epub::doc::{EpubDoc, NavPoint};
+use lenient::{Defect, Repaired};
+use std::collections::{HashMap, HashSet};
+use std::fs::{self, File, OpenOptions};
+use std::io::{BufReader, BufWriter, Cursor, ErrorKind, Read, Seek, Write};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::path::{Path, PathBuf};
+use std::time::Instant;
 use ollama_rs::Ollama;
 use ollama_rs::generation::options::GenerationOptions;
 
+// First, so that its warn! and info! macros can be used in the modules below.
+#[macro_use]
+pub mod log;
+mod batch;
+mod boilerplate;
+pub mod cache;
+mod cancel;
+mod chapter;
+mod code;
+mod contents;
+mod convert;
+mod converter;
+mod cover;
+mod direction;
+pub mod dom;
+pub mod download;
+mod drm;
+mod encoding;
+mod filter;
+mod footnotes;
+mod format;
+mod guide;
+mod href;
+pub mod html;
+mod images;
+mod info;
+mod invalid;
+mod items;
+pub mod json;
+mod keep;
+mod lazy;
+mod lenient;
+mod links;
+mod markdown;
+mod math;
+mod matter;
+mod metadata;
+mod nonlinear;
+mod normalize;
+mod opf;
+pub mod org;
+mod pages;
+mod pool;
+pub mod positions;
+mod progress;
+pub mod reader;
+pub mod render;
+mod ruby;
+mod sanitize;
+mod search;
+pub mod slug;
+pub mod split;
+mod stats;
+mod tables;
+pub mod text;
+mod toc;
+mod transform;
+mod typography;
+mod unpacked;
+mod unreadable;
+mod validate;
+mod verse;
+mod zip;
+
+pub use batch::{find_epubs, BatchError, BookPlan};
+pub use cancel::{CancelToken, Cancelled};
+pub use chapter::{Chapter, ChapterErrors, ChapterSelection, SpineEntry, TocEntry};
+pub use contents::{Contents, CoverImage};
+pub use convert::Converter;
+pub use converter::{
+    Bullet, DefinitionList, Emphasis, HeadingStyle, LineBreak, ListSpacing, MarkdownOptions, OrderedDelimiter,
+    QuoteStyle,
+};
+pub use cover::{CoverOptions, NoCover};
+pub use direction::{language_direction, Direction, RtlWrap};
+pub use drm::DrmProtected;
+pub use format::Format;
+pub use guide::{GuideRef, GuideSource};
+pub use images::{FigureCaption, ImageOptions};
+pub use info::Info;
+pub use invalid::InvalidEpub;
+pub use items::{Item, Items};
+pub use lazy::{Chapters, LazyChapter};
+pub use lenient::EpubFile;
+pub use log::{Level, LogFormat};
+pub use markdown::SECTION_MARKER;
+pub use matter::Matter;
+pub use metadata::{Metadata, MetadataFormat};
+pub use opf::{Rendition, Rootfile};
+pub use pages::{PageTarget, DEFAULT_PAGE_MARKER};
+pub use progress::Progress;
+pub use render::{Color, Renderer, Style, Theme, Wrap};
+pub use ruby::Ruby;
+pub use nonlinear::Nonlinear;
+pub use normalize::{normalize, LineEnding};
+pub use search::{search_chapter, Pattern, SearchMatch, SearchOptions};
+pub use split::{NameContext, NameTemplate};
+pub use stats::{reading_minutes, word_count, BookStats, ChapterStats};
+pub use transform::Transform;
+pub use typography::{normalize_typography, Typography};
+pub use unpacked::{html_to_epub, is_html, is_unpacked_epub, InputFormat};
+pub use unreadable::Unreadable;
+pub use validate::Problem;
+
+#[derive(Debug, Clone)]
+pub struct Options {
+    /// Prepend the book metadata, in `metadata_format`.
+    pub front_matter: bool,
+    pub metadata_format: MetadataFormat,
+    /// Insert a table of contents built from the nav document or NCX after the front matter.
+    pub toc: bool,
+    /// Build that table of contents from the converted chapters instead: their
+    /// titles and the headings in them, this many levels deep, linking to the
+    /// heading anchors. Only chapters selected by `chapters` are listed.
+    pub toc_depth: Option<usize>,
+    /// Extract image manifest items and rewrite image links to point at them.
+    pub images: Option<ImageOptions>,
+    /// Inline images as base64 `data:` URIs instead, so the markdown stands
+    /// on its own. Images over this many bytes are left linked, with a
+    /// warning. Can't be combined with `images`.
+    pub embed_images: Option<u64>,
+    /// Keep drawings made with inline <svg> elements, and SVG spine items
+    /// such as covers, as <svg> markup in the markdown instead of writing,
+    /// embedding or describing them. Only renderers that pass HTML through
+    /// will show them.
+    pub inline_svg: bool,
+    /// Where a <figure>'s <figcaption> goes: an italic line under its images
+    /// by default, or their titles.
+    pub figure_captions: FigureCaption,
+    /// Fail on the first chapter that can't be converted. When false, the
+    /// chapter is replaced by a `> [conversion failed: ...]` placeholder, the
+    /// rest of the book is converted, and the conversion returns a
+    /// `ChapterErrors` holding the output and the failures.
+    pub strict: bool,
+    /// How to handle a spine item, navigation document or NCX that can't be
+    /// read out of the archive. None treats an unreadable spine item like a
+    /// conversion failure, following `strict`, and leaves an unreadable
+    /// navigation out of the table of contents without a word.
+    pub unreadable: Option<Unreadable>,
+    /// Open books that break the container rules in ways that can be worked
+    /// around, with a warning for each: no mimetype file or a compressed one,
+    /// META-INF/container.xml inside the folder the book was zipped up in or
+    /// in another case, and XML files starting with a byte order mark. When
+    /// false they fail with an `InvalidEpub`.
+    pub lenient: bool,
+    /// Checked between spine items; conversion stops with a `Cancelled`
+    /// error once it fires.
+    pub cancel: Option<CancelToken>,
+    /// Only convert these spine positions (counting from 1).
+    pub chapters: Option<ChapterSelection>,
+    /// Where spine items marked linear="no", such as pop-up notes and image
+    /// pages, go: after the rest of the book by default. A `chapters`
+    /// selection converts the items it picks in their place in the spine.
+    pub nonlinear: Nonlinear,
+    /// Fail on chapters whose HTML is larger than this many bytes rather than
+    /// converting them, to guard against books built to exhaust memory. Like
+    /// other conversion failures, this only stops the book when `strict`.
+    pub max_chapter_size: Option<u64>,
+    /// Cut chapters whose markdown is longer than this many bytes at their
+    /// top-level headings (see `markdown::chunk`), for books that put all of
+    /// their text in one file: into chapters of their own, titled "(part 2)"
+    /// and so on, when the chapters are kept apart, and with a
+    /// `SECTION_MARKER` between the parts in one document.
+    pub chunk_chapters: Option<usize>,
+    /// Remove lines that open or close at least this fraction (0 to 1) of the
+    /// chapters, such as a publisher banner repeated in every one. Headings
+    /// are never removed, and a line must repeat in at least three chapters.
+    pub strip_boilerplate: Option<f64>,
+    /// Remove the blocks, headings included, that open at least this many
+    /// chapters word for word, such as the book's title and author repeated
+    /// at the top of every chapter file, from all but the first. A block
+    /// matching the chapter's own TOC title is kept.
+    pub dedupe_boilerplate: Option<usize>,
+    /// Write MathML as LaTeX between $ (inline) or $$ (display) delimiters,
+    /// for renderers that typeset it. Otherwise math is left to html2md,
+    /// which runs its characters together.
+    pub math: bool,
+    /// Skip the cover, title page, copyright page and HTML table of contents
+    /// the spine opens with, found from the landmarks or guide and from file
+    /// names. Like non-linear items, they are converted when `chapters`
+    /// selects them.
+    pub skip_front_matter: bool,
+    /// Skip the ads for other books and colophon the spine closes with.
+    pub skip_back_matter: bool,
+    /// Put a `<a id="start-reading">` anchor before the chapter the landmarks
+    /// or guide say the text of the book starts at, past the cover, title page
+    /// and contents. Only applies when converting the whole book into one
+    /// document.
+    pub mark_start: bool,
+    /// Spine items matching any of these patterns, against the manifest id or
+    /// the href, are never skipped as front or back matter. `*` matches any
+    /// run of characters and `?` any one.
+    pub keep: Vec<String>,
+    /// Skip spine items whose TOC title matches any of these patterns, such
+    /// as "Also by" pages and newsletter sign-ups. Items without a TOC title
+    /// never match. Unlike front and back matter, they're skipped even when
+    /// `chapters` selects them.
+    pub skip_titles: Vec<Pattern>,
+    /// Skip spine items whose href, relative to the package document,
+    /// matches any of these patterns.
+    pub skip_hrefs: Vec<Pattern>,
+    /// Only convert the spine items whose title or href, relative to the
+    /// package document, matches one of these patterns, or all of them when
+    /// empty. The title is the one the chapter ends up with: its TOC label,
+    /// or failing that its first heading, its <title> or its file name.
+    /// Conversion fails when the patterns leave out every item.
+    pub match_chapters: Vec<Pattern>,
+    /// Leave out the spine items whose title or href matches any of these
+    /// patterns, even when `match_chapters` matches them too.
+    pub exclude_chapters: Vec<Pattern>,
+    /// Number of worker threads converting chapters; defaults to the number
+    /// of CPUs. Output keeps spine order regardless.
+    pub jobs: usize,
+    /// Convert tables to GitHub Flavored Markdown pipe tables. When false,
+    /// tables are kept as HTML blocks.
+    pub gfm: bool,
+    /// Called as each chapter finishes converting.
+    pub progress: Option<Progress>,
+    /// Run on each chapter's markdown in order; see `Transform` for when.
+    pub transforms: Vec<Transform>,
+    /// Which rootfile to convert when the book ships several renditions;
+    /// the first one by default.
+    pub rendition: Option<Rendition>,
+    /// Heading, list, emphasis and escaping style of the converted markdown.
+    pub markdown: MarkdownOptions,
+    /// When converting the whole book into one document, start each chapter
+    /// that doesn't open with a level 1 or 2 heading with its TOC title as a
+    /// heading of this level.
+    pub title_headings: Option<usize>,
+    /// Shift each chapter's headings so that its first heading is of this
+    /// level, and the rest keep their place relative to it (within levels 1
+    /// to 6), for books whose chapters start at <h1> in some places and <h3>
+    /// in others. Replaces `MarkdownOptions::heading_offset` where given.
+    pub promote_chapters: Option<usize>,
+    /// Keep the ids that links in the book point at as `<a id="..."></a>`
+    /// anchors, and link to those rather than to the heading before them.
+    /// Ids on or around headings aren't needed and aren't kept.
+    pub anchors: bool,
+    /// Give each heading an explicit `{#id}` attribute holding the anchor
+    /// links to it use, for renderers that don't generate GitHub's.
+    pub heading_ids: bool,
+    /// Prepend section numbers to the headings, "1.", "1.1.", "2." and so on
+    /// by level, counting on from one chapter to the next. Links to the
+    /// headings follow the anchors their numbered text gives them.
+    pub number_headings: bool,
+    /// Drop <script>, <style> and <template> elements, elements that are
+    /// hidden, and style and other presentational attributes, before
+    /// converting.
+    pub sanitize: bool,
+    /// Keep the lines of elements with a class matching any of these
+    /// patterns, such as "verse" or "stanza*", joining them with line breaks
+    /// as poetry needs. `*` matches any run of characters and `?` any one.
+    pub verse_classes: Vec<String>,
+    /// Mark up the chapters and paragraphs written right to left, which a
+    /// chapter declares with a dir or lang attribute on its <html> or <body>
+    /// and a paragraph with a dir attribute. Chapters that declare neither
+    /// run in the book's direction, see `Metadata::direction`.
+    pub rtl_wrap: Option<RtlWrap>,
+    /// How <ruby> annotations such as furigana are written.
+    pub ruby: Ruby,
+    /// Elements kept as their HTML, such as <details> or <sup>, since
+    /// markdown can't represent them. The markdown is then GitHub Flavored
+    /// Markdown mixed with HTML. Naming table keeps every table.
+    pub keep_html: Vec<String>,
+    /// Write a marker at each page break of the print edition that the book
+    /// marks, with {page} in it standing for the page number, such as
+    /// `DEFAULT_PAGE_MARKER`. Otherwise the page breaks are dropped, so that
+    /// their numbers don't run into the text.
+    pub page_markers: Option<String>,
+    /// Write the cover image to a file and show it after the front matter.
+    /// Books without a cover are converted without it, with a warning. Only
+    /// applies when converting the whole book into one document.
+    pub cover: Option<CoverOptions>,
+    /// Line ending of the combined document. Chapters always use `\n`;
+    /// `split::write_chapters` takes its own.
+    pub line_ending: LineEnding,
+}
+
+impl Default for Options {
+    fn default() -> Self {
+        Options {
+            front_matter: true,
+            metadata_format: MetadataFormat::default(),
+            toc: true,
+            toc_depth: None,
+            images: None,
+            embed_images: None,
+            inline_svg: false,
+            figure_captions: FigureCaption::default(),
+            strict: true,
+            unreadable: None,
+            lenient: true,
+            cancel: None,
+            chapters: None,
+            nonlinear: Nonlinear::default(),
+            max_chapter_size: None,
+            chunk_chapters: None,
+            strip_boilerplate: None,
+            dedupe_boilerplate: None,
+            math: false,
+            skip_front_matter: false,
+            skip_back_matter: false,
+            mark_start: false,
+            keep: Vec::new(),
+            skip_titles: Vec::new(),
+            skip_hrefs: Vec::new(),
+            match_chapters: Vec::new(),
+            exclude_chapters: Vec::new(),
+            jobs: pool::default_jobs(),
+            gfm: true,
+            progress: None,
+            transforms: Vec::new(),
+            rendition: None,
+            markdown: MarkdownOptions::default(),
+            title_headings: None,
+            promote_chapters: None,
+            anchors: false,
+            heading_ids: false,
+            number_headings: false,
+            sanitize: true,
+            verse_classes: Vec::new(),
+            rtl_wrap: None,
+            ruby: Ruby::default(),
+            keep_html: keep::DEFAULT_KEEP_HTML.iter().map(|tag| tag.to_string()).collect(),
+            page_markers: None,
+            cover: None,
+            line_ending: LineEnding::default(),
+        }
+    }
+}
+
+// Converts the chapters with the default options, one at a time as
+// `Converter::lazy_chapters_file` hands them out.
 pub fn epub_to_markdown(path_str: &str) -> Result<Vec<String>> {
+    let chapters = Converter::new().lazy_chapters_file(path_str)?;
+    chapters.map(|chapter| chapter?.markdown()).collect()
+}
+
+pub fn convert_chapters(path_str: &str) -> Result<Vec<Chapter>> {
+    convert_chapters_with(path_str, &Options::default())
+}
+
+pub fn convert_chapters_with(path_str: &str, options: &Options) -> Result<Vec<Chapter>> {
+    let mut doc = open_file(path_str, options.lenient)?;
+    select_rendition(&mut doc, options)?;
+    let (points, _) = load_toc(&mut doc, options)?;
+    doc_to_chapters(&mut doc, &points, options, true)
+}
+
+pub fn convert_chapters_from<R: Read>(reader: R, options: &Options) -> Result<Vec<Chapter>> {
+    let mut doc = open_reader(reader, options.lenient)?;
+    select_rendition(&mut doc, options)?;
+    let (points, _) = load_toc(&mut doc, options)?;
+    doc_to_chapters(&mut doc, &points, options, true)
+}
+
+// Reads the book's metadata, table of contents and cover and converts its
+// chapters, opening the archive once for all of them.
+pub fn convert_all(path_str: &str) -> Result<Contents> {
+    convert_all_with(path_str, &Options::default())
+}
+
+pub fn convert_all_with(path_str: &str, options: &Options) -> Result<Contents> {
+    contents::load(open_file(path_str, options.lenient)?, options)
+}
+
+pub fn convert_all_from<R: Read>(reader: R, options: &Options) -> Result<Contents> {
+    contents::load(open_reader(reader, options.lenient)?, options)
+}
+
+// Opens the book for `Converter::lazy_chapters_file`.
+fn open_chapters(path_str: &str, options: &Options) -> Result<Chapters> {
+    let mut doc = open_file(path_str, options.lenient)?;
+    select_rendition(&mut doc, options)?;
+    Chapters::new(Book { options: options.clone(), ..Book::new(doc) })
+}
+
+// Opens the book for `Converter::lazy_chapters`, reading it from `reader` as it's
+// converted, or from memory once it had to be repaired.
+fn open_chapters_from<R: Read + Seek + Send + 'static>(reader: R, options: &Options) -> Result<Chapters> {
+    let mut doc = open_seekable(reader, options.lenient)?;
+    select_rendition(&mut doc, options)?;
+    Chapters::new(Book { options: options.clone(), ..Book::new(doc) })
+}
+
+// Loads the navigation, handling a navigation document or NCX that can't be
+// read as `options.unreadable` says. Returns the note to put in place of the
+// table of contents, if any.
+fn load_toc<R: Read + Seek>(doc: &mut EpubDoc<R>, options: &Options) -> Result<(Vec<NavPoint>, Option<String>)> {
+    let note = match (toc::check(doc), options.unreadable) {
+        (Ok(()), _) | (Err(_), None) => None,
+        (Err(e), Some(Unreadable::Fail)) => return Err(e.into()),
+        (Err(e), Some(Unreadable::Skip)) => {
+            info!("leaving out the navigation: {}", e);
+            None
+        }
+        (Err(e), Some(Unreadable::Placeholder)) => {
+            warn!("{}", e);
+            Some(format!("> [unreadable: {}]", e))
+        }
+    };
+    Ok((toc::load(doc), note))
+}
+
+// The spine item at `index`, counting from 1, as it is in the archive: the
+// chapter's XHTML before anything is converted, for callers that render it
+// themselves. Image and SVG pages in the spine come back as they are too.
+pub fn chapter_html(path_str: &str, index: usize) -> Result<Vec<u8>> {
+    let mut doc = open_file(path_str, true)?;
+    let len = doc.spine.len();
+    if index == 0 {
+        anyhow::bail!("Chapter 0 is out of range: chapters count from 1");
+    }
+    check_chapter(index, len)?;
+    let id = doc.spine[index - 1].clone();
+    read_raw(&mut doc, &id)
+}
+
+// Every spine item as it is in the archive, in spine order.
+pub fn chapters_html(path_str: &str) -> Result<Vec<Vec<u8>>> {
+    let mut doc = open_file(path_str, true)?;
+    let ids = doc.spine.clone();
+    ids.iter().map(|id| read_raw(&mut doc, id)).collect()
+}
+
+// Converts the book and counts the words in each chapter.
+pub fn book_stats(path_str: &str) -> Result<BookStats> {
+    Ok(BookStats::new(&convert_chapters(path_str)?))
+}
+
+// Checks the book's structure without converting it: that
+// META-INF/container.xml names a package document, that every manifest item
+// is in the archive under a unique id, that the spine only refers to manifest
+// items, and that there's a navigation document or NCX. An empty list means
+// the book looks fine; an error means it isn't a readable archive at all.
+pub fn validate(path_str: &str) -> Result<Vec<Problem>> {
+    if let Some(bytes) = unpacked::pack(Path::new(path_str))? {
+        return validate_from(Cursor::new(bytes));
+    }
+    let mut archive = EpubArchive::new(path_str).map_err(|e| anyhow::anyhow!("Failed to open EPUB file: {}", e))?;
+    Ok(validate::check(&mut archive))
+}
+
+pub fn validate_from<R: Read>(mut reader: R) -> Result<Vec<Problem>> {
+    let mut bytes = Vec::new();
+    reader.read_to_end(&mut bytes).context("Failed to read EPUB")?;
+    let mut archive =
+        EpubArchive::from_reader(Cursor::new(bytes)).map_err(|e| anyhow::anyhow!("Failed to open EPUB: {}", e))?;
+    Ok(validate::check(&mut archive))
+}
+
+// Lists the rootfiles in META-INF/container.xml, in order.
+pub fn renditions(path_str: &str) -> Result<Vec<Rootfile>> {
+    let mut doc = open_file(path_str, true)?;
+    opf::rootfiles(&mut doc)
+}
+
+pub fn read_metadata(path_str: &str) -> Result<Metadata> {
+    let mut doc = open_file(path_str, true)?;
+    Ok(Metadata::load(&mut doc))
+}
+
+pub fn read_metadata_from<R: Read>(reader: R) -> Result<Metadata> {
+    let mut doc = open_reader(reader, true)?;
+    Ok(Metadata::load(&mut doc))
+}
+
+// Summarizes the book's metadata and structure without converting it.
+pub fn book_info(path_str: &str) -> Result<Info> {
+    let mut doc = open_file(path_str, true)?;
+    info::read(&mut doc)
+}
+
+pub fn book_info_from<R: Read>(reader: R) -> Result<Info> {
+    let mut doc = open_reader(reader, true)?;
+    info::read(&mut doc)
+}
+
+// The book's page list, mapping the print edition's page numbers to where
+// those pages start; empty when the book has none.
+pub fn page_list(path_str: &str) -> Result<Vec<PageTarget>> {
+    let mut doc = open_file(path_str, true)?;
+    Ok(pages::page_list(&mut doc))
+}
+
+pub fn page_list_from<R: Read>(reader: R) -> Result<Vec<PageTarget>> {
+    let mut doc = open_reader(reader, true)?;
+    Ok(pages::page_list(&mut doc))
+}
+
+// Lists the spine items and the rest of the manifest as the package document
+// declares them, without converting anything.
+pub fn list_items(path_str: &str) -> Result<Items> {
+    let mut doc = open_file(path_str, true)?;
+    items::read(&mut doc)
+}
+
+pub fn list_items_from<R: Read>(reader: R) -> Result<Items> {
+    let mut doc = open_reader(reader, true)?;
+    items::read(&mut doc)
+}
+
+// The hrefs of the spine items, relative to the package document, in the
+// order conversion visits them: the spine's, whatever order the manifest
+// lists them in, with the items marked linear="no" after the rest as
+// `Nonlinear::Appendix` puts them. Spine entries without a manifest item are
+// left out, as conversion skips them.
+pub fn reading_order(path_str: &str) -> Result<Vec<String>> {
+    let mut doc = open_file(path_str, true)?;
+    let spine_ids: Vec<String> = doc.spine.iter().cloned().collect();
+    let nonlinear = opf::nonlinear(&mut doc);
+    let hrefs = reading_positions(&spine_ids, &nonlinear, Nonlinear::default())
+        .into_iter()
+        .filter_map(|index| {
+            let (path, _) = doc.resources.get(&spine_ids[index])?;
+            Some(path.strip_prefix(&doc.root_base).unwrap_or(path).to_string_lossy().into_owned())
+        })
+        .collect();
+    Ok(hrefs)
+}
+
+// The landmarks of the book, from an EPUB3 navigation document's landmarks
+// nav and then an EPUB2 package document's guide.
+pub fn guide(path_str: &str) -> Result<Vec<GuideRef>> {
+    let mut doc = open_file(path_str, true)?;
+    Ok(guide::read(&mut doc))
+}
+
+pub fn guide_from<R: Read>(reader: R) -> Result<Vec<GuideRef>> {
+    let mut doc = open_reader(reader, true)?;
+    Ok(guide::read(&mut doc))
+}
+
+// Writes the book's cover image to `dst_path`. Fails with `NoCover` when the
+// book doesn't declare one.
+pub fn extract_cover(path_str: &str, dst_path: &Path) -> Result<()> {
+    let mut doc = open_file(path_str, true)?;
+    let (_, bytes) = cover::read(&mut doc)?;
+    fs::write(dst_path, bytes).with_context(|| format!("Failed to write {}", dst_path.display()))
+}
+
+// Renders the book's navigation (the EPUB3 nav document, the NCX, or else the
+// spine) as a nested markdown list linking to the chapter anchors.
+pub fn build_toc(path_str: &str) -> Result<String> {
+    let mut doc = open_file(path_str, true)?;
+    let points = toc::load(&mut doc);
+    Ok(toc::render(&points, &doc.root_base))
+}
+
+pub fn build_toc_from<R: Read>(reader: R) -> Result<String> {
+    let mut doc = open_reader(reader, true)?;
+    let points = toc::load(&mut doc);
+    Ok(toc::render(&points, &doc.root_base))
+}
+
+// A book opened for converting one spine item at a time, for callers such as
+// the interactive reader that shouldn't convert everything up front.
+pub struct Book<R: Read + Seek> {
+    doc: EpubDoc<R>,
+    toc: Vec<NavPoint>,
+    titles: HashMap<PathBuf, String>,
+    nonlinear: HashSet<String>,
+    matter: HashMap<String, Matter>,
+    // The element ids of each converted chapter and the heading each falls
+    // under, by spine position counting from 0.
+    ids: HashMap<usize, HashMap<String, Option<usize>>>,
+    // How chapters are converted; the defaults, but for books opened by
+    // `Converter::lazy_chapters`.
+    options: Options,
+}
+
+impl Book<EpubFile> {
+    pub fn open(path_str: &str) -> Result<Self> {
+        Ok(Book::new(open_file(path_str, true)?))
+    }
+}
+
+impl Book<Cursor<Vec<u8>>> {
+    pub fn from_reader<T: Read>(reader: T) -> Result<Self> {
+        Ok(Book::new(open_reader(reader, true)?))
+    }
+}
+
+impl<R: Read + Seek> Book<R> {
+    fn new(mut doc: EpubDoc<R>) -> Self {
+        let toc = toc::load(&mut doc);
+        let titles = chapter::toc_titles(&toc);
+        let nonlinear = opf::nonlinear(&mut doc);
+        let matter = matter::classify(&mut doc, &[]);
+        Book {
+            doc,
+            toc,
+            titles,
+            nonlinear,
+            matter,
+            ids: HashMap::new(),
+            options: Options::default(),
+        }
+    }
+
+    // Leaves the items matching these --keep patterns out of the front and
+    // back matter marked by `spine`.
+    pub fn keeping(mut self, patterns: &[String]) -> Self {
+        self.matter = matter::classify(&mut self.doc, patterns);
+        self
+    }
+
+    // The number of spine items.
+    pub fn len(&self) -> usize {
+        self.doc.spine.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.doc.spine.is_empty()
+    }
+
+    // Identifies the book from one run to the next, for remembering where
+    // reading stopped: its identifier, or failing that a hash of its package
+    // document.
+    pub fn key(&mut self) -> String {
+        let identifier = self.doc.metadata.get("identifier").and_then(|ids| ids.first()).map(|id| id.trim());
+        if let Some(identifier) = identifier.filter(|id| !id.is_empty()) {
+            return format!("id:{}", identifier);
+        }
+        let root_file = self.doc.root_file.clone();
+        let package = self.doc.get_resource_by_path(&root_file).unwrap_or_default();
+        format!("opf:{:016x}", positions::fnv1a(&package))
+    }
+
+    // Lists the spine in reading order with the TOC title of each item.
+    pub fn spine(&self) -> Vec<SpineEntry> {
+        self.doc
+            .spine
+            .iter()
+            .enumerate()
+            .map(|(i, idref)| SpineEntry {
+                index: i + 1,
+                idref: idref.clone(),
+                title: self.doc.resources.get(idref).and_then(|(path, _)| self.titles.get(path).cloned()),
+                linear: !self.nonlinear.contains(idref),
+                matter: self.matter.get(idref).copied(),
+            })
+            .collect()
+    }
+
+    // The table of contents in reading order, each entry followed by those
+    // nested under it, leaving out entries that point outside the spine. A
+    // book without one, or whose entries all point outside it, lists its
+    // spine instead, each item under the title it gives itself.
+    pub fn toc(&mut self) -> Vec<TocEntry> {
+        toc_of(&mut self.doc, &self.toc)
+    }
+
+    // The heading the element with this id falls under in the spine item at
+    // `index` (counting from 0), counting the item's headings from 0, once
+    // `chapter` has converted it. None for ids before the first heading and
+    // ids the item doesn't have.
+    pub fn heading_of(&self, index: usize, id: &str) -> Option<usize> {
+        self.ids.get(&index)?.get(id).copied().flatten()
+    }
+
+    // Converts the spine item at `index` (counting from 0).
+    pub fn chapter(&mut self, index: usize) -> Result<Chapter> {
+        let (chapter, marks) = self.convert(index, None)?;
+        // Other chapters aren't converted, so links between them keep their hrefs.
+        let markdown = links::Targets::default().resolve(&chapter.markdown, &marks.links);
+        Ok(Chapter { markdown, ..chapter })
+    }
+
+    // Converts the spine item at `index` (counting from 0), leaving its links
+    // as placeholders for `links::Targets::resolve`. Without `wide` it's
+    // converted on its own, taking only the notes it refers to.
+    fn convert(&mut self, index: usize, wide: Option<&BookWide>) -> Result<(Chapter, links::Marks)> {
+        let id = self
+            .doc
+            .spine
+            .get(index)
+            .cloned()
+            .with_context(|| format!("No chapter {} (the book has {})", index + 1, self.len()))?;
+        let (path, media_type) = match self.doc.resources.get(&id) {
+            Some((path, media_type)) => (path.clone(), media_type.clone()),
+            None => anyhow::bail!("Spine item {} is not in the manifest", id),
+        };
+        let href = path.strip_prefix(&self.doc.root_base).unwrap_or(&path).to_string_lossy().into_owned();
+        let (doc, options) = (&mut self.doc, &self.options);
+        let max_size = options.max_chapter_size;
+        let (own_title, markdown, marks) = read_spine_item(doc, &id, &path, &media_type, max_size, options.inline_svg)
+            .and_then(|html| html.with_context(|| format!("{} is {} and can't be converted", href, media_type)))
+            .and_then(|html| {
+                let own;
+                let wide = match wide {
+                    Some(wide) => wide,
+                    None => {
+                        let chapter = [(path.as_path(), html.as_str())];
+                        let note_files = footnotes::NoteFiles::load(chapter, |p| read_path(doc, p));
+                        own = BookWide { note_files, ..BookWide::default() };
+                        &own
+                    }
+                };
+                let converter = HtmlConverter::new(&options.markdown).with_direction(Metadata::load(doc).direction);
+                convert_html(&html, &path, wide, &converter, options)
+            })
+            .with_context(|| format!("Failed to convert {}", href))?;
+        let title = chapter::resolve_title(self.titles.get(&path), own_title, &href);
+        self.ids.insert(index, marks.ids.clone());
+        let chapter = Chapter {
+            index: index + 1,
+            title,
+            href,
+            markdown,
+        };
+        Ok((chapter, marks))
+    }
+
+    // What the spine items at `indexes` (counting from 0) take from each
+    // other when converted together, as whole-book conversion finds it. The
+    // items that can't be read are left out of it.
+    fn book_wide(&mut self, indexes: &[usize]) -> Result<BookWide> {
+        let (doc, options) = (&mut self.doc, &self.options);
+        let image_links = image_links(doc, options)?;
+        let mut read = Vec::new();
+        for &index in indexes {
+            let Some((path, media_type)) = doc.spine.get(index).and_then(|id| doc.resources.get(id)).cloned() else {
+                continue;
+            };
+            let id = doc.spine[index].clone();
+            let max_size = options.max_chapter_size;
+            if let Ok(Some(html)) = read_spine_item(doc, &id, &path, &media_type, max_size, options.inline_svg) {
+                read.push((path, html));
+            }
+        }
+        let read: Vec<(&Path, &str)> = read.iter().map(|(path, html)| (path.as_path(), html.as_str())).collect();
+        Ok(BookWide::load(doc, &read, image_links, options))
+    }
+
+    // The spine item at `index` (counting from 0) as it is in the archive.
+    pub fn html(&mut self, index: usize) -> Result<Vec<u8>> {
+        let id = self
+            .doc
+            .spine
+            .get(index)
+            .cloned()
+            .with_context(|| format!("No chapter {} (the book has {})", index + 1, self.len()))?;
+        read_raw(&mut self.doc, &id)
+    }
+
+    // Converts the spine items one at a time as the iterator is advanced, in
+    // spine order, so that a caller can send each chapter on as soon as it's
+    // ready. Dropping the iterator stops the conversion. An item that can't be
+    // converted is an error in its place and the rest still follow.
+    pub fn chapters(&mut self) -> impl Iterator<Item = Result<Chapter>> + '_ {
+        (0..self.len()).map(move |index| self.chapter(index))
+    }
+
+    // Searches the chapters' plain text, converting one chapter at a time and
+    // calling `on_match` with its matches before moving on to the next. An
+    // error from `on_match` stops the search. Chapters that can't be converted
+    // are reported and skipped.
+    pub fn search<F>(&mut self, pattern: &Pattern, context: usize, mut on_match: F) -> Result<()>
+    where
+        F: FnMut(SearchMatch) -> Result<()>,
+    {
+        for (index, chapter) in self.chapters().enumerate() {
+            let chapter = match chapter {
+                Ok(chapter) => chapter,
+                Err(e) => {
+                    warn!("skipping chapter {}: {:#}", index + 1, e);
+                    continue;
+                }
+            };
+            for found in search::search_chapter(&chapter, pattern, context) {
+                on_match(found)?;
+            }
+        }
+        Ok(())
+    }
+}
+
+// The entries `Book::toc` lists for the navigation `points` of `doc`.
+fn toc_of<R: Read + Seek>(doc: &mut EpubDoc<R>, points: &[NavPoint]) -> Vec<TocEntry> {
+    let spine: HashMap<PathBuf, usize> = doc
+        .spine
+        .iter()
+        .enumerate()
+        .filter_map(|(i, idref)| doc.resources.get(idref).map(|(path, _)| (path.clone(), i + 1)))
+        .collect();
+    let mut entries = Vec::new();
+    toc_entries(points, 0, &spine, &mut entries);
+    if entries.is_empty() {
+        toc_entries(&toc::from_spine(doc), 0, &spine, &mut entries);
+    }
+    entries
+}
+
+fn toc_entries(points: &[NavPoint], depth: usize, spine: &HashMap<PathBuf, usize>, entries: &mut Vec<TocEntry>) {
+    let mut points: Vec<&NavPoint> = points.iter().collect();
+    points.sort_by_key(|point| point.play_order);
+    for point in points {
+        let content = point.content.to_string_lossy();
+        let (path, fragment) = match content.split_once('#') {
+            Some((path, fragment)) => (path, Some(fragment).filter(|fragment| !fragment.is_empty())),
+            None => (content.as_ref(), None),
+        };
+        let title = point.label.split_whitespace().collect::<Vec<_>>().join(" ");
+        match spine.get(Path::new(path)) {
+            Some(index) if !title.is_empty() => entries.push(TocEntry {
+                title,
+                depth,
+                index: *index,
+                fragment: fragment.map(String::from),
+            }),
+            _ => {}
+        }
+        toc_entries(&point.children, depth + 1, spine, entries);
+    }
+}
+
+// Every line of the book's plain text matching `pattern`, chapter by chapter.
+pub fn search(path_str: &str, pattern: &str, options: &SearchOptions) -> Result<Vec<SearchMatch>> {
+    let pattern = Pattern::new(pattern, options)?;
+    let mut matches = Vec::new();
+    Book::open(path_str)?.search(&pattern, options.context, |found| {
+        matches.push(found);
+        Ok(())
+    })?;
+    Ok(matches)
+}
+
+pub fn convert<R: Read>(reader: R) -> Result<String> {
+    convert_with(reader, &Options::default())
+}
+
+// Reads the whole EPUB into memory first, since the zip archive has to be
+// seekable; nothing is written to disk. Use convert_seekable to avoid the copy
+// when the bytes are already in memory.
+pub fn convert_with<R: Read>(reader: R, options: &Options) -> Result<String> {
+    let mut doc = open_reader(reader, options.lenient)?;
+    assemble(&mut doc, options)
+}
+
+// Converts an EPUB from any seekable source without buffering it again, and
+// without a file on disk: a Cursor over an upload body, or over a book built
+// into the program with include_bytes!.
+pub fn convert_seekable<R: Read + Seek>(reader: R, options: &Options) -> Result<String> {
+    assemble(&mut open_seekable(reader, options.lenient)?, options)
+}
+
+pub fn convert_file(path_str: &str) -> Result<String> {
+    convert_file_with(path_str, &Options::default())
+}
+
+pub fn convert_file_with(path_str: &str, options: &Options) -> Result<String> {
+    let mut doc = open_file(path_str, options.lenient)?;
+    assemble(&mut doc, options)
+}
+
+fn open_file(path_str: &str, lenient: bool) -> Result<EpubDoc<EpubFile>> {
     let path = Path::new(path_str);
-    let mut doc = EpubDoc::new(path).map_err(|e| anyhow::anyhow!("Failed to open EPUB file: {}", e))?;
+    let mut reader = match unpacked::pack(path).with_context(|| format!("Failed to open {}", path_str))? {
+        Some(bytes) => EpubFile::Memory(Cursor::new(bytes)),
+        None => {
+            let file = File::open(path).map_err(|e| anyhow::anyhow!("Failed to open EPUB file: {}", e))?;
+            EpubFile::Disk(BufReader::new(file))
+        }
+    };
+    let opened = tolerate(&mut reader, path_str, lenient).and_then(|repaired| {
+        let reader = match repaired {
+            Some(bytes) => EpubFile::Memory(Cursor::new(bytes)),
+            None => reader,
+        };
+        EpubDoc::from_reader(reader).map_err(|e| InvalidEpub::Corrupt(e.to_string()))
+    });
+    let mut doc = opened.with_context(|| format!("Failed to open {}", path_str))?;
+    drm::check(&mut doc)?;
+    Ok(doc)
+}
 
-    let mut markdown_chunks = Vec::new();
+// Checks the book before the epub crate opens it. What can't be worked
+// around is an error, and so is anything out of spec unless `lenient`, when
+// it's warned about instead. Returns a repaired copy of the archive when the
+// epub crate couldn't open the book as it is, and otherwise leaves the reader
+// at the start.
+fn tolerate<R: Read + Seek>(reader: &mut R, book: &str, lenient: bool) -> Result<Option<Vec<u8>>, InvalidEpub> {
+    let defects = invalid::check(&mut *reader)?;
+    let rewind = |reader: &mut R| reader.rewind().map_err(|e| InvalidEpub::Corrupt(format!("can't read it again: {}", e)));
+    rewind(reader)?;
+    if let (false, Some(defect)) = (lenient, defects.first()) {
+        return Err(defect.into());
+    }
+    for defect in &defects {
+        warn!("{} is out of spec: {}", book, defect);
+    }
+    if !defects.iter().any(Defect::needs_repair) {
+        return Ok(None);
+    }
+    let repaired = lenient::repair(&mut *reader, &defects).map_err(|e| InvalidEpub::Corrupt(format!("{:#}", e)))?;
+    rewind(reader)?;
+    Ok(Some(repaired))
+}
 
+// Opens the book from `reader` as it is, or from a repaired copy in memory
+// when it has to be.
+fn open_seekable<R: Read + Seek>(mut reader: R, lenient: bool) -> Result<EpubDoc<Repaired<R>>> {
+    let reader = match tolerate(&mut reader, "the EPUB", lenient)? {
+        Some(repaired) => Repaired::Copy(Cursor::new(repaired)),
+        None => Repaired::Original(reader),
+    };
+    let mut doc = EpubDoc::from_reader(reader).map_err(|e| InvalidEpub::Corrupt(e.to_string()))?;
+    drm::check(&mut doc)?;
+    Ok(doc)
+}
+
+// The zip reader needs to seek, so the input is buffered in memory first.
+fn open_reader<R: Read>(mut reader: R, lenient: bool) -> Result<EpubDoc<Cursor<Vec<u8>>>> {
+    let mut bytes = Vec::new();
+    reader.read_to_end(&mut bytes).context("Failed to read EPUB")?;
+    if let Some(repaired) = tolerate(&mut Cursor::new(bytes.as_slice()), "the EPUB", lenient)? {
+        bytes = repaired;
+    }
+    let mut doc = EpubDoc::from_reader(Cursor::new(bytes)).map_err(|e| InvalidEpub::Corrupt(e.to_string()))?;
+    drm::check(&mut doc)?;
+    Ok(doc)
+}
+
+// Switches to the requested rendition, or warns when the book has several and
+// the first one is used by default.
+fn select_rendition<R: Read + Seek>(doc: &mut EpubDoc<R>, options: &Options) -> Result<()> {
+    let rootfiles = match (opf::rootfiles(doc), &options.rendition) {
+        (Ok(rootfiles), _) => rootfiles,
+        (Err(_), None) => return Ok(()),
+        (Err(e), Some(_)) => return Err(e),
+    };
+    let list = || {
+        let entries: Vec<String> =
+            rootfiles.iter().enumerate().map(|(i, rootfile)| format!("{}: {}", i + 1, rootfile.describe())).collect();
+        entries.join(", ")
+    };
+    let rendition = match &options.rendition {
+        Some(rendition) => rendition,
+        None => {
+            if rootfiles.len() > 1 {
+                warn!("the book has {} renditions ({}), using the first", rootfiles.len(), list());
+            }
+            info!("reading the package document {}", doc.root_file.display());
+            return Ok(());
+        }
+    };
+    let rootfile = rendition
+        .find(&rootfiles)
+        .with_context(|| format!("No rendition {} (the book has {})", rendition, list()))?;
+    let root_file = Path::new(&rootfile.full_path);
+    if root_file != doc.root_file {
+        opf::switch_rootfile(doc, root_file)?;
+    }
+    info!("reading the package document {}, rendition {}", rootfile.full_path, rendition);
+    Ok(())
+}
+
+fn assemble<R: Read + Seek>(doc: &mut EpubDoc<R>, options: &Options) -> Result<String> {
+    select_rendition(doc, options)?;
+    let mut parts = Vec::new();
+    if options.front_matter {
+        let metadata = Metadata::load(doc);
+        let header = metadata.header(options.metadata_format);
+        if !metadata.is_empty() && !header.is_empty() {
+            parts.push(header);
+        }
+    }
+    if let Some(cover) = &options.cover {
+        parts.extend(cover::write(doc, cover)?);
+    }
+    // The navigation is read once and shared with the chapter titles.
+    let (points, note) = load_toc(doc, options)?;
+    if options.toc {
+        parts.extend(note);
+    }
+    let (mut chapters, failures) = match doc_to_chapters(doc, &points, options, false) {
+        Ok(chapters) => (chapters, None),
+        Err(e) => {
+            let mut errors = e.downcast::<ChapterErrors>()?;
+            (std::mem::take(&mut errors.chapters), Some(errors))
+        }
+    };
+    if options.toc && options.toc_depth.is_none() && !points.is_empty() {
+        // The chapters the title and href filters leave out aren't listed.
+        let points = match options.match_chapters.is_empty() && options.exclude_chapters.is_empty() {
+            true => points.clone(),
+            false => {
+                let files = chapters.iter().map(|chapter| doc.root_base.join(&chapter.href)).collect();
+                toc::only_files(points.clone(), &files)
+            }
+        };
+        parts.push(toc::render(&points, &doc.root_base));
+    }
+    if let Some(level) = options.title_headings {
+        add_title_headings(&mut chapters, &chapter::toc_titles(&points), &doc.root_base, level, &options.markdown);
+    }
+    if options.nonlinear == Nonlinear::Appendix && options.chapters.is_none() {
+        add_appendix_heading(&mut chapters, &opf::nonlinear(doc), &doc.spine, &options.markdown);
+    }
+    if let Some(max) = options.chunk_chapters {
+        for chapter in chapters.iter_mut() {
+            let parts = chunk_chapter(chapter, max);
+            if parts.len() > 1 {
+                let parts: Vec<&str> = parts.iter().map(|part| part.trim_matches('\n')).collect();
+                chapter.markdown = parts.join(&format!("\n\n{}\n\n", SECTION_MARKER)) + "\n";
+            }
+        }
+    }
+    if options.number_headings {
+        links::number_headings(&mut chapters);
+    }
+    links::merge(&mut chapters);
+    if let Some(depth) = options.toc_depth.filter(|_| options.toc) {
+        parts.push(toc::generate(&chapters, depth));
+    }
+    if options.heading_ids {
+        // In the same order as `links::merge`, so the ids match the links.
+        let mut slugger = Slugger::default();
+        for chapter in chapters.iter_mut() {
+            chapter.markdown = markdown::add_heading_ids(&chapter.markdown, &mut slugger);
+        }
+    }
+    if options.mark_start {
+        mark_start(&mut chapters, &guide::read(doc), &doc.root_base);
+    }
+    parts.extend(chapters.into_iter().map(|chapter| chapter.markdown));
+    let markdown = normalize(&parts.join("\n\n"), options.line_ending);
+    match failures {
+        Some(errors) => Err(ChapterErrors { markdown, ..errors }.into()),
+        None => Ok(markdown),
+    }
+}
+
+// Puts the start-reading anchor before the chapter where the text starts.
+// Books that don't say, or whose start page was skipped, are left as they are.
+fn mark_start(chapters: &mut [Chapter], references: &[GuideRef], root_base: &Path) {
+    let Some(start) = references.iter().find(|reference| reference.is_start()) else {
+        info!("not marking the start: the book's guide and landmarks don't say where the text starts");
+        return;
+    };
+    match chapters.iter_mut().find(|chapter| root_base.join(&chapter.href) == start.path) {
+        Some(chapter) => chapter.markdown = format!("<a id=\"start-reading\"></a>\n\n{}", chapter.markdown),
+        None => info!("not marking the start: {} isn't converted", start.href),
+    }
+}
+
+// Opens the non-linear items, which come after the rest of the book, with a
+// top-level Appendix heading, so that they don't read as part of the last
+// chapter.
+fn add_appendix_heading(
+    chapters: &mut [Chapter],
+    nonlinear: &HashSet<String>,
+    spine: &[String],
+    style: &MarkdownOptions,
+) {
+    let is_nonlinear = |chapter: &Chapter| spine.get(chapter.index - 1).is_some_and(|id| nonlinear.contains(id));
+    if let Some(chapter) = chapters.iter_mut().find(|chapter| is_nonlinear(chapter)) {
+        let heading = converter::heading(style.headings, (1 + style.heading_offset).min(6), "Appendix");
+        chapter.markdown = format!("{}\n\n{}", heading, chapter.markdown.trim_start_matches('\n'));
+    }
+}
+
+// The parts `Options::chunk_chapters` cuts a chapter into, the whole chapter
+// when it's small enough.
+fn chunk_chapter(chapter: &Chapter, max: usize) -> Vec<String> {
+    let parts = markdown::chunk(&chapter.markdown, max);
+    if parts.len() > 1 {
+        info!("cut {} ({} KiB) into {} parts", chapter.href, chapter.markdown.len().div_ceil(1024), parts.len());
+    }
+    parts
+}
+
+// Gives chapters whose title is only in the TOC a visible heading, so that
+// chapter boundaries show in the combined document. Chapters that already open
+// with a level 1 or 2 heading (after any heading offset) are left alone.
+fn add_title_headings(
+    chapters: &mut [Chapter],
+    titles: &HashMap<PathBuf, String>,
+    root_base: &Path,
+    level: usize,
+    style: &MarkdownOptions,
+) {
+    let max_level = (2 + style.heading_offset).min(6);
+    for chapter in chapters.iter_mut() {
+        let title = match titles.get(&root_base.join(&chapter.href)) {
+            Some(title) => title.split_whitespace().collect::<Vec<_>>().join(" "),
+            None => continue,
+        };
+        if title.is_empty() || markdown::starts_with_heading(&chapter.markdown, max_level) {
+            continue;
+        }
+        let heading = converter::heading(style.headings, level.clamp(1, 6), &title);
+        chapter.markdown = format!("{}\n\n{}", heading, chapter.markdown.trim_start_matches('\n'));
+    }
+}
+
+// Converts the spine into chapters. `standalone` chapters are used on their
+// own, so heading ids only need to be unique within each one; otherwise the
+// caller joins them and adds ids across the whole book.
+fn doc_to_chapters<R: Read + Seek>(
+    doc: &mut EpubDoc<R>,
+    toc: &[NavPoint],
+    options: &Options,
+    standalone: bool,
+) -> Result<Vec<Chapter>> {
+    let titles = chapter::toc_titles(toc);
+    let obfuscated = drm::read(doc).obfuscated;
+    if !obfuscated.is_empty() {
+        warn!("converting the text without the obfuscated fonts: {}", obfuscated.join(", "));
+    }
+    let image_links = image_links(doc, options)?;
+
+    // Reading from the archive needs the document mutably, so the spine items
+    // are read in order first and only the conversion runs on the pool.
     let spine_ids: Vec<String> = doc.spine.iter().cloned().collect();
-    for (_idx, spine_item_id) in spine_ids.iter().enumerate() {
-        if let Ok(content_bytes_vec) = doc.get_resource(spine_item_id) {
-            let html_content = String::from_utf8_lossy(&content_bytes_vec);
-            let markdown = html2md::parse_html(&html_content);
-            markdown_chunks.push(markdown);
+    let mut filter = filter::SpineFilter::new(doc, options, &titles)?;
+    // Every spine item is reported once, including the ones that are skipped,
+    // so the count always ends at the length of the spine.
+    let done = AtomicUsize::new(0);
+    let root_base = doc.root_base.clone();
+    let report = |path: &Path| {
+        if let Some(progress) = &options.progress {
+            let href = path.strip_prefix(&root_base).unwrap_or(path).to_string_lossy();
+            progress.report(done.fetch_add(1, Ordering::SeqCst) + 1, spine_ids.len(), &href);
+        }
+    };
+    let mut items = Vec::new();
+    // Notes standing in for the spine items that couldn't be read, each with
+    // the number of items converted before it.
+    let mut unreadable = Vec::new();
+    for (position, index) in filter.order(&spine_ids).into_iter().enumerate() {
+        let spine_item_id = &spine_ids[index];
+        let resource = doc.resources.get(spine_item_id).cloned();
+        if filter.skips(index, spine_item_id, resource.as_ref().map(|(path, _)| path.as_path())) {
+            report(resource.as_ref().map_or(Path::new(spine_item_id), |(path, _)| path));
+            continue;
+        }
+        if let Some(Err(e)) = options.cancel.as_ref().map(CancelToken::check) {
+            let stopped = format!("Stopped after {} of {} spine items", position, spine_ids.len());
+            return Err(anyhow::Error::new(e).context(stopped));
+        }
+        let Some((path, media_type)) = resource else {
+            report(Path::new(spine_item_id));
+            continue;
+        };
+        let max_size = options.max_chapter_size;
+        let html = match read_spine_item(doc, spine_item_id, &path, &media_type, max_size, options.inline_svg) {
+            Ok(Some(html)) => Ok(html),
+            Ok(None) => {
+                let href = path.strip_prefix(&doc.root_base).unwrap_or(&path).display().to_string();
+                warn!("skipping spine item {} ({})", href, media_type);
+                report(&path);
+                continue;
+            }
+            Err(e) => Err(e),
+        };
+        let html = match (html, options.unreadable) {
+            (Err(e), Some(policy)) if e.downcast_ref::<unreadable::EntryError>().is_some() => {
+                let href = path.strip_prefix(&doc.root_base).unwrap_or(&path).display().to_string();
+                match policy {
+                    Unreadable::Fail => return Err(e.context(format!("Failed to convert {}", href))),
+                    Unreadable::Skip => info!("skipping unreadable spine item {}: {:#}", href, e),
+                    Unreadable::Placeholder => {
+                        warn!("spine item {} is unreadable: {:#}", href, e);
+                        let title = chapter::resolve_title(titles.get(&path), None, &href);
+                        let markdown = format!("> [unreadable: {}: {:#}]", href, e);
+                        unreadable.push((items.len(), Chapter { index: index + 1, title, href, markdown }));
+                    }
+                }
+                report(&path);
+                continue;
+            }
+            (html, _) => html,
+        };
+        if options.strict {
+            if let Err(e) = html {
+                let href = path.strip_prefix(&doc.root_base).unwrap_or(&path).display().to_string();
+                return Err(e.context(format!("Failed to convert {}", href)));
+            }
+        }
+        if filter.leaves_out(&path, html.as_deref().ok()) {
+            report(&path);
+            continue;
+        }
+        items.push((index + 1, path, html));
+    }
+    filter.check_kept(items.len())?;
+    let read: Vec<(&Path, &str)> =
+        items.iter().filter_map(|(_, path, html)| Some((path.as_path(), html.as_deref().ok()?))).collect();
+    let wide = BookWide::load(doc, &read, image_links, options);
+
+    let converter = HtmlConverter::new(&options.markdown).with_direction(Metadata::load(doc).direction);
+    let started = Instant::now();
+    let results = pool::map_ordered(&items, options.jobs, options.strict, options.cancel.as_ref(), |(_, path, html)| {
+        let chapter_started = Instant::now();
+        let result = match html {
+            Ok(html) => {
+                convert_html(html, path, &wide, &converter, options)
+            }
+            Err(e) => Err(anyhow::anyhow!("{:#}", e)),
+        };
+        let href = path.strip_prefix(&root_base).unwrap_or(path).display();
+        match &result {
+            Ok((_, _, marks)) => info!(
+                "converted {} in {:.1?}, with {} internal links",
+                href,
+                chapter_started.elapsed(),
+                marks.links.len()
+            ),
+            Err(_) => info!("failed to convert {} after {:.1?}", href, chapter_started.elapsed()),
+        }
+        report(path);
+        result
+    });
+    let converted = results.iter().filter(|result| result.is_some()).count();
+    info!("converted {} of {} spine items in {:.1?}", converted, spine_ids.len(), started.elapsed());
+    if let Some(Err(e)) = options.cancel.as_ref().map(CancelToken::check).filter(|_| converted < items.len()) {
+        let stopped = format!("Stopped after converting {} of {} spine items", converted, items.len());
+        return Err(anyhow::Error::new(e).context(stopped));
+    }
+
+    let mut chapters = Vec::new();
+    let mut failures = Vec::new();
+    let mut targets = links::Targets::default();
+    let mut unreadable = unreadable.into_iter().peekable();
+    for (position, ((index, path, _), result)) in items.iter().zip(results).enumerate() {
+        while let Some((_, note)) = unreadable.next_if(|(before, _)| *before <= position) {
+            chapters.push((note, Vec::new()));
+        }
+        let href = path.strip_prefix(&doc.root_base).unwrap_or(path).to_string_lossy().into_owned();
+        match result {
+            Some(Ok((own_title, markdown, mut marks))) => {
+                let title = chapter::resolve_title(titles.get(path), own_title, &href);
+                let chapter = Chapter { index: *index, title, href, markdown };
+                let links = std::mem::take(&mut marks.links);
+                targets.insert(path, &chapter, marks);
+                chapters.push((chapter, links));
+            }
+            Some(Err(e)) if options.strict => return Err(e.context(format!("Failed to convert {}", href))),
+            Some(Err(e)) => {
+                let title = chapter::resolve_title(titles.get(path), None, &href);
+                let markdown = format!("> [conversion failed: {}: {:#}]", href, e);
+                failures.push((href.clone(), format!("{:#}", e)));
+                chapters.push((Chapter { index: *index, title, href, markdown }, Vec::new()));
+            }
+            // Skipped after a failure in strict mode; that error comes later in the spine.
+            None => continue,
+        }
+    }
+    chapters.extend(unreadable.map(|(_, note)| (note, Vec::new())));
+
+    // Links can point forward in the spine, so they are resolved once every
+    // chapter's headings are known.
+    let mut chapters = chapters
+        .into_iter()
+        .map(|(chapter, links)| {
+            let mut markdown = normalize(&targets.resolve(&chapter.markdown, &links), LineEnding::Lf);
+            if let Some(level) = options.promote_chapters {
+                markdown = markdown::promote_headings(&markdown, level, options.markdown.headings);
+            }
+            Chapter { markdown, ..chapter }
+        })
+        .collect::<Vec<_>>();
+    // Joined chapters are numbered once the title and appendix headings are
+    // in, and get their ids after that.
+    if standalone {
+        if options.number_headings {
+            links::number_headings(&mut chapters);
+        }
+        if options.heading_ids {
+            for chapter in chapters.iter_mut() {
+                chapter.markdown = markdown::add_heading_ids(&chapter.markdown, &mut Slugger::default());
+            }
+        }
+    }
+    if let Some(threshold) = options.strip_boilerplate {
+        for (line, count) in boilerplate::strip(&mut chapters, threshold) {
+            info!("removed boilerplate {:?} from {} chapters", line, count);
+        }
+    }
+    if let Some(min) = options.dedupe_boilerplate {
+        for (block, count) in boilerplate::dedupe(&mut chapters, &titles, &doc.root_base, min) {
+            info!("removed repeated {:?} from {} chapters", block, count);
+        }
+    }
+    for chapter in chapters.iter_mut() {
+        for transform in &options.transforms {
+            match transform.apply(&chapter.markdown) {
+                Ok(markdown) => chapter.markdown = markdown,
+                Err(e) if options.strict => {
+                    return Err(e.context(format!("Failed to transform {} with {}", chapter.href, transform.name())));
+                }
+                Err(e) => {
+                    failures.push((chapter.href.clone(), format!("{} transform: {:#}", transform.name(), e)));
+                    break;
+                }
+            }
+        }
+    }
+    if let Some(max) = options.chunk_chapters.filter(|_| standalone) {
+        chapters = chapters
+            .into_iter()
+            .flat_map(|chapter| {
+                let parts = chunk_chapter(&chapter, max);
+                let Chapter { index, title, href, .. } = chapter;
+                parts.into_iter().enumerate().map(move |(i, markdown)| Chapter {
+                    index,
+                    title: match i {
+                        0 => title.clone(),
+                        _ => format!("{} (part {})", title, i + 1),
+                    },
+                    href: href.clone(),
+                    markdown,
+                })
+            })
+            .collect();
+    }
+    if failures.is_empty() {
+        return Ok(chapters);
+    }
+    Err(ChapterErrors {
+        failures,
+        chapters,
+        markdown: String::new(),
+    }
+    .into())
+}
+
+// The spine positions, counting from 0, in the order they're converted: the
+// spine's, with the `nonlinear` items after the rest for `Nonlinear::Appendix`.
+fn reading_positions(spine_ids: &[String], nonlinear: &HashSet<String>, policy: Nonlinear) -> Vec<usize> {
+    let (linear, appendix): (Vec<usize>, Vec<usize>) =
+        (0..spine_ids.len()).partition(|index| !nonlinear.contains(&spine_ids[*index]));
+    match policy {
+        Nonlinear::Appendix => linear.into_iter().chain(appendix).collect(),
+        _ => (0..spine_ids.len()).collect(),
+    }
+}
+
+// Rejects selections past the end of the spine, naming the valid range.
+fn check_selection(selection: &ChapterSelection, len: usize) -> Result<()> {
+    check_chapter(selection.max(), len)
+}
+
+fn check_chapter(index: usize, len: usize) -> Result<()> {
+    if index <= len {
+        return Ok(());
+    }
+    let valid = match len {
+        0 => "there are none to select".to_string(),
+        1 => "only chapter 1 can be selected".to_string(),
+        _ => format!("valid chapters are 1-{}", len),
+    };
+    anyhow::bail!("Chapter {} is out of range: the book has {} chapters, {}", index, len, valid)
+}
+
+fn read_raw<R: Read + Seek>(doc: &mut EpubDoc<R>, id: &str) -> Result<Vec<u8>> {
+    doc.get_resource(id)
+        .map_err(|e| anyhow::Error::new(unreadable::EntryError(format!("Failed to read {}: {}", id, e))))
+}
+
+fn read_chapter<R: Read + Seek>(doc: &mut EpubDoc<R>, id: &str, max_size: Option<u64>) -> Result<String> {
+    let content_bytes_vec = read_raw(doc, id)?;
+    if let Some(max_size) = max_size.filter(|max_size| content_bytes_vec.len() as u64 > *max_size) {
+        anyhow::bail!(
+            "the chapter is {} KiB, over the {} KiB limit",
+            content_bytes_vec.len().div_ceil(1024),
+            max_size / 1024
+        );
+    }
+    Ok(encoding::decode(&content_bytes_vec))
+}
+
+// Reads a spine item as HTML according to its manifest media type. Image
+// pages become a lone <img> so they convert to a single image line, unless
+// `inline_svg` keeps an SVG page's markup; None means the item is neither and
+// should be skipped. HTML over `max_size` bytes is an error.
+fn read_spine_item<R: Read + Seek>(
+    doc: &mut EpubDoc<R>,
+    id: &str,
+    path: &Path,
+    media_type: &str,
+    max_size: Option<u64>,
+    inline_svg: bool,
+) -> Result<Option<String>> {
+    match media_type.split(';').next().unwrap_or_default().trim() {
+        "application/xhtml+xml" | "text/html" => read_chapter(doc, id, max_size).map(Some),
+        "image/svg+xml" if inline_svg => read_chapter(doc, id, max_size).map(Some),
+        _ if images::is_image(media_type) => {
+            let name = path.file_name().unwrap_or_default().to_string_lossy().replace(' ', "%20");
+            Ok(Some(format!("<img src=\"{}\" alt=\"\"/>", dom::escape_attr(&name))))
         }
+        _ => Ok(None),
     }
+}
+
+// The images `options` extracts or embeds, for the chapters to link to.
+fn image_links<R: Read + Seek>(doc: &mut EpubDoc<R>, options: &Options) -> Result<Option<images::Links>> {
+    Ok(match (&options.images, options.embed_images) {
+        (Some(_), Some(_)) => anyhow::bail!("images can't be both extracted and embedded"),
+        (Some(images), None) => Some(images::extract(doc, images)?),
+        (None, Some(max_bytes)) => Some(images::embed(doc, max_bytes)),
+        (None, None) => None,
+    })
+}
+
+// What converting a chapter takes from the others converted with it: the
+// notes it copies from other files, the ids they link to, and the images.
+#[derive(Default)]
+struct BookWide {
+    note_files: footnotes::NoteFiles,
+    /// With `Options::anchors`, the ids the chapters link to.
+    referenced: Option<links::Referenced>,
+    image_links: Option<images::Links>,
+}
 
-    Ok(markdown_chunks)
+impl BookWide {
+    // Finds what the chapters read from `chapters`, each an archive path and
+    // its HTML, take from each other.
+    fn load<R: Read + Seek>(
+        doc: &mut EpubDoc<R>,
+        chapters: &[(&Path, &str)],
+        image_links: Option<images::Links>,
+        options: &Options,
+    ) -> BookWide {
+        let note_files = footnotes::NoteFiles::load(chapters.iter().copied(), |path| read_path(doc, path));
+        let referenced = options.anchors.then(|| {
+            let mut referenced = links::Referenced::new();
+            for (path, html) in chapters {
+                links::referenced(&dom::parse(html), path, &mut referenced);
+            }
+            referenced
+        });
+        BookWide { note_files, referenced, image_links }
+    }
+}
+
+// Reads a file that isn't necessarily in the spine, such as a separate notes file.
+fn read_path<R: Read + Seek>(doc: &mut EpubDoc<R>, path: &Path) -> Option<String> {
+    let bytes = doc.get_resource_by_path(path).ok()?;
+    Some(encoding::decode(&bytes))
+}
+
+// Converts one spine item's HTML, returning the title it gives itself (its
+// first h1-h3 heading or <title>), its markdown with link placeholders, and
+// the marks needed to resolve them. Ids the other chapters link to are kept as
+// anchors when `wide` has them.
+fn convert_html(
+    html_content: &str,
+    path: &Path,
+    wide: &BookWide,
+    converter: &HtmlConverter,
+    options: &Options,
+) -> Result<(Option<String>, String, links::Marks)> {
+    let mut nodes = dom::parse(html_content);
+    // Before the title is taken, so that it doesn't hold a page number.
+    let pages = pages::mark(&mut nodes, options.page_markers.as_deref());
+    // A chapter can run the other way from its book, as an English preface
+    // to a Hebrew book does.
+    let dir = direction::chapter_direction(&nodes).unwrap_or(converter.direction());
+    let converter = converter.for_direction(dir);
+    images::caption_figures(&mut nodes, options.figure_captions);
+    if let Some(links) = &wide.image_links {
+        images::rewrite(&mut nodes, path, links);
+    }
+    let svg_output = match (&options.images, options.embed_images) {
+        _ if options.inline_svg => images::SvgOutput::Inline,
+        (Some(images), _) => images::SvgOutput::Write(images),
+        (None, Some(max_bytes)) => images::SvgOutput::Embed(max_bytes),
+        (None, None) => images::SvgOutput::Describe,
+    };
+    let figures = images::inline_svg(&mut nodes, path, svg_output)?;
+    let notes = footnotes::extract(&mut nodes, path, &wide.note_files);
+    // Before the title is taken, so that it reads the way the text does, and
+    // before sanitizing, so that kept markup is the book's own.
+    let rubies = match options.ruby {
+        Ruby::Html => ruby::hide(&mut nodes),
+        form => {
+            ruby::annotate(&mut nodes, form);
+            Vec::new()
+        }
+    };
+    // Before sanitizing, which drops the classes.
+    if !options.verse_classes.is_empty() {
+        verse::preserve_lines(&mut nodes, &options.verse_classes);
+    }
+    // After the notes are taken out, since some books hide the note bodies.
+    if options.sanitize {
+        sanitize::sanitize(&mut nodes);
+    }
+    images::prepare(&mut nodes);
+    let title = chapter::html_heading(&nodes).map(|title| ruby::restore_text(&title, &rubies));
+    let title = title.map(|title| pages::strip_text(&title, &pages)).filter(|title| !title.is_empty());
+    let title = title.or_else(|| chapter::html_title(html_content));
+    // After the title is taken, so that it doesn't carry the marks.
+    match options.rtl_wrap {
+        Some(RtlWrap::Marks) => direction::mark(&mut nodes, dir, Direction::Ltr),
+        Some(RtlWrap::Div) => direction::mark(&mut nodes, dir, dir),
+        None => {}
+    }
+    let marks = links::mark(&mut nodes, path, wide.referenced.as_ref());
+    let formulas = match options.math {
+        true => math::hide(&mut nodes),
+        false => Vec::new(),
+    };
+    let kept = keep::hide(&mut nodes, &options.keep_html);
+    let hidden_tables = tables::hide(&mut nodes, !options.gfm);
+    let code_blocks = code::hide(&mut nodes);
+    let html = dom::serialize(&nodes);
+    let markdown = code::restore(&converter.to_markdown(&html)?, &code_blocks);
+    let markdown = keep::restore(&tables::restore(&markdown, &hidden_tables), &kept);
+    let markdown = images::restore_figures(&markdown, &figures);
+    let markdown = ruby::restore(&math::restore(&markdown, &formulas), &rubies);
+    let mut markdown = pages::restore(&markdown, &pages);
+    if !notes.is_empty() {
+        let notes = notes
+            .into_iter()
+            .map(|note| Ok((note.number, converter.to_markdown(&note.html)?)))
+            .collect::<Result<Vec<_>>>()?;
+        markdown = footnotes::restore(&markdown, &notes);
+    }
+    if !marks.anchors.is_empty() {
+        markdown = links::restore_anchors(&markdown, &marks.anchors);
+    }
+    if options.rtl_wrap == Some(RtlWrap::Div) && dir == Direction::Rtl {
+        markdown = direction::wrap(&markdown);
+    }
+    Ok((title, markdown, marks))
+}
+
+pub fn write_markdown<W: Write>(path_str: &str, w: &mut W) -> Result<()> {
+    w.write_all(convert_file(path_str)?.as_bytes())?;
+    Ok(())
+}
+
+pub fn write_rendered<W: Write, S: Into<Style>>(path_str: &str, w: &mut W, style: S) -> Result<()> {
+    let markdown = convert_file(path_str)?;
+    w.write_all(render::render(&markdown, style).as_bytes())?;
+    Ok(())
+}
+
+pub fn create_output(path: &Path, force: bool) -> Result<File> {
+    if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+        fs::create_dir_all(parent).with_context(|| format!("Failed to create {}", parent.display()))?;
+    }
+    let mut options = OpenOptions::new();
+    if force {
+        options.write(true).create(true).truncate(true);
+    } else {
+        options.write(true).create_new(true);
+    }
+    options.open(path).map_err(|e| match e.kind() {
+        ErrorKind::AlreadyExists => anyhow::anyhow!("Output file {} already exists", path.display()),
+        _ => anyhow::anyhow!("Failed to create {}: {}", path.display(), e),
+    })
+}
+
+pub fn epub_to_markdown_file(src_path: &str, dst_path: &str) -> Result<()> {
+    let file = create_output(Path::new(dst_path), true)?;
+    let mut writer = BufWriter::new(file);
+    let result = write_markdown(src_path, &mut writer);
+    writer.flush().with_context(|| format!("Failed to write {}", dst_path))?;
+    result
+}
+
+pub fn convert_to_dir(src_path: &str, dst_dir: &Path) -> Result<Vec<PathBuf>> {
+    convert_to_dir_named(src_path, dst_dir, None)
+}
+
+// Like `convert_to_dir`, naming the chapter files with `template` when there
+// is one. Names the template gives more than one chapter are numbered, as
+// `split::file_names` does.
+pub fn convert_to_dir_named(src_path: &str, dst_dir: &Path, template: Option<&NameTemplate>) -> Result<Vec<PathBuf>> {
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: dst_dir.join("images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with(src_path, &options)?;
+    let book = match template {
+        Some(_) => NameContext::new(&read_metadata(src_path)?, &list_items(src_path)?),
+        None => NameContext::default(),
+    };
+    let names = split::file_names(&chapters, template, &book)?;
+    split::write_chapters(&chapters, &names, dst_dir, true, LineEnding::default())
+}
+
+// Converts every .epub under `src_dir` into a markdown file of the same name
+// in `dst_dir`. A book that fails doesn't stop the others; the failures are
+// returned together as a `BatchError` once the rest are done.
+pub fn convert_dir(src_dir: &Path, dst_dir: &Path) -> Result<()> {
+    convert_dir_with(src_dir, dst_dir, &Options::default())
+}
+
+// Like `convert_dir`, but converts `options.jobs` books in parallel, each
+// one with its chapters converted in turn.
+pub fn convert_dir_with(src_dir: &Path, dst_dir: &Path, options: &Options) -> Result<()> {
+    let books = find_epubs(src_dir, true)?;
+    fs::create_dir_all(dst_dir).with_context(|| format!("Failed to create {}", dst_dir.display()))?;
+    convert_books(&books, Some(dst_dir), true, options)
+}
+
+// Converts each book into `<stem>.md` in `dst_dir`, or next to the book when
+// `dst_dir` is None, `options.jobs` books at a time. Existing files are only
+// replaced when `force` is set. Failures are collected into a `BatchError`,
+// which lists the DRM-protected books apart, rather than stopping the batch.
+pub fn convert_books(books: &[PathBuf], dst_dir: Option<&Path>, force: bool, options: &Options) -> Result<()> {
+    let results = run_books(books, dst_dir, force, options, true);
+    let mut drm_protected = Vec::new();
+    let failures: Vec<(PathBuf, String)> = books
+        .iter()
+        .zip(results)
+        .filter_map(|(book, result)| match result {
+            Some(Ok(_)) => None,
+            Some(Err(e)) => {
+                if e.downcast_ref::<DrmProtected>().is_some() {
+                    drm_protected.push(book.clone());
+                }
+                Some((book.clone(), format!("{:#}", e)))
+            }
+            None => Some((book.clone(), "not converted: the batch was cancelled".to_string())),
+        })
+        .collect();
+    if failures.is_empty() {
+        return Ok(());
+    }
+    Err(BatchError {
+        failures,
+        drm_protected,
+        total: books.len(),
+    }
+    .into())
+}
+
+// Converts each book as `convert_books` would but writes nothing, returning
+// the file each book would be written to and its size, or why it would fail.
+// An existing file without `force` fails, as it would when writing.
+pub fn plan_books(books: &[PathBuf], dst_dir: Option<&Path>, force: bool, options: &Options) -> Vec<BookPlan> {
+    let results = run_books(books, dst_dir, force, options, false);
+    books
+        .iter()
+        .zip(results)
+        .map(|(book, result)| BookPlan {
+            book: book.clone(),
+            output: match result {
+                Some(Ok(output)) => Ok(output),
+                Some(Err(e)) => Err(format!("{:#}", e)),
+                None => Err("not converted: the batch was cancelled".to_string()),
+            },
+        })
+        .collect()
+}
+
+// Converts the books, up to `options.jobs` at a time, writing each one's
+// markdown when `write` is set, and returns the output path and size of each
+// in the order of `books`. `options.progress` hears about each book as it
+// finishes, and once `options.cancel` fires the books in progress stop at
+// their next spine item and the rest aren't started.
+fn run_books(
+    books: &[PathBuf],
+    dst_dir: Option<&Path>,
+    force: bool,
+    options: &Options,
+    write: bool,
+) -> Vec<Option<Result<(PathBuf, usize)>>> {
+    let outputs: Vec<_> = books.iter().cloned().zip(batch::outputs(books, dst_dir)).collect();
+    let book_options = Options {
+        jobs: 1,
+        progress: None,
+        ..options.clone()
+    };
+    let done = AtomicUsize::new(0);
+    pool::map_ordered(&outputs, options.jobs, false, options.cancel.as_ref(), |(book, dst)| {
+        let result = run_book(book, dst, force, &book_options, write);
+        if let Some(progress) = &options.progress {
+            progress.report(done.fetch_add(1, Ordering::SeqCst) + 1, books.len(), &book.to_string_lossy());
+        }
+        result
+    })
+}
+
+fn run_book(
+    book: &Path,
+    dst: &Result<PathBuf, String>,
+    force: bool,
+    options: &Options,
+    write: bool,
+) -> Result<(PathBuf, usize)> {
+    let dst = dst.as_ref().map_err(|e| anyhow::anyhow!("{}", e))?;
+    // A book with broken chapters is still written out, but counts as failed.
+    let (markdown, errors) = match convert_file_with(&book.to_string_lossy(), options) {
+        Ok(markdown) => (markdown, None),
+        Err(e) => {
+            let mut errors = e.downcast::<ChapterErrors>()?;
+            (std::mem::take(&mut errors.markdown), Some(errors))
+        }
+    };
+    if write {
+        let mut writer = BufWriter::new(create_output(dst, force)?);
+        let written = writer.write_all(markdown.as_bytes()).and_then(|()| writer.flush());
+        // Half a book is worse than none.
+        if let Err(e) = written {
+            drop(writer);
+            let _ = fs::remove_file(dst);
+            return Err(anyhow::Error::new(e).context(format!("Failed to write {}", dst.display())));
+        }
+    } else if !force && dst.exists() {
+        anyhow::bail!("Output file {} already exists", dst.display());
+    }
+    match errors {
+        Some(errors) => Err(errors.into()),
+        None => Ok((dst.clone(), markdown.len())),
+    }
 }
 
 pub async fn get_embeddings(markdown_chunks: Vec<String>) -> Result<Vec<Vec<f64>>> {
@@ -37,7 +1746,7 @@ pub async fn get_embeddings(markdown_chunks: Vec<String>) -> Result<Vec<Vec<f64>
         if let Ok(res) = res {
             embeddings.push(res.embeddings);
         } else {
-            eprintln!("Failed to generate embeddings: {:?}", res);
+            warn!("failed to generate embeddings: {:?}", res);
         }
     }
 
@@ -0,0 +1,408 @@
+use crate::chapter::Chapter;
+use crate::dom::{Element, Node};
+use crate::href;
+use crate::markdown;
+use crate::slug::Slugger;
+use crate::dom;
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+
+// Links between spine items are rewritten in two steps. While a chapter is
+// converted, `mark` swaps each internal <a href> for a placeholder and maps
+// element ids to the heading they fall under. Once every chapter is
+// converted, `Targets::resolve` turns the placeholders into links of the form
+// `chapter.xhtml#heading-anchor`, relative to the package root. `merge` then
+// points those at anchors in the combined document and `to_files` at the
+// per-chapter files written by --split.
+//
+// With `Options::anchors`, ids that some link points at and that aren't on or
+// in a heading are also kept, as `<a id="..."></a>` in the markdown, and links
+// to them use the id instead of the heading before it.
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct Link {
+    /// Archive path of the linked spine item.
+    pub path: PathBuf,
+    pub fragment: Option<String>,
+    /// The href as written, restored when the target wasn't converted.
+    pub href: String,
+}
+
+#[derive(Debug, Clone, Default)]
+pub(crate) struct Marks {
+    /// Link targets, indexed by placeholder number.
+    pub links: Vec<Link>,
+    /// Element ids and the index of the heading each one falls under, or
+    /// None for ids before the first heading.
+    pub ids: HashMap<String, Option<usize>>,
+    /// Ids kept as anchors, indexed by placeholder number.
+    pub anchors: Vec<String>,
+}
+
+// Every (archive path, id) some internal link points at.
+pub(crate) type Referenced = HashSet<(PathBuf, String)>;
+
+pub(crate) fn mark(nodes: &mut Vec<Node>, chapter_path: &Path, referenced: Option<&Referenced>) -> Marks {
+    let mut marks = Marks::default();
+    if let Some(referenced) = referenced {
+        anchor_in(nodes, chapter_path, referenced, &mut marks.anchors);
+    }
+    mark_in(nodes, chapter_path, &mut Walk::default(), &mut marks);
+    marks
+}
+
+// Collects the targets of the internal links in a chapter.
+pub(crate) fn referenced(nodes: &[Node], chapter_path: &Path, referenced: &mut Referenced) {
+    dom::walk(nodes, &mut |el| {
+        if !el.is("a") {
+            return;
+        }
+        if let Some((path, Some(fragment))) = el.attr("href").and_then(|href| internal(href, chapter_path)) {
+            referenced.insert((path, fragment.to_string()));
+        }
+    });
+}
+
+#[derive(Default)]
+struct Walk {
+    /// Number of headings seen so far.
+    headings: usize,
+    /// The most recent heading, if any.
+    current: Option<usize>,
+}
+
+fn mark_in(nodes: &mut [Node], chapter_path: &Path, walk: &mut Walk, marks: &mut Marks) {
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        let (first, preceding) = (walk.headings, walk.current);
+        if is_heading(el) && !el.text().is_empty() {
+            walk.current = Some(walk.headings);
+            walk.headings += 1;
+        }
+        if el.is("a") {
+            mark_link(el, chapter_path, marks);
+        }
+        mark_in(&mut el.children, chapter_path, walk, marks);
+
+        // An element that contains a heading is anchored at the first one
+        // inside it; anything else at the heading before it.
+        let heading = if walk.headings > first { Some(first) } else { preceding };
+        let id = el.attr("id").or_else(|| el.attr("name").filter(|_| el.is("a")));
+        if let Some(id) = id {
+            marks.ids.entry(id.to_string()).or_insert(heading);
+        }
+    }
+}
+
+pub(crate) fn is_heading(el: &Element) -> bool {
+    ["h1", "h2", "h3", "h4", "h5", "h6"].iter().any(|name| el.is(name))
+}
+
+fn mark_link(el: &mut Element, chapter_path: &Path, marks: &mut Marks) {
+    let Some(href) = el.attr("href").map(String::from) else {
+        return;
+    };
+    let Some((path, fragment)) = internal(&href, chapter_path) else {
+        return;
+    };
+    let fragment = fragment.map(String::from);
+    el.set_attr("href", &placeholder(marks.links.len()));
+    marks.links.push(Link { path, fragment, href });
+}
+
+// The archive path and fragment an internal href points at; None for
+// external links.
+fn internal<'a>(href: &'a str, chapter_path: &Path) -> Option<(PathBuf, Option<&'a str>)> {
+    if href::is_external(href) {
+        return None;
+    }
+    let (_, fragment) = href::split_fragment(href);
+    let path = match href.starts_with('#') {
+        true => chapter_path.to_path_buf(),
+        false => href::resolve(chapter_path, href)?,
+    };
+    Some((path, fragment.filter(|f| !f.is_empty())))
+}
+
+const PLACEHOLDER: &str = "CIPHERLINK";
+
+fn placeholder(n: usize) -> String {
+    format!("{}{}X", PLACEHOLDER, n)
+}
+
+const ANCHOR: &str = "CIPHERANCHOR";
+
+// Places a placeholder for each referenced id: at the start of the element's
+// text for paragraphs, list items, cells and inline elements, and just before
+// anything else. Headings and elements around them are skipped, since links to
+// those already land on the heading anchor.
+fn anchor_in(nodes: &mut Vec<Node>, chapter_path: &Path, referenced: &Referenced, anchors: &mut Vec<String>) {
+    let mut out = Vec::with_capacity(nodes.len());
+    for node in nodes.drain(..) {
+        let Node::Element(mut el) = node else {
+            out.push(node);
+            continue;
+        };
+        if is_heading(&el) {
+            out.push(Node::Element(el));
+            continue;
+        }
+        let id = el.attr("id").or_else(|| el.attr("name").filter(|_| el.is("a"))).map(String::from);
+        let around_heading = contains_heading(&el.children);
+        anchor_in(&mut el.children, chapter_path, referenced, anchors);
+        let id = id.filter(|id| !around_heading && referenced.contains(&(chapter_path.to_path_buf(), id.clone())));
+        let Some(id) = id else {
+            out.push(Node::Element(el));
+            continue;
+        };
+        let placeholder = Node::Text(format!("{}{}X", ANCHOR, anchors.len()));
+        anchors.push(id);
+        match TEXT_BLOCKS.contains(&el.local_name()) {
+            true => {
+                el.children.insert(0, placeholder);
+                out.push(Node::Element(el));
+            }
+            false => {
+                out.push(placeholder);
+                out.push(Node::Element(el));
+            }
+        }
+    }
+    *nodes = out;
+}
+
+// Elements whose content is text, where an anchor can go inline.
+const TEXT_BLOCKS: &[&str] =
+    &["p", "li", "dt", "dd", "td", "th", "figcaption", "caption", "span", "em", "strong", "i", "b", "cite", "q"];
+
+fn contains_heading(nodes: &[Node]) -> bool {
+    let mut found = false;
+    dom::walk(nodes, &mut |el| found |= is_heading(el));
+    found
+}
+
+// Replaces the anchor placeholders `mark` left with the anchors themselves.
+pub(crate) fn restore_anchors(markdown: &str, anchors: &[String]) -> String {
+    let mut markdown = markdown.to_string();
+    for (n, id) in anchors.iter().enumerate() {
+        let anchor = format!("<a id=\"{}\"></a>", dom::escape_attr(id));
+        markdown = markdown.replace(&format!("{}{}X", ANCHOR, n), &anchor);
+    }
+    markdown
+}
+
+// The ids of the `<a id="..."></a>` anchors in `markdown`.
+fn anchored_ids(markdown: &str) -> HashSet<String> {
+    let mut ids = HashSet::new();
+    let mut rest = markdown;
+    while let Some(start) = rest.find("<a id=\"") {
+        rest = &rest[start + 7..];
+        if let Some(end) = rest.find("\"></a>") {
+            ids.insert(dom::decode_entities(&rest[..end]));
+            rest = &rest[end..];
+        }
+    }
+    ids
+}
+
+// A converted spine item that links can point into.
+#[derive(Debug)]
+struct Target {
+    href: String,
+    ids: HashMap<String, Option<usize>>,
+    /// Anchors of the item's headings, unique within the item.
+    anchors: Vec<String>,
+    /// Ids kept as anchors of their own.
+    anchored: HashSet<String>,
+}
+
+#[derive(Debug, Default)]
+pub(crate) struct Targets(HashMap<PathBuf, Target>);
+
+impl Targets {
+    pub(crate) fn insert(&mut self, path: &Path, chapter: &Chapter, marks: Marks) {
+        let target = Target {
+            href: chapter.href.replace(' ', "%20"),
+            ids: marks.ids,
+            anchors: local_anchors(&chapter.markdown),
+            anchored: marks.anchors.into_iter().collect(),
+        };
+        self.0.insert(path.to_path_buf(), target);
+    }
+
+    pub(crate) fn contains(&self, path: &Path) -> bool {
+        self.0.contains_key(path)
+    }
+
+    // Replaces the placeholders `mark` left in `markdown`. Links to items
+    // that weren't converted, or to ids they don't have, keep their original href.
+    pub(crate) fn resolve(&self, markdown: &str, links: &[Link]) -> String {
+        let mut out = String::with_capacity(markdown.len());
+        let mut rest = markdown;
+        while let Some(start) = rest.find(PLACEHOLDER) {
+            out.push_str(&rest[..start]);
+            let after = &rest[start + PLACEHOLDER.len()..];
+            let digits = after.find(|c: char| !c.is_ascii_digit()).unwrap_or(after.len());
+            let link = after[..digits].parse::<usize>().ok().and_then(|n| links.get(n));
+            match link {
+                Some(link) if after[digits..].starts_with('X') => {
+                    out.push_str(&self.target(link));
+                    rest = &after[digits + 1..];
+                }
+                _ => {
+                    out.push_str(PLACEHOLDER);
+                    rest = after;
+                }
+            }
+        }
+        out.push_str(rest);
+        out
+    }
+
+    fn target(&self, link: &Link) -> String {
+        let Some(target) = self.0.get(&link.path) else {
+            return link.href.clone();
+        };
+        let heading = match &link.fragment {
+            Some(fragment) if target.anchored.contains(fragment) => return format!("{}#{}", target.href, fragment),
+            Some(fragment) => match target.ids.get(fragment) {
+                Some(heading) => *heading,
+                None => return link.href.clone(),
+            },
+            None => None,
+        };
+        match heading.and_then(|i| target.anchors.get(i)) {
+            Some(anchor) => format!("{}#{}", target.href, anchor),
+            None => target.href.clone(),
+        }
+    }
+}
+
+fn local_anchors(markdown: &str) -> Vec<String> {
+    let mut anchors = Slugger::default();
+    markdown::headings(markdown).iter().map(|heading| anchors.next(heading)).collect()
+}
+
+// Points links between chapters at heading anchors of the combined document,
+// where anchors are unique across all chapters rather than within each one.
+// Links to kept ids become a bare fragment; an id kept by two chapters only
+// works for the first.
+pub(crate) fn merge(chapters: &mut [Chapter]) {
+    let mut anchors = Slugger::default();
+    let mut merged: HashMap<String, HashMap<String, String>> = HashMap::new();
+    let mut first: HashMap<String, String> = HashMap::new();
+    for chapter in chapters.iter() {
+        let headings = markdown::headings(&chapter.markdown);
+        let global: Vec<String> = headings.iter().map(|heading| anchors.next(heading)).collect();
+        let href = chapter.href.replace(' ', "%20");
+        if let Some(anchor) = global.first() {
+            first.insert(href.clone(), anchor.clone());
+        }
+        let mut targets: HashMap<String, String> = local_anchors(&chapter.markdown).into_iter().zip(global).collect();
+        for id in anchored_ids(&chapter.markdown) {
+            targets.entry(id.clone()).or_insert(id);
+        }
+        merged.insert(href, targets);
+    }
+    for chapter in chapters.iter_mut() {
+        chapter.markdown = rewrite(&chapter.markdown, |url| {
+            let (path, fragment) = href::split_fragment(url);
+            if path.is_empty() {
+                return None;
+            }
+            let anchor = match fragment {
+                Some(fragment) => merged.get(path)?.get(fragment),
+                None => first.get(path),
+            };
+            anchor.map(|anchor| format!("#{}", anchor))
+        });
+    }
+}
+
+// Numbers the headings of the chapters as one outline, in order, and points
+// the links at them at the anchors their numbered text gives them.
+pub(crate) fn number_headings(chapters: &mut [Chapter]) {
+    let mut numbering = markdown::Numbering::default();
+    let mut renamed: HashMap<String, HashMap<String, String>> = HashMap::new();
+    for chapter in chapters.iter_mut() {
+        let before = local_anchors(&chapter.markdown);
+        chapter.markdown = markdown::number_headings(&chapter.markdown, &mut numbering);
+        // Links to a kept `<a id>` that shares a heading's anchor go to the id.
+        let kept = anchored_ids(&chapter.markdown);
+        let anchors = before.into_iter().zip(local_anchors(&chapter.markdown)).filter(|(old, _)| !kept.contains(old));
+        renamed.entry(chapter.href.replace(' ', "%20")).or_default().extend(anchors);
+    }
+    for chapter in chapters.iter_mut() {
+        chapter.markdown = rewrite(&chapter.markdown, |url| {
+            let (path, fragment) = href::split_fragment(url);
+            let anchor = renamed.get(path)?.get(fragment?)?;
+            Some(format!("{}#{}", path, anchor))
+        });
+    }
+}
+
+// Points links between chapters at the files `names` gives each chapter,
+// keeping the heading anchor. Links within a chapter become bare fragments.
+// A chapter cut into parts has a file for each, all under its href: links to
+// it go to the first, and links to an anchor to the part that holds it.
+pub(crate) fn to_files(chapter: &Chapter, chapters: &[Chapter], names: &[String]) -> String {
+    let mut files: HashMap<String, Vec<(&Chapter, &String)>> = HashMap::new();
+    for (other, name) in chapters.iter().zip(names).filter(|(other, _)| !other.href.is_empty()) {
+        files.entry(other.href.replace(' ', "%20")).or_default().push((other, name));
+    }
+    let own = chapter.href.replace(' ', "%20");
+    rewrite(&chapter.markdown, |url| {
+        let (path, fragment) = href::split_fragment(url);
+        // A bare fragment can point at another part of the same chapter.
+        let path = match (path, fragment) {
+            ("", Some(_)) => own.as_str(),
+            _ => path,
+        };
+        let parts = files.get(path)?;
+        let Some(fragment) = fragment else {
+            return Some(parts[0].1.to_string());
+        };
+        let part = match parts.len() {
+            1 => None,
+            _ => parts.iter().find(|(other, _)| holds_anchor(&other.markdown, fragment)),
+        };
+        Some(match part {
+            Some((other, _)) if std::ptr::eq(*other, chapter) => format!("#{}", fragment),
+            None if path == own => format!("#{}", fragment),
+            Some((_, name)) => format!("{}#{}", name, fragment),
+            None => format!("{}#{}", parts[0].1, fragment),
+        })
+    })
+}
+
+// Whether the anchor is in this markdown: an `<a id>`, a heading's `{#id}`,
+// or the anchor a heading gets from its text.
+fn holds_anchor(markdown: &str, anchor: &str) -> bool {
+    if markdown.contains(&format!("id=\"{}\"", anchor)) || markdown.contains(&format!("{{#{}}}", anchor)) {
+        return true;
+    }
+    let mut slugger = Slugger::default();
+    markdown::headings(markdown).iter().any(|heading| slugger.next(heading) == anchor)
+}
+
+// Calls `f` with the target of every inline link and image in `markdown`,
+// replacing it when `f` returns a new one.
+fn rewrite<F: FnMut(&str) -> Option<String>>(markdown: &str, mut f: F) -> String {
+    let mut out = String::with_capacity(markdown.len());
+    let mut rest = markdown;
+    while let Some(start) = rest.find("](") {
+        let (before, after) = rest.split_at(start + 2);
+        out.push_str(before);
+        let end = after.find(|c: char| c == ')' || c.is_whitespace()).unwrap_or(after.len());
+        let url = &after[..end];
+        match f(url) {
+            Some(url) => out.push_str(&url),
+            None => out.push_str(url),
+        }
+        rest = &after[end..];
+    }
+    out.push_str(rest);
+    out
+}
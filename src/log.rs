@@ -0,0 +1,122 @@
+use std::fmt;
+use std::str::FromStr;
+use std::sync::atomic::{AtomicU8, Ordering};
+
+// How much the library and the command write to stderr besides errors. The
+// level is process wide, as warnings come from deep inside the conversion
+// where there's no Options to consult.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Level {
+    /// Nothing but the error that ends the command.
+    Quiet,
+    /// Warnings about parts of the book that were skipped or left as is.
+    #[default]
+    Warn,
+    /// Warnings, plus each chapter as it's converted and how long it took.
+    Verbose,
+}
+
+// How the lines on stderr are written.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum LogFormat {
+    /// Plain lines, warnings prefixed with "warning: ".
+    #[default]
+    Text,
+    /// A JSON object on each line, {"level": "warning", "message": "..."},
+    /// for pipelines that collect logs. The levels are error, warning, info
+    /// and status, the last for the summary lines of a batch.
+    Json,
+}
+
+impl FromStr for LogFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "text" => Ok(LogFormat::Text),
+            "json" => Ok(LogFormat::Json),
+            _ => Err(format!("invalid log format {} (expected text or json)", s)),
+        }
+    }
+}
+
+impl fmt::Display for LogFormat {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LogFormat::Text => f.write_str("text"),
+            LogFormat::Json => f.write_str("json"),
+        }
+    }
+}
+
+static LEVEL: AtomicU8 = AtomicU8::new(Level::Warn as u8);
+static FORMAT: AtomicU8 = AtomicU8::new(LogFormat::Text as u8);
+
+pub fn set_level(level: Level) {
+    LEVEL.store(level as u8, Ordering::Relaxed);
+}
+
+pub fn level() -> Level {
+    match LEVEL.load(Ordering::Relaxed) {
+        0 => Level::Quiet,
+        1 => Level::Warn,
+        _ => Level::Verbose,
+    }
+}
+
+pub fn set_format(format: LogFormat) {
+    FORMAT.store(format as u8, Ordering::Relaxed);
+}
+
+pub fn format() -> LogFormat {
+    match FORMAT.load(Ordering::Relaxed) {
+        0 => LogFormat::Text,
+        _ => LogFormat::Json,
+    }
+}
+
+// Writes "Error: ..." to stderr whatever the level: the error that ends the
+// command.
+pub fn error(args: fmt::Arguments) {
+    write("error", "Error: ", args);
+}
+
+// Writes "warning: ..." to stderr unless the level is Quiet.
+pub fn warn(args: fmt::Arguments) {
+    if level() >= Level::Warn {
+        write("warning", "warning: ", args);
+    }
+}
+
+// Writes the line to stderr when the level is Verbose.
+pub fn info(args: fmt::Arguments) {
+    if level() >= Level::Verbose {
+        write("info", "", args);
+    }
+}
+
+// Writes the line to stderr as it is, such as a batch's tally of the books
+// it converted. Whether it's shown at all is up to the caller.
+pub fn status(args: fmt::Arguments) {
+    write("status", "", args);
+}
+
+// One line, so that lines written from several threads at once don't mix.
+fn write(level: &str, prefix: &str, args: fmt::Arguments) {
+    match format() {
+        LogFormat::Text => eprintln!("{}{}", prefix, args),
+        LogFormat::Json => eprintln!("{}", serde_json::json!({ "level": level, "message": args.to_string() })),
+    }
+}
+
+macro_rules! warn {
+    ($($arg:tt)*) => {
+        $crate::log::warn(format_args!($($arg)*))
+    };
+}
+
+macro_rules! info {
+    ($($arg:tt)*) => {
+        $crate::log::info(format_args!($($arg)*))
+    };
+}
@@ -1,20 +1,1726 @@
 use anyhow::{Context, Result};
-use clap::Parser;
-use cipher::{epub_to_markdown, get_embeddings};
+use clap::{Parser, Subcommand};
+use cipher::cache::Cache;
+use cipher::download::{self, Download};
+use cipher::{
+    book_info, book_info_from, build_toc, build_toc_from, convert_books, convert_chapters_from, convert_chapters_with,
+    convert_file_with, convert_with, create_output, find_epubs, get_embeddings, guide, guide_from, html, html_to_epub,
+    is_html, is_unpacked_epub, json, list_items, list_items_from, log, normalize, org, page_list, page_list_from,
+    plan_books, read_metadata, read_metadata_from, reader, split, text, validate, validate_from, BatchError, Book,
+    BookStats, Bullet, CancelToken, Cancelled, Chapter, ChapterErrors, ChapterSelection, Color, CoverOptions,
+    DEFAULT_PAGE_MARKER, DefinitionList, DrmProtected, Emphasis, FigureCaption, Format, GuideRef, GuideSource,
+    HeadingStyle, ImageOptions, InputFormat, InvalidEpub, Item, Items, Level, LineBreak, LineEnding, ListSpacing,
+    LogFormat, MarkdownOptions, Metadata, MetadataFormat, NameContext, NameTemplate, Nonlinear, Options,
+    OrderedDelimiter, PageTarget, Pattern, Problem, Progress, QuoteStyle, Renderer, Rendition, RtlWrap, Ruby,
+    SearchOptions, Style, Theme, Typography, Unreadable, Wrap,
+};
+use std::env;
+use std::fs;
+use std::io::{self, BufWriter, Cursor, IsTerminal, Read, Seek, Write};
+use std::mem;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::Duration;
 
+// A command and its flags, or the convert command's flags on their own.
 #[derive(Parser, Debug)]
 #[clap(author, version, about, long_about = None)]
+#[clap(args_conflicts_with_subcommands = true, subcommand_negates_reqs = true)]
+struct Cli {
+    #[clap(subcommand)]
+    command: Option<Command>,
+    #[clap(flatten)]
+    convert: Args,
+}
+
+#[derive(Subcommand, Debug)]
+enum Command {
+    /// Convert EPUBs to markdown, also what runs without a command
+    Convert(Args),
+    /// Print a JSON summary of the book (metadata, chapter and manifest counts,
+    /// size, TOC presence) without converting it
+    Info(InfoArgs),
+    /// Print the book's table of contents as a markdown list, from the nav
+    /// document, the NCX or else the spine
+    Toc(TocArgs),
+    /// Check each book's structure (container, rootfile, manifest, spine and
+    /// TOC) without converting, printing each problem with a code such as
+    /// missing-file; exits with 1 when any book has problems
+    Validate(ValidateArgs),
+}
+
+// The flags of the convert command.
+#[derive(clap::Args, Debug)]
 struct Args {
+    /// The EPUB to convert, or - to read it from stdin, or an http(s) URL to
+    /// download it from. An HTML file or an unpacked EPUB folder works too.
+    /// Several EPUBs or directories of them are each converted into a .md file
+    /// next to the EPUB (or into --output-dir)
+    #[clap(required_unless_present_any = ["cache_info", "clear_cache"], num_args = 1..)]
+    epub_paths: Vec<String>,
+    /// Also look for EPUBs in subdirectories of directory arguments
+    #[clap(short, long)]
+    recursive: bool,
+    /// Write the .md file for each EPUB into this directory
+    #[clap(long, value_name = "DIR", conflicts_with_all = ["output", "split"])]
+    output_dir: Option<PathBuf>,
+    #[clap(flatten)]
+    input: InputArgs,
+    /// Save the EPUB downloaded from a URL next to the output
+    #[clap(long)]
+    keep_download: bool,
+    /// Write the markdown to this file, or to stdout for -. Without it the book
+    /// goes to stdout on a terminal, and otherwise to a file named after the EPUB
+    /// in the current directory (book.epub to book.md)
+    #[clap(short, long)]
+    output: Option<PathBuf>,
+    /// Write one markdown file per chapter, plus an index.md, into this directory
+    #[clap(long, value_name = "DIR", conflicts_with = "output")]
+    split: Option<PathBuf>,
+    /// With --split, also write an index.json listing each chapter's title,
+    /// source href, file and word count alongside the book's metadata
+    #[clap(long, requires = "split")]
+    index_json: bool,
+    /// With --split, name the chapter files with this template instead of
+    /// "{index:02}-{slug}.md": {index} (or zero-padded, {index:03}), {title},
+    /// {slug}, {href} and {idref} stand for the chapter's, and {book_title} for
+    /// the book's. Names that come out the same, as chapters sharing a title do
+    /// without {index}, get -2, -3, ... before the extension
+    #[clap(long, value_name = "TEMPLATE", requires = "split")]
+    name_template: Option<NameTemplate>,
+    /// Write one zip holding the files --split and --index-json would write,
+    /// with the images under images/, to --output, or to the EPUB's name with
+    /// .zip. An --output ending in .zip writes a bundle without it
+    #[clap(long, conflicts_with_all = ["split", "images", "cover"])]
+    bundle: bool,
+    /// Overwrite the output file if it already exists
+    #[clap(short, long)]
+    force: bool,
+    /// Convert as usual but only list the files that would be written, with
+    /// their sizes; images and the cover aren't extracted
+    #[clap(long, conflicts_with_all = ["read", "embed", "cache"])]
+    dry_run: bool,
+    /// Style the markdown on stdout for the terminal, falling back to plain
+    /// markdown when stdout isn't one (see --color)
+    #[clap(long, conflicts_with_all = ["output", "raw"])]
+    render: bool,
+    /// Terminal style for rendered output (implies --render): auto, dark, light,
+    /// notty, dracula, pink, or a path to a glamour JSON style file
+    #[clap(long, visible_alias = "theme")]
+    style: Option<Style>,
+    /// When to style rendered output: auto only when stdout is a terminal (off
+    /// with NO_COLOR set, on with CLICOLOR_FORCE set), always or never
+    #[clap(long, value_name = "WHEN", default_value = "auto")]
+    color: Color,
+    /// Word-wrap styled output at this many columns: a number, 0 for no
+    /// wrapping, or auto for the terminal width (at most 100, 80 if unknown)
+    #[clap(long, visible_alias = "width", value_name = "N", default_value = "auto")]
+    wrap: Wrap,
+    /// Output format: md; txt for plain text without markdown syntax; ansi for
+    /// markdown styled with --style even when stdout isn't a terminal; json for
+    /// the metadata and chapters as one JSON object; ndjson for one chapter per
+    /// line; html for one self-contained HTML page with a linked table of
+    /// contents (add --embed-images for one that opens offline with its images);
+    /// org for an Emacs Org document
+    #[clap(long, value_name = "FORMAT", default_value = "md", conflicts_with_all = ["render", "split", "read"])]
+    format: Format,
+    /// Write the converted markdown to stdout without terminal styling
+    /// (the default unless --render or --style is given)
+    #[clap(long, conflicts_with = "output")]
+    raw: bool,
+    /// Prepend the book metadata as front matter (the default)
+    #[clap(long, overrides_with = "no_front_matter")]
+    front_matter: bool,
+    /// Don't prepend the book metadata as front matter
+    #[clap(long, overrides_with = "front_matter")]
+    no_front_matter: bool,
+    /// How the front matter is written: yaml (a --- block) or pandoc (a Pandoc
+    /// title block of % lines with the title, authors and date)
+    #[clap(long, value_name = "FORMAT", default_value = "yaml")]
+    metadata_format: MetadataFormat,
+    /// Don't insert a table of contents built from the nav document or NCX
+    #[clap(long)]
+    no_toc: bool,
+    /// Build the table of contents from the converted chapters' titles and
+    /// headings instead, linking to the heading anchors
+    #[clap(long, conflicts_with = "no_toc")]
+    toc: bool,
+    /// Levels of the --toc table of contents: 1 lists only the chapters, 2 adds
+    /// the sections inside them, and so on
+    #[clap(
+        long,
+        value_name = "N",
+        default_value_t = 2,
+        value_parser = clap::value_parser!(u8).range(1..=6),
+        requires = "toc"
+    )]
+    toc_depth: u8,
+    /// Convert tables to GitHub Flavored Markdown pipe tables (the default)
+    #[clap(long, overrides_with = "no_gfm")]
+    gfm: bool,
+    /// Keep tables as HTML instead of converting them to pipe tables
+    #[clap(long, overrides_with = "gfm")]
+    no_gfm: bool,
+    /// Heading style: atx (# Title) or setext (Title underlined; levels 1 and 2 only)
+    #[clap(long, value_name = "STYLE", default_value = "atx")]
+    heading_style: HeadingStyle,
+    /// Add N to every heading level (at most 6), so chapters nest under a book title
+    #[clap(long, value_name = "N", default_value_t = 0)]
+    heading_offset: usize,
+    /// Start each chapter that doesn't open with a level 1 or 2 heading with its
+    /// TOC title, as a heading of this level
+    #[clap(long, value_name = "LEVEL", value_parser = clap::value_parser!(u8).range(1..=6), conflicts_with = "split")]
+    title_headings: Option<u8>,
+    /// Shift each chapter's headings so that its first heading is of this level
+    /// and the rest keep their place relative to it, for books whose chapters
+    /// don't all start at the same level
+    #[clap(
+        long,
+        value_name = "LEVEL",
+        value_parser = clap::value_parser!(u8).range(1..=6),
+        conflicts_with = "heading_offset"
+    )]
+    promote_chapters: Option<u8>,
+    /// Marker for unordered list items: *, - or +
+    #[clap(long, value_name = "CHAR", default_value = "*")]
+    bullet: Bullet,
+    /// What follows the number of ordered list items: . or )
+    #[clap(long, value_name = "CHAR", default_value = ".")]
+    ordered_delimiter: OrderedDelimiter,
+    /// Write lists tight (no blank lines between items) or loose (a blank
+    /// line between every two); by default they're spaced as converted
+    #[clap(long, value_name = "SPACING")]
+    list_spacing: Option<ListSpacing>,
+    /// Emphasis delimiter: * or _, or none to keep emphasized text plain
+    #[clap(long, value_name = "CHAR", default_value = "*")]
+    emphasis: Emphasis,
+    /// Quotation marks for inline <q> quotes: curly (“ and ‘) or straight (" and ')
+    #[clap(long, value_name = "STYLE", default_value = "curly")]
+    quote_style: QuoteStyle,
+    /// How a <br> ends its line: spaces (two trailing spaces) or backslash
+    #[clap(long, value_name = "STYLE", default_value = "spaces")]
+    line_break: LineBreak,
+    /// How to write <dl> definition lists: extra (the term, then `:   ` before
+    /// each definition) or bold (the term in bold over an indented paragraph,
+    /// for renderers without definition lists)
+    #[clap(long, value_name = "STYLE", default_value = "extra")]
+    definition_lists: DefinitionList,
+    /// Keep the line breaks of elements with a matching class, as in poetry:
+    /// each line of a stanza on its own line (* and ? are wildcards; can be
+    /// repeated)
+    #[clap(long, value_name = "PATTERN")]
+    verse_class: Vec<String>,
+    /// Mark up text written right to left, as in Arabic or Hebrew books: marks
+    /// (a right-to-left mark starting each paragraph) or div (each right-to-left
+    /// chapter in a <div dir="rtl">, for renderers that allow HTML)
+    #[clap(long, value_name = "STYLE")]
+    rtl_wrap: Option<RtlWrap>,
+    /// How <ruby> annotations such as Japanese furigana are written: parentheses
+    /// (the reading after its base text, 漢字（かんじ）), base (the base text
+    /// alone) or html (the <ruby> markup kept)
+    #[clap(long, value_name = "FORM", default_value = "parentheses")]
+    ruby: Ruby,
+    /// Keep <ruby> annotations as HTML; the same as --ruby html
+    #[clap(long, conflicts_with = "ruby")]
+    keep_ruby_html: bool,
+    /// Elements kept as HTML since markdown can't represent them, as a
+    /// comma-separated list of tag names, or none. The output is then GitHub
+    /// Flavored Markdown mixed with HTML. Complex tables, with cells spanning
+    /// rows or columns, are kept as HTML either way; table keeps every table
+    #[clap(long, value_name = "TAGS", value_delimiter = ',', default_value = "details,sub,sup")]
+    keep_html: Vec<String>,
+    /// Mark the page breaks of the print edition that print-based books carry,
+    /// for cross-referencing it: <!-- page 42 --> at each one by default, or
+    /// the marker given, with {page} standing for the page number. Without it
+    /// the page breaks are dropped
+    #[clap(
+        long,
+        visible_alias = "pages",
+        value_name = "MARKER",
+        num_args = 0..=1,
+        default_missing_value = DEFAULT_PAGE_MARKER
+    )]
+    page_markers: Option<String>,
+    /// Keep struck-through text plain instead of writing ~~strikethrough~~
+    #[clap(long)]
+    no_strikethrough: bool,
+    /// Don't backslash-escape markdown characters in the text
+    #[clap(long)]
+    no_escape: bool,
+    /// Tidy the typography of the text: curly quotes and dashes to ASCII, runs of
+    /// non-breaking spaces to one space, and soft hyphens and zero-width spaces
+    /// removed. Takes all (the default) or a comma-separated list of quotes,
+    /// dashes, spaces, hyphens and zero-width. Code is left alone
+    #[clap(long, value_name = "LIST", num_args = 0..=1, default_missing_value = "all")]
+    normalize: Option<Typography>,
+    /// With --normalize, turn quotes and dashes the other way: "..." to curly
+    /// quotes, --- to an em dash and -- to an en dash
+    #[clap(long, requires = "normalize")]
+    smart: bool,
+    /// Line ending of the written markdown or text: lf or crlf
+    #[clap(long, value_name = "EOL", default_value_t = LineEnding::Lf)]
+    line_ending: LineEnding,
+    /// Keep <script>, <style>, hidden elements and inline styles instead of
+    /// dropping them before converting
+    #[clap(long)]
+    no_sanitize: bool,
+    /// Keep the element ids that links point at as <a id> anchors, so links
+    /// land on the paragraph rather than the heading before it
+    #[clap(long)]
+    anchors: bool,
+    /// Write each heading's anchor as an explicit {#id} attribute, for
+    /// renderers such as pandoc that make up their own otherwise
+    #[clap(long)]
+    heading_ids: bool,
+    /// Number the headings "1.", "1.1.", "2." and so on by level, counting
+    /// on across chapters
+    #[clap(long)]
+    number_headings: bool,
+    /// Extract images into this directory (defaults to images/ next to the output)
+    #[clap(long, value_name = "DIR", conflicts_with = "no_images")]
+    images: Option<PathBuf>,
+    /// Don't extract images next to the output; leave image links untouched
+    #[clap(long)]
+    no_images: bool,
+    /// Write the cover image to this file (adding an extension from its type
+    /// when there is none) and show it after the front matter
+    #[clap(long, value_name = "PATH", conflicts_with = "split")]
+    cover: Option<PathBuf>,
+    /// Inline images as base64 data: URIs, for a single self-contained file
+    #[clap(long, conflicts_with_all = ["images", "no_images"])]
+    embed_images: bool,
+    /// Keep inline <svg> drawings and SVG pages as <svg> markup. Obsidian,
+    /// Typora, VS Code's preview and pandoc's HTML output show it; GitHub,
+    /// GitLab and other renderers that filter HTML drop it
+    #[clap(long)]
+    inline_svg: bool,
+    /// Where figure captions go: italic (a line under the image) or title (the
+    /// image's title, ![alt](src "caption"))
+    #[clap(long, value_name = "STYLE", default_value = "italic")]
+    figure_captions: FigureCaption,
+    /// Largest image inlined by --embed-images, in KiB; larger ones keep their link
+    #[clap(
+        long,
+        visible_alias = "embed-max-size",
+        value_name = "KIB",
+        default_value_t = 1024,
+        requires = "embed_images"
+    )]
+    max_embed_size: u64,
+    /// Rendition to convert when the book has several rootfiles: its number
+    /// (counting from 1), its full-path in META-INF/container.xml, or its
+    /// rendition:label, layout (reflowable, pre-paginated) or media
+    #[clap(long, value_name = "N|PATH|LABEL")]
+    rendition: Option<Rendition>,
+    /// Only convert these chapters, counting spine items from 1 (e.g. 1,3,5-8)
+    #[clap(long, value_name = "LIST")]
+    chapters: Option<ChapterSelection>,
+    /// Convert spine items the book marks as outside the reading order
+    /// (linear="no"), such as pop-up notes and full-size image pages, in their
+    /// place in the spine rather than after the rest of the book, under an
+    /// Appendix heading
+    #[clap(long, conflicts_with = "drop_nonlinear")]
+    include_nonlinear: bool,
+    /// Leave out the spine items marked linear="no" altogether
+    #[clap(long)]
+    drop_nonlinear: bool,
+    /// Fail on chapters whose HTML is larger than this, in KiB, instead of
+    /// converting them (they become placeholders unless --strict)
+    #[clap(long, value_name = "KIB")]
+    max_chapter_size: Option<u64>,
+    /// Cut chapters whose markdown is over this, in KiB, at their top-level
+    /// headings: into files of their own with --split, and with a
+    /// <!-- section --> comment between the parts otherwise
+    #[clap(long, value_name = "KIB", value_parser = clap::value_parser!(u64).range(1..))]
+    chunk_chapters: Option<u64>,
+    /// Remove lines, other than headings, found among the first or last few
+    /// lines of at least PERCENT of the chapters (80 if not given), such as a
+    /// publisher banner or running header; -v lists what was removed
+    #[clap(
+        long,
+        value_name = "PERCENT",
+        num_args = 0..=1,
+        default_missing_value = "80",
+        value_parser = clap::value_parser!(u8).range(1..=100)
+    )]
+    strip_boilerplate: Option<u8>,
+    /// Remove the blocks, headings included, that open at least CHAPTERS of
+    /// the chapters word for word (3 if not given), such as the book's title
+    /// and author atop every chapter, from all but the first; a chapter's own
+    /// TOC title is kept, and -v lists what was removed
+    #[clap(
+        long,
+        value_name = "CHAPTERS",
+        num_args = 0..=1,
+        default_missing_value = "3",
+        value_parser = clap::value_parser!(u8).range(2..)
+    )]
+    dedupe_boilerplate: Option<u8>,
+    /// Write MathML as LaTeX between $ or $$ delimiters, for renderers that
+    /// typeset math
+    #[clap(long)]
+    math: bool,
+    /// Skip the cover, title page, copyright page and HTML table of contents
+    /// the book opens with; --list-chapters marks them
+    #[clap(long)]
+    skip_front_matter: bool,
+    /// Skip the ads for other books and colophon the book closes with
+    #[clap(long)]
+    skip_back_matter: bool,
+    /// Put an <a id="start-reading"> anchor before the chapter the book's
+    /// landmarks or guide say its text starts at
+    #[clap(long, conflicts_with = "split")]
+    mark_start: bool,
+    /// Never skip spine items whose manifest id or href matches this pattern
+    /// as front or back matter (* and ? are wildcards; can be repeated)
+    #[clap(long, value_name = "PATTERN")]
+    keep: Vec<String>,
+    /// Skip chapters whose TOC title matches this regular expression, ignoring
+    /// case; plain text matches anywhere in the title (can be repeated)
+    #[clap(long, value_name = "PATTERN", value_parser = skip_pattern)]
+    skip_title: Vec<Pattern>,
+    /// Skip chapters whose manifest href matches this regular expression,
+    /// ignoring case (can be repeated)
+    #[clap(long, value_name = "PATTERN", value_parser = skip_pattern)]
+    skip_href: Vec<Pattern>,
+    /// Only convert chapters whose title or href matches this regular
+    /// expression, case-sensitively unless it starts with (?i); the title is
+    /// the TOC's, or the chapter's first heading (can be repeated, matching
+    /// any)
+    #[clap(long = "match", value_name = "REGEX", value_parser = chapter_pattern)]
+    match_chapter: Vec<Pattern>,
+    /// Leave out chapters whose title or href matches this regular
+    /// expression, even ones --match matches (can be repeated)
+    #[clap(long, value_name = "REGEX", value_parser = chapter_pattern)]
+    exclude: Vec<Pattern>,
+    /// Print the index, idref and TOC title of each spine item and exit
+    #[clap(long, conflicts_with_all = ["output", "split", "read", "embed"])]
+    list_chapters: bool,
+    /// Print each spine item's id, href, media type and linearity, then the
+    /// manifest items outside the spine, and exit; JSON with --format json
+    #[clap(long, conflicts_with_all = ["output", "split", "list_chapters", "read", "embed"])]
+    list_items: bool,
+    /// Print the book's landmarks (EPUB3) and guide references (EPUB2), such as
+    /// its cover, contents and where the text starts, and exit; JSON with
+    /// --format json
+    #[clap(long, conflicts_with_all = ["output", "split", "list_chapters", "list_items", "read", "embed"])]
+    guide: bool,
+    /// Print the book's page list, the page numbers of the print edition and
+    /// where each page starts, and exit; JSON with --format json
+    #[clap(long, conflicts_with_all = ["output", "split", "list_chapters", "list_items", "guide", "read", "embed"])]
+    page_list: bool,
+    /// Number of chapters to convert in parallel, or of books when converting
+    /// several (defaults to the number of CPUs)
+    #[clap(short, long, value_name = "N")]
+    jobs: Option<usize>,
+    /// Print the book's metadata as JSON and exit without converting
+    #[clap(long, conflicts_with_all = ["output", "split", "list_chapters", "read", "embed"])]
+    metadata: bool,
+    /// Indent the JSON written by --format json
+    #[clap(long)]
+    pretty: bool,
+    /// Page through the book one chapter at a time in the terminal
+    #[clap(long, conflicts_with_all = ["output", "split", "raw", "embed"])]
+    read: bool,
+    /// Start --read at the beginning instead of offering to resume where the
+    /// book was left
+    #[clap(long, requires = "read")]
+    fresh: bool,
+    /// Page through the whole book, rendered, with $PAGER, each chapter after a
+    /// line starting with § (n and N in less go to the next and previous
+    /// chapter); without $PAGER, the same as --read
+    #[clap(
+        long,
+        conflicts_with_all = [
+            "output", "split", "raw", "embed", "read", "dry_run", "format", "list_chapters", "list_items", "guide",
+            "page_list", "metadata", "grep", "stats", "cache"
+        ]
+    )]
+    pager: bool,
+    #[clap(flatten)]
+    log: LogArgs,
+    /// Stop at the first chapter that fails to convert instead of inserting a
+    /// placeholder, and refuse EPUBs that break the container rules (no or a
+    /// compressed mimetype, a misplaced container.xml, byte order marks)
+    #[clap(long)]
+    strict: bool,
+    /// What to do with a chapter, navigation document or NCX that can't be read
+    /// out of the archive: fail, placeholder (a note in its place) or skip. By
+    /// default an unreadable chapter is handled like one that fails to convert
+    #[clap(long, value_name = "POLICY")]
+    unreadable: Option<Unreadable>,
+    /// Print the lines of the book's plain text matching PATTERN, with the
+    /// chapter they're in and the lines around them, instead of converting
+    #[clap(
+        long,
+        value_name = "PATTERN",
+        conflicts_with_all = ["output", "split", "list_chapters", "metadata", "read", "embed", "stats"]
+    )]
+    grep: Option<String>,
+    /// Match --grep's pattern regardless of case
+    #[clap(short, long, requires = "grep")]
+    ignore_case: bool,
+    /// Read --grep's pattern as a regular expression
+    #[clap(short = 'E', long, requires = "grep")]
+    regex: bool,
+    /// Lines of context shown around each --grep match
+    #[clap(short = 'C', long, value_name = "N", default_value_t = 2, requires = "grep")]
+    context: usize,
+    /// Print the word, character and image counts of each chapter and an
+    /// estimated reading time to stderr after converting, as a table or, with
+    /// --format json or ndjson, as JSON
+    #[clap(long, conflicts_with_all = ["list_chapters", "metadata", "read", "embed"])]
+    stats: bool,
+    /// Reading speed for the reading time of --stats and --format json
+    #[clap(long, value_name = "N", default_value_t = 200, value_parser = clap::value_parser!(u16).range(1..))]
+    wpm: u16,
+    /// Print embeddings for each chunk instead of markdown
+    #[clap(long)]
+    embed: bool,
+    /// Reuse the markdown from an earlier run on the same book with the same
+    /// options, kept in the user's cache directory, and cache it otherwise.
+    /// Conversions that write images or a cover aren't cached
+    #[clap(long, conflicts_with_all = ["split", "read", "embed"])]
+    cache: bool,
+    /// Print where the cache is, how many books it holds and its size
+    #[clap(long, conflicts_with = "clear_cache")]
+    cache_info: bool,
+    /// Remove every cached book
+    #[clap(long)]
+    clear_cache: bool,
+}
+
+// The flags of the info command.
+#[derive(clap::Args, Debug)]
+struct InfoArgs {
+    /// The EPUB to summarize, or - to read it from stdin, or an http(s) URL to
+    /// download it from
     epub_path: String,
+    #[clap(flatten)]
+    input: InputArgs,
+    /// Indent the JSON
+    #[clap(long)]
+    pretty: bool,
+    #[clap(flatten)]
+    log: LogArgs,
+}
+
+// The flags of the toc command.
+#[derive(clap::Args, Debug)]
+struct TocArgs {
+    /// The EPUB whose table of contents to print, or - to read it from stdin,
+    /// or an http(s) URL to download it from
+    epub_path: String,
+    #[clap(flatten)]
+    input: InputArgs,
+    #[clap(flatten)]
+    log: LogArgs,
+}
+
+// The flags of the validate command.
+#[derive(clap::Args, Debug)]
+struct ValidateArgs {
+    /// The EPUBs to check, or directories of them, or - to read one from stdin
+    #[clap(required = true, num_args = 1..)]
+    epub_paths: Vec<String>,
+    /// Also look for EPUBs in subdirectories of directory arguments
+    #[clap(short, long)]
+    recursive: bool,
+    /// Print the problems as txt, or as json or ndjson
+    #[clap(long, value_name = "FORMAT", default_value = "txt")]
+    format: Format,
+    /// Indent the JSON written by --format json
+    #[clap(long)]
+    pretty: bool,
+    /// Largest EPUB accepted on stdin, in MiB
+    #[clap(long, value_name = "MIB", default_value_t = 512)]
+    max_input_size: u64,
+    /// Read the input as epub or html instead of going by its extension
+    /// (.html, .htm and .xhtml are HTML), e.g. for HTML on stdin
+    #[clap(long, value_name = "FORMAT")]
+    input_format: Option<InputFormat>,
+    #[clap(flatten)]
+    log: LogArgs,
+}
+
+// How every command reads its input.
+#[derive(clap::Args, Debug)]
+struct InputArgs {
+    /// Largest EPUB accepted on stdin or from a URL, in MiB
+    #[clap(long, value_name = "MIB", default_value_t = 512)]
+    max_input_size: u64,
+    /// Give up downloading a URL after this many seconds
+    #[clap(long, value_name = "SECS", default_value_t = 60)]
+    download_timeout: u64,
+    /// Read the input as epub or html instead of going by its extension
+    /// (.html, .htm and .xhtml are HTML), e.g. for HTML on stdin
+    #[clap(long, value_name = "FORMAT")]
+    input_format: Option<InputFormat>,
+}
+
+// How every command logs to stderr.
+#[derive(clap::Args, Debug)]
+struct LogArgs {
+    /// Don't show progress or warnings on stderr, only the error when the
+    /// command fails
+    #[clap(short, long)]
+    quiet: bool,
+    /// Log what's done, such as each chapter converted with its timings,
+    /// instead of showing progress
+    #[clap(short, long, conflicts_with = "quiet")]
+    verbose: bool,
+    /// How warnings, errors and --verbose lines are written to stderr: text, or
+    /// json for a JSON object on each line (which also turns off the progress)
+    #[clap(long, value_name = "FORMAT", default_value = "text")]
+    log_format: LogFormat,
+}
+
+// Where the EPUB comes from: a file, or stdin buffered into memory. HTML read
+// with --input-format html is packed into an EPUB in memory.
+enum Input {
+    Path(String),
+    Bytes(Vec<u8>),
+}
+
+impl Input {
+    fn open(path: &str, max_size_mib: u64, format: Option<InputFormat>) -> Result<Input> {
+        let forced = match format {
+            Some(InputFormat::Html) => !is_html(Path::new(path)),
+            Some(InputFormat::Epub) => is_html(Path::new(path)),
+            None => false,
+        };
+        if path != "-" && !forced {
+            return Ok(Input::Path(path.to_string()));
+        }
+        let bytes = match path {
+            "-" => Input::read_stdin(max_size_mib)?,
+            _ => fs::read(path).with_context(|| format!("Failed to read {}", path))?,
+        };
+        match format {
+            Some(InputFormat::Html) => {
+                let page = if path == "-" { Path::new("stdin.html") } else { Path::new(path) };
+                Ok(Input::Bytes(html_to_epub(&bytes, page)?))
+            }
+            _ => Ok(Input::Bytes(bytes)),
+        }
+    }
+
+    fn read_stdin(max_size_mib: u64) -> Result<Vec<u8>> {
+        let limit = max_size_mib.saturating_mul(1024 * 1024);
+        let mut bytes = Vec::new();
+        io::stdin()
+            .lock()
+            .take(limit.saturating_add(1))
+            .read_to_end(&mut bytes)
+            .context("Failed to read EPUB from stdin")?;
+        if bytes.len() as u64 > limit {
+            anyhow::bail!("EPUB on stdin is larger than --max-input-size ({} MiB)", max_size_mib);
+        }
+        Ok(bytes)
+    }
+
+    fn metadata(&self) -> Result<Metadata> {
+        match self {
+            Input::Path(path) => read_metadata(path),
+            Input::Bytes(bytes) => read_metadata_from(Cursor::new(bytes)),
+        }
+    }
+
+    fn items(&self) -> Result<Items> {
+        match self {
+            Input::Path(path) => list_items(path),
+            Input::Bytes(bytes) => list_items_from(Cursor::new(bytes)),
+        }
+    }
+
+    fn guide(&self) -> Result<Vec<GuideRef>> {
+        match self {
+            Input::Path(path) => guide(path),
+            Input::Bytes(bytes) => guide_from(Cursor::new(bytes)),
+        }
+    }
+
+    fn page_list(&self) -> Result<Vec<PageTarget>> {
+        match self {
+            Input::Path(path) => page_list(path),
+            Input::Bytes(bytes) => page_list_from(Cursor::new(bytes)),
+        }
+    }
+
+    fn chapters(&self, options: &Options) -> Result<(Vec<Chapter>, Failures)> {
+        let chapters = match self {
+            Input::Path(path) => convert_chapters_with(path, options),
+            Input::Bytes(bytes) => convert_chapters_from(Cursor::new(bytes), options),
+        };
+        best_effort(chapters, |errors| mem::take(&mut errors.chapters))
+    }
+
+    fn markdown(&self, options: &Options) -> Result<(String, Failures)> {
+        let markdown = match self {
+            Input::Path(path) => convert_file_with(path, options),
+            Input::Bytes(bytes) => convert_with(Cursor::new(bytes), options),
+        };
+        best_effort(markdown, |errors| mem::take(&mut errors.markdown))
+    }
+}
+
+// Chapters that failed in a best-effort conversion, by href, with the reason.
+type Failures = Vec<(String, String)>;
+
+// Without --strict a book with broken chapters still converts; the output is
+// kept and the failures are warned about once it has been written.
+fn best_effort<T, F: FnOnce(&mut ChapterErrors) -> T>(result: Result<T>, output: F) -> Result<(T, Failures)> {
+    match result {
+        Ok(converted) => Ok((converted, Vec::new())),
+        Err(e) => {
+            let mut errors = e.downcast::<ChapterErrors>().context("Failed to convert EPUB to Markdown")?;
+            Ok((output(&mut errors), errors.failures))
+        }
+    }
+}
+
+fn warn_failures(failures: &Failures) {
+    for (href, reason) in failures {
+        log::warn(format_args!("failed to convert {}: {}", href, reason));
+    }
+}
+
+fn list_chapters<R: Read + Seek>(book: &Book<R>) -> Result<()> {
+    let entries = book.spine();
+    let width = entries.iter().map(|entry| entry.idref.len()).max().unwrap_or(0);
+    let stdout = io::stdout();
+    let mut writer = stdout.lock();
+    for entry in entries {
+        let mut marks: Vec<String> = Vec::new();
+        if !entry.linear {
+            marks.push("non-linear".to_string());
+        }
+        if let Some(matter) = entry.matter {
+            marks.push(matter.to_string());
+        }
+        let marks = (!marks.is_empty()).then(|| format!("({})", marks.join(", ")));
+        let title = [entry.title, marks].into_iter().flatten().collect::<Vec<_>>().join(" ");
+        let line = format!("{:>3}  {:<width$}  {}", entry.index, entry.idref, title);
+        writeln!(writer, "{}", line.trim_end())?;
+    }
+    Ok(())
+}
+
+// Prints each match as soon as its chapter is searched, grep style: "N:" for
+// the matching line and "N-" for context, under a "title (href)" line for each
+// chapter, with "--" between groups that aren't adjacent. Exits with 1 when
+// nothing matched.
+fn grep<R: Read + Seek>(book: &mut Book<R>, pattern: &Pattern, context: usize) -> Result<()> {
+    let stdout = io::stdout();
+    let mut writer = stdout.lock();
+    // The chapter and line printed last, so that overlapping context isn't
+    // printed twice.
+    let mut last: Option<(usize, usize)> = None;
+    book.search(pattern, context, |found| {
+        let first = found.line - found.before.len();
+        let printed = match last {
+            Some((index, line)) if index == found.index => {
+                if first > line + 1 {
+                    writeln!(writer, "--")?;
+                }
+                line
+            }
+            Some(_) => {
+                writeln!(writer, "\n{} ({})", found.title, found.href)?;
+                0
+            }
+            None => {
+                writeln!(writer, "{} ({})", found.title, found.href)?;
+                0
+            }
+        };
+        let before = (first..).zip(&found.before).map(|(n, text)| (n, '-', text));
+        let after = (found.line + 1..).zip(&found.after).map(|(n, text)| (n, '-', text));
+        let lines = before.chain([(found.line, ':', &found.text)]).chain(after);
+        for (n, separator, text) in lines.filter(|(n, _, _)| *n > printed) {
+            writeln!(writer, "{}{}{}", n, separator, text)?;
+        }
+        last = Some((found.index, printed.max(found.line + found.after.len())));
+        Ok(())
+    })?;
+    if last.is_none() {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+// Prints the spine, numbered, and then the other manifest items.
+fn print_items(items: &Items) -> Result<()> {
+    let all = || items.spine.iter().chain(&items.other);
+    let id_width = all().map(|item| item.id.len()).max().unwrap_or(0);
+    let href_width = all().map(|item| item.href.len()).max().unwrap_or(0);
+    let line = |number: String, item: &Item| {
+        let mut marks: Vec<String> = Vec::new();
+        if !item.linear {
+            marks.push("non-linear".to_string());
+        }
+        if item.href.is_empty() {
+            marks.push("not in the manifest".to_string());
+        }
+        marks.extend(item.properties.iter().cloned());
+        let marks = (!marks.is_empty()).then(|| format!("({})", marks.join(", "))).unwrap_or_default();
+        let line = format!("{:>3}  {:<id_width$}  {:<href_width$}  {}  {}", number, item.id, item.href, item.media_type, marks);
+        line.trim_end().to_string()
+    };
+    let stdout = io::stdout();
+    let mut writer = stdout.lock();
+    writeln!(writer, "spine:")?;
+    for (i, item) in items.spine.iter().enumerate() {
+        writeln!(writer, "{}", line((i + 1).to_string(), item))?;
+    }
+    writeln!(writer, "other manifest items:")?;
+    for item in &items.other {
+        writeln!(writer, "{}", line(String::new(), item))?;
+    }
+    Ok(())
+}
+
+fn print_guide(references: &[GuideRef]) -> Result<()> {
+    let kind_width = references.iter().map(|reference| reference.kind.len()).max().unwrap_or(0);
+    let href_width = references.iter().map(|reference| reference.href.len()).max().unwrap_or(0);
+    let stdout = io::stdout();
+    let mut writer = stdout.lock();
+    for reference in references {
+        let source = match reference.source {
+            GuideSource::Guide => "guide",
+            GuideSource::Landmarks => "landmarks",
+        };
+        let line = format!(
+            "{:<kind_width$}  {:<href_width$}  ({})  {}",
+            reference.kind, reference.href, source, reference.title
+        );
+        writeln!(writer, "{}", line.trim_end())?;
+    }
+    Ok(())
+}
+
+fn print_page_list(pages: &[PageTarget]) -> Result<()> {
+    let page_width = pages.iter().map(|target| target.page.chars().count()).max().unwrap_or(0);
+    let stdout = io::stdout();
+    let mut writer = stdout.lock();
+    for target in pages {
+        writeln!(writer, "{:<page_width$}  {}", target.page, target.href)?;
+    }
+    Ok(())
+}
+
+// The flags that only make sense for a single EPUB, by name.
+fn single_book_flags(args: &Args) -> Vec<&'static str> {
+    [
+        ("--output", args.output.is_some()),
+        ("--split", args.split.is_some()),
+        ("--bundle", args.bundle),
+        ("--images", args.images.is_some()),
+        ("--cover", args.cover.is_some()),
+        ("--render", args.render || args.style.is_some()),
+        ("--format", args.format != Format::Markdown),
+        ("--list-chapters", args.list_chapters),
+        ("--list-items", args.list_items),
+        ("--guide", args.guide),
+        ("--page-list", args.page_list),
+        ("--metadata", args.metadata),
+        ("--read", args.read),
+        ("--pager", args.pager),
+        ("--embed", args.embed),
+        ("--stats", args.stats),
+        ("--grep", args.grep.is_some()),
+        ("--cache", args.cache),
+    ]
+    .into_iter()
+    .filter_map(|(flag, set)| set.then_some(flag))
+    .collect()
+}
+
+// Where --keep-download saves the book: beside the output file or the
+// --split directory, or in the current directory when the output goes to
+// stdout.
+fn kept_download_path(args: &Args, download: &Download) -> PathBuf {
+    let output = args.split.as_ref().or(args.output.as_ref().filter(|path| path.as_os_str() != "-"));
+    let dir = output.and_then(|path| path.parent()).unwrap_or(Path::new(""));
+    dir.join(download.file_name())
+}
+
+fn is_batch(args: &Args) -> bool {
+    let folder = |path: &String| Path::new(path).is_dir() && !is_unpacked_epub(Path::new(path));
+    args.epub_paths.len() > 1 || args.output_dir.is_some() || args.epub_paths.iter().any(folder)
+}
+
+// Converts every EPUB named on the command line, and those in the directories
+// named, --jobs at a time, reporting the ones that failed and a count of both
+// at the end in the order the books were named. Ctrl-C or SIGTERM lets the
+// books in progress stop at their next chapter and starts no more.
+fn convert_batch(args: &Args, options: &Options) -> Result<()> {
+    if let Some(flag) = single_book_flags(args).first() {
+        anyhow::bail!("{} can only be used with a single EPUB", flag);
+    }
+    let books = books(&args.epub_paths, args.recursive)?;
+    let cancel = cancel_on_signals();
+    let show_progress = shows_progress(args);
+    let options = Options {
+        cancel: Some(cancel),
+        progress: show_progress
+            .then(|| Progress::new(|done, total, book| eprint!("\r\x1b[2Kbook {}/{}: {}", done, total, book))),
+        ..options.clone()
+    };
+    let options = &options;
+    if args.dry_run {
+        return plan_batch(args, &books, options, show_progress);
+    }
+    if let Some(dir) = &args.output_dir {
+        fs::create_dir_all(dir).with_context(|| format!("Failed to create {}", dir.display()))?;
+    }
+
+    let converted = convert_books(&books, args.output_dir.as_deref(), args.force, options);
+    clear_progress(show_progress);
+    let (failed, drm_protected) = match converted {
+        Ok(()) => (0, 0),
+        Err(e) => match e.downcast_ref::<BatchError>() {
+            Some(batch) => {
+                for (book, reason) in &batch.failures {
+                    log::status(format_args!("failed: {}: {}", book.display(), reason));
+                }
+                (batch.failures.len(), batch.drm_protected.len())
+            }
+            None => return Err(e),
+        },
+    };
+    if !args.log.quiet {
+        match drm_protected {
+            0 => log::status(format_args!("converted {}, failed {}", books.len() - failed, failed)),
+            _ => log::status(format_args!(
+                "converted {}, failed {} ({} DRM-protected)",
+                books.len() - failed,
+                failed,
+                drm_protected
+            )),
+        }
+    }
+    interrupted(options);
+    // Only DRM-protected books failing is worth telling apart from a book
+    // that's broken.
+    match failed {
+        0 => Ok(()),
+        _ if failed == drm_protected => std::process::exit(EXIT_DRM_PROTECTED),
+        _ => std::process::exit(1),
+    }
+}
+
+// A token cancelled by Ctrl-C or, on Unix, SIGTERM, which then don't end the
+// process: the conversion stops at its next chapter instead.
+fn cancel_on_signals() -> CancelToken {
+    let cancel = CancelToken::new();
+    let interrupt = cancel.clone();
+    tokio::spawn(async move {
+        terminated().await;
+        interrupt.cancel();
+    });
+    cancel
+}
+
+// Waits for Ctrl-C or SIGTERM, forever if they can't be listened for.
+#[cfg(unix)]
+async fn terminated() {
+    use tokio::signal::unix::{signal, SignalKind};
+    let term = async {
+        match signal(SignalKind::terminate()) {
+            Ok(mut term) => term.recv().await,
+            Err(_) => std::future::pending().await,
+        }
+    };
+    tokio::select! {
+        Ok(()) = tokio::signal::ctrl_c() => {}
+        _ = term => {}
+    }
+}
+
+#[cfg(not(unix))]
+async fn terminated() {
+    if tokio::signal::ctrl_c().await.is_err() {
+        std::future::pending::<()>().await;
+    }
 }
 
+// The files and folders an interrupted conversion of a single book had
+// started writing, such as its images folder, which `main` removes before
+// exiting with EXIT_INTERRUPTED.
+static PARTIAL_OUTPUT: Mutex<Vec<PathBuf>> = Mutex::new(Vec::new());
+
+// Notes that this run creates `path`, unless it's there already and so isn't
+// the run's to remove.
+fn creates(path: &Path) {
+    if !path.exists() {
+        PARTIAL_OUTPUT.lock().unwrap().push(path.to_path_buf());
+    }
+}
+
+fn remove_partial_output() {
+    for path in PARTIAL_OUTPUT.lock().unwrap().drain(..) {
+        let removed = match path.is_dir() {
+            true => fs::remove_dir_all(&path),
+            false => fs::remove_file(&path),
+        };
+        match removed {
+            Ok(()) => log::info(format_args!("removed {}", path.display())),
+            Err(e) if e.kind() == io::ErrorKind::NotFound => {}
+            Err(e) => log::warn(format_args!("can't remove {}: {}", path.display(), e)),
+        }
+    }
+}
+
+// Exits with EXIT_INTERRUPTED once the batch has been stopped with Ctrl-C.
+fn interrupted(options: &Options) {
+    if options.cancel.as_ref().is_some_and(CancelToken::is_cancelled) {
+        log::status(format_args!("interrupted"));
+        std::process::exit(EXIT_INTERRUPTED);
+    }
+}
+
+// Converts the books of a batch without writing them, listing the file each
+// would be written to.
+fn plan_batch(args: &Args, books: &[PathBuf], options: &Options, show_progress: bool) -> Result<()> {
+    let plans = plan_books(books, args.output_dir.as_deref(), args.force, options);
+    clear_progress(show_progress);
+    let mut failed = 0;
+    for plan in &plans {
+        match &plan.output {
+            Ok((path, bytes)) => println!("would write {} ({} bytes)", path.display(), bytes),
+            Err(reason) => {
+                log::status(format_args!("failed: {}: {}", plan.book.display(), reason));
+                failed += 1;
+            }
+        }
+    }
+    if !args.log.quiet {
+        log::status(format_args!("would convert {}, failed {}", plans.len() - failed, failed));
+    }
+    interrupted(options);
+    if failed > 0 {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+// The EPUBs named on the command line, and those in the directories named,
+// and with `recursive` in their subdirectories. A directory that is an
+// unpacked EPUB is a book itself.
+fn books(paths: &[String], recursive: bool) -> Result<Vec<PathBuf>> {
+    let mut books = Vec::new();
+    for path in paths {
+        if path == "-" {
+            anyhow::bail!("- (stdin) can only be used on its own");
+        }
+        let path = PathBuf::from(path);
+        match path.is_dir() && !is_unpacked_epub(&path) {
+            true => books.extend(find_epubs(&path, recursive)?),
+            false => books.push(path),
+        }
+    }
+    Ok(books)
+}
+
+// Checks the structure of each book without converting it, printing "ok" or
+// one line per problem, or JSON with --format json or ndjson. Exits with 1
+// when any book has problems.
+fn validate_books(args: &ValidateArgs) -> Result<()> {
+    if let Some(url) = args.epub_paths.iter().find(|path| download::is_url(path)) {
+        anyhow::bail!("{} can't be validated from the web; download it first", url);
+    }
+    let results = match args.epub_paths.as_slice() {
+        [path] if path == "-" => {
+            let Input::Bytes(bytes) = Input::open(path, args.max_input_size, args.input_format)? else {
+                unreachable!("- is read from stdin")
+            };
+            vec![(path.clone(), validate_from(Cursor::new(bytes)))]
+        }
+        _ => books(&args.epub_paths, args.recursive)?
+            .into_iter()
+            .map(|book| {
+                let result = validate(&book.to_string_lossy());
+                (book.display().to_string(), result)
+            })
+            .collect(),
+    };
+    // A file that isn't a readable archive is reported like any other problem.
+    let results: Vec<(String, Vec<Problem>)> = results
+        .into_iter()
+        .map(|(book, result)| {
+            let problems = result.unwrap_or_else(|e| {
+                vec![Problem {
+                    code: "unreadable",
+                    message: format!("{:#}", e),
+                }]
+            });
+            (book, problems)
+        })
+        .collect();
+    match args.format {
+        Format::Json => println!("{}", json::validation_to_json(&results, args.pretty)),
+        Format::Ndjson => print!("{}", json::validation_to_ndjson(&results)),
+        _ => {
+            for (book, problems) in &results {
+                if problems.iter().all(Problem::is_warning) {
+                    println!("{}: ok", book);
+                }
+                for problem in problems {
+                    println!("{}: {}", book, problem);
+                }
+            }
+        }
+    }
+    if results.iter().any(|(_, problems)| !problems.iter().all(Problem::is_warning)) {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+// Parses a --skip-title or --skip-href pattern.
+fn skip_pattern(s: &str) -> Result<Pattern, String> {
+    let options = SearchOptions {
+        regex: true,
+        ignore_case: true,
+        ..SearchOptions::default()
+    };
+    Pattern::new(s, &options).map_err(|e| format!("{:#}", e))
+}
+
+// Parses a --match or --exclude pattern.
+fn chapter_pattern(s: &str) -> Result<Pattern, String> {
+    let options = SearchOptions {
+        regex: true,
+        ..SearchOptions::default()
+    };
+    Pattern::new(s, &options).map_err(|e| format!("{:#}", e))
+}
+
+// Conversion settings shared by single-book and batch conversion.
+fn base_options(args: &Args) -> Options {
+    let options = Options {
+        front_matter: !args.no_front_matter,
+        metadata_format: args.metadata_format,
+        toc: !args.no_toc,
+        toc_depth: args.toc.then_some(usize::from(args.toc_depth)),
+        strict: args.strict,
+        unreadable: args.unreadable,
+        lenient: !args.strict,
+        chapters: args.chapters.clone(),
+        nonlinear: match (args.include_nonlinear, args.drop_nonlinear) {
+            (true, _) => Nonlinear::Include,
+            (_, true) => Nonlinear::Drop,
+            _ => Nonlinear::Appendix,
+        },
+        max_chapter_size: args.max_chapter_size.map(|kib| kib.saturating_mul(1024)),
+        chunk_chapters: args.chunk_chapters.map(|kib| usize::try_from(kib.saturating_mul(1024)).unwrap_or(usize::MAX)),
+        strip_boilerplate: args.strip_boilerplate.map(|percent| f64::from(percent) / 100.0),
+        dedupe_boilerplate: args.dedupe_boilerplate.map(usize::from),
+        math: args.math,
+        skip_front_matter: args.skip_front_matter,
+        skip_back_matter: args.skip_back_matter,
+        mark_start: args.mark_start,
+        keep: args.keep.clone(),
+        skip_titles: args.skip_title.clone(),
+        skip_hrefs: args.skip_href.clone(),
+        match_chapters: args.match_chapter.clone(),
+        exclude_chapters: args.exclude.clone(),
+        gfm: !args.no_gfm,
+        rendition: args.rendition.clone(),
+        markdown: MarkdownOptions {
+            headings: args.heading_style,
+            bullet: args.bullet,
+            ordered_delimiter: args.ordered_delimiter,
+            list_spacing: args.list_spacing,
+            emphasis: args.emphasis,
+            strikethrough: !args.no_strikethrough,
+            escape: !args.no_escape,
+            heading_offset: args.heading_offset,
+            typography: args.normalize.map(|typography| typography.smart(args.smart)),
+            quote_style: args.quote_style,
+            line_break: args.line_break,
+            definition_lists: args.definition_lists,
+        },
+        title_headings: args.title_headings.map(usize::from),
+        promote_chapters: args.promote_chapters.map(usize::from),
+        anchors: args.anchors,
+        heading_ids: args.heading_ids,
+        number_headings: args.number_headings,
+        sanitize: !args.no_sanitize,
+        verse_classes: args.verse_class.clone(),
+        rtl_wrap: args.rtl_wrap,
+        ruby: match args.keep_ruby_html {
+            true => Ruby::Html,
+            false => args.ruby,
+        },
+        keep_html: args
+            .keep_html
+            .iter()
+            .map(|tag| tag.trim().to_string())
+            .filter(|tag| !tag.is_empty() && tag != "none")
+            .collect(),
+        page_markers: args.page_markers.clone(),
+        line_ending: args.line_ending,
+        embed_images: args.embed_images.then(|| args.max_embed_size.saturating_mul(1024)),
+        inline_svg: args.inline_svg,
+        figure_captions: args.figure_captions,
+        ..Options::default()
+    };
+    match args.jobs {
+        Some(jobs) => Options { jobs, ..options },
+        None => options,
+    }
+}
+
+// Progress is drawn over itself on a terminal, which would garble the lines
+// logged alongside it.
+fn shows_progress(args: &Args) -> bool {
+    !args.log.quiet && !args.log.verbose && args.log.log_format == LogFormat::Text && io::stderr().is_terminal()
+}
+
+fn clear_progress(shown: bool) {
+    if shown {
+        eprint!("\r\x1b[2K");
+    }
+}
+
+// Exit statuses for input that isn't a usable EPUB and for a DRM-protected
+// book, or a batch whose only failures are DRM-protected books, so scripts
+// can tell them from other failures, which exit with 1. A batch stopped with
+// Ctrl-C exits with 130, as a shell reports SIGINT.
+const EXIT_BAD_INPUT: i32 = 2;
+const EXIT_DRM_PROTECTED: i32 = 3;
+const EXIT_INTERRUPTED: i32 = 130;
+
 #[tokio::main]
-async fn main() -> Result<()> {
-    let args = Args::parse();
-    let markdown_chunks = epub_to_markdown(&args.epub_path).context("Failed to convert EPUB to Markdown")?;
-    let embeddings = get_embeddings(markdown_chunks).await?;
-    for embedding in embeddings {
-        println!("Embedding for chunk: {:?}", embedding);
+async fn main() {
+    if let Err(e) = run().await {
+        if e.downcast_ref::<Cancelled>().is_some() {
+            remove_partial_output();
+            log::status(format_args!("interrupted"));
+            std::process::exit(EXIT_INTERRUPTED);
+        }
+        if let Some(drm) = e.downcast_ref::<DrmProtected>() {
+            log::error(format_args!("{}", drm));
+            std::process::exit(EXIT_DRM_PROTECTED);
+        }
+        // The whole cause chain on one line, e.g. "Error: Failed to open x.epub: No such file".
+        log::error(format_args!("{:#}", e));
+        match e.downcast_ref::<InvalidEpub>() {
+            Some(_) => std::process::exit(EXIT_BAD_INPUT),
+            None => std::process::exit(1),
+        }
+    }
+}
+
+async fn run() -> Result<()> {
+    let cli = Cli::parse();
+    let command = cli.command.unwrap_or(Command::Convert(cli.convert));
+    let log = match &command {
+        Command::Convert(args) => &args.log,
+        Command::Info(args) => &args.log,
+        Command::Toc(args) => &args.log,
+        Command::Validate(args) => &args.log,
+    };
+    log::set_level(match (log.quiet, log.verbose) {
+        (true, _) => Level::Quiet,
+        (_, true) => Level::Verbose,
+        _ => Level::Warn,
+    });
+    log::set_format(log.log_format);
+    match command {
+        Command::Convert(args) => convert(args).await,
+        Command::Info(args) => {
+            let (input, _download) = open_input(&args.epub_path, &args.input).await?;
+            let info = match &input {
+                Input::Path(path) => book_info(path)?,
+                Input::Bytes(bytes) => book_info_from(Cursor::new(bytes))?,
+            };
+            println!("{}", info.to_json(args.pretty));
+            Ok(())
+        }
+        Command::Toc(args) => {
+            let (input, _download) = open_input(&args.epub_path, &args.input).await?;
+            let toc = match &input {
+                Input::Path(path) => build_toc(path)?,
+                Input::Bytes(bytes) => build_toc_from(Cursor::new(bytes))?,
+            };
+            print!("{}", toc);
+            Ok(())
+        }
+        Command::Validate(args) => validate_books(&args),
+    }
+}
+
+// Opens the book at `path`, downloading it first when it's a URL. The
+// `Download` returned has to be kept for as long as the book is read.
+async fn open_input(path: &str, options: &InputArgs) -> Result<(Input, Option<Download>)> {
+    let download = fetch(path, options).await?;
+    let input = Input::open(&local_path(path, download.as_ref()), options.max_input_size, options.input_format)?;
+    Ok((input, download))
+}
+
+// Downloads the book at `path` when it's a URL. A book on the web is read
+// from a temporary copy, removed when the `Download` goes out of scope.
+async fn fetch(path: &str, options: &InputArgs) -> Result<Option<Download>> {
+    if !download::is_url(path) {
+        return Ok(None);
+    }
+    let timeout = Duration::from_secs(options.download_timeout);
+    let max_size = options.max_input_size.saturating_mul(1024 * 1024);
+    // Ctrl-C drops the download in progress, and with it the file.
+    let fetch = download::fetch(path, timeout, max_size);
+    tokio::select! {
+        download = fetch => Ok(Some(download?)),
+        _ = terminated() => Err(Cancelled::Cancelled.into()),
+    }
+}
+
+// Where the book named `path` on the command line is read from.
+fn local_path(path: &str, download: Option<&Download>) -> String {
+    match download {
+        Some(download) => download.path().to_string_lossy().into_owned(),
+        None => path.to_string(),
+    }
+}
+
+async fn convert(mut args: Args) -> Result<()> {
+    if args.cache_info || args.clear_cache {
+        return manage_cache(&args);
+    }
+    if is_batch(&args) {
+        if let Some(url) = args.epub_paths.iter().find(|path| download::is_url(path)) {
+            anyhow::bail!("{} can only be downloaded when it's the one book converted", url);
+        }
+        return convert_batch(&args, &base_options(&args));
+    }
+    let download = fetch(&args.epub_paths[0], &args.input).await?;
+    if let Some(download) = download.as_ref().filter(|_| args.keep_download) {
+        let path = kept_download_path(&args, download);
+        download.keep(&path, args.force)?;
+        log::info(format_args!("saved the download to {}", path.display()));
+    }
+    let path = local_path(&args.epub_paths[0], download.as_ref());
+    let input = Input::open(&path, args.input.max_input_size, args.input.input_format)?;
+    if args.embed {
+        let (chapters, _) = input.chapters(&Options::default())?;
+        let markdown_chunks = chapters.into_iter().map(|chapter| chapter.markdown).collect();
+        let embeddings = get_embeddings(markdown_chunks).await?;
+        for embedding in embeddings {
+            println!("Embedding for chunk: {:?}", embedding);
+        }
+        return Ok(());
+    }
+
+    if args.metadata {
+        println!("{}", input.metadata()?.to_json());
+        return Ok(());
+    }
+    if let Some(pattern) = &args.grep {
+        let options = SearchOptions {
+            ignore_case: args.ignore_case,
+            regex: args.regex,
+            context: args.context,
+        };
+        let pattern = Pattern::new(pattern, &options)?;
+        return match &input {
+            Input::Path(path) => grep(&mut Book::open(path)?, &pattern, options.context),
+            Input::Bytes(bytes) => grep(&mut Book::from_reader(Cursor::new(bytes))?, &pattern, options.context),
+        };
+    }
+    if args.list_chapters {
+        return match &input {
+            Input::Path(path) => list_chapters(&Book::open(path)?.keeping(&args.keep)),
+            Input::Bytes(bytes) => list_chapters(&Book::from_reader(Cursor::new(bytes))?.keeping(&args.keep)),
+        };
+    }
+    if args.guide {
+        let references = input.guide()?;
+        return match args.format {
+            Format::Json | Format::Ndjson => {
+                let json = match args.pretty {
+                    true => serde_json::to_string_pretty(&references),
+                    false => serde_json::to_string(&references),
+                };
+                println!("{}", json?);
+                Ok(())
+            }
+            _ => print_guide(&references),
+        };
+    }
+    if args.page_list {
+        let pages = input.page_list()?;
+        return match args.format {
+            Format::Json | Format::Ndjson => {
+                let json = match args.pretty {
+                    true => serde_json::to_string_pretty(&pages),
+                    false => serde_json::to_string(&pages),
+                };
+                println!("{}", json?);
+                Ok(())
+            }
+            _ => print_page_list(&pages),
+        };
+    }
+    if args.list_items {
+        let items = input.items()?;
+        return match args.format {
+            Format::Json | Format::Ndjson => {
+                println!("{}", items.to_json(args.pretty));
+                Ok(())
+            }
+            _ => print_items(&items),
+        };
+    }
+    // A style only matters when rendering, so choosing one implies --render.
+    let style = match (&args.style, args.render) {
+        (Some(style), _) => Some(style.clone()),
+        (None, true) => Some(Style::Theme(Theme::Auto)),
+        (None, false) => None,
+    };
+    if args.read {
+        let renderer = Renderer::new(style.unwrap_or(Style::Theme(Theme::Auto))).wrap(args.wrap);
+        return match &input {
+            Input::Path(path) => reader::run(&mut Book::open(path)?, &renderer, !args.fresh),
+            Input::Bytes(bytes) => reader::run(&mut Book::from_reader(Cursor::new(bytes))?, &renderer, !args.fresh),
+        };
+    }
+    if args.pager {
+        let renderer = Renderer::new(style.unwrap_or(Style::Theme(Theme::Auto))).wrap(args.wrap);
+        return match &input {
+            Input::Path(path) => reader::page(&mut Book::open(path)?, &renderer),
+            Input::Bytes(bytes) => reader::page(&mut Book::from_reader(Cursor::new(bytes))?, &renderer),
+        };
+    }
+
+    args.bundle |= args.output.as_ref().is_some_and(|path| path.extension().is_some_and(|ext| ext == "zip"));
+    if args.bundle && args.format != Format::Markdown {
+        anyhow::bail!("a bundle holds markdown files, so it can't be written with --format {}", args.format);
+    }
+    args.output = output_path(&args);
+    // A bundle's images are extracted into a folder of their own, which goes
+    // into the zip and is removed after.
+    let bundle_dir = env::temp_dir().join(format!("cipher-bundle-{}", std::process::id()));
+    let markdown_dir = match (&args.split, &args.output) {
+        _ if args.bundle => Some(bundle_dir.clone()),
+        (Some(dir), _) => Some(dir.clone()),
+        (None, Some(output)) => Some(output.parent().unwrap_or(Path::new("")).to_path_buf()),
+        (None, None) => None,
+    };
+    let images_dir = match (&args.images, &markdown_dir) {
+        _ if args.no_images || args.embed_images || args.dry_run => None,
+        _ if args.bundle => Some(bundle_dir.join("images")),
+        (Some(dir), _) => Some(dir.clone()),
+        (None, Some(dir)) => Some(dir.join("images")),
+        (None, None) => None,
+    };
+    // Ctrl-C or SIGTERM stops the conversion at its next chapter, and the
+    // images and cover it has written so far are removed.
+    if let Some(dir) = images_dir.as_ref().filter(|_| !args.bundle) {
+        creates(dir);
+    }
+    if let Some(cover) = args.cover.as_ref().filter(|_| !args.dry_run) {
+        creates(cover);
+    }
+    let show_progress = shows_progress(&args);
+    let options = Options {
+        cancel: Some(cancel_on_signals()),
+        images: images_dir.map(|dir| {
+            let base = markdown_dir.clone().unwrap_or_default();
+            let link_prefix = dir.strip_prefix(&base).unwrap_or(&dir).to_string_lossy().into_owned();
+            ImageOptions { dir, link_prefix }
+        }),
+        cover: args.cover.as_ref().filter(|_| !args.dry_run).map(|path| {
+            let base = markdown_dir.clone().unwrap_or_default();
+            let link = path.strip_prefix(&base).unwrap_or(path).to_string_lossy().into_owned();
+            CoverOptions { path: path.clone(), link }
+        }),
+        progress: show_progress.then(|| {
+            Progress::new(|current, total, chapter| eprint!("\r\x1b[2Kchapter {}/{}: {}", current, total, chapter))
+        }),
+        ..base_options(&args)
+    };
+    // The HTML page puts the metadata in its <head> and builds its own table
+    // of contents, linking to the ids the headings are given; the Org document
+    // puts it in keywords and the ids in the headings' properties.
+    let options = match args.format {
+        Format::Html | Format::Org => Options {
+            front_matter: false,
+            toc: false,
+            heading_ids: true,
+            ..options
+        },
+        _ => options,
+    };
+
+    if matches!(args.format, Format::Json | Format::Ndjson) {
+        let chapters = input.chapters(&options);
+        clear_progress(show_progress);
+        let (chapters, failures) = chapters?;
+        let json = match args.format {
+            Format::Json => {
+                let stats = BookStats::with_words_per_minute(&chapters, usize::from(args.wpm));
+                json::book_to_json(&input.metadata()?, &chapters, &stats, args.pretty) + "\n"
+            }
+            _ => json::to_ndjson(&chapters),
+        };
+        write_output(&args, &json)?;
+        warn_failures(&failures);
+        print_stats(&args, &chapters);
+        return Ok(());
+    }
+    if args.bundle {
+        let chapters = input.chapters(&options);
+        clear_progress(show_progress);
+        let bundle = chapters.and_then(|(chapters, failures)| {
+            let names = chapter_names(&args, &input, &chapters)?;
+            let images = options.images.as_ref().map(|images| images.dir.as_path());
+            let zip = split::bundle(&input.metadata()?, &chapters, &names, images, args.line_ending)?;
+            Ok((zip, chapters, failures))
+        });
+        let _ = fs::remove_dir_all(&bundle_dir);
+        let (zip, chapters, failures) = bundle?;
+        match &args.output {
+            Some(path) if args.dry_run => plan_output(path, &zip, args.force)?,
+            None if args.dry_run => println!("would write {} bytes to stdout", zip.len()),
+            Some(path) => split::write_bundle(&zip, path, args.force)?,
+            None => io::stdout().lock().write_all(&zip)?,
+        }
+        warn_failures(&failures);
+        print_stats(&args, &chapters);
+        return Ok(());
+    }
+    if let Some(dir) = &args.split {
+        let chapters = input.chapters(&options);
+        clear_progress(show_progress);
+        let (chapters, failures) = chapters?;
+        let names = chapter_names(&args, &input, &chapters)?;
+        if args.dry_run {
+            let mut files = split::chapter_files(&chapters, &names, args.line_ending);
+            if args.index_json {
+                files.push(("index.json".to_string(), split::index_json(&input.metadata()?, &chapters, &names)));
+            }
+            for (name, contents) in files {
+                plan_output(&dir.join(name), &contents, args.force)?;
+            }
+        } else {
+            split::write_chapters(&chapters, &names, dir, args.force, args.line_ending)?;
+            if args.index_json {
+                split::write_index_json(&input.metadata()?, &chapters, &names, dir, args.force)?;
+            }
+        }
+        warn_failures(&failures);
+        print_stats(&args, &chapters);
+        return Ok(());
+    }
+
+    let entry = cache_entry(&args, &input, &options)?;
+    let cached = entry.as_ref().and_then(|(cache, key)| Some((cache.dir(), cache.get(key)?)));
+    let (markdown, failures) = match cached {
+        Some((dir, markdown)) => {
+            log::info(format_args!("using the cached markdown in {}", dir.display()));
+            (markdown, Vec::new())
+        }
+        None => {
+            let markdown = input.markdown(&options);
+            clear_progress(show_progress);
+            let (markdown, failures) = markdown?;
+            // Books with failed chapters aren't cached, so that the failures
+            // are reported every time.
+            if let Some((cache, key)) = entry.as_ref().filter(|_| failures.is_empty()) {
+                if let Err(e) = cache.put(key, &markdown) {
+                    log::warn(format_args!("can't cache the markdown: {:#}", e));
+                }
+            }
+            (markdown, failures)
+        }
+    };
+    let output = match args.format {
+        Format::Html => normalize(&html::to_html(&input.metadata()?, &markdown), args.line_ending),
+        Format::Org => normalize(&org::to_org(&input.metadata()?, &markdown), args.line_ending),
+        _ => format_output(&args, style, markdown),
+    };
+    write_output(&args, &output)?;
+    warn_failures(&failures);
+    if args.stats {
+        // The whole-book conversion doesn't keep the chapters apart, so they
+        // are converted again, without writing or embedding images a second time.
+        // The output is complete by now, and interrupting this leaves it be.
+        PARTIAL_OUTPUT.lock().unwrap().clear();
+        let options = Options {
+            images: None,
+            embed_images: None,
+            progress: None,
+            ..options
+        };
+        let (chapters, _) = input.chapters(&options)?;
+        print_stats(&args, &chapters);
+    }
+    Ok(())
+}
+
+// With --cache, the cache and the key of this conversion. Serving cached
+// markdown wouldn't write the images or cover it links to, so conversions
+// that write them aren't cached.
+fn cache_entry(args: &Args, input: &Input, options: &Options) -> Result<Option<(Cache, String)>> {
+    if !args.cache {
+        return Ok(None);
+    }
+    if options.images.is_some() || options.cover.is_some() {
+        log::info(format_args!("not caching: images or a cover are written alongside the markdown"));
+        return Ok(None);
+    }
+    let Some(cache) = Cache::open_default() else {
+        log::warn(format_args!("not caching: can't find the user's cache directory"));
+        return Ok(None);
+    };
+    let key = match input {
+        Input::Path(path) if Path::new(path).is_dir() => {
+            log::info(format_args!("not caching: {} is a folder", path));
+            return Ok(None);
+        }
+        Input::Path(path) => {
+            let file = fs::File::open(path).with_context(|| format!("Failed to open {}", path))?;
+            Cache::key_from_reader(io::BufReader::new(file), options).with_context(|| format!("Failed to read {}", path))?
+        }
+        Input::Bytes(bytes) => Cache::key(bytes, options),
+    };
+    Ok(Some((cache, key)))
+}
+
+fn manage_cache(args: &Args) -> Result<()> {
+    let cache = Cache::open_default().context("Can't find the user's cache directory")?;
+    if args.clear_cache {
+        let removed = cache.clear()?;
+        println!("removed {} cached book{} from {}", removed, if removed == 1 { "" } else { "s" }, cache.dir().display());
+        return Ok(());
+    }
+    let info = cache.info()?;
+    println!("directory: {}", cache.dir().display());
+    println!("books: {}", info.entries);
+    println!("size: {} KiB", info.bytes.div_ceil(1024));
+    Ok(())
+}
+
+// Turns the converted markdown into what --format asks for. The JSON formats
+// are built from the chapters instead, and HTML with the metadata, and never
+// get here.
+fn format_output(args: &Args, style: Option<Style>, markdown: String) -> String {
+    let terminal = io::stdout().is_terminal();
+    match args.format {
+        Format::Markdown => match style.filter(|_| !args.raw && args.output.is_none()) {
+            Some(style) => {
+                // Color forced onto a pipe needs a theme auto can't pick there.
+                let style = match style {
+                    Style::Theme(Theme::Auto) if !terminal && args.color.enabled(terminal) => Style::Theme(Theme::Dark),
+                    style => style,
+                };
+                Renderer::new(style).wrap(args.wrap).color(args.color, terminal).render(&markdown)
+            }
+            None => markdown,
+        },
+        Format::Text => normalize(&text::to_text(&markdown), args.line_ending),
+        Format::Ansi => {
+            // Asking for ANSI means styling a pipe or file too, so auto can't
+            // fall back to notty here. Only --color never turns it off.
+            let style = match style {
+                None | Some(Style::Theme(Theme::Auto)) if !terminal => Style::Theme(Theme::Dark),
+                style => style.unwrap_or(Style::Theme(Theme::Auto)),
+            };
+            let color = match args.color {
+                Color::Never => Color::Never,
+                _ => Color::Always,
+            };
+            Renderer::new(style).wrap(args.wrap).color(color, terminal).render(&markdown)
+        }
+        Format::Json | Format::Ndjson | Format::Html | Format::Org => markdown,
+    }
+}
+
+fn print_stats(args: &Args, chapters: &[Chapter]) {
+    if args.stats {
+        let stats = BookStats::with_words_per_minute(chapters, usize::from(args.wpm));
+        match args.format {
+            Format::Json | Format::Ndjson => eprintln!("{}", stats.to_json(args.pretty)),
+            _ => eprint!("{}", stats.table()),
+        }
+    }
+}
+
+// Where the converted book goes: the file -o names, or stdout for -o -.
+// Without -o it goes to stdout when that's a terminal, when it's styled for
+// one and when the EPUB came from stdin, and otherwise to a file in the
+// current directory named after the EPUB and the format, book.md for
+// book.epub.
+fn output_path(args: &Args) -> Option<PathBuf> {
+    match &args.output {
+        Some(path) if path.as_os_str() == "-" => return None,
+        Some(path) => return Some(path.clone()),
+        None => {}
+    }
+    let styled = args.raw || args.render || args.style.is_some() || args.format == Format::Ansi;
+    // A bundle is no use on a terminal, so it goes to a file there too.
+    let to_stdout = io::stdout().is_terminal() && !args.bundle || styled || args.split.is_some();
+    if to_stdout || args.epub_paths[0] == "-" {
+        return None;
+    }
+    let extension = if args.bundle { "zip".to_string() } else { args.format.to_string() };
+    let source = match download::is_url(&args.epub_paths[0]) {
+        true => download::file_name(&args.epub_paths[0]),
+        false => args.epub_paths[0].clone(),
+    };
+    let mut name = Path::new(&source).file_stem()?.to_os_string();
+    name.push(format!(".{}", extension));
+    let path = PathBuf::from(name);
+    log::info(format_args!("writing {} (-o - writes to stdout)", path.display()));
+    Some(path)
+}
+
+// The names of the files --split and --bundle write the chapters to.
+fn chapter_names(args: &Args, input: &Input, chapters: &[Chapter]) -> Result<Vec<String>> {
+    let book = match &args.name_template {
+        Some(_) => NameContext::new(&input.metadata()?, &input.items()?),
+        None => NameContext::default(),
+    };
+    split::file_names(chapters, args.name_template.as_ref(), &book)
+}
+
+// Writes the converted book to --output, or to stdout.
+fn write_output(args: &Args, output: &str) -> Result<()> {
+    if args.dry_run {
+        return match &args.output {
+            Some(path) => plan_output(path, output, args.force),
+            None => {
+                println!("would write {} bytes to stdout", output.len());
+                Ok(())
+            }
+        };
+    }
+    match &args.output {
+        Some(path) => {
+            refuse_overwrite(path, args.force)?;
+            let file = create_output(path, args.force)?;
+            let mut writer = BufWriter::new(file);
+            writer.write_all(output.as_bytes())?;
+            writer.flush()?;
+        }
+        None => io::stdout().lock().write_all(output.as_bytes())?,
+    }
+    Ok(())
+}
+
+// Reports a file --dry-run would write, failing as writing it would when it
+// already exists.
+fn plan_output(path: &Path, contents: impl AsRef<[u8]>, force: bool) -> Result<()> {
+    refuse_overwrite(path, force)?;
+    println!("would write {} ({} bytes)", path.display(), contents.as_ref().len());
+    Ok(())
+}
+
+fn refuse_overwrite(path: &Path, force: bool) -> Result<()> {
+    if !force && path.exists() {
+        anyhow::bail!("Output file {} already exists (use --force to overwrite)", path.display());
     }
     Ok(())
 }
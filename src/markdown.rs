@@ -0,0 +1,237 @@
+use crate::converter::{self, HeadingStyle};
+use crate::slug::Slugger;
+
+// Returns the text of the first ATX or setext heading in `markdown`.
+pub(crate) fn first_heading(markdown: &str) -> Option<String> {
+    headings(markdown).into_iter().next()
+}
+
+// Returns the text of every ATX and setext heading in `markdown`, in order,
+// skipping fenced code blocks.
+pub(crate) fn headings(markdown: &str) -> Vec<String> {
+    outline(markdown).into_iter().map(|(_, text)| text).collect()
+}
+
+// The level and text of every heading, as `headings` finds them. Setext
+// headings are levels 1 and 2.
+pub(crate) fn outline(markdown: &str) -> Vec<(usize, String)> {
+    let lines: Vec<&str> = markdown.lines().collect();
+    heading_lines(&lines).into_iter().map(|(_, level, text)| (level, text)).collect()
+}
+
+// The line index of every heading, counting from 0, as `headings` finds them.
+pub(crate) fn heading_line_numbers(markdown: &str) -> Vec<usize> {
+    let lines: Vec<&str> = markdown.lines().collect();
+    heading_lines(&lines).into_iter().map(|(i, _, _)| i).collect()
+}
+
+// Gives every heading an explicit `{#id}` attribute, as understood by pandoc
+// and most static site generators, with the anchor `slugger` hands out for it.
+// Share one slugger between chapters to keep the ids unique across them.
+// Headings that already have an id keep it.
+pub(crate) fn add_heading_ids(markdown: &str, slugger: &mut Slugger) -> String {
+    let lines: Vec<&str> = markdown.lines().collect();
+    let mut out: Vec<String> = lines.iter().map(|line| line.to_string()).collect();
+    for (i, _, text) in heading_lines(&lines) {
+        let line = lines[i].trim_end();
+        if without_id(line.trim_start()) == line.trim_start() {
+            out[i] = format!("{} {{#{}}}", line, slugger.next(&text));
+        }
+    }
+    let mut out = out.join("\n");
+    if markdown.ends_with('\n') {
+        out.push('\n');
+    }
+    out
+}
+
+// What goes between the parts of a chapter cut up by
+// `Options::chunk_chapters` in one document: a comment, which renderers
+// don't show, for tools that want to cut the document there.
+pub const SECTION_MARKER: &str = "<!-- section -->";
+
+// Cuts markdown longer than `max` bytes into parts of at most that where its
+// headings allow: before each heading of the top level below its first line,
+// with neighbouring sections packed together up to the limit. A section too
+// big on its own is cut the same way at the headings under it, and one
+// without any stays whole, however big.
+pub(crate) fn chunk(markdown: &str, max: usize) -> Vec<String> {
+    if markdown.len() <= max {
+        return vec![markdown.to_string()];
+    }
+    let lines: Vec<&str> = markdown.lines().collect();
+    let headings: Vec<(usize, usize)> =
+        heading_lines(&lines).into_iter().filter(|(i, _, _)| *i > 0).map(|(i, level, _)| (i, level)).collect();
+    let Some(top) = headings.iter().map(|(_, level)| *level).min() else {
+        return vec![markdown.to_string()];
+    };
+    let mut starts = vec![0];
+    let mut offset = 0;
+    let mut cuts = headings.iter().filter(|(_, level)| *level == top).map(|(i, _)| *i).peekable();
+    for (i, line) in markdown.split_inclusive('\n').enumerate() {
+        if cuts.next_if_eq(&i).is_some() {
+            starts.push(offset);
+        }
+        offset += line.len();
+    }
+    starts.push(markdown.len());
+    let mut parts: Vec<String> = Vec::new();
+    let mut current = String::new();
+    for section in starts.windows(2).map(|range| &markdown[range[0]..range[1]]) {
+        if !current.is_empty() && current.len() + section.len() > max {
+            parts.push(std::mem::take(&mut current));
+        }
+        current.push_str(section);
+    }
+    parts.push(current);
+    parts.into_iter().flat_map(|part| chunk(&part, max)).collect()
+}
+
+// Shifts every heading by the same amount, so that the first one is of
+// `level` and the others keep their place relative to it, within levels 1 to
+// 6. The headings are rewritten in `style`, keeping any explicit `{#id}`.
+pub(crate) fn promote_headings(markdown: &str, level: usize, style: HeadingStyle) -> String {
+    let lines: Vec<&str> = markdown.lines().collect();
+    let headings = heading_lines(&lines);
+    let Some(&(_, first, _)) = headings.first() else {
+        return markdown.to_string();
+    };
+    let mut out: Vec<Option<String>> = lines.iter().map(|line| Some(line.to_string())).collect();
+    for (i, old, _) in headings {
+        let new = (old + level).saturating_sub(first).clamp(1, 6);
+        let line = lines[i].trim();
+        let text = match line.starts_with('#') {
+            true => line.trim_start_matches('#').trim_start(),
+            false => {
+                // Setext: the underline goes with the old level.
+                out[i + 1] = None;
+                line
+            }
+        };
+        out[i] = Some(converter::heading(style, new, text));
+    }
+    let mut out = out.into_iter().flatten().collect::<Vec<_>>().join("\n");
+    if markdown.ends_with('\n') {
+        out.push('\n');
+    }
+    out
+}
+
+// Prepends its section number to every heading: "1.", "1.1.", "2." and so
+// on by level, carrying on from where `numbering` left off in the chapter
+// before. Setext headings get the number on their text line.
+pub(crate) fn number_headings(markdown: &str, numbering: &mut Numbering) -> String {
+    let lines: Vec<&str> = markdown.lines().collect();
+    let mut out: Vec<String> = lines.iter().map(|line| line.to_string()).collect();
+    for (i, level, _) in heading_lines(&lines) {
+        let number = numbering.next(level);
+        let line = lines[i];
+        let indent = &line[..line.len() - line.trim_start().len()];
+        let text = line.trim_start();
+        out[i] = match text.starts_with('#') {
+            true => {
+                let hashes = text.len() - text.trim_start_matches('#').len();
+                format!("{}{} {} {}", indent, &text[..hashes], number, text[hashes..].trim_start())
+            }
+            // "1. " on its own line would start a list instead.
+            false if !number[..number.len() - 1].contains('.') => {
+                format!("{}{} {}", indent, number.replace('.', "\\."), text)
+            }
+            false => format!("{}{} {}", indent, number, text),
+        };
+    }
+    let mut out = out.join("\n");
+    if markdown.ends_with('\n') {
+        out.push('\n');
+    }
+    out
+}
+
+// Hands out section numbers for a sequence of headings. Each heading counts
+// within the nearest lower level above it, so a level skipped, as in an h3
+// right under an h1, doesn't show up as a 0: the h3 is "1.1.", and an h2
+// after it "1.2.".
+#[derive(Debug, Clone, Default)]
+pub(crate) struct Numbering {
+    /// The level and number of the headings the next one can be under.
+    open: Vec<(usize, usize)>,
+}
+
+impl Numbering {
+    pub(crate) fn next(&mut self, level: usize) -> String {
+        let mut last = 0;
+        while let Some(&(open, number)) = self.open.last() {
+            if open < level {
+                break;
+            }
+            self.open.pop();
+            last = number;
+        }
+        self.open.push((level, last + 1));
+        self.open.iter().map(|(_, number)| format!("{}.", number)).collect()
+    }
+}
+
+// The line index, level and text of each heading; for a setext heading, the
+// line above the underline. An explicit `{#id}` isn't part of the text.
+fn heading_lines(lines: &[&str]) -> Vec<(usize, usize, String)> {
+    let mut headings = Vec::new();
+    let mut in_fence = false;
+    let mut underline_of_previous = false;
+    for (i, line) in lines.iter().enumerate() {
+        let trimmed = line.trim();
+        if std::mem::take(&mut underline_of_previous) {
+            continue;
+        }
+        if trimmed.starts_with("```") || trimmed.starts_with("~~~") {
+            in_fence = !in_fence;
+            continue;
+        }
+        if in_fence {
+            continue;
+        }
+        if trimmed.starts_with('#') {
+            let level = trimmed.len() - trimmed.trim_start_matches('#').len();
+            let text = without_id(trimmed).trim_start_matches('#').trim_end_matches('#').trim();
+            if !text.is_empty() {
+                headings.push((i, level, text.to_string()));
+                continue;
+            }
+        }
+        if let Some(next) = lines.get(i + 1) {
+            let next = next.trim();
+            let underline = next.len() >= 3 && (next.chars().all(|c| c == '=') || next.chars().all(|c| c == '-'));
+            if underline && !trimmed.is_empty() {
+                let level = if next.starts_with('=') { 1 } else { 2 };
+                headings.push((i, level, without_id(trimmed).to_string()));
+                underline_of_previous = true;
+            }
+        }
+    }
+    headings
+}
+
+fn without_id(heading: &str) -> &str {
+    match heading.rfind(" {#") {
+        Some(start) if heading.ends_with('}') => heading[..start].trim_end(),
+        _ => heading,
+    }
+}
+
+// Whether the first non-blank line of `markdown` is a heading of at most
+// `max_level`. Setext headings count as levels 1 and 2.
+pub(crate) fn starts_with_heading(markdown: &str, max_level: usize) -> bool {
+    let mut lines = markdown.lines().map(str::trim).skip_while(|line| line.is_empty());
+    let Some(first) = lines.next() else {
+        return false;
+    };
+    if first.starts_with('#') {
+        let level = first.len() - first.trim_start_matches('#').len();
+        return level <= max_level && first[level..].starts_with(' ');
+    }
+    match lines.next() {
+        Some(next) if next.len() >= 3 && next.chars().all(|c| c == '=') => max_level >= 1,
+        Some(next) if next.len() >= 3 && next.chars().all(|c| c == '-') => max_level >= 2,
+        _ => false,
+    }
+}
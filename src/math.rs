@@ -0,0 +1,234 @@
+use crate::dom::{Element, Node};
+
+// html2md flattens MathML into its characters run together. With --math each
+// <math> is swapped for a placeholder before conversion and put back as LaTeX
+// afterwards: $...$ inline, or $$...$$ on a line of its own for display math.
+// Math that uses elements we don't translate falls back to its alttext, and
+// failing that to its text as before.
+pub(crate) fn hide(nodes: &mut [Node]) -> Vec<(String, String)> {
+    let mut formulas = Vec::new();
+    hide_in(nodes, &mut formulas);
+    formulas
+}
+
+fn hide_in(nodes: &mut [Node], formulas: &mut Vec<(String, String)>) {
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        if !el.is("math") {
+            hide_in(&mut el.children, formulas);
+            continue;
+        }
+        let block = el.attr("display").is_some_and(|d| d.eq_ignore_ascii_case("block"))
+            || el.attr("mode").is_some_and(|m| m.eq_ignore_ascii_case("display"));
+        let tex = latex(&el.children)
+            .or_else(|| el.attr("alttext").map(|alt| alt.trim().to_string()))
+            .filter(|tex| !tex.is_empty());
+        let markdown = match (tex, block) {
+            (Some(tex), true) => format!("$${}$$", tex),
+            (Some(tex), false) => format!("${}$", tex),
+            (None, _) => el.text(),
+        };
+        let placeholder = format!("CIPHERMATH{}X", formulas.len());
+        formulas.push((placeholder.clone(), markdown));
+        *node = match block {
+            true => {
+                let mut paragraph = Element::new("p");
+                paragraph.children.push(Node::Text(placeholder));
+                Node::Element(paragraph)
+            }
+            false => Node::Text(placeholder),
+        };
+    }
+}
+
+pub(crate) fn restore(markdown: &str, formulas: &[(String, String)]) -> String {
+    let mut markdown = markdown.to_string();
+    for (placeholder, tex) in formulas {
+        markdown = markdown.replace(placeholder, tex);
+    }
+    markdown
+}
+
+// The LaTeX for a run of MathML nodes, or None when they use an element that
+// isn't translated.
+fn latex(nodes: &[Node]) -> Option<String> {
+    let mut out = String::new();
+    for node in nodes {
+        if let Node::Element(el) = node {
+            push(&mut out, &element(el)?);
+        }
+    }
+    Some(out)
+}
+
+fn element(el: &Element) -> Option<String> {
+    let children: Vec<&Element> = el
+        .children
+        .iter()
+        .filter_map(|node| match node {
+            Node::Element(child) => Some(child),
+            _ => None,
+        })
+        .collect();
+    let arg = |i: usize| children.get(i).and_then(|child| element(child));
+    Some(match el.local_name() {
+        "mi" => identifier(&el.text()),
+        "mn" => escape(&el.text()),
+        "mo" => operator(&el.text()),
+        "mtext" => match el.text() {
+            text if text.is_empty() => String::new(),
+            text => format!("\\text{{{}}}", escape(&text)),
+        },
+        "mspace" => "\\,".to_string(),
+        "mrow" | "mstyle" | "mpadded" | "merror" => latex(&el.children)?,
+        "mphantom" => String::new(),
+        "mfrac" if children.len() == 2 => format!("\\frac{{{}}}{{{}}}", arg(0)?, arg(1)?),
+        "msup" if children.len() == 2 => format!("{}^{{{}}}", base(arg(0)?), arg(1)?),
+        "msub" if children.len() == 2 => format!("{}_{{{}}}", base(arg(0)?), arg(1)?),
+        "msubsup" if children.len() == 3 => format!("{}_{{{}}}^{{{}}}", base(arg(0)?), arg(1)?, arg(2)?),
+        "munder" if children.len() == 2 => format!("{}_{{{}}}", base(arg(0)?), arg(1)?),
+        "mover" if children.len() == 2 => format!("{}^{{{}}}", base(arg(0)?), arg(1)?),
+        "munderover" if children.len() == 3 => format!("{}_{{{}}}^{{{}}}", base(arg(0)?), arg(1)?, arg(2)?),
+        "msqrt" => format!("\\sqrt{{{}}}", latex(&el.children)?),
+        "mroot" if children.len() == 2 => format!("\\sqrt[{}]{{{}}}", arg(1)?, arg(0)?),
+        "mfenced" => {
+            let open = el.attr("open").unwrap_or("(");
+            let close = el.attr("close").unwrap_or(")");
+            let separator = el.attr("separators").unwrap_or(",").trim().chars().next().map(String::from);
+            let items = children.iter().map(|child| element(child)).collect::<Option<Vec<_>>>()?;
+            let inner = items.join(&operator(separator.as_deref().unwrap_or_default()));
+            format!("\\left{}{}\\right{}", fence(open), inner, fence(close))
+        }
+        // The presentation markup, not the annotations.
+        "semantics" => {
+            let tex = children.iter().find(|child| {
+                child.is("annotation") && child.attr("encoding").is_some_and(|e| e.eq_ignore_ascii_case("application/x-tex"))
+            });
+            match tex {
+                Some(annotation) => annotation.text(),
+                None => element(children.first()?)?,
+            }
+        }
+        _ => return None,
+    })
+}
+
+// Appends a piece of LaTeX, with a space after a command such as \pi when the
+// piece starts with a letter, so that the two don't run together.
+fn push(out: &mut String, piece: &str) {
+    let command = out.rsplit('\\').next().is_some_and(|tail| {
+        out.contains('\\') && !tail.is_empty() && tail.chars().all(|c| c.is_ascii_alphabetic())
+    });
+    if command && piece.starts_with(|c: char| c.is_ascii_alphabetic()) {
+        out.push(' ');
+    }
+    out.push_str(piece);
+}
+
+// A base that already has a script is braced, since x^2^3 isn't valid.
+fn base(tex: String) -> String {
+    match tex.contains(['^', '_']) {
+        true => format!("{{{}}}", tex),
+        false => tex,
+    }
+}
+
+const FUNCTIONS: &[&str] = &[
+    "sin", "cos", "tan", "cot", "sec", "csc", "sinh", "cosh", "tanh", "log", "ln", "exp", "lim", "max", "min", "det",
+    "gcd", "arg", "deg",
+];
+
+fn identifier(text: &str) -> String {
+    if FUNCTIONS.contains(&text) {
+        return format!("\\{}", text);
+    }
+    match text.chars().count() {
+        0 | 1 => symbol(text),
+        _ => format!("\\mathrm{{{}}}", escape(text)),
+    }
+}
+
+fn operator(text: &str) -> String {
+    match text {
+        "{" | "}" => format!("\\{}", text),
+        _ => symbol(text),
+    }
+}
+
+fn fence(delimiter: &str) -> String {
+    match delimiter {
+        "" => ".".to_string(),
+        "{" | "}" => format!("\\{}", delimiter),
+        _ => delimiter.to_string(),
+    }
+}
+
+// Greek letters and operators as LaTeX commands; other characters as they are.
+fn symbol(text: &str) -> String {
+    let mut out = String::new();
+    for c in text.chars() {
+        let command = match c {
+            'α' => "\\alpha",
+            'β' => "\\beta",
+            'γ' => "\\gamma",
+            'δ' => "\\delta",
+            'ε' => "\\epsilon",
+            'θ' => "\\theta",
+            'λ' => "\\lambda",
+            'μ' => "\\mu",
+            'π' => "\\pi",
+            'ρ' => "\\rho",
+            'σ' => "\\sigma",
+            'τ' => "\\tau",
+            'φ' => "\\phi",
+            'ω' => "\\omega",
+            'Γ' => "\\Gamma",
+            'Δ' => "\\Delta",
+            'Σ' => "\\Sigma",
+            'Ω' => "\\Omega",
+            '±' => "\\pm",
+            '∓' => "\\mp",
+            '×' => "\\times",
+            '·' | '⋅' => "\\cdot",
+            '÷' => "\\div",
+            '−' => "-",
+            '≤' => "\\leq",
+            '≥' => "\\geq",
+            '≠' => "\\neq",
+            '≈' => "\\approx",
+            '∞' => "\\infty",
+            '→' => "\\to",
+            '∑' => "\\sum",
+            '∏' => "\\prod",
+            '∫' => "\\int",
+            '∂' => "\\partial",
+            '∈' => "\\in",
+            '…' => "\\ldots",
+            // Invisible times and function application.
+            '\u{2062}' | '\u{2061}' => "",
+            _ => {
+                out.push_str(&escape(&c.to_string()));
+                continue;
+            }
+        };
+        push(&mut out, command);
+    }
+    out
+}
+
+fn escape(text: &str) -> String {
+    let mut out = String::new();
+    for c in text.chars() {
+        match c {
+            '#' | '$' | '%' | '&' | '_' | '{' | '}' => {
+                out.push('\\');
+                out.push(c);
+            }
+            '\\' => out.push_str("\\backslash "),
+            _ => out.push(c),
+        }
+    }
+    out
+}
@@ -0,0 +1,121 @@
+use crate::guide;
+use crate::opf::Package;
+use epub::doc::EpubDoc;
+use std::collections::HashMap;
+use std::fmt;
+use std::io::{Read, Seek};
+use std::path::{Path, PathBuf};
+
+// Spine items around the text of the book rather than part of it: the cover,
+// title page, copyright page and HTML table of contents it opens with, and the
+// ads for other books it closes with.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Matter {
+    Front,
+    Back,
+}
+
+impl fmt::Display for Matter {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Matter::Front => f.write_str("front matter"),
+            Matter::Back => f.write_str("back matter"),
+        }
+    }
+}
+
+// Guide reference types (EPUB2) and landmark epub:types (EPUB3) of each kind.
+const FRONT_TYPES: &[&str] =
+    &["cover", "titlepage", "title-page", "halftitlepage", "copyright-page", "copyright", "imprint", "toc"];
+const BACK_TYPES: &[&str] = &["colophon", "advertisement", "ads"];
+
+// File names, lowercased and with everything but letters dropped, so that
+// "Title_Page01.xhtml" is "titlepage".
+const FRONT_NAMES: &[&str] =
+    &["cover", "frontcover", "title", "titlepage", "halftitle", "copyright", "imprint", "toc", "contents", "nav"];
+const BACK_NAMES: &[&str] = &[
+    "alsoby", "adcard", "ads", "advert", "advertisement", "otherbooks", "morebooks", "newsletter", "backad", "colophon",
+    "backcover",
+];
+
+// Sorts the front and back matter out of the spine, by manifest id. Front
+// matter is only looked for in the run of items the spine opens with, and
+// back matter in the run it closes with, so a "contents" page in the middle
+// of the book is left alone; the landmarks and guide are trusted before file
+// names. A spine that is front or back matter from end to end has none.
+// Items matching a `keep` pattern are left out of the result.
+pub(crate) fn classify<R: Read + Seek>(doc: &mut EpubDoc<R>, keep: &[String]) -> HashMap<String, Matter> {
+    let package = Package::load(doc).unwrap_or_default();
+    let mut types: HashMap<PathBuf, Vec<String>> = HashMap::new();
+    let landmarks = guide::landmarks(doc, &package);
+    for reference in package.guide.into_iter().chain(landmarks) {
+        types.entry(reference.path).or_default().push(reference.kind);
+    }
+    let kind = |idref: &String| -> Option<Matter> {
+        let (path, _) = doc.resources.get(idref)?;
+        if let Some(kinds) = types.get(path) {
+            if kinds.iter().any(|kind| FRONT_TYPES.contains(&kind.as_str())) {
+                return Some(Matter::Front);
+            }
+            if kinds.iter().any(|kind| BACK_TYPES.contains(&kind.as_str())) {
+                return Some(Matter::Back);
+            }
+        }
+        let stem = path.file_stem()?.to_string_lossy().to_lowercase();
+        let name: String = stem.chars().filter(char::is_ascii_alphabetic).collect();
+        if FRONT_NAMES.contains(&name.as_str()) {
+            Some(Matter::Front)
+        } else if BACK_NAMES.contains(&name.as_str()) {
+            Some(Matter::Back)
+        } else {
+            None
+        }
+    };
+    let front = doc.spine.iter().take_while(|idref| kind(idref) == Some(Matter::Front)).count();
+    let back = doc.spine.iter().rev().take_while(|idref| kind(idref) == Some(Matter::Back)).count();
+    if front == doc.spine.len() || back == doc.spine.len() {
+        return HashMap::new();
+    }
+    let front = doc.spine.iter().take(front).map(|idref| (idref.clone(), Matter::Front));
+    let back = doc.spine.iter().rev().take(back).map(|idref| (idref.clone(), Matter::Back));
+    let href = |idref: &str| -> String {
+        let path = doc.resources.get(idref).map_or(Path::new(idref), |(path, _)| path.as_path());
+        path.strip_prefix(&doc.root_base).unwrap_or(path).to_string_lossy().into_owned()
+    };
+    front.chain(back).filter(|(idref, _)| !kept(keep, idref, &href(idref))).collect()
+}
+
+// Whether a --keep pattern matches the item's manifest id or its href. `*`
+// matches any run of characters and `?` any one; case is ignored.
+fn kept(patterns: &[String], idref: &str, href: &str) -> bool {
+    patterns.iter().any(|pattern| glob(pattern, idref) || glob(pattern, href))
+}
+
+pub(crate) fn glob(pattern: &str, text: &str) -> bool {
+    let pattern: Vec<char> = pattern.to_lowercase().chars().collect();
+    let text: Vec<char> = text.to_lowercase().chars().collect();
+    // The position after the last `*` and the text position it was tried at,
+    // to backtrack to when the rest stops matching.
+    let (mut p, mut t, mut star) = (0, 0, None);
+    while t < text.len() {
+        match pattern.get(p) {
+            Some('*') => {
+                star = Some((p + 1, t));
+                p += 1;
+            }
+            Some(c) if *c == '?' || *c == text[t] => {
+                p += 1;
+                t += 1;
+            }
+            _ => match star {
+                Some((after, tried)) => {
+                    p = after;
+                    t = tried + 1;
+                    star = Some((after, tried + 1));
+                }
+                None => return false,
+            },
+        }
+    }
+    pattern[p..].iter().all(|c| *c == '*')
+}
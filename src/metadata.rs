@@ -0,0 +1,168 @@
+use crate::direction::{language_direction, Direction};
+use crate::opf::Package;
+use epub::doc::EpubDoc;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::fmt;
+use std::io::{Read, Seek};
+use std::str::FromStr;
+
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct Metadata {
+    pub title: Option<String>,
+    #[serde(rename = "authors")]
+    pub creators: Vec<String>,
+    pub language: Option<String>,
+    pub identifiers: Vec<String>,
+    pub publisher: Option<String>,
+    pub date: Option<String>,
+    pub description: Option<String>,
+    /// Which way the book's text runs: the spine's page-progression-direction,
+    /// or right to left for a language written that way. None for a book
+    /// that says neither, which is read left to right.
+    pub direction: Option<Direction>,
+}
+
+impl Metadata {
+    pub(crate) fn from_map(map: &HashMap<String, Vec<String>>) -> Self {
+        let first = |key: &str| all(map, key).into_iter().next();
+        let direction = first("language").map(|language| language_direction(&language));
+        Metadata {
+            title: first("title"),
+            creators: all(map, "creator"),
+            language: first("language"),
+            identifiers: all(map, "identifier"),
+            publisher: first("publisher"),
+            date: first("date"),
+            description: first("description"),
+            direction: direction.filter(|direction| *direction == Direction::Rtl),
+        }
+    }
+
+    // The book's metadata along with the direction its spine declares.
+    pub(crate) fn load<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Metadata {
+        let metadata = Metadata::from_map(&doc.metadata);
+        match Package::load(doc).ok().and_then(|package| package.direction) {
+            Some(direction) => Metadata { direction: Some(direction), ..metadata },
+            None => metadata,
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        *self == Metadata::default()
+    }
+
+    // Renders a `---` delimited YAML block, omitting fields the book leaves empty.
+    pub fn front_matter(&self) -> String {
+        let mut yaml = String::from("---\n");
+        push_field(&mut yaml, "title", &self.title);
+        push_list(&mut yaml, "creator", &self.creators);
+        push_field(&mut yaml, "language", &self.language);
+        push_field(&mut yaml, "direction", &self.direction.map(|direction| direction.to_string()));
+        push_field(&mut yaml, "publisher", &self.publisher);
+        push_field(&mut yaml, "date", &self.date);
+        push_list(&mut yaml, "identifier", &self.identifiers);
+        push_field(&mut yaml, "description", &self.description);
+        yaml.push_str("---\n");
+        yaml
+    }
+
+    // Pandoc's `%` title block: the title, the authors separated by
+    // semicolons and the date, one to a line. A missing field leaves its line
+    // as a bare `%`, and the lines after the last field are left out.
+    pub fn title_block(&self) -> String {
+        let creators = Some(self.creators.join("; ")).filter(|creators| !creators.is_empty());
+        let mut lines = vec![self.title.as_deref(), creators.as_deref(), self.date.as_deref()];
+        while lines.last().is_some_and(Option::is_none) {
+            lines.pop();
+        }
+        lines
+            .into_iter()
+            .map(|line| match line {
+                Some(value) => format!("% {}\n", value),
+                None => "%\n".to_string(),
+            })
+            .collect()
+    }
+
+    // The metadata block `format` asks for.
+    pub fn header(&self, format: MetadataFormat) -> String {
+        match format {
+            MetadataFormat::Yaml => self.front_matter(),
+            MetadataFormat::Pandoc => self.title_block(),
+        }
+    }
+
+    // Pretty-printed JSON with every field present; missing scalars are null.
+    pub fn to_json(&self) -> String {
+        serde_json::to_string_pretty(self).expect("metadata always serializes")
+    }
+}
+
+// How the book's metadata is written at the top of the markdown.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum MetadataFormat {
+    /// A `---` delimited YAML front matter block.
+    #[default]
+    Yaml,
+    /// A Pandoc title block, which only has room for the title, authors and
+    /// date.
+    Pandoc,
+}
+
+impl FromStr for MetadataFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "yaml" => Ok(MetadataFormat::Yaml),
+            "pandoc" => Ok(MetadataFormat::Pandoc),
+            _ => Err(format!("invalid metadata format {} (expected yaml or pandoc)", s)),
+        }
+    }
+}
+
+impl fmt::Display for MetadataFormat {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            MetadataFormat::Yaml => f.write_str("yaml"),
+            MetadataFormat::Pandoc => f.write_str("pandoc"),
+        }
+    }
+}
+
+pub(crate) fn all(map: &HashMap<String, Vec<String>>, key: &str) -> Vec<String> {
+    map.get(key)
+        .map(|values| {
+            values
+                .iter()
+                .map(|v| v.split_whitespace().collect::<Vec<_>>().join(" "))
+                .filter(|v| !v.is_empty())
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+fn push_field(yaml: &mut String, key: &str, value: &Option<String>) {
+    if let Some(value) = value {
+        yaml.push_str(&format!("{}: {}\n", key, yaml_string(value)));
+    }
+}
+
+// A single value is written as a scalar, several as a list.
+fn push_list(yaml: &mut String, key: &str, values: &[String]) {
+    match values {
+        [] => {}
+        [value] => push_field(yaml, key, &Some(value.clone())),
+        values => {
+            yaml.push_str(&format!("{}:\n", key));
+            for value in values {
+                yaml.push_str(&format!("  - {}\n", yaml_string(value)));
+            }
+        }
+    }
+}
+
+fn yaml_string(value: &str) -> String {
+    format!("\"{}\"", value.replace('\\', "\\\\").replace('"', "\\\""))
+}
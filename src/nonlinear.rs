@@ -0,0 +1,40 @@
+use std::fmt;
+use std::str::FromStr;
+
+// What to do with the spine items a book marks linear="no": content outside
+// the reading order, such as answer keys, pop-up notes and full-size image
+// pages, which readers only open from a link.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Nonlinear {
+    /// Convert them after the rest of the book, under an Appendix heading
+    /// when the book is one document.
+    #[default]
+    Appendix,
+    /// Convert them in their place in the spine, like any other item.
+    Include,
+    /// Leave them out, logging them at info level.
+    Drop,
+}
+
+impl FromStr for Nonlinear {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "appendix" => Ok(Nonlinear::Appendix),
+            "include" => Ok(Nonlinear::Include),
+            "drop" => Ok(Nonlinear::Drop),
+            _ => Err(format!("invalid non-linear item policy {} (expected appendix, include or drop)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Nonlinear {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Nonlinear::Appendix => f.write_str("appendix"),
+            Nonlinear::Include => f.write_str("include"),
+            Nonlinear::Drop => f.write_str("drop"),
+        }
+    }
+}
@@ -0,0 +1,85 @@
+use std::fmt;
+use std::str::FromStr;
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum LineEnding {
+    #[default]
+    Lf,
+    Crlf,
+}
+
+impl LineEnding {
+    fn as_str(self) -> &'static str {
+        match self {
+            LineEnding::Lf => "\n",
+            LineEnding::Crlf => "\r\n",
+        }
+    }
+}
+
+impl FromStr for LineEnding {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "lf" => Ok(LineEnding::Lf),
+            "crlf" => Ok(LineEnding::Crlf),
+            _ => Err(format!("invalid line ending {} (expected lf or crlf)", s)),
+        }
+    }
+}
+
+impl fmt::Display for LineEnding {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LineEnding::Lf => f.write_str("lf"),
+            LineEnding::Crlf => f.write_str("crlf"),
+        }
+    }
+}
+
+// Tidies markdown for linters: CRLF and lone CR become `line_ending`, trailing
+// whitespace is stripped, runs of blank lines collapse to one and the text ends
+// with exactly one line ending. A hard line break keeps its two trailing
+// spaces, and fenced code only has its line endings changed. Idempotent, so it
+// can be run on each chapter and again on the document they're joined into.
+pub fn normalize(markdown: &str, line_ending: LineEnding) -> String {
+    let text = markdown.replace("\r\n", "\n").replace('\r', "\n");
+    let lines: Vec<&str> = text.split('\n').collect();
+    let mut out: Vec<String> = Vec::with_capacity(lines.len());
+    let mut in_fence = false;
+    for (i, line) in lines.iter().enumerate() {
+        let trimmed = line.trim_start();
+        let fence = trimmed.starts_with("```") || trimmed.starts_with("~~~");
+        if in_fence && !fence {
+            out.push(line.to_string());
+            continue;
+        }
+        if fence {
+            in_fence = !in_fence;
+        }
+        let stripped = line.trim_end();
+        if stripped.is_empty() {
+            // Blank lines before the first line and after another blank line go.
+            if out.last().is_some_and(|last| !last.is_empty()) {
+                out.push(String::new());
+            }
+            continue;
+        }
+        let next_blank = lines.get(i + 1).is_none_or(|next| next.trim().is_empty());
+        match line.ends_with("  ") && !fence && !next_blank {
+            true => out.push(format!("{}  ", stripped)),
+            false => out.push(stripped.to_string()),
+        }
+    }
+    while out.last().is_some_and(|last| last.is_empty()) {
+        out.pop();
+    }
+    if out.is_empty() {
+        return String::new();
+    }
+    let eol = line_ending.as_str();
+    let mut normalized = out.join(eol);
+    normalized.push_str(eol);
+    normalized
+}
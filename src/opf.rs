@@ -0,0 +1,257 @@
+use crate::direction::Direction;
+use crate::dom::{self, Element};
+use crate::encoding;
+use crate::guide::{GuideRef, GuideSource};
+use crate::href;
+use crate::toc;
+use anyhow::Result;
+use epub::doc::EpubDoc;
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::io::{Read, Seek};
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+pub(crate) const CONTAINER: &str = "META-INF/container.xml";
+
+// The parts of the OPF package document that the epub crate doesn't expose.
+#[derive(Debug, Clone, Default)]
+pub(crate) struct Package {
+    pub manifest: Vec<ManifestItem>,
+    /// Manifest ids in reading order.
+    pub spine: Vec<String>,
+    /// Spine items marked linear="no": auxiliary content such as pop-up notes
+    /// that isn't part of the reading order.
+    pub nonlinear: HashSet<String>,
+    /// The EPUB2 guide's references, e.g. of type toc for OEBPS/toc.xhtml.
+    pub guide: Vec<GuideRef>,
+    /// The manifest id of the NCX, from the spine's toc attribute.
+    pub toc_id: Option<String>,
+    /// The spine's page-progression-direction, when it's ltr or rtl rather
+    /// than default.
+    pub direction: Option<Direction>,
+    /// Dublin Core elements by local name plus `<meta name content>` pairs,
+    /// keyed the same way as the epub crate's metadata map.
+    pub metadata: HashMap<String, Vec<String>>,
+}
+
+#[derive(Debug, Clone)]
+pub(crate) struct ManifestItem {
+    pub id: String,
+    /// Normalized path of the item inside the archive.
+    pub path: PathBuf,
+    pub media_type: String,
+    pub properties: Vec<String>,
+}
+
+impl Package {
+    pub(crate) fn load<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Result<Package> {
+        let root_file = doc.root_file.clone();
+        Package::load_path(doc, &root_file)
+    }
+
+    pub(crate) fn load_path<R: Read + Seek>(doc: &mut EpubDoc<R>, root_file: &Path) -> Result<Package> {
+        let bytes = doc
+            .get_resource_by_path(root_file)
+            .map_err(|e| anyhow::anyhow!("Failed to read {}: {}", root_file.display(), e))?;
+        Ok(Package::parse(&String::from_utf8_lossy(&bytes), root_file))
+    }
+
+    pub(crate) fn parse(xml: &str, root_file: &Path) -> Package {
+        let mut package = Package::default();
+        let nodes = dom::parse(xml);
+        dom::walk(&nodes, &mut |el| {
+            if el.is("item") {
+                if let (Some(id), Some(href)) = (el.attr("id"), el.attr("href")) {
+                    package.manifest.push(ManifestItem {
+                        id: id.to_string(),
+                        path: href::resolve(root_file, href).unwrap_or_default(),
+                        media_type: el.attr("media-type").unwrap_or_default().to_string(),
+                        properties: split_list(el, "properties"),
+                    });
+                }
+            } else if el.is("spine") {
+                package.toc_id = el.attr("toc").map(String::from);
+                package.direction = el.attr("page-progression-direction").and_then(|dir| dir.parse().ok());
+            } else if el.is("itemref") {
+                if let Some(idref) = el.attr("idref") {
+                    if el.attr("linear").is_some_and(|linear| linear.trim() == "no") {
+                        package.nonlinear.insert(idref.to_string());
+                    }
+                    package.spine.push(idref.to_string());
+                }
+            } else if el.is("reference") {
+                if let (Some(kind), Some(target)) = (el.attr("type"), el.attr("href")) {
+                    let title = el.attr("title").unwrap_or_default();
+                    package.guide.extend(GuideRef::new(kind, title, target, root_file, GuideSource::Guide));
+                }
+            } else if el.is("metadata") {
+                collect_metadata(el, &mut package.metadata);
+            }
+        });
+        package
+    }
+
+    pub(crate) fn item_with_property(&self, property: &str) -> Option<&ManifestItem> {
+        self.manifest.iter().find(|item| item.properties.iter().any(|p| p == property))
+    }
+}
+
+// The spine items marked linear="no", which the epub crate doesn't keep. A
+// package that can't be read has none.
+pub(crate) fn nonlinear<R: Read + Seek>(doc: &mut EpubDoc<R>) -> HashSet<String> {
+    Package::load(doc).map(|package| package.nonlinear).unwrap_or_default()
+}
+
+fn collect_metadata(metadata: &Element, map: &mut HashMap<String, Vec<String>>) {
+    dom::walk(&metadata.children, &mut |el| {
+        let (key, value) = if el.name.starts_with("dc:") {
+            (el.local_name().to_string(), el.text())
+        } else if el.is("meta") {
+            match (el.attr("name"), el.attr("content"), el.attr("property")) {
+                (Some(name), Some(content), _) => (name.to_string(), content.to_string()),
+                (_, _, Some(property)) => (property.to_string(), el.text()),
+                _ => return,
+            }
+        } else {
+            return;
+        };
+        map.entry(key).or_default().push(value);
+    });
+}
+
+fn split_list(el: &Element, attr: &str) -> Vec<String> {
+    el.attr(attr)
+        .map(|v| v.split_whitespace().map(String::from).collect())
+        .unwrap_or_default()
+}
+
+// Points the document at another package document. The epub crate only reads
+// the first rootfile, so the fields it filled in are replaced from our own
+// parse of the selected OPF.
+pub(crate) fn switch_rootfile<R: Read + Seek>(doc: &mut EpubDoc<R>, root_file: &Path) -> Result<()> {
+    let package = Package::load_path(doc, root_file)?;
+    let ncx = package
+        .toc_id
+        .as_ref()
+        .and_then(|id| package.manifest.iter().find(|item| item.id == *id))
+        .map(|item| item.path.clone());
+    doc.toc = match ncx {
+        Some(path) => match doc.get_resource_by_path(&path) {
+            Ok(bytes) => toc::parse_ncx(&encoding::decode(&bytes), &path),
+            Err(_) => Vec::new(),
+        },
+        None => Vec::new(),
+    };
+    doc.root_file = root_file.to_path_buf();
+    doc.root_base = root_file.parent().unwrap_or(Path::new("")).to_path_buf();
+    doc.resources = package
+        .manifest
+        .iter()
+        .map(|item| (item.id.clone(), (item.path.clone(), item.media_type.clone())))
+        .collect();
+    doc.spine = package.spine;
+    doc.cover_id = package.metadata.get("cover").and_then(|ids| ids.first().cloned());
+    doc.metadata = package.metadata;
+    Ok(())
+}
+
+// A rootfile listed in META-INF/container.xml. Books can ship several
+// renditions of the same content, each with its own package document.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Rootfile {
+    pub full_path: String,
+    pub media_type: String,
+    /// The multiple-renditions attributes describing the rendition, such as
+    /// rendition:label="Large print" or rendition:layout="pre-paginated".
+    pub label: Option<String>,
+    pub layout: Option<String>,
+    pub media: Option<String>,
+}
+
+impl Rootfile {
+    // How the rendition is listed in warnings and errors, e.g.
+    // "large/package.opf (Large print, reflowable)".
+    pub(crate) fn describe(&self) -> String {
+        let details: Vec<&str> =
+            [&self.label, &self.layout, &self.media].into_iter().flatten().map(String::as_str).collect();
+        match details.is_empty() {
+            true => self.full_path.clone(),
+            false => format!("{} ({})", self.full_path, details.join(", ")),
+        }
+    }
+}
+
+pub(crate) fn rootfiles<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Result<Vec<Rootfile>> {
+    let bytes = doc
+        .get_resource_by_path(CONTAINER)
+        .map_err(|e| anyhow::anyhow!("Failed to read {}: {}", CONTAINER, e))?;
+    Ok(parse_rootfiles(&String::from_utf8_lossy(&bytes)))
+}
+
+pub(crate) fn parse_rootfiles(xml: &str) -> Vec<Rootfile> {
+    let mut rootfiles = Vec::new();
+    dom::walk(&dom::parse(xml), &mut |el| {
+        if el.is("rootfile") {
+            if let Some(full_path) = el.attr("full-path") {
+                let rendition = |name: &str| el.attr(&format!("rendition:{}", name)).map(String::from);
+                rootfiles.push(Rootfile {
+                    full_path: full_path.to_string(),
+                    media_type: el.attr("media-type").unwrap_or_default().to_string(),
+                    label: rendition("label"),
+                    layout: rendition("layout"),
+                    media: rendition("media"),
+                });
+            }
+        }
+    });
+    rootfiles
+}
+
+// Selects a rendition by its position in container.xml (counting from 1), by
+// its full-path, or by its rendition:label, layout or media.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Rendition {
+    Index(usize),
+    Path(String),
+    /// Matched case-insensitively against the label, then the layout
+    /// ("reflowable", "pre-paginated"), then the media query.
+    Name(String),
+}
+
+impl FromStr for Rendition {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.parse::<usize>() {
+            Ok(0) => Err("renditions are numbered from 1".to_string()),
+            Ok(n) => Ok(Rendition::Index(n)),
+            Err(_) if s.contains('/') || s.ends_with(".opf") => Ok(Rendition::Path(s.to_string())),
+            Err(_) => Ok(Rendition::Name(s.to_string())),
+        }
+    }
+}
+
+impl fmt::Display for Rendition {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Rendition::Index(n) => write!(f, "{}", n),
+            Rendition::Path(path) | Rendition::Name(path) => f.write_str(path),
+        }
+    }
+}
+
+impl Rendition {
+    pub(crate) fn find<'a>(&self, rootfiles: &'a [Rootfile]) -> Option<&'a Rootfile> {
+        match self {
+            Rendition::Index(n) => n.checked_sub(1).and_then(|i| rootfiles.get(i)),
+            Rendition::Path(path) => rootfiles.iter().find(|rootfile| rootfile.full_path == *path),
+            Rendition::Name(name) => {
+                let matches = |value: &Option<String>| value.as_ref().is_some_and(|v| v.eq_ignore_ascii_case(name));
+                (rootfiles.iter().find(|rootfile| matches(&rootfile.label)))
+                    .or_else(|| rootfiles.iter().find(|rootfile| matches(&rootfile.layout)))
+                    .or_else(|| rootfiles.iter().find(|rootfile| matches(&rootfile.media)))
+            }
+        }
+    }
+}
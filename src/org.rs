@@ -0,0 +1,353 @@
+use crate::metadata::Metadata;
+use pulldown_cmark::{CodeBlockKind, Event, Options, Parser, Tag, TagEnd};
+
+// Turns the converted book into an Emacs Org document: the metadata as
+// #+TITLE and other keywords, headings as asterisks, fenced code as
+// #+BEGIN_SRC blocks, links as [[target][description]], pipe tables as Org
+// tables and footnotes as [fn:1]. The markdown should be converted with
+// `Options::heading_ids`, whose ids become the headings' CUSTOM_ID, which
+// [[#id]] links point at, and without front matter, which the keywords
+// replace. HTML kept in the markdown goes into #+BEGIN_EXPORT html blocks.
+pub fn to_org(metadata: &Metadata, markdown: &str) -> String {
+    let mut writer = Writer::default();
+    let keywords = [
+        ("TITLE", metadata.title.clone()),
+        ("AUTHOR", Some(metadata.creators.join(", ")).filter(|authors| !authors.is_empty())),
+        ("DATE", metadata.date.clone()),
+        ("LANGUAGE", metadata.language.clone()),
+        ("DESCRIPTION", metadata.description.clone()),
+    ];
+    for (keyword, value) in keywords {
+        if let Some(value) = value.map(|value| value.split_whitespace().collect::<Vec<_>>().join(" ")) {
+            if !value.is_empty() {
+                writer.out.push_str(&format!("#+{}: {}\n", keyword, value));
+            }
+        }
+    }
+    let options = Options::ENABLE_TABLES
+        | Options::ENABLE_FOOTNOTES
+        | Options::ENABLE_STRIKETHROUGH
+        | Options::ENABLE_HEADING_ATTRIBUTES
+        | Options::ENABLE_DEFINITION_LIST;
+    for event in Parser::new_ext(markdown, options) {
+        writer.event(event);
+    }
+    let mut out = writer.out.trim_end().to_string();
+    out.push('\n');
+    out
+}
+
+#[derive(Default)]
+struct Writer {
+    out: String,
+    /// The width of the marker of each list item being written, whose
+    /// continuation lines are indented by all of them.
+    indents: Vec<usize>,
+    /// The number of the next item of each list being written, None for
+    /// bulleted lists.
+    lists: Vec<Option<u64>>,
+    /// Right after a list item's marker or a footnote's label, where its
+    /// first block goes on the same line.
+    after_marker: bool,
+    /// The id of the heading being written, for its property drawer.
+    heading_id: Option<String>,
+    /// The line that ends the code block being written.
+    code_end: Option<&'static str>,
+    /// Inside an image, whose alt text isn't written.
+    in_image: bool,
+    table: Table,
+}
+
+#[derive(Default)]
+struct Table {
+    rows: Vec<Vec<String>>,
+    /// Where the current cell's text starts in `out`.
+    cell_start: usize,
+    header_rows: usize,
+}
+
+impl Writer {
+    fn event(&mut self, event: Event) {
+        match event {
+            Event::Start(tag) => self.start(tag),
+            Event::End(tag) => self.end(tag),
+            Event::Text(text) if self.code_end.is_some() => {
+                let indent = self.indent();
+                for line in text.split_inclusive('\n') {
+                    if self.out.ends_with('\n') {
+                        self.out.push_str(&indent);
+                        // Lines that Org would read as a heading or a keyword.
+                        if line.starts_with('*') || line.starts_with("#+") {
+                            self.out.push(',');
+                        }
+                    }
+                    self.out.push_str(line);
+                }
+            }
+            Event::Text(_) if self.in_image => {}
+            Event::Text(text) => self.out.push_str(&text),
+            Event::Code(code) => self.out.push_str(&format!("~{}~", code)),
+            Event::InlineHtml(html) | Event::InlineMath(html) => self.out.push_str(&format!("@@html:{}@@", html)),
+            Event::Html(html) | Event::DisplayMath(html) => self.out.push_str(&html),
+            Event::FootnoteReference(label) => self.out.push_str(&format!("[fn:{}]", label)),
+            Event::SoftBreak => self.line(),
+            Event::HardBreak => {
+                self.out.push_str("\\\\");
+                self.line();
+            }
+            Event::Rule => {
+                self.block();
+                self.out.push_str("-----");
+            }
+            Event::TaskListMarker(done) => self.out.push_str(if done { "[X] " } else { "[ ] " }),
+        }
+    }
+
+    fn start(&mut self, tag: Tag) {
+        match tag {
+            Tag::Paragraph => self.block(),
+            Tag::Heading { level, id, .. } => {
+                self.block();
+                self.out.push_str(&"*".repeat(level as usize));
+                self.out.push(' ');
+                self.heading_id = id.map(|id| id.to_string());
+            }
+            Tag::BlockQuote(_) => {
+                self.block();
+                self.out.push_str("#+BEGIN_QUOTE\n");
+                self.out.push_str(&self.indent());
+                self.after_marker = true;
+            }
+            Tag::CodeBlock(kind) => {
+                self.block();
+                let language = match &kind {
+                    CodeBlockKind::Fenced(info) => info.split_whitespace().next().unwrap_or_default(),
+                    CodeBlockKind::Indented => "",
+                };
+                // A source block needs a language; without one it's an example.
+                self.code_end = match language.is_empty() {
+                    true => {
+                        self.out.push_str("#+BEGIN_EXAMPLE\n");
+                        Some("#+END_EXAMPLE")
+                    }
+                    false => {
+                        self.out.push_str(&format!("#+BEGIN_SRC {}\n", language));
+                        Some("#+END_SRC")
+                    }
+                };
+            }
+            Tag::HtmlBlock => {
+                self.block();
+                self.out.push_str("#+BEGIN_EXPORT html\n");
+            }
+            Tag::List(start) => self.start_list(start),
+            // Org's description lists: `- term :: definition`.
+            Tag::DefinitionList => self.start_list(None),
+            Tag::DefinitionListTitle => {
+                if !self.after_marker {
+                    self.start_line();
+                }
+                self.out.push_str(&self.indent());
+                self.out.push_str("- ");
+                self.after_marker = false;
+            }
+            Tag::DefinitionListDefinition => {
+                // A term's second definition is a paragraph of its own.
+                match self.out.ends_with(" ::") {
+                    true => self.out.push(' '),
+                    false => {
+                        self.start_line();
+                        self.out.push('\n');
+                        self.out.push_str(&self.indent());
+                        self.out.push_str("  ");
+                    }
+                }
+                self.indents.push(2);
+                self.after_marker = true;
+            }
+            Tag::Item => {
+                if !self.after_marker {
+                    self.start_line();
+                }
+                self.out.push_str(&self.indent());
+                let marker = match self.lists.last_mut() {
+                    Some(Some(number)) => {
+                        *number += 1;
+                        format!("{}. ", *number - 1)
+                    }
+                    _ => "- ".to_string(),
+                };
+                self.out.push_str(&marker);
+                self.indents.push(marker.len());
+                self.after_marker = true;
+            }
+            Tag::FootnoteDefinition(label) => {
+                self.block();
+                self.out.push_str(&format!("[fn:{}] ", label));
+                self.after_marker = true;
+            }
+            Tag::Table(_) => {
+                self.block();
+                self.table = Table::default();
+            }
+            Tag::TableHead | Tag::TableRow => self.table.rows.push(Vec::new()),
+            Tag::TableCell => self.table.cell_start = self.out.len(),
+            Tag::Emphasis => self.out.push('/'),
+            Tag::Strong => self.out.push('*'),
+            Tag::Strikethrough => self.out.push('+'),
+            Tag::Link { dest_url, .. } => self.out.push_str(&format!("[[{}][", target(&dest_url))),
+            Tag::Image { dest_url, .. } => {
+                self.out.push_str(&format!("[[{}]]", target(&dest_url)));
+                self.in_image = true;
+            }
+            _ => {}
+        }
+    }
+
+    fn end(&mut self, tag: TagEnd) {
+        match tag {
+            TagEnd::Heading(_) => {
+                if let Some(id) = self.heading_id.take() {
+                    self.out.push_str(&format!("\n:PROPERTIES:\n:CUSTOM_ID: {}\n:END:", id));
+                }
+            }
+            TagEnd::BlockQuote(_) => {
+                self.start_line();
+                self.out.push_str("#+END_QUOTE");
+            }
+            TagEnd::CodeBlock => {
+                let end = self.code_end.take().unwrap_or_default();
+                self.start_line();
+                self.out.push_str(&self.indent());
+                self.out.push_str(end);
+            }
+            TagEnd::HtmlBlock => {
+                self.start_line();
+                self.out.push_str("#+END_EXPORT");
+            }
+            TagEnd::List(_) | TagEnd::DefinitionList => {
+                self.lists.pop();
+                self.after_marker = false;
+            }
+            TagEnd::DefinitionListTitle => self.out.push_str(" ::"),
+            TagEnd::DefinitionListDefinition => {
+                self.indents.pop();
+                self.after_marker = false;
+            }
+            TagEnd::Item => {
+                self.indents.pop();
+                self.after_marker = false;
+            }
+            TagEnd::FootnoteDefinition => self.after_marker = false,
+            TagEnd::TableCell => {
+                let cell = self.out.split_off(self.table.cell_start);
+                let cell = cell.split_whitespace().collect::<Vec<_>>().join(" ").replace('|', "\\vert{}");
+                if let Some(row) = self.table.rows.last_mut() {
+                    row.push(cell);
+                }
+            }
+            TagEnd::TableHead => self.table.header_rows = self.table.rows.len(),
+            TagEnd::Table => {
+                let table = std::mem::take(&mut self.table);
+                self.out.push_str(&table.render(&self.indent()));
+            }
+            TagEnd::Emphasis => self.out.push('/'),
+            TagEnd::Strong => self.out.push('*'),
+            TagEnd::Strikethrough => self.out.push('+'),
+            TagEnd::Link => match self.out.strip_suffix("][") {
+                // A link without a description.
+                Some(link) => {
+                    let len = link.len();
+                    self.out.truncate(len);
+                    self.out.push_str("]]");
+                }
+                None => self.out.push_str("]]"),
+            },
+            TagEnd::Image => self.in_image = false,
+            _ => {}
+        }
+    }
+
+    fn start_list(&mut self, start: Option<u64>) {
+        // A nested list starts on the line after its item's text.
+        match self.lists.is_empty() {
+            true => {
+                self.block();
+                self.after_marker = true;
+            }
+            false => self.after_marker = false,
+        }
+        self.lists.push(start);
+    }
+
+    // Starts a block: after a blank line, indented under the list item it
+    // belongs to, or on the line of the marker it follows.
+    fn block(&mut self) {
+        if std::mem::take(&mut self.after_marker) || self.out.is_empty() {
+            return;
+        }
+        self.start_line();
+        self.out.push('\n');
+        self.out.push_str(&self.indent());
+    }
+
+    // Ends the line being written, if any, without trailing spaces.
+    fn start_line(&mut self) {
+        let len = self.out.trim_end_matches([' ', '\n']).len();
+        self.out.truncate(len);
+        if !self.out.is_empty() {
+            self.out.push('\n');
+        }
+    }
+
+    fn line(&mut self) {
+        self.out.push('\n');
+        self.out.push_str(&self.indent());
+    }
+
+    fn indent(&self) -> String {
+        " ".repeat(self.indents.iter().sum())
+    }
+}
+
+impl Table {
+    // The rows with their cells padded to the width of their column, and a
+    // rule under the header.
+    fn render(&self, indent: &str) -> String {
+        let columns = self.rows.iter().map(Vec::len).max().unwrap_or(0);
+        let mut widths = vec![1; columns];
+        for row in &self.rows {
+            for (width, cell) in widths.iter_mut().zip(row) {
+                *width = (*width).max(cell.chars().count());
+            }
+        }
+        let mut lines = Vec::new();
+        for (i, row) in self.rows.iter().enumerate() {
+            let cells: Vec<String> = widths
+                .iter()
+                .enumerate()
+                .map(|(column, width)| {
+                    let cell = row.get(column).map(String::as_str).unwrap_or_default();
+                    format!("{}{}", cell, " ".repeat(width - cell.chars().count()))
+                })
+                .collect();
+            lines.push(format!("{}| {} |", indent, cells.join(" | ")));
+            if i + 1 == self.header_rows {
+                let rules: Vec<String> = widths.iter().map(|width| "-".repeat(width + 2)).collect();
+                lines.push(format!("{}|{}|", indent, rules.join("+")));
+            }
+        }
+        lines.join("\n").trim_start().to_string()
+    }
+}
+
+// A link target as Org reads it. Relative paths need file:, or Org would
+// search the document for a heading with that text; links to ids, which are
+// CUSTOM_IDs here, and URLs stay as they are.
+fn target(url: &str) -> String {
+    if url.starts_with('#') || url.contains("://") || url.starts_with("mailto:") || url.starts_with("data:") {
+        url.to_string()
+    } else {
+        format!("file:{}", url)
+    }
+}
@@ -0,0 +1,189 @@
+use crate::dom::{self, Element, Node};
+use crate::encoding;
+use crate::href;
+use crate::opf::Package;
+use epub::doc::EpubDoc;
+use serde::Serialize;
+use std::io::{Read, Seek};
+use std::path::Path;
+
+// What a page marker is written as by default, with {page} standing for the
+// page number: an HTML comment, which renderers don't show.
+pub const DEFAULT_PAGE_MARKER: &str = "<!-- page {page} -->";
+
+// Takes out the page breaks print-based books mark with epub:type="pagebreak"
+// or role="doc-pagebreak", whose page numbers would otherwise run into the
+// text. With a `marker`, each break that gives its number, in its title or
+// aria-label or as its text, leaves a placeholder holding the marker with
+// the number in place of {page}, which `restore` puts back after conversion.
+// A break in a block of its own, such as a <div> or <hr>, becomes a
+// paragraph of its own; one in a line of text, a <span> or <a>, stays there.
+pub(crate) fn mark(nodes: &mut Vec<Node>, marker: Option<&str>) -> Vec<(String, String)> {
+    let mut pages = Vec::new();
+    mark_in(nodes, marker, &mut pages);
+    pages
+}
+
+fn mark_in(nodes: &mut Vec<Node>, marker: Option<&str>, pages: &mut Vec<(String, String)>) {
+    let mut out = Vec::with_capacity(nodes.len());
+    for node in std::mem::take(nodes) {
+        match node {
+            Node::Element(el) if is_page_break(&el) => {
+                let (Some(marker), Some(number)) = (marker, page_number(&el)) else {
+                    continue;
+                };
+                let placeholder = format!("CIPHERPAGE{}X", pages.len());
+                pages.push((placeholder.clone(), marker.replace("{page}", &number)));
+                match el.is("span") || el.is("a") {
+                    true => out.push(Node::Text(placeholder)),
+                    false => {
+                        let mut paragraph = Element::new("p");
+                        paragraph.children.push(Node::Text(placeholder));
+                        out.push(Node::Element(paragraph));
+                    }
+                }
+            }
+            Node::Element(mut el) => {
+                mark_in(&mut el.children, marker, pages);
+                out.push(Node::Element(el));
+            }
+            node => out.push(node),
+        }
+    }
+    *nodes = out;
+}
+
+fn is_page_break(el: &Element) -> bool {
+    let has = |attr: &str, value: &str| el.attr(attr).is_some_and(|v| v.split_whitespace().any(|v| v == value));
+    has("epub:type", "pagebreak") || has("role", "doc-pagebreak")
+}
+
+// The number the break gives its page, without a leading "Page" as in
+// aria-label="Page 42".
+fn page_number(el: &Element) -> Option<String> {
+    let text = el.text();
+    let label = [el.attr("title"), el.attr("aria-label"), Some(text.as_str())]
+        .into_iter()
+        .flatten()
+        .map(str::trim)
+        .find(|label| !label.is_empty())?;
+    let number = match label.get(..4) {
+        Some(word) if word.eq_ignore_ascii_case("page") => label[4..].trim_start(),
+        _ => label,
+    };
+    Some(number.split_whitespace().collect::<Vec<_>>().join(" ")).filter(|number| !number.is_empty())
+}
+
+// Puts the markers in place of their placeholders. A break inside a word,
+// as books whose print edition hyphenated it across two pages have, is moved
+// to the end of the word, so that the marker doesn't split it.
+pub(crate) fn restore(markdown: &str, pages: &[(String, String)]) -> String {
+    let mut markdown = markdown.to_string();
+    for (placeholder, marker) in pages {
+        let mut out = String::with_capacity(markdown.len());
+        let mut rest = markdown.as_str();
+        while let Some(start) = rest.find(placeholder.as_str()) {
+            out.push_str(&rest[..start]);
+            rest = &rest[start + placeholder.len()..];
+            let in_word = out.ends_with(char::is_alphanumeric) && rest.starts_with(char::is_alphanumeric);
+            if in_word {
+                let end = rest.find(|c: char| !c.is_alphanumeric()).unwrap_or(rest.len());
+                out.push_str(&rest[..end]);
+                rest = &rest[end..];
+            }
+            out.push_str(marker);
+        }
+        out.push_str(rest);
+        markdown = out;
+    }
+    markdown
+}
+
+// A chapter title taken while the page markers were hidden, without them,
+// since a title is plain text.
+pub(crate) fn strip_text(title: &str, pages: &[(String, String)]) -> String {
+    let mut title = title.to_string();
+    for (placeholder, _) in pages {
+        title = title.replace(placeholder, "");
+    }
+    title.split_whitespace().collect::<Vec<_>>().join(" ")
+}
+
+// An entry of the book's page list, which maps the page numbers of the print
+// edition to the places in the book where those pages start. EPUB3 books
+// list them in the navigation document's <nav epub:type="page-list">, and
+// EPUB2 books in the NCX's <pageList>.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct PageTarget {
+    /// The page number as the book gives it, e.g. 127 or xiv.
+    pub page: String,
+    /// Where the page starts, relative to the package document, with the
+    /// fragment when there is one, as in `GuideRef`.
+    pub href: String,
+}
+
+// The page list from the navigation document, or failing that the NCX.
+// Empty for a book without one.
+pub(crate) fn page_list<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Vec<PageTarget> {
+    let Ok(package) = Package::load(doc) else {
+        return Vec::new();
+    };
+    let nav = package.item_with_property("nav").map(|item| item.path.clone());
+    let ncx = package.toc_id.as_ref().and_then(|id| package.manifest.iter().find(|item| item.id == *id));
+    let sources = [(nav, false), (ncx.map(|item| item.path.clone()), true)];
+    for (path, is_ncx) in sources.into_iter().filter_map(|(path, is_ncx)| Some((path?, is_ncx))) {
+        let Ok(bytes) = doc.get_resource_by_path(&path) else {
+            continue;
+        };
+        let nodes = dom::parse(&encoding::decode(&bytes));
+        let mut entries = Vec::new();
+        match is_ncx {
+            true => dom::walk(&nodes, &mut |el| {
+                if el.is("pageTarget") {
+                    let page = find(&el.children, "navLabel").map(|label| label.text()).unwrap_or_default();
+                    let src = find(&el.children, "content").and_then(|content| content.attr("src"));
+                    entries.extend(src.map(|src| (page, src.to_string())));
+                }
+            }),
+            false => dom::walk(&nodes, &mut |el| {
+                let is_page_list = el.attr("epub:type").is_some_and(|t| t.split_whitespace().any(|t| t == "page-list"));
+                if el.is("nav") && is_page_list {
+                    dom::walk(&el.children, &mut |a| {
+                        if let (true, Some(target)) = (a.is("a"), a.attr("href")) {
+                            entries.push((a.text(), target.to_string()));
+                        }
+                    });
+                }
+            }),
+        }
+        let targets: Vec<PageTarget> = entries
+            .into_iter()
+            .filter_map(|(page, target)| page_target(&page, &target, &path, &doc.root_base))
+            .collect();
+        if !targets.is_empty() {
+            return targets;
+        }
+    }
+    Vec::new()
+}
+
+// The entry for `target`, as written in the document at `base`. None for
+// external links and pure fragments.
+fn page_target(page: &str, target: &str, base: &Path, root_base: &Path) -> Option<PageTarget> {
+    let path = href::resolve(base, target)?;
+    let path = path.strip_prefix(root_base).unwrap_or(&path).display().to_string();
+    let href = match href::split_fragment(target) {
+        (_, Some(fragment)) => format!("{}#{}", path, fragment),
+        (_, None) => path,
+    };
+    let page = page.split_whitespace().collect::<Vec<_>>().join(" ");
+    Some(PageTarget { page, href })
+}
+
+fn find<'a>(nodes: &'a [Node], name: &str) -> Option<&'a Element> {
+    nodes.iter().find_map(|node| match node {
+        Node::Element(el) if el.is(name) => Some(el),
+        Node::Element(el) => find(&el.children, name),
+        _ => None,
+    })
+}
@@ -0,0 +1,53 @@
+use crate::CancelToken;
+use anyhow::Result;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::Mutex;
+use std::thread;
+
+// The default number of workers: one per available CPU.
+pub(crate) fn default_jobs() -> usize {
+    thread::available_parallelism().map(|n| n.get()).unwrap_or(1)
+}
+
+// Runs `f` over `items` on up to `jobs` scoped threads and returns the
+// results in the order of `items`. Workers stop picking up new items once
+// `cancel` fires, or after the first failure with `stop_on_error`; the items
+// they skipped are None.
+pub(crate) fn map_ordered<T, U, F>(
+    items: &[T],
+    jobs: usize,
+    stop_on_error: bool,
+    cancel: Option<&CancelToken>,
+    f: F,
+) -> Vec<Option<Result<U>>>
+where
+    T: Sync,
+    U: Send,
+    F: Fn(&T) -> Result<U> + Sync,
+{
+    let next = AtomicUsize::new(0);
+    let failed = AtomicBool::new(false);
+    let results: Vec<Mutex<Option<Result<U>>>> = items.iter().map(|_| Mutex::new(None)).collect();
+
+    thread::scope(|scope| {
+        for _ in 0..jobs.clamp(1, items.len().max(1)) {
+            scope.spawn(|| loop {
+                if (stop_on_error && failed.load(Ordering::SeqCst)) || cancel.is_some_and(CancelToken::is_cancelled) {
+                    break;
+                }
+                let i = next.fetch_add(1, Ordering::SeqCst);
+                let item = match items.get(i) {
+                    Some(item) => item,
+                    None => break,
+                };
+                let result = f(item);
+                if result.is_err() {
+                    failed.store(true, Ordering::SeqCst);
+                }
+                *results[i].lock().unwrap() = Some(result);
+            });
+        }
+    });
+
+    results.into_iter().map(|slot| slot.into_inner().unwrap()).collect()
+}
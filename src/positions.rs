@@ -0,0 +1,94 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::env;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+// Where --read left off in each book, kept in positions.json under the user's
+// config directory. The file is only a convenience: when it's missing or
+// can't be parsed, reading starts from the beginning as if it were empty.
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Position {
+    /// Spine position, counting from 0.
+    pub chapter: usize,
+    /// Rows scrolled down in the chapter.
+    pub scroll: usize,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Positions {
+    path: Option<PathBuf>,
+    books: HashMap<String, Position>,
+}
+
+impl Positions {
+    // Reads the positions saved at `path`, or none when there's no such file
+    // or it isn't valid.
+    pub fn load(path: &Path) -> Positions {
+        let books = fs::read_to_string(path)
+            .ok()
+            .and_then(|json| serde_json::from_str(&json).ok())
+            .unwrap_or_default();
+        Positions {
+            path: Some(path.to_path_buf()),
+            books,
+        }
+    }
+
+    // The positions in the user's config directory, see `default_path`.
+    pub fn load_default() -> Positions {
+        match default_path() {
+            Some(path) => Positions::load(&path),
+            None => Positions::default(),
+        }
+    }
+
+    pub fn get(&self, key: &str) -> Option<Position> {
+        self.books.get(key).copied()
+    }
+
+    pub fn set(&mut self, key: &str, position: Position) {
+        self.books.insert(key.to_string(), position);
+    }
+
+    // Writes the positions back, through a temporary file so that a failed
+    // write can't leave a truncated file behind. Does nothing without a path.
+    pub fn save(&self) -> Result<()> {
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        if let Some(dir) = path.parent() {
+            fs::create_dir_all(dir).with_context(|| format!("Failed to create {}", dir.display()))?;
+        }
+        let json = serde_json::to_string_pretty(&self.books).expect("positions always serialize");
+        let tmp = path.with_extension("json.tmp");
+        fs::write(&tmp, json).with_context(|| format!("Failed to write {}", tmp.display()))?;
+        fs::rename(&tmp, path).with_context(|| format!("Failed to write {}", path.display()))
+    }
+}
+
+// cipher/positions.json in the user's config directory: $XDG_CONFIG_HOME or
+// ~/.config on Unix, ~/Library/Application Support on macOS and %AppData% on
+// Windows. None when the directory can't be determined.
+pub fn default_path() -> Option<PathBuf> {
+    Some(config_dir()?.join("cipher").join("positions.json"))
+}
+
+fn config_dir() -> Option<PathBuf> {
+    let var = |name: &str| env::var_os(name).filter(|value| !value.is_empty()).map(PathBuf::from);
+    if cfg!(windows) {
+        var("APPDATA")
+    } else if cfg!(target_os = "macos") {
+        var("HOME").map(|home| home.join("Library").join("Application Support"))
+    } else {
+        var("XDG_CONFIG_HOME").or_else(|| var("HOME").map(|home| home.join(".config")))
+    }
+}
+
+// 64-bit FNV-1a, for keying books that have no identifier by their package
+// document. Unlike DefaultHasher it gives the same value in every build.
+pub(crate) fn fnv1a(bytes: &[u8]) -> u64 {
+    bytes.iter().fold(0xcbf29ce484222325, |hash, &b| (hash ^ u64::from(b)).wrapping_mul(0x100000001b3))
+}
@@ -0,0 +1,27 @@
+use std::fmt;
+use std::sync::Arc;
+
+// Called once for each spine item with the number of items done so far, the
+// length of the spine, and the item's href. Items that are skipped, because
+// they weren't selected or can't be converted, count as done straight away,
+// so the last call always has done == total. Chapters may finish out of
+// order when converting on several threads. In a batch conversion it's
+// called once for each book instead, with its path.
+#[derive(Clone)]
+pub struct Progress(Arc<dyn Fn(usize, usize, &str) + Send + Sync>);
+
+impl Progress {
+    pub fn new<F: Fn(usize, usize, &str) + Send + Sync + 'static>(f: F) -> Self {
+        Progress(Arc::new(f))
+    }
+
+    pub(crate) fn report(&self, current: usize, total: usize, chapter: &str) {
+        (self.0)(current, total, chapter)
+    }
+}
+
+impl fmt::Debug for Progress {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("Progress(..)")
+    }
+}
@@ -0,0 +1,450 @@
+use crate::positions::{Position, Positions};
+use crate::render::Renderer;
+use crate::{Book, TocEntry};
+use anyhow::{Context, Result};
+use crossterm::cursor::{Hide, MoveTo, Show};
+use crossterm::event::{self, Event, KeyCode, KeyEvent, KeyEventKind, KeyModifiers};
+use crossterm::style::{Attribute, Print, SetAttribute};
+use crossterm::terminal::{self, Clear, ClearType, EnterAlternateScreen, LeaveAlternateScreen};
+use crossterm::{execute, queue};
+use std::collections::HashMap;
+use std::env;
+use std::io::{self, ErrorKind, IsTerminal, Read, Seek, Write};
+use std::process::{Command, Stdio};
+
+const HELP: &str = "n/p: chapter  ↑/↓/space: scroll  g: go to  t: contents  q: quit";
+
+// Starts the line above each chapter in `page`'s output, where less's search
+// for it stops.
+const CHAPTER_MARKER: &str = "§ ";
+
+// Puts the terminal into raw mode on the alternate screen and restores it on
+// drop, so an error inside the reader doesn't leave the terminal broken.
+struct Screen;
+
+impl Screen {
+    fn enter() -> Result<Screen> {
+        terminal::enable_raw_mode().context("Failed to enable raw terminal mode")?;
+        execute!(io::stdout(), EnterAlternateScreen, Hide)?;
+        Ok(Screen)
+    }
+}
+
+impl Drop for Screen {
+    fn drop(&mut self) {
+        let _ = execute!(io::stdout(), Show, LeaveAlternateScreen);
+        let _ = terminal::disable_raw_mode();
+    }
+}
+
+enum Mode {
+    Reading,
+    // Asking whether to go back to where the book was left last time.
+    Resume(Position),
+    // Typing a chapter number after pressing g.
+    GoTo(String),
+    // Picking an entry of the table of contents after pressing t, narrowed
+    // down by what has been typed. `selected` counts the matching entries.
+    Toc { filter: String, selected: usize },
+}
+
+struct Reader<'a, R: Read + Seek> {
+    book: &'a mut Book<R>,
+    renderer: &'a Renderer,
+    // Rendered lines per chapter and the line each heading starts on, filled
+    // the first time a chapter is shown.
+    pages: HashMap<usize, Page>,
+    // The table of contents, read the first time it's opened.
+    toc: Option<Vec<TocEntry>>,
+    chapter: usize,
+    scroll: usize,
+    // The id a table of contents entry points at in the chapter being shown,
+    // scrolled to once the chapter is rendered.
+    fragment: Option<String>,
+    max_scroll: usize,
+    height: usize,
+    mode: Mode,
+    message: Option<String>,
+}
+
+struct Page {
+    title: String,
+    lines: Vec<String>,
+    headings: Vec<usize>,
+}
+
+// Shows the book one chapter at a time in a full-screen pager. Chapters are
+// converted and rendered lazily as they are visited, all with one renderer.
+// With `resume`, offers to go back to the position saved when the book was
+// last closed. The position is saved on quitting either way.
+pub fn run<R: Read + Seek>(book: &mut Book<R>, renderer: &Renderer, resume: bool) -> Result<()> {
+    if book.is_empty() {
+        anyhow::bail!("The book has no chapters");
+    }
+    if !io::stdout().is_terminal() {
+        anyhow::bail!("--read needs stdout to be a terminal");
+    }
+    let key = book.key();
+    let mut positions = Positions::load_default();
+    let saved = positions.get(&key).filter(|position| resume && position.chapter < book.len());
+    let position = read(book, renderer, saved)?;
+    positions.set(&key, position);
+    // Not being able to save the position shouldn't turn quitting into an error.
+    if let Err(e) = positions.save() {
+        warn!("{:#}", e);
+    }
+    Ok(())
+}
+
+// Pages the whole book, rendered, through the program $PAGER names, such as
+// less. A marker line leads each chapter: less is started on the search for
+// it, so that n and N go to the next and previous chapter, and is passed -R
+// when $LESS is unset so that it shows the styles. Without a $PAGER the book
+// is shown in the built-in pager, as `run` does.
+pub fn page<R: Read + Seek>(book: &mut Book<R>, renderer: &Renderer) -> Result<()> {
+    let pager = env::var("PAGER").unwrap_or_default();
+    let mut words = pager.split_whitespace();
+    let Some(program) = words.next() else {
+        return run(book, renderer, false);
+    };
+    if book.is_empty() {
+        anyhow::bail!("The book has no chapters");
+    }
+    let mut out = String::new();
+    for index in 0..book.len() {
+        let (title, rendered) = match book.chapter(index) {
+            Ok(chapter) => (chapter.title, renderer.render(&chapter.markdown)),
+            Err(e) => (String::new(), format!("> [conversion failed: {:#}]\n", e)),
+        };
+        if index > 0 {
+            out.push('\n');
+        }
+        out.push_str(&format!("{}{}/{}  {}", CHAPTER_MARKER, index + 1, book.len(), title).trim_end());
+        out.push_str("\n\n");
+        out.push_str(&rendered);
+    }
+
+    let mut command = Command::new(program);
+    command.args(words).stdin(Stdio::piped());
+    let less = program.rsplit('/').next() == Some("less");
+    if less {
+        command.arg(format!("+/^{}", CHAPTER_MARKER));
+        if env::var_os("LESS").is_none() {
+            command.env("LESS", "R");
+        }
+    }
+    let mut child = command.spawn().with_context(|| format!("Failed to start the pager {}", pager))?;
+    let written = child.stdin.take().map_or(Ok(()), |mut stdin| stdin.write_all(out.as_bytes()));
+    let status = child.wait().with_context(|| format!("Failed to run the pager {}", pager))?;
+    match written {
+        // Quitting the pager before the end closes its input.
+        Err(e) if e.kind() != ErrorKind::BrokenPipe => Err(e).context("Failed to write to the pager"),
+        _ if !status.success() => anyhow::bail!("The pager {} exited with {}", pager, status),
+        _ => Ok(()),
+    }
+}
+
+// Runs the pager until the reader quits, returning where they were.
+fn read<R: Read + Seek>(book: &mut Book<R>, renderer: &Renderer, saved: Option<Position>) -> Result<Position> {
+    let _screen = Screen::enter()?;
+    let mut reader = Reader {
+        book,
+        renderer,
+        pages: HashMap::new(),
+        toc: None,
+        chapter: 0,
+        scroll: 0,
+        fragment: None,
+        max_scroll: 0,
+        height: 0,
+        mode: saved.map_or(Mode::Reading, Mode::Resume),
+        message: None,
+    };
+    loop {
+        reader.draw()?;
+        if let Event::Key(key) = event::read()? {
+            if key.kind != KeyEventKind::Release && !reader.handle(key) {
+                return Ok(Position {
+                    chapter: reader.chapter,
+                    scroll: reader.scroll,
+                });
+            }
+        }
+    }
+}
+
+impl<R: Read + Seek> Reader<'_, R> {
+    // Returns false when the reader should quit.
+    fn handle(&mut self, key: KeyEvent) -> bool {
+        if let Mode::Resume(position) = self.mode {
+            self.mode = Mode::Reading;
+            match key.code {
+                KeyCode::Char('y') | KeyCode::Enter => {
+                    self.chapter = position.chapter;
+                    // Clamped to the chapter's length when it's drawn.
+                    self.scroll = position.scroll;
+                }
+                KeyCode::Char('q') => return false,
+                _ => {}
+            }
+            return true;
+        }
+        if let Mode::GoTo(digits) = &mut self.mode {
+            match key.code {
+                KeyCode::Char(c) if c.is_ascii_digit() => digits.push(c),
+                KeyCode::Backspace => {
+                    digits.pop();
+                }
+                KeyCode::Enter => {
+                    let len = self.book.len();
+                    match digits.parse::<usize>() {
+                        Ok(n) if (1..=len).contains(&n) => self.show(n - 1),
+                        _ => self.message = Some(format!("No chapter {:?} (the book has {})", digits, len)),
+                    }
+                    self.mode = Mode::Reading;
+                }
+                KeyCode::Esc => self.mode = Mode::Reading,
+                _ => {}
+            }
+            return true;
+        }
+        if let Mode::Toc { .. } = self.mode {
+            return self.handle_toc(key);
+        }
+
+        let page = self.height.max(1);
+        match key.code {
+            KeyCode::Char('q') | KeyCode::Esc => return false,
+            KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => return false,
+            KeyCode::Char('n') | KeyCode::Right => {
+                if self.chapter + 1 < self.book.len() {
+                    self.show(self.chapter + 1);
+                } else {
+                    self.message = Some("Already at the last chapter".to_string());
+                }
+            }
+            KeyCode::Char('p') | KeyCode::Left => {
+                if self.chapter > 0 {
+                    self.show(self.chapter - 1);
+                } else {
+                    self.message = Some("Already at the first chapter".to_string());
+                }
+            }
+            KeyCode::Char('g') => self.mode = Mode::GoTo(String::new()),
+            KeyCode::Char('t') => {
+                let chapter = self.chapter + 1;
+                let selected = self.toc().iter().rposition(|entry| entry.index <= chapter).unwrap_or(0);
+                self.mode = Mode::Toc {
+                    filter: String::new(),
+                    selected,
+                };
+            }
+            KeyCode::Down | KeyCode::Char('j') => self.scroll_to(self.scroll.saturating_add(1)),
+            KeyCode::Up | KeyCode::Char('k') => self.scroll_to(self.scroll.saturating_sub(1)),
+            KeyCode::PageDown | KeyCode::Char(' ') => self.scroll_to(self.scroll.saturating_add(page)),
+            KeyCode::PageUp | KeyCode::Char('b') => self.scroll_to(self.scroll.saturating_sub(page)),
+            KeyCode::Home => self.scroll_to(0),
+            KeyCode::End => self.scroll_to(self.max_scroll),
+            _ => {}
+        }
+        true
+    }
+
+    // Returns false when the reader should quit.
+    fn handle_toc(&mut self, key: KeyEvent) -> bool {
+        let Mode::Toc { filter, selected } = &mut self.mode else {
+            return true;
+        };
+        let toc = self.toc.as_deref().unwrap_or_default();
+        let matches = matching(toc, filter);
+        let page = self.height.max(1);
+        match key.code {
+            KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => return false,
+            KeyCode::Esc => self.mode = Mode::Reading,
+            KeyCode::Enter => {
+                match matches.get(*selected).map(|&i| toc[i].clone()) {
+                    Some(entry) => {
+                        self.show(entry.index - 1);
+                        self.fragment = entry.fragment;
+                    }
+                    None => self.message = Some("No entry matches".to_string()),
+                }
+                self.mode = Mode::Reading;
+            }
+            KeyCode::Down => *selected = (*selected + 1).min(matches.len().saturating_sub(1)),
+            KeyCode::Up => *selected = selected.saturating_sub(1),
+            KeyCode::PageDown => *selected = (*selected + page).min(matches.len().saturating_sub(1)),
+            KeyCode::PageUp => *selected = selected.saturating_sub(page),
+            KeyCode::Backspace => {
+                filter.pop();
+                *selected = 0;
+            }
+            KeyCode::Char(c) => {
+                filter.push(c);
+                *selected = 0;
+            }
+            _ => {}
+        }
+        true
+    }
+
+    fn toc(&mut self) -> &[TocEntry] {
+        self.toc.get_or_insert_with(|| self.book.toc())
+    }
+
+    fn show(&mut self, chapter: usize) {
+        self.chapter = chapter;
+        self.scroll = 0;
+        self.fragment = None;
+    }
+
+    fn scroll_to(&mut self, scroll: usize) {
+        self.scroll = scroll.min(self.max_scroll);
+    }
+
+    fn draw(&mut self) -> Result<()> {
+        let (width, height) = terminal::size()?;
+        let (width, height) = (width as usize, height as usize);
+        self.height = height.saturating_sub(1);
+        if let Mode::Toc { filter, selected } = &self.mode {
+            return self.draw_toc(filter, *selected, width);
+        }
+
+        let (book, renderer, index) = (&mut *self.book, self.renderer, self.chapter);
+        let page = self.pages.entry(index).or_insert_with(|| match book.chapter(index) {
+            Ok(chapter) => {
+                let (rendered, headings) = renderer.render_with_headings(&chapter.markdown);
+                Page {
+                    title: chapter.title,
+                    lines: rendered.lines().map(String::from).collect(),
+                    headings,
+                }
+            }
+            Err(e) => Page {
+                title: String::new(),
+                lines: vec![format!("> [conversion failed: {:#}]", e)],
+                headings: Vec::new(),
+            },
+        });
+        let (title, lines) = (&page.title, &page.lines);
+        let rows: Vec<String> = lines.iter().flat_map(|line| wrap(line, width)).collect();
+        if let Some(fragment) = self.fragment.take() {
+            // The rows before the heading's line, which wrapping may have
+            // made more than one each.
+            let line = book.heading_of(index, &fragment).and_then(|heading| page.headings.get(heading));
+            self.scroll = line.map_or(0, |&line| lines[..line].iter().map(|line| wrap(line, width).len()).sum());
+        }
+        self.max_scroll = rows.len().saturating_sub(self.height);
+        self.scroll = self.scroll.min(self.max_scroll);
+
+        let status = match &self.mode {
+            Mode::GoTo(digits) => format!("Go to chapter (1-{}): {}", self.book.len(), digits),
+            Mode::Resume(position) => {
+                format!("Resume at chapter {} of {}? (y/n)", position.chapter + 1, self.book.len())
+            }
+            Mode::Reading => match self.message.take() {
+                Some(message) => message,
+                None => format!("{}/{} {}  —  {}", index + 1, self.book.len(), title, HELP),
+            },
+            Mode::Toc { .. } => unreachable!(),
+        };
+
+        let mut out = io::stdout().lock();
+        queue!(out, Clear(ClearType::All))?;
+        for (row, line) in rows.iter().skip(self.scroll).take(self.height).enumerate() {
+            queue!(out, MoveTo(0, row as u16), Print(line), SetAttribute(Attribute::Reset))?;
+        }
+        draw_status(&mut out, &status, self.height, width)?;
+        out.flush()?;
+        Ok(())
+    }
+
+    // The entries matching `filter`, nested ones indented under their parent,
+    // scrolled so that the selected one shows.
+    fn draw_toc(&self, filter: &str, selected: usize, width: usize) -> Result<()> {
+        let toc = self.toc.as_deref().unwrap_or_default();
+        let matches = matching(toc, filter);
+        let first = (selected + 1).saturating_sub(self.height);
+        let mut out = io::stdout().lock();
+        queue!(out, Clear(ClearType::All))?;
+        for (row, &i) in matches.iter().enumerate().skip(first).take(self.height) {
+            let entry = &toc[i];
+            let line = format!("{}{}", "  ".repeat(entry.depth), entry.title);
+            let line: String = line.chars().take(width).collect();
+            queue!(out, MoveTo(0, (row - first) as u16))?;
+            if row == selected {
+                queue!(out, SetAttribute(Attribute::Reverse), Print(line), SetAttribute(Attribute::Reset))?;
+            } else {
+                queue!(out, Print(line))?;
+            }
+        }
+        let status = format!(
+            "Contents ({} of {}): {}  —  ↑/↓: select  enter: go  esc: back",
+            matches.len(),
+            toc.len(),
+            filter
+        );
+        draw_status(&mut out, &status, self.height, width)?;
+        out.flush()?;
+        Ok(())
+    }
+}
+
+// The status line at the foot of the screen, in reverse video.
+fn draw_status<W: Write>(out: &mut W, status: &str, row: usize, width: usize) -> Result<()> {
+    let status: String = status.chars().take(width).collect();
+    queue!(
+        out,
+        MoveTo(0, row as u16),
+        SetAttribute(Attribute::Reverse),
+        Print(format!("{:<width$}", status, width = width)),
+        SetAttribute(Attribute::Reset)
+    )?;
+    Ok(())
+}
+
+// The positions of the entries whose titles hold the characters of `filter`
+// in order, ignoring case and spaces, so that "ch3" finds "Chapter 3".
+fn matching(toc: &[TocEntry], filter: &str) -> Vec<usize> {
+    let filter: Vec<char> = filter.chars().filter(|c| !c.is_whitespace()).flat_map(char::to_lowercase).collect();
+    toc.iter()
+        .enumerate()
+        .filter(|(_, entry)| {
+            let mut title = entry.title.chars().flat_map(char::to_lowercase);
+            filter.iter().all(|c| title.any(|t| t == *c))
+        })
+        .map(|(i, _)| i)
+        .collect()
+}
+
+// Hard-wraps a rendered line at `width` visible characters, carrying escape
+// sequences along without counting them.
+fn wrap(line: &str, width: usize) -> Vec<String> {
+    if width == 0 {
+        return vec![line.to_string()];
+    }
+    let mut rows = vec![String::new()];
+    let mut visible = 0;
+    let mut chars = line.chars();
+    while let Some(c) = chars.next() {
+        let row = rows.last_mut().unwrap();
+        if c == '\x1b' {
+            row.push(c);
+            for next in chars.by_ref() {
+                row.push(next);
+                if next.is_ascii_alphabetic() {
+                    break;
+                }
+            }
+            continue;
+        }
+        if visible == width {
+            rows.push(c.to_string());
+            visible = 1;
+        } else {
+            row.push(c);
+            visible += 1;
+        }
+    }
+    rows
+}
@@ -0,0 +1,676 @@
+use crate::markdown;
+use anyhow::{Context, Result};
+use crossterm::terminal;
+use serde::Deserialize;
+use std::env;
+use std::fmt;
+use std::fs;
+use std::io::{self, IsTerminal};
+use std::path::Path;
+use std::str::FromStr;
+
+const RESET: &str = "\x1b[0m";
+const BOLD: &str = "\x1b[1m";
+const ITALIC: &str = "\x1b[3m";
+const UNDERLINE: &str = "\x1b[4m";
+
+pub const THEME_NAMES: &[&str] = &["auto", "dark", "light", "notty", "dracula", "pink"];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Theme {
+    Auto,
+    Dark,
+    Light,
+    NoTty,
+    Dracula,
+    Pink,
+}
+
+impl FromStr for Theme {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "auto" => Ok(Theme::Auto),
+            "dark" => Ok(Theme::Dark),
+            "light" => Ok(Theme::Light),
+            "notty" => Ok(Theme::NoTty),
+            "dracula" => Ok(Theme::Dracula),
+            "pink" => Ok(Theme::Pink),
+            _ => Err(format!("unknown theme {:?} (expected one of: {})", s, THEME_NAMES.join(", "))),
+        }
+    }
+}
+
+impl fmt::Display for Theme {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let name = match self {
+            Theme::Auto => "auto",
+            Theme::Dark => "dark",
+            Theme::Light => "light",
+            Theme::NoTty => "notty",
+            Theme::Dracula => "dracula",
+            Theme::Pink => "pink",
+        };
+        f.write_str(name)
+    }
+}
+
+impl Theme {
+    // Auto becomes notty when stdout isn't a terminal, otherwise dark or light
+    // depending on the background reported in COLORFGBG (e.g. "15;0").
+    pub fn resolve(self) -> Theme {
+        if self != Theme::Auto {
+            return self;
+        }
+        if !io::stdout().is_terminal() {
+            return Theme::NoTty;
+        }
+        let background = env::var("COLORFGBG")
+            .ok()
+            .and_then(|v| v.rsplit(';').next().and_then(|bg| bg.parse::<u8>().ok()));
+        match background {
+            Some(7) | Some(9..=15) => Theme::Light,
+            _ => Theme::Dark,
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Palette {
+    heading: String,
+    code: String,
+    quote: String,
+    link: String,
+    rule: String,
+}
+
+impl Palette {
+    fn new(heading: &str, code: &str, quote: &str, link: &str, rule: &str) -> Palette {
+        Palette {
+            heading: heading.to_string(),
+            code: code.to_string(),
+            quote: quote.to_string(),
+            link: link.to_string(),
+            rule: rule.to_string(),
+        }
+    }
+}
+
+fn palette(theme: Theme) -> Option<Palette> {
+    match theme {
+        Theme::Auto | Theme::NoTty => None,
+        Theme::Dark => Some(Palette::new(
+            "\x1b[38;5;39m",
+            "\x1b[38;5;203m",
+            "\x1b[38;5;245m",
+            "\x1b[38;5;30m",
+            "\x1b[38;5;240m",
+        )),
+        Theme::Light => Some(Palette::new(
+            "\x1b[38;5;27m",
+            "\x1b[38;5;160m",
+            "\x1b[38;5;242m",
+            "\x1b[38;5;36m",
+            "\x1b[38;5;250m",
+        )),
+        Theme::Dracula => Some(Palette::new(
+            "\x1b[38;5;141m",
+            "\x1b[38;5;84m",
+            "\x1b[38;5;228m",
+            "\x1b[38;5;117m",
+            "\x1b[38;5;61m",
+        )),
+        Theme::Pink => Some(Palette::new(
+            "\x1b[38;5;212m",
+            "\x1b[38;5;218m",
+            "\x1b[38;5;175m",
+            "\x1b[38;5;211m",
+            "\x1b[38;5;219m",
+        )),
+    }
+}
+
+// Either a built-in theme or a palette loaded from a glamour JSON style file.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Style {
+    Theme(Theme),
+    Custom(Palette),
+}
+
+impl From<Theme> for Style {
+    fn from(theme: Theme) -> Self {
+        Style::Theme(theme)
+    }
+}
+
+// A theme name, or failing that a path to a style file.
+impl FromStr for Style {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        if let Ok(theme) = s.parse::<Theme>() {
+            return Ok(Style::Theme(theme));
+        }
+        if !Path::new(s).is_file() {
+            return Err(format!(
+                "unknown style {:?} (expected one of: {}, or a path to a JSON style file)",
+                s,
+                THEME_NAMES.join(", ")
+            ));
+        }
+        Style::load(Path::new(s)).map_err(|e| format!("{:#}", e))
+    }
+}
+
+impl Style {
+    // Loads the colors from a glamour-style JSON file. Only the color of the
+    // heading, code, block_quote, link and hr elements is used; anything
+    // missing falls back to the dark theme.
+    pub fn load(path: &Path) -> Result<Style> {
+        let json = fs::read_to_string(path).with_context(|| format!("Failed to read style file {}", path.display()))?;
+        let file: StyleFile =
+            serde_json::from_str(&json).with_context(|| format!("Failed to parse style file {}", path.display()))?;
+        let dark = palette(Theme::Dark).expect("the dark theme has a palette");
+        let color = |element: Option<StyleElement>, fallback: String| -> Result<String> {
+            match element.and_then(|el| el.color) {
+                Some(color) => ansi_color(&color)
+                    .with_context(|| format!("Invalid color {:?} in style file {}", color, path.display())),
+                None => Ok(fallback),
+            }
+        };
+        Ok(Style::Custom(Palette {
+            heading: color(file.heading, dark.heading)?,
+            code: color(file.code, dark.code)?,
+            quote: color(file.block_quote, dark.quote)?,
+            link: color(file.link, dark.link)?,
+            rule: color(file.hr, dark.rule)?,
+        }))
+    }
+
+    fn palette(&self) -> Option<Palette> {
+        match self {
+            Style::Theme(theme) => palette(theme.resolve()),
+            Style::Custom(palette) => Some(palette.clone()),
+        }
+    }
+}
+
+#[derive(Deserialize)]
+struct StyleFile {
+    heading: Option<StyleElement>,
+    code: Option<StyleElement>,
+    block_quote: Option<StyleElement>,
+    link: Option<StyleElement>,
+    hr: Option<StyleElement>,
+}
+
+#[derive(Deserialize)]
+struct StyleElement {
+    color: Option<String>,
+}
+
+// Glamour colors are either an ANSI 256 color number ("39") or "#rrggbb".
+fn ansi_color(color: &str) -> Result<String> {
+    if let Some(hex) = color.strip_prefix('#') {
+        if hex.len() == 6 {
+            let channel = |i: usize| u8::from_str_radix(&hex[i..i + 2], 16);
+            if let (Ok(r), Ok(g), Ok(b)) = (channel(0), channel(2), channel(4)) {
+                return Ok(format!("\x1b[38;2;{};{};{}m", r, g, b));
+            }
+        }
+    } else if let Ok(n) = color.parse::<u8>() {
+        return Ok(format!("\x1b[38;5;{}m", n));
+    }
+    anyhow::bail!("expected an ANSI color number or #rrggbb")
+}
+
+// Widest line Wrap::Auto picks on a wide terminal, and the width it uses when
+// the terminal size can't be read.
+const MAX_AUTO_WIDTH: usize = 100;
+const FALLBACK_WIDTH: usize = 80;
+
+// How wide rendered lines may get before they are word-wrapped.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Wrap {
+    /// The width of the terminal, capped at 100 columns, or 80 when it can't
+    /// be detected.
+    #[default]
+    Auto,
+    Off,
+    Width(usize),
+}
+
+impl FromStr for Wrap {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "auto" => Ok(Wrap::Auto),
+            "0" => Ok(Wrap::Off),
+            _ => s
+                .parse::<usize>()
+                .map(Wrap::Width)
+                .map_err(|_| format!("invalid wrap width {:?} (expected a number of columns, 0 or auto)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Wrap {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Wrap::Auto => f.write_str("auto"),
+            Wrap::Off => f.write_str("0"),
+            Wrap::Width(width) => write!(f, "{}", width),
+        }
+    }
+}
+
+impl Wrap {
+    pub fn width(self) -> Option<usize> {
+        match self {
+            Wrap::Auto => match terminal::size() {
+                Ok((columns, _)) if columns > 0 => Some((columns as usize).min(MAX_AUTO_WIDTH)),
+                _ => Some(FALLBACK_WIDTH),
+            },
+            Wrap::Off => None,
+            Wrap::Width(width) => Some(width),
+        }
+    }
+}
+
+// When to style output, as with grep and ls: auto styles it only for a
+// terminal, unless NO_COLOR or CLICOLOR_FORCE says otherwise.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Color {
+    #[default]
+    Auto,
+    Always,
+    Never,
+}
+
+impl FromStr for Color {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "auto" => Ok(Color::Auto),
+            "always" => Ok(Color::Always),
+            "never" => Ok(Color::Never),
+            _ => Err(format!("invalid color choice {:?} (expected auto, always or never)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Color {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Color::Auto => f.write_str("auto"),
+            Color::Always => f.write_str("always"),
+            Color::Never => f.write_str("never"),
+        }
+    }
+}
+
+impl Color {
+    // Whether output to a writer that is or isn't a `terminal` gets styled.
+    // A non-empty NO_COLOR turns auto off and a CLICOLOR_FORCE other than 0
+    // turns it on; NO_COLOR wins when both are set.
+    pub fn enabled(self, terminal: bool) -> bool {
+        let set = |name: &str| env::var_os(name).filter(|value| !value.is_empty());
+        match self {
+            Color::Always => true,
+            Color::Never => false,
+            Color::Auto if set("NO_COLOR").is_some() => false,
+            Color::Auto if set("CLICOLOR_FORCE").is_some_and(|value| value != "0") => true,
+            Color::Auto => terminal,
+        }
+    }
+}
+
+// Renders markdown for display in a terminal with a fixed style and wrap
+// width, so that both are worked out once when rendering several documents.
+#[derive(Debug, Clone)]
+pub struct Renderer {
+    palette: Option<Palette>,
+    width: Option<usize>,
+}
+
+impl Renderer {
+    pub fn new<S: Into<Style>>(style: S) -> Renderer {
+        Renderer {
+            palette: style.into().palette(),
+            width: None,
+        }
+    }
+
+    pub fn wrap(self, wrap: Wrap) -> Renderer {
+        Renderer {
+            width: wrap.width().filter(|width| *width > 0),
+            ..self
+        }
+    }
+
+    // Leaves the markdown unstyled when `color` is off for output to a writer
+    // that is or isn't a `terminal`.
+    pub fn color(self, color: Color, terminal: bool) -> Renderer {
+        match color.enabled(terminal) {
+            true => self,
+            false => Renderer { palette: None, ..self },
+        }
+    }
+
+    // The notty theme (and auto when stdout isn't a terminal) returns the
+    // markdown unchanged.
+    pub fn render(&self, markdown: &str) -> String {
+        self.render_with_headings(markdown).0
+    }
+
+    // Renders the markdown as `render` does, along with the rendered line
+    // each heading starts on, counting from 0, for jumping to a heading.
+    pub(crate) fn render_with_headings(&self, markdown: &str) -> (String, Vec<usize>) {
+        let palette = match &self.palette {
+            Some(palette) => palette,
+            None => return (markdown.to_string(), markdown::heading_line_numbers(markdown)),
+        };
+        let fill = |line: String, indent: &str| match self.width {
+            Some(width) => word_wrap(&line, width, indent),
+            None => line,
+        };
+        let lines: Vec<&str> = markdown.lines().collect();
+        let mut out = String::new();
+        let mut headings = Vec::new();
+        let mut in_code = false;
+        let mut i = 0;
+        if lines.first() == Some(&"---") {
+            if let Some(end) = lines.iter().skip(1).position(|l| *l == "---") {
+                for line in &lines[..end + 2] {
+                    out.push_str(&format!("{}{}{}\n", palette.quote, line, RESET));
+                }
+                i = end + 2;
+            }
+        }
+        while i < lines.len() {
+            let line = lines[i];
+            let trimmed = line.trim();
+            i += 1;
+
+            if trimmed.starts_with("```") {
+                in_code = !in_code;
+                continue;
+            }
+            if in_code {
+                out.push_str(&format!("  {}{}{}\n", palette.code, line, RESET));
+                continue;
+            }
+            if let Some(next) = lines.get(i) {
+                if !trimmed.is_empty() && is_setext_underline(next) {
+                    headings.push(out.matches('\n').count());
+                    out.push_str(&fill(heading(trimmed, palette), ""));
+                    i += 1;
+                    continue;
+                }
+            }
+            if trimmed.starts_with('#') {
+                let text = trimmed.trim_start_matches('#').trim_end_matches('#').trim();
+                if !text.is_empty() {
+                    headings.push(out.matches('\n').count());
+                }
+                out.push_str(&fill(heading(text, palette), ""));
+            } else if is_rule(trimmed) {
+                out.push_str(&format!("{}{}{}\n", palette.rule, "─".repeat(40), RESET));
+            } else if let Some(quoted) = trimmed.strip_prefix('>') {
+                let base = palette.quote.as_str();
+                let quoted = format!("{}│ {}{}", base, inline(quoted.trim_start(), palette, base), RESET);
+                out.push_str(&fill(quoted, "│ "));
+                out.push('\n');
+            } else if let Some(item) = list_item(line) {
+                let indent = &line[..line.len() - line.trim_start().len()];
+                let item = format!("{}• {}", indent, inline(item, palette, ""));
+                out.push_str(&fill(item, &format!("{}  ", indent)));
+                out.push('\n');
+            } else if trimmed.starts_with('|') {
+                let start = i - 1;
+                while lines.get(i).is_some_and(|line| line.trim().starts_with('|')) {
+                    i += 1;
+                }
+                out.push_str(&table(&lines[start..i], palette));
+            } else if trimmed.starts_with('<') {
+                out.push_str(&inline(line, palette, ""));
+                out.push('\n');
+            } else {
+                out.push_str(&fill(inline(line, palette, ""), ""));
+                out.push('\n');
+            }
+        }
+        (out, headings)
+    }
+}
+
+// Renders markdown for display in a terminal without wrapping.
+pub fn render<S: Into<Style>>(markdown: &str, style: S) -> String {
+    Renderer::new(style).render(markdown)
+}
+
+fn heading(text: &str, palette: &Palette) -> String {
+    let base = format!("{}{}", palette.heading, BOLD);
+    format!("{}{}{}\n", base, inline(text, palette, &base), RESET)
+}
+
+// Breaks a styled line between words so that no row is wider than `width`
+// visible characters, starting continuation rows with `indent`. Escape
+// sequences aren't counted, and words longer than a row are left whole.
+fn word_wrap(line: &str, width: usize, indent: &str) -> String {
+    let (line, newline) = match line.strip_suffix('\n') {
+        Some(line) => (line, "\n"),
+        None => (line, ""),
+    };
+    let words = line.trim_start_matches(' ');
+    let mut out = line[..line.len() - words.len()].to_string();
+    let mut used = out.len();
+    for (i, word) in words.split(' ').enumerate() {
+        let len = visible_len(word);
+        if i > 0 && used + 1 + len > width && used > visible_len(indent) {
+            out.push('\n');
+            out.push_str(indent);
+            used = visible_len(indent);
+        } else if i > 0 {
+            out.push(' ');
+            used += 1;
+        }
+        out.push_str(word);
+        used += len;
+    }
+    out.push_str(newline);
+    out
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Align {
+    Left,
+    Center,
+    Right,
+}
+
+// Lays a pipe table out in aligned columns, with the header in bold and a rule
+// under it. Cells keep their inline styling; column alignment follows the
+// colons of the delimiter row.
+fn table(rows: &[&str], palette: &Palette) -> String {
+    let mut cells: Vec<Vec<String>> = Vec::new();
+    let mut aligns = Vec::new();
+    let mut header = 0;
+    for row in rows {
+        let row = table_cells(row);
+        if header == 0 && !cells.is_empty() && row.iter().all(|cell| is_delimiter(cell)) {
+            aligns = row.iter().map(|cell| alignment(cell)).collect();
+            header = cells.len();
+            continue;
+        }
+        let base = if header == 0 { BOLD } else { "" };
+        cells.push(row.iter().map(|cell| format!("{}{}{}", base, inline(cell, palette, base), RESET)).collect());
+    }
+    if header == 0 {
+        // Not a table after all; strip the bold again.
+        cells = rows.iter().map(|row| vec![inline(row, palette, "")]).collect();
+    }
+    let columns = cells.iter().map(Vec::len).max().unwrap_or(0);
+    let widths: Vec<usize> = (0..columns)
+        .map(|c| cells.iter().filter_map(|row| row.get(c)).map(|cell| visible_len(cell)).max().unwrap_or(0))
+        .collect();
+    let separator = format!(" {}│{} ", palette.rule, RESET);
+    let mut out = String::new();
+    for (n, row) in cells.iter().enumerate() {
+        let padded: Vec<String> = (0..columns)
+            .map(|c| {
+                let cell = row.get(c).map_or("", String::as_str);
+                pad(cell, widths[c], aligns.get(c).copied().unwrap_or(Align::Left))
+            })
+            .collect();
+        out.push_str(padded.join(&separator).trim_end());
+        out.push('\n');
+        if n + 1 == header {
+            let rule: Vec<String> = widths.iter().map(|width| "─".repeat(*width)).collect();
+            out.push_str(&format!("{}{}{}\n", palette.rule, rule.join("─┼─"), RESET));
+        }
+    }
+    out
+}
+
+// Splits "| a | b |" into its trimmed cells, keeping escaped pipes.
+fn table_cells(row: &str) -> Vec<String> {
+    let row = row.trim();
+    let row = row.strip_prefix('|').unwrap_or(row);
+    let row = match row.strip_suffix('|') {
+        Some(inner) if !inner.ends_with('\\') => inner,
+        _ => row,
+    };
+    let mut cells = vec![String::new()];
+    let mut chars = row.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' if chars.peek() == Some(&'|') => cells.last_mut().unwrap().extend(chars.next()),
+            '|' => cells.push(String::new()),
+            c => cells.last_mut().unwrap().push(c),
+        }
+    }
+    cells.iter().map(|cell| cell.trim().to_string()).collect()
+}
+
+fn is_delimiter(cell: &str) -> bool {
+    cell.contains('-') && cell.chars().all(|c| c == '-' || c == ':')
+}
+
+fn alignment(cell: &str) -> Align {
+    match (cell.starts_with(':'), cell.ends_with(':')) {
+        (true, true) => Align::Center,
+        (false, true) => Align::Right,
+        _ => Align::Left,
+    }
+}
+
+fn pad(cell: &str, width: usize, align: Align) -> String {
+    let space = width.saturating_sub(visible_len(cell));
+    let (left, right) = match align {
+        Align::Left => (0, space),
+        Align::Right => (space, 0),
+        Align::Center => (space / 2, space - space / 2),
+    };
+    format!("{}{}{}", " ".repeat(left), cell, " ".repeat(right))
+}
+
+fn visible_len(text: &str) -> usize {
+    let mut len = 0;
+    let mut chars = text.chars();
+    while let Some(c) = chars.next() {
+        if c == '\x1b' {
+            for next in chars.by_ref() {
+                if next.is_ascii_alphabetic() {
+                    break;
+                }
+            }
+        } else {
+            len += 1;
+        }
+    }
+    len
+}
+
+pub(crate) fn is_setext_underline(line: &str) -> bool {
+    let line = line.trim();
+    line.len() >= 3 && (line.chars().all(|c| c == '=') || line.chars().all(|c| c == '-'))
+}
+
+pub(crate) fn is_rule(line: &str) -> bool {
+    let compact: String = line.chars().filter(|c| !c.is_whitespace()).collect();
+    compact.len() >= 3
+        && (compact.chars().all(|c| c == '-') || compact.chars().all(|c| c == '*') || compact.chars().all(|c| c == '_'))
+}
+
+fn list_item(line: &str) -> Option<&str> {
+    let trimmed = line.trim_start();
+    ["* ", "- ", "+ "].iter().find_map(|marker| trimmed.strip_prefix(marker))
+}
+
+// Styles code spans, strong/emphasis and links; `base` is re-applied after
+// each span so styling inside headings and quotes keeps its color.
+fn inline(text: &str, palette: &Palette, base: &str) -> String {
+    let chars: Vec<char> = text.chars().collect();
+    let mut out = String::new();
+    let mut i = 0;
+    while i < chars.len() {
+        let c = chars[i];
+        if c == '`' {
+            if let Some(end) = find(&chars, i + 1, "`") {
+                let code: String = chars[i + 1..end].iter().collect();
+                out.push_str(&format!("{}{}{}{}", palette.code, code, RESET, base));
+                i = end + 1;
+                continue;
+            }
+        }
+        if c == '*' && chars.get(i + 1) == Some(&'*') {
+            if let Some(end) = find(&chars, i + 2, "**") {
+                let strong: String = chars[i + 2..end].iter().collect();
+                out.push_str(&format!("{}{}{}{}", BOLD, strong, RESET, base));
+                i = end + 2;
+                continue;
+            }
+        }
+        let word_start = i == 0 || !chars[i - 1].is_alphanumeric();
+        if (c == '*' || c == '_') && word_start && chars.get(i + 1).is_some_and(|n| !n.is_whitespace()) {
+            if let Some(end) = find(&chars, i + 1, &c.to_string()) {
+                let emphasis: String = chars[i + 1..end].iter().collect();
+                out.push_str(&format!("{}{}{}{}", ITALIC, emphasis, RESET, base));
+                i = end + 1;
+                continue;
+            }
+        }
+        let image = c == '!' && chars.get(i + 1) == Some(&'[');
+        if c == '[' || image {
+            let open = if image { i + 1 } else { i };
+            if let Some(close) = find(&chars, open + 1, "](") {
+                if let Some(end) = find(&chars, close + 2, ")") {
+                    let label: String = chars[open + 1..close].iter().collect();
+                    let target: String = chars[close + 2..end].iter().collect();
+                    if image {
+                        out.push_str(&format!("{}[image: {}]{}{}", palette.link, label, RESET, base));
+                    } else {
+                        out.push_str(&format!(
+                            "{}{}{}{} {}({}){}{}",
+                            palette.link, UNDERLINE, label, RESET, palette.rule, target, RESET, base
+                        ));
+                    }
+                    i = end + 1;
+                    continue;
+                }
+            }
+        }
+        out.push(c);
+        i += 1;
+    }
+    out
+}
+
+fn find(chars: &[char], from: usize, needle: &str) -> Option<usize> {
+    let needle: Vec<char> = needle.chars().collect();
+    (from..chars.len()).find(|&i| chars[i..].starts_with(&needle))
+}
@@ -0,0 +1,153 @@
+use crate::dom::{self, Element, Node};
+use std::fmt;
+use std::str::FromStr;
+
+// How <ruby> annotations come out, such as the furigana over the kanji of a
+// Japanese book. html2md runs the base text and its reading together, so
+// 漢字 read かんじ would come out as 漢字かんじ.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Ruby {
+    /// The reading in full-width parentheses after its base text: 漢字（かんじ）.
+    #[default]
+    Parentheses,
+    /// Only the base text, dropping the readings.
+    Base,
+    /// The <ruby> markup as it is, for renderers that allow HTML.
+    Html,
+}
+
+impl FromStr for Ruby {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "parentheses" => Ok(Ruby::Parentheses),
+            "base" => Ok(Ruby::Base),
+            "html" => Ok(Ruby::Html),
+            _ => Err(format!("invalid ruby form {} (expected parentheses, base or html)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Ruby {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Ruby::Parentheses => f.write_str("parentheses"),
+            Ruby::Base => f.write_str("base"),
+            Ruby::Html => f.write_str("html"),
+        }
+    }
+}
+
+// Replaces each <ruby> with its base text, each base followed by its reading
+// in parentheses unless `form` is Base. A ruby can pair several bases with
+// their readings, 漢<rt>かん</rt>字<rt>じ</rt>, and the <rp> fallback
+// parentheses some books carry are dropped for our own. Html leaves the
+// markup alone; see `hide`.
+pub(crate) fn annotate(nodes: &mut Vec<Node>, form: Ruby) {
+    if form == Ruby::Html {
+        return;
+    }
+    let mut out = Vec::with_capacity(nodes.len());
+    for node in std::mem::take(nodes) {
+        match node {
+            Node::Element(el) if el.is("ruby") => out.extend(annotated(el, form)),
+            Node::Element(mut el) => {
+                annotate(&mut el.children, form);
+                out.push(Node::Element(el));
+            }
+            node => out.push(node),
+        }
+    }
+    *nodes = out;
+}
+
+fn annotated(ruby: Element, form: Ruby) -> Vec<Node> {
+    let mut out = Vec::new();
+    let mut base = Vec::new();
+    for child in ruby.children {
+        match child {
+            Node::Element(el) if el.is("rt") || el.is("rtc") => {
+                out.append(&mut base);
+                let reading = el.text();
+                if form == Ruby::Parentheses && !reading.is_empty() {
+                    out.push(Node::Text(format!("（{}）", dom::escape_text(&reading))));
+                }
+            }
+            Node::Element(el) if el.is("rp") => {}
+            // The old XHTML ruby holds its bases in <rb>s inside an <rbc>.
+            Node::Element(el) if el.is("rb") || el.is("rbc") => {
+                let mut children: Vec<Node> = el
+                    .children
+                    .into_iter()
+                    .flat_map(|child| match child {
+                        Node::Element(rb) if rb.is("rb") => rb.children,
+                        child => vec![child],
+                    })
+                    .collect();
+                annotate(&mut children, form);
+                base.extend(children);
+            }
+            Node::Element(mut el) => {
+                annotate(&mut el.children, form);
+                base.push(Node::Element(el));
+            }
+            // The markup's indentation, which would put spaces into the text.
+            Node::Text(text) if text.trim().is_empty() => {}
+            child => base.push(child),
+        }
+    }
+    out.append(&mut base);
+    out
+}
+
+// Swaps each <ruby> outside code for a placeholder holding its markup, which
+// `restore` puts back after conversion, since html2md would flatten it.
+pub(crate) fn hide(nodes: &mut [Node]) -> Vec<(String, String)> {
+    let mut rubies = Vec::new();
+    hide_in(nodes, &mut rubies);
+    rubies
+}
+
+fn hide_in(nodes: &mut [Node], rubies: &mut Vec<(String, String)>) {
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        if el.is("pre") || el.is("code") {
+            continue;
+        }
+        if !el.is("ruby") {
+            hide_in(&mut el.children, rubies);
+            continue;
+        }
+        // On one line, so that it stays inside its paragraph.
+        let html = dom::serialize(std::slice::from_ref(node));
+        let html = html.split_whitespace().collect::<Vec<_>>().join(" ");
+        let placeholder = format!("CIPHERRUBY{}X", rubies.len());
+        rubies.push((placeholder.clone(), html));
+        *node = Node::Text(placeholder);
+    }
+}
+
+pub(crate) fn restore(markdown: &str, rubies: &[(String, String)]) -> String {
+    let mut markdown = markdown.to_string();
+    for (placeholder, html) in rubies {
+        markdown = markdown.replace(placeholder, html);
+    }
+    markdown
+}
+
+// A chapter title taken while the rubies were hidden, with each one read as
+// its base text and readings in parentheses, since a title is plain text.
+pub(crate) fn restore_text(title: &str, rubies: &[(String, String)]) -> String {
+    let mut title = title.to_string();
+    for (placeholder, html) in rubies {
+        if title.contains(placeholder.as_str()) {
+            let mut nodes = dom::parse(html);
+            annotate(&mut nodes, Ruby::Parentheses);
+            title = title.replace(placeholder, &dom::text_content(&nodes));
+        }
+    }
+    title
+}
@@ -0,0 +1,49 @@
+use crate::dom::{Element, Node};
+
+// Elements whose content is never meant to be read.
+const DROPPED: &[&str] = &["script", "style", "template"];
+
+// Attributes that only say how an element looks. Tables kept as HTML would
+// otherwise carry them into the markdown.
+const PRESENTATIONAL: &[&str] = &[
+    "style", "align", "valign", "bgcolor", "background", "color", "face", "size", "width", "height", "border",
+    "cellpadding", "cellspacing", "nowrap", "hspace", "vspace", "clear",
+];
+
+// Removes scripts, stylesheets and templates, and elements hidden with the
+// hidden attribute or an inline display:none, so that their text doesn't leak
+// into the markdown. Retailer markup often carries such elements. Presentational
+// attributes and classes are dropped from the rest, except the classes of code
+// blocks, which name their language.
+pub(crate) fn sanitize(nodes: &mut Vec<Node>) {
+    nodes.retain(|node| match node {
+        Node::Element(el) => !DROPPED.iter().any(|name| el.is(name)) && !is_hidden(el),
+        _ => true,
+    });
+    for node in nodes.iter_mut() {
+        if let Node::Element(el) = node {
+            let keep_class = el.is("pre") || el.is("code");
+            el.attrs.retain(|(name, _)| {
+                let name = name.to_ascii_lowercase();
+                !PRESENTATIONAL.contains(&name.as_str()) && (keep_class || name != "class")
+            });
+            sanitize(&mut el.children);
+        }
+    }
+}
+
+fn is_hidden(el: &Element) -> bool {
+    if el.attr("hidden").is_some() {
+        return true;
+    }
+    let Some(style) = el.attr("style") else {
+        return false;
+    };
+    style.split(';').any(|declaration| {
+        let Some((property, value)) = declaration.split_once(':') else {
+            return false;
+        };
+        let value = value.trim().trim_end_matches("!important").trim_end();
+        property.trim().eq_ignore_ascii_case("display") && value.eq_ignore_ascii_case("none")
+    })
+}
@@ -0,0 +1,102 @@
+use crate::chapter::Chapter;
+use crate::text;
+use anyhow::{Context, Result};
+use regex::{Regex, RegexBuilder};
+use serde::Serialize;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SearchOptions {
+    /// Match regardless of case.
+    pub ignore_case: bool,
+    /// Read the pattern as a regular expression rather than literal text.
+    pub regex: bool,
+    /// Lines kept before and after each matching line.
+    pub context: usize,
+}
+
+impl Default for SearchOptions {
+    fn default() -> Self {
+        SearchOptions {
+            ignore_case: false,
+            regex: false,
+            context: 2,
+        }
+    }
+}
+
+// A line of a chapter's plain text that matched, see `text::to_text`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct SearchMatch {
+    /// Position of the chapter in the spine, counting from 1.
+    pub index: usize,
+    pub href: String,
+    /// The TOC title, or failing that the chapter's first heading.
+    pub title: String,
+    /// Line number in the chapter's plain text, counting from 1.
+    pub line: usize,
+    pub text: String,
+    /// Up to `context` lines before and after the match.
+    pub before: Vec<String>,
+    pub after: Vec<String>,
+}
+
+// A compiled search pattern.
+#[derive(Debug, Clone)]
+pub struct Pattern {
+    kind: Kind,
+}
+
+#[derive(Debug, Clone)]
+enum Kind {
+    Literal(String),
+    /// Compared against lowercased lines.
+    LiteralIgnoreCase(String),
+    Regex(Regex),
+}
+
+impl Pattern {
+    pub fn new(pattern: &str, options: &SearchOptions) -> Result<Pattern> {
+        let kind = match (options.regex, options.ignore_case) {
+            (true, ignore_case) => {
+                let regex = RegexBuilder::new(pattern)
+                    .case_insensitive(ignore_case)
+                    .build()
+                    .with_context(|| format!("Invalid pattern {:?}", pattern))?;
+                Kind::Regex(regex)
+            }
+            (false, true) => Kind::LiteralIgnoreCase(pattern.to_lowercase()),
+            (false, false) => Kind::Literal(pattern.to_string()),
+        };
+        Ok(Pattern { kind })
+    }
+
+    pub fn is_match(&self, line: &str) -> bool {
+        match &self.kind {
+            Kind::Literal(literal) => line.contains(literal.as_str()),
+            Kind::LiteralIgnoreCase(literal) => line.to_lowercase().contains(literal.as_str()),
+            Kind::Regex(regex) => regex.is_match(line),
+        }
+    }
+}
+
+// Every line of the chapter's plain text that matches, in order.
+pub fn search_chapter(chapter: &Chapter, pattern: &Pattern, context: usize) -> Vec<SearchMatch> {
+    let text = text::to_text(&chapter.markdown);
+    let lines: Vec<&str> = text.lines().collect();
+    let title = chapter.display_title();
+    let owned = |lines: &[&str]| lines.iter().map(|line| line.to_string()).collect();
+    lines
+        .iter()
+        .enumerate()
+        .filter(|(_, line)| pattern.is_match(line))
+        .map(|(i, line)| SearchMatch {
+            index: chapter.index,
+            href: chapter.href.clone(),
+            title: title.clone(),
+            line: i + 1,
+            text: line.to_string(),
+            before: owned(&lines[i.saturating_sub(context)..i]),
+            after: owned(&lines[i + 1..(i + 1 + context).min(lines.len())]),
+        })
+        .collect()
+}
@@ -0,0 +1,63 @@
+use std::collections::HashMap;
+
+// The anchor GitHub generates for a heading: the rendered text lowercased,
+// with punctuation dropped and spaces turned into hyphens. Letters and digits
+// in any script are kept, so "猫と鼠" stays "猫と鼠".
+pub fn slug(heading: &str) -> String {
+    let mut slug = String::new();
+    for c in plain_text(heading).chars().flat_map(char::to_lowercase) {
+        if c.is_alphanumeric() || c == '-' || c == '_' {
+            slug.push(c);
+        } else if c == ' ' {
+            slug.push('-');
+        }
+    }
+    slug
+}
+
+// Strips the inline markup html2md produces from heading text: escapes,
+// emphasis and code markers, and link targets.
+fn plain_text(heading: &str) -> String {
+    let mut text = String::new();
+    let mut chars = heading.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' => text.extend(chars.next()),
+            '*' | '`' | '[' => {}
+            '!' if chars.peek() == Some(&'[') => {}
+            ']' if chars.peek() == Some(&'(') => {
+                for c in chars.by_ref() {
+                    if c == ')' {
+                        break;
+                    }
+                }
+            }
+            ']' => {}
+            c => text.push(c),
+        }
+    }
+    text
+}
+
+// Hands out heading anchors the way GitHub does when the same heading text
+// occurs more than once: "notes", "notes-1", "notes-2", ... A suffixed anchor
+// that another heading already has is skipped, so "Notes", "Notes 1", "Notes"
+// get "notes", "notes-1" and "notes-2".
+#[derive(Debug, Clone, Default)]
+pub struct Slugger {
+    seen: HashMap<String, usize>,
+}
+
+impl Slugger {
+    pub fn next(&mut self, heading: &str) -> String {
+        let base = slug(heading);
+        let mut unique = base.clone();
+        while self.seen.contains_key(&unique) {
+            let count = self.seen.get_mut(&base).expect("the base slug is seen first");
+            *count += 1;
+            unique = format!("{}-{}", base, count);
+        }
+        self.seen.insert(unique.clone(), 0);
+        unique
+    }
+}
@@ -0,0 +1,373 @@
+use crate::chapter::Chapter;
+use crate::json;
+use crate::items::Items;
+use crate::links;
+use crate::markdown::first_heading;
+use crate::metadata::Metadata;
+use crate::normalize::{normalize, LineEnding};
+use crate::zip::ZipWriter;
+use crate::create_output;
+use anyhow::{Context, Result};
+use std::collections::HashSet;
+use std::fmt;
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process;
+use std::str::FromStr;
+
+// The files written next to the chapters.
+const RESERVED: &[&str] = &["index.md", "index.json"];
+
+// The longest slug the chapter file names use, in bytes: a whole paragraph
+// taken for a heading would otherwise run past the 255 bytes most
+// filesystems allow a name.
+const MAX_SLUG: usize = 60;
+
+// Path separators, and the other characters Windows doesn't allow in file
+// names.
+const RESERVED_CHARS: &[char] = &['/', '\\', '<', '>', ':', '"', '|', '?', '*'];
+
+pub fn slugify(text: &str) -> String {
+    let mut slug = String::new();
+    for c in text.chars().flat_map(char::to_lowercase) {
+        if c.is_alphanumeric() {
+            slug.push(c);
+        } else if !slug.is_empty() && !slug.ends_with('-') {
+            slug.push('-');
+        }
+    }
+    slug.trim_end_matches('-').to_string()
+}
+
+// Builds "NN-slug.md" names in spine order. The index keeps them apart when
+// two chapters share a slug.
+pub fn chapter_filenames(chapters: &[Chapter]) -> Vec<String> {
+    let width = chapters.len().to_string().len().max(2);
+    chapters
+        .iter()
+        .enumerate()
+        .map(|(idx, chapter)| format!("{:0width$}-{}.md", idx + 1, chapter_slug(chapter), width = width))
+        .collect()
+}
+
+// The chapter files' names: from `template` when there is one, and otherwise
+// as `chapter_filenames` builds them. When the template gives two chapters the
+// same name, as it does chapters sharing a title without {index}, the later
+// ones get -2, -3, ... before the extension. A name index.md or index.json
+// uses is an error.
+pub fn file_names(chapters: &[Chapter], template: Option<&NameTemplate>, book: &NameContext) -> Result<Vec<String>> {
+    let Some(template) = template else {
+        return Ok(chapter_filenames(chapters));
+    };
+    let mut seen = HashSet::new();
+    let mut names = Vec::new();
+    for (idx, chapter) in chapters.iter().enumerate() {
+        let name = template.render(idx + 1, chapter, book);
+        if name.is_empty() || name == "." || name == ".." {
+            anyhow::bail!("File name template {} gives chapter {} no file name", template, idx + 1);
+        }
+        if RESERVED.contains(&name.as_str()) {
+            anyhow::bail!("File name template {} names chapter {} {}, which the index uses", template, idx + 1, name);
+        }
+        names.push(unique_name(&name, &mut seen));
+    }
+    Ok(names)
+}
+
+// `name`, or when `seen` already has it, the first of "stem-2.ext",
+// "stem-3.ext", ... it doesn't have. Adds the name returned to `seen`.
+fn unique_name(name: &str, seen: &mut HashSet<String>) -> String {
+    let (stem, extension) = match name.rfind('.') {
+        Some(dot) if dot > 0 => name.split_at(dot),
+        _ => (name, ""),
+    };
+    let mut unique = name.to_string();
+    let mut n = 2;
+    while !seen.insert(unique.clone()) {
+        unique = format!("{}-{}{}", stem, n, extension);
+        n += 1;
+    }
+    unique
+}
+
+// The slug of a chapter's first heading, or of its title when it has none,
+// cut to at most MAX_SLUG bytes at the last word that fits.
+fn chapter_slug(chapter: &Chapter) -> String {
+    let label = first_heading(&chapter.markdown).unwrap_or_else(|| chapter.title.clone());
+    let mut slug = slugify(&label);
+    if slug.len() > MAX_SLUG {
+        let mut end = MAX_SLUG;
+        while !slug.is_char_boundary(end) {
+            end -= 1;
+        }
+        let cut = match slug[end..].starts_with('-') {
+            true => end,
+            false => slug[..end].rfind('-').unwrap_or(end),
+        };
+        slug.truncate(cut);
+    }
+    match slug {
+        s if s.is_empty() => "chapter".to_string(),
+        s => s,
+    }
+}
+
+// A file name pattern for the chapter files, such as "{index:03}_{slug}.md".
+// The fields are `{index}`, the chapter's position among the files counting
+// from 1, optionally zero-padded to a width as in `{index:03}`; `{title}`, its
+// title; `{slug}`, the slug the default names use; `{href}`, the file name of
+// its href without the extension; `{idref}`, its spine item's id; and
+// `{book_title}`, the book's title. `{{` and `}}` are literal braces. The
+// files all go in the one folder, so a template can't hold a path separator
+// or a character Windows doesn't allow in file names, and those in a field's
+// value become `-`. The default names are "{index:02}-{slug}.md".
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct NameTemplate {
+    template: String,
+    parts: Vec<Part>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum Part {
+    Text(String),
+    /// The index, zero-padded to this width.
+    Index(usize),
+    Title,
+    Slug,
+    Href,
+    Idref,
+    BookTitle,
+}
+
+// What a template can say about the book, beyond the chapters themselves.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct NameContext {
+    pub book_title: String,
+    /// The spine's idrefs in order, which `Chapter::index` counts.
+    pub idrefs: Vec<String>,
+}
+
+impl NameContext {
+    pub fn new(metadata: &Metadata, items: &Items) -> NameContext {
+        NameContext {
+            book_title: metadata.title.clone().unwrap_or_default(),
+            idrefs: items.spine.iter().map(|item| item.id.clone()).collect(),
+        }
+    }
+}
+
+impl NameTemplate {
+    pub fn render(&self, index: usize, chapter: &Chapter, book: &NameContext) -> String {
+        let mut name = String::new();
+        for part in &self.parts {
+            match part {
+                Part::Text(text) => name.push_str(text),
+                Part::Index(width) => name.push_str(&format!("{:0width$}", index, width = width)),
+                Part::Title => name.push_str(&file_safe(&chapter.title)),
+                Part::Slug => name.push_str(&chapter_slug(chapter)),
+                Part::Href => {
+                    let stem = Path::new(&chapter.href).file_stem().unwrap_or_default();
+                    name.push_str(&file_safe(&stem.to_string_lossy()));
+                }
+                Part::Idref => {
+                    let idref = chapter.index.checked_sub(1).and_then(|i| book.idrefs.get(i));
+                    name.push_str(&file_safe(idref.map_or("", String::as_str)));
+                }
+                Part::BookTitle => name.push_str(&file_safe(&book.book_title)),
+            }
+        }
+        name
+    }
+}
+
+fn is_reserved(c: char) -> bool {
+    RESERVED_CHARS.contains(&c) || c.is_control()
+}
+
+// A field's value with the characters a file name can't hold turned into `-`.
+fn file_safe(value: &str) -> String {
+    value.trim().chars().map(|c| if is_reserved(c) { '-' } else { c }).collect()
+}
+
+impl FromStr for NameTemplate {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = |reason: String| format!("invalid file name template {} ({})", s, reason);
+        let mut parts = Vec::new();
+        let mut text = String::new();
+        let mut chars = s.chars().peekable();
+        while let Some(c) = chars.next() {
+            match c {
+                '{' if chars.next_if_eq(&'{').is_some() => text.push('{'),
+                '}' if chars.next_if_eq(&'}').is_some() => text.push('}'),
+                '}' => return Err(invalid("a } without its {; write }} for a brace".to_string())),
+                '{' => {
+                    let mut field = String::new();
+                    loop {
+                        match chars.next() {
+                            Some('}') => break,
+                            Some(c) => field.push(c),
+                            None => return Err(invalid(format!("{{{} isn't closed", field))),
+                        }
+                    }
+                    if !text.is_empty() {
+                        parts.push(Part::Text(std::mem::take(&mut text)));
+                    }
+                    parts.push(parse_field(&field).map_err(invalid)?);
+                }
+                c if is_reserved(c) => return Err(invalid(format!("{:?} can't be part of a file name", c))),
+                c => text.push(c),
+            }
+        }
+        if !text.is_empty() {
+            parts.push(Part::Text(text));
+        }
+        Ok(NameTemplate {
+            template: s.to_string(),
+            parts,
+        })
+    }
+}
+
+fn parse_field(field: &str) -> Result<Part, String> {
+    let (name, width) = match field.split_once(':') {
+        Some((name, width)) => (name.trim(), Some(width.trim())),
+        None => (field.trim(), None),
+    };
+    let part = match name {
+        "index" => {
+            let width = match width {
+                None => 0,
+                Some(width) => width
+                    .strip_prefix('0')
+                    .and_then(|digits| digits.parse().ok())
+                    .ok_or_else(|| format!("the width in {{{}}} isn't a 0 followed by a number, as in 03", field))?,
+            };
+            return Ok(Part::Index(width));
+        }
+        "title" => Part::Title,
+        "slug" => Part::Slug,
+        "href" => Part::Href,
+        "idref" => Part::Idref,
+        "book_title" => Part::BookTitle,
+        _ => return Err(format!("unknown field {{{}}}; expected index, title, slug, href, idref or book_title", name)),
+    };
+    match width {
+        None => Ok(part),
+        Some(_) => Err(format!("only {{index}} takes a width, not {{{}}}", name)),
+    }
+}
+
+impl fmt::Display for NameTemplate {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.template)
+    }
+}
+
+// The files `write_chapters` writes, as (file name, contents): one per
+// chapter under its name from `file_names`, with links between chapters
+// pointing at the files, then index.md.
+pub fn chapter_files(chapters: &[Chapter], names: &[String], line_ending: LineEnding) -> Vec<(String, String)> {
+    let mut files = Vec::new();
+    let mut index = String::from("# Contents\n\n");
+    for (chapter, name) in chapters.iter().zip(names) {
+        files.push((name.clone(), normalize(&links::to_files(chapter, chapters, names), line_ending)));
+        let label = match chapter.title.as_str() {
+            "" => name.trim_end_matches(".md"),
+            title => title,
+        };
+        index.push_str(&format!("- [{}]({})\n", label, name));
+    }
+    files.push(("index.md".to_string(), normalize(&index, line_ending)));
+    files
+}
+
+pub fn write_chapters(
+    chapters: &[Chapter],
+    names: &[String],
+    dir: &Path,
+    force: bool,
+    line_ending: LineEnding,
+) -> Result<Vec<PathBuf>> {
+    fs::create_dir_all(dir).with_context(|| format!("Failed to create {}", dir.display()))?;
+    let mut paths = Vec::new();
+    for (name, contents) in chapter_files(chapters, names, line_ending) {
+        let path = dir.join(name);
+        let mut file = create_output(&path, force)?;
+        file.write_all(contents.as_bytes()).with_context(|| format!("Failed to write {}", path.display()))?;
+        paths.push(path);
+    }
+    Ok(paths)
+}
+
+// The index.json `write_index_json` writes.
+pub fn index_json(metadata: &Metadata, chapters: &[Chapter], names: &[String]) -> String {
+    json::split_index_to_json(metadata, chapters, names, true) + "\n"
+}
+
+// Writes index.json next to the files from `write_chapters`, for tools that
+// want the chapter files and book metadata without reading the EPUB again.
+pub fn write_index_json(
+    metadata: &Metadata,
+    chapters: &[Chapter],
+    names: &[String],
+    dir: &Path,
+    force: bool,
+) -> Result<PathBuf> {
+    let path = dir.join("index.json");
+    let mut file = create_output(&path, force)?;
+    file.write_all(index_json(metadata, chapters, names).as_bytes())
+        .with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(path)
+}
+
+// The split output as one zip, for sharing a converted book as a single file:
+// the files from `chapter_files`, index.json, and the images `images::extract`
+// wrote into `images` under images/, where the chapters' links point.
+pub fn bundle(
+    metadata: &Metadata,
+    chapters: &[Chapter],
+    names: &[String],
+    images: Option<&Path>,
+    line_ending: LineEnding,
+) -> Result<Vec<u8>> {
+    let mut zip = ZipWriter::default();
+    for (name, contents) in chapter_files(chapters, names, line_ending) {
+        zip.add(&name, contents.as_bytes())?;
+    }
+    zip.add("index.json", index_json(metadata, chapters, names).as_bytes())?;
+    if let Some(dir) = images.filter(|dir| dir.is_dir()) {
+        let mut paths = Vec::new();
+        for entry in fs::read_dir(dir).with_context(|| format!("Failed to read {}", dir.display()))? {
+            paths.push(entry.with_context(|| format!("Failed to read {}", dir.display()))?.path());
+        }
+        paths.sort();
+        for path in paths {
+            let bytes = fs::read(&path).with_context(|| format!("Failed to read {}", path.display()))?;
+            zip.add(&format!("images/{}", path.file_name().unwrap_or_default().to_string_lossy()), &bytes)?;
+        }
+    }
+    zip.finish()
+}
+
+// Writes a zip from `bundle` by writing a temporary file next to `path` and
+// renaming it into place, so an interrupted run leaves no half-written bundle.
+pub fn write_bundle(bundle: &[u8], path: &Path, force: bool) -> Result<()> {
+    if !force && path.exists() {
+        anyhow::bail!("Output file {} already exists", path.display());
+    }
+    let mut tmp = path.as_os_str().to_os_string();
+    tmp.push(format!(".{}.tmp", process::id()));
+    let tmp = PathBuf::from(tmp);
+    let written = create_output(&tmp, true).and_then(|mut file| {
+        let written = file.write_all(bundle).and_then(|_| file.sync_all());
+        written.with_context(|| format!("Failed to write {}", tmp.display()))
+    });
+    if let Err(e) = written {
+        let _ = fs::remove_file(&tmp);
+        return Err(e);
+    }
+    fs::rename(&tmp, path).with_context(|| format!("Failed to write {}", path.display()))
+}
@@ -0,0 +1,175 @@
+use crate::chapter::Chapter;
+use crate::text;
+use serde::Serialize;
+
+/// Average silent reading speed used for the reading time estimate.
+pub const WORDS_PER_MINUTE: usize = 200;
+
+// Word, character and image counts for a converted book, as printed by
+// --stats and included in --format json.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct BookStats {
+    pub words: usize,
+    pub characters: usize,
+    pub images: usize,
+    /// Estimated reading time at `words_per_minute`, rounded up.
+    pub minutes: usize,
+    pub words_per_minute: usize,
+    pub chapters: Vec<ChapterStats>,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct ChapterStats {
+    /// Position in the spine, counting from 1.
+    pub index: usize,
+    pub href: String,
+    /// The TOC title, or failing that the chapter's first heading.
+    pub title: String,
+    pub words: usize,
+    /// Characters of the chapter's plain text, with each run of whitespace
+    /// counted as one.
+    pub characters: usize,
+    pub images: usize,
+    pub minutes: usize,
+}
+
+impl BookStats {
+    pub fn new(chapters: &[Chapter]) -> Self {
+        BookStats::with_words_per_minute(chapters, WORDS_PER_MINUTE)
+    }
+
+    pub fn with_words_per_minute(chapters: &[Chapter], words_per_minute: usize) -> Self {
+        let words_per_minute = words_per_minute.max(1);
+        let chapters: Vec<ChapterStats> = chapters
+            .iter()
+            .map(|chapter| {
+                let words = word_count(&chapter.markdown);
+                ChapterStats {
+                    index: chapter.index,
+                    href: chapter.href.clone(),
+                    title: chapter.display_title(),
+                    words,
+                    characters: character_count(&chapter.markdown),
+                    images: image_count(&chapter.markdown),
+                    minutes: words.div_ceil(words_per_minute),
+                }
+            })
+            .collect();
+        let words = chapters.iter().map(|chapter| chapter.words).sum::<usize>();
+        BookStats {
+            words,
+            characters: chapters.iter().map(|chapter| chapter.characters).sum(),
+            images: chapters.iter().map(|chapter| chapter.images).sum(),
+            minutes: words.div_ceil(words_per_minute),
+            words_per_minute,
+            chapters,
+        }
+    }
+
+    // A table of the chapters' counts followed by the totals, e.g.
+    //
+    //       #  words  chars  images  min  chapter
+    //       1   1204   6791       2    7  The Harbour
+    //       2    873   4802       0    5  ch2.xhtml
+    //   total   2077  11593       2   11  at 200 words a minute
+    pub fn table(&self) -> String {
+        let words = self.words.to_string().len().max("words".len());
+        let chars = self.characters.to_string().len().max("chars".len());
+        let images = self.images.to_string().len().max("images".len());
+        let minutes = self.minutes.to_string().len().max("min".len());
+        let mut out = format!(
+            "{:>5}  {:>words$}  {:>chars$}  {:>images$}  {:>minutes$}  chapter\n",
+            "#", "words", "chars", "images", "min"
+        );
+        for chapter in &self.chapters {
+            let name = match chapter.title.is_empty() {
+                true => &chapter.href,
+                false => &chapter.title,
+            };
+            out.push_str(&format!(
+                "{:>5}  {:>words$}  {:>chars$}  {:>images$}  {:>minutes$}  {}\n",
+                chapter.index, chapter.words, chapter.characters, chapter.images, chapter.minutes, name
+            ));
+        }
+        out.push_str(&format!(
+            "{:>5}  {:>words$}  {:>chars$}  {:>images$}  {:>minutes$}  at {} words a minute\n",
+            "total", self.words, self.characters, self.images, self.minutes, self.words_per_minute
+        ));
+        out
+    }
+
+    pub fn to_json(&self, pretty: bool) -> String {
+        let json = match pretty {
+            true => serde_json::to_string_pretty(self),
+            false => serde_json::to_string(self),
+        };
+        json.expect("stats always serialize")
+    }
+}
+
+pub fn reading_minutes(words: usize) -> usize {
+    words.div_ceil(WORDS_PER_MINUTE)
+}
+
+// Counts the words a reader would read: code blocks, markup and link and image
+// URLs don't count, and neither do leftover symbols such as list markers.
+pub fn word_count(markdown: &str) -> usize {
+    plain_text(markdown).split_whitespace().filter(|word| word.chars().any(char::is_alphanumeric)).count()
+}
+
+fn character_count(markdown: &str) -> usize {
+    let text = plain_text(markdown);
+    let words: Vec<&str> = text.split_whitespace().collect();
+    words.iter().map(|word| word.chars().count()).sum::<usize>() + words.len().saturating_sub(1)
+}
+
+// Images in markdown syntax and those left as <img> tags, in tables kept as
+// HTML for example.
+fn image_count(markdown: &str) -> usize {
+    let prose = prose(markdown);
+    prose.matches("![").count() + prose.matches("<img").count()
+}
+
+// The text of the markdown outside code blocks, without the tags of any HTML
+// left in it, such as tables kept as HTML.
+fn plain_text(markdown: &str) -> String {
+    let text = text::to_text(&prose(markdown));
+    let mut out = String::with_capacity(text.len());
+    let mut rest = text.as_str();
+    while let Some(start) = rest.find('<') {
+        out.push_str(&rest[..start]);
+        let tag = &rest[start + 1..];
+        let is_tag = tag.starts_with(|c: char| c.is_ascii_alphabetic() || c == '/');
+        match tag.find('>').filter(|_| is_tag) {
+            Some(end) => {
+                // A tag separates words like the space it usually stands for.
+                out.push(' ');
+                rest = &tag[end + 1..];
+            }
+            None => {
+                out.push('<');
+                rest = tag;
+            }
+        }
+    }
+    out.push_str(rest);
+    out
+}
+
+// The markdown without its code blocks.
+fn prose(markdown: &str) -> String {
+    let mut prose = String::with_capacity(markdown.len());
+    let mut in_code = false;
+    for line in markdown.lines() {
+        let trimmed = line.trim_start();
+        if trimmed.starts_with("```") || trimmed.starts_with("~~~") {
+            in_code = !in_code;
+            continue;
+        }
+        if !in_code {
+            prose.push_str(line);
+            prose.push('\n');
+        }
+    }
+    prose
+}
@@ -0,0 +1,48 @@
+use crate::dom::{self, Element, Node};
+use std::slice;
+
+// html2md always turns tables into pipe tables. Tables a pipe table can't
+// represent, and every table when GFM tables are off, are swapped for a
+// placeholder paragraph before conversion and their markup is put back
+// afterwards, leaving them as HTML blocks.
+pub(crate) fn hide(nodes: &mut [Node], all: bool) -> Vec<(String, String)> {
+    let mut tables = Vec::new();
+    hide_in(nodes, all, &mut tables);
+    tables
+}
+
+fn hide_in(nodes: &mut [Node], all: bool, tables: &mut Vec<(String, String)>) {
+    for node in nodes.iter_mut() {
+        let is_table = matches!(node, Node::Element(el) if el.is("table") && (all || is_complex(el)));
+        if is_table {
+            let placeholder = format!("CIPHERTABLE{}X", tables.len());
+            tables.push((placeholder.clone(), dom::serialize(slice::from_ref(node))));
+            let mut paragraph = Element::new("p");
+            paragraph.children.push(Node::Text(placeholder));
+            *node = Node::Element(paragraph);
+        } else if let Node::Element(el) = node {
+            hide_in(&mut el.children, all, tables);
+        }
+    }
+}
+
+// Whether the table has cells spanning several rows or columns, or another
+// table inside it; pipe tables have neither.
+fn is_complex(table: &Element) -> bool {
+    let mut complex = false;
+    dom::walk(&table.children, &mut |el| {
+        let spans = ["rowspan", "colspan"].iter().any(|attr| {
+            el.attr(attr).and_then(|n| n.trim().parse::<usize>().ok()).is_some_and(|n| n > 1)
+        });
+        complex |= el.is("table") || ((el.is("td") || el.is("th")) && spans);
+    });
+    complex
+}
+
+pub(crate) fn restore(markdown: &str, tables: &[(String, String)]) -> String {
+    let mut markdown = markdown.to_string();
+    for (placeholder, html) in tables {
+        markdown = markdown.replace(placeholder, html);
+    }
+    markdown
+}
@@ -0,0 +1,201 @@
+use crate::render::{is_rule, is_setext_underline};
+
+// Reduces converted markdown to plain text for text-to-speech or word counts.
+// Headings become plain lines, list items "- " lines at any depth, links their
+// text and images their alt text. The front matter, rules and code fences are
+// dropped, and paragraphs stay separated by a blank line.
+pub fn to_text(markdown: &str) -> String {
+    let lines: Vec<&str> = markdown.lines().collect();
+    let mut out: Vec<String> = Vec::new();
+    let mut in_code = false;
+    let mut i = 0;
+    if lines.first() == Some(&"---") {
+        if let Some(end) = lines.iter().skip(1).position(|l| *l == "---") {
+            i = end + 2;
+        }
+    }
+    while i < lines.len() {
+        let line = lines[i];
+        let trimmed = line.trim();
+        i += 1;
+
+        if trimmed.starts_with("```") || trimmed.starts_with("~~~") {
+            in_code = !in_code;
+            continue;
+        }
+        if in_code {
+            out.push(line.to_string());
+            continue;
+        }
+        if let Some(next) = lines.get(i) {
+            if !trimmed.is_empty() && is_setext_underline(next) {
+                out.push(inline(trimmed));
+                i += 1;
+                continue;
+            }
+        }
+        if trimmed.starts_with('#') {
+            out.push(inline(trimmed.trim_start_matches('#').trim_end_matches('#').trim()));
+        } else if is_rule(trimmed) {
+            out.push(String::new());
+        } else if trimmed.starts_with('>') {
+            out.push(inline(trimmed.trim_start_matches(|c: char| c == '>' || c.is_whitespace())));
+        } else if let Some(item) = list_item(trimmed) {
+            out.push(format!("- {}", inline(item)));
+        } else if trimmed.starts_with('|') {
+            if let Some(row) = table_row(trimmed) {
+                out.push(row);
+            }
+        } else if let Some((number, note)) = footnote(trimmed) {
+            out.push(format!("[{}] {}", number, inline(note)));
+        } else {
+            out.push(inline(trimmed));
+        }
+    }
+
+    // Dropped lines can leave runs of blank lines behind.
+    let mut text = String::new();
+    let mut blank = true;
+    for line in out {
+        let line = line.trim_end();
+        if line.is_empty() {
+            if !blank {
+                text.push('\n');
+            }
+            blank = true;
+            continue;
+        }
+        text.push_str(line);
+        text.push('\n');
+        blank = false;
+    }
+    let len = text.trim_end().len();
+    text.truncate(len);
+    text.push('\n');
+    text
+}
+
+// Bullets and ordered items alike.
+fn list_item(line: &str) -> Option<&str> {
+    if let Some(item) = ["* ", "- ", "+ "].iter().find_map(|marker| line.strip_prefix(marker)) {
+        return Some(item);
+    }
+    let digits = line.find(|c: char| !c.is_ascii_digit())?;
+    match digits {
+        0 => None,
+        _ => line[digits..].strip_prefix(". ").or_else(|| line[digits..].strip_prefix(") ")),
+    }
+}
+
+// The cells of a pipe table row separated by tabs, or None for the
+// delimiter row under the header.
+fn table_row(line: &str) -> Option<String> {
+    let inner = line.trim_matches('|');
+    if inner.chars().all(|c| matches!(c, '-' | ':' | '|' | ' ')) {
+        return None;
+    }
+    Some(inner.split('|').map(|cell| inline(cell.trim())).collect::<Vec<_>>().join("\t"))
+}
+
+// A footnote definition, "[^1]: text".
+fn footnote(line: &str) -> Option<(&str, &str)> {
+    let (number, note) = line.strip_prefix("[^")?.split_once("]:")?;
+    Some((number, note.trim_start()))
+}
+
+// Strips inline markup: escapes, code spans, emphasis, strikethrough, links
+// and images.
+fn inline(text: &str) -> String {
+    let chars: Vec<char> = text.chars().collect();
+    let mut out = String::new();
+    let mut i = 0;
+    while i < chars.len() {
+        let c = chars[i];
+        if c == '\\' && chars.get(i + 1).is_some_and(|n| n.is_ascii_punctuation()) {
+            out.push(chars[i + 1]);
+            i += 2;
+            continue;
+        }
+        if c == '`' {
+            let run = chars[i..].iter().take_while(|&&c| c == '`').count();
+            let fence: String = chars[i..i + run].iter().collect();
+            if let Some(end) = find(&chars, i + run, &fence) {
+                out.extend(chars[i + run..end].iter());
+                i = end + run;
+                continue;
+            }
+        }
+        if c == '~' && chars.get(i + 1) == Some(&'~') {
+            i += 2;
+            continue;
+        }
+        if c == '*' || c == '_' {
+            // A run of delimiters, unless it sits inside a word like snake_case.
+            let run = chars[i..].iter().take_while(|&&d| d == c).count();
+            let inside_word = i > 0
+                && chars[i - 1].is_alphanumeric()
+                && chars.get(i + run).is_some_and(|n| n.is_alphanumeric());
+            if !inside_word {
+                i += run;
+                continue;
+            }
+        }
+        if c == '[' && chars.get(i + 1) == Some(&'^') {
+            if let Some(end) = find(&chars, i + 2, "]") {
+                out.push('[');
+                out.extend(chars[i + 2..end].iter());
+                out.push(']');
+                i = end + 1;
+                continue;
+            }
+        }
+        let image = c == '!' && chars.get(i + 1) == Some(&'[');
+        if c == '[' || image {
+            let open = if image { i + 1 } else { i };
+            if let Some((close, end)) = link_end(&chars, open) {
+                let label: String = chars[open + 1..close].iter().collect();
+                out.push_str(&inline(&label));
+                i = end + 1;
+                continue;
+            }
+        }
+        out.push(c);
+        i += 1;
+    }
+    out
+}
+
+// Finds the "]" closing the label opened at `open` and the ")" closing the
+// target after it, allowing brackets and parentheses to nest.
+fn link_end(chars: &[char], open: usize) -> Option<(usize, usize)> {
+    let close = matching(chars, open, '[', ']')?;
+    if chars.get(close + 1) != Some(&'(') {
+        return None;
+    }
+    Some((close, matching(chars, close + 1, '(', ')')?))
+}
+
+fn matching(chars: &[char], open: usize, left: char, right: char) -> Option<usize> {
+    let mut depth = 0;
+    let mut i = open;
+    while i < chars.len() {
+        match chars[i] {
+            '\\' => i += 1,
+            c if c == left => depth += 1,
+            c if c == right => {
+                depth -= 1;
+                if depth == 0 {
+                    return Some(i);
+                }
+            }
+            _ => {}
+        }
+        i += 1;
+    }
+    None
+}
+
+fn find(chars: &[char], from: usize, needle: &str) -> Option<usize> {
+    let needle: Vec<char> = needle.chars().collect();
+    (from..chars.len()).find(|&i| chars[i..].starts_with(&needle))
+}
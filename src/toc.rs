@@ -0,0 +1,293 @@
+use crate::chapter::{self, Chapter};
+use crate::dom::{self, Element, Node};
+use crate::encoding;
+use crate::href;
+use crate::markdown;
+use crate::opf::Package;
+use crate::slug::Slugger;
+use crate::unreadable::EntryError;
+use epub::doc::{EpubDoc, NavPoint};
+use std::collections::HashSet;
+use std::io::{Read, Seek};
+use std::path::{Path, PathBuf};
+
+// Returns the book's navigation from the first source that has entries: the
+// EPUB3 nav document the manifest declares, then the NCX, and failing both, a
+// table of contents built from the spine (see `from_spine`). Entries pointing
+// at files the manifest doesn't list are left out with a warning, keeping the
+// entries nested under them, rather than losing the whole table.
+pub(crate) fn load<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Vec<NavPoint> {
+    let package = Package::load(doc).ok();
+    let files: HashSet<PathBuf> = doc.resources.values().map(|(path, _)| path.clone()).collect();
+    let nav_path = package.as_ref().and_then(|package| package.item_with_property("nav")).map(|item| item.path.clone());
+    if let Some(path) = nav_path {
+        if let Ok(bytes) = doc.get_resource_by_path(&path) {
+            let points = drop_dangling(parse_nav(&encoding::decode(&bytes), &path), &files);
+            if !points.is_empty() {
+                return points;
+            }
+        }
+    }
+    let mut points = doc.toc.clone();
+    if points.is_empty() {
+        // The epub crate gives up on an NCX that isn't well-formed, such as
+        // one cut short; the entries before the damage are still worth having.
+        let ncx = package.as_ref().and_then(|package| {
+            let id = package.toc_id.as_ref()?;
+            package.manifest.iter().find(|item| item.id == *id).map(|item| item.path.clone())
+        });
+        if let Some(path) = ncx {
+            if let Ok(bytes) = doc.get_resource_by_path(&path) {
+                points = parse_ncx(&encoding::decode(&bytes), &path);
+            }
+        }
+    }
+    let points = drop_dangling(points, &files);
+    if !points.is_empty() {
+        return points;
+    }
+    from_spine(doc)
+}
+
+// A table of contents for a book without one: an entry for each spine item,
+// in reading order, under the text of its first h1-h3 heading, its <title>,
+// or its file name.
+pub(crate) fn from_spine<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Vec<NavPoint> {
+    let paths: Vec<PathBuf> = doc.spine.iter().filter_map(|id| Some(doc.resources.get(id)?.0.clone())).collect();
+    let mut points = Vec::new();
+    for path in paths {
+        let own = doc.get_resource_by_path(&path).ok().and_then(|bytes| {
+            let html = encoding::decode(&bytes);
+            chapter::html_heading(&dom::parse(&html)).or_else(|| chapter::html_title(&html))
+        });
+        let href = path.strip_prefix(&doc.root_base).unwrap_or(&path).to_string_lossy().into_owned();
+        points.push(NavPoint {
+            label: chapter::resolve_title(None, own, &href),
+            content: path,
+            children: Vec::new(),
+            play_order: points.len() + 1,
+        });
+    }
+    points
+}
+
+// Leaves out the entries whose target isn't in the manifest, putting the
+// entries nested under one in its place. Entries without a target, such as
+// the headings some nav documents group entries under, stay.
+fn drop_dangling(points: Vec<NavPoint>, files: &HashSet<PathBuf>) -> Vec<NavPoint> {
+    keep_targets(points, files, &mut |label, path| {
+        warn!("leaving out the TOC entry \"{}\": {} is not in the manifest", label, path)
+    })
+}
+
+// The table of contents of the chapters in `files` alone, for a book only
+// some of whose chapters are converted, the entries for the others left out
+// as `drop_dangling` leaves them out.
+pub(crate) fn only_files(points: Vec<NavPoint>, files: &HashSet<PathBuf>) -> Vec<NavPoint> {
+    keep_targets(points, files, &mut |_, _| {})
+}
+
+fn keep_targets(points: Vec<NavPoint>, files: &HashSet<PathBuf>, dropped: &mut dyn FnMut(&str, &str)) -> Vec<NavPoint> {
+    let mut kept = Vec::new();
+    for mut point in points {
+        point.children = keep_targets(std::mem::take(&mut point.children), files, dropped);
+        let content = point.content.to_string_lossy().into_owned();
+        let (path, _) = href::split_fragment(&content);
+        let known = |path: &str| files.contains(Path::new(path));
+        if path.is_empty() || known(path) || known(&href::percent_decode(path)) {
+            kept.push(point);
+            continue;
+        }
+        dropped(&point.label.split_whitespace().collect::<Vec<_>>().join(" "), path);
+        kept.append(&mut point.children);
+    }
+    kept
+}
+
+// Reads the navigation document and NCX the package names, to tell one that
+// can't be read from a book without one; `load` falls back without a word.
+pub(crate) fn check<R: Read + Seek>(doc: &mut EpubDoc<R>) -> Result<(), EntryError> {
+    let Ok(package) = Package::load(doc) else {
+        return Ok(());
+    };
+    let ncx = package.toc_id.as_ref().and_then(|id| package.manifest.iter().find(|item| item.id == *id));
+    for item in package.item_with_property("nav").into_iter().chain(ncx) {
+        if let Err(e) = doc.get_resource_by_path(&item.path) {
+            return Err(EntryError(format!("Failed to read {}: {}", item.path.display(), e)));
+        }
+    }
+    Ok(())
+}
+
+// Parses the `<nav epub:type="toc">` list of an EPUB3 navigation document
+// into nav points whose content paths are archive paths, like the NCX ones.
+pub(crate) fn parse_nav(html: &str, nav_path: &Path) -> Vec<NavPoint> {
+    let nodes = dom::parse(html);
+    let mut navs = Vec::new();
+    dom::walk(&nodes, &mut |el| {
+        if el.is("nav") {
+            navs.push(el.clone());
+        }
+    });
+    let is_toc = |el: &Element| el.attr("epub:type").is_some_and(|t| t.split_whitespace().any(|t| t == "toc"));
+    let nav = match navs.iter().find(|el| is_toc(el)).or_else(|| navs.first()) {
+        Some(nav) => nav,
+        None => return Vec::new(),
+    };
+    let mut play_order = 0;
+    match child(&nav.children, "ol") {
+        Some(list) => parse_list(list, nav_path, &mut play_order),
+        None => Vec::new(),
+    }
+}
+
+// Parses the navMap of an NCX document into nav points with archive paths.
+pub(crate) fn parse_ncx(xml: &str, ncx_path: &Path) -> Vec<NavPoint> {
+    let nodes = dom::parse(xml);
+    let mut maps = Vec::new();
+    dom::walk(&nodes, &mut |el| {
+        if el.is("navMap") {
+            maps.push(el.clone());
+        }
+    });
+    match maps.first() {
+        Some(map) => parse_nav_points(&map.children, ncx_path),
+        None => Vec::new(),
+    }
+}
+
+fn parse_nav_points(nodes: &[Node], ncx_path: &Path) -> Vec<NavPoint> {
+    let mut points = Vec::new();
+    for node in nodes {
+        let point = match node {
+            Node::Element(el) if el.is("navPoint") => el,
+            _ => continue,
+        };
+        let label = child(&point.children, "navLabel").map(|el| el.text()).unwrap_or_default();
+        let content = child(&point.children, "content")
+            .and_then(|el| el.attr("src"))
+            .map(|src| resolve_target(ncx_path, src))
+            .unwrap_or_default();
+        points.push(NavPoint {
+            label,
+            content,
+            children: parse_nav_points(&point.children, ncx_path),
+            play_order: point.attr("playOrder").and_then(|n| n.parse().ok()).unwrap_or(0),
+        });
+    }
+    points
+}
+
+// Resolves a navigation href to an archive path, keeping the fragment.
+fn resolve_target(base: &Path, target: &str) -> PathBuf {
+    let Some(path) = href::resolve(base, target) else {
+        return PathBuf::new();
+    };
+    match href::split_fragment(target) {
+        (_, Some(fragment)) => PathBuf::from(format!("{}#{}", path.to_string_lossy(), fragment)),
+        _ => path,
+    }
+}
+
+fn parse_list(list: &Element, nav_path: &Path, play_order: &mut usize) -> Vec<NavPoint> {
+    let mut points = Vec::new();
+    for node in &list.children {
+        let item = match node {
+            Node::Element(el) if el.is("li") => el,
+            _ => continue,
+        };
+        let label_el = child(&item.children, "a").or_else(|| child(&item.children, "span"));
+        let label = label_el.map(|el| el.text()).unwrap_or_default();
+        let content = label_el
+            .and_then(|el| el.attr("href"))
+            .map(|target| resolve_target(nav_path, target))
+            .unwrap_or_default();
+        *play_order += 1;
+        let order = *play_order;
+        let children = match child(&item.children, "ol") {
+            Some(sublist) => parse_list(sublist, nav_path, play_order),
+            None => Vec::new(),
+        };
+        points.push(NavPoint {
+            label,
+            content,
+            children,
+            play_order: order,
+        });
+    }
+    points
+}
+
+// The first element called `name` directly below `nodes`, looking through
+// wrappers such as `<div>` that some generators put around the list.
+fn child<'a>(nodes: &'a [Node], name: &str) -> Option<&'a Element> {
+    nodes.iter().find_map(|node| match node {
+        Node::Element(el) if el.is(name) => Some(el),
+        Node::Element(el) if !el.is("ol") && !el.is("li") && !el.is("a") => child(&el.children, name),
+        _ => None,
+    })
+}
+
+// Renders the navigation as a nested markdown list. Entries link to their
+// fragment when they have one, so they resolve once anchors exist in the
+// merged document, and to the chapter href otherwise.
+pub(crate) fn render(points: &[NavPoint], root_base: &Path) -> String {
+    let mut out = String::new();
+    render_level(points, root_base, 0, &mut out);
+    out
+}
+
+fn render_level(points: &[NavPoint], root_base: &Path, depth: usize, out: &mut String) {
+    let mut points: Vec<&NavPoint> = points.iter().collect();
+    points.sort_by_key(|point| point.play_order);
+    for point in points {
+        let label = point.label.split_whitespace().collect::<Vec<_>>().join(" ");
+        if !label.is_empty() {
+            out.push_str(&format!("{}- [{}]({})\n", "  ".repeat(depth), escape_label(&label), target(point, root_base)));
+        }
+        render_level(&point.children, root_base, depth + 1, out);
+    }
+}
+
+fn target(point: &NavPoint, root_base: &Path) -> String {
+    let content = point.content.strip_prefix(root_base).unwrap_or(&point.content);
+    let content = content.to_string_lossy();
+    match content.split_once('#') {
+        Some((_, fragment)) if !fragment.is_empty() => format!("#{}", fragment),
+        _ => content.replace(' ', "%20"),
+    }
+}
+
+// A table of contents for the combined document built from the converted
+// chapters rather than the book's navigation, so it only lists what was
+// converted and links to heading anchors. Each chapter is an entry under its
+// title, linking to its first heading; headings below that one become nested
+// entries, `depth` levels deep in all. The anchors are handed out in the same
+// order as `links::merge`, so they match the ones links use.
+pub(crate) fn generate(chapters: &[Chapter], depth: usize) -> String {
+    let mut slugger = Slugger::default();
+    let mut out = String::new();
+    for chapter in chapters {
+        let outline = markdown::outline(&chapter.markdown);
+        let anchors: Vec<String> = outline.iter().map(|(_, text)| slugger.next(text)).collect();
+        let title = escape_label(&chapter.title);
+        match anchors.first() {
+            Some(anchor) => out.push_str(&format!("- [{}](#{})\n", title, anchor)),
+            None => out.push_str(&format!("- {}\n", title)),
+        }
+        let Some(&(top, _)) = outline.first() else {
+            continue;
+        };
+        for ((level, text), anchor) in outline.iter().zip(&anchors).skip(1) {
+            let level = level.saturating_sub(top).max(1) + 1;
+            if level <= depth {
+                out.push_str(&format!("{}- [{}](#{})\n", "  ".repeat(level - 1), escape_label(text), anchor));
+            }
+        }
+    }
+    out
+}
+
+fn escape_label(label: &str) -> String {
+    label.replace('[', "\\[").replace(']', "\\]")
+}
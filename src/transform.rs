@@ -0,0 +1,43 @@
+use anyhow::Result;
+use std::fmt;
+use std::sync::Arc;
+
+// A rewrite of each chapter's markdown that cipher doesn't do itself, such as
+// expanding abbreviations or fixing a publisher's known typos. The
+// transforms in `Options::transforms` run in order on every chapter, each on
+// what the one before it returned, once the chapter is converted, its links
+// resolved and its markdown normalized with \n line endings, and after
+// boilerplate is stripped; the chapters are then chunked, put together and
+// normalized again with `Options::line_ending`. An error fails the chapter
+// like a conversion error: `Options::strict` stops the book, and otherwise
+// the chapter keeps the markdown it had before that transform and is listed
+// in the `ChapterErrors`. The name tells transforms apart in errors and in
+// cache keys, so a changed transform needs a new name.
+#[derive(Clone)]
+pub struct Transform {
+    name: String,
+    f: Arc<dyn Fn(&str) -> Result<String> + Send + Sync>,
+}
+
+impl Transform {
+    pub fn new<F: Fn(&str) -> Result<String> + Send + Sync + 'static>(name: &str, f: F) -> Self {
+        Transform {
+            name: name.to_string(),
+            f: Arc::new(f),
+        }
+    }
+
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    pub(crate) fn apply(&self, markdown: &str) -> Result<String> {
+        (self.f)(markdown)
+    }
+}
+
+impl fmt::Debug for Transform {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Transform({:?})", self.name)
+    }
+}
@@ -0,0 +1,234 @@
+use std::fmt;
+use std::str::FromStr;
+
+// Which typographic characters `normalize_typography` rewrites. Publishers
+// scatter soft hyphens, zero-width spaces and runs of non-breaking spaces
+// through their text, which then doesn't match a search for the words.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Typography {
+    /// Curly quotes and apostrophes become ASCII `"` and `'`.
+    pub quotes: bool,
+    /// Em dashes become `---` and en dashes `--`.
+    pub dashes: bool,
+    /// Runs of non-breaking spaces, with any spaces around them, become one
+    /// space.
+    pub spaces: bool,
+    /// Soft hyphens (U+00AD) are removed.
+    pub soft_hyphens: bool,
+    /// Zero-width spaces, word joiners and stray byte order marks are
+    /// removed. Zero-width joiners and non-joiners change how text is shown
+    /// and are kept.
+    pub zero_width: bool,
+    /// Turn `quotes` and `dashes` around: ASCII quotes become curly ones,
+    /// `---` an em dash and `--` an en dash.
+    pub smart: bool,
+}
+
+impl Typography {
+    const NONE: Typography = Typography {
+        quotes: false,
+        dashes: false,
+        spaces: false,
+        soft_hyphens: false,
+        zero_width: false,
+        smart: false,
+    };
+
+    pub fn smart(self, smart: bool) -> Typography {
+        Typography { smart, ..self }
+    }
+
+    fn line(&self, line: &str) -> String {
+        let dashes = self.dashes && !rule(line);
+        let mut out = String::with_capacity(line.len());
+        let mut rest = line;
+        while !rest.is_empty() {
+            let (text, kept, after) = split_kept(rest);
+            self.text(text, dashes, &mut out);
+            out.push_str(kept);
+            rest = after;
+        }
+        out
+    }
+
+    fn text(&self, text: &str, dashes: bool, out: &mut String) {
+        let mut chars = text.chars().peekable();
+        while let Some(c) = chars.next() {
+            match c {
+                '\u{ad}' if self.soft_hyphens => {}
+                '\u{200b}' | '\u{2060}' | '\u{feff}' if self.zero_width => {}
+                c if self.spaces && non_breaking(c) => {
+                    while chars.next_if(|c| *c == ' ' || non_breaking(*c)).is_some() {}
+                    out.truncate(out.trim_end_matches(' ').len());
+                    out.push(' ');
+                }
+                '“' | '”' | '„' | '‟' if self.quotes && !self.smart => out.push('"'),
+                '‘' | '’' | '‚' | '‛' if self.quotes && !self.smart => out.push('\''),
+                '"' if self.quotes && self.smart => out.push(if opens(out) { '“' } else { '”' }),
+                '\'' if self.quotes && self.smart => out.push(if opens(out) { '‘' } else { '’' }),
+                '—' if dashes && !self.smart => out.push_str("---"),
+                '–' if dashes && !self.smart => out.push_str("--"),
+                '-' if dashes && self.smart => {
+                    let mut run = 1;
+                    while chars.next_if_eq(&'-').is_some() {
+                        run += 1;
+                    }
+                    match run {
+                        2 => out.push('–'),
+                        3 => out.push('—'),
+                        _ => out.push_str(&"-".repeat(run)),
+                    }
+                }
+                c => out.push(c),
+            }
+        }
+    }
+}
+
+// Everything, to ASCII.
+impl Default for Typography {
+    fn default() -> Self {
+        Typography {
+            quotes: true,
+            dashes: true,
+            spaces: true,
+            soft_hyphens: true,
+            zero_width: true,
+            smart: false,
+        }
+    }
+}
+
+// "all", or a comma-separated list of quotes, dashes, spaces, hyphens and
+// zero-width.
+impl FromStr for Typography {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        if s == "all" {
+            return Ok(Typography::default());
+        }
+        let mut typography = Typography::NONE;
+        for name in s.split(',').map(str::trim) {
+            match name {
+                "quotes" => typography.quotes = true,
+                "dashes" => typography.dashes = true,
+                "spaces" => typography.spaces = true,
+                "hyphens" => typography.soft_hyphens = true,
+                "zero-width" => typography.zero_width = true,
+                _ => {
+                    return Err(format!(
+                        "invalid normalization {} (expected all, or quotes, dashes, spaces, hyphens or zero-width)",
+                        name
+                    ))
+                }
+            }
+        }
+        Ok(typography)
+    }
+}
+
+impl fmt::Display for Typography {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let names = [
+            (self.quotes, "quotes"),
+            (self.dashes, "dashes"),
+            (self.spaces, "spaces"),
+            (self.soft_hyphens, "hyphens"),
+            (self.zero_width, "zero-width"),
+        ];
+        let names: Vec<&str> = names.iter().filter(|(on, _)| *on).map(|(_, name)| *name).collect();
+        f.write_str(&names.join(","))
+    }
+}
+
+// Rewrites the quotes, dashes and spaces of the text in `markdown` as
+// `typography` asks. Fenced code, code spans, backslash escapes, HTML tags
+// and link destinations are left as they are, as are the dashes of thematic
+// breaks, setext underlines and table delimiter rows.
+pub fn normalize_typography(markdown: &str, typography: &Typography) -> String {
+    let mut out = Vec::new();
+    let mut in_fence = false;
+    for line in markdown.split('\n') {
+        // Fences can sit in list items and blockquotes.
+        let content = line.trim_start_matches(|c: char| c == '>' || c.is_whitespace());
+        if content.starts_with("```") || content.starts_with("~~~") {
+            in_fence = !in_fence;
+            out.push(line.to_string());
+            continue;
+        }
+        match in_fence {
+            true => out.push(line.to_string()),
+            false => out.push(typography.line(line)),
+        }
+    }
+    out.join("\n")
+}
+
+fn non_breaking(c: char) -> bool {
+    matches!(c, '\u{a0}' | '\u{202f}' | '\u{2007}')
+}
+
+// Whether a quote after the text so far opens rather than closes. A quote
+// after a letter is an apostrophe or closes.
+fn opens(before: &str) -> bool {
+    match before.chars().last() {
+        None => true,
+        Some(c) => c.is_whitespace() || "([{<>*_~/-–—“‘".contains(c),
+    }
+}
+
+// Lines made of nothing but dashes and markdown punctuation, whose dashes are
+// markup: `---`, `===` underlines, `| --- | :-: |` and the like. A line of em
+// dashes would become one as ASCII.
+fn rule(line: &str) -> bool {
+    line.chars().all(|c| c.is_whitespace() || "-=*_|:>—–".contains(c))
+}
+
+// Splits off the text before the first part of the line that has to be kept
+// as it is, returning the text, that part and what follows it.
+fn split_kept(line: &str) -> (&str, &str, &str) {
+    let bytes = line.as_bytes();
+    let mut i = 0;
+    while i < bytes.len() {
+        let end = match bytes[i] {
+            b'\\' => line[i + 1..].chars().next().map(|c| i + 1 + c.len_utf8()),
+            b'`' => {
+                // A code span closes at the next run of as many backticks;
+                // without one, the backticks are literal.
+                let open = bytes[i..].iter().take_while(|b| **b == b'`').count();
+                let mut j = i + open;
+                let mut close = None;
+                while j < bytes.len() {
+                    let run = bytes[j..].iter().take_while(|b| **b == b'`').count();
+                    if run == open {
+                        close = Some(j + run);
+                        break;
+                    }
+                    j += run.max(1);
+                }
+                Some(close.unwrap_or(i + open))
+            }
+            b'<' if bytes.get(i + 1).is_some_and(|b| b.is_ascii_alphabetic() || matches!(b, b'/' | b'!' | b'?')) => {
+                line[i..].find('>').map(|end| i + end + 1)
+            }
+            b']' if bytes.get(i + 1) == Some(&b'(') => {
+                let mut depth = 0;
+                line[i + 1..].char_indices().find_map(|(j, c)| {
+                    match c {
+                        '(' => depth += 1,
+                        ')' => depth -= 1,
+                        _ => {}
+                    }
+                    (depth == 0).then_some(i + 1 + j + 1)
+                })
+            }
+            _ => None,
+        };
+        if let Some(end) = end {
+            return (&line[..i], &line[i..end], &line[end..]);
+        }
+        i += 1;
+    }
+    (line, "", "")
+}
@@ -0,0 +1,243 @@
+use crate::chapter;
+use crate::dom;
+use crate::encoding;
+use crate::href;
+use crate::opf::CONTAINER;
+use crate::zip::ZipWriter;
+use anyhow::{Context, Result};
+use std::fmt;
+use std::fs;
+use std::path::{Component, Path, PathBuf};
+use std::str::FromStr;
+
+const MIMETYPE: &[u8] = b"application/epub+zip";
+
+// What the input is read as. Without one, a path is read by its extension,
+// and a folder holding META-INF/container.xml as an unpacked EPUB.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum InputFormat {
+    Epub,
+    /// A single HTML or XHTML file, converted as a book of one chapter.
+    Html,
+}
+
+impl FromStr for InputFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "epub" => Ok(InputFormat::Epub),
+            "html" | "htm" | "xhtml" => Ok(InputFormat::Html),
+            _ => Err(format!("invalid input format {} (expected epub or html)", s)),
+        }
+    }
+}
+
+impl fmt::Display for InputFormat {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            InputFormat::Epub => f.write_str("epub"),
+            InputFormat::Html => f.write_str("html"),
+        }
+    }
+}
+
+pub fn is_unpacked_epub(path: &Path) -> bool {
+    path.join(CONTAINER).is_file()
+}
+
+pub fn is_html(path: &Path) -> bool {
+    let ext = path.extension().unwrap_or_default().to_string_lossy().to_lowercase();
+    matches!(ext.as_str(), "html" | "htm" | "xhtml")
+}
+
+// Packs a path that isn't an EPUB file into one in memory, so that it goes
+// through the same conversion: an unpacked EPUB folder as it is, and an HTML
+// file as a book of one chapter. None for anything else.
+pub(crate) fn pack(path: &Path) -> Result<Option<Vec<u8>>> {
+    if is_unpacked_epub(path) {
+        return pack_dir(path).map(Some);
+    }
+    if !is_html(path) {
+        return Ok(None);
+    }
+    let html = fs::read(path).with_context(|| format!("Failed to read {}", path.display()))?;
+    html_to_epub(&html, path).map(Some)
+}
+
+// Zips up an unpacked EPUB, with the mimetype first as the spec asks.
+fn pack_dir(dir: &Path) -> Result<Vec<u8>> {
+    let mut files = Vec::new();
+    let mut dirs = vec![dir.to_path_buf()];
+    while let Some(dir) = dirs.pop() {
+        let entries = fs::read_dir(&dir).with_context(|| format!("Failed to read {}", dir.display()))?;
+        for entry in entries {
+            let path = entry.with_context(|| format!("Failed to read {}", dir.display()))?.path();
+            match path.is_dir() {
+                true => dirs.push(path),
+                false => files.push(path),
+            }
+        }
+    }
+    files.sort();
+    let mut zip = ZipWriter::default();
+    zip.add("mimetype", MIMETYPE)?;
+    for path in files {
+        let name = archive_name(path.strip_prefix(dir).unwrap_or(&path));
+        if name == "mimetype" {
+            continue;
+        }
+        let bytes = fs::read(&path).with_context(|| format!("Failed to read {}", path.display()))?;
+        zip.add(&name, &bytes)?;
+    }
+    zip.finish()
+}
+
+// Wraps an HTML file in a book of one chapter, along with the images it
+// shows, found relative to `path`. Images above its folder (../images/a.png)
+// are packed with as many of the folders above it as their links climb, so
+// that the links still resolve in the book.
+pub fn html_to_epub(html: &[u8], path: &Path) -> Result<Vec<u8>> {
+    let text = encoding::decode(html);
+    let dir = path.parent().filter(|dir| !dir.as_os_str().is_empty()).unwrap_or(Path::new("."));
+    let mut images = Vec::new();
+    dom::walk(&dom::parse(&text), &mut |el| {
+        let src = match el.local_name() {
+            "img" => el.attr("src"),
+            "image" => el.attr("xlink:href").or_else(|| el.attr("href")),
+            _ => None,
+        };
+        if let Some((up, relative)) = src.and_then(local_path) {
+            let media_type = image_type(&relative);
+            let file = (0..up).fold(dir.to_path_buf(), |dir, _| dir.join("..")).join(&relative);
+            if let Some(media_type) = media_type.filter(|_| file.is_file()) {
+                images.push((up, relative, file, media_type));
+            }
+        }
+    });
+    // The folders the chapter is packed under, outermost first.
+    let climb = images.iter().map(|(up, ..)| *up).max().unwrap_or(0);
+    let folders: Vec<String> = match climb {
+        0 => Vec::new(),
+        _ => {
+            let absolute = fs::canonicalize(dir).with_context(|| format!("Failed to read {}", dir.display()))?;
+            let mut names: Vec<String> = absolute
+                .components()
+                .rev()
+                .filter_map(|c| match c {
+                    Component::Normal(name) => Some(name.to_string_lossy().into_owned()),
+                    _ => None,
+                })
+                .take(climb)
+                .collect();
+            names.reverse();
+            names
+        }
+    };
+    let under = |depth: usize, name: &str| {
+        let mut parts: Vec<&str> = folders.iter().take(depth).map(String::as_str).collect();
+        parts.push(name);
+        parts.join("/")
+    };
+
+    let file_name = path.file_name().unwrap_or_default().to_string_lossy().into_owned();
+    let file_name = match file_name.is_empty() {
+        true => "index.html".to_string(),
+        false => file_name,
+    };
+    let chapter_type = match path.extension().is_some_and(|ext| ext.eq_ignore_ascii_case("xhtml")) {
+        true => "application/xhtml+xml",
+        false => "text/html",
+    };
+    let title = chapter::html_title(&text)
+        .map(|title| dom::decode_entities(&title))
+        .unwrap_or_else(|| path.file_stem().unwrap_or_default().to_string_lossy().into_owned());
+
+    let mut manifest = vec![format!(
+        "<item id=\"chapter\" href=\"{}\" media-type=\"{}\"/>",
+        dom::escape_attr(&under(folders.len(), &file_name)),
+        chapter_type
+    )];
+    let mut files = vec![(under(folders.len(), &file_name), html.to_vec())];
+    for (i, (up, relative, file, media_type)) in images.iter().enumerate() {
+        let name = under(folders.len().saturating_sub(*up), &archive_name(relative));
+        if files.iter().any(|(packed, _)| *packed == name) {
+            continue;
+        }
+        let bytes = fs::read(file).with_context(|| format!("Failed to read {}", file.display()))?;
+        manifest.push(format!(
+            "<item id=\"image{}\" href=\"{}\" media-type=\"{}\"/>",
+            i + 1,
+            dom::escape_attr(&name),
+            media_type
+        ));
+        files.push((name, bytes));
+    }
+    let package = format!(
+        concat!(
+            "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n",
+            "<package xmlns=\"http://www.idpf.org/2007/opf\" version=\"3.0\">\n",
+            "<metadata xmlns:dc=\"http://purl.org/dc/elements/1.1/\"><dc:title>{}</dc:title></metadata>\n",
+            "<manifest>\n{}\n</manifest>\n",
+            "<spine><itemref idref=\"chapter\"/></spine>\n",
+            "</package>\n"
+        ),
+        dom::escape_text(&title),
+        manifest.join("\n")
+    );
+    let container = concat!(
+        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n",
+        "<container version=\"1.0\" xmlns=\"urn:oasis:names:tc:opendocument:xmlns:container\">\n",
+        "<rootfiles><rootfile full-path=\"content.opf\" media-type=\"application/oebps-package+xml\"/></rootfiles>\n",
+        "</container>\n"
+    );
+
+    let mut zip = ZipWriter::default();
+    zip.add("mimetype", MIMETYPE)?;
+    zip.add(CONTAINER, container.as_bytes())?;
+    zip.add("content.opf", package.as_bytes())?;
+    for (name, bytes) in &files {
+        zip.add(name, bytes)?;
+    }
+    zip.finish()
+}
+
+// An image src relative to the page, as the number of folders it climbs and
+// the path from there. None for external and absolute links.
+fn local_path(src: &str) -> Option<(usize, PathBuf)> {
+    if href::is_external(src) || src.starts_with('/') {
+        return None;
+    }
+    let (path, _) = href::split_fragment(src);
+    let path = href::percent_decode(path.split('?').next().unwrap_or_default());
+    let mut up = 0;
+    let mut relative = PathBuf::new();
+    for component in Path::new(&path).components() {
+        match component {
+            Component::ParentDir if relative.as_os_str().is_empty() => up += 1,
+            Component::ParentDir => {
+                relative.pop();
+            }
+            Component::Normal(part) => relative.push(part),
+            _ => {}
+        }
+    }
+    (!relative.as_os_str().is_empty()).then_some((up, relative))
+}
+
+fn image_type(path: &Path) -> Option<&'static str> {
+    let ext = path.extension()?.to_string_lossy().to_lowercase();
+    Some(match ext.as_str() {
+        "png" => "image/png",
+        "jpg" | "jpeg" => "image/jpeg",
+        "gif" => "image/gif",
+        "svg" => "image/svg+xml",
+        "webp" => "image/webp",
+        _ => return None,
+    })
+}
+
+fn archive_name(path: &Path) -> String {
+    let parts: Vec<String> = path.components().map(|c| c.as_os_str().to_string_lossy().into_owned()).collect();
+    parts.join("/")
+}
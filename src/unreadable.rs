@@ -0,0 +1,53 @@
+use std::error::Error;
+use std::fmt;
+use std::str::FromStr;
+
+// What to do with a spine item, navigation document or NCX whose entry can't
+// be read out of the archive, as happens with slightly corrupted books. HTML
+// that is read but can't be converted is a conversion failure instead.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Unreadable {
+    /// Stop the conversion with the error.
+    Fail,
+    /// Warn and put a `> [unreadable: ...]` note in its place: where the
+    /// chapter would be, or where the table of contents would be.
+    Placeholder,
+    /// Leave it out, logging it at info level.
+    Skip,
+}
+
+impl FromStr for Unreadable {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "fail" => Ok(Unreadable::Fail),
+            "placeholder" => Ok(Unreadable::Placeholder),
+            "skip" => Ok(Unreadable::Skip),
+            _ => Err(format!("invalid unreadable entry policy {} (expected fail, placeholder or skip)", s)),
+        }
+    }
+}
+
+impl fmt::Display for Unreadable {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Unreadable::Fail => f.write_str("fail"),
+            Unreadable::Placeholder => f.write_str("placeholder"),
+            Unreadable::Skip => f.write_str("skip"),
+        }
+    }
+}
+
+// An archive entry that couldn't be read, so that `Unreadable` can tell it
+// apart from other failures with `downcast_ref`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct EntryError(pub String);
+
+impl fmt::Display for EntryError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.0)
+    }
+}
+
+impl Error for EntryError {}
@@ -0,0 +1,115 @@
+use crate::drm::{self, ENCRYPTION};
+use crate::opf::{self, Package, CONTAINER};
+use epub::archive::EpubArchive;
+use serde::Serialize;
+use std::collections::HashSet;
+use std::fmt;
+use std::io::{Read, Seek};
+use std::path::Path;
+
+// Codes of the problems that don't make a book invalid.
+const WARNINGS: &[&str] = &["obfuscated-font"];
+
+// A structural problem found in a book, with a code that stays the same
+// between releases so that scripts can match on it.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Problem {
+    /// One of missing-container, no-rootfile, missing-rootfile, duplicate-id,
+    /// missing-file, empty-spine, missing-manifest-item or missing-toc, or
+    /// the warning obfuscated-font.
+    pub code: &'static str,
+    pub message: String,
+}
+
+impl Problem {
+    fn new(code: &'static str, message: String) -> Problem {
+        Problem { code, message }
+    }
+
+    // Whether the book is still valid despite it, as with an obfuscated font,
+    // which only that font can't be read for.
+    pub fn is_warning(&self) -> bool {
+        WARNINGS.contains(&self.code)
+    }
+}
+
+impl fmt::Display for Problem {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.code, self.message)
+    }
+}
+
+// Walks the structure the conversion relies on, reading the archive directly
+// so that a book the epub crate refuses to open still gets precise reasons.
+// Only the first rootfile's package is checked, as that's the one converted by
+// default. Without a container or package document there's nothing more to
+// check, so those problems are reported alone.
+pub(crate) fn check<R: Read + Seek>(archive: &mut EpubArchive<R>) -> Vec<Problem> {
+    let container = match archive.get_entry(CONTAINER) {
+        Ok(bytes) => bytes,
+        Err(_) => return vec![Problem::new("missing-container", format!("{} is missing", CONTAINER))],
+    };
+    let rootfiles = opf::parse_rootfiles(&String::from_utf8_lossy(&container));
+    if rootfiles.is_empty() {
+        return vec![Problem::new("no-rootfile", format!("{} lists no rootfile", CONTAINER))];
+    }
+    let mut problems = Vec::new();
+    for rootfile in &rootfiles {
+        if !in_archive(archive, Path::new(&rootfile.full_path)) {
+            let message = format!("rootfile {} is missing from the archive", rootfile.full_path);
+            problems.push(Problem::new("missing-rootfile", message));
+        }
+    }
+    let root_file = Path::new(&rootfiles[0].full_path);
+    let package = match archive.get_entry(root_file) {
+        Ok(bytes) => Package::parse(&String::from_utf8_lossy(&bytes), root_file),
+        Err(_) => return problems,
+    };
+
+    let mut ids = HashSet::new();
+    let mut duplicates = HashSet::new();
+    for item in &package.manifest {
+        if !ids.insert(&item.id) && duplicates.insert(&item.id) {
+            problems.push(Problem::new("duplicate-id", format!("manifest id '{}' is used more than once", item.id)));
+        }
+    }
+    let mut paths = HashSet::new();
+    for item in &package.manifest {
+        // Remote resources resolve to no path and aren't expected in the archive.
+        if item.path.as_os_str().is_empty() || !paths.insert(&item.path) {
+            continue;
+        }
+        if !in_archive(archive, &item.path) {
+            let message = format!("manifest item '{}' ({}) is missing from the archive", item.id, item.path.display());
+            problems.push(Problem::new("missing-file", message));
+        }
+    }
+
+    if package.spine.is_empty() {
+        problems.push(Problem::new("empty-spine", format!("the spine in {} is empty", root_file.display())));
+    }
+    for idref in &package.spine {
+        if !ids.contains(idref) {
+            problems.push(Problem::new("missing-manifest-item", format!("spine item '{}' not found in manifest", idref)));
+        }
+    }
+
+    let ncx = package.toc_id.as_ref().is_some_and(|id| ids.contains(id))
+        || package.manifest.iter().any(|item| item.media_type == "application/x-dtbncx+xml");
+    if !ncx && package.item_with_property("nav").is_none() {
+        let message = "the book has neither a navigation document nor an NCX".to_string();
+        problems.push(Problem::new("missing-toc", message));
+    }
+
+    if let Ok(bytes) = archive.get_entry(ENCRYPTION) {
+        for font in drm::classify(&String::from_utf8_lossy(&bytes)).obfuscated {
+            let message = format!("font {} is obfuscated, and only the text is converted", font);
+            problems.push(Problem::new("obfuscated-font", message));
+        }
+    }
+    problems
+}
+
+fn in_archive<R: Read + Seek>(archive: &EpubArchive<R>, path: &Path) -> bool {
+    archive.files.iter().any(|file| Path::new(file) == path)
+}
@@ -0,0 +1,113 @@
+use crate::dom::{Element, Node};
+use crate::matter;
+
+// Elements that hold the lines of a poem one to an element, as publishers
+// mark up verse: <div class="stanza"><p class="line">...</p></div>.
+const LINE_ELEMENTS: &[&str] = &["p", "div"];
+
+// Turns each element whose class matches one of `patterns` into paragraphs
+// that keep its lines, so that a stanza comes out as one paragraph with a
+// line break after each line rather than a paragraph for each line or one run
+// of prose. The lines are its block children, or the lines of its text when
+// it has none; blocks holding blocks of their own, as a poem holds stanzas,
+// stay paragraphs of their own. `*` matches any run of characters and `?`
+// any one; case is ignored.
+pub(crate) fn preserve_lines(nodes: &mut [Node], patterns: &[String]) {
+    for node in nodes.iter_mut() {
+        let Node::Element(el) = node else {
+            continue;
+        };
+        if el.is("pre") || el.is("code") || el.is("table") {
+            continue;
+        }
+        let verse = el.attr("class").is_some_and(|class| {
+            class.split_whitespace().any(|class| patterns.iter().any(|pattern| matter::glob(pattern, class)))
+        });
+        match verse {
+            true => keep_lines(el),
+            false => preserve_lines(&mut el.children, patterns),
+        }
+    }
+}
+
+fn keep_lines(el: &mut Element) {
+    if !el.children.iter().any(is_line) {
+        break_text(&mut el.children);
+        return;
+    }
+    if has_breaks(&el.children) {
+        return;
+    }
+    let mut out = Vec::new();
+    let mut lines = Vec::new();
+    for child in std::mem::take(&mut el.children) {
+        match child {
+            Node::Element(mut stanza) if is_block(&stanza) && stanza.children.iter().any(is_line) => {
+                flush(&mut lines, &mut out);
+                keep_lines(&mut stanza);
+                out.push(Node::Element(stanza));
+            }
+            Node::Element(line) if is_block(&line) => {
+                if !lines.is_empty() {
+                    lines.push(Node::Element(Element::new("br")));
+                }
+                lines.extend(line.children);
+            }
+            Node::Text(text) if text.trim().is_empty() => {}
+            node => lines.push(node),
+        }
+    }
+    flush(&mut lines, &mut out);
+    el.children = out;
+}
+
+fn is_block(el: &Element) -> bool {
+    LINE_ELEMENTS.iter().any(|name| el.is(name))
+}
+
+fn is_line(node: &Node) -> bool {
+    matches!(node, Node::Element(el) if is_block(el))
+}
+
+// A run of lines becomes one paragraph.
+fn flush(lines: &mut Vec<Node>, out: &mut Vec<Node>) {
+    if lines.is_empty() {
+        return;
+    }
+    let mut paragraph = Element::new("p");
+    paragraph.children = std::mem::take(lines);
+    out.push(Node::Element(paragraph));
+}
+
+// Text written with its lines as they are, which HTML would run together:
+// each newline becomes a <br>, unless the text already has them. Breaks at
+// the start and end of the paragraph come to nothing, and a blank line
+// between stanzas is two breaks in a row, which end the paragraph.
+fn break_text(nodes: &mut Vec<Node>) {
+    if has_breaks(nodes) {
+        return;
+    }
+    let mut out = Vec::with_capacity(nodes.len());
+    for node in std::mem::take(nodes) {
+        match node {
+            Node::Text(text) => {
+                for (i, line) in text.split('\n').enumerate() {
+                    if i > 0 {
+                        out.push(Node::Element(Element::new("br")));
+                    }
+                    out.push(Node::Text(line.to_string()));
+                }
+            }
+            Node::Element(mut el) => {
+                break_text(&mut el.children);
+                out.push(Node::Element(el));
+            }
+            node => out.push(node),
+        }
+    }
+    *nodes = out;
+}
+
+fn has_breaks(nodes: &[Node]) -> bool {
+    nodes.iter().any(|node| matches!(node, Node::Element(el) if el.is("br")))
+}
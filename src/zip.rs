@@ -0,0 +1,68 @@
+// Just enough of a zip writer for books rebuilt in memory and bundles: stored entries
+// with UTF-8 names, and no zip64, so at most 65535 entries and 4 GiB.
+#[derive(Default)]
+pub(crate) struct ZipWriter {
+    out: Vec<u8>,
+    central: Vec<u8>,
+    entries: u16,
+}
+
+impl ZipWriter {
+    pub(crate) fn add(&mut self, name: &str, data: &[u8]) -> anyhow::Result<()> {
+        let too_big = || anyhow::anyhow!("the archive is too large to build in memory");
+        let offset = u32::try_from(self.out.len()).map_err(|_| too_big())?;
+        let size = u32::try_from(data.len()).map_err(|_| too_big())?;
+        self.entries = self.entries.checked_add(1).ok_or_else(too_big)?;
+        let crc = crc32(data);
+        // Version 2.0, UTF-8 names, stored, 1980-01-01 00:00.
+        let fields = |out: &mut Vec<u8>| {
+            for half in [20u16, 0x0800, 0, 0, 0x21] {
+                out.extend(half.to_le_bytes());
+            }
+            for word in [crc, size, size] {
+                out.extend(word.to_le_bytes());
+            }
+            out.extend((name.len() as u16).to_le_bytes());
+            out.extend(0u16.to_le_bytes());
+        };
+        self.out.extend(b"PK\x03\x04");
+        fields(&mut self.out);
+        self.out.extend(name.as_bytes());
+        self.out.extend(data);
+
+        self.central.extend(b"PK\x01\x02");
+        self.central.extend(20u16.to_le_bytes());
+        fields(&mut self.central);
+        // Comment length, disk, internal and external attributes.
+        self.central.extend([0u8; 10]);
+        self.central.extend(offset.to_le_bytes());
+        self.central.extend(name.as_bytes());
+        Ok(())
+    }
+
+    pub(crate) fn finish(mut self) -> anyhow::Result<Vec<u8>> {
+        let too_big = || anyhow::anyhow!("the archive is too large to build in memory");
+        let offset = u32::try_from(self.out.len()).map_err(|_| too_big())?;
+        let size = self.central.len() as u32;
+        self.out.append(&mut self.central);
+        self.out.extend(b"PK\x05\x06");
+        self.out.extend([0u8; 4]);
+        self.out.extend(self.entries.to_le_bytes());
+        self.out.extend(self.entries.to_le_bytes());
+        self.out.extend(size.to_le_bytes());
+        self.out.extend(offset.to_le_bytes());
+        self.out.extend(0u16.to_le_bytes());
+        Ok(self.out)
+    }
+}
+
+fn crc32(data: &[u8]) -> u32 {
+    let mut crc = !0u32;
+    for byte in data {
+        crc ^= u32::from(*byte);
+        for _ in 0..8 {
+            crc = (crc >> 1) ^ (0xedb8_8320 & (crc & 1).wrapping_neg());
+        }
+    }
+    !crc
+}
@@ -0,0 +1,105 @@
+use cipher::cache::{sha256, Cache, CacheInfo};
+use cipher::Options;
+use std::fs;
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+#[test]
+fn test_sha256() {
+    assert_eq!(
+        hex(&sha256(b"")),
+        "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+    );
+    assert_eq!(
+        hex(&sha256(b"abc")),
+        "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+    );
+    // 56 bytes: the padding needs a block of its own.
+    assert_eq!(
+        hex(&sha256(
+            b"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq"
+        )),
+        "248d6a61d20638b8e5c026930c3e6039a33ce45964ff2167f6ecedd419db06c1"
+    );
+    assert_eq!(
+        hex(&sha256(&vec![b'a'; 1_000_000])),
+        "cdc76e5c9914fb9281a1c7e284d73e67f1809a48a497200e046d39ccc7112cd0"
+    );
+}
+
+#[test]
+fn test_cache_keys() {
+    let options = Options::default();
+    let key = Cache::key(b"book", &options);
+    assert_eq!(key.len(), 64);
+    assert_eq!(key, Cache::key(b"book", &options));
+    assert_ne!(key, Cache::key(b"other book", &options));
+    assert_ne!(
+        key,
+        Cache::key(
+            b"book",
+            &Options {
+                front_matter: false,
+                ..Options::default()
+            }
+        )
+    );
+    // The number of jobs doesn't change the markdown.
+    assert_eq!(
+        key,
+        Cache::key(
+            b"book",
+            &Options {
+                jobs: 3,
+                ..Options::default()
+            }
+        )
+    );
+}
+
+#[test]
+fn test_cache_key_from_reader() {
+    let options = Options::default();
+    // Longer than the reader's buffer and not a whole number of blocks.
+    let epub: Vec<u8> = (0..200_003u32).map(|i| (i % 251) as u8).collect();
+    let key = Cache::key_from_reader(&epub[..], &options).unwrap();
+    assert_eq!(key, Cache::key(&epub, &options));
+    assert_eq!(
+        Cache::key_from_reader(&b""[..], &options).unwrap(),
+        Cache::key(b"", &options)
+    );
+}
+
+#[test]
+fn test_cache_round_trip() {
+    let dir = tempfile::tempdir().unwrap();
+    let cache = Cache::new(&dir.path().join("cipher"));
+    assert_eq!(cache.info().unwrap(), CacheInfo::default());
+    let key = Cache::key(b"book", &Options::default());
+    assert_eq!(cache.get(&key), None);
+
+    cache.put(&key, "# Rats\n").unwrap();
+    assert_eq!(cache.get(&key).as_deref(), Some("# Rats\n"));
+    let names: Vec<String> = fs::read_dir(cache.dir())
+        .unwrap()
+        .map(|entry| entry.unwrap().file_name().to_string_lossy().into_owned())
+        .collect();
+    assert_eq!(names, [format!("{}.md", key)]);
+
+    // A temporary file left by an interrupted run isn't an entry, but is cleared.
+    fs::write(cache.dir().join(format!("{}.123.tmp", key)), "# Ra").unwrap();
+    fs::write(cache.dir().join("notes.txt"), "kept").unwrap();
+    assert_eq!(
+        cache.info().unwrap(),
+        CacheInfo {
+            entries: 1,
+            bytes: 7
+        }
+    );
+    assert_eq!(cache.clear().unwrap(), 1);
+    assert_eq!(cache.get(&key), None);
+    assert_eq!(cache.info().unwrap(), CacheInfo::default());
+    assert!(cache.dir().join("notes.txt").exists());
+}
@@ -1,7 +1,10 @@
 use assert_cmd::prelude::*;
 use predicates::prelude::*;
+use std::fs;
 use std::process::Command;
 
+mod common;
+
 #[test]
 fn test_cli_help() {
     let mut cmd = Command::cargo_bin("cipher").unwrap();
@@ -11,10 +14,2057 @@ fn test_cli_help() {
         .stdout(predicate::str::contains("Usage"));
 }
 
+#[test]
+fn test_cli_command_help() {
+    // Each command lists only its own flags.
+    for (command, flag) in [
+        ("convert", "--split"),
+        ("info", "--pretty"),
+        ("toc", "--input-format"),
+        ("validate", "--recursive"),
+    ] {
+        let mut cmd = Command::cargo_bin("cipher").unwrap();
+        cmd.args([command, "-h"]);
+        let output = cmd.assert().success().get_output().stdout.clone();
+        let help = String::from_utf8(output).unwrap();
+        assert!(
+            help.contains(&format!("Usage: cipher {} [OPTIONS]", command)),
+            "{}",
+            help
+        );
+        assert!(help.contains(flag), "{}", help);
+        assert_eq!(help.contains("--split"), command == "convert", "{}", help);
+    }
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("--help");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Commands:\n  convert"))
+        .stdout(predicate::str::contains("\n  validate "));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args(["testdata/rich-metadata.epub", "--info"]);
+    cmd.assert()
+        .code(2)
+        .stderr(predicate::str::contains("unexpected argument '--info'"));
+}
+
+#[test]
+fn test_cli_no_arguments() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.assert()
+        .code(2)
+        .stderr(predicate::str::contains("Usage"));
+}
+
+#[test]
+fn test_cli_error_on_one_line() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/does-not-exist.epub");
+    let output = cmd.assert().code(1).get_output().stderr.clone();
+    let stderr = String::from_utf8(output).unwrap();
+    assert!(stderr.starts_with("Error: "), "{}", stderr);
+    assert_eq!(stderr.lines().count(), 1, "{}", stderr);
+}
+
 #[test]
 fn test_cli_epub_to_markdown() {
     let mut cmd = Command::cargo_bin("cipher").unwrap();
-    cmd.arg("testdata/pg35542.epub");
+    cmd.arg("testdata/pg35542.epub").args(["-o", "-"]);
     cmd.assert()
-        .success();
+        .success()
+        .stdout(predicate::str::contains("COMMUNITY EFFORTS"));
+}
+
+#[test]
+fn test_cli_output_file() {
+    let dir = tempfile::tempdir().unwrap();
+    let output = dir.path().join("nested").join("pg35542.md");
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub").arg("-o").arg(&output);
+    cmd.assert().success().stdout(predicate::str::is_empty());
+
+    let markdown = fs::read_to_string(&output).unwrap();
+    assert!(!markdown.contains('\x1b'));
+    common::assert_golden("pg35542.md", &markdown);
+}
+
+#[test]
+fn test_cli_output_refuses_overwrite() {
+    let dir = tempfile::tempdir().unwrap();
+    let output = dir.path().join("pg35542.md");
+    fs::write(&output, "existing").unwrap();
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub").arg("-o").arg(&output);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("already exists"));
+    assert_eq!(fs::read_to_string(&output).unwrap(), "existing");
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .arg("-o")
+        .arg(&output)
+        .arg("--force");
+    cmd.assert().success();
+    assert!(fs::read_to_string(&output)
+        .unwrap()
+        .contains("COMMUNITY EFFORTS"));
+}
+
+#[test]
+fn test_cli_output_derived_from_input() {
+    let dir = tempfile::tempdir().unwrap();
+    let epub = fs::canonicalize("testdata/pg35542.epub").unwrap();
+
+    // stdout isn't a terminal here, so the book goes next to where we are.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(&epub).current_dir(dir.path());
+    cmd.assert().success().stdout(predicate::str::is_empty());
+    let markdown = fs::read_to_string(dir.path().join("pg35542.md")).unwrap();
+    assert!(markdown.contains("COMMUNITY EFFORTS"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(&epub).current_dir(dir.path());
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "pg35542.md already exists (use --force to overwrite)",
+    ));
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(&epub).arg("-f").current_dir(dir.path());
+    cmd.assert().success();
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(&epub)
+        .args(["--format", "txt"])
+        .current_dir(dir.path());
+    cmd.assert().success();
+    assert!(fs::read_to_string(dir.path().join("pg35542.txt"))
+        .unwrap()
+        .contains("COMMUNITY EFFORTS"));
+
+    // -o - always means stdout.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(&epub).args(["-o", "-"]).current_dir(dir.path());
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("COMMUNITY EFFORTS"));
+    assert_eq!(fs::read_dir(dir.path()).unwrap().count(), 2);
+}
+
+#[test]
+fn test_cli_batch() {
+    let src = tempfile::tempdir().unwrap();
+    fs::create_dir(src.path().join("more")).unwrap();
+    fs::copy("testdata/pg35542.epub", src.path().join("pg35542.epub")).unwrap();
+    fs::copy("testdata/table.epub", src.path().join("more/table.epub")).unwrap();
+    fs::write(src.path().join("broken.epub"), "not a zip").unwrap();
+
+    // Directories are only searched recursively with -r; files next to the EPUB.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(src.path()).arg("testdata/no-such-book.epub");
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("failed: "))
+        .stderr(predicate::str::contains("converted 1, failed 2"));
+    assert!(src.path().join("pg35542.md").exists());
+    assert!(!src.path().join("more/table.md").exists());
+
+    let out = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(src.path())
+        .arg("-r")
+        .arg("--output-dir")
+        .arg(out.path());
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("broken.epub"))
+        .stderr(predicate::str::contains("converted 2, failed 1"));
+    assert!(fs::read_to_string(out.path().join("pg35542.md"))
+        .unwrap()
+        .contains("COMMUNITY EFFORTS"));
+    assert!(out.path().join("table.md").exists());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(src.path().join("pg35542.epub"))
+        .arg("--output-dir")
+        .arg(out.path());
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("already exists"))
+        .stderr(predicate::str::contains("converted 0, failed 1"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(src.path().join("pg35542.epub"))
+        .arg("--output-dir")
+        .arg(out.path())
+        .arg("--force");
+    cmd.assert()
+        .success()
+        .stderr(predicate::str::contains("converted 1, failed 0"));
+}
+
+#[test]
+fn test_cli_images_dir() {
+    let dir = tempfile::tempdir().unwrap();
+    let images = dir.path().join("assets");
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images.epub")
+        .args(["-o", "-"])
+        .arg("--images")
+        .arg(&images);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(format!(
+            "]({}/6789594627817495676_fig-00-400.png",
+            images.display()
+        )));
+    assert!(images.join("6789594627817495676_fig-00-400.png").exists());
+    assert!(images.join("6789594627817495676_fig-00-800.jpg").exists());
+}
+
+#[test]
+fn test_cli_embed_images() {
+    let dir = tempfile::tempdir().unwrap();
+    let output = dir.path().join("book.md");
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images.epub")
+        .args(["--embed-images", "--max-embed-size", "20", "-o"])
+        .arg(&output);
+    cmd.assert().success().stderr(predicate::str::contains(
+        "not embedding image OEBPS/6789594627817495676_fig-00-400.png",
+    ));
+    let markdown = fs::read_to_string(&output).unwrap();
+    assert!(markdown.contains("](data:image/png;base64,"));
+    assert!(!dir.path().join("images").exists());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images.epub")
+        .arg("--embed-images")
+        .arg("--images")
+        .arg(dir.path());
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("cannot be used with"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images.epub")
+        .args(["--embed-images", "--embed-max-size", "1"]);
+    cmd.assert().success();
+}
+
+#[test]
+fn test_cli_inline_svg() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/svg-figures.epub")
+        .args(["-o", "-", "--inline-svg"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(
+            "\n<svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"0 0 10 10\">\n",
+        ))
+        .stdout(predicate::str::contains("[figure").not());
+}
+
+#[test]
+fn test_cli_cover() {
+    let dir = tempfile::tempdir().unwrap();
+    let output = dir.path().join("book.md");
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images-3.epub")
+        .arg("-o")
+        .arg(&output)
+        .arg("--cover")
+        .arg(dir.path().join("front"));
+    cmd.assert().success();
+    assert!(dir.path().join("front.png").exists());
+    assert!(fs::read_to_string(&output)
+        .unwrap()
+        .contains("\n---\n\n![cover](front.png)\n"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub")
+        .args(["-o", "-"])
+        .arg("--cover")
+        .arg(dir.path().join("none.png"));
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("![cover]").not())
+        .stderr(predicate::str::contains(
+            "warning: the book declares no cover image; not writing",
+        ));
+    assert!(!dir.path().join("none.png").exists());
+}
+
+#[test]
+fn test_cli_front_matter() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub")
+        .args(["-o", "-"])
+        .arg("--front-matter");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::starts_with(
+            "---\ntitle: \"The Rich Metadata Book\"\n",
+        ))
+        .stdout(predicate::str::contains(
+            "identifier:\n  - \"urn:isbn:9780000000001\"\n",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub")
+        .args(["-o", "-"])
+        .arg("--front-matter")
+        .arg("--no-front-matter");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("title: ").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub")
+        .args(["-o", "-", "--metadata-format", "pandoc"]);
+    cmd.assert().success().stdout(predicate::str::starts_with(
+        "% The Rich Metadata Book\n% Ada Lovelace; Charles Babbage\n",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub")
+        .args(["--metadata-format", "toml"]);
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "invalid metadata format toml (expected yaml or pandoc)",
+    ));
+}
+
+#[test]
+fn test_cli_metadata() {
+    let expected = fs::read_to_string("testdata/golden/rich-metadata.json").unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub").arg("--metadata");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::diff(expected));
+}
+
+#[test]
+fn test_cli_info() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args(["info", "testdata/rich-metadata.epub"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::starts_with("{\"title\":\"The Rich Metadata Book\","))
+        .stdout(predicate::str::contains("\"chapters\":2,\"manifest_items\":3,\"size\":1100,\"has_toc\":true,\"pages\":0,\"obfuscated_fonts\":[]}"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args(["info", "testdata/rich-metadata.epub", "--pretty"]);
+    cmd.assert().success().stdout(predicate::str::contains(
+        "\n  \"subjects\": [\n    \"Computing\"\n  ],\n",
+    ));
+}
+
+#[test]
+fn test_cli_toc_command() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args(["toc", "testdata/pg35542.epub"]);
+    cmd.assert().success().stdout(predicate::str::starts_with(
+        "- [HOUSE RATS AND MICE](#pgepubid00001)\n",
+    ));
+
+    let mut cmd = assert_cmd::Command::cargo_bin("cipher").unwrap();
+    cmd.args(["toc", "-"])
+        .write_stdin(fs::read("testdata/epub3-nav.epub").unwrap());
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("  - [Departure](#departure)\n"));
+}
+
+#[test]
+fn test_cli_strict() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/missing-chapter.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("conversion failed: ch2.xhtml"))
+        .stderr(predicate::str::contains(
+            "warning: failed to convert ch2.xhtml",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/missing-chapter.epub").arg("--strict");
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("ch2.xhtml"));
+}
+
+#[test]
+fn test_cli_log_levels() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/missing-chapter.epub")
+        .args(["-o", "-"])
+        .arg("--quiet");
+    cmd.assert().success().stderr(predicate::str::is_empty());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/missing-chapter.epub")
+        .args(["-o", "-"])
+        .arg("--verbose");
+    cmd.assert()
+        .success()
+        .stderr(predicate::str::contains("converted ch1.xhtml in "))
+        .stderr(predicate::str::contains(
+            "warning: failed to convert ch2.xhtml",
+        ));
+
+    // Quiet still fails, and says why.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/missing-chapter.epub")
+        .arg("--quiet")
+        .arg("--strict");
+    cmd.assert()
+        .code(1)
+        .stderr(predicate::str::starts_with("Error: "));
+}
+
+#[test]
+fn test_cli_log_format_json() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/missing-chapter.epub")
+        .args(["-o", "-", "--verbose", "--log-format", "json"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("{\"level\"").not())
+        .stderr(predicate::str::contains(
+            "{\"level\":\"info\",\"message\":\"converted ch1.xhtml in ",
+        ))
+        .stderr(predicate::str::contains(
+            "{\"level\":\"warning\",\"message\":\"failed to convert ch2.xhtml",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/missing-chapter.epub")
+        .args(["--strict", "--log-format", "json"]);
+    cmd.assert().code(1).stderr(predicate::str::starts_with(
+        "{\"level\":\"error\",\"message\":\"",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/missing-chapter.epub")
+        .args(["--log-format", "xml"]);
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "invalid log format xml (expected text or json)",
+    ));
+}
+
+#[test]
+fn test_cli_skips_unconvertible_spine_items() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/svg-cover.epub")
+        .args(["-o", "-"])
+        .arg("--strict");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("![](cover.svg)"))
+        .stdout(predicate::str::contains(
+            "Rats cost farmers dearly every year.",
+        ))
+        .stderr(predicate::str::contains(
+            "warning: skipping spine item colophon.txt (text/plain)",
+        ));
+}
+
+#[test]
+fn test_cli_markdown_style() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/styles.epub").args(["-o", "-"]).args([
+        "--heading-style",
+        "setext",
+        "--bullet",
+        "-",
+        "--emphasis",
+        "none",
+        "--no-escape",
+    ]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Feeding\n-------"))
+        .stdout(predicate::str::contains("- Fresh vegetables"))
+        .stdout(predicate::str::contains("Rats are very social"))
+        .stdout(predicate::str::contains("cage_one"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/styles.epub").args(["--bullet", "x"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("expected *, - or +"));
+}
+
+#[test]
+fn test_cli_list_style() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/lists.epub").args(["-o", "-"]).args([
+        "--bullet",
+        "-",
+        "--ordered-delimiter",
+        ")",
+        "--list-spacing",
+        "tight",
+    ]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("- Cage\n"))
+        .stdout(predicate::str::contains("1) Wash the tray\n"))
+        .stdout(
+            predicate::str::contains("Pellets\n")
+                .and(predicate::str::contains("Pellets\n\n").not()),
+        )
+        .stdout(predicate::str::contains("1. ").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/lists.epub")
+        .args(["--list-spacing", "compact"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("expected tight or loose"));
+}
+
+#[test]
+fn test_cli_markdown_flags() {
+    // Each flag, and what it changes in styles.epub compared to the default output.
+    let cases: &[(&[&str], &str, &str)] = &[
+        (
+            &["--heading-style", "setext"],
+            "Feeding\n-------",
+            "## Feeding",
+        ),
+        (
+            &["--bullet", "-"],
+            "- Fresh vegetables",
+            "* Fresh vegetables",
+        ),
+        (
+            &["--bullet", "+"],
+            "+ Fresh vegetables",
+            "* Fresh vegetables",
+        ),
+        (
+            &["--emphasis", "_"],
+            "_very_ social and __must not__",
+            "*very*",
+        ),
+        (
+            &["--emphasis", "none"],
+            "very social and must not",
+            "*very*",
+        ),
+        (&["--no-strikethrough"], "The wire glass tank", "~~wire~~"),
+        (&["--no-escape"], "cage_one", "cage\\_one"),
+    ];
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/styles.epub").args(["-o", "-"]);
+    let default = cmd.output().unwrap().stdout;
+    let default = String::from_utf8(default).unwrap();
+    for (args, expected, replaced) in cases {
+        assert!(
+            default.contains(replaced),
+            "{:?} not in the default output",
+            replaced
+        );
+        let mut cmd = Command::cargo_bin("cipher").unwrap();
+        cmd.arg("testdata/styles.epub")
+            .args(["-o", "-"])
+            .args(*args);
+        cmd.assert()
+            .success()
+            .stdout(predicate::str::contains(*expected))
+            .stdout(predicate::str::contains(*replaced).not());
+    }
+}
+
+#[test]
+fn test_cli_text_format() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/styles.epub").args([
+        "-o",
+        "-",
+        "--format",
+        "txt",
+        "--no-front-matter",
+        "--no-toc",
+    ]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::starts_with(
+            "Rat Husbandry\n\nRats are very social and must not be kept alone.",
+        ))
+        .stdout(predicate::str::contains("- Fresh vegetables"))
+        .stdout(predicate::str::contains("cage_one"))
+        .stdout(predicate::str::contains("#").not());
+}
+
+#[test]
+fn test_cli_json_format() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-", "--format", "json"]);
+    let output = cmd.assert().success().get_output().stdout.clone();
+    let book: serde_json::Value = serde_json::from_slice(&output).unwrap();
+    assert_eq!(book["metadata"]["title"], "The Voyage");
+    assert_eq!(book["metadata"]["authors"], "A. Sailor");
+    let chapters = book["chapters"].as_array().unwrap();
+    assert_eq!(chapters.len(), 2);
+    assert_eq!(chapters[0]["index"], 1);
+    assert_eq!(chapters[0]["href"], "text/ch1.xhtml");
+    assert_eq!(chapters[0]["title"], "Chapter One: The Harbour");
+    assert_eq!(chapters[1]["index"], 2);
+    assert_eq!(chapters[1]["title"], "Chapter Two: Landfall");
+    assert!(chapters[1]["markdown"]
+        .as_str()
+        .unwrap()
+        .contains("Landfall"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-", "--format", "ndjson", "--chapters", "2"]);
+    let output = cmd.assert().success().get_output().stdout.clone();
+    let lines: Vec<serde_json::Value> = String::from_utf8(output)
+        .unwrap()
+        .lines()
+        .map(|line| serde_json::from_str(line).unwrap())
+        .collect();
+    assert_eq!(lines.len(), 1);
+    assert_eq!(lines[0]["index"], 2);
+    assert_eq!(lines[0]["href"], "text/ch2.xhtml");
+}
+
+#[test]
+fn test_cli_drm_protected() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/drm.epub");
+    cmd.assert()
+        .code(3)
+        .stdout(predicate::str::is_empty())
+        .stderr(predicate::str::contains(
+            "this book is DRM-protected (Adobe ADEPT) and cannot be converted",
+        ));
+}
+
+#[test]
+fn test_cli_batch_drm_protected() {
+    let src = tempfile::tempdir().unwrap();
+    fs::copy("testdata/table.epub", src.path().join("table.epub")).unwrap();
+    fs::copy("testdata/drm.epub", src.path().join("drm.epub")).unwrap();
+    fs::copy("testdata/drm-lcp.epub", src.path().join("drm-lcp.epub")).unwrap();
+
+    // A batch whose only failures are DRM-protected books exits with their code.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(src.path());
+    cmd.assert()
+        .code(3)
+        .stderr(predicate::str::contains("(Readium LCP)"))
+        .stderr(predicate::str::contains(
+            "converted 1, failed 2 (2 DRM-protected)",
+        ));
+
+    fs::write(src.path().join("broken.epub"), "not a zip").unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(src.path()).arg("--force");
+    cmd.assert().code(1).stderr(predicate::str::contains(
+        "converted 1, failed 3 (2 DRM-protected)",
+    ));
+}
+
+#[test]
+fn test_cli_invalid_epub() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/not-epub.zip");
+    let expected =
+        "Error: Failed to convert EPUB to Markdown: Failed to open testdata/not-epub.zip: \
+                    not an EPUB: the zip archive has no mimetype file\n";
+    cmd.assert().code(2).stderr(predicate::str::diff(expected));
+
+    let mut cmd = assert_cmd::Command::cargo_bin("cipher").unwrap();
+    cmd.arg("-").write_stdin(b"%PDF-1.4\n".to_vec());
+    cmd.assert().code(2).stderr(predicate::str::contains(
+        "not an EPUB: the file isn't a zip archive",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/no-container.epub");
+    cmd.assert().code(2).stderr(predicate::str::contains(
+        "corrupt EPUB: META-INF/container.xml is missing",
+    ));
+}
+
+#[test]
+fn test_cli_html_input() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/html/article.html").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("A saved article about rats."));
+
+    let html = fs::read("testdata/html/article.html").unwrap();
+    let mut cmd = assert_cmd::Command::cargo_bin("cipher").unwrap();
+    cmd.args(["-", "--input-format", "html", "-o", "-"])
+        .write_stdin(html);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("# Rats & Their Runs"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args(["testdata/unpacked-epub", "-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("This book was never zipped."));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args(["testdata/html/article.html", "--input-format", "pdf"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("expected epub or html"));
+}
+
+#[test]
+fn test_cli_out_of_spec_epub() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/zipped-folder.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("This book has a defect: zipped folder."))
+        .stderr(predicate::str::contains(
+            "warning: testdata/zipped-folder.epub is out of spec: META-INF/container.xml is at Rats/meta-inf/container.xml",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/compressed-mimetype.epub").arg("--strict");
+    cmd.assert().code(2).stderr(predicate::str::contains(
+        "corrupt EPUB: the mimetype file is compressed",
+    ));
+}
+
+#[test]
+fn test_cli_raw() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .arg("--style")
+        .arg("dark")
+        .args(["--color", "always"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("\x1b["));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .arg("--style")
+        .arg("dark")
+        .arg("--raw");
+    cmd.assert().success().stdout(
+        predicate::str::contains("COMMUNITY EFFORTS").and(predicate::str::contains("\x1b[").not()),
+    );
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("\x1b[").not());
+}
+
+#[test]
+fn test_cli_render() {
+    // stdout is a pipe here, so auto styling falls back to plain markdown.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub").arg("--render");
+    cmd.assert().success().stdout(
+        predicate::str::contains("COMMUNITY EFFORTS").and(predicate::str::contains("\x1b[").not()),
+    );
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .arg("--render")
+        .arg("--style")
+        .arg("dracula")
+        .args(["--color", "always"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("\x1b[38;5;141m"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .arg("--render")
+        .arg("--raw");
+    cmd.assert().failure();
+}
+
+#[test]
+fn test_cli_color() {
+    let styled = |extra: &[&str], env: &[(&str, &str)]| {
+        let mut cmd = Command::cargo_bin("cipher").unwrap();
+        cmd.arg("testdata/pg35542.epub")
+            .args(["--style", "dark"])
+            .args(extra);
+        cmd.env_remove("NO_COLOR")
+            .env_remove("CLICOLOR_FORCE")
+            .envs(env.iter().copied());
+        let output = cmd.output().unwrap();
+        assert!(output.status.success());
+        output.stdout.contains(&0x1b)
+    };
+    // stdout is a pipe here, so even a named style is left off by default.
+    assert!(!styled(&[], &[]));
+    assert!(styled(&["--color", "always"], &[]));
+    assert!(!styled(&["--color", "never"], &[("CLICOLOR_FORCE", "1")]));
+    assert!(styled(&[], &[("CLICOLOR_FORCE", "1")]));
+    assert!(!styled(&[], &[("CLICOLOR_FORCE", "0")]));
+    assert!(!styled(&[], &[("NO_COLOR", "1"), ("CLICOLOR_FORCE", "1")]));
+    assert!(styled(&["--color", "always"], &[("NO_COLOR", "1")]));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .args(["--format", "ansi", "--color", "never"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("\x1b[").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .args(["--color", "sometimes"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("expected auto, always or never"));
+}
+
+#[test]
+fn test_cli_ansi_format() {
+    // Unlike --render, the ansi format styles the output through a pipe.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub").args(["--format", "ansi"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("\x1b[38;5;39m"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .args(["--format", "ansi", "--style", "dracula"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("\x1b[38;5;141m"));
+
+    let dir = tempfile::tempdir().unwrap();
+    let output = dir.path().join("book.ansi");
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .args(["--format", "ansi", "--output"])
+        .arg(&output);
+    cmd.assert().success();
+    assert!(fs::read_to_string(&output).unwrap().contains("\x1b["));
+}
+
+#[test]
+fn test_cli_width() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub")
+        .arg("--style")
+        .arg("dark")
+        .arg("--width")
+        .arg("20");
+    cmd.assert().success().stdout(predicate::str::contains(
+        "The engine weaves\nalgebraic patterns.",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub")
+        .arg("--style")
+        .arg("dark")
+        .arg("--width")
+        .arg("0");
+    cmd.assert().success().stdout(predicate::str::contains(
+        "The engine weaves algebraic patterns.",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rich-metadata.epub")
+        .arg("--width")
+        .arg("wide");
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("invalid wrap width"));
+}
+
+#[test]
+fn test_cli_stdin() {
+    let epub = fs::read("testdata/pg35542.epub").unwrap();
+    let mut cmd = assert_cmd::Command::cargo_bin("cipher").unwrap();
+    cmd.arg("-").write_stdin(epub.clone());
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("COMMUNITY EFFORTS"));
+
+    let mut cmd = assert_cmd::Command::cargo_bin("cipher").unwrap();
+    cmd.arg("-")
+        .arg("--max-input-size")
+        .arg("0")
+        .write_stdin(epub);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("--max-input-size"));
+}
+
+#[test]
+fn test_cli_list_chapters() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub").arg("--list-chapters");
+    cmd.assert().success().stdout(predicate::str::diff(
+        "  1  ch1  Chapter One: The Harbour\n  2  ch2  Chapter Two: Landfall\n",
+    ));
+}
+
+#[test]
+fn test_cli_list_items() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub").arg("--list-items");
+    cmd.assert().success().stdout(predicate::str::diff(concat!(
+        "spine:\n",
+        "  1  ch1  text/ch1.xhtml  application/xhtml+xml\n",
+        "  2  ch2  text/ch2.xhtml  application/xhtml+xml\n",
+        "other manifest items:\n",
+        "     nav  nav.xhtml       application/xhtml+xml  (nav)\n",
+        "     ncx  toc.ncx         application/x-dtbncx+xml\n",
+    )));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/nonlinear.epub")
+        .args(["--list-items", "--format", "json"]);
+    let output = cmd.output().unwrap();
+    assert!(output.status.success());
+    let items: serde_json::Value = serde_json::from_slice(&output.stdout).unwrap();
+    assert_eq!(items["spine"][1]["id"], "note");
+    assert_eq!(items["spine"][1]["linear"], false);
+    assert_eq!(items["other"][0]["media_type"], "application/x-dtbncx+xml");
+}
+
+#[test]
+fn test_cli_rendition() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/renditions.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("This is the text rendition."))
+        .stderr(predicate::str::contains(
+            "2 renditions (1: text/package.opf, 2: large/package.opf)",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/renditions.epub")
+        .args(["-o", "-"])
+        .arg("--rendition")
+        .arg("2");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(
+            "This is the large print rendition.",
+        ))
+        .stderr(predicate::str::contains("renditions").not());
+}
+
+#[test]
+fn test_cli_rendition_label() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/renditions-labelled.epub")
+        .args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(
+            "This is the fixed layout rendition.",
+        ))
+        .stderr(predicate::str::contains(
+            "1: fixed/package.opf (Fixed layout, pre-paginated)",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/renditions-labelled.epub")
+        .args(["-o", "-"])
+        .arg("--rendition")
+        .arg("reflowable");
+    cmd.assert().success().stdout(predicate::str::contains(
+        "This is the reflowable rendition.",
+    ));
+}
+
+#[test]
+fn test_cli_stats() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-"])
+        .arg("--stats");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("words  chapter").not())
+        .stderr(predicate::str::contains(
+            "    #  words  chars  images  min  chapter\n",
+        ))
+        .stderr(predicate::str::contains("Chapter One: The Harbour"))
+        .stderr(predicate::str::contains("at 200 words a minute\n"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-", "--stats", "--wpm", "50", "--format", "json"]);
+    let output = cmd.output().unwrap();
+    assert!(output.status.success());
+    let stats: serde_json::Value = serde_json::from_slice(&output.stderr).unwrap();
+    assert_eq!(stats["words_per_minute"], 50);
+    assert_eq!(stats["chapters"][0]["title"], "Chapter One: The Harbour");
+    let book: serde_json::Value = serde_json::from_slice(&output.stdout).unwrap();
+    assert_eq!(book["stats"], stats);
+}
+
+#[test]
+fn test_cli_anchors() {
+    let dir = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/links.epub")
+        .arg("--anchors")
+        .arg("--split")
+        .arg(dir.path());
+    cmd.assert().success();
+
+    let first = fs::read_to_string(dir.path().join("01-chapter-one.md")).unwrap();
+    assert!(first.contains("[habits of rats](02-chapter-two.md#habits)"));
+    let second = fs::read_to_string(dir.path().join("02-chapter-two.md")).unwrap();
+    assert!(second.contains("<a id=\"habits\"></a>Rats are nocturnal."));
+}
+
+#[test]
+fn test_cli_no_sanitize() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/retailer-cruft.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Kindle edition").not())
+        .stdout(predicate::str::contains("font-weight").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/retailer-cruft.epub")
+        .args(["-o", "-"])
+        .arg("--no-sanitize");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Kindle edition"));
+}
+
+#[test]
+fn test_cli_validate() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args(["validate", "testdata/pg35542.epub"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("testdata/pg35542.epub: ok\n"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args([
+        "validate",
+        "testdata/pg35542.epub",
+        "testdata/invalid-spine.epub",
+    ]);
+    cmd.assert()
+        .failure()
+        .code(1)
+        .stdout(predicate::str::contains("testdata/pg35542.epub: ok\n"))
+        .stdout(predicate::str::contains(
+            "testdata/invalid-spine.epub: missing-manifest-item: spine item 'ch4' not found in manifest\n",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args([
+        "validate",
+        "testdata/pg35542.epub",
+        "testdata/messy-manifest.epub",
+        "--format",
+        "ndjson",
+    ]);
+    cmd.assert()
+        .failure()
+        .code(1)
+        .stdout(predicate::str::contains(
+            "{\"file\":\"testdata/pg35542.epub\",\"ok\":true,\"problems\":[]}\n",
+        ))
+        .stdout(predicate::str::contains("\"ok\":false"))
+        .stdout(predicate::str::contains(
+            "{\"code\":\"missing-toc\",\"message\":",
+        ));
+}
+
+#[test]
+fn test_cli_line_ending() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-", "--line-ending", "crlf"]);
+    let output = cmd.assert().success().get_output().stdout.clone();
+    let markdown = String::from_utf8(output).unwrap();
+    assert!(markdown.ends_with("\r\n") && !markdown.ends_with("\r\n\r\n"));
+    assert!(!markdown.replace("\r\n", "").contains('\n'));
+    assert!(!markdown.contains("\r\n\r\n\r\n"));
+
+    let dir = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["--line-ending", "crlf", "--split"])
+        .arg(dir.path());
+    cmd.assert().success();
+    let index = fs::read_to_string(dir.path().join("index.md")).unwrap();
+    assert!(index.starts_with("# Contents\r\n\r\n- ["));
+}
+
+#[test]
+fn test_cli_validate_obfuscated_fonts() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args(["validate", "testdata/obfuscated-fonts.epub"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(
+            "testdata/obfuscated-fonts.epub: ok\n",
+        ))
+        .stdout(predicate::str::contains(
+            "testdata/obfuscated-fonts.epub: obfuscated-font: font OEBPS/fonts/Serif.ttf",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/obfuscated-fonts.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(
+            "The fonts are obfuscated, but the text is not.",
+        ))
+        .stderr(predicate::str::contains(
+            "without the obfuscated fonts: OEBPS/fonts/Serif.ttf, OEBPS/fonts/Sans Bold.ttf",
+        ));
+}
+
+#[test]
+fn test_cli_name_template() {
+    let dir = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/links.epub")
+        .arg("--split")
+        .arg(dir.path())
+        .args(["--name-template", "{index:03}_{slug}.md"]);
+    cmd.assert().success();
+    let first = fs::read_to_string(dir.path().join("001_chapter-one.md")).unwrap();
+    assert!(
+        first.contains("[in chapter two](002_chapter-two.md)"),
+        "{}",
+        first
+    );
+    let index = fs::read_to_string(dir.path().join("index.md")).unwrap();
+    assert!(index.contains("](001_chapter-one.md)"), "{}", index);
+
+    let dir = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/links.epub")
+        .arg("--split")
+        .arg(dir.path())
+        .args(["--name-template", "{book_title}/{idref}.md"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("'/' can't be part of a file name"));
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/links.epub")
+        .arg("--split")
+        .arg(dir.path())
+        .args(["--name-template", "{book_title} {idref}.md"]);
+    cmd.assert().success();
+    assert!(dir.path().join("Cross References ch2.md").exists());
+
+    // Colliding names are numbered rather than overwriting each other.
+    let dir = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/links.epub")
+        .arg("--split")
+        .arg(dir.path())
+        .args(["--name-template", "book.md"]);
+    cmd.assert().success();
+    assert!(dir.path().join("book.md").exists());
+    assert!(dir.path().join("book-2.md").exists());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/links.epub")
+        .arg("--split")
+        .arg(dir.path())
+        .args(["--name-template", "{number}.md"]);
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "invalid file name template {number}.md (unknown field {number}",
+    ));
+}
+
+#[test]
+fn test_cli_index_json() {
+    let dir = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub")
+        .arg("--split")
+        .arg(dir.path())
+        .arg("--index-json");
+    cmd.assert().success();
+    let index: serde_json::Value =
+        serde_json::from_slice(&fs::read(dir.path().join("index.json")).unwrap()).unwrap();
+    assert!(index["metadata"]["title"].is_string());
+    let chapters = index["chapters"].as_array().unwrap();
+    assert_eq!(chapters.len(), 4);
+    for chapter in chapters {
+        assert!(
+            dir.path().join(chapter["file"].as_str().unwrap()).exists(),
+            "{}",
+            chapter
+        );
+        assert!(chapter["href"].as_str().unwrap().ends_with("html"));
+    }
+    assert!(chapters
+        .iter()
+        .any(|chapter| chapter["words"].as_u64().unwrap() > 0));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542.epub").arg("--index-json");
+    cmd.assert().failure();
+}
+
+#[test]
+fn test_cli_bundle() {
+    let dir = tempfile::tempdir().unwrap();
+    let output = dir.path().join("book.zip");
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images.epub")
+        .arg("-o")
+        .arg(&output);
+    cmd.assert().success();
+    // Entries are stored, so their names and the markdown show in the bytes.
+    let zip = fs::read(&output).unwrap();
+    assert!(zip.starts_with(b"PK\x03\x04"));
+    let text = String::from_utf8_lossy(&zip);
+    for name in [
+        "index.md",
+        "index.json",
+        "images/6789594627817495676_fig-00-400.png",
+    ] {
+        assert!(text.contains(name), "{} is missing", name);
+    }
+    assert!(text.contains("](images/6789594627817495676_fig-00-400.png"));
+    assert_eq!(fs::read_dir(dir.path()).unwrap().count(), 1);
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images.epub")
+        .arg("-o")
+        .arg(&output);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("already exists"));
+
+    let output = dir.path().join("shared");
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images.epub")
+        .arg("--bundle")
+        .arg("-o")
+        .arg(&output);
+    cmd.assert().success();
+    assert!(fs::read(&output).unwrap().starts_with(b"PK\x03\x04"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pg35542-images.epub")
+        .args(["--format", "json", "-o"])
+        .arg(dir.path().join("book.json.zip"));
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("--format json"));
+}
+
+#[test]
+fn test_cli_toc() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub").args([
+        "-o",
+        "-",
+        "--no-front-matter",
+        "--toc",
+        "--toc-depth",
+        "1",
+    ]);
+    cmd.assert().success().stdout(predicate::str::starts_with(
+        "- [Chapter One: The Harbour](#chapter-one-the-harbour)\n- [Chapter Two",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-", "--toc-depth", "3"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("--toc"));
+}
+
+#[test]
+fn test_cli_chapters() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/many-chapters.epub").args([
+        "-o",
+        "-",
+        "--chapters",
+        "3,5-6",
+        "--no-front-matter",
+        "--no-toc",
+    ]);
+    let output = cmd.assert().success().get_output().stdout.clone();
+    let markdown = String::from_utf8(output).unwrap();
+    for n in [3, 5, 6] {
+        assert!(
+            markdown.contains(&format!("# Chapter {}\n", n)),
+            "{}",
+            markdown
+        );
+    }
+    assert!(!markdown.contains("# Chapter 4\n") && !markdown.contains("# Chapter 7\n"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-", "--chapters", "3-7"]);
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "Chapter 7 is out of range: the book has 2 chapters, valid chapters are 1-2",
+    ));
+}
+
+#[test]
+fn test_cli_grep() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["--grep", "the", "-i", "-C", "0"]);
+    cmd.assert().success().stdout(predicate::str::diff(
+        "Chapter One: The Harbour (text/ch1.xhtml)\n1:Chapter One: The Harbour\n--\n3:The ship waited at the quay.\n--\n\
+         9:The Open Sea\n",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["--grep", "dawn|island", "-E", "-C", "1"]);
+    cmd.assert().success().stdout(predicate::str::diff(
+        "Chapter One: The Harbour (text/ch1.xhtml)\n6-\n7:We left at dawn.\n8-\n\n\
+         Chapter Two: Landfall (text/ch2.xhtml)\n2-\n3:At last, an island.\n",
+    ));
+
+    // Case matters without -i.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub").args(["--grep", "sea"]);
+    cmd.assert()
+        .failure()
+        .code(1)
+        .stdout(predicate::str::is_empty());
+}
+
+#[test]
+fn test_cli_fresh() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-"])
+        .arg("--fresh");
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("--read"));
+
+    // The reader refuses to start without a terminal, before touching any saved position.
+    let config = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["--read", "--fresh"])
+        .env("XDG_CONFIG_HOME", config.path());
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "--read needs stdout to be a terminal",
+    ));
+    assert!(!config.path().join("cipher").exists());
+}
+
+#[test]
+fn test_cli_guide() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/guide.epub").arg("--guide");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(
+            "cover  text/front.xhtml       (guide)  Cover\n",
+        ))
+        .stdout(predicate::str::contains(
+            "text   text/ch1.xhtml#start  (guide)  Beginning\n",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/matter.epub")
+        .args(["--guide", "--format", "json"]);
+    cmd.assert().success().stdout(predicate::str::contains(
+        "{\"kind\":\"bodymatter\",\"title\":\"Start\",\"href\":\"text/ch1.xhtml\",\"source\":\"landmarks\"}",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/guide.epub")
+        .args(["-o", "-", "--mark-start"]);
+    cmd.assert().success().stdout(predicate::str::contains(
+        "<a id=\"start-reading\"></a>\n\n# Rats Indoors",
+    ));
+}
+
+#[test]
+fn test_cli_pager() {
+    // cat stands in for the pager, so what it's given ends up on stdout.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["--pager", "--style", "notty"])
+        .env("PAGER", "cat");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::starts_with("§ 1/2  "))
+        .stdout(predicate::str::contains("\n\n§ 2/2  "));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .arg("--pager")
+        .env("PAGER", "false");
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("The pager false exited with"));
+
+    // Without a $PAGER it's the built-in one, which needs a terminal.
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .arg("--pager")
+        .env_remove("PAGER");
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("needs stdout to be a terminal"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["--pager", "--read"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("cannot be used with"));
+}
+
+#[test]
+fn test_cli_include_nonlinear() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/nonlinear.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Rats wake at dusk."))
+        .stdout(predicate::str::contains("# Appendix\n"))
+        .stdout(predicate::str::contains("Copyright 1902"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/nonlinear.epub")
+        .args(["-o", "-"])
+        .arg("--include-nonlinear");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Copyright 1902"))
+        .stdout(predicate::str::contains("# Appendix").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/nonlinear.epub")
+        .args(["-o", "-"])
+        .arg("--drop-nonlinear");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Rats wake at dusk."))
+        .stdout(predicate::str::contains("Copyright 1902").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/nonlinear.epub")
+        .args(["--include-nonlinear", "--drop-nonlinear"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("cannot be used with"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/nonlinear.epub").arg("--list-chapters");
+    cmd.assert().success().stdout(predicate::str::diff(
+        "  1  one        Chapter One\n  2  note       (non-linear)\n  3  two        Chapter Two\n  4  copyright  (non-linear)\n",
+    ));
+}
+
+#[test]
+fn test_cli_max_chapter_size() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/large-chapter.epub")
+        .args(["-o", "-", "--max-chapter-size", "1024"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("A short preface."))
+        .stdout(predicate::str::contains("> [conversion failed: large.xhtml: the chapter is 3065 KiB"))
+        .stderr(predicate::str::contains("warning: failed to convert large.xhtml: the chapter is 3065 KiB, over the 1024 KiB limit"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/large-chapter.epub")
+        .args(["--max-chapter-size", "1024", "--strict"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("over the 1024 KiB limit"));
+}
+
+#[test]
+fn test_cli_cache() {
+    let dir = tempfile::tempdir().unwrap();
+    let cipher = || {
+        let mut cmd = Command::cargo_bin("cipher").unwrap();
+        cmd.env("XDG_CACHE_HOME", dir.path());
+        cmd
+    };
+    let first = cipher()
+        .args(["testdata/epub3-nav.epub", "-o", "-", "--cache"])
+        .output()
+        .unwrap();
+    assert!(first.status.success());
+    let cached = dir.path().join("cipher");
+    assert_eq!(fs::read_dir(&cached).unwrap().count(), 1);
+
+    cipher()
+        .args(["testdata/epub3-nav.epub", "-o", "-", "--cache", "--verbose"])
+        .assert()
+        .success()
+        .stdout(predicate::str::diff(
+            String::from_utf8(first.stdout).unwrap(),
+        ))
+        .stderr(predicate::str::contains("using the cached markdown"));
+    // Other options are another entry.
+    cipher()
+        .args(["testdata/epub3-nav.epub", "-o", "-", "--cache", "--no-toc"])
+        .assert()
+        .success();
+
+    cipher()
+        .arg("--cache-info")
+        .assert()
+        .success()
+        .stdout(predicate::str::contains(format!(
+            "directory: {}\nbooks: 2\n",
+            cached.display()
+        )));
+    cipher()
+        .arg("--clear-cache")
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("removed 2 cached books"));
+    assert_eq!(fs::read_dir(&cached).unwrap().count(), 0);
+}
+
+#[test]
+fn test_cli_strip_boilerplate() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/boilerplate.epub")
+        .args(["-o", "-", "--strip-boilerplate", "--verbose"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("More books at rattus.example").not())
+        .stderr(predicate::str::contains(
+            "removed boilerplate \"More books at rattus.example\" from 4 chapters",
+        ))
+        .stderr(predicate::str::contains(
+            "removed boilerplate \"Rattus Press · The Rat Keeper's Library\" from 5 chapters",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/boilerplate.epub")
+        .args(["-o", "-"])
+        .arg("--strip-boilerplate=100");
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("More books at rattus.example"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/boilerplate.epub")
+        .args(["-o", "-"])
+        .arg("--strip-boilerplate=0");
+    cmd.assert().failure();
+}
+
+#[test]
+fn test_cli_dedupe_boilerplate() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/repeated-headers.epub").args([
+        "-o",
+        "-",
+        "--dedupe-boilerplate",
+        "--verbose",
+    ]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("# Feeding"))
+        .stderr(predicate::str::contains(
+            "removed repeated \"by A. Rat\" from 3 chapters",
+        ))
+        .stderr(predicate::str::contains(
+            "removed repeated \"## The Rat Keeper\" from 2 chapters",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/repeated-headers.epub")
+        .args(["-o", "-"])
+        .arg("--dedupe-boilerplate=1");
+    cmd.assert().failure();
+}
+
+#[test]
+fn test_cli_skip_front_and_back_matter() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/matter.epub")
+        .args(["--list-chapters", "--keep", "p002"]);
+    cmd.assert().success().stdout(predicate::str::diff(concat!(
+        "  1  cover  (front matter)\n",
+        "  2  p002\n",
+        "  3  nav    (front matter)\n",
+        "  4  ch1    Rats at Home\n",
+        "  5  ch2    What Rats Eat\n",
+        "  6  ch3    Rats Abroad\n",
+        "  7  also   (back matter)\n",
+        "  8  ads    (back matter)\n",
+    )));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/matter.epub").args([
+        "-o",
+        "-",
+        "--skip-front-matter",
+        "--skip-back-matter",
+        "--verbose",
+    ]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Rats nest under floors."))
+        .stdout(predicate::str::contains("COVER ART").not())
+        .stdout(predicate::str::contains("SUBSCRIBE").not())
+        .stderr(predicate::str::contains(
+            "skipping front matter text/cover.xhtml",
+        ))
+        .stderr(predicate::str::contains(
+            "skipping back matter text/adcard.xhtml",
+        ));
+}
+
+#[test]
+fn test_cli_skip_title_and_href() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/matter.epub").args([
+        "-o",
+        "-",
+        "--skip-title",
+        "what rats",
+        "--skip-href",
+        "adcard",
+        "--skip-href",
+        "also-by",
+        "--verbose",
+    ]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Rats travel by ship."))
+        .stdout(predicate::str::contains("Grain, mostly.").not())
+        .stdout(predicate::str::contains("SUBSCRIBE").not())
+        .stdout(predicate::str::contains("ALSO BY").not())
+        .stderr(predicate::str::contains(
+            "skipping text/contents.xhtml, titled \"What Rats Eat\"",
+        ))
+        .stderr(predicate::str::contains(
+            "skipping text/adcard.xhtml by its href",
+        ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/matter.epub")
+        .args(["--skip-title", "(unclosed"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("Invalid pattern"));
+}
+
+#[test]
+fn test_cli_verse_class() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/poetry.epub").args([
+        "-o",
+        "-",
+        "--verse-class",
+        "verse",
+        "--line-break",
+        "backslash",
+    ]);
+    cmd.assert().success().stdout(predicate::str::contains(
+        "Whiskers twitch,\\\nthe pantry creaks;\n\na crumb is missed\\\n",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/poetry.epub")
+        .args(["--line-break", "tab"]);
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "invalid line break tab (expected spaces or backslash)",
+    ));
+}
+
+#[test]
+fn test_cli_unreadable() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/unreadable.epub")
+        .args(["-o", "-", "--unreadable", "skip"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("This one reads fine too."))
+        .stdout(predicate::str::contains("unreadable").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/unreadable.epub")
+        .args(["-o", "-", "--unreadable", "fail"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("Failed to read OEBPS/nav.xhtml"));
+}
+
+#[test]
+fn test_cli_dry_run() {
+    let out = tempfile::tempdir().unwrap();
+    let markdown = out.path().join("markdown");
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.args([
+        "testdata/pg35542.epub",
+        "testdata/table.epub",
+        "--dry-run",
+        "--output-dir",
+    ])
+    .arg(&markdown);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(format!(
+            "would write {} (",
+            markdown.join("pg35542.md").display()
+        )))
+        .stdout(predicate::str::contains(format!(
+            "would write {} (",
+            markdown.join("table.md").display()
+        )))
+        .stderr(predicate::str::contains("would convert 2, failed 0"));
+    assert!(!markdown.exists());
+
+    // The chapter files --split would write, without the directory.
+    let split = out.path().join("split");
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/table.epub")
+        .arg("--split")
+        .arg(&split)
+        .args(["--index-json", "--dry-run"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains(format!(
+            "would write {} (",
+            split.join("01-rodents-in-numbers.md").display()
+        )))
+        .stdout(predicate::str::contains(format!(
+            "would write {} (",
+            split.join("index.md").display()
+        )))
+        .stdout(predicate::str::contains(format!(
+            "would write {} (",
+            split.join("index.json").display()
+        )));
+    assert!(!split.exists());
+
+    let existing = out.path().join("table.md");
+    fs::write(&existing, "already here").unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/table.epub")
+        .arg("--output")
+        .arg(&existing)
+        .arg("--dry-run");
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("already exists"));
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/table.epub")
+        .arg("--output")
+        .arg(&existing)
+        .args(["--dry-run", "--force"]);
+    cmd.assert().success();
+    assert_eq!(fs::read_to_string(&existing).unwrap(), "already here");
+}
+
+#[test]
+fn test_cli_math() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/math.epub")
+        .args(["-o", "-"])
+        .arg("--math");
+    cmd.assert().success().stdout(predicate::str::contains(
+        "$$x=\\frac{-b\\pm\\sqrt{b^{2}-4ac}}{2a}$$",
+    ));
+}
+
+#[test]
+fn test_cli_normalize() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/typography.epub")
+        .args(["-o", "-", "--normalize", "hyphens"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("The rodent ratcatcher"))
+        .stdout(predicate::str::contains("“Rats,” she said—and"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/typography.epub").arg("--smart");
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("--normalize"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/typography.epub")
+        .args(["--normalize", "ligatures"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("invalid normalization ligatures"));
+}
+
+#[test]
+fn test_cli_rtl_wrap() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rtl.epub")
+        .args(["-o", "-", "--rtl-wrap", "div"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("direction: \"rtl\"\n"))
+        .stdout(predicate::str::contains("<div dir=\"rtl\">\n\n"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/rtl.epub").args(["--rtl-wrap", "span"]);
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "invalid rtl wrap span (expected marks or div)",
+    ));
+}
+
+#[test]
+fn test_cli_ruby() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/ruby.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("漢字（かんじ）を読む。"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/ruby.epub")
+        .args(["-o", "-", "--keep-ruby-html"]);
+    cmd.assert().success().stdout(predicate::str::contains(
+        "<ruby>漢字<rp>（</rp><rt>かんじ</rt><rp>）</rp></ruby>を読む。",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/ruby.epub")
+        .args(["-o", "-", "--ruby", "base"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("漢字を読む。"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/ruby.epub").args(["--ruby", "furigana"]);
+    cmd.assert().failure().stderr(predicate::str::contains(
+        "invalid ruby form furigana (expected parentheses, base or html)",
+    ));
+}
+
+#[test]
+fn test_cli_keep_html() {
+    let book = common::EpubBuilder::new("Rats Kept Whole")
+        .chapter("Kept", "<h1>Kept</h1>\n<p>Rats drink H<sub>2</sub>O.</p>")
+        .build();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(book.path()).args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("Rats drink H<sub>2</sub>O."));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(book.path())
+        .args(["-o", "-", "--keep-html", "none"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("<sub>").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(book.path())
+        .args(["-o", "-", "--keep-html", "details,sup"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("<sub>").not());
+}
+
+#[test]
+fn test_cli_format_html() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-", "--format", "html"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::starts_with("<!DOCTYPE html>\n"))
+        .stdout(predicate::str::contains("<nav id=\"toc\">"))
+        .stdout(predicate::str::contains("<h1 id=\""))
+        .stdout(predicate::str::contains("At last, an island."))
+        // The metadata is in the <head>, not in front matter.
+        .stdout(predicate::str::contains("\n---\n").not())
+        .stdout(predicate::str::contains("</html>\n"));
+
+    let dir = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(fs::canonicalize("testdata/epub3-nav.epub").unwrap())
+        .args(["--format", "html"])
+        .current_dir(dir.path());
+    cmd.assert().success();
+    assert!(fs::read_to_string(dir.path().join("epub3-nav.html"))
+        .unwrap()
+        .contains("<main>"));
+}
+
+#[test]
+fn test_cli_format_org() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/epub3-nav.epub")
+        .args(["-o", "-", "--format", "org"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::starts_with("#+TITLE: "))
+        .stdout(predicate::str::contains("\n* "))
+        .stdout(predicate::str::contains(":CUSTOM_ID: "))
+        .stdout(predicate::str::contains("At last, an island."))
+        // The metadata is in keywords, not in front matter.
+        .stdout(predicate::str::contains("\n---\n").not());
+
+    let dir = tempfile::tempdir().unwrap();
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(fs::canonicalize("testdata/epub3-nav.epub").unwrap())
+        .args(["--format", "org"])
+        .current_dir(dir.path());
+    cmd.assert().success();
+    assert!(fs::read_to_string(dir.path().join("epub3-nav.org"))
+        .unwrap()
+        .starts_with("#+TITLE: "));
+}
+
+#[test]
+fn test_cli_page_markers() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pagebreaks.epub").args(["-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("came ashore in the year"))
+        .stdout(predicate::str::contains("<!-- page").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pagebreaks.epub")
+        .args(["-o", "-", "--page-markers"]);
+    cmd.assert().success().stdout(predicate::str::contains(
+        "came ashore<!-- page 2 --> in the year",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pagebreaks.epub")
+        .args(["-o", "-", "--page-markers=[p. {page}]"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("came ashore[p. 2] in the year"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pagebreaks.epub")
+        .args(["-o", "-", "--pages=<sup>{page}</sup>"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("granary<sup>5</sup> all winter"));
+}
+
+#[test]
+fn test_cli_page_list() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pagebreaks.epub").arg("--page-list");
+    cmd.assert().success().stdout(predicate::str::starts_with(
+        "1  ch1.xhtml#page1\n2  ch1.xhtml#page2\n",
+    ));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/pagebreaks-nav.epub")
+        .args(["--page-list", "--format", "json"]);
+    cmd.assert().success().stdout(predicate::str::diff(
+        "[{\"page\":\"i\",\"href\":\"ch1.xhtml#page1\"},{\"page\":\"ii\",\"href\":\"ch1.xhtml#page2\"}]\n",
+    ));
+}
+
+#[test]
+fn test_cli_url() {
+    let book = fs::read("testdata/pg35542.epub").unwrap();
+    let url = common::serve(vec![common::response(
+        "200 OK",
+        &["Content-Type: application/epub+zip"],
+        &book,
+    )]);
+    let dir = tempfile::tempdir().unwrap();
+    let output = dir.path().join("book.md");
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(format!("{}/ebooks/pg35542.epub", url))
+        .arg("--keep-download")
+        .arg("-o")
+        .arg(&output);
+    cmd.assert().success();
+    assert!(fs::read_to_string(&output).unwrap().contains("# "));
+    assert_eq!(fs::read(dir.path().join("pg35542.epub")).unwrap(), book);
+
+    let url = common::serve(vec![common::response("410 Gone", &[], b"")]);
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg(format!("{}/ebooks/pg35542.epub", url))
+        .arg("-o")
+        .arg(dir.path().join("gone.md"));
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("410 Gone"));
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("https://example.com/book.epub")
+        .arg("testdata/pg35542.epub")
+        .arg("--output-dir")
+        .arg(dir.path());
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains("can only be downloaded"));
+}
+
+#[test]
+fn test_cli_match_and_exclude() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/shuffled-manifest.epub").args([
+        "--match",
+        "(?i)^d",
+        "--exclude",
+        "dawn|ch3",
+        "-o",
+        "-",
+    ]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("The rats wake."))
+        .stdout(predicate::str::contains("go home").not());
+
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/shuffled-manifest.epub")
+        .args(["--match", "^Appendix", "-o", "-"]);
+    cmd.assert()
+        .failure()
+        .stderr(predicate::str::contains(
+            "No chapter matches the title and href filters",
+        ))
+        .stderr(predicate::str::contains("\"Midnight\""));
+}
+
+#[test]
+fn test_cli_number_headings() {
+    let mut cmd = Command::cargo_bin("cipher").unwrap();
+    cmd.arg("testdata/outline.epub")
+        .args(["--number-headings", "-o", "-"]);
+    cmd.assert()
+        .success()
+        .stdout(predicate::str::contains("### 1.1. Cage sizes\n"))
+        .stdout(predicate::str::contains("# 2. Feeding\n"));
 }
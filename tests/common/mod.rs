@@ -0,0 +1,282 @@
+use std::env;
+use std::fs;
+use std::io::{Read, Write};
+use std::net::TcpListener;
+use std::path::Path;
+use std::thread;
+use tempfile::TempDir;
+
+// Compares `actual` against testdata/golden/<name>. Set UPDATE_GOLDEN=1 to
+// (re)write the golden file; a missing one fails the test rather than
+// passing unchecked.
+#[allow(dead_code)]
+pub fn assert_golden(name: &str, actual: &str) {
+    let path = Path::new("testdata/golden").join(name);
+    if env::var_os("UPDATE_GOLDEN").is_some() {
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(&path, actual).unwrap();
+        return;
+    }
+    assert!(
+        path.exists(),
+        "{} is missing; re-run with UPDATE_GOLDEN=1 to write it",
+        path.display()
+    );
+    let expected = fs::read_to_string(&path).unwrap();
+    assert_eq!(expected, actual, "output differs from {}", path.display());
+}
+
+// A book written out as an unpacked EPUB in a temporary folder, which the
+// converter zips up in memory like any unpacked book, so that a test can say
+// what it converts without a binary fixture.
+//
+//     let book = EpubBuilder::new("Rats")
+//         .chapter("One", "<h1>One</h1><p>Rats.</p>")
+//         .section("Whiskers", "whiskers")
+//         .build();
+//     let markdown = convert_file(book.path())?;
+#[allow(dead_code)]
+pub struct EpubBuilder {
+    title: String,
+    chapters: Vec<BuiltChapter>,
+    files: Vec<(String, String, Vec<u8>)>,
+    toc: bool,
+}
+
+struct BuiltChapter {
+    title: String,
+    body: String,
+    /// TOC entries under the chapter's own: (title, fragment).
+    sections: Vec<(String, String)>,
+}
+
+#[allow(dead_code)]
+pub struct BuiltEpub {
+    dir: TempDir,
+    path: String,
+}
+
+#[allow(dead_code)]
+impl BuiltEpub {
+    pub fn path(&self) -> &str {
+        &self.path
+    }
+
+    // The folder the book was written to, which goes away with it.
+    pub fn dir(&self) -> &Path {
+        self.dir.path()
+    }
+}
+
+#[allow(dead_code)]
+impl EpubBuilder {
+    pub fn new(title: &str) -> Self {
+        EpubBuilder {
+            title: title.to_string(),
+            chapters: Vec::new(),
+            files: Vec::new(),
+            toc: true,
+        }
+    }
+
+    // Adds a chapter to the spine and the TOC, saved as chN.xhtml. `body` is
+    // the markup inside its <body>.
+    pub fn chapter(mut self, title: &str, body: &str) -> Self {
+        self.chapters.push(BuiltChapter {
+            title: title.to_string(),
+            body: body.to_string(),
+            sections: Vec::new(),
+        });
+        self
+    }
+
+    // Adds a TOC entry under the last chapter's, pointing at the element
+    // with id `fragment` in it.
+    pub fn section(mut self, title: &str, fragment: &str) -> Self {
+        let chapter = self
+            .chapters
+            .last_mut()
+            .expect("a section goes under a chapter");
+        chapter
+            .sections
+            .push((title.to_string(), fragment.to_string()));
+        self
+    }
+
+    // Adds a manifest item outside the spine, such as an image, at `href`
+    // relative to the package document.
+    pub fn file(mut self, href: &str, media_type: &str, bytes: &[u8]) -> Self {
+        self.files
+            .push((href.to_string(), media_type.to_string(), bytes.to_vec()));
+        self
+    }
+
+    // Leaves the NCX's navMap empty, for a book without a table of contents.
+    pub fn without_toc(mut self) -> Self {
+        self.toc = false;
+        self
+    }
+
+    pub fn build(self) -> BuiltEpub {
+        let dir = tempfile::tempdir().unwrap();
+        let root = dir.path().join("book");
+        let write = |name: &str, contents: &[u8]| {
+            let path = root.join(name);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, contents).unwrap();
+        };
+        write("mimetype", b"application/epub+zip");
+        write(
+            "META-INF/container.xml",
+            concat!(
+                "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n",
+                "<container version=\"1.0\" xmlns=\"urn:oasis:names:tc:opendocument:xmlns:container\">\n",
+                "<rootfiles><rootfile full-path=\"OEBPS/content.opf\" media-type=\"application/oebps-package+xml\"/>",
+                "</rootfiles>\n</container>\n"
+            )
+            .as_bytes(),
+        );
+
+        let ncx = "<item id=\"ncx\" href=\"toc.ncx\" media-type=\"application/x-dtbncx+xml\"/>";
+        let mut manifest = vec![ncx.to_string()];
+        let mut spine = Vec::new();
+        let mut nav_points = Vec::new();
+        let mut play_order = 0;
+        for (i, chapter) in self.chapters.iter().enumerate() {
+            let href = format!("ch{}.xhtml", i + 1);
+            manifest.push(format!(
+                "<item id=\"ch{}\" href=\"{}\" media-type=\"application/xhtml+xml\"/>",
+                i + 1,
+                href
+            ));
+            spine.push(format!("<itemref idref=\"ch{}\"/>", i + 1));
+            write(
+                &format!("OEBPS/{}", href),
+                format!(
+                    concat!(
+                        "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!DOCTYPE html>\n",
+                        "<html xmlns=\"http://www.w3.org/1999/xhtml\" xmlns:epub=\"http://www.idpf.org/2007/ops\">\n",
+                        "<head><title>{}</title></head>\n<body>\n{}\n</body>\n</html>\n"
+                    ),
+                    escape(&chapter.title),
+                    chapter.body
+                )
+                .as_bytes(),
+            );
+            play_order += 1;
+            let mut point = format!(
+                "<navPoint id=\"nav{}\" playOrder=\"{}\"><navLabel><text>{}</text></navLabel><content src=\"{}\"/>",
+                play_order,
+                play_order,
+                escape(&chapter.title),
+                href
+            );
+            for (title, fragment) in &chapter.sections {
+                play_order += 1;
+                point.push_str(&format!(
+                    concat!(
+                        "<navPoint id=\"nav{}\" playOrder=\"{}\"><navLabel><text>{}</text></navLabel>",
+                        "<content src=\"{}#{}\"/></navPoint>"
+                    ),
+                    play_order,
+                    play_order,
+                    escape(title),
+                    href,
+                    fragment
+                ));
+            }
+            point.push_str("</navPoint>");
+            if self.toc {
+                nav_points.push(point);
+            }
+        }
+        for (i, (href, media_type, bytes)) in self.files.iter().enumerate() {
+            manifest.push(format!(
+                "<item id=\"file{}\" href=\"{}\" media-type=\"{}\"/>",
+                i + 1,
+                href,
+                media_type
+            ));
+            write(&format!("OEBPS/{}", href), bytes);
+        }
+        write(
+            "OEBPS/content.opf",
+            format!(
+                concat!(
+                    "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n",
+                    "<package xmlns=\"http://www.idpf.org/2007/opf\" version=\"2.0\" unique-identifier=\"bookid\">\n",
+                    "<metadata xmlns:dc=\"http://purl.org/dc/elements/1.1/\">",
+                    "<dc:identifier id=\"bookid\">urn:uuid:built</dc:identifier><dc:title>{}</dc:title>",
+                    "<dc:language>en</dc:language></metadata>\n",
+                    "<manifest>\n{}\n</manifest>\n<spine toc=\"ncx\">\n{}\n</spine>\n</package>\n"
+                ),
+                escape(&self.title),
+                manifest.join("\n"),
+                spine.join("\n")
+            )
+            .as_bytes(),
+        );
+        write(
+            "OEBPS/toc.ncx",
+            format!(
+                concat!(
+                    "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n",
+                    "<ncx xmlns=\"http://www.daisy.org/z3986/2005/ncx/\" version=\"2005-1\">\n",
+                    "<head><meta name=\"dtb:uid\" content=\"urn:uuid:built\"/></head>\n",
+                    "<docTitle><text>{}</text></docTitle>\n<navMap>\n{}\n</navMap>\n</ncx>\n"
+                ),
+                escape(&self.title),
+                nav_points.join("\n")
+            )
+            .as_bytes(),
+        );
+        let path = root.to_string_lossy().into_owned();
+        BuiltEpub { dir, path }
+    }
+}
+
+fn escape(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+}
+
+// Serves each of `responses` (status line, headers and body) to one request
+// in turn on a local port, closing the connection after each, and returns the
+// server's base URL. Enough HTTP for the downloads the converter makes.
+#[allow(dead_code)]
+pub fn serve(responses: Vec<Vec<u8>>) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+    let url = format!("http://{}", listener.local_addr().unwrap());
+    thread::spawn(move || {
+        for response in responses {
+            let Ok((mut stream, _)) = listener.accept() else {
+                return;
+            };
+            let mut request = Vec::new();
+            let mut byte = [0];
+            while !request.ends_with(b"\r\n\r\n") && stream.read(&mut byte).is_ok_and(|n| n == 1) {
+                request.push(byte[0]);
+            }
+            let _ = stream.write_all(&response);
+        }
+    });
+    url
+}
+
+// A response, closing the connection, with `headers` given as "Name: value".
+#[allow(dead_code)]
+pub fn response(status: &str, headers: &[&str], body: &[u8]) -> Vec<u8> {
+    let mut response = format!(
+        "HTTP/1.1 {}\r\nContent-Length: {}\r\nConnection: close\r\n",
+        status,
+        body.len()
+    );
+    for header in headers {
+        response.push_str(&format!("{}\r\n", header));
+    }
+    response.push_str("\r\n");
+    let mut response = response.into_bytes();
+    response.extend_from_slice(body);
+    response
+}
@@ -0,0 +1,27 @@
+use cipher::{language_direction, Direction, RtlWrap};
+
+#[test]
+fn test_language_direction() {
+    for language in ["he", "ar", "ar-EG", "fa-IR", "ur", "yi", "HE", "iw"] {
+        assert_eq!(language_direction(language), Direction::Rtl, "{}", language);
+    }
+    for language in ["en", "en-GB", "de", "zh-Hant", "", "hebrew"] {
+        assert_eq!(language_direction(language), Direction::Ltr, "{}", language);
+    }
+    // The script decides when the tag names one.
+    assert_eq!(language_direction("az-Arab"), Direction::Rtl);
+    assert_eq!(language_direction("sd-Deva-IN"), Direction::Ltr);
+    assert_eq!(language_direction("ku_arab"), Direction::Rtl);
+}
+
+#[test]
+fn test_parse_direction() {
+    assert_eq!("rtl".parse::<Direction>().unwrap(), Direction::Rtl);
+    assert_eq!(" LTR ".parse::<Direction>().unwrap(), Direction::Ltr);
+    assert_eq!(
+        "default".parse::<Direction>().unwrap_err(),
+        "invalid direction default (expected ltr or rtl)"
+    );
+    assert_eq!("div".parse::<RtlWrap>().unwrap(), RtlWrap::Div);
+    assert_eq!(RtlWrap::Marks.to_string(), "marks");
+}
@@ -0,0 +1,51 @@
+use cipher::dom::{self, Node};
+
+#[test]
+fn test_round_trip() {
+    let html = r#"<?xml version="1.0"?><!DOCTYPE html><html><head><title>T &amp; U</title><style>p > a { color: red }</style></head><body><!-- note --><p class="x">One<br/>two &mdash; <a href="a.xhtml#b">link</a></p></body></html>"#;
+    let nodes = dom::parse(html);
+    assert_eq!(dom::serialize(&nodes), html);
+}
+
+#[test]
+fn test_lenient_parsing() {
+    let nodes = dom::parse("<div><p>unclosed<p>second</div></span>tail");
+    assert_eq!(
+        dom::serialize(&nodes),
+        "<div><p>unclosed<p>second</p></p></div>tail"
+    );
+}
+
+#[test]
+fn test_empty_elements_are_closed() {
+    let nodes = dom::parse(r#"<p><a id="anchor"/>Text</p>"#);
+    assert_eq!(dom::serialize(&nodes), r#"<p><a id="anchor"></a>Text</p>"#);
+}
+
+#[test]
+fn test_attributes_and_text() {
+    let mut nodes =
+        dom::parse(r#"<img src='a b.png' alt="&quot;Hi&quot;"><svg:image xlink:href="c.svg"/>"#);
+    let mut names = Vec::new();
+    dom::walk(&nodes, &mut |el| {
+        names.push((
+            el.local_name().to_string(),
+            el.attr("href").map(String::from),
+        ))
+    });
+    assert_eq!(names[1], ("image".to_string(), Some("c.svg".to_string())));
+
+    dom::walk_mut(&mut nodes, &mut |el| {
+        if el.is("img") {
+            el.set_attr("src", "images/a.png");
+        }
+    });
+    assert_eq!(
+        dom::serialize(&nodes),
+        r#"<img src="images/a.png" alt="&quot;Hi&quot;"/><svg:image xlink:href="c.svg"></svg:image>"#
+    );
+    match &dom::parse("<p>A &amp; <b>B</b>&#8217;s</p>")[0] {
+        Node::Element(p) => assert_eq!(p.text(), "A & B’s"),
+        other => panic!("unexpected node {:?}", other),
+    }
+}
@@ -0,0 +1,128 @@
+use cipher::download::{fetch, file_name, is_url};
+use std::fs;
+use std::time::Duration;
+
+mod common;
+
+const BOOK: &str = "testdata/pg35542.epub";
+const MIB: u64 = 1024 * 1024;
+
+#[test]
+fn test_is_url() {
+    assert!(is_url(
+        "https://www.gutenberg.org/ebooks/35542.epub3.images"
+    ));
+    assert!(is_url("HTTP://example.com/book.epub"));
+    assert!(!is_url("ftp://example.com/book.epub"));
+    assert!(!is_url("testdata/pg35542.epub"));
+    assert!(!is_url("-"));
+}
+
+#[test]
+fn test_file_name() {
+    assert_eq!(
+        file_name("https://example.com/books/rats.epub?download=1"),
+        "rats.epub"
+    );
+    assert_eq!(
+        file_name("https://www.gutenberg.org/ebooks/35542.epub3.images"),
+        "35542.epub3.images.epub"
+    );
+    assert_eq!(file_name("https://example.com/"), "download.epub");
+    assert_eq!(file_name("https://example.com"), "download.epub");
+}
+
+#[tokio::test]
+async fn test_fetch_follows_redirects() {
+    let book = fs::read(BOOK).unwrap();
+    // Served without a content type, so the zip's magic bytes vouch for it.
+    let url = common::serve(vec![
+        common::response("302 Found", &["Location: /files/pg35542.epub"], b""),
+        common::response("200 OK", &[], &book),
+    ]);
+    let download = fetch(
+        &format!("{}/ebooks/35542", url),
+        Duration::from_secs(10),
+        512 * MIB,
+    )
+    .await
+    .unwrap();
+    assert_eq!(fs::read(download.path()).unwrap(), book);
+    assert_eq!(download.file_name(), "pg35542.epub");
+
+    let path = download.path().to_path_buf();
+    drop(download);
+    assert!(!path.exists(), "{} was left behind", path.display());
+}
+
+#[tokio::test]
+async fn test_fetch_keep() {
+    let book = fs::read(BOOK).unwrap();
+    let url = common::serve(vec![common::response(
+        "200 OK",
+        &["Content-Type: application/epub+zip"],
+        &book,
+    )]);
+    let download = fetch(
+        &format!("{}/rats.epub", url),
+        Duration::from_secs(10),
+        512 * MIB,
+    )
+    .await
+    .unwrap();
+    let dir = tempfile::tempdir().unwrap();
+    let kept = dir.path().join(download.file_name());
+    download.keep(&kept, false).unwrap();
+    assert_eq!(fs::read(&kept).unwrap(), book);
+    let err = download.keep(&kept, false).unwrap_err();
+    assert!(err.to_string().contains("already exists"), "{}", err);
+    download.keep(&kept, true).unwrap();
+}
+
+#[tokio::test]
+async fn test_fetch_errors() {
+    let url = common::serve(vec![common::response(
+        "404 Not Found",
+        &[],
+        b"no such book",
+    )]);
+    let err = fetch(
+        &format!("{}/missing.epub", url),
+        Duration::from_secs(10),
+        512 * MIB,
+    )
+    .await
+    .unwrap_err();
+    assert!(err.to_string().contains("404"), "{}", err);
+
+    let page = b"<!DOCTYPE html><html><body>Sign in</body></html>";
+    let url = common::serve(vec![common::response(
+        "200 OK",
+        &["Content-Type: text/html; charset=utf-8"],
+        page,
+    )]);
+    let err = fetch(
+        &format!("{}/book.epub", url),
+        Duration::from_secs(10),
+        512 * MIB,
+    )
+    .await
+    .unwrap_err();
+    assert!(
+        err.to_string()
+            .contains("isn't an EPUB (the server sent text/html"),
+        "{}",
+        err
+    );
+
+    let book = fs::read(BOOK).unwrap();
+    let url = common::serve(vec![common::response(
+        "200 OK",
+        &["Content-Type: application/epub+zip"],
+        &book,
+    )]);
+    let err = fetch(&format!("{}/book.epub", url), Duration::from_secs(10), 1024)
+        .await
+        .unwrap_err();
+    assert!(err.to_string().contains("larger than"), "{}", err);
+}
@@ -1,9 +1,3683 @@
 use anyhow::Result;
-use cipher::epub_to_markdown;
+use cipher::{
+    book_info, book_stats, build_toc, chapter_html, chapters_html, convert, convert_all,
+    convert_all_from, convert_books, convert_chapters, convert_chapters_from,
+    convert_chapters_with, convert_dir_with, convert_file, convert_file_with, convert_seekable,
+    epub_to_markdown, epub_to_markdown_file, extract_cover, guide, html_to_epub, list_items,
+    list_items_from, page_list, plan_books, read_metadata, reading_minutes, reading_order,
+    renditions, search, validate, validate_from, write_markdown, BatchError, Book, Bullet,
+    CancelToken, Cancelled, ChapterErrors, ChapterSelection, Converter, CoverOptions,
+    DefinitionList, Direction, DrmProtected, Emphasis, FigureCaption, Format, GuideSource,
+    HeadingStyle, ImageOptions, InvalidEpub, LineBreak, ListSpacing, MarkdownOptions, Matter,
+    MetadataFormat, NoCover, Nonlinear, Options, OrderedDelimiter, Pattern, Progress, QuoteStyle,
+    Rendition, RtlWrap, Ruby, SearchOptions, Transform, Typography, Unreadable,
+    DEFAULT_PAGE_MARKER, SECTION_MARKER,
+};
+use std::fs::{self, File};
+use std::io::{Cursor, Read, Seek, SeekFrom};
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+mod common;
 
 #[test]
 fn test_epub_to_markdown() -> Result<()> {
     let markdown_chunks = epub_to_markdown("testdata/pg35542.epub")?;
     assert!(!markdown_chunks.is_empty());
+    assert!(markdown_chunks
+        .iter()
+        .any(|chunk| chunk.contains("COMMUNITY EFFORTS")));
+    Ok(())
+}
+
+#[test]
+fn test_write_markdown() -> Result<()> {
+    let mut out = Vec::new();
+    write_markdown("testdata/pg35542.epub", &mut out)?;
+    let markdown = String::from_utf8(out)?;
+    assert!(markdown.contains("COMMUNITY EFFORTS"));
+    assert!(markdown.contains("rats"));
+    Ok(())
+}
+
+#[test]
+fn test_epub_to_markdown_file() -> Result<()> {
+    let dir = tempfile::tempdir()?;
+    let dst = dir.path().join("book.md");
+    epub_to_markdown_file("testdata/pg35542.epub", dst.to_str().unwrap())?;
+    let markdown = fs::read_to_string(&dst)?;
+    assert!(markdown.contains("COMMUNITY EFFORTS"));
+    assert!(markdown.contains("\n\n"));
+    Ok(())
+}
+
+#[test]
+fn test_convert_reader() -> Result<()> {
+    let markdown = convert(File::open("testdata/pg35542.epub")?)?;
+    assert!(markdown.contains("COMMUNITY EFFORTS"));
+    assert_eq!(markdown, convert_file("testdata/pg35542.epub")?);
+    Ok(())
+}
+
+#[test]
+fn test_convert_chapters() -> Result<()> {
+    let chapters = convert_chapters("testdata/pg35542.epub")?;
+    assert_eq!(chapters.len(), 4);
+    assert_eq!(chapters[0].href, "wrap0000.html");
+    assert_eq!(chapters[1].href, "2646190561790918633_35542-h-0.htm.html");
+    assert_eq!(chapters[1].title, "HOUSE RATS AND MICE");
+    assert_eq!(chapters[0].title, "\"Cover\"");
+    assert!(chapters[2].markdown.contains("COMMUNITY EFFORTS"));
+    Ok(())
+}
+
+#[test]
+fn test_metadata_json() -> Result<()> {
+    let metadata = read_metadata("testdata/rich-metadata.epub")?;
+    assert_eq!(
+        metadata.identifiers,
+        vec![
+            "urn:isbn:9780000000001",
+            "urn:uuid:5e3c1f0a-8d2b-4c6e-9a7f-1b2c3d4e5f60"
+        ]
+    );
+    let expected = fs::read_to_string("testdata/golden/rich-metadata.json")?;
+    assert_eq!(metadata.to_json() + "\n", expected);
+    Ok(())
+}
+
+#[test]
+fn test_book_info() -> Result<()> {
+    let info = book_info("testdata/rich-metadata.epub")?;
+    assert_eq!(info.title.as_deref(), Some("The Rich Metadata Book"));
+    assert_eq!(info.authors, vec!["Ada Lovelace", "Charles Babbage"]);
+    assert_eq!(info.identifier.as_deref(), Some("urn:isbn:9780000000001"));
+    assert_eq!(info.subjects, vec!["Computing"]);
+    assert_eq!(info.chapters, 2);
+    assert_eq!(info.manifest_items, 3);
+    assert_eq!(info.size, 529 + 284 + 287);
+    assert!(info.has_toc);
+
+    let info = book_info("testdata/svg-cover.epub")?;
+    assert_eq!(info.chapters, 3);
+    assert!(info.subjects.is_empty() && info.publisher.is_none());
+    Ok(())
+}
+
+#[test]
+fn test_front_matter() -> Result<()> {
+    let metadata = read_metadata("testdata/rich-metadata.epub")?;
+    assert_eq!(metadata.creators, vec!["Ada Lovelace", "Charles Babbage"]);
+    let expected = fs::read_to_string("testdata/golden/rich-metadata.frontmatter.yaml")?;
+    assert_eq!(metadata.front_matter(), expected);
+
+    let markdown = convert_file("testdata/rich-metadata.epub")?;
+    assert!(markdown.starts_with(&expected));
+
+    let options = Options {
+        front_matter: false,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/rich-metadata.epub", &options)?;
+    assert!(!markdown.starts_with("---"));
+
+    let pandoc = Options {
+        metadata_format: MetadataFormat::Pandoc,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/rich-metadata.epub", &pandoc)?;
+    assert!(markdown.starts_with(
+        "% The Rich Metadata Book\n% Ada Lovelace; Charles Babbage\n% 1843-10-01\n\n"
+    ));
+    assert!(!markdown.contains("---\ntitle:"));
+    let markdown = convert_file_with(
+        "testdata/rich-metadata.epub",
+        &Options {
+            front_matter: false,
+            ..pandoc
+        },
+    )?;
+    assert!(!markdown.starts_with('%'));
+    Ok(())
+}
+
+#[test]
+fn test_extract_images() -> Result<()> {
+    let dir = tempfile::tempdir()?;
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: dir.path().join("images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/pg35542-images.epub", &options)?;
+    assert!(dir
+        .path()
+        .join("images/6789594627817495676_fig-00-400.png")
+        .exists());
+    assert!(dir
+        .path()
+        .join("images/1054793958495425571_35542-cover.png")
+        .exists());
+    assert!(markdown.contains("](images/6789594627817495676_fig-00-400.png"));
+    Ok(())
+}
+
+#[test]
+fn test_html_input() -> Result<()> {
+    let markdown = convert_file("testdata/html/article.html")?;
+    assert!(markdown.contains("# Rats & Their Runs"), "{}", markdown);
+    assert!(markdown.contains("A saved article about rats."));
+    assert!(!markdown.contains("track()"));
+    assert_eq!(
+        read_metadata("testdata/html/article.html")?
+            .title
+            .as_deref(),
+        Some("Rats & Their Runs")
+    );
+
+    // Images are found next to the file and above it.
+    let dir = tempfile::tempdir()?;
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: dir.path().join("images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..Options::default()
+    };
+    let with_images = convert_file_with("testdata/html/article.html", &options)?;
+    let mut written: Vec<String> = fs::read_dir(dir.path().join("images"))?
+        .map(|entry| Ok(entry?.file_name().to_string_lossy().into_owned()))
+        .collect::<Result<_>>()?;
+    written.sort();
+    assert_eq!(written.len(), 2, "{:?}", written);
+    assert!(written.iter().any(|name| name.ends_with("rat.png")));
+    assert!(written.iter().any(|name| name.ends_with("whisker.png")));
+    assert!(with_images.contains("](images/"));
+    assert!(with_images.contains("](https://example.com/remote.png)"));
+
+    // HTML from elsewhere, such as stdin, is packed the same way.
+    let html = fs::read("testdata/html/article.html")?;
+    let epub = html_to_epub(&html, std::path::Path::new("testdata/html/article.html"))?;
+    assert_eq!(convert(Cursor::new(epub))?, markdown);
+    Ok(())
+}
+
+#[test]
+fn test_unpacked_epub_input() -> Result<()> {
+    let chapters = convert_chapters("testdata/unpacked-epub")?;
+    let titles: Vec<&str> = chapters
+        .iter()
+        .map(|chapter| chapter.title.as_str())
+        .collect();
+    assert_eq!(titles, ["Nests", "Runs"]);
+    assert!(chapters[0].markdown.contains("This book was never zipped."));
+    assert_eq!(
+        read_metadata("testdata/unpacked-epub")?.title.as_deref(),
+        Some("Unzipped Rats")
+    );
+    assert!(validate("testdata/unpacked-epub")?.is_empty());
+    let markdown = convert_file("testdata/unpacked-epub")?;
+    assert!(markdown.contains("[the runs](#runs)"), "{}", markdown);
+    Ok(())
+}
+
+#[test]
+fn test_embed_images() -> Result<()> {
+    let options = Options {
+        embed_images: Some(20_000),
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/pg35542-images.epub", &options)?;
+    // fig-10-400.png is about 5 KB, fig-00-400.png about 68 KB.
+    assert!(markdown.contains("](data:image/png;base64,iVBORw0KGgo"));
+    assert!(markdown.contains("](6789594627817495676_fig-00-400.png"));
+    assert!(!markdown.contains("fig-10-400.png"));
+
+    let dir = tempfile::tempdir()?;
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: dir.path().join("images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..options
+    };
+    let err = convert_file_with("testdata/pg35542-images.epub", &options).unwrap_err();
+    assert!(err.to_string().contains("both extracted and embedded"));
+    Ok(())
+}
+
+#[test]
+fn test_image_alt_and_title() -> Result<()> {
+    let markdown = convert_file("testdata/figures.epub")?;
+    assert!(markdown.contains("![A brown rat on a wall](images/rat.png \"Rattus norvegicus\")"));
+    // A figure's caption stands in for missing alt text.
+    assert!(markdown.contains("![The granary at dawn](images/granary.png)"));
+    assert!(markdown.contains("![Mouse](images/mouse.png)"));
+    // Without alt text or a caption, the file name.
+    assert!(markdown.contains("![plain.png](images/plain.png)"));
+    assert!(markdown.contains("![Rat \\[brown\\]](images/brown.png)"));
+    assert!(!markdown.contains("width="));
+    Ok(())
+}
+
+#[test]
+fn test_figure_captions() -> Result<()> {
+    let book = "testdata/captioned-figures.epub";
+    let markdown = convert_file(book)?;
+    for expected in [
+        "The brown rat is the larger of the two.\n\n\
+         ![Figure 1. The brown rat, Rattus norvegicus](images/brown-rat.png)\n\n\
+         *Figure 1. The brown rat, Rattus norvegicus*\n\nIts cousin climbs.",
+        // Each image of a figure, with the caption once under them.
+        "![A black rat on a rope](images/black-rat.png)\n\n\
+         ![Figure 2. The black rat and its nest](images/nest.png)\n\n\
+         *Figure 2. The black rat and its nest*\n\n",
+        "Look for tracks: ![tracks.png](images/tracks.png)",
+        // A decorative image stays without alt text.
+        "![](images/flourish.png)",
+    ] {
+        assert!(
+            markdown.contains(expected),
+            "{:?} not in {}",
+            expected,
+            markdown
+        );
+    }
+    assert_eq!(markdown.matches("*Figure 2.").count(), 1, "{}", markdown);
+
+    let options = Options {
+        figure_captions: FigureCaption::Title,
+        ..Options::default()
+    };
+    let markdown = convert_file_with(book, &options)?;
+    assert!(
+        markdown.contains(
+            "![A black rat on a rope](images/black-rat.png \"Figure 2. The black rat and its nest\")\n\n\
+             ![Figure 2. The black rat and its nest](images/nest.png \"Figure 2. The black rat and its nest\")\n"
+        ),
+        "{}",
+        markdown
+    );
+    assert!(!markdown.contains("*Figure"), "{}", markdown);
+    assert_eq!("title".parse::<FigureCaption>(), Ok(FigureCaption::Title));
+    assert!("bold".parse::<FigureCaption>().is_err());
+    Ok(())
+}
+
+#[test]
+fn test_table_of_contents() -> Result<()> {
+    let markdown = convert_file("testdata/pg35542.epub")?;
+    assert!(markdown.contains("- [HOUSE RATS AND MICE](#pgepubid00001)\n"));
+    assert!(markdown.contains("\n  - [UNITED STATES DEPARTMENT OF AGRICULTURE](#pgepubid00004)\n"));
+    assert!(markdown.contains("\n    - [E. W. NELSON, Chief](#pgepubid00006)\n"));
+
+    let options = Options {
+        toc: false,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/pg35542.epub", &options)?;
+    assert!(!markdown.contains("](#pgepubid00001)"));
+    Ok(())
+}
+
+#[test]
+fn test_generated_table_of_contents() -> Result<()> {
+    let options = Options {
+        front_matter: false,
+        toc_depth: Some(2),
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/epub3-nav.epub", &options)?;
+    let expected = "- [Chapter One: The Harbour](#chapter-one-the-harbour)\n  - [Departure](#departure)\n  \
+                    - [The Open Sea](#the-open-sea)\n- [Chapter Two: Landfall](#chapter-two-landfall)\n\n";
+    assert!(
+        markdown.starts_with(expected),
+        "unexpected table of contents:\n{}",
+        markdown
+    );
+    assert!(!markdown.contains("](text/ch1.xhtml)"));
+
+    let options = Options {
+        toc_depth: Some(1),
+        ..options
+    };
+    let markdown = convert_file_with("testdata/epub3-nav.epub", &options)?;
+    let expected = "- [Chapter One: The Harbour](#chapter-one-the-harbour)\n- [Chapter Two: Landfall](#chapter-two-landfall)\n\n";
+    assert!(
+        markdown.starts_with(expected),
+        "unexpected table of contents:\n{}",
+        markdown
+    );
+
+    // Only the selected chapters are listed.
+    let options = Options {
+        chapters: Some("3,5".parse().unwrap()),
+        ..options
+    };
+    let markdown = convert_file_with("testdata/many-chapters.epub", &options)?;
+    assert!(
+        markdown.starts_with("- [Chapter 3](#chapter-3)\n- [Chapter 5](#chapter-5)\n\n"),
+        "{}",
+        markdown
+    );
+    Ok(())
+}
+
+#[test]
+fn test_epub3_nav_table_of_contents() -> Result<()> {
+    let options = Options {
+        front_matter: false,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/epub3-nav.epub", &options)?;
+    let expected = "- [Chapter One: The Harbour](text/ch1.xhtml)\n  - [Departure](#departure)\n  - [The Open Sea](#open-sea)\n- [Chapter Two: Landfall](text/ch2.xhtml)\n";
+    assert!(
+        markdown.starts_with(expected),
+        "unexpected table of contents:\n{}",
+        markdown
+    );
+    assert!(!markdown.contains("NCX Chapter One"));
+
+    let chapters = convert_chapters("testdata/epub3-nav.epub")?;
+    let titles: Vec<&str> = chapters
+        .iter()
+        .map(|chapter| chapter.title.as_str())
+        .collect();
+    assert_eq!(
+        titles,
+        ["Chapter One: The Harbour", "Chapter Two: Landfall"]
+    );
+    Ok(())
+}
+
+#[test]
+fn test_best_effort_conversion() -> Result<()> {
+    let err = convert_file("testdata/missing-chapter.epub").unwrap_err();
+    assert!(format!("{:#}", err).contains("ch2.xhtml"));
+
+    let options = Options {
+        strict: false,
+        ..Options::default()
+    };
+    let err = convert_file_with("testdata/missing-chapter.epub", &options).unwrap_err();
+    let errors = err
+        .downcast_ref::<ChapterErrors>()
+        .expect("a ChapterErrors");
+    assert_eq!(errors.failures.len(), 1);
+    assert_eq!(errors.failures[0].0, "ch2.xhtml");
+    assert!(err
+        .to_string()
+        .starts_with("1 chapter failed to convert:\n  ch2.xhtml: "));
+    assert!(errors.markdown.contains("The first chapter."));
+    assert!(errors.markdown.contains("> [conversion failed: ch2.xhtml"));
+    assert!(errors.markdown.contains("The third chapter."));
+
+    let err = convert_chapters_with("testdata/missing-chapter.epub", &options).unwrap_err();
+    let errors = err
+        .downcast_ref::<ChapterErrors>()
+        .expect("a ChapterErrors");
+    let hrefs: Vec<&str> = errors
+        .chapters
+        .iter()
+        .map(|chapter| chapter.href.as_str())
+        .collect();
+    assert_eq!(hrefs, ["ch1.xhtml", "ch2.xhtml", "ch3.xhtml"]);
+    assert_eq!(errors.failures[0].0, "ch2.xhtml");
+    Ok(())
+}
+
+#[test]
+fn test_broken_xhtml_chapter() -> Result<()> {
+    // Markup that isn't well-formed converts as best it can rather than
+    // failing, and doesn't get in the way of the chapters around it.
+    let chapters = convert_chapters("testdata/broken-xhtml.epub")?;
+    assert_eq!(chapters.len(), 3);
+    assert!(chapters[0].markdown.contains("The first chapter."));
+    assert!(chapters[1].markdown.contains("The second chapter."));
+    assert!(chapters[2].markdown.contains("The third chapter."));
+    Ok(())
+}
+
+#[test]
+fn test_build_toc() -> Result<()> {
+    let toc = build_toc("testdata/pg35542.epub")?;
+    assert!(toc.starts_with("- [HOUSE RATS AND MICE](#pgepubid00001)\n"));
+    assert!(toc.contains("\n    - [E. W. NELSON, Chief](#pgepubid00006)\n"));
+
+    let toc = build_toc("testdata/epub3-nav.epub")?;
+    assert!(toc.contains("  - [Departure](#departure)\n"));
+    Ok(())
+}
+
+#[test]
+fn test_toc_fallbacks() -> Result<()> {
+    let titles = |path: &str| -> Result<Vec<String>> {
+        Ok(convert_chapters(path)?
+            .into_iter()
+            .map(|chapter| chapter.title)
+            .collect())
+    };
+    // Without a nav document or NCX, the spine under each item's first
+    // heading, <title>, or file name.
+    assert_eq!(
+        titles("testdata/no-toc.epub")?,
+        ["The Sewer", "The Granary", "ch3"]
+    );
+    assert_eq!(
+        build_toc("testdata/no-toc.epub")?,
+        "- [The Sewer](ch1.xhtml)\n- [The Granary](ch2.xhtml)\n- [ch3](ch3.xhtml)\n"
+    );
+    let entries: Vec<String> = Book::open("testdata/no-toc.epub")?
+        .toc()
+        .into_iter()
+        .map(|entry| entry.title)
+        .collect();
+    assert_eq!(entries, ["The Sewer", "The Granary", "ch3"]);
+
+    // An NCX cut short keeps the entries before the cut.
+    assert_eq!(
+        titles("testdata/truncated-ncx.epub")?,
+        ["Prologue", "The Granary", "Stores"]
+    );
+
+    // Entries for files the book doesn't have are left out, and those nested
+    // under them take their place.
+    assert_eq!(
+        titles("testdata/dangling-ncx.epub")?,
+        ["Prologue", "The Granary", "The Larder"]
+    );
+    assert_eq!(
+        build_toc("testdata/dangling-ncx.epub")?,
+        "- [Prologue](ch1.xhtml)\n- [The Granary](ch2.xhtml)\n- [The Larder](ch3.xhtml)\n"
+    );
+    Ok(())
+}
+
+#[test]
+fn test_reading_order_follows_the_spine() -> Result<()> {
+    // The manifest lists the chapters backwards; the notes page is non-linear.
+    let order = reading_order("testdata/shuffled-manifest.epub")?;
+    assert_eq!(
+        order,
+        [
+            "text/ch1.xhtml",
+            "text/ch2.xhtml",
+            "text/ch3.xhtml",
+            "text/notes.xhtml"
+        ]
+    );
+
+    let chapters = convert_chapters("testdata/shuffled-manifest.epub")?;
+    let hrefs: Vec<&str> = chapters
+        .iter()
+        .map(|chapter| chapter.href.as_str())
+        .collect();
+    assert_eq!(hrefs, order);
+    let indexes: Vec<usize> = chapters.iter().map(|chapter| chapter.index).collect();
+    assert_eq!(indexes, [1, 3, 4, 2]);
+
+    let markdown = convert_file("testdata/shuffled-manifest.epub")?;
+    let positions: Vec<usize> = [
+        "The rats wake.",
+        "The rats forage.",
+        "The rats go home.",
+        "Rats keep late hours.",
+    ]
+    .iter()
+    .map(|text| {
+        markdown
+            .find(text)
+            .unwrap_or_else(|| panic!("{:?} is missing:\n{}", text, markdown))
+    })
+    .collect();
+    assert!(
+        positions.windows(2).all(|pair| pair[0] < pair[1]),
+        "{}",
+        markdown
+    );
+
+    let options = Options {
+        nonlinear: Nonlinear::Include,
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/shuffled-manifest.epub", &options)?;
+    let hrefs: Vec<&str> = chapters
+        .iter()
+        .map(|chapter| chapter.href.as_str())
+        .collect();
+    assert_eq!(
+        hrefs,
+        [
+            "text/ch1.xhtml",
+            "text/notes.xhtml",
+            "text/ch2.xhtml",
+            "text/ch3.xhtml"
+        ]
+    );
+    Ok(())
+}
+
+#[test]
+fn test_match_and_exclude_chapters() -> Result<()> {
+    let regex = |pattern: &str| {
+        Pattern::new(
+            pattern,
+            &SearchOptions {
+                regex: true,
+                ..SearchOptions::default()
+            },
+        )
+    };
+    let hrefs = |options: &Options| -> Result<Vec<String>> {
+        let chapters = convert_chapters_with("testdata/shuffled-manifest.epub", options)?;
+        Ok(chapters.into_iter().map(|chapter| chapter.href).collect())
+    };
+    // The notes page has no TOC entry, so its heading is its title.
+    let options = Options {
+        match_chapters: vec![regex("^D")?, regex("^Notes$")?],
+        ..Options::default()
+    };
+    assert_eq!(
+        hrefs(&options)?,
+        ["text/ch1.xhtml", "text/ch3.xhtml", "text/notes.xhtml"]
+    );
+
+    // Case matters unless the pattern says otherwise.
+    let options = Options {
+        match_chapters: vec![regex("dusk")?],
+        ..Options::default()
+    };
+    let err = convert_chapters_with("testdata/shuffled-manifest.epub", &options).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "No chapter matches the title and href filters; the book has \"Dusk\", \"Midnight\", \"Dawn\", \"Notes\""
+    );
+    let options = Options {
+        match_chapters: vec![regex("(?i)dusk")?],
+        ..Options::default()
+    };
+    assert_eq!(hrefs(&options)?, ["text/ch1.xhtml"]);
+
+    // Exclusion wins, and hrefs match too.
+    let options = Options {
+        match_chapters: vec![regex("(?i)^d")?, regex("notes\\.xhtml$")?],
+        exclude_chapters: vec![regex("Dawn")?],
+        ..Options::default()
+    };
+    assert_eq!(hrefs(&options)?, ["text/ch1.xhtml", "text/notes.xhtml"]);
+
+    // With --chapters, a chapter has to be selected and match.
+    let options = Options {
+        chapters: Some("1-3".parse().unwrap()),
+        match_chapters: vec![regex("(?i)^d")?],
+        ..Options::default()
+    };
+    assert_eq!(hrefs(&options)?, ["text/ch1.xhtml"]);
+
+    // The table of contents lists only what was converted.
+    let options = Options {
+        match_chapters: vec![regex("^D")?],
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/shuffled-manifest.epub", &options)?;
+    assert!(
+        markdown.contains("[Dusk]") && markdown.contains("[Dawn]"),
+        "{}",
+        markdown
+    );
+    assert!(
+        !markdown.contains("Midnight") && !markdown.contains("forage"),
+        "{}",
+        markdown
+    );
+    Ok(())
+}
+
+#[test]
+fn test_transforms() -> Result<()> {
+    // Each transform sees what the one before it returned.
+    let options = Options {
+        transforms: vec![
+            Transform::new("shout", |markdown| Ok(markdown.replace("rats", "RATS"))),
+            Transform::new("sign", |markdown| {
+                Ok(format!("{}\n(RATS only)\n", markdown.trim_end()))
+            }),
+        ],
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/shuffled-manifest.epub", &options)?;
+    assert!(
+        chapters[0]
+            .markdown
+            .ends_with("The RATS wake.\n(RATS only)\n"),
+        "{}",
+        chapters[0].markdown
+    );
+    let markdown = Converter::new()
+        .options(options)
+        .convert_file("testdata/shuffled-manifest.epub")?;
+    assert_eq!(markdown.matches("(RATS only)").count(), 4, "{}", markdown);
+
+    let picky = |markdown: &str| match markdown.contains("forage") {
+        true => Err(anyhow::anyhow!("no foraging")),
+        false => Ok(markdown.to_uppercase()),
+    };
+    let err = Converter::new()
+        .options(Options {
+            strict: true,
+            ..Options::default()
+        })
+        .transform("picky", picky)
+        .convert_file("testdata/shuffled-manifest.epub")
+        .unwrap_err();
+    assert_eq!(
+        format!("{:#}", err),
+        "Failed to transform text/ch2.xhtml with picky: no foraging"
+    );
+
+    // Otherwise the chapter keeps its markdown and the failure is reported.
+    let err = Converter::new()
+        .transform("picky", picky)
+        .convert_file("testdata/shuffled-manifest.epub")
+        .unwrap_err();
+    let errors = err.downcast_ref::<ChapterErrors>().unwrap();
+    assert_eq!(
+        errors.failures,
+        [(
+            "text/ch2.xhtml".to_string(),
+            "picky transform: no foraging".to_string()
+        )]
+    );
+    assert!(
+        errors.markdown.contains("THE RATS WAKE.") && errors.markdown.contains("The rats forage.")
+    );
+    Ok(())
+}
+
+#[test]
+fn test_cancel_conversion() {
+    let token = CancelToken::new();
+    token.cancel();
+    let options = Options {
+        cancel: Some(token),
+        ..Options::default()
+    };
+    let err = convert_file_with("testdata/pg35542.epub", &options).unwrap_err();
+    assert_eq!(err.downcast_ref::<Cancelled>(), Some(&Cancelled::Cancelled));
+
+    let options = Options {
+        cancel: Some(CancelToken::with_timeout(Duration::ZERO)),
+        ..Options::default()
+    };
+    let err = convert_file_with("testdata/pg35542.epub", &options).unwrap_err();
+    assert_eq!(err.downcast_ref::<Cancelled>(), Some(&Cancelled::TimedOut));
+}
+
+#[test]
+fn test_book_converts_single_chapters() -> Result<()> {
+    let mut book = Book::open("testdata/epub3-nav.epub")?;
+    assert_eq!(book.len(), 2);
+    let chapter = book.chapter(1)?;
+    assert_eq!(chapter.title, "Chapter Two: Landfall");
+    assert!(chapter.markdown.contains("At last, an island."));
+
+    let err = book.chapter(2).unwrap_err();
+    assert!(err.to_string().contains("the book has 2"));
+    Ok(())
+}
+
+#[test]
+fn test_book_toc() -> Result<()> {
+    let built = common::EpubBuilder::new("The Rat Atlas")
+        .chapter(
+            "Old World",
+            "<h1>Old World</h1>\n<h2 id=\"asia\">Asia</h2>\n<p>Where the brown rat began.</p>\n\
+             <h2>Europe</h2>\n<p id=\"europe\">Where it went next.</p>",
+        )
+        .section("Asia", "asia")
+        .section("Europe", "europe")
+        .chapter(
+            "New World",
+            "<h1>New World</h1>\n<p>Where it went by ship.</p>",
+        )
+        .build();
+    let mut book = Book::open(built.path())?;
+    let toc = book.toc();
+    let entries: Vec<(&str, usize, usize, Option<&str>)> = toc
+        .iter()
+        .map(|entry| {
+            (
+                entry.title.as_str(),
+                entry.depth,
+                entry.index,
+                entry.fragment.as_deref(),
+            )
+        })
+        .collect();
+    assert_eq!(
+        entries,
+        [
+            ("Old World", 0, 1, None),
+            ("Asia", 1, 1, Some("asia")),
+            ("Europe", 1, 1, Some("europe")),
+            ("New World", 0, 2, None),
+        ]
+    );
+    // The ids are known once the chapter is converted: a heading's own, and
+    // that of an element under one.
+    assert_eq!(book.heading_of(0, "asia"), None);
+    book.chapter(0)?;
+    assert_eq!(book.heading_of(0, "asia"), Some(1));
+    assert_eq!(book.heading_of(0, "europe"), Some(2));
+    assert_eq!(book.heading_of(0, "missing"), None);
+
+    // Without a table of contents, the spine under each item's own title.
+    let built = common::EpubBuilder::new("The Rat Atlas")
+        .chapter(
+            "Old World",
+            "<h1>Old World</h1>\n<p>Where the brown rat began.</p>",
+        )
+        .chapter("New World", "<p>Where it went by ship.</p>")
+        .without_toc()
+        .build();
+    let titles: Vec<(String, usize)> = Book::open(built.path())?
+        .toc()
+        .into_iter()
+        .map(|entry| (entry.title, entry.index))
+        .collect();
+    assert_eq!(
+        titles,
+        [("Old World".to_string(), 1), ("New World".to_string(), 2)]
+    );
+    Ok(())
+}
+
+#[test]
+fn test_book_streams_chapters() -> Result<()> {
+    let mut book = Book::from_reader(File::open("testdata/epub3-nav.epub")?)?;
+    let first = book.chapters().next().unwrap()?;
+    assert_eq!(first.index, 1);
+
+    let chapters = book.chapters().collect::<Result<Vec<_>>>()?;
+    let titles: Vec<&str> = chapters
+        .iter()
+        .map(|chapter| chapter.title.as_str())
+        .collect();
+    assert_eq!(titles, [first.title.as_str(), "Chapter Two: Landfall"]);
+    assert_eq!(chapters[1].markdown, book.chapter(1)?.markdown);
+    Ok(())
+}
+
+// A book in memory that counts the bytes read from it and notes when it's
+// dropped.
+struct TrackedReader {
+    bytes: Cursor<Vec<u8>>,
+    read: Arc<AtomicUsize>,
+    dropped: Arc<AtomicBool>,
+}
+
+impl Read for TrackedReader {
+    fn read(&mut self, buf: &mut [u8]) -> std::io::Result<usize> {
+        let n = self.bytes.read(buf)?;
+        self.read.fetch_add(n, Ordering::SeqCst);
+        Ok(n)
+    }
+}
+
+impl Seek for TrackedReader {
+    fn seek(&mut self, pos: SeekFrom) -> std::io::Result<u64> {
+        self.bytes.seek(pos)
+    }
+}
+
+impl Drop for TrackedReader {
+    fn drop(&mut self) {
+        self.dropped.store(true, Ordering::SeqCst);
+    }
+}
+
+#[test]
+fn test_lazy_chapters() -> Result<()> {
+    let (read, dropped) = (
+        Arc::new(AtomicUsize::new(0)),
+        Arc::new(AtomicBool::new(false)),
+    );
+    let reader = TrackedReader {
+        bytes: Cursor::new(fs::read("testdata/shuffled-manifest.epub")?),
+        read: read.clone(),
+        dropped: dropped.clone(),
+    };
+    let mut chapters = Converter::new().lazy_chapters(reader)?;
+    let opened = read.load(Ordering::SeqCst);
+    assert_eq!(chapters.len(), 4);
+
+    // Listing the chapters doesn't read, let alone convert, any of them.
+    let listed = chapters.by_ref().collect::<Result<Vec<_>>>()?;
+    let titles: Vec<(usize, &str)> = listed
+        .iter()
+        .map(|chapter| (chapter.index, chapter.title.as_str()))
+        .collect();
+    assert_eq!(titles[..3], [(1, "Dusk"), (3, "Midnight"), (4, "Dawn")]);
+    assert_eq!(listed[3].href, "text/notes.xhtml");
+    assert_eq!(read.load(Ordering::SeqCst), opened);
+
+    let midnight = listed[1].markdown()?;
+    assert!(midnight.contains("The rats forage."), "{}", midnight);
+    let converted = convert_chapters("testdata/shuffled-manifest.epub")?;
+    assert_eq!(
+        midnight,
+        converted
+            .iter()
+            .find(|chapter| chapter.index == 3)
+            .unwrap()
+            .markdown
+    );
+    assert!(String::from_utf8(listed[2].html()?)?.contains("<p>The rats go home.</p>"));
+    assert!(read.load(Ordering::SeqCst) > opened);
+
+    // Closing drops the reader, though the chapters handed out are still around.
+    assert!(!dropped.load(Ordering::SeqCst));
+    chapters.close();
+    assert!(dropped.load(Ordering::SeqCst));
+    let err = listed[0].markdown().unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "Failed to convert text/ch1.xhtml: the book was closed"
+    );
+
+    // The converter's options pick and order the chapters.
+    let converter = Converter::new().chapters("2-3".parse().unwrap());
+    let chapters = converter.lazy_chapters_file("testdata/shuffled-manifest.epub")?;
+    let indexes: Vec<usize> = chapters.map(|chapter| chapter.unwrap().index).collect();
+    assert_eq!(indexes, [2, 3]);
+    let options = Options {
+        nonlinear: Nonlinear::Drop,
+        ..Options::default()
+    };
+    assert_eq!(
+        Converter::new()
+            .options(options)
+            .lazy_chapters_file("testdata/shuffled-manifest.epub")?
+            .len(),
+        3
+    );
+    let converter = Converter::new().chapters("5".parse().unwrap());
+    assert!(converter
+        .lazy_chapters_file("testdata/shuffled-manifest.epub")
+        .is_err());
+    Ok(())
+}
+
+#[test]
+fn test_lazy_chapters_match_whole_book() -> Result<()> {
+    // `epub_to_markdown` converts one chapter at a time, where
+    // `convert_chapters` converts the whole book at once, yet links between
+    // the chapters and notes kept in another file come out the same.
+    for book in [
+        "testdata/cross-links.epub",
+        "testdata/endnotes.epub",
+        "testdata/shuffled-manifest.epub",
+    ] {
+        let converted: Vec<String> = convert_chapters(book)?
+            .into_iter()
+            .map(|chapter| chapter.markdown)
+            .collect();
+        assert_eq!(epub_to_markdown(book)?, converted, "{}", book);
+    }
+    let notes = &epub_to_markdown("testdata/endnotes.epub")?[2];
+    assert!(
+        !notes.contains("Rattus") && notes.contains("Mus musculus, mentioned nowhere."),
+        "{}",
+        notes
+    );
+    let book = "testdata/cross-links.epub";
+
+    // The same chapters, converted the same way, with links between them
+    // pointed at their headings.
+    let regex = |pattern: &str| {
+        Pattern::new(
+            pattern,
+            &SearchOptions {
+                regex: true,
+                ..SearchOptions::default()
+            },
+        )
+    };
+    let lazy = |book: &str, options: &Options| -> Result<Vec<(usize, String, String)>> {
+        let chapters = Converter::new()
+            .options(options.clone())
+            .lazy_chapters_file(book)?;
+        chapters
+            .map(|chapter| {
+                let chapter = chapter?;
+                Ok((chapter.index, chapter.href.clone(), chapter.markdown()?))
+            })
+            .collect()
+    };
+    let eager = |book: &str, options: &Options| -> Result<Vec<(usize, String, String)>> {
+        let chapters = convert_chapters_with(book, options)?;
+        Ok(chapters
+            .into_iter()
+            .map(|chapter| (chapter.index, chapter.href, chapter.markdown))
+            .collect())
+    };
+    let options = Options {
+        skip_titles: vec![regex("Three")?],
+        skip_hrefs: vec![regex("chapter4")?],
+        exclude_chapters: vec![regex("Two")?],
+        ..Options::default()
+    };
+    let chapters = lazy(book, &options)?;
+    assert_eq!(chapters, eager(book, &options)?);
+    assert_eq!(
+        chapters
+            .iter()
+            .map(|(index, _, _)| *index)
+            .collect::<Vec<_>>(),
+        [1, 5]
+    );
+    assert!(
+        chapters[0].2.contains("(chapter5.xhtml#where-rats-live)"),
+        "{}",
+        chapters[0].2
+    );
+
+    let options = Options {
+        skip_front_matter: true,
+        skip_back_matter: true,
+        ..Options::default()
+    };
+    assert_eq!(
+        lazy("testdata/matter.epub", &options)?,
+        eager("testdata/matter.epub", &options)?
+    );
+
+    let book = "testdata/shuffled-manifest.epub";
+    let options = Options {
+        match_chapters: vec![regex("dusk")?],
+        ..Options::default()
+    };
+    let err = Converter::new()
+        .options(options.clone())
+        .lazy_chapters_file(book)
+        .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        convert_chapters_with(book, &options)
+            .unwrap_err()
+            .to_string()
+    );
+
+    let options = Options {
+        max_chapter_size: Some(1024 * 1024),
+        ..Options::default()
+    };
+    let mut chapters = Converter::new()
+        .options(options)
+        .lazy_chapters_file("testdata/large-chapter.epub")?;
+    let large = chapters
+        .find(|chapter| {
+            chapter
+                .as_ref()
+                .is_ok_and(|chapter| chapter.href == "large.xhtml")
+        })
+        .unwrap()?;
+    let err = large.markdown().unwrap_err();
+    assert!(
+        format!("{:#}", err).contains("Failed to convert large.xhtml: the chapter is 3065 KiB"),
+        "{:#}",
+        err
+    );
+    Ok(())
+}
+
+#[test]
+fn test_chapter_selection() -> Result<()> {
+    let selection: ChapterSelection = "1,3-4".parse().unwrap();
+    assert!(selection.contains(1) && !selection.contains(2) && selection.contains(4));
+    assert!("0".parse::<ChapterSelection>().is_err());
+    assert!("5-3".parse::<ChapterSelection>().is_err());
+    assert!("1,,2".parse::<ChapterSelection>().is_err());
+
+    let options = Options {
+        chapters: Some("2".parse().unwrap()),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/epub3-nav.epub", &options)?;
+    assert_eq!(chapters.len(), 1);
+    assert_eq!(chapters[0].title, "Chapter Two: Landfall");
+
+    let options = Options {
+        chapters: Some("1-9".parse().unwrap()),
+        ..Options::default()
+    };
+    let err = convert_chapters_with("testdata/epub3-nav.epub", &options).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "Chapter 9 is out of range: the book has 2 chapters, valid chapters are 1-2"
+    );
+    Ok(())
+}
+
+#[test]
+fn test_parallel_conversion_keeps_spine_order() -> Result<()> {
+    let sequential = Options {
+        jobs: 1,
+        ..Options::default()
+    };
+    let parallel = Options {
+        jobs: 8,
+        ..Options::default()
+    };
+    let expected = convert_chapters_with("testdata/many-chapters.epub", &sequential)?;
+    assert_eq!(expected.len(), 100);
+    assert_eq!(
+        convert_chapters_with("testdata/many-chapters.epub", &parallel)?,
+        expected
+    );
+    assert_eq!(expected[41].title, "Chapter 42");
+    Ok(())
+}
+
+#[test]
+fn test_cancel_parallel_conversion() {
+    let options = Options {
+        cancel: Some(CancelToken::with_timeout(Duration::from_millis(1))),
+        jobs: 4,
+        ..Options::default()
+    };
+    let err = convert_chapters_with("testdata/many-chapters.epub", &options).unwrap_err();
+    assert_eq!(err.downcast_ref::<Cancelled>(), Some(&Cancelled::TimedOut));
+}
+
+#[test]
+fn test_cancel_mid_book() {
+    for jobs in [1, 4] {
+        // Cancelled from the progress callback once a few chapters are done,
+        // as a server would when its request goes away.
+        let cancel = CancelToken::new();
+        let cancelled_at = Arc::new(Mutex::new(None));
+        let (token, at) = (cancel.clone(), cancelled_at.clone());
+        let progress = Progress::new(move |current, _, _| {
+            if current == 3 {
+                token.cancel();
+                *at.lock().unwrap() = Some(Instant::now());
+            }
+        });
+        let converter = Converter::new()
+            .options(Options {
+                progress: Some(progress),
+                ..Options::default()
+            })
+            .cancel(cancel)
+            .jobs(jobs);
+        let err = converter
+            .convert_file("testdata/many-chapters.epub")
+            .unwrap_err();
+        assert_eq!(err.downcast_ref::<Cancelled>(), Some(&Cancelled::Cancelled));
+        let waited = cancelled_at.lock().unwrap().unwrap().elapsed();
+        assert!(
+            waited < Duration::from_secs(2),
+            "took {:?} to stop with {} jobs",
+            waited,
+            jobs
+        );
+        assert!(err.to_string().contains("of 100 spine items"), "{}", err);
+    }
+}
+
+#[test]
+fn test_convert_seekable() -> Result<()> {
+    let bytes = fs::read("testdata/pg35542.epub")?;
+    let markdown = convert_seekable(Cursor::new(bytes.as_slice()), &Options::default())?;
+    assert_eq!(markdown, convert_file("testdata/pg35542.epub")?);
+    Ok(())
+}
+
+#[test]
+fn test_convert_embedded() -> Result<()> {
+    // A book compiled into the program converts without touching the disk.
+    static BOOK: &[u8] = include_bytes!("../testdata/pg35542.epub");
+    let markdown = convert_seekable(Cursor::new(BOOK), &Options::default())?;
+    assert_eq!(markdown, convert_file("testdata/pg35542.epub")?);
+    let chapters = convert_chapters_from(BOOK, &Options::default())?;
+    assert_eq!(chapters, convert_chapters("testdata/pg35542.epub")?);
+    Ok(())
+}
+
+#[test]
+fn test_gfm_tables() -> Result<()> {
+    let markdown = convert_file("testdata/table.epub")?;
+    let rows: Vec<&str> = markdown
+        .lines()
+        .filter(|line| line.trim_start().starts_with('|'))
+        .collect();
+    assert_eq!(
+        rows.len(),
+        5,
+        "expected a header, separator and three rows:\n{}",
+        markdown
+    );
+    assert!(rows[0].contains("Species") && rows[0].contains("Weight (g)"));
+    assert!(rows[1].contains("---") && rows[1].chars().all(|c| "|-: ".contains(c)));
+    assert!(rows[2].contains("Rattus norvegicus") && rows[2].trim_end().ends_with('|'));
+    // Spanning cells have no pipe table form, so that table stays HTML.
+    assert!(markdown.contains("<th colspan=\"2\">Litter size</th>"));
+    assert!(markdown.contains("<th rowspan=\"2\">Species</th>"));
+
+    let options = Options {
+        gfm: false,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/table.epub", &options)?;
+    assert!(markdown.contains("<table>"));
+    assert!(markdown.contains("<td>Rattus norvegicus</td>"));
+    assert!(!markdown
+        .lines()
+        .any(|line| line.trim_start().starts_with('|')));
+    Ok(())
+}
+
+#[test]
+fn test_progress() -> Result<()> {
+    let seen = Arc::new(Mutex::new(Vec::new()));
+    let recorder = seen.clone();
+    let options = Options {
+        progress: Some(Progress::new(move |current, total, chapter| {
+            recorder
+                .lock()
+                .unwrap()
+                .push((current, total, chapter.to_string()));
+        })),
+        ..Options::default()
+    };
+    convert_chapters_with("testdata/epub3-nav.epub", &options)?;
+
+    let mut seen = seen.lock().unwrap().clone();
+    seen.sort();
+    assert_eq!(seen.len(), 2);
+    assert_eq!((seen[0].0, seen[0].1), (1, 2));
+    assert_eq!((seen[1].0, seen[1].1), (2, 2));
+    let mut chapters: Vec<&str> = seen
+        .iter()
+        .map(|(_, _, chapter)| chapter.as_str())
+        .collect();
+    chapters.sort();
+    assert_eq!(chapters, ["text/ch1.xhtml", "text/ch2.xhtml"]);
+    Ok(())
+}
+
+#[test]
+fn test_progress_counts_whole_spine() -> Result<()> {
+    let seen = Arc::new(Mutex::new(Vec::new()));
+    let recorder = seen.clone();
+    let options = Options {
+        chapters: Some("3,5-6".parse().unwrap()),
+        jobs: 4,
+        progress: Some(Progress::new(move |current, total, _| {
+            recorder.lock().unwrap().push((current, total))
+        })),
+        ..Options::default()
+    };
+    convert_chapters_with("testdata/many-chapters.epub", &options)?;
+
+    // Chapters that aren't selected are reported too, so the count reaches the spine length.
+    let seen = seen.lock().unwrap().clone();
+    let mut done: Vec<usize> = seen.iter().map(|(current, _)| *current).collect();
+    done.sort();
+    assert_eq!(done, (1..=100).collect::<Vec<_>>());
+    assert!(seen.iter().all(|(_, total)| *total == 100));
+    Ok(())
+}
+
+#[test]
+fn test_renditions() -> Result<()> {
+    let rootfiles = renditions("testdata/renditions.epub")?;
+    let paths: Vec<&str> = rootfiles
+        .iter()
+        .map(|rootfile| rootfile.full_path.as_str())
+        .collect();
+    assert_eq!(paths, ["text/package.opf", "large/package.opf"]);
+
+    let markdown = convert_file("testdata/renditions.epub")?;
+    assert!(markdown.contains("This is the text rendition."));
+    assert!(!markdown.contains("large print"));
+
+    for rendition in [
+        Rendition::Index(2),
+        Rendition::Path("large/package.opf".to_string()),
+    ] {
+        let options = Options {
+            rendition: Some(rendition),
+            ..Options::default()
+        };
+        let markdown = convert_file_with("testdata/renditions.epub", &options)?;
+        assert!(markdown.contains("title: \"Two Renditions (large)\""));
+        assert!(markdown.contains("- [Opening (large)](#start)"));
+        assert!(markdown.contains("This is the large print rendition."));
+        assert!(!markdown.contains("This is the text rendition."));
+    }
+
+    let options = Options {
+        rendition: Some(Rendition::Index(3)),
+        ..Options::default()
+    };
+    let err = convert_file_with("testdata/renditions.epub", &options).unwrap_err();
+    assert!(err.to_string().contains("2: large/package.opf"));
+    Ok(())
+}
+
+#[test]
+fn test_rendition_labels() -> Result<()> {
+    let rootfiles = renditions("testdata/renditions-labelled.epub")?;
+    assert_eq!(rootfiles[0].label.as_deref(), Some("Fixed layout"));
+    assert_eq!(rootfiles[0].layout.as_deref(), Some("pre-paginated"));
+    assert_eq!(rootfiles[1].media.as_deref(), Some("(min-width: 40em)"));
+
+    for name in ["reflowable", "Reflowable", "(min-width: 40em)"] {
+        let options = Options {
+            rendition: Some(name.parse().unwrap()),
+            ..Options::default()
+        };
+        let markdown = convert_file_with("testdata/renditions-labelled.epub", &options)?;
+        assert!(
+            markdown.contains("This is the reflowable rendition."),
+            "{}",
+            name
+        );
+    }
+    let options = Options {
+        rendition: Some("fixed layout".parse().unwrap()),
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/renditions-labelled.epub", &options)?;
+    assert!(markdown.contains("This is the fixed layout rendition."));
+
+    let options = Options {
+        rendition: Some("large print".parse().unwrap()),
+        ..Options::default()
+    };
+    let err = convert_file_with("testdata/renditions-labelled.epub", &options).unwrap_err();
+    assert!(err
+        .to_string()
+        .contains("2: reflow/package.opf (Reflowable, reflowable, (min-width: 40em))"));
+    Ok(())
+}
+
+#[test]
+fn test_footnotes() -> Result<()> {
+    let chapters = convert_chapters("testdata/footnotes.epub")?;
+    let markdown = &chapters[0].markdown;
+    assert!(markdown.contains("The brown rat[^1] arrived in Europe later than the black rat[^2]."));
+    assert!(markdown.contains("The brown rat[^1] is now"));
+    assert!(
+        markdown.ends_with("[^1]: Rattus norvegicus.\n\n[^2]: Rattus rattus.\n"),
+        "{}",
+        markdown
+    );
+    // A noteref whose note isn't in the chapter is left as a link.
+    assert!(markdown.contains("](#missing)"));
+    assert!(!markdown.contains("(#note1)") && !markdown.contains("(#ref1)"));
+    Ok(())
+}
+
+#[test]
+fn test_footnotes_in_other_files() -> Result<()> {
+    let chapters = convert_chapters("testdata/endnotes.epub")?;
+    let first = &chapters[0].markdown;
+    assert!(
+        first.contains("The black rat[^1] came west with trade[^2]."),
+        "{}",
+        first
+    );
+    assert!(first.contains("It carried the plague[^1]."));
+    assert!(
+        first.ends_with("[^1]: Rattus rattus.\n\n[^2]: Mostly by ship.\n"),
+        "{}",
+        first
+    );
+    assert!(!first.contains("footnote") && !first.contains("↩"));
+
+    let second = &chapters[1].markdown;
+    assert!(second.ends_with("[^1]: Rattus norvegicus.\n"), "{}", second);
+
+    // Notes moved into the chapters that cite them are dropped from the notes file.
+    let notes = &chapters[2].markdown;
+    assert!(!notes.contains("Rattus"));
+    assert!(notes.contains("Mus musculus, mentioned nowhere."));
+    Ok(())
+}
+
+#[test]
+fn test_intra_book_links() -> Result<()> {
+    let chapters = convert_chapters("testdata/links.epub")?;
+    assert!(chapters[0]
+        .markdown
+        .contains("[the second section](text/chapter02.xhtml#the-second-section)"));
+
+    let markdown = convert_file("testdata/links.epub")?;
+    assert!(markdown.contains("[the second section](#the-second-section)"));
+    assert!(markdown.contains("[in chapter two](#chapter-two)"));
+    assert!(markdown.contains("[the notes below](#notes)"));
+    assert!(markdown.contains("[habits of rats](#the-second-section)"));
+    assert!(markdown.contains("[the start](#chapter-one)"));
+    // Both chapters have a "Notes" heading; the second one's anchor is deduplicated.
+    assert!(markdown.contains("[these notes](#notes-1)"));
+    assert!(markdown.contains("[Project Gutenberg](https://www.gutenberg.org/)"));
+    Ok(())
+}
+
+#[test]
+fn test_heading_ids() -> Result<()> {
+    let options = Options {
+        heading_ids: true,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/links.epub", &options)?;
+    assert!(markdown.contains("# Chapter One {#chapter-one}\n"));
+    assert!(markdown.contains("## Notes {#notes}\n"));
+    assert!(markdown.contains("## Notes {#notes-1}\n"));
+    assert!(markdown.contains("[these notes](#notes-1)"));
+
+    // On their own, each chapter's ids only need to be unique within it.
+    let chapters = convert_chapters_with("testdata/links.epub", &options)?;
+    assert!(chapters[1].markdown.contains("## Notes {#notes}\n"));
+    assert!(chapters[0]
+        .markdown
+        .contains("[the second section](text/chapter02.xhtml#the-second-section)"));
+    assert!(!convert_file("testdata/links.epub")?.contains("{#"));
+    Ok(())
+}
+
+#[test]
+fn test_number_headings() -> Result<()> {
+    let options = Options {
+        number_headings: true,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/outline.epub", &options)?;
+    let headings: Vec<&str> = markdown
+        .lines()
+        .filter(|line| line.starts_with('#'))
+        .collect();
+    assert_eq!(
+        headings,
+        [
+            "# 1. Installing",
+            "### 1.1. Cage sizes",
+            "## 1.2. Bedding",
+            "### 1.2.1. Paper",
+            "### 1.2.2. Straw",
+            "# 2. Feeding",
+            "## 2.1. Pellets",
+        ]
+    );
+    assert!(
+        markdown.contains("[a big enough cage](#11-cage-sizes)"),
+        "{}",
+        markdown
+    );
+    assert!(markdown.contains("\n# not a heading\n"), "{}", markdown);
+
+    // Chapters on their own count on from the one before.
+    let options = Options {
+        heading_ids: true,
+        ..options
+    };
+    let chapters = convert_chapters_with("testdata/outline.epub", &options)?;
+    assert!(chapters[0]
+        .markdown
+        .contains("### 1.1. Cage sizes {#11-cage-sizes}\n"));
+    assert!(chapters[1].markdown.contains("# 2. Feeding {#2-feeding}\n"));
+    assert!(chapters[1]
+        .markdown
+        .contains("[a big enough cage](ch1.xhtml#11-cage-sizes)"));
+    assert!(!convert_file("testdata/outline.epub")?.contains("# 1."));
+    Ok(())
+}
+
+#[test]
+fn test_anchors() -> Result<()> {
+    let options = Options {
+        anchors: true,
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/links.epub", &options)?;
+    assert!(chapters[0]
+        .markdown
+        .contains("[habits of rats](text/chapter02.xhtml#habits)"));
+    assert!(chapters[1]
+        .markdown
+        .contains("<a id=\"habits\"></a>Rats are nocturnal."));
+    // Ids on or around headings still link to the heading, and ids nothing
+    // links to aren't kept.
+    assert!(chapters[0]
+        .markdown
+        .contains("[the second section](text/chapter02.xhtml#the-second-section)"));
+    for id in ["section2", "start", "notes1", "notes2"] {
+        assert!(
+            !chapters
+                .iter()
+                .any(|chapter| chapter.markdown.contains(&format!("<a id=\"{}\">", id))),
+            "{}",
+            id
+        );
+    }
+
+    let markdown = convert_file_with("testdata/links.epub", &options)?;
+    assert!(markdown.contains("[habits of rats](#habits)"));
+    assert!(markdown.contains("[the start](#chapter-one)"));
+
+    let markdown = convert_file("testdata/links.epub")?;
+    assert!(!markdown.contains("<a id="));
+    Ok(())
+}
+
+#[test]
+fn test_extract_cover() -> Result<()> {
+    let dir = tempfile::tempdir()?;
+    // EPUB3 cover-image property, then the EPUB2 <meta name="cover">.
+    for book in [
+        "testdata/pg35542-images-3.epub",
+        "testdata/pg35542-images.epub",
+    ] {
+        let dst = dir.path().join("cover.png");
+        extract_cover(book, &dst)?;
+        assert!(
+            fs::read(&dst)?.starts_with(b"\x89PNG"),
+            "{} cover isn't a PNG",
+            book
+        );
+    }
+
+    // No cover declared, but the guide's cover page frames an image in an <svg>.
+    let dst = dir.path().join("svg-cover-page.png");
+    extract_cover("testdata/svg-cover-page.epub", &dst)?;
+    assert!(fs::read(&dst)?.starts_with(b"\x89PNG"));
+    // A cover page with no picture on it isn't a cover image.
+    let err = extract_cover("testdata/matter.epub", &dir.path().join("none.png")).unwrap_err();
+    assert!(err.downcast_ref::<NoCover>().is_some());
+
+    let err =
+        extract_cover("testdata/rich-metadata.epub", &dir.path().join("none.png")).unwrap_err();
+    assert!(err.downcast_ref::<NoCover>().is_some());
+    assert!(!dir.path().join("none.png").exists());
+    Ok(())
+}
+
+#[test]
+fn test_convert_all() -> Result<()> {
+    // The same as reading each part on its own.
+    let book = "testdata/pg35542-images-3.epub";
+    let contents = convert_all(book)?;
+    assert_eq!(contents.metadata, read_metadata(book)?);
+    assert_eq!(contents.toc, Book::open(book)?.toc());
+    assert_eq!(contents.chapters, convert_chapters(book)?);
+    let cover = contents.cover.expect("a cover");
+    assert_eq!(cover.media_type, "image/png");
+    assert!(cover.bytes.starts_with(b"\x89PNG"));
+
+    let options = Options {
+        chapters: Some("2".parse().unwrap()),
+        ..Options::default()
+    };
+    let contents = convert_all_from(File::open("testdata/rich-metadata.epub")?, &options)?;
+    assert_eq!(
+        contents.metadata,
+        read_metadata("testdata/rich-metadata.epub")?
+    );
+    assert_eq!(
+        contents
+            .chapters
+            .iter()
+            .map(|chapter| chapter.index)
+            .collect::<Vec<_>>(),
+        [2]
+    );
+    assert!(contents.cover.is_none());
+    Ok(())
+}
+
+#[test]
+fn test_cover_option() -> Result<()> {
+    let dir = tempfile::tempdir()?;
+    let options = Options {
+        cover: Some(CoverOptions {
+            path: dir.path().join("cover"),
+            link: "cover".to_string(),
+        }),
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/pg35542-images.epub", &options)?;
+    assert!(fs::read(dir.path().join("cover.png"))?.starts_with(b"\x89PNG"));
+    let (_, body) = markdown
+        .strip_prefix("---\n")
+        .unwrap()
+        .split_once("\n---\n")
+        .unwrap();
+    assert!(body.starts_with("\n![cover](cover.png)\n\n"), "{}", body);
+
+    // No cover: converted as usual, and nothing written.
+    let markdown = convert_file_with("testdata/rich-metadata.epub", &options)?;
+    assert!(!markdown.contains("![cover]"));
+    assert_eq!(fs::read_dir(dir.path())?.count(), 1);
+    Ok(())
+}
+
+#[test]
+fn test_image_spine_items() -> Result<()> {
+    let chapters = convert_chapters("testdata/svg-cover.epub")?;
+    assert_eq!(chapters.len(), 2);
+    assert_eq!(chapters[0].title, "Cover");
+    assert_eq!(chapters[0].markdown.trim(), "![](cover.svg)");
+    assert!(chapters[1]
+        .markdown
+        .contains("Rats cost farmers dearly every year."));
+
+    let dir = tempfile::tempdir()?;
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: dir.path().join("images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/svg-cover.epub", &options)?;
+    assert_eq!(chapters[0].markdown.trim(), "![](images/cover.svg)");
+    assert!(dir.path().join("images/cover.svg").exists());
+    Ok(())
+}
+
+#[test]
+fn test_inline_svg() -> Result<()> {
+    let book = "testdata/svg-figures.epub";
+    let markdown = convert_file(book)?;
+    assert!(
+        markdown.contains("![Maze plan](../images/diagram.svg)"),
+        "{}",
+        markdown
+    );
+    // Drawings are described by their title or aria-label, and a frame around
+    // an image becomes the image.
+    assert!(
+        markdown.contains("\n[figure: A rat maze]\n"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("A whisker: [figure: Whisker]"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("![Rat portrait](../images/portrait.png)"),
+        "{}",
+        markdown
+    );
+    assert!(markdown.contains("\n[figure]\n"), "{}", markdown);
+    assert!(!markdown.contains("exit"));
+
+    let dir = tempfile::tempdir()?;
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: dir.path().join("images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..Options::default()
+    };
+    let markdown = convert_file_with(book, &options)?;
+    assert!(
+        markdown.contains("![Maze plan](images/diagram.svg)"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("![A rat maze](images/ch1-svg1.svg)"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("A whisker: ![Whisker](images/ch1-svg2.svg)"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("![Rat portrait](images/portrait.png)"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("![](images/ch1-svg3.svg)"),
+        "{}",
+        markdown
+    );
+    let svg = fs::read_to_string(dir.path().join("images/ch1-svg2.svg"))?;
+    assert!(
+        svg.starts_with(
+            "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<svg xmlns=\"http://www.w3.org/2000/svg\""
+        ),
+        "{}",
+        svg
+    );
+    assert!(svg.contains("<line x1=\"0\""));
+
+    let options = Options {
+        embed_images: Some(10_000),
+        ..Options::default()
+    };
+    let markdown = convert_file_with(book, &options)?;
+    assert!(
+        markdown.contains("![A rat maze](data:image/svg+xml;base64,"),
+        "{}",
+        markdown
+    );
+    assert!(!markdown.contains("[figure"));
+
+    let options = Options {
+        inline_svg: true,
+        ..Options::default()
+    };
+    let markdown = convert_file_with(book, &options)?;
+    let maze = "\n<svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"0 0 10 10\">\n  <title>A rat\n    maze</title>\n";
+    assert!(markdown.contains(maze), "{}", markdown);
+    assert!(
+        markdown.contains("<text x=\"1\" y=\"9\">exit</text>\n</svg>\n"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown
+            .contains("A whisker: <svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"0 0 4 1\""),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("![Rat portrait](../images/portrait.png)"),
+        "{}",
+        markdown
+    );
+    assert!(!markdown.contains("[figure"));
+
+    // An SVG page is kept as its markup too.
+    let chapters = convert_chapters_with("testdata/svg-cover.epub", &options)?;
+    assert!(chapters[0]
+        .markdown
+        .trim()
+        .starts_with("<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"600\""));
+    assert!(chapters[0].markdown.contains(">The Rat Problem</text>"));
+    Ok(())
+}
+
+#[test]
+fn test_convert_dir() -> Result<()> {
+    let src = tempfile::tempdir()?;
+    fs::create_dir(src.path().join("more"))?;
+    fs::copy("testdata/pg35542.epub", src.path().join("pg35542.epub"))?;
+    fs::copy("testdata/table.epub", src.path().join("more/table.epub"))?;
+    fs::write(src.path().join("broken.epub"), b"not a zip")?;
+    fs::write(src.path().join("notes.txt"), b"not an epub")?;
+
+    let dst = tempfile::tempdir()?;
+    let out = dst.path().join("markdown");
+    let options = Options {
+        jobs: 2,
+        ..Options::default()
+    };
+    let err = convert_dir_with(src.path(), &out, &options).unwrap_err();
+    let batch = err.downcast_ref::<BatchError>().expect("a BatchError");
+    assert_eq!(batch.total, 3);
+    assert_eq!(batch.failures.len(), 1);
+    assert_eq!(batch.failures[0].0, src.path().join("broken.epub"));
+    assert!(err
+        .to_string()
+        .starts_with("1 of 3 books failed to convert:"));
+
+    assert_eq!(
+        fs::read_to_string(out.join("pg35542.md"))?,
+        convert_file("testdata/pg35542.epub")?
+    );
+    assert_eq!(
+        fs::read_to_string(out.join("table.md"))?,
+        convert_file("testdata/table.epub")?
+    );
+    assert!(!out.join("broken.md").exists());
+    assert!(!out.join("notes.md").exists());
+    Ok(())
+}
+
+#[test]
+fn test_convert_dir_drm_protected() -> Result<()> {
+    let src = tempfile::tempdir()?;
+    fs::copy("testdata/table.epub", src.path().join("table.epub"))?;
+    fs::copy("testdata/drm.epub", src.path().join("drm.epub"))?;
+    fs::write(src.path().join("broken.epub"), b"not a zip")?;
+
+    let dst = tempfile::tempdir()?;
+    let err = convert_dir_with(src.path(), dst.path(), &Options::default()).unwrap_err();
+    let batch = err.downcast_ref::<BatchError>().expect("a BatchError");
+    assert_eq!(batch.failures.len(), 2);
+    assert_eq!(batch.drm_protected, [src.path().join("drm.epub")]);
+    assert!(dst.path().join("table.md").exists());
+    Ok(())
+}
+
+#[test]
+fn test_plan_books() -> Result<()> {
+    let dst = tempfile::tempdir()?;
+    fs::write(dst.path().join("table.md"), "already here")?;
+    let books = [
+        PathBuf::from("testdata/pg35542.epub"),
+        PathBuf::from("testdata/table.epub"),
+        PathBuf::from("nope.epub"),
+    ];
+    let plans = plan_books(&books, Some(dst.path()), false, &Options::default());
+    let markdown = convert_file("testdata/pg35542.epub")?;
+    assert_eq!(
+        plans[0].output,
+        Ok((dst.path().join("pg35542.md"), markdown.len()))
+    );
+    assert_eq!(
+        plans[1].output,
+        Err(format!(
+            "Output file {} already exists",
+            dst.path().join("table.md").display()
+        ))
+    );
+    assert_eq!(plans[2].book, books[2]);
+    assert!(plans[2].output.is_err());
+    // Nothing is written, or overwritten.
+    assert_eq!(fs::read_dir(dst.path())?.count(), 1);
+    assert_eq!(
+        fs::read_to_string(dst.path().join("table.md"))?,
+        "already here"
+    );
+
+    let plans = plan_books(&books[1..2], Some(dst.path()), true, &Options::default());
+    assert!(plans[0].output.is_ok());
+    Ok(())
+}
+
+#[test]
+fn test_convert_books_progress_and_cancel() -> Result<()> {
+    let books = [
+        PathBuf::from("testdata/pg35542.epub"),
+        PathBuf::from("testdata/table.epub"),
+    ];
+    let dst = tempfile::tempdir()?;
+    let calls = Arc::new(Mutex::new(Vec::new()));
+    let seen = calls.clone();
+    let options = Options {
+        jobs: 2,
+        progress: Some(Progress::new(move |done, total, name| {
+            seen.lock().unwrap().push((done, total, name.to_string()))
+        })),
+        ..Options::default()
+    };
+    convert_books(&books, Some(dst.path()), false, &options)?;
+    let mut calls = calls.lock().unwrap().clone();
+    // The books finish in any order, but each one is counted once.
+    assert_eq!(
+        calls
+            .iter()
+            .map(|(done, total, _)| (*done, *total))
+            .collect::<Vec<_>>(),
+        [(1, 2), (2, 2)]
+    );
+    calls.sort_by(|a, b| a.2.cmp(&b.2));
+    assert_eq!(calls[0].2, "testdata/pg35542.epub");
+    assert_eq!(calls[1].2, "testdata/table.epub");
+
+    let dst = tempfile::tempdir()?;
+    let cancel = CancelToken::new();
+    cancel.cancel();
+    let options = Options {
+        jobs: 2,
+        cancel: Some(cancel),
+        ..Options::default()
+    };
+    let err = convert_books(&books, Some(dst.path()), false, &options).unwrap_err();
+    let batch = err.downcast_ref::<BatchError>().expect("a BatchError");
+    assert_eq!(
+        batch
+            .failures
+            .iter()
+            .map(|(book, _)| book.clone())
+            .collect::<Vec<_>>(),
+        books
+    );
+    assert_eq!(
+        batch.failures[0].1,
+        "not converted: the batch was cancelled"
+    );
+    assert_eq!(fs::read_dir(dst.path())?.count(), 0);
+    Ok(())
+}
+
+#[test]
+fn test_markdown_options() -> Result<()> {
+    let plain = Options {
+        front_matter: false,
+        toc: false,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/styles.epub", &plain)?;
+    for expected in [
+        "# Rat Husbandry",
+        "## Feeding",
+        "*very*",
+        "**must not**",
+        "* Fresh vegetables",
+        "5\\*2",
+        "cage\\_one",
+    ] {
+        assert!(
+            markdown.contains(expected),
+            "{:?} not in {}",
+            expected,
+            markdown
+        );
+    }
+
+    let options = Options {
+        markdown: MarkdownOptions {
+            headings: HeadingStyle::Setext,
+            bullet: Bullet::Dash,
+            emphasis: Emphasis::Underscore,
+            escape: false,
+            ..MarkdownOptions::default()
+        },
+        ..plain.clone()
+    };
+    let markdown = convert_file_with("testdata/styles.epub", &options)?;
+    for expected in [
+        "Rat Husbandry\n=============",
+        "Feeding\n-------",
+        "_very_",
+        "__must not__",
+        "- Fresh vegetables",
+        "5*2",
+        "cage_one",
+    ] {
+        assert!(
+            markdown.contains(expected),
+            "{:?} not in {}",
+            expected,
+            markdown
+        );
+    }
+    assert!(!markdown.contains("# "));
+
+    let options = Options {
+        markdown: MarkdownOptions {
+            emphasis: Emphasis::None,
+            strikethrough: false,
+            ..MarkdownOptions::default()
+        },
+        ..plain
+    };
+    let markdown = convert_file_with("testdata/styles.epub", &options)?;
+    assert!(markdown.contains("Rats are very social and must not be kept alone."));
+    assert!(markdown.contains("The wire glass tank is best."));
+    Ok(())
+}
+
+#[test]
+fn test_list_markers_and_spacing() -> Result<()> {
+    // The lines from the first item to the last.
+    let list = |markdown: &str| -> Vec<String> {
+        let lines: Vec<String> = markdown.lines().map(String::from).collect();
+        let first = lines
+            .iter()
+            .position(|line| line.ends_with(" Cage"))
+            .expect("the list");
+        let last = lines
+            .iter()
+            .position(|line| line.ends_with(" Water"))
+            .expect("the list");
+        lines[first..=last].to_vec()
+    };
+    let styled = |spacing: ListSpacing| Options {
+        front_matter: false,
+        toc: false,
+        markdown: MarkdownOptions {
+            bullet: Bullet::Dash,
+            ordered_delimiter: OrderedDelimiter::Paren,
+            list_spacing: Some(spacing),
+            ..MarkdownOptions::default()
+        },
+        ..Options::default()
+    };
+
+    let markdown = convert_file_with("testdata/lists.epub", &styled(ListSpacing::Tight))?;
+    let items: Vec<&str> = markdown
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty())
+        .collect();
+    for expected in [
+        "- Cage",
+        "1) Wash the tray",
+        "2) Fill the bedding",
+        "- Food",
+        "- Pellets",
+        "- Greens",
+        "- Water",
+    ] {
+        assert!(
+            items.contains(&expected),
+            "{:?} not in {}",
+            expected,
+            markdown
+        );
+    }
+    assert!(
+        !markdown.contains("* ") && !markdown.contains("1. "),
+        "{}",
+        markdown
+    );
+    assert!(
+        list(&markdown).iter().all(|line| !line.trim().is_empty()),
+        "{}",
+        markdown
+    );
+    // The paragraphs around the list keep their blank lines.
+    assert!(
+        markdown.contains("Before the rats arrive:\n\n"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("\n\nThen let them settle."),
+        "{}",
+        markdown
+    );
+    // A number starting a line of prose isn't a list item.
+    assert!(
+        markdown.contains("\n1984. The year of the flood."),
+        "{}",
+        markdown
+    );
+
+    let markdown = convert_file_with("testdata/lists.epub", &styled(ListSpacing::Loose))?;
+    let lines = list(&markdown);
+    let items = lines.iter().enumerate().filter(|(_, line)| {
+        let line = line.trim_start();
+        line.starts_with("- ") || line.starts_with("1) ") || line.starts_with("2) ")
+    });
+    assert_eq!(items.clone().count(), 7, "{}", markdown);
+    assert!(
+        items.skip(1).all(|(i, _)| lines[i - 1].trim().is_empty()),
+        "{}",
+        markdown
+    );
+    assert!(markdown.contains("\n\n- Water"), "{}", markdown);
+    Ok(())
+}
+
+#[test]
+fn test_heading_offset() -> Result<()> {
+    let plain = Options {
+        front_matter: false,
+        toc: false,
+        ..Options::default()
+    };
+    let shifted = Options {
+        markdown: MarkdownOptions {
+            heading_offset: 1,
+            ..MarkdownOptions::default()
+        },
+        ..plain.clone()
+    };
+    let before = convert_file_with("testdata/styles.epub", &plain)?;
+    let after = convert_file_with("testdata/styles.epub", &shifted)?;
+    assert_eq!(before.lines().count(), after.lines().count());
+    for (before, after) in before.lines().zip(after.lines()) {
+        match before.strip_prefix('#') {
+            Some(_) => assert_eq!(after, format!("#{}", before)),
+            None => assert_eq!(after, before),
+        }
+    }
+    assert!(after.contains("## Rat Husbandry"));
+    assert!(after.contains("### Feeding"));
+
+    let deep = Options {
+        markdown: MarkdownOptions {
+            heading_offset: 5,
+            ..MarkdownOptions::default()
+        },
+        ..plain
+    };
+    let markdown = convert_file_with("testdata/styles.epub", &deep)?;
+    assert!(markdown.contains("###### Rat Husbandry"));
+    assert!(markdown.contains("###### Feeding"));
+    Ok(())
+}
+
+#[test]
+fn test_promote_chapters() -> Result<()> {
+    // Chapters that start at different levels, one with a heading above its first.
+    let book = common::EpubBuilder::new("Rat Homes")
+        .chapter(
+            "Burrows",
+            "<h1>Burrows</h1><p>Deep.</p><h2>Tunnels</h2><p>Long.</p>",
+        )
+        .chapter(
+            "Nests",
+            "<h3>Nests</h3><p>Warm.</p><h4>Bedding</h4><p>Soft.</p><h5>Paper</h5><p>Shredded.</p>",
+        )
+        .chapter(
+            "Larders",
+            "<h2>Larders</h2><p>Full.</p><h1>Stores</h1><p>Fuller.</p>",
+        )
+        .build();
+    let options = Options {
+        front_matter: false,
+        toc_depth: Some(2),
+        heading_ids: true,
+        promote_chapters: Some(2),
+        ..Options::default()
+    };
+    let markdown = convert_file_with(book.path(), &options)?;
+    for expected in [
+        "## Burrows {#burrows}\n\nDeep.\n\n### Tunnels {#tunnels}\n",
+        "## Nests {#nests}\n\nWarm.\n\n### Bedding {#bedding}\n\nSoft.\n\n#### Paper {#paper}\n",
+        // Levels stop at 1.
+        "## Larders {#larders}\n\nFull.\n\n# Stores {#stores}\n",
+    ] {
+        assert!(
+            markdown.contains(expected),
+            "{:?} not in {}",
+            expected,
+            markdown
+        );
+    }
+    let toc = "- [Burrows](#burrows)\n  - [Tunnels](#tunnels)\n- [Nests](#nests)\n  - [Bedding](#bedding)\n\
+               - [Larders](#larders)\n  - [Stores](#stores)\n";
+    assert!(
+        markdown.starts_with(toc),
+        "unexpected table of contents:\n{}",
+        markdown
+    );
+
+    // Chapters on their own are promoted too.
+    let options = Options {
+        promote_chapters: Some(1),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with(book.path(), &options)?;
+    assert!(chapters[1]
+        .markdown
+        .starts_with("# Nests\n\nWarm.\n\n## Bedding\n\nSoft.\n\n### Paper\n"));
+    assert!(chapters[2]
+        .markdown
+        .starts_with("# Larders\n\nFull.\n\n# Stores\n"));
+    Ok(())
+}
+
+#[test]
+fn test_nested_blockquotes_and_inline_quotes() -> Result<()> {
+    let markdown = convert_file("testdata/blockquotes.epub")?;
+    for expected in [
+        "> Dear Sir, your neighbour sent me this:\n>\n> > The rats have taken the granary.\n>\n> I will come on Tuesday.",
+        "He called it “a ‘minor’ visit” in his diary.",
+    ] {
+        assert!(markdown.contains(expected), "{:?} not in {}", expected, markdown);
+    }
+
+    let options = Options {
+        markdown: MarkdownOptions {
+            quote_style: QuoteStyle::Straight,
+            ..MarkdownOptions::default()
+        },
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/blockquotes.epub", &options)?;
+    assert!(
+        markdown.contains("He called it \"a 'minor' visit\" in his diary."),
+        "{}",
+        markdown
+    );
+    Ok(())
+}
+
+#[test]
+fn test_unreadable_entries() -> Result<()> {
+    let book = "testdata/unreadable.epub";
+    let err = convert_file(book).unwrap_err();
+    assert!(
+        format!("{:#}", err).starts_with("Failed to convert ch2.xhtml: Failed to read ch2:"),
+        "{:#}",
+        err
+    );
+
+    let policy = |unreadable| Options {
+        strict: false,
+        unreadable: Some(unreadable),
+        ..Options::default()
+    };
+    let err = convert_file_with(book, &policy(Unreadable::Fail)).unwrap_err();
+    assert!(
+        format!("{:#}", err).starts_with("Failed to read OEBPS/nav.xhtml:"),
+        "{:#}",
+        err
+    );
+
+    // Not conversion failures, so there's no ChapterErrors.
+    let markdown = convert_file_with(book, &policy(Unreadable::Placeholder))?;
+    assert!(
+        markdown.contains("> [unreadable: Failed to read OEBPS/nav.xhtml:"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("> [unreadable: ch2.xhtml: Failed to read ch2:"),
+        "{}",
+        markdown
+    );
+    assert!(markdown.find("This chapter reads fine.") < markdown.find("> [unreadable: ch2.xhtml"));
+    assert!(markdown.find("> [unreadable: ch2.xhtml") < markdown.find("This one reads fine too."));
+
+    let chapters = convert_chapters_with(book, &policy(Unreadable::Skip))?;
+    assert_eq!(
+        chapters
+            .iter()
+            .map(|chapter| chapter.index)
+            .collect::<Vec<_>>(),
+        [1, 3]
+    );
+
+    assert_eq!(
+        "placeholder".parse::<Unreadable>(),
+        Ok(Unreadable::Placeholder)
+    );
+    assert!("retry".parse::<Unreadable>().is_err());
+    Ok(())
+}
+
+#[test]
+fn test_scene_breaks() -> Result<()> {
+    let markdown = convert_chapters("testdata/scene-breaks.epub")?
+        .remove(0)
+        .markdown;
+    for expected in [
+        "The rats waited for the lamps to go out.\n\n---\n\nBy morning the larder was empty.\n\n---\n\n",
+        // A run of breaks is one paragraph break, however long.
+        "The cat slept through it all.\n\nThe dog did not.",
+    ] {
+        assert!(markdown.contains(expected), "{:?} not in {}", expected, markdown);
+    }
+    // Breaks that start or end a paragraph do nothing.
+    assert!(
+        markdown.contains("\n\nNobody blamed the rats.\n"),
+        "{}",
+        markdown
+    );
+    assert!(!markdown.contains('\\'), "{}", markdown);
+    assert!(!markdown.contains("  \n\n"), "{}", markdown);
+    Ok(())
+}
+
+#[test]
+fn test_definition_lists() -> Result<()> {
+    let book = "testdata/glossary.epub";
+    let markdown = convert_chapters(book)?.remove(0).markdown;
+    let expected = "\
+Burrow
+:   A hole dug by a rat to live in.
+
+Doe
+Sow
+:   A female rat.
+
+*Rattus norvegicus*
+:   The brown rat.
+
+    Also called the sewer rat.
+:   The Norway rat, though it isn't from Norway.
+
+Mischief
+:   A group of rats.
+
+See also the index.";
+    assert!(markdown.contains(expected), "{}", markdown);
+
+    let options = Options {
+        markdown: MarkdownOptions {
+            definition_lists: DefinitionList::Bold,
+            ..MarkdownOptions::default()
+        },
+        ..Options::default()
+    };
+    let markdown = convert_chapters_with(book, &options)?.remove(0).markdown;
+    for expected in [
+        "**Burrow**\n\n  A hole dug by a rat to live in.\n\n**Doe**\n**Sow**\n\n  A female rat.\n\n",
+        "**Mischief**\n\n  A group of rats.\n\nSee also the index.",
+    ] {
+        assert!(markdown.contains(expected), "{:?} not in {}", expected, markdown);
+    }
+    Ok(())
+}
+
+#[test]
+fn test_poetry() -> Result<()> {
+    let book = "testdata/poetry.epub";
+    let options = Options {
+        verse_classes: vec!["poem".to_string(), "verse".to_string()],
+        ..Options::default()
+    };
+    let markdown = convert_chapters_with(book, &options)?.remove(0).markdown;
+    for expected in [
+        "Rats in the hall,  \nrats on the stair,  \nrats in the *larder*  \nand under the chair.\n\n",
+        // Two breaks in a row end the stanza.
+        "Rats in the cellar,\n\nrats in the loft.",
+        "```\n   a\n     rat\n        runs\n           down\n```",
+        "The rat is grey,  \nthe rat is quick,\n\nthe rat is gone  \nbefore the click.",
+        "Whiskers twitch,  \nthe pantry creaks;\n\na crumb is missed  \nfor weeks and weeks.",
+    ] {
+        assert!(markdown.contains(expected), "{:?} not in {}", expected, markdown);
+    }
+    common::assert_golden("poetry.md", &markdown);
+
+    let backslash = Options {
+        markdown: MarkdownOptions {
+            line_break: LineBreak::Backslash,
+            ..MarkdownOptions::default()
+        },
+        ..options
+    };
+    let markdown = convert_chapters_with(book, &backslash)?.remove(0).markdown;
+    assert!(
+        markdown.contains("Rats in the hall,\\\nrats on the stair,\\\n"),
+        "{}",
+        markdown
+    );
+    assert!(markdown.contains("and under the chair.\n"), "{}", markdown);
+
+    // Without a verse class, lines written as text run together.
+    let markdown = convert_chapters(book)?.remove(0).markdown;
+    assert!(
+        markdown.contains("Whiskers twitch, the pantry creaks;"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("Rats in the hall,  \nrats on the stair,"),
+        "{}",
+        markdown
+    );
+    Ok(())
+}
+
+#[test]
+fn test_right_to_left() -> Result<()> {
+    let book = "testdata/rtl.epub";
+    let metadata = read_metadata(book)?;
+    assert_eq!(metadata.direction, Some(Direction::Rtl));
+    assert!(metadata
+        .front_matter()
+        .contains("language: \"he\"\ndirection: \"rtl\"\n"));
+
+    // Without --rtl-wrap the text is left as it is.
+    let chapters = convert_chapters_with(book, &Options::default())?;
+    assert!(
+        !chapters[1].markdown.contains('\u{200f}'),
+        "{}",
+        chapters[1].markdown
+    );
+
+    let marks = Options {
+        rtl_wrap: Some(RtlWrap::Marks),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with(book, &marks)?;
+    // The preface declares itself English, and stays left to right.
+    assert!(
+        !chapters[0].markdown.contains(['\u{200e}', '\u{200f}']),
+        "{}",
+        chapters[0].markdown
+    );
+    let hebrew = &chapters[1].markdown;
+    assert!(hebrew.contains("\u{200f}פרק ראשון"), "{}", hebrew);
+    assert!(hebrew.contains("\u{200f}עכבר"), "{}", hebrew);
+    assert_eq!(chapters[1].title, "פרק ראשון");
+    assert!(hebrew.contains("\n\nRattus norvegicus"), "{}", hebrew);
+
+    let div = Options {
+        rtl_wrap: Some(RtlWrap::Div),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with(book, &div)?;
+    assert!(
+        !chapters[0].markdown.contains("<div"),
+        "{}",
+        chapters[0].markdown
+    );
+    let hebrew = &chapters[1].markdown;
+    assert!(hebrew.starts_with("<div dir=\"rtl\">\n\n"), "{}", hebrew);
+    assert!(hebrew.ends_with("\n\n</div>"), "{}", hebrew);
+    // Only the English paragraph runs the other way from its chapter.
+    assert!(hebrew.contains("\u{200e}Rattus norvegicus"), "{}", hebrew);
+    assert!(!hebrew.contains('\u{200f}'), "{}", hebrew);
+
+    // Smart quotes and dashes follow English usage, so Hebrew is left out.
+    let smart = Options {
+        markdown: MarkdownOptions {
+            typography: Some("quotes,dashes".parse::<Typography>().unwrap().smart(true)),
+            ..MarkdownOptions::default()
+        },
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with(book, &smart)?;
+    assert!(
+        chapters[0].markdown.contains("about rats – “in Hebrew”."),
+        "{}",
+        chapters[0].markdown
+    );
+    assert!(
+        chapters[1].markdown.contains("העכבר \"רץ\" -- מהר."),
+        "{}",
+        chapters[1].markdown
+    );
+    Ok(())
+}
+
+#[test]
+fn test_ruby() -> Result<()> {
+    let book = "testdata/ruby.epub";
+    // By default each reading follows its base text in parentheses, in place
+    // of the book's own <rp> ones.
+    let chapter = convert_chapters(book)?.remove(0);
+    assert_eq!(chapter.title, "第一章　鼠（ねずみ）");
+    assert!(
+        chapter.markdown.contains("漢字（かんじ）を読む。"),
+        "{}",
+        chapter.markdown
+    );
+    assert!(
+        chapter
+            .markdown
+            .contains("東（とう）京（きょう）の鼠（ねずみ）は速い。"),
+        "{}",
+        chapter.markdown
+    );
+    assert!(!chapter.markdown.contains("（）"), "{}", chapter.markdown);
+
+    let base = Options {
+        ruby: Ruby::Base,
+        ..Options::default()
+    };
+    let chapter = convert_chapters_with(book, &base)?.remove(0);
+    assert!(
+        chapter.markdown.contains("漢字を読む。"),
+        "{}",
+        chapter.markdown
+    );
+    assert!(
+        chapter.markdown.contains("東京の鼠は速い。"),
+        "{}",
+        chapter.markdown
+    );
+
+    let html = Options {
+        ruby: Ruby::Html,
+        ..Options::default()
+    };
+    let chapter = convert_chapters_with(book, &html)?.remove(0);
+    assert_eq!(chapter.title, "第一章　鼠（ねずみ）");
+    assert!(
+        chapter
+            .markdown
+            .contains("<ruby>漢字<rp>（</rp><rt>かんじ</rt><rp>）</rp></ruby>を読む。"),
+        "{}",
+        chapter.markdown
+    );
+    assert!(
+        chapter
+            .markdown
+            .contains("<ruby>東<rt>とう</rt>京<rt>きょう</rt></ruby>の"),
+        "{}",
+        chapter.markdown
+    );
+    Ok(())
+}
+
+#[test]
+fn test_page_markers() -> Result<()> {
+    let book = "testdata/pagebreaks.epub";
+    // By default the page breaks are dropped, numbers and all.
+    let chapter = convert_chapters(book)?.remove(0);
+    assert_eq!(chapter.title, "Chapter One");
+    assert!(
+        chapter
+            .markdown
+            .contains("The brown rat came ashore in the year of the flood."),
+        "{}",
+        chapter.markdown
+    );
+    assert!(!chapter.markdown.contains('4'), "{}", chapter.markdown);
+
+    let marked = Options {
+        page_markers: Some(DEFAULT_PAGE_MARKER.to_string()),
+        ..Options::default()
+    };
+    let chapter = convert_chapters_with(book, &marked)?.remove(0);
+    assert_eq!(chapter.title, "Chapter One");
+    assert!(
+        chapter
+            .markdown
+            .contains("came ashore<!-- page 2 --> in the year"),
+        "{}",
+        chapter.markdown
+    );
+    // From the aria-label, without its "Page", and from the text.
+    assert!(
+        chapter.markdown.contains("\n<!-- page 3 -->\n"),
+        "{}",
+        chapter.markdown
+    );
+    assert!(
+        chapter.markdown.contains("\n<!-- page 4 -->\n"),
+        "{}",
+        chapter.markdown
+    );
+    // A break inside a word goes after it.
+    assert!(
+        chapter
+            .markdown
+            .contains("in the granary<!-- page 5 --> all winter"),
+        "{}",
+        chapter.markdown
+    );
+    // A break without a number leaves no marker.
+    assert_eq!(
+        chapter.markdown.matches("<!-- page").count(),
+        5,
+        "{}",
+        chapter.markdown
+    );
+
+    let custom = Options {
+        page_markers: Some("[p. {page}]".to_string()),
+        ..Options::default()
+    };
+    let chapter = convert_chapters_with(book, &custom)?.remove(0);
+    assert!(
+        chapter.markdown.contains("came ashore[p. 2] in the year"),
+        "{}",
+        chapter.markdown
+    );
+    Ok(())
+}
+
+#[test]
+fn test_page_list() -> Result<()> {
+    let pages = page_list("testdata/pagebreaks.epub")?;
+    let pages: Vec<(&str, &str)> = pages
+        .iter()
+        .map(|target| (target.page.as_str(), target.href.as_str()))
+        .collect();
+    assert_eq!(pages[0], ("1", "ch1.xhtml#page1"));
+    assert_eq!(pages.len(), 5);
+    assert_eq!(book_info("testdata/pagebreaks.epub")?.pages, 5);
+
+    // The navigation document's page list comes first, without external links.
+    let pages = page_list("testdata/pagebreaks-nav.epub")?;
+    let pages: Vec<(&str, &str)> = pages
+        .iter()
+        .map(|target| (target.page.as_str(), target.href.as_str()))
+        .collect();
+    assert_eq!(pages, [("i", "ch1.xhtml#page1"), ("ii", "ch1.xhtml#page2")]);
+
+    assert!(page_list("testdata/pg35542.epub")?.is_empty());
+    Ok(())
+}
+
+#[test]
+fn test_normalize_typography() -> Result<()> {
+    let plain = Options {
+        front_matter: false,
+        toc: false,
+        ..Options::default()
+    };
+    let options = Options {
+        markdown: MarkdownOptions {
+            typography: Some(Typography::default()),
+            ..MarkdownOptions::default()
+        },
+        ..plain.clone()
+    };
+    let markdown = convert_file_with("testdata/typography.epub", &options)?;
+    assert!(
+        markdown.contains("\"Rats,\" she said---and it's true--are clever."),
+        "{}",
+        markdown
+    );
+    assert!(markdown.contains("The rodent ratcatcher came at noon."));
+    assert!(markdown.contains("Zerowidth and spaced."));
+    // Code keeps its characters, inline and in blocks.
+    assert!(markdown.contains("`say “hi”\u{ad}—now`"), "{}", markdown);
+    assert!(markdown.contains("```sh\necho “it’s\u{ad}—done”\u{a0}\u{a0}ok\n```"));
+
+    let original = convert_file_with("testdata/typography.epub", &plain)?;
+    assert!(original.contains("ro\u{ad}dent"));
+    let options = Options {
+        markdown: MarkdownOptions {
+            typography: Some(Typography::default().smart(true)),
+            ..MarkdownOptions::default()
+        },
+        ..plain
+    };
+    let smart = convert_file_with("testdata/typography.epub", &options)?;
+    assert!(
+        smart.contains("“Rats,” she said—and it’s true–are clever."),
+        "{}",
+        smart
+    );
+    Ok(())
+}
+#[test]
+fn test_title_headings() -> Result<()> {
+    let plain = Options {
+        front_matter: false,
+        toc: false,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/untitled-chapters.epub", &plain)?;
+    assert!(!markdown.contains("Prologue"));
+
+    let options = Options {
+        title_headings: Some(2),
+        ..plain.clone()
+    };
+    let markdown = convert_file_with("testdata/untitled-chapters.epub", &options)?;
+    assert!(markdown.starts_with("## Prologue\n\nThe prologue has no heading."));
+    assert_eq!(markdown.matches("The Granary").count(), 1);
+    assert!(markdown.contains("## Part Three\n\n### A minor heading"));
+
+    // An offset that pushes the h2 down to ### still counts as the chapter's own heading.
+    let options = Options {
+        title_headings: Some(1),
+        markdown: MarkdownOptions {
+            heading_offset: 1,
+            ..MarkdownOptions::default()
+        },
+        ..plain
+    };
+    let markdown = convert_file_with("testdata/untitled-chapters.epub", &options)?;
+    assert!(markdown.starts_with("# Prologue\n\n"));
+    assert_eq!(markdown.matches("The Granary").count(), 1);
+    assert!(markdown.contains("# Part Three\n\n#### A minor heading"));
+    Ok(())
+}
+
+#[test]
+fn test_chapter_titles() -> Result<()> {
+    let chapters = convert_chapters("testdata/chapter-titles.epub")?;
+    let titles: Vec<&str> = chapters
+        .iter()
+        .map(|chapter| chapter.title.as_str())
+        .collect();
+    // The TOC entry for part2.xhtml itself wins over the earlier one for a
+    // fragment in it; part3 has only headings and part4 only a file name.
+    assert_eq!(
+        titles,
+        ["Chapter One", "Chapter Two", "An Interlude", "part4"]
+    );
+
+    let mut book = Book::open("testdata/chapter-titles.epub")?;
+    assert_eq!(book.chapter(2)?.title, "An Interlude");
+    let titles: Vec<Option<String>> = book.spine().into_iter().map(|entry| entry.title).collect();
+    assert_eq!(
+        titles,
+        [
+            Some("Chapter One".to_string()),
+            Some("Chapter Two".to_string()),
+            None,
+            None
+        ]
+    );
+    Ok(())
+}
+
+#[test]
+fn test_invalid_epub() -> Result<()> {
+    let dir = tempfile::tempdir()?;
+    let pdf = dir.path().join("book.pdf");
+    fs::write(&pdf, b"%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")?;
+    let not_zip = InvalidEpub::NotEpub("the file isn't a zip archive".to_string());
+    let err = convert_file(pdf.to_str().unwrap()).unwrap_err();
+    assert_eq!(err.downcast_ref::<InvalidEpub>(), Some(&not_zip));
+    assert!(format!("{:#}", err).ends_with("book.pdf: not an EPUB: the file isn't a zip archive"));
+    let err = convert(File::open(&pdf)?).unwrap_err();
+    assert_eq!(err.downcast_ref::<InvalidEpub>(), Some(&not_zip));
+
+    let cases = [
+        (
+            "testdata/not-epub.zip",
+            InvalidEpub::NotEpub("the zip archive has no mimetype file".to_string()),
+        ),
+        (
+            "testdata/wrong-mimetype.epub",
+            InvalidEpub::NotEpub(
+                "its mimetype is \"application/zip\" rather than application/epub+zip".to_string(),
+            ),
+        ),
+        (
+            "testdata/no-container.epub",
+            InvalidEpub::Corrupt("META-INF/container.xml is missing".to_string()),
+        ),
+    ];
+    for (path, expected) in cases {
+        let err = convert_file(path).unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<InvalidEpub>(),
+            Some(&expected),
+            "{}",
+            path
+        );
+        let err = convert_seekable(File::open(path)?, &Options::default()).unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<InvalidEpub>(),
+            Some(&expected),
+            "{}",
+            path
+        );
+    }
+
+    // A file that isn't there is a different kind of failure.
+    let err = convert_file("testdata/does-not-exist.epub").unwrap_err();
+    assert!(err.downcast_ref::<InvalidEpub>().is_none());
+    Ok(())
+}
+
+#[test]
+fn test_drm_protected() -> Result<()> {
+    let err = convert_file("testdata/drm.epub").unwrap_err();
+    let drm = err.downcast_ref::<DrmProtected>().expect("a DrmProtected");
+    assert_eq!(drm.encrypted, ["OEBPS/ch1.xhtml"]);
+    assert!(drm.adobe);
+    assert!(Book::from_reader(File::open("testdata/drm.epub")?).is_err());
+
+    let err = convert_file("testdata/drm-lcp.epub").unwrap_err();
+    let drm = err.downcast_ref::<DrmProtected>().expect("a DrmProtected");
+    assert!(drm.readium && !drm.adobe);
+    assert_eq!(
+        err.to_string(),
+        "this book is DRM-protected (Readium LCP) and cannot be converted"
+    );
+
+    // Obfuscated fonts don't stop the text from being converted.
+    let markdown = convert_file("testdata/font-obfuscation.epub")?;
+    assert!(markdown.contains("Only the font is obfuscated."));
+    Ok(())
+}
+
+#[test]
+fn test_obfuscated_fonts() -> Result<()> {
+    let book = "testdata/obfuscated-fonts.epub";
+    let fonts = ["OEBPS/fonts/Serif.ttf", "OEBPS/fonts/Sans Bold.ttf"];
+    assert_eq!(book_info(book)?.obfuscated_fonts, fonts);
+    assert_eq!(
+        book_info("testdata/pg35542.epub")?.obfuscated_fonts,
+        Vec::<String>::new()
+    );
+
+    let problems = validate(book)?;
+    assert_eq!(problems.len(), 2, "{:?}", problems);
+    assert!(problems
+        .iter()
+        .all(|problem| problem.code == "obfuscated-font" && problem.is_warning()));
+    assert!(
+        problems[1].message.contains("OEBPS/fonts/Sans Bold.ttf"),
+        "{}",
+        problems[1]
+    );
+
+    // The text converts, and only the image is written out.
+    let dir = tempfile::tempdir()?;
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: dir.path().join("images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..Options::default()
+    };
+    let markdown = convert_file_with(book, &options)?;
+    assert!(
+        markdown.contains("The fonts are obfuscated, but the text is not."),
+        "{}",
+        markdown
+    );
+    let written: Vec<_> = fs::read_dir(dir.path().join("images"))?
+        .map(|entry| entry.unwrap().file_name())
+        .collect();
+    assert_eq!(written, ["rat.png"]);
+    Ok(())
+}
+
+#[test]
+fn test_book_stats() -> Result<()> {
+    let stats = book_stats("testdata/epub3-nav.epub")?;
+    let titles: Vec<&str> = stats
+        .chapters
+        .iter()
+        .map(|chapter| chapter.title.as_str())
+        .collect();
+    assert_eq!(
+        titles,
+        ["Chapter One: The Harbour", "Chapter Two: Landfall"]
+    );
+    assert!(stats.chapters.iter().all(|chapter| chapter.words > 0));
+    assert_eq!(
+        stats.words,
+        stats
+            .chapters
+            .iter()
+            .map(|chapter| chapter.words)
+            .sum::<usize>()
+    );
+    assert_eq!(stats.minutes, reading_minutes(stats.words));
+    Ok(())
+}
+
+#[test]
+fn test_legacy_encodings() -> Result<()> {
+    let chapters = convert_chapters("testdata/legacy-encodings.epub")?;
+    // ISO-8859-1 from the XML declaration, windows-1252 from a meta tag, and
+    // windows-1252 detected without any declaration.
+    assert!(chapters[0]
+        .markdown
+        .contains("Le garçon apporta un crème brûlée à la fenêtre."));
+    assert!(chapters[1]
+        .markdown
+        .contains("“Encore,” dit-elle – une fois de plus… pour 5 €."));
+    assert!(chapters[2]
+        .markdown
+        .contains("Où est la bibliothèque ? Ça dépend."));
+
+    let markdown = convert_file("testdata/legacy-encodings.epub")?;
+    assert!(!markdown.contains(char::REPLACEMENT_CHARACTER));
+    assert!(markdown.contains("# Déjà vu"));
+    common::assert_golden("legacy-encodings.md", &markdown);
+    let golden = fs::read("testdata/golden/legacy-encodings.md")?;
+    assert!(String::from_utf8(golden).is_ok());
+    Ok(())
+}
+
+#[test]
+fn test_cjk_encodings() -> Result<()> {
+    let chapters = convert_chapters("testdata/cjk-encodings.epub")?;
+    // Shift_JIS from the XML declaration, GBK from a meta charset.
+    assert!(
+        chapters[0]
+            .markdown
+            .contains("ドブネズミは「夜行性」の動物です。"),
+        "{}",
+        chapters[0].markdown
+    );
+    assert!(
+        chapters[1].markdown.contains("褐家鼠是最常见的老鼠。"),
+        "{}",
+        chapters[1].markdown
+    );
+    assert!(
+        chapters[2]
+            .markdown
+            .contains("‘Rats,’ she said, “are clever.”"),
+        "{}",
+        chapters[2].markdown
+    );
+    assert!(chapters[0].markdown.starts_with("# ネズミ"));
+    Ok(())
+}
+
+#[test]
+fn test_stored_entries() -> Result<()> {
+    // Every entry of the archive is stored uncompressed.
+    let markdown = convert_file("testdata/stored.epub")?;
+    assert!(
+        markdown.contains("Rats dig burrows under hedges."),
+        "{}",
+        markdown
+    );
+    assert!(markdown.contains("Every entry in this book is stored, not deflated."));
+    assert_eq!(convert(File::open("testdata/stored.epub")?)?, markdown);
+
+    let dir = tempfile::tempdir()?;
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: dir.path().join("images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..Options::default()
+    };
+    convert_file_with("testdata/stored.epub", &options)?;
+    let written: Vec<PathBuf> = fs::read_dir(dir.path().join("images"))?
+        .map(|entry| entry.map(|e| e.path()))
+        .collect::<Result<_, _>>()?;
+    assert_eq!(written.len(), 1, "{:?}", written);
+    let png = fs::read(&written[0])?;
+    assert!(png.starts_with(b"\x89PNG\r\n\x1a\n"));
+    assert_eq!(png.len(), 70);
+    Ok(())
+}
+
+#[test]
+fn test_sanitize() -> Result<()> {
+    let markdown = convert_file("testdata/retailer-cruft.epub")?;
+    for cruft in [
+        "text-indent",
+        "font-weight",
+        "tracking",
+        "Kindle edition",
+        "secretly",
+        "hidden note",
+        "Template row",
+    ] {
+        assert!(!markdown.contains(cruft), "{:?} in {}", cruft, markdown);
+    }
+    assert!(markdown.contains("The brown rat is the commoner of the two."));
+    assert!(markdown.contains("It is nocturnal."));
+    assert!(markdown.contains("Rats climb well."));
+    // No CSS is left, in the text or in the attributes of the table kept as
+    // HTML, while the emphasis and the quote survive.
+    for css in [
+        "page-break",
+        "margin",
+        "font-style",
+        "epigraph",
+        "calibre",
+        "style=",
+        "align=",
+        "bgcolor",
+        "border",
+    ] {
+        assert!(!markdown.contains(css), "{:?} in {}", css, markdown);
+    }
+    assert!(
+        markdown.contains("> A rat *smells* what it cannot see."),
+        "{}",
+        markdown
+    );
+    assert!(markdown.contains("Whiskers are **sensitive**."));
+    assert!(
+        markdown.contains("<th rowspan=\"2\">Sense</th>"),
+        "{}",
+        markdown
+    );
+
+    let options = Options {
+        sanitize: false,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/retailer-cruft.epub", &options)?;
+    assert!(markdown.contains("Kindle edition, do not remove this marker."));
+    assert!(markdown.contains("It is secretly nocturnal."));
+    Ok(())
+}
+
+#[test]
+fn test_out_of_spec_epubs() -> Result<()> {
+    let strict = Options {
+        lenient: false,
+        ..Options::default()
+    };
+    let cases = [
+        (
+            "no-mimetype",
+            InvalidEpub::NotEpub("the zip archive has no mimetype file".to_string()),
+        ),
+        (
+            "compressed-mimetype",
+            InvalidEpub::Corrupt("the mimetype file is compressed".to_string()),
+        ),
+        (
+            "bom-container",
+            InvalidEpub::Corrupt(
+                "META-INF/container.xml starts with a byte order mark".to_string(),
+            ),
+        ),
+        (
+            "zipped-folder",
+            InvalidEpub::Corrupt(
+                "META-INF/container.xml is at Rats/meta-inf/container.xml".to_string(),
+            ),
+        ),
+    ];
+    for (name, expected) in cases {
+        let path = format!("testdata/{}.epub", name);
+        let defect = name.replace('-', " ");
+        let markdown = convert_file(&path)?;
+        assert!(
+            markdown.contains(&format!("This book has a defect: {}.", defect)),
+            "{}: {}",
+            name,
+            markdown
+        );
+        assert_eq!(convert(File::open(&path)?)?, markdown, "{}", path);
+        assert_eq!(
+            convert_seekable(File::open(&path)?, &Options::default())?,
+            markdown,
+            "{}",
+            path
+        );
+
+        let err = convert_file_with(&path, &strict).unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<InvalidEpub>(),
+            Some(&expected),
+            "{}",
+            path
+        );
+        let err = convert_seekable(File::open(&path)?, &strict).unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<InvalidEpub>(),
+            Some(&expected),
+            "{}",
+            path
+        );
+    }
+    Ok(())
+}
+
+#[test]
+fn test_validate() -> Result<()> {
+    assert_eq!(validate("testdata/pg35542.epub")?, []);
+    assert_eq!(validate_from(File::open("testdata/epub3-nav.epub")?)?, []);
+
+    let cases: [(&str, &[&str]); 4] = [
+        (
+            "testdata/missing-chapter.epub",
+            &["missing-file: manifest item 'ch2' (OEBPS/ch2.xhtml) is missing from the archive"],
+        ),
+        (
+            "testdata/invalid-spine.epub",
+            &["missing-manifest-item: spine item 'ch4' not found in manifest"],
+        ),
+        (
+            "testdata/no-container.epub",
+            &["missing-container: META-INF/container.xml is missing"],
+        ),
+        (
+            "testdata/messy-manifest.epub",
+            &[
+                "duplicate-id: manifest id 'ch1' is used more than once",
+                "missing-file: manifest item 'style' (OEBPS/style.css) is missing from the archive",
+                "missing-toc: the book has neither a navigation document nor an NCX",
+            ],
+        ),
+    ];
+    for (path, expected) in cases {
+        let problems: Vec<String> = validate(path)?
+            .iter()
+            .map(|problem| problem.to_string())
+            .collect();
+        assert_eq!(problems, expected, "{}", path);
+    }
+    Ok(())
+}
+
+#[test]
+fn test_search() -> Result<()> {
+    let options = SearchOptions {
+        ignore_case: true,
+        context: 0,
+        ..SearchOptions::default()
+    };
+    let matches = search("testdata/epub3-nav.epub", "the", &options)?;
+    let found: Vec<(&str, usize, &str)> = matches
+        .iter()
+        .map(|found| (found.href.as_str(), found.line, found.text.as_str()))
+        .collect();
+    assert_eq!(
+        found,
+        [
+            ("text/ch1.xhtml", 1, "Chapter One: The Harbour"),
+            ("text/ch1.xhtml", 3, "The ship waited at the quay."),
+            ("text/ch1.xhtml", 9, "The Open Sea"),
+        ]
+    );
+    assert_eq!(matches[0].title, "Chapter One: The Harbour");
+    Ok(())
+}
+
+#[test]
+fn test_list_items() -> Result<()> {
+    let items = list_items("testdata/nonlinear.epub")?;
+    let spine: Vec<(&str, &str, bool)> = items
+        .spine
+        .iter()
+        .map(|item| (item.id.as_str(), item.href.as_str(), item.linear))
+        .collect();
+    assert_eq!(
+        spine,
+        [
+            ("one", "one.xhtml", true),
+            ("note", "note.xhtml", false),
+            ("two", "two.xhtml", true),
+            ("copyright", "copyright.xhtml", false)
+        ]
+    );
+    let other: Vec<&str> = items.other.iter().map(|item| item.href.as_str()).collect();
+    assert_eq!(other, ["toc.ncx"]);
+    assert_eq!(
+        list_items_from(File::open("testdata/nonlinear.epub")?)?,
+        items
+    );
+
+    // A spine item the manifest doesn't have is still listed.
+    let items = list_items("testdata/invalid-spine.epub")?;
+    assert_eq!(items.spine[1].id, "ch4");
+    assert!(items.spine[1].href.is_empty() && items.spine[1].media_type.is_empty());
+    Ok(())
+}
+
+#[test]
+fn test_chapter_html() -> Result<()> {
+    let book = "testdata/epub3-nav.epub";
+    let html = chapter_html(book, 1)?;
+    // The file as it is in the archive, declaration and all.
+    assert!(html.starts_with(b"<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!DOCTYPE html>"));
+    assert!(String::from_utf8(html.clone())?.contains("<h2 id=\"departure\">Departure</h2>"));
+
+    let chapters = chapters_html(book)?;
+    assert_eq!(chapters.len(), 2);
+    assert_eq!(chapters[0], html);
+    assert!(String::from_utf8(chapters[1].clone())?.contains("At last, an island."));
+
+    let err = chapter_html(book, 3).unwrap_err();
+    assert!(
+        err.to_string()
+            .contains("Chapter 3 is out of range: the book has 2 chapters"),
+        "{}",
+        err
+    );
+    assert!(chapter_html(book, 0).is_err());
+    Ok(())
+}
+
+#[test]
+fn test_nonlinear_spine_items() -> Result<()> {
+    // By default the non-linear items come after the others.
+    let chapters = convert_chapters("testdata/nonlinear.epub")?;
+    let indices: Vec<usize> = chapters.iter().map(|chapter| chapter.index).collect();
+    assert_eq!(indices, [1, 3, 2, 4]);
+    let markdown = convert_file("testdata/nonlinear.epub")?;
+    let appendix = markdown
+        .find("\n# Appendix\n")
+        .expect("an appendix heading");
+    assert!(
+        markdown[..appendix].contains("Rats wake at dusk."),
+        "{}",
+        markdown
+    );
+    assert!(
+        !markdown[..appendix].contains("pop-up note"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown[appendix..].contains("A pop-up note about burrows."),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown[appendix..].contains("Copyright 1902"),
+        "{}",
+        markdown
+    );
+
+    let options = Options {
+        nonlinear: Nonlinear::Include,
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/nonlinear.epub", &options)?;
+    assert_eq!(
+        chapters
+            .iter()
+            .map(|chapter| chapter.index)
+            .collect::<Vec<_>>(),
+        [1, 2, 3, 4]
+    );
+    assert!(chapters[1]
+        .markdown
+        .contains("A pop-up note about burrows."));
+    assert!(!convert_file_with("testdata/nonlinear.epub", &options)?.contains("# Appendix"));
+
+    let options = Options {
+        nonlinear: Nonlinear::Drop,
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/nonlinear.epub", &options)?;
+    assert_eq!(
+        chapters
+            .iter()
+            .map(|chapter| chapter.index)
+            .collect::<Vec<_>>(),
+        [1, 3]
+    );
+    let markdown = convert_file_with("testdata/nonlinear.epub", &options)?;
+    assert!(!markdown.contains("pop-up note"), "{}", markdown);
+    assert!(!markdown.contains("# Appendix"), "{}", markdown);
+
+    assert_eq!("drop".parse::<Nonlinear>(), Ok(Nonlinear::Drop));
+    assert!("skip".parse::<Nonlinear>().is_err());
+
+    // Selecting a non-linear item by position converts it.
+    let options = Options {
+        chapters: Some("2".parse().unwrap()),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/nonlinear.epub", &options)?;
+    assert_eq!(chapters.len(), 1);
+    assert!(chapters[0].markdown.contains("pop-up note"));
+
+    let linear: Vec<bool> = Book::open("testdata/nonlinear.epub")?
+        .spine()
+        .iter()
+        .map(|entry| entry.linear)
+        .collect();
+    assert_eq!(linear, [true, false, true, false]);
+    Ok(())
+}
+
+#[test]
+fn test_max_chapter_size() -> Result<()> {
+    let options = Options {
+        max_chapter_size: Some(1024 * 1024),
+        ..Options::default()
+    };
+    let err = convert_file_with("testdata/large-chapter.epub", &options).unwrap_err();
+    assert!(format!("{:#}", err).contains(
+        "Failed to convert large.xhtml: the chapter is 3065 KiB, over the 1024 KiB limit"
+    ));
+
+    let options = Options {
+        strict: false,
+        ..options
+    };
+    let err = convert_chapters_with("testdata/large-chapter.epub", &options).unwrap_err();
+    let errors = err
+        .downcast_ref::<ChapterErrors>()
+        .expect("a ChapterErrors");
+    assert_eq!(errors.failures.len(), 1);
+    assert_eq!(errors.failures[0].0, "large.xhtml");
+    assert!(errors.chapters[0].markdown.contains("A short preface."));
+
+    let chapters = convert_chapters("testdata/large-chapter.epub")?;
+    assert!(chapters[1].markdown.contains("## Section 1600"));
+    Ok(())
+}
+
+#[test]
+fn test_chunk_chapters() -> Result<()> {
+    let book = "testdata/large-chapter.epub";
+    let options = Options {
+        chunk_chapters: Some(1024 * 1024),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with(book, &options)?;
+    assert!(chapters.len() > 3, "{}", chapters.len());
+    assert_eq!(chapters[1].title, "Everything Else");
+    assert_eq!(chapters[2].title, "Everything Else (part 2)");
+    assert!(chapters[1].markdown.starts_with("# Everything Else\n"));
+    for chapter in &chapters[1..] {
+        assert!(
+            chapter.markdown.len() <= 1024 * 1024,
+            "{}",
+            chapter.markdown.len()
+        );
+        assert_eq!((chapter.index, chapter.href.as_str()), (2, "large.xhtml"));
+    }
+    // Each part after the first starts at a section.
+    assert!(chapters[2..]
+        .iter()
+        .all(|chapter| chapter.markdown.starts_with("## Section ")));
+
+    // In one document, the parts are kept together with a marker between them.
+    let markdown = convert_file_with(book, &options)?;
+    assert_eq!(markdown.matches(SECTION_MARKER).count(), chapters.len() - 2);
+    assert!(markdown.contains(&format!(".\n\n{}\n\n## Section ", SECTION_MARKER)));
+    assert!(!convert_file(book)?.contains(SECTION_MARKER));
+    Ok(())
+}
+
+#[test]
+fn test_strip_boilerplate() -> Result<()> {
+    let banner = "Rattus Press · The Rat Keeper's Library";
+    let footer = "More books at rattus.example";
+    let chapters = convert_chapters("testdata/boilerplate.epub")?;
+    assert!(chapters
+        .iter()
+        .all(|chapter| chapter.markdown.starts_with(banner)));
+
+    let options = Options {
+        strip_boilerplate: Some(0.8),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/boilerplate.epub", &options)?;
+    assert!(
+        chapters
+            .iter()
+            .all(|chapter| chapter.markdown.starts_with("# ")),
+        "{:?}",
+        chapters
+    );
+    assert!(chapters
+        .iter()
+        .all(|chapter| !chapter.markdown.contains(footer)));
+    // The banner quoted away from the edges of a chapter stays, as does the
+    // ornament that opens only two chapters.
+    assert!(chapters[2].markdown.contains(&format!(
+        "Never by the tail.\n\n{}\n\nAway from the edges",
+        banner
+    )));
+    assert!(
+        chapters[3].markdown.contains("*\n\nWatch for sneezing."),
+        "{}",
+        chapters[3].markdown
+    );
+
+    // The footer is missing from the last chapter, so it isn't in all of them.
+    let options = Options {
+        strip_boilerplate: Some(1.0),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/boilerplate.epub", &options)?;
+    assert!(chapters
+        .iter()
+        .all(|chapter| chapter.markdown.starts_with("# ")));
+    assert!(chapters[0].markdown.contains(footer));
+    Ok(())
+}
+
+#[test]
+fn test_dedupe_boilerplate() -> Result<()> {
+    let header = "## The Rat Keeper\n\nby A. Rat\n\n";
+    let chapters = convert_chapters("testdata/repeated-headers.epub")?;
+    assert!(
+        chapters
+            .iter()
+            .all(|chapter| chapter.markdown.starts_with(header)),
+        "{:?}",
+        chapters
+    );
+
+    let options = Options {
+        dedupe_boilerplate: Some(3),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/repeated-headers.epub", &options)?;
+    assert!(
+        chapters[0]
+            .markdown
+            .starts_with(&format!("{}# Housing\n", header)),
+        "{}",
+        chapters[0].markdown
+    );
+    assert!(
+        chapters[1].markdown.starts_with("# Feeding\n"),
+        "{}",
+        chapters[1].markdown
+    );
+    assert!(
+        chapters[2].markdown.starts_with("# Handling\n"),
+        "{}",
+        chapters[2].markdown
+    );
+    // The title essay keeps its heading, which is the book's title too.
+    assert!(
+        chapters[3]
+            .markdown
+            .starts_with("## The Rat Keeper\n\nWhat it takes"),
+        "{}",
+        chapters[3].markdown
+    );
+
+    let options = Options {
+        front_matter: false,
+        ..options
+    };
+    let markdown = convert_file_with("testdata/repeated-headers.epub", &options)?;
+    assert_eq!(markdown.matches("by A. Rat").count(), 1);
+    assert_eq!(markdown.matches("## The Rat Keeper").count(), 2);
+
+    // Four chapters open with the header, so it isn't repeated in five.
+    let options = Options {
+        dedupe_boilerplate: Some(5),
+        ..Options::default()
+    };
+    let chapters = convert_chapters_with("testdata/repeated-headers.epub", &options)?;
+    assert!(chapters
+        .iter()
+        .all(|chapter| chapter.markdown.starts_with(header)));
+    Ok(())
+}
+
+#[test]
+fn test_converter() -> Result<()> {
+    let converter = Converter::new();
+    assert_eq!(
+        converter.convert_file("testdata/pg35542.epub")?,
+        convert_file("testdata/pg35542.epub")?
+    );
+    assert_eq!(
+        converter.convert(File::open("testdata/table.epub")?)?,
+        convert_file("testdata/table.epub")?
+    );
+
+    let options = Options {
+        front_matter: false,
+        toc: false,
+        ..Options::default()
+    };
+    let converter = Converter::new()
+        .options(options)
+        .format(Format::Text)
+        .jobs(2);
+    let text = converter.convert_file("testdata/styles.epub")?;
+    assert!(
+        text.starts_with("Rat Husbandry\n\nRats are very social"),
+        "{}",
+        text
+    );
+    assert!(!text.contains('#'));
+
+    let json = Converter::new()
+        .format(Format::Json)
+        .convert_file("testdata/epub3-nav.epub")?;
+    let value: serde_json::Value = serde_json::from_str(&json)?;
+    assert_eq!(value["chapters"].as_array().map(Vec::len), Some(2));
+
+    let ansi = Converter::new()
+        .format(Format::Ansi)
+        .convert_file("testdata/pg35542.epub")?;
+    assert!(ansi.contains("\x1b["));
+
+    // One converter, several books at once.
+    let converter = Converter::new().format(Format::Text);
+    let books = [
+        "testdata/pg35542.epub",
+        "testdata/table.epub",
+        "testdata/styles.epub",
+    ];
+    let converted: Vec<String> = std::thread::scope(|scope| {
+        let handles: Vec<_> = books
+            .iter()
+            .map(|book| scope.spawn(|| converter.convert_file(book)))
+            .collect();
+        handles
+            .into_iter()
+            .map(|handle| handle.join().unwrap())
+            .collect::<Result<_>>()
+    })?;
+    for (book, text) in books.iter().zip(&converted) {
+        assert_eq!(*text, converter.convert_file(book)?);
+    }
+
+    let options = Options {
+        toc: false,
+        ..Options::default()
+    };
+    let converter = Converter::new()
+        .options(options.clone())
+        .front_matter(false)
+        .chapters("2".parse().unwrap());
+    let markdown = converter.convert_file("testdata/epub3-nav.epub")?;
+    let chapters = convert_chapters_with("testdata/epub3-nav.epub", &options)?;
+    assert!(
+        markdown.contains(chapters[1].markdown.trim()),
+        "{}",
+        markdown
+    );
+    assert!(
+        !markdown.contains(chapters[0].markdown.trim()),
+        "{}",
+        markdown
+    );
+    assert!(!markdown.starts_with("---\n"));
+
+    let mut written = Vec::new();
+    converter.write(File::open("testdata/epub3-nav.epub")?, &mut written)?;
+    assert_eq!(String::from_utf8(written)?, markdown);
+
+    let dir = tempfile::tempdir()?;
+    let images = ImageOptions {
+        dir: dir.path().join("images"),
+        link_prefix: "images".to_string(),
+    };
+    let mut written = Vec::new();
+    Converter::new()
+        .images(images)
+        .write_file("testdata/pg35542-images.epub", &mut written)?;
+    assert!(String::from_utf8(written)?.contains("](images/6789594627817495676_fig-00-400.png"));
+    assert!(dir
+        .path()
+        .join("images/6789594627817495676_fig-00-400.png")
+        .exists());
+    Ok(())
+}
+
+#[test]
+fn test_skip_front_and_back_matter() -> Result<()> {
+    let book = "testdata/matter.epub";
+    let indices = |options: &Options| -> Result<Vec<usize>> {
+        Ok(convert_chapters_with(book, options)?
+            .iter()
+            .map(|chapter| chapter.index)
+            .collect())
+    };
+    assert_eq!(indices(&Options::default())?, [1, 2, 3, 4, 5, 6, 7, 8]);
+    // The cover by its file name, the title page and the nav document by their
+    // landmarks; contents.xhtml is in the middle of the book, so it stays.
+    let front = Options {
+        skip_front_matter: true,
+        ..Options::default()
+    };
+    assert_eq!(indices(&front)?, [4, 5, 6, 7, 8]);
+    let back = Options {
+        skip_back_matter: true,
+        ..Options::default()
+    };
+    assert_eq!(indices(&back)?, [1, 2, 3, 4, 5, 6]);
+    let both = Options {
+        skip_front_matter: true,
+        ..back.clone()
+    };
+    let markdown = convert_file_with(book, &both)?;
+    assert!(markdown.contains("Rats travel by ship."));
+    assert!(!markdown.contains("COVER ART") && !markdown.contains("SUBSCRIBE"));
+
+    let keep = Options {
+        keep: vec!["p00?".to_string(), "*/ALSO-BY.xhtml".to_string()],
+        ..both
+    };
+    assert_eq!(indices(&keep)?, [2, 4, 5, 6, 7]);
+
+    let matter: Vec<Option<Matter>> = Book::open(book)?
+        .spine()
+        .iter()
+        .map(|entry| entry.matter)
+        .collect();
+    let (front, back) = (Some(Matter::Front), Some(Matter::Back));
+    assert_eq!(matter, [front, front, front, None, None, None, back, back]);
+    Ok(())
+}
+
+#[test]
+fn test_guide() -> Result<()> {
+    let references = guide("testdata/guide.epub")?;
+    let found: Vec<(&str, &str, &str)> = references
+        .iter()
+        .map(|reference| {
+            (
+                reference.kind.as_str(),
+                reference.href.as_str(),
+                reference.title.as_str(),
+            )
+        })
+        .collect();
+    assert_eq!(
+        found,
+        [
+            ("cover", "text/front.xhtml", "Cover"),
+            ("toc", "text/listing.xhtml", "Table of Contents"),
+            ("text", "text/ch1.xhtml#start", "Beginning"),
+        ]
+    );
+    assert!(references
+        .iter()
+        .all(|reference| reference.source == GuideSource::Guide));
+
+    // EPUB3 landmarks, with the link text as the title.
+    let references = guide("testdata/matter.epub")?;
+    let found: Vec<(&str, &str, &str)> = references
+        .iter()
+        .map(|reference| {
+            (
+                reference.kind.as_str(),
+                reference.href.as_str(),
+                reference.title.as_str(),
+            )
+        })
+        .collect();
+    assert_eq!(
+        found,
+        [
+            ("titlepage", "text/p002.xhtml", "Title Page"),
+            ("toc", "nav.xhtml#toc", "Contents"),
+            ("bodymatter", "text/ch1.xhtml", "Start")
+        ]
+    );
+    assert!(references
+        .iter()
+        .all(|reference| reference.source == GuideSource::Landmarks));
+    assert!(guide("testdata/pg35542.epub")?
+        .iter()
+        .all(|reference| reference.kind != "bodymatter"));
+
+    // The guide alone marks the cover and contents as front matter.
+    let skip = Options {
+        skip_front_matter: true,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/guide.epub", &skip)?;
+    assert!(
+        !markdown.contains("A GUIDE TO RATS") && !markdown.contains("Rats Indoors. Rats Outdoors."),
+        "{}",
+        markdown
+    );
+
+    let mark = Options {
+        mark_start: true,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/guide.epub", &mark)?;
+    let start = markdown
+        .find("<a id=\"start-reading\"></a>\n\n# Rats Indoors")
+        .expect("no start marker");
+    assert!(
+        markdown
+            .find("A GUIDE TO RATS")
+            .is_some_and(|cover| cover < start),
+        "{}",
+        markdown
+    );
+    assert_eq!(markdown.matches("start-reading").count(), 1);
+    let markdown = convert_file_with("testdata/matter.epub", &mark)?;
+    assert!(
+        markdown.contains("<a id=\"start-reading\"></a>\n\n# Rats at Home"),
+        "{}",
+        markdown
+    );
+    assert!(!convert_file("testdata/guide.epub")?.contains("start-reading"));
+    Ok(())
+}
+
+#[test]
+fn test_skip_titles_and_hrefs() -> Result<()> {
+    let book = "testdata/matter.epub";
+    let search = SearchOptions {
+        regex: true,
+        ignore_case: true,
+        ..SearchOptions::default()
+    };
+    let pattern = |pattern: &str| Pattern::new(pattern, &search);
+    let options = Options {
+        skip_titles: vec![pattern("abroad")?],
+        skip_hrefs: vec![pattern(r"also-by|^text/ad")?],
+        ..Options::default()
+    };
+    let indices: Vec<usize> = convert_chapters_with(book, &options)?
+        .iter()
+        .map(|chapter| chapter.index)
+        .collect();
+    assert_eq!(indices, [1, 2, 3, 4, 5]);
+
+    // Items outside the TOC have no title to match.
+    let untitled = Options {
+        skip_titles: vec![pattern("cover|also")?],
+        ..Options::default()
+    };
+    assert_eq!(convert_chapters_with(book, &untitled)?.len(), 8);
+    Ok(())
+}
+
+#[test]
+fn test_code_blocks() -> Result<()> {
+    let markdown = convert_file("testdata/code-blocks.epub")?;
+    // Tabs and the blank lines inside the loop are kept as they were.
+    let go = "```go\npackage main\n\nimport \"fmt\"\n\nfunc main() {\n\tfor i := 0; i < 3; i++ {\n\t\tfmt.Println(\"turn\", i)\n\n\n\t}\n}\n```";
+    assert!(markdown.contains(go), "{}", markdown);
+    let python = "```python\ndef feed(rat):\n    if rat.hungry:\n        return \"cheese\"\n\n    return None\n```";
+    assert!(markdown.contains(python), "{}", markdown);
+    // No language, and a longer fence around the backticks in the code.
+    let log = "````\n09:00  rat  entered   maze\n09:05  rat  found     ```cheese```\n````";
+    assert!(markdown.contains(log), "{}", markdown);
+    // GitHub puts the language on a wrapper around the <pre>.
+    assert!(
+        markdown.contains("```rust\nfn main() {\n    println!(\"maze\");\n}\n```"),
+        "{}",
+        markdown
+    );
+    // Inside a list item the block is indented along with the item.
+    let sh = markdown
+        .lines()
+        .skip_while(|line| !line.ends_with("```sh"))
+        .nth(1);
+    assert_eq!(sh.map(str::trim), Some("maze reset --all"), "{}", markdown);
+    Ok(())
+}
+
+#[test]
+fn test_math() -> Result<()> {
+    let options = Options {
+        math: true,
+        ..Options::default()
+    };
+    let markdown = convert_file_with("testdata/math.epub", &options)?;
+    for expected in [
+        "Half the litter, $\\frac{n}{2}$, are female.",
+        "A colony grows as $2^{t}$ and its area as $\\pi r^{2}$.",
+        "\n$$x=\\frac{-b\\pm\\sqrt{b^{2}-4ac}}{2a}$$\n",
+        // An mtable isn't translated, so the alttext is used.
+        "Survival after $e^{-kt}$ days.",
+        "Tail length $L_{\\mathrm{tail}}$.",
+    ] {
+        assert!(
+            markdown.contains(expected),
+            "{:?} not in {}",
+            expected,
+            markdown
+        );
+    }
+
+    let markdown = convert_file("testdata/math.epub")?;
+    assert!(!markdown.contains('$'));
+    assert!(markdown.contains("Half the litter,"));
     Ok(())
 }
@@ -0,0 +1,245 @@
+use anyhow::Result;
+use cipher::{convert_chapters, convert_file, convert_file_with, ImageOptions, Options};
+use std::fs;
+use std::io;
+
+mod common;
+
+use common::EpubBuilder;
+
+// Fixtures left out of the golden files: generated books whose output is too
+// big to be worth keeping and is checked piecewise elsewhere.
+const SKIPPED: &[&str] = &["large-chapter", "many-chapters"];
+
+// Every EPUB in testdata has its whole conversion kept in
+// testdata/golden/<name>.md, or when it's meant not to convert the error in
+// <name>.error, so that any change to the output shows up as a diff rather
+// than only a failure to convert. Run with UPDATE_GOLDEN=1 to write them again
+// after a change that's meant.
+#[test]
+fn test_golden_fixtures() -> Result<()> {
+    let mut names: Vec<String> = fs::read_dir("testdata")?
+        .map(|entry| entry.map(|entry| entry.path()))
+        .collect::<io::Result<Vec<_>>>()?
+        .into_iter()
+        .filter(|path| path.is_file() && path.extension().is_some_and(|ext| ext == "epub"))
+        .filter_map(|path| {
+            path.file_stem()
+                .map(|stem| stem.to_string_lossy().into_owned())
+        })
+        .filter(|name| !SKIPPED.contains(&name.as_str()))
+        .collect();
+    names.sort();
+    assert!(names.len() > 40, "{:?}", names);
+    for name in &names {
+        match convert_file(&format!("testdata/{}.epub", name)) {
+            Ok(markdown) => {
+                assert!(!markdown.trim().is_empty(), "{} converted to nothing", name);
+                common::assert_golden(&format!("{}.md", name), &markdown);
+            }
+            Err(e) => common::assert_golden(&format!("{}.error", name), &format!("{:#}\n", e)),
+        }
+    }
+    Ok(())
+}
+
+#[test]
+fn test_golden_nested_toc() -> Result<()> {
+    let book = EpubBuilder::new("The Rat Atlas")
+        .chapter(
+            "Old World",
+            "<h1>Old World</h1>\n<h2 id=\"asia\">Asia</h2>\n<p>Where the brown rat began.</p>\n\
+             <h2 id=\"europe\">Europe</h2>\n<p>Where it went next.</p>",
+        )
+        .section("Asia", "asia")
+        .section("Europe", "europe")
+        .chapter(
+            "New World",
+            "<h1>New World</h1>\n<p>Where it went by ship.</p>",
+        )
+        .build();
+    let markdown = convert_file(book.path())?;
+    assert!(
+        markdown.contains("[Old World](ch1.xhtml)\n  - [Asia](#asia)\n  - [Europe](#europe)\n"),
+        "{}",
+        markdown
+    );
+    common::assert_golden("built-nested-toc.md", &markdown);
+
+    let chapters = convert_chapters(book.path())?;
+    let titles: Vec<&str> = chapters
+        .iter()
+        .map(|chapter| chapter.title.as_str())
+        .collect();
+    assert_eq!(titles, ["Old World", "New World"]);
+    Ok(())
+}
+
+#[test]
+fn test_golden_images() -> Result<()> {
+    let book = EpubBuilder::new("Rats in Pictures")
+        .chapter(
+            "Portraits",
+            "<h1>Portraits</h1>\n<p><img src=\"images/rat.png\" alt=\"A brown rat\"/></p>\n\
+             <p><img src=\"images/missing.png\" alt=\"A lost rat\"/></p>",
+        )
+        .file("images/rat.png", "image/png", b"\x89PNG\r\n\x1a\n")
+        .build();
+    let options = Options {
+        images: Some(ImageOptions {
+            dir: book.dir().join("out/images"),
+            link_prefix: "images".to_string(),
+        }),
+        ..Options::default()
+    };
+    let markdown = convert_file_with(book.path(), &options)?;
+    assert!(markdown.contains("![A brown rat](images/"), "{}", markdown);
+    assert_eq!(fs::read_dir(book.dir().join("out/images"))?.count(), 1);
+    common::assert_golden("built-images.md", &markdown);
+    Ok(())
+}
+
+#[test]
+fn test_golden_footnotes() -> Result<()> {
+    let book = EpubBuilder::new("Annotated Rats")
+        .chapter(
+            "Notes",
+            "<h1>Notes</h1>\n\
+             <p>The brown rat<a epub:type=\"noteref\" href=\"#n1\" id=\"r1\">1</a> outran the black rat\
+             <a epub:type=\"noteref\" href=\"#n2\" id=\"r2\">2</a>.</p>\n\
+             <aside epub:type=\"footnote\" id=\"n1\"><p>Rattus norvegicus.</p></aside>\n\
+             <aside epub:type=\"footnote\" id=\"n2\"><p>Rattus rattus.</p></aside>",
+        )
+        .build();
+    let markdown = convert_file(book.path())?;
+    assert!(
+        markdown.contains("The brown rat[^1] outran the black rat[^2]."),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.ends_with("[^1]: Rattus norvegicus.\n\n[^2]: Rattus rattus.\n"),
+        "{}",
+        markdown
+    );
+    common::assert_golden("built-footnotes.md", &markdown);
+    Ok(())
+}
+
+#[test]
+fn test_golden_tables() -> Result<()> {
+    let book = EpubBuilder::new("Rats by the Numbers")
+        .chapter(
+            "Census",
+            "<h1>Census</h1>\n<table>\n\
+             <thead><tr><th>Species</th><th>Weight</th></tr></thead>\n\
+             <tbody><tr><td>Brown rat</td><td>350 g</td></tr><tr><td>Black rat</td><td>200 g</td></tr></tbody>\n\
+             </table>",
+        )
+        .build();
+    let markdown = convert_file(book.path())?;
+    assert!(markdown.contains("| Brown rat | 350 g "), "{}", markdown);
+    common::assert_golden("built-tables.md", &markdown);
+
+    let html = convert_file_with(
+        book.path(),
+        &Options {
+            gfm: false,
+            ..Options::default()
+        },
+    )?;
+    assert!(html.contains("<table>"), "{}", html);
+    Ok(())
+}
+
+#[test]
+fn test_golden_org() -> Result<()> {
+    let book = EpubBuilder::new("Rats in Org")
+        .chapter(
+            "Rats",
+            "<h1>Rats</h1>\n\
+             <p>Rats are <em>clever</em> and <strong>social</strong>; see \
+             <a href=\"https://example.com/rats\">the Rat Society</a>.<a epub:type=\"noteref\" href=\"#n1\">1</a></p>\n\
+             <h2>Counting</h2>\n\
+             <pre><code class=\"language-python\">def count(rats):\n    return len(rats)\n</code></pre>\n\
+             <table><tr><th>Species</th><th>Weight</th></tr><tr><td>Brown rat</td><td>350 g</td></tr></table>\n\
+             <aside epub:type=\"footnote\" id=\"n1\"><p>Rats can count to four.</p></aside>",
+        )
+        .build();
+    let options = Options {
+        front_matter: false,
+        toc: false,
+        heading_ids: true,
+        ..Options::default()
+    };
+    let markdown = convert_file_with(book.path(), &options)?;
+    let org = cipher::org::to_org(&cipher::read_metadata(book.path())?, &markdown);
+    assert!(org.starts_with("#+TITLE: Rats in Org\n"), "{}", org);
+    assert!(org.contains("\n* Rats\n:PROPERTIES:\n"), "{}", org);
+    assert!(org.contains("\n** Counting\n"), "{}", org);
+    assert!(org.contains("/clever/ and *social*"), "{}", org);
+    assert!(
+        org.contains("[[https://example.com/rats][the Rat Society]]"),
+        "{}",
+        org
+    );
+    assert!(
+        org.contains("#+BEGIN_SRC python\ndef count(rats):\n    return len(rats)\n#+END_SRC"),
+        "{}",
+        org
+    );
+    assert!(
+        org.contains("| Species   | Weight |\n|-----------+--------|\n| Brown rat | 350 g  |"),
+        "{}",
+        org
+    );
+    assert!(org.contains("[fn:1]"), "{}", org);
+    common::assert_golden("built-org.org", &org);
+    Ok(())
+}
+
+#[test]
+fn test_golden_keep_html() -> Result<()> {
+    let table = "<table>\n\
+                 <tr><th>Species</th><th>Weight</th></tr>\n\
+                 <tr><td rowspan=\"2\">Brown rat</td><td>350 g</td></tr>\n\
+                 <tr><td>500 g</td></tr>\n\
+                 </table>";
+    let book = EpubBuilder::new("Rats Kept Whole")
+        .chapter(
+            "Kept",
+            &format!(
+                "<h1>Kept</h1>\n{}\n\
+                 <details><summary>Diet</summary><p>Anything at all.</p></details>\n\
+                 <p>Rats drink H<sub>2</sub>O, about 10<sup>2</sup> ml a week.</p>",
+                table
+            ),
+        )
+        .build();
+    let markdown = convert_file(book.path())?;
+    assert!(markdown.contains(table), "{}", markdown);
+    assert!(
+        markdown.contains("<details><summary>Diet</summary><p>Anything at all.</p></details>"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("Rats drink H<sub>2</sub>O, about 10<sup>2</sup> ml a week."),
+        "{}",
+        markdown
+    );
+    common::assert_golden("built-keep-html.md", &markdown);
+
+    let plain = convert_file_with(
+        book.path(),
+        &Options {
+            keep_html: Vec::new(),
+            ..Options::default()
+        },
+    )?;
+    assert!(!plain.contains("<details>"), "{}", plain);
+    assert!(!plain.contains("<sub>"), "{}", plain);
+    // Pipe tables can't span rows, so the table is still kept.
+    assert!(plain.contains(table), "{}", plain);
+    Ok(())
+}
@@ -0,0 +1,89 @@
+use cipher::html::to_html;
+use cipher::{Direction, Metadata};
+
+#[test]
+fn test_to_html() {
+    let metadata = Metadata {
+        title: Some("Rats & Mice".to_string()),
+        creators: vec!["A. Rat".to_string()],
+        language: Some("en".to_string()),
+        description: Some("All about \"rats\".".to_string()),
+        ..Metadata::default()
+    };
+    let markdown = "# Part One {#part-one}\n\n## Burrows {#burrows}\n\nSee [the granary](#granary).\n\n\
+                    ## The Granary {#granary}\n\nGrain.\n\n# Part Two {#part-two}\n\n### Deep {#deep}\n";
+    let html = to_html(&metadata, markdown);
+    assert!(
+        html.starts_with("<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n"),
+        "{}",
+        html
+    );
+    assert!(
+        html.contains("<title>Rats &amp; Mice</title>\n"),
+        "{}",
+        html
+    );
+    assert!(
+        html.contains("<meta name=\"author\" content=\"A. Rat\">\n"),
+        "{}",
+        html
+    );
+    assert!(
+        html.contains("<meta name=\"description\" content=\"All about &quot;rats&quot;.\">\n"),
+        "{}",
+        html
+    );
+    assert!(html.contains("<style>\n"), "{}", html);
+    // The top two levels of headings, the second nested under the first.
+    assert!(
+        html.contains(
+            "<nav id=\"toc\">\n<ul>\n<li><a href=\"#part-one\">Part One</a>\n<ul>\n\
+             <li><a href=\"#burrows\">Burrows</a></li>\n<li><a href=\"#granary\">The Granary</a></li>\n</ul></li>\n\
+             <li><a href=\"#part-two\">Part Two</a></li>\n</ul>\n</nav>\n"
+        ),
+        "{}",
+        html
+    );
+    assert!(
+        html.contains("<h2 id=\"granary\">The Granary</h2>"),
+        "{}",
+        html
+    );
+    assert!(
+        html.contains("<a href=\"#granary\">the granary</a>"),
+        "{}",
+        html
+    );
+    assert!(html.ends_with("</main>\n</body>\n</html>\n"), "{}", html);
+}
+
+#[test]
+fn test_to_html_without_metadata() {
+    let metadata = Metadata {
+        direction: Some(Direction::Rtl),
+        ..Metadata::default()
+    };
+    let html = to_html(&metadata, "Text without headings.\n");
+    assert!(
+        html.starts_with("<!DOCTYPE html>\n<html dir=\"rtl\">\n"),
+        "{}",
+        html
+    );
+    assert!(html.contains("<title>Untitled</title>"), "{}", html);
+    assert!(!html.contains("<nav"), "{}", html);
+    assert!(
+        html.contains("<main>\n<p>Text without headings.</p>\n</main>"),
+        "{}",
+        html
+    );
+}
+
+#[test]
+fn test_to_html_definition_lists() {
+    let html = to_html(&Metadata::default(), "Rat\n:   A rodent.\n");
+    assert!(
+        html.contains("<dl>\n<dt>Rat</dt>\n<dd>A rodent.</dd>\n</dl>"),
+        "{}",
+        html
+    );
+}
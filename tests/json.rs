@@ -0,0 +1,86 @@
+use cipher::{json, Chapter, Format, Metadata};
+use serde_json::Value;
+
+fn chapter(index: usize, title: &str, markdown: &str) -> Chapter {
+    Chapter {
+        index,
+        title: title.to_string(),
+        href: format!("ch{}.xhtml", index),
+        markdown: markdown.to_string(),
+    }
+}
+
+#[test]
+fn test_to_json() {
+    let metadata = Metadata {
+        title: Some("Rats".to_string()),
+        ..Metadata::default()
+    };
+    let chapters = [
+        chapter(1, "Cover", ""),
+        chapter(3, "", "Intro\n=====\n\nText."),
+    ];
+    let book: Value = serde_json::from_str(&json::to_json(&metadata, &chapters, false)).unwrap();
+    assert_eq!(book["metadata"]["title"], "Rats");
+    assert_eq!(book["metadata"]["publisher"], Value::Null);
+    assert_eq!(
+        book["chapters"][0],
+        serde_json::json!({"index": 1, "href": "ch1.xhtml", "title": "Cover", "markdown": ""})
+    );
+    // Without a TOC title the first heading is used.
+    assert_eq!(book["chapters"][1]["index"], 3);
+    assert_eq!(book["chapters"][1]["title"], "Intro");
+    assert_eq!(book["chapters"][1]["markdown"], "Intro\n=====\n\nText.");
+    assert_eq!(book["stats"]["words"], 2);
+    assert_eq!(book["stats"]["chapters"][1]["minutes"], 1);
+    assert!(json::to_json(&metadata, &chapters, true).contains("\n  \"chapters\": ["));
+}
+
+#[test]
+fn test_to_ndjson() {
+    let chapters = [
+        chapter(1, "One", "First\nline"),
+        chapter(2, "Two", "Second"),
+    ];
+    let ndjson = json::to_ndjson(&chapters);
+    let lines: Vec<Value> = ndjson
+        .lines()
+        .map(|line| serde_json::from_str(line).unwrap())
+        .collect();
+    assert_eq!(lines.len(), 2);
+    assert_eq!(lines[0]["title"], "One");
+    assert_eq!(lines[0]["markdown"], "First\nline");
+    assert_eq!(lines[1]["index"], 2);
+    assert!(ndjson.ends_with("}\n"));
+}
+
+#[test]
+fn test_split_index_to_json() {
+    let metadata = Metadata {
+        title: Some("Rats".to_string()),
+        ..Metadata::default()
+    };
+    let chapters = [
+        chapter(1, "Cover", ""),
+        chapter(2, "", "Intro\n=====\n\nRats are rodents."),
+    ];
+    let files = ["01-cover.md".to_string(), "02-intro.md".to_string()];
+    let index: Value = serde_json::from_str(&json::split_index_to_json(
+        &metadata, &chapters, &files, false,
+    ))
+    .unwrap();
+    assert_eq!(index["metadata"]["title"], "Rats");
+    assert_eq!(
+        index["chapters"][0],
+        serde_json::json!({"index": 1, "href": "ch1.xhtml", "title": "Cover", "file": "01-cover.md", "words": 0})
+    );
+    assert_eq!(index["chapters"][1]["title"], "Intro");
+    assert_eq!(index["chapters"][1]["file"], "02-intro.md");
+    assert_eq!(index["chapters"][1]["words"], 4);
+}
+
+#[test]
+fn test_parse_json_formats() {
+    assert_eq!("json".parse::<Format>().unwrap(), Format::Json);
+    assert_eq!("ndjson".parse::<Format>().unwrap(), Format::Ndjson);
+}
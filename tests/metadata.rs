@@ -0,0 +1,54 @@
+use cipher::{Metadata, MetadataFormat};
+
+#[test]
+fn test_title_block() {
+    let metadata = Metadata {
+        title: Some("Rats".to_string()),
+        creators: vec!["Ada Lovelace".to_string(), "Charles Babbage".to_string()],
+        date: Some("1843".to_string()),
+        publisher: Some("Analytical Press".to_string()),
+        ..Metadata::default()
+    };
+    assert_eq!(
+        metadata.title_block(),
+        "% Rats\n% Ada Lovelace; Charles Babbage\n% 1843\n"
+    );
+    assert_eq!(
+        metadata.header(MetadataFormat::Pandoc),
+        metadata.title_block()
+    );
+    assert_eq!(
+        metadata.header(MetadataFormat::Yaml),
+        metadata.front_matter()
+    );
+
+    // Missing fields leave a bare %, and trailing ones aren't written.
+    let untitled = Metadata {
+        date: Some("1843".to_string()),
+        ..Metadata::default()
+    };
+    assert_eq!(untitled.title_block(), "%\n%\n% 1843\n");
+    let title = Metadata {
+        title: Some("Rats".to_string()),
+        ..Metadata::default()
+    };
+    assert_eq!(title.title_block(), "% Rats\n");
+    let publisher = Metadata {
+        publisher: Some("Analytical Press".to_string()),
+        ..Metadata::default()
+    };
+    assert_eq!(publisher.title_block(), "");
+}
+
+#[test]
+fn test_parse_metadata_format() {
+    assert_eq!(
+        "pandoc".parse::<MetadataFormat>().unwrap(),
+        MetadataFormat::Pandoc
+    );
+    assert_eq!(MetadataFormat::default(), MetadataFormat::Yaml);
+    assert_eq!(
+        "toml".parse::<MetadataFormat>().unwrap_err(),
+        "invalid metadata format toml (expected yaml or pandoc)"
+    );
+}
@@ -0,0 +1,45 @@
+use cipher::{normalize, LineEnding};
+
+#[test]
+fn test_normalize_blank_lines_and_whitespace() {
+    let markdown = "\n\n# Rats   \r\n\r\n\r\n\r\nThe brown rat. \t\n\n\n\n* one\n* two\n\n\n";
+    assert_eq!(
+        normalize(markdown, LineEnding::Lf),
+        "# Rats\n\nThe brown rat.\n\n* one\n* two\n"
+    );
+}
+
+#[test]
+fn test_normalize_keeps_hard_breaks_and_code() {
+    let markdown = "First line  \nsecond line  \n\n```\nfn main() {   \n\n\n\n}\n```\n";
+    assert_eq!(
+        normalize(markdown, LineEnding::Lf),
+        "First line  \nsecond line\n\n```\nfn main() {   \n\n\n\n}\n```\n"
+    );
+}
+
+#[test]
+fn test_normalize_line_endings() {
+    assert_eq!(
+        normalize("One\r\rTwo\nThree", LineEnding::Crlf),
+        "One\r\n\r\nTwo\r\nThree\r\n"
+    );
+    assert_eq!(
+        normalize("One\r\n\r\nTwo\r\n", LineEnding::Lf),
+        "One\n\nTwo\n"
+    );
+    assert_eq!(normalize("\n \n\t\n", LineEnding::Lf), "");
+    assert_eq!("crlf".parse::<LineEnding>(), Ok(LineEnding::Crlf));
+    assert!("cr".parse::<LineEnding>().is_err());
+}
+
+#[test]
+fn test_normalize_is_idempotent() {
+    let markdown = "Title\n=====\n\n\n\nText  \nmore\n\n~~~\n  code  \n~~~\n\n\n";
+    let once = normalize(markdown, LineEnding::Crlf);
+    assert_eq!(normalize(&once, LineEnding::Crlf), once);
+    assert_eq!(
+        normalize(&once, LineEnding::Lf),
+        normalize(markdown, LineEnding::Lf)
+    );
+}
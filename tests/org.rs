@@ -0,0 +1,124 @@
+use cipher::org::to_org;
+use cipher::Metadata;
+
+mod common;
+
+// A chapter as the converter writes it with heading ids, with each construct
+// the Org output has its own syntax for.
+const CHAPTER: &str = "\
+# Rats {#rats}
+
+Rats are *clever*, **social** and ~~dull~~ curious. See [their burrows](#burrows), the
+[Rat Society](https://example.com/rats) or [a map](map.xhtml), and run `rats --count`.[^1]
+
+![A brown rat](images/rat.png)
+
+## Burrows {#burrows}
+
+- Tunnels
+- Nests
+  - Grass
+  - Paper
+- Larders
+
+1. Dig
+2. Line the nest
+
+> Rats are never far away.
+> — Old saying
+
+```python
+* not a heading
+#+not a keyword
+def count(rats):
+    return len(rats)
+```
+
+    plain example
+
+| Species | Weight |
+| --- | ---: |
+| Brown rat | 350 g |
+| Black rat | 200 g |
+
+A line\\
+broken in two. Rats drink H<sub>2</sub>O.
+
+<details><summary>Diet</summary><p>Anything at all.</p></details>
+
+---
+
+[^1]: Rats can count to [four](https://example.com/four).
+";
+
+#[test]
+fn test_to_org() {
+    let metadata = Metadata {
+        title: Some("Rats & Mice".to_string()),
+        creators: vec!["A. Rat".to_string(), "B. Mouse".to_string()],
+        language: Some("en".to_string()),
+        ..Metadata::default()
+    };
+    let org = to_org(&metadata, CHAPTER);
+    assert!(
+        org.starts_with("#+TITLE: Rats & Mice\n#+AUTHOR: A. Rat, B. Mouse\n#+LANGUAGE: en\n\n"),
+        "{}",
+        org
+    );
+    assert!(
+        org.contains("* Rats\n:PROPERTIES:\n:CUSTOM_ID: rats\n:END:\n"),
+        "{}",
+        org
+    );
+    assert!(org.contains("** Burrows\n"), "{}", org);
+    assert!(
+        org.contains("/clever/, *social* and +dull+ curious"),
+        "{}",
+        org
+    );
+    assert!(org.contains("[[#burrows][their burrows]]"), "{}", org);
+    assert!(
+        org.contains("[[https://example.com/rats][Rat Society]]"),
+        "{}",
+        org
+    );
+    assert!(org.contains("[[file:map.xhtml][a map]]"), "{}", org);
+    assert!(org.contains("~rats --count~.[fn:1]"), "{}", org);
+    assert!(org.contains("[[file:images/rat.png]]"), "{}", org);
+    assert!(
+        org.contains("#+BEGIN_SRC python\n,* not a heading\n,#+not a keyword\ndef count"),
+        "{}",
+        org
+    );
+    assert!(
+        org.contains("#+BEGIN_EXAMPLE\nplain example\n#+END_EXAMPLE"),
+        "{}",
+        org
+    );
+    assert!(
+        org.contains("| Species   | Weight |\n|-----------+--------|\n| Brown rat | 350 g  |"),
+        "{}",
+        org
+    );
+    assert!(
+        org.contains("[fn:1] Rats can count to [[https://example.com/four][four]]."),
+        "{}",
+        org
+    );
+    common::assert_golden("org.org", &org);
+}
+
+#[test]
+fn test_to_org_without_metadata() {
+    let org = to_org(&Metadata::default(), "Text without headings.\n");
+    assert_eq!(org, "Text without headings.\n");
+}
+
+#[test]
+fn test_to_org_definition_lists() {
+    let markdown = "Rat\n:   A rodent.\n\nBurrow\n:   A hole where rats live.\n\n    Often under a shed.\n:   A tunnel.\n";
+    assert_eq!(
+        to_org(&Metadata::default(), markdown),
+        "- Rat :: A rodent.\n- Burrow :: A hole where rats live.\n\n  Often under a shed.\n\n  A tunnel.\n"
+    );
+}
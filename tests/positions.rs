@@ -0,0 +1,55 @@
+use cipher::positions::{Position, Positions};
+use std::fs;
+
+#[test]
+fn test_positions_round_trip() {
+    let dir = tempfile::tempdir().unwrap();
+    let path = dir.path().join("cipher/positions.json");
+    let mut positions = Positions::load(&path);
+    assert_eq!(positions.get("id:urn:uuid:rats"), None);
+
+    let position = Position {
+        chapter: 3,
+        scroll: 41,
+    };
+    positions.set("id:urn:uuid:rats", position);
+    positions.save().unwrap();
+    assert!(!dir.path().join("cipher/positions.json.tmp").exists());
+
+    let positions = Positions::load(&path);
+    assert_eq!(positions.get("id:urn:uuid:rats"), Some(position));
+    assert_eq!(positions.get("id:urn:uuid:mice"), None);
+}
+
+#[test]
+fn test_positions_ignore_a_broken_file() {
+    let dir = tempfile::tempdir().unwrap();
+    let path = dir.path().join("positions.json");
+    for broken in [
+        "",
+        "{\"id:a\": {\"chapter\": 1",
+        "[1, 2]",
+        "{\"id:a\": {\"chapter\": -1, \"scroll\": 0}}",
+    ] {
+        fs::write(&path, broken).unwrap();
+        assert_eq!(Positions::load(&path).get("id:a"), None, "{:?}", broken);
+    }
+
+    // Saving replaces the broken file.
+    let mut positions = Positions::load(&path);
+    positions.set(
+        "id:a",
+        Position {
+            chapter: 1,
+            scroll: 0,
+        },
+    );
+    positions.save().unwrap();
+    assert_eq!(
+        Positions::load(&path).get("id:a"),
+        Some(Position {
+            chapter: 1,
+            scroll: 0
+        })
+    );
+}
@@ -0,0 +1,134 @@
+use cipher::render::render;
+use cipher::{Color, Renderer, Style, Theme, Wrap};
+use std::fs;
+
+#[test]
+fn test_theme_names() {
+    for name in cipher::render::THEME_NAMES {
+        let theme: Theme = name.parse().unwrap();
+        assert_eq!(theme.to_string(), *name);
+    }
+}
+
+#[test]
+fn test_unknown_theme_lists_names() {
+    let err = "solarized".parse::<Theme>().unwrap_err();
+    assert!(err.contains("solarized"));
+    assert!(err.contains("auto, dark, light, notty, dracula, pink"));
+}
+
+#[test]
+fn test_render_notty_is_plain() {
+    let markdown = "Title\n==========\n\nSome *text*.";
+    assert_eq!(render(markdown, Theme::NoTty), markdown);
+}
+
+#[test]
+fn test_render_dark() {
+    let rendered = render(
+        "# Title\n\nSome **bold** and `code`.\n\n* item",
+        Theme::Dark,
+    );
+    assert!(rendered.contains('\x1b'));
+    assert!(!rendered.contains("# Title"));
+    assert!(!rendered.contains("**"));
+    assert!(rendered.contains("• item"));
+}
+
+#[test]
+fn test_color() {
+    let markdown = "# Title\n\nSome **bold** text.";
+    let renderer = Renderer::new(Theme::Dark);
+    assert_eq!(
+        renderer.clone().color(Color::Never, true).render(markdown),
+        markdown
+    );
+    assert!(renderer
+        .clone()
+        .color(Color::Always, false)
+        .render(markdown)
+        .contains('\x1b'));
+    for name in ["auto", "always", "never"] {
+        assert_eq!(name.parse::<Color>().unwrap().to_string(), name);
+    }
+    assert!("yes".parse::<Color>().is_err());
+}
+
+#[test]
+fn test_render_wrap() {
+    let markdown = "The quick brown fox jumps over the lazy dog.\n\n```\nlet code = \"stays on one line however long it is\";\n```";
+    let rendered = Renderer::new(Theme::Dark)
+        .wrap(Wrap::Width(20))
+        .render(markdown);
+    let text: Vec<&str> = rendered.lines().collect();
+    assert_eq!(
+        &text[..3],
+        &["The quick brown fox", "jumps over the lazy", "dog."]
+    );
+    assert!(rendered.contains("let code = \"stays on one line however long it is\";"));
+
+    let unwrapped = Renderer::new(Theme::Dark).wrap(Wrap::Off).render(markdown);
+    assert_eq!(unwrapped, render(markdown, Theme::Dark));
+    assert!(unwrapped.starts_with("The quick brown fox jumps over the lazy dog.\n"));
+}
+
+#[test]
+fn test_parse_wrap() {
+    assert_eq!("auto".parse::<Wrap>(), Ok(Wrap::Auto));
+    assert_eq!("0".parse::<Wrap>(), Ok(Wrap::Off));
+    assert_eq!("72".parse::<Wrap>(), Ok(Wrap::Width(72)));
+    assert!("wide".parse::<Wrap>().unwrap_err().contains("wide"));
+}
+
+#[test]
+fn test_style_file() {
+    let dir = tempfile::tempdir().unwrap();
+    let path = dir.path().join("style.json");
+    fs::write(&path, r##"{"heading": {"color": "#ff0000", "bold": true}, "code": {"color": "42"}, "document": {}}"##).unwrap();
+    let style: Style = path.to_str().unwrap().parse().unwrap();
+    let rendered = render("# Title\n\nSome `code`.", style);
+    assert!(rendered.contains("\x1b[38;2;255;0;0m"));
+    assert!(rendered.contains("\x1b[38;5;42mcode"));
+}
+
+#[test]
+fn test_invalid_style_file_names_file() {
+    let dir = tempfile::tempdir().unwrap();
+    let path = dir.path().join("broken.json");
+    fs::write(&path, "{ not json").unwrap();
+    let err = path.to_str().unwrap().parse::<Style>().unwrap_err();
+    assert!(err.contains("Failed to parse style file"));
+    assert!(err.contains("broken.json"));
+}
+
+#[test]
+fn test_unknown_style() {
+    let err = "solarized".parse::<Style>().unwrap_err();
+    assert!(err.contains("solarized"));
+    assert!(err.contains("path to a JSON style file"));
+}
+
+#[test]
+fn test_render_table() {
+    let markdown = "Before.\n\n| Species | Weight (g) |\n|:--|--:|\n| Rattus **rattus** | 200 |\n| Mus musculus | 20 |\n\nAfter.";
+    let rendered = render(markdown, Theme::Dark);
+    let plain = strip_ansi(&rendered);
+    assert!(plain.contains(
+        "Species       │ Weight (g)\n──────────────┼───────────\nRattus rattus │        200\nMus musculus  │         20\n"
+    ), "{}", plain);
+    assert!(!plain.contains('|'));
+    assert!(plain.ends_with("After.\n"));
+}
+
+fn strip_ansi(text: &str) -> String {
+    let mut out = String::new();
+    let mut chars = text.chars();
+    while let Some(c) = chars.next() {
+        if c == '\x1b' {
+            chars.by_ref().find(|c| c.is_ascii_alphabetic());
+        } else {
+            out.push(c);
+        }
+    }
+    out
+}
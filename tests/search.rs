@@ -0,0 +1,65 @@
+use cipher::{search_chapter, Chapter, Pattern, SearchOptions};
+
+fn chapter(markdown: &str) -> Chapter {
+    Chapter {
+        index: 2,
+        title: String::new(),
+        href: "ch2.xhtml".to_string(),
+        markdown: markdown.to_string(),
+    }
+}
+
+const MARKDOWN: &str = "# Habits\n\nRats are *nocturnal*.\n\nThey nest in [burrows](ch3.xhtml).\n\nBrown RATS swim well.";
+
+#[test]
+fn test_search_literal() {
+    let pattern = Pattern::new("Rats", &SearchOptions::default()).unwrap();
+    let matches = search_chapter(&chapter(MARKDOWN), &pattern, 1);
+    assert_eq!(matches.len(), 1);
+    let found = &matches[0];
+    assert_eq!(
+        (found.index, found.href.as_str(), found.title.as_str()),
+        (2, "ch2.xhtml", "Habits")
+    );
+    // Lines of the plain text: the markup is gone.
+    assert_eq!(found.line, 3);
+    assert_eq!(found.text, "Rats are nocturnal.");
+    assert_eq!(found.before, [""]);
+    assert_eq!(found.after, [""]);
+}
+
+#[test]
+fn test_search_ignore_case_and_regex() {
+    let options = SearchOptions {
+        ignore_case: true,
+        context: 0,
+        ..SearchOptions::default()
+    };
+    let pattern = Pattern::new("rats", &options).unwrap();
+    let lines: Vec<usize> = search_chapter(&chapter(MARKDOWN), &pattern, 0)
+        .iter()
+        .map(|found| found.line)
+        .collect();
+    assert_eq!(lines, [3, 7]);
+
+    let options = SearchOptions {
+        regex: true,
+        ..options
+    };
+    let pattern = Pattern::new(r"\b(nest|swim)\b", &options).unwrap();
+    let matches = search_chapter(&chapter(MARKDOWN), &pattern, 2);
+    let texts: Vec<&str> = matches.iter().map(|found| found.text.as_str()).collect();
+    assert_eq!(texts, ["They nest in burrows.", "Brown RATS swim well."]);
+    assert_eq!(matches[1].before, ["They nest in burrows.", ""]);
+    assert!(matches[1].after.is_empty());
+
+    let regex = SearchOptions {
+        regex: true,
+        ..SearchOptions::default()
+    };
+    assert!(Pattern::new("(unclosed", &regex).is_err());
+    // Without -E the same text is literal.
+    assert!(Pattern::new("(unclosed", &SearchOptions::default())
+        .unwrap()
+        .is_match("an (unclosed bracket"));
+}
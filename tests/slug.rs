@@ -0,0 +1,36 @@
+use cipher::slug::{slug, Slugger};
+
+#[test]
+fn test_slug() {
+    assert_eq!(slug("The House of Usher"), "the-house-of-usher");
+    assert_eq!(slug("Rats, Mice & Voles!"), "rats-mice--voles");
+    assert_eq!(slug("What's new? (1917)"), "whats-new-1917");
+    assert_eq!(slug("snake_case and-dashes"), "snake_case-and-dashes");
+    // Inline markup the converter writes isn't part of the anchor.
+    assert_eq!(slug("*Rattus* `norvegicus`"), "rattus-norvegicus");
+    assert_eq!(slug("[Notes](notes.xhtml)"), "notes");
+    assert_eq!(slug("1\\. Introduction"), "1-introduction");
+}
+
+#[test]
+fn test_slug_unicode() {
+    assert_eq!(slug("第一章 猫と鼠"), "第一章-猫と鼠");
+    assert_eq!(slug("Ökologie der Ratte"), "ökologie-der-ratte");
+    assert_eq!(slug("ΚΕΦΑΛΑΙΟ Α"), "κεφαλαιο-α");
+}
+
+#[test]
+fn test_slugger_duplicates() {
+    let mut slugger = Slugger::default();
+    assert_eq!(slugger.next("Notes"), "notes");
+    assert_eq!(slugger.next("Notes"), "notes-1");
+    assert_eq!(slugger.next("NOTES"), "notes-2");
+    assert_eq!(slugger.next("Chapter One"), "chapter-one");
+
+    // A heading whose own anchor looks like a suffixed one doesn't clash.
+    let mut slugger = Slugger::default();
+    assert_eq!(slugger.next("Notes"), "notes");
+    assert_eq!(slugger.next("Notes 1"), "notes-1");
+    assert_eq!(slugger.next("Notes"), "notes-2");
+    assert_eq!(slugger.next("Notes 1"), "notes-1-1");
+}
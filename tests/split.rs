@@ -0,0 +1,255 @@
+use anyhow::Result;
+use cipher::split::{
+    chapter_filenames, chapter_files, file_names, slugify, NameContext, NameTemplate,
+};
+use cipher::{convert_to_dir, Chapter, LineEnding};
+use std::fs;
+
+fn chapter(title: &str, markdown: &str) -> Chapter {
+    Chapter {
+        index: 0,
+        title: title.to_string(),
+        href: String::new(),
+        markdown: markdown.to_string(),
+    }
+}
+
+#[test]
+fn test_slugify() {
+    assert_eq!(slugify("The House of Usher"), "the-house-of-usher");
+    assert_eq!(slugify("  RAT-PROOF BUILDING. "), "rat-proof-building");
+    assert_eq!(slugify("FARMERS’ BULLETIN 896"), "farmers-bulletin-896");
+    assert_eq!(slugify("!!!"), "");
+}
+
+#[test]
+fn test_chapter_filenames() {
+    let chapters = vec![
+        chapter("Cover", ""),
+        chapter("ignored", "The House of Usher\n==========\n\ntext"),
+        chapter("", "### Notes ###"),
+    ];
+    assert_eq!(
+        chapter_filenames(&chapters),
+        vec!["01-cover.md", "02-the-house-of-usher.md", "03-notes.md"]
+    );
+}
+
+#[test]
+fn test_chapter_filenames_safe() {
+    let long = "A very long opening sentence that the book has set as its heading, ".repeat(4);
+    let chapters = vec![
+        chapter("Rats/Mice: A Comparison", ""),
+        chapter("", &format!("# {}", long)),
+        chapter("Überschrift", ""),
+        chapter("Rats/Mice: A Comparison", ""),
+    ];
+    let names = chapter_filenames(&chapters);
+    assert_eq!(names[0], "01-rats-mice-a-comparison.md");
+    assert_eq!(
+        names[1],
+        "02-a-very-long-opening-sentence-that-the-book-has-set-as-its.md"
+    );
+    assert_eq!(names[2], "03-überschrift.md");
+    assert_eq!(names[3], "04-rats-mice-a-comparison.md");
+    for name in &names {
+        assert!(
+            !name.contains(['/', '\\', ':', '<', '>', '"', '|', '?', '*']),
+            "{}",
+            name
+        );
+        assert!(name.len() <= 70, "{}", name);
+    }
+}
+
+#[test]
+fn test_convert_to_dir() -> Result<()> {
+    let dir = tempfile::tempdir()?;
+    let paths = convert_to_dir("testdata/pg35542.epub", dir.path())?;
+    assert_eq!(paths.len(), 5);
+
+    let index = fs::read_to_string(dir.path().join("index.md"))?;
+    for path in &paths[..4] {
+        let name = path.file_name().unwrap().to_str().unwrap();
+        assert!(
+            index.contains(&format!("]({})", name)),
+            "index.md missing {}",
+            name
+        );
+    }
+    Ok(())
+}
+
+#[test]
+fn test_split_links() -> Result<()> {
+    let dir = tempfile::tempdir()?;
+    convert_to_dir("testdata/links.epub", dir.path())?;
+
+    let first = fs::read_to_string(dir.path().join("01-chapter-one.md"))?;
+    assert!(first.contains("[the second section](02-chapter-two.md#the-second-section)"));
+    assert!(first.contains("[in chapter two](02-chapter-two.md)"));
+    assert!(first.contains("[the notes below](#notes)"));
+    let second = fs::read_to_string(dir.path().join("02-chapter-two.md"))?;
+    assert!(second.contains("[the start](01-chapter-one.md#chapter-one)"));
+    assert!(second.contains("[these notes](#notes)"));
+    Ok(())
+}
+
+#[test]
+fn test_split_links_across_book() -> Result<()> {
+    let dir = tempfile::tempdir()?;
+    convert_to_dir("testdata/cross-links.epub", dir.path())?;
+
+    let first = fs::read_to_string(dir.path().join("01-chapter-one.md"))?;
+    assert!(
+        first.contains("[the second section of chapter five](05-chapter-five.md#where-rats-live)")
+    );
+    assert!(first.contains("[the editor](mailto:editor@example.com)"));
+    assert!(first.contains("[the website](http://example.com/chapter5.xhtml#section2)"));
+    assert!(!first.contains("](chapter5.xhtml"));
+    Ok(())
+}
+
+#[test]
+fn test_split_links_to_parts() {
+    // A chapter cut in two, both parts under its href.
+    let chapters = vec![
+        Chapter {
+            href: "rats.xhtml".to_string(),
+            ..chapter(
+                "Rats",
+                "# Rats\n\nSee [burrows](#burrows) and [the start](#rats).\n\n",
+            )
+        },
+        Chapter {
+            href: "rats.xhtml".to_string(),
+            ..chapter(
+                "Rats (part 2)",
+                "## Burrows\n\nBack to [the start](#rats).\n",
+            )
+        },
+        Chapter {
+            href: "mice.xhtml".to_string(),
+            ..chapter(
+                "Mice",
+                "# Mice\n\nUnlike [rats](rats.xhtml) in [burrows](rats.xhtml#burrows).\n",
+            )
+        },
+    ];
+    let names = chapter_filenames(&chapters);
+    let files = chapter_files(&chapters, &names, LineEnding::Lf);
+    assert!(
+        files[0]
+            .1
+            .contains("[burrows](02-burrows.md#burrows) and [the start](#rats)"),
+        "{}",
+        files[0].1
+    );
+    assert!(
+        files[1].1.contains("[the start](01-rats.md#rats)"),
+        "{}",
+        files[1].1
+    );
+    assert!(
+        files[2]
+            .1
+            .contains("[rats](01-rats.md) in [burrows](02-burrows.md#burrows)"),
+        "{}",
+        files[2].1
+    );
+}
+
+#[test]
+fn test_name_template() -> Result<()> {
+    let chapters = vec![
+        Chapter {
+            index: 2,
+            href: "text/ch01.xhtml".to_string(),
+            ..chapter("Rats / Mice: A \"Study\"?", "# The House of Usher\n\ntext")
+        },
+        Chapter {
+            index: 3,
+            ..chapter("Notes", "")
+        },
+    ];
+    let book = NameContext {
+        book_title: "Rats: Collected".to_string(),
+        idrefs: vec!["cover".to_string(), "ch1".to_string(), "notes".to_string()],
+    };
+    let names = |template: &str| file_names(&chapters, Some(&template.parse().unwrap()), &book);
+    assert_eq!(
+        names("{index:03}_{slug}.md")?,
+        vec!["001_the-house-of-usher.md", "002_notes.md"]
+    );
+    // Characters a file name can't hold become -.
+    assert_eq!(
+        names("{{{index}}} {title} ({href}).md")?,
+        vec!["{1} Rats - Mice- A -Study-- (ch01).md", "{2} Notes ().md"]
+    );
+    assert_eq!(
+        names("{book_title} {idref}.md")?,
+        vec!["Rats- Collected ch1.md", "Rats- Collected notes.md"]
+    );
+    // Without a template the names are the usual ones.
+    assert_eq!(
+        file_names(&chapters, None, &NameContext::default())?,
+        chapter_filenames(&chapters)
+    );
+    Ok(())
+}
+
+#[test]
+fn test_invalid_name_template() {
+    for (template, reason) in [
+        ("{index", "{index isn't closed"),
+        (
+            "{chapter}.md",
+            "unknown field {chapter}; expected index, title, slug, href, idref or book_title",
+        ),
+        (
+            "{index:3}.md",
+            "the width in {index:3} isn't a 0 followed by a number, as in 03",
+        ),
+        ("{slug:02}.md", "only {index} takes a width, not {slug}"),
+        ("a}.md", "a } without its {; write }} for a brace"),
+        ("part1/{slug}.md", "'/' can't be part of a file name"),
+        ("{slug}?.md", "'?' can't be part of a file name"),
+    ] {
+        let err = template.parse::<NameTemplate>().unwrap_err();
+        assert_eq!(
+            err,
+            format!("invalid file name template {} ({})", template, reason)
+        );
+    }
+}
+
+#[test]
+fn test_name_template_collisions() {
+    // Without {index}, chapters with the same title get the same name, so
+    // the later ones are numbered.
+    let chapters = vec![
+        chapter("Notes", ""),
+        chapter("Notes", ""),
+        chapter("Notes", ""),
+        chapter("Notes 2", ""),
+    ];
+    let book = NameContext::default();
+    let template: NameTemplate = "{slug}.md".parse().unwrap();
+    let names = file_names(&chapters, Some(&template), &book).unwrap();
+    assert_eq!(
+        names,
+        ["notes.md", "notes-2.md", "notes-3.md", "notes-2-2.md"]
+    );
+    let template: NameTemplate = "{slug}".parse().unwrap();
+    assert_eq!(
+        file_names(&chapters[..2], Some(&template), &book).unwrap(),
+        ["notes", "notes-2"]
+    );
+
+    let template: NameTemplate = "index.md".parse().unwrap();
+    let err = file_names(&chapters[..1], Some(&template), &book).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "File name template index.md names chapter 1 index.md, which the index uses"
+    );
+}
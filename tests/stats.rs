@@ -0,0 +1,81 @@
+use cipher::{reading_minutes, word_count, BookStats, Chapter};
+
+fn chapter(index: usize, title: &str, markdown: &str) -> Chapter {
+    Chapter {
+        index,
+        title: title.to_string(),
+        href: format!("ch{}.xhtml", index),
+        markdown: markdown.to_string(),
+    }
+}
+
+#[test]
+fn test_word_count() {
+    assert_eq!(word_count(""), 0);
+    assert_eq!(word_count("# The Harbour\n\nShips came and went."), 6);
+    assert_eq!(word_count("* one\n* two\n\n---\n\n1. three"), 3);
+}
+
+#[test]
+fn test_word_count_skips_code_and_urls() {
+    let markdown = "Read [the guide](https://example.com/a/very/long/path) first.\n\n\
+                    ```\nfn main() { println!(\"not counted\"); }\n```\n\n\
+                    ![A map](images/map.png) and `code`.";
+    assert_eq!(word_count(markdown), 8);
+}
+
+#[test]
+fn test_reading_minutes() {
+    assert_eq!(reading_minutes(0), 0);
+    assert_eq!(reading_minutes(1), 1);
+    assert_eq!(reading_minutes(200), 1);
+    assert_eq!(reading_minutes(201), 2);
+}
+
+#[test]
+fn test_book_stats() {
+    let words = "word ".repeat(250);
+    let chapters = [
+        chapter(1, "Cover", ""),
+        chapter(2, "", &format!("Intro\n=====\n\n{}", words)),
+    ];
+    let stats = BookStats::new(&chapters);
+    assert_eq!(stats.words, 251);
+    assert_eq!(stats.minutes, 2);
+    assert_eq!(stats.chapters[1].title, "Intro");
+    assert_eq!(stats.characters, 1255);
+    assert_eq!(stats.words_per_minute, 200);
+    assert_eq!(
+        stats.table(),
+        concat!(
+            "    #  words  chars  images  min  chapter\n",
+            "    1      0      0       0    0  Cover\n",
+            "    2    251   1255       0    2  Intro\n",
+            "total    251   1255       0    2  at 200 words a minute\n",
+        )
+    );
+}
+
+#[test]
+fn test_book_stats_counts() {
+    let markdown = "# Maps\n\n![A map](images/map.png) of *the* harbour.\n\n\
+                    ```\n![not an image](x.png)\n```\n\n\
+                    <table><tr><td><img src=\"images/key.png\"/></td></tr></table>";
+    let chapters = [
+        chapter(1, "Maps", markdown),
+        chapter(2, "More", &"word ".repeat(300)),
+    ];
+    let stats = BookStats::with_words_per_minute(&chapters, 100);
+    assert_eq!(stats.chapters[0].images, 2);
+    // "Maps A map of the harbour."
+    assert_eq!(stats.chapters[0].characters, 26);
+    assert_eq!(stats.chapters[1].minutes, 3);
+    assert_eq!(
+        (stats.images, stats.minutes, stats.words_per_minute),
+        (2, 4, 100)
+    );
+
+    let json: serde_json::Value = serde_json::from_str(&stats.to_json(false)).unwrap();
+    assert_eq!(json["words_per_minute"], 100);
+    assert_eq!(json["chapters"][1]["words"], 300);
+}
@@ -0,0 +1,71 @@
+use cipher::text::to_text;
+use cipher::Format;
+
+#[test]
+fn test_text_headings_and_paragraphs() {
+    let markdown = "---\ntitle: \"Rats\"\n---\n\n# Rats\n\nFirst paragraph\nstill first.\n\n\n\nSecond\n======\n\n---\n\nThird.";
+    assert_eq!(
+        to_text(markdown),
+        "Rats\n\nFirst paragraph\nstill first.\n\nSecond\n\nThird.\n"
+    );
+}
+
+#[test]
+fn test_text_links() {
+    let markdown =
+        "See [the appendix](appendix.xhtml#notes) and [*Rattus*](https://example.com/(rats)).";
+    assert_eq!(to_text(markdown), "See the appendix and Rattus.\n");
+}
+
+#[test]
+fn test_text_emphasis() {
+    let markdown = "Rats are *very* social and **must not** be kept alone, says __one__ _source_.\n\n\
+                    Name cages like cage\\_one or cage_two; feed 5\\*2 blocks and use `code *as is*`.";
+    assert_eq!(
+        to_text(markdown),
+        "Rats are very social and must not be kept alone, says one source.\n\n\
+         Name cages like cage_one or cage_two; feed 5*2 blocks and use code *as is*.\n"
+    );
+    assert_eq!(
+        to_text("The ~~old~~ new cage, ~ 2m wide."),
+        "The old new cage, ~ 2m wide.\n"
+    );
+}
+
+#[test]
+fn test_text_lists() {
+    let markdown =
+        "* Fresh vegetables\n  * Kale\n+ Lab blocks\n\n1. Clean the cage\n2. Refill the water";
+    assert_eq!(
+        to_text(markdown),
+        "- Fresh vegetables\n- Kale\n- Lab blocks\n\n- Clean the cage\n- Refill the water\n"
+    );
+}
+
+#[test]
+fn test_text_images() {
+    let markdown = "![A brown rat](images/rat.png)\n\n![](images/divider.png)\n\nText [![icon](i.png)](page.xhtml) after.";
+    assert_eq!(to_text(markdown), "A brown rat\n\nText icon after.\n");
+}
+
+#[test]
+fn test_text_quotes_tables_code_and_notes() {
+    let markdown = "> Quoted *text*\n\n| Name | Age |\n|------|----:|\n| Rex | 2 |\n\n```\nlet *x* = 1;\n```\n\nA claim[^1].\n\n[^1]: The *source*.";
+    assert_eq!(
+        to_text(markdown),
+        "Quoted text\n\nName\tAge\nRex\t2\n\nlet *x* = 1;\n\nA claim[1].\n\n[1] The source.\n"
+    );
+}
+
+#[test]
+fn test_parse_format() {
+    assert_eq!("md".parse::<Format>().unwrap(), Format::Markdown);
+    assert_eq!("txt".parse::<Format>().unwrap(), Format::Text);
+    assert_eq!("ansi".parse::<Format>().unwrap(), Format::Ansi);
+    assert_eq!("html".parse::<Format>().unwrap(), Format::Html);
+    assert_eq!("org".parse::<Format>().unwrap(), Format::Org);
+    assert!("pdf"
+        .parse::<Format>()
+        .unwrap_err()
+        .contains("expected md, txt, ansi, json, ndjson, html or org"));
+}
@@ -0,0 +1,96 @@
+use cipher::{normalize_typography, Typography};
+
+fn ascii(markdown: &str) -> String {
+    normalize_typography(markdown, &Typography::default())
+}
+
+fn smart(markdown: &str) -> String {
+    normalize_typography(markdown, &Typography::default().smart(true))
+}
+
+#[test]
+fn test_typography_to_ascii() {
+    assert_eq!(
+        ascii("“Rats,” she said — it’s true – mostly."),
+        "\"Rats,\" she said --- it's true -- mostly."
+    );
+    assert_eq!(
+        ascii("gnaw\u{ad}ing rat\u{200b}catcher\u{feff}"),
+        "gnawing ratcatcher"
+    );
+    assert_eq!(
+        ascii("10\u{a0}kg and\u{a0}\u{a0} \u{a0}more"),
+        "10 kg and more"
+    );
+    // Joiners change how the text is shown.
+    assert_eq!(
+        ascii("👩\u{200d}🔬 and می\u{200c}خواهم"),
+        "👩\u{200d}🔬 and می\u{200c}خواهم"
+    );
+}
+
+#[test]
+fn test_typography_smart() {
+    assert_eq!(
+        smart("\"Rats,\" she said --- it's true -- mostly."),
+        "“Rats,” she said — it’s true – mostly."
+    );
+    assert_eq!(smart("*\"So\"* ('quite') right"), "*“So”* (‘quite’) right");
+    assert_eq!(smart("a - b ---- c"), "a - b ---- c");
+}
+
+#[test]
+fn test_typography_keeps_code() {
+    let markdown = "Say “hi”:\n\n```sh\necho \"it’s\u{ad} --- ok\"\u{a0}\u{a0}\n```\n\n> ~~~\n> a – b\n> ~~~\n";
+    assert_eq!(
+        ascii(markdown),
+        "Say \"hi\":\n\n```sh\necho \"it’s\u{ad} --- ok\"\u{a0}\u{a0}\n```\n\n> ~~~\n> a – b\n> ~~~\n"
+    );
+    assert_eq!(
+        ascii("Use `“x” — y` or ``a`“b”`` — “z”"),
+        "Use `“x” — y` or ``a`“b”`` --- \"z\""
+    );
+    assert_eq!(
+        smart("Run `grep -- \"x\"` or \"y\""),
+        "Run `grep -- \"x\"` or “y”"
+    );
+    // An unmatched backtick is literal and only protects itself.
+    assert_eq!(ascii("a ` “b”"), "a ` \"b\"");
+}
+
+#[test]
+fn test_typography_keeps_markup() {
+    assert_eq!(
+        smart("[\"Rats\"](ch1.xhtml#a--b \"Title\")"),
+        "[“Rats”](ch1.xhtml#a--b \"Title\")"
+    );
+    assert_eq!(
+        smart("<td class=\"x\">'a'</td> <!-- x -->"),
+        "<td class=\"x\">‘a’</td> <!-- x -->"
+    );
+    assert_eq!(smart("5\\-\\-2 \\\"x\\\""), "5\\-\\-2 \\\"x\\\"");
+    for markup in [
+        "---",
+        "Title\n=====",
+        "| a | b |\n| --- | :-: |",
+        "> ---",
+        "—",
+    ] {
+        assert_eq!(smart(markup), markup);
+        assert_eq!(ascii(markup), markup);
+    }
+}
+
+#[test]
+fn test_typography_parse() {
+    assert_eq!("all".parse::<Typography>(), Ok(Typography::default()));
+    let typography: Typography = "hyphens,zero-width".parse().unwrap();
+    assert!(typography.soft_hyphens && typography.zero_width);
+    assert!(!typography.quotes && !typography.dashes && !typography.spaces);
+    assert_eq!(typography.to_string(), "hyphens,zero-width");
+    assert_eq!(
+        normalize_typography("“shy\u{ad}ly”", &typography),
+        "“shyly”"
+    );
+    assert!("quotes,ligatures".parse::<Typography>().is_err());
+}